@@ -212,5 +212,55 @@ fn bench_insert_batch(c: &mut Criterion) {
     group.finish();
 }
 
-criterion_group!(insert_benches, bench_insert_single, bench_insert_batch);
+/// The same documents sent as one `insertMany` (a multi-row INSERT per 1000 documents) and
+/// as one `insert` command per document.
+fn bench_insert_many_vs_per_row(c: &mut Criterion) {
+    let rt = tokio::runtime::Runtime::new().unwrap();
+
+    let mut group = c.benchmark_group("insert_many_vs_per_row");
+    group.measurement_time(Duration::from_secs(20));
+    group.sample_size(10);
+
+    for count in [1_000usize, 10_000] {
+        group.bench_with_input(BenchmarkId::new("insert_many", count), &count, |b, &n| {
+            b.iter_batched(
+                || (BenchContext::new(DocumentSize::Medium), 2i32),
+                |(ctx, mut req_id)| {
+                    let response = rt.block_on(async {
+                        let mut stream = TcpStream::connect(ctx.addr).await.unwrap();
+                        ctx.insert_batch(n, &mut stream, &mut req_id).await
+                    });
+                    black_box(response);
+                },
+                criterion::BatchSize::PerIteration,
+            );
+        });
+        group.bench_with_input(BenchmarkId::new("per_row", count), &count, |b, &n| {
+            b.iter_batched(
+                || (BenchContext::new(DocumentSize::Medium), 2i32),
+                |(ctx, mut req_id)| {
+                    rt.block_on(async {
+                        let mut stream = TcpStream::connect(ctx.addr).await.unwrap();
+                        for _ in 0..n {
+                            let response = ctx
+                                .insert_single(DocumentSize::Medium, &mut stream, &mut req_id)
+                                .await;
+                            black_box(response);
+                        }
+                    });
+                },
+                criterion::BatchSize::PerIteration,
+            );
+        });
+    }
+
+    group.finish();
+}
+
+criterion_group!(
+    insert_benches,
+    bench_insert_single,
+    bench_insert_batch,
+    bench_insert_many_vs_per_row
+);
 criterion_main!(insert_benches);
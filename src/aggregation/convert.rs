@@ -0,0 +1,364 @@
+//! Type conversion for `$convert` and its `$toInt`, `$toString`, ... shorthands.
+//!
+//! The rules follow MongoDB: numbers convert between each other as long as the value fits
+//! (doubles truncate toward zero, NaN and out-of-range values are errors), strings must parse
+//! completely, booleans are `0`/`1`, and dates are milliseconds since the epoch. Decimals go
+//! through their exact string form, so no precision is lost on the way in or out. Null and
+//! missing inputs never reach [`convert`]; the caller answers them (`onNull`).
+
+use bson::{Bson, Decimal128, oid::ObjectId};
+
+/// Target type of a conversion.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ConvertTarget {
+    Double,
+    String,
+    ObjectId,
+    Bool,
+    Date,
+    Int,
+    Long,
+    Decimal,
+}
+
+impl ConvertTarget {
+    /// Target named by a `to` value: a type alias (`"int"`) or its numeric code (`16`).
+    pub fn from_bson(to: &Bson) -> Option<Self> {
+        if matches!(to, Bson::Array(_)) {
+            return None;
+        }
+        match crate::bson_type::parse_type_spec(to)?.first().copied()? {
+            "double" => Some(ConvertTarget::Double),
+            "string" => Some(ConvertTarget::String),
+            "objectId" => Some(ConvertTarget::ObjectId),
+            "bool" => Some(ConvertTarget::Bool),
+            "date" => Some(ConvertTarget::Date),
+            "int" => Some(ConvertTarget::Int),
+            "long" => Some(ConvertTarget::Long),
+            "decimal" => Some(ConvertTarget::Decimal),
+            _ => None,
+        }
+    }
+
+    fn alias(self) -> &'static str {
+        match self {
+            ConvertTarget::Double => "double",
+            ConvertTarget::String => "string",
+            ConvertTarget::ObjectId => "objectId",
+            ConvertTarget::Bool => "bool",
+            ConvertTarget::Date => "date",
+            ConvertTarget::Int => "int",
+            ConvertTarget::Long => "long",
+            ConvertTarget::Decimal => "decimal",
+        }
+    }
+}
+
+/// Convert a non-null `value` to `target`.
+pub fn convert(value: &Bson, target: ConvertTarget) -> anyhow::Result<Bson> {
+    let unsupported = || {
+        anyhow::anyhow!(
+            "Unsupported conversion from {} to {}",
+            crate::bson_type::alias_of(value),
+            target.alias()
+        )
+    };
+    match target {
+        ConvertTarget::Double => to_double(value)?.map(Bson::Double).ok_or_else(unsupported),
+        ConvertTarget::Long => to_long(value)?.map(Bson::Int64).ok_or_else(unsupported),
+        ConvertTarget::Int => {
+            if matches!(value, Bson::DateTime(_)) {
+                return Err(unsupported());
+            }
+            let n = to_long(value)?.ok_or_else(unsupported)?;
+            i32::try_from(n)
+                .map(Bson::Int32)
+                .map_err(|_| anyhow::anyhow!("Conversion would overflow target type"))
+        }
+        ConvertTarget::Decimal => to_decimal(value)?
+            .map(Bson::Decimal128)
+            .ok_or_else(unsupported),
+        ConvertTarget::String => to_string(value).map(Bson::String).ok_or_else(unsupported),
+        ConvertTarget::Bool => Ok(Bson::Boolean(to_bool(value))),
+        ConvertTarget::Date => to_date(value)?.map(Bson::DateTime).ok_or_else(unsupported),
+        ConvertTarget::ObjectId => match value {
+            Bson::ObjectId(oid) => Ok(Bson::ObjectId(*oid)),
+            Bson::String(s) => ObjectId::parse_str(s)
+                .map(Bson::ObjectId)
+                .map_err(|_| anyhow::anyhow!("Failed to parse objectId '{}'", s)),
+            _ => Err(unsupported()),
+        },
+    }
+}
+
+fn parse_failure(s: &str) -> anyhow::Error {
+    anyhow::anyhow!("Failed to parse number '{}'", s)
+}
+
+fn parse_decimal(s: &str) -> anyhow::Result<Decimal128> {
+    s.parse::<Decimal128>().map_err(|_| parse_failure(s))
+}
+
+fn decimal_to_f64(d: &Decimal128) -> f64 {
+    // Display gives "1.5", "1.5E+20", "NaN" or "Infinity", all of which f64 parses
+    d.to_string().parse::<f64>().unwrap_or(f64::NAN)
+}
+
+/// Truncate a double toward zero, rejecting NaN, infinities and values outside the int64
+/// range.
+fn truncate_to_i64(f: f64) -> anyhow::Result<i64> {
+    if f.is_nan() {
+        return Err(anyhow::anyhow!(
+            "Attempt to convert NaN value to integer type"
+        ));
+    }
+    if f.is_infinite() {
+        return Err(anyhow::anyhow!(
+            "Attempt to convert infinity value to integer type"
+        ));
+    }
+    let t = f.trunc();
+    // 2^63 is exactly representable, i64::MAX is not
+    if t < -9_223_372_036_854_775_808.0 || t >= 9_223_372_036_854_775_808.0 {
+        return Err(anyhow::anyhow!("Conversion would overflow target type"));
+    }
+    Ok(t as i64)
+}
+
+fn to_double(value: &Bson) -> anyhow::Result<Option<f64>> {
+    Ok(Some(match value {
+        Bson::Double(f) => *f,
+        Bson::Int32(n) => *n as f64,
+        Bson::Int64(n) => *n as f64,
+        Bson::Decimal128(d) => decimal_to_f64(d),
+        Bson::Boolean(b) => *b as i32 as f64,
+        Bson::DateTime(dt) => dt.timestamp_millis() as f64,
+        Bson::String(s) => s.parse::<f64>().map_err(|_| parse_failure(s))?,
+        _ => return Ok(None),
+    }))
+}
+
+fn to_long(value: &Bson) -> anyhow::Result<Option<i64>> {
+    Ok(Some(match value {
+        Bson::Int32(n) => *n as i64,
+        Bson::Int64(n) => *n,
+        Bson::Double(f) => truncate_to_i64(*f)?,
+        // Integral decimals parse exactly; anything else truncates like a double
+        Bson::Decimal128(d) => {
+            let s = d.to_string();
+            match s.parse::<i64>() {
+                Ok(n) => n,
+                Err(_) => truncate_to_i64(decimal_to_f64(d))?,
+            }
+        }
+        Bson::Boolean(b) => *b as i64,
+        Bson::DateTime(dt) => dt.timestamp_millis(),
+        Bson::String(s) => s.parse::<i64>().map_err(|_| parse_failure(s))?,
+        _ => return Ok(None),
+    }))
+}
+
+fn to_decimal(value: &Bson) -> anyhow::Result<Option<Decimal128>> {
+    let digits = match value {
+        Bson::Decimal128(d) => return Ok(Some(*d)),
+        Bson::Int32(n) => n.to_string(),
+        Bson::Int64(n) => n.to_string(),
+        Bson::Double(f) if f.is_nan() => "NaN".to_string(),
+        Bson::Double(f) if f.is_infinite() => {
+            (if *f > 0.0 { "Infinity" } else { "-Infinity" }).to_string()
+        }
+        // The shortest representation that reads back as the same double
+        Bson::Double(f) => format!("{:E}", f),
+        Bson::Boolean(b) => (*b as i32).to_string(),
+        Bson::DateTime(dt) => dt.timestamp_millis().to_string(),
+        Bson::String(s) => s.clone(),
+        _ => return Ok(None),
+    };
+    parse_decimal(&digits).map(Some)
+}
+
+fn to_string(value: &Bson) -> Option<String> {
+    Some(match value {
+        Bson::String(s) => s.clone(),
+        Bson::Int32(n) => n.to_string(),
+        Bson::Int64(n) => n.to_string(),
+        Bson::Double(f) if f.is_infinite() => {
+            (if *f > 0.0 { "Infinity" } else { "-Infinity" }).to_string()
+        }
+        Bson::Double(f) => f.to_string(),
+        Bson::Decimal128(d) => d.to_string(),
+        Bson::Boolean(b) => b.to_string(),
+        Bson::ObjectId(oid) => oid.to_hex(),
+        Bson::DateTime(dt) => format_date(dt.timestamp_millis()),
+        _ => return None,
+    })
+}
+
+/// Numbers are true unless zero; every other non-null value, even an empty string, is true.
+fn to_bool(value: &Bson) -> bool {
+    match value {
+        Bson::Boolean(b) => *b,
+        Bson::Int32(n) => *n != 0,
+        Bson::Int64(n) => *n != 0,
+        Bson::Double(f) => *f != 0.0,
+        Bson::Decimal128(d) => decimal_to_f64(d) != 0.0,
+        _ => true,
+    }
+}
+
+fn to_date(value: &Bson) -> anyhow::Result<Option<bson::DateTime>> {
+    let millis = match value {
+        Bson::DateTime(dt) => return Ok(Some(*dt)),
+        Bson::ObjectId(oid) => return Ok(Some(oid.timestamp())),
+        Bson::String(s) => return parse_date(s).map(Some),
+        Bson::Int64(n) => *n,
+        Bson::Double(f) => truncate_to_i64(*f)?,
+        Bson::Decimal128(_) => to_long(value)?.unwrap_or_default(),
+        Bson::Timestamp(ts) => ts.time as i64 * 1000,
+        _ => return Ok(None),
+    };
+    Ok(Some(bson::DateTime::from_millis(millis)))
+}
+
+/// Parse an ISO-8601 date string; a bare `YYYY-MM-DD` is midnight UTC.
+fn parse_date(s: &str) -> anyhow::Result<bson::DateTime> {
+    let full = if s.len() == 10 {
+        format!("{}T00:00:00Z", s)
+    } else {
+        s.to_string()
+    };
+    bson::DateTime::parse_rfc3339_str(&full)
+        .map_err(|_| anyhow::anyhow!("Error parsing date string '{}'", s))
+}
+
+/// `YYYY-MM-DDTHH:MM:SS.mmmZ`, the form MongoDB prints dates in.
+fn format_date(millis: i64) -> String {
+    use crate::aggregation::dates::{DAY_MS, civil_from_days};
+    let (year, month, day) = civil_from_days(millis.div_euclid(DAY_MS));
+    let ms = millis.rem_euclid(DAY_MS);
+    format!(
+        "{:04}-{:02}-{:02}T{:02}:{:02}:{:02}.{:03}Z",
+        year,
+        month,
+        day,
+        ms / 3_600_000,
+        ms / 60_000 % 60,
+        ms / 1000 % 60,
+        ms % 1000
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn conv(value: Bson, target: ConvertTarget) -> anyhow::Result<Bson> {
+        convert(&value, target)
+    }
+
+    #[test]
+    fn targets_by_alias_and_code() {
+        assert_eq!(
+            ConvertTarget::from_bson(&Bson::String("long".into())),
+            Some(ConvertTarget::Long)
+        );
+        assert_eq!(
+            ConvertTarget::from_bson(&Bson::Int32(19)),
+            Some(ConvertTarget::Decimal)
+        );
+        assert_eq!(
+            ConvertTarget::from_bson(&Bson::String("array".into())),
+            None
+        );
+        assert_eq!(ConvertTarget::from_bson(&Bson::String("nope".into())), None);
+    }
+
+    #[test]
+    fn integers_truncate_and_reject_overflow() {
+        use ConvertTarget::*;
+        assert_eq!(conv(Bson::Double(-2.9), Int).unwrap(), Bson::Int32(-2));
+        assert_eq!(
+            conv(Bson::String("42".into()), Int).unwrap(),
+            Bson::Int32(42)
+        );
+        assert_eq!(conv(Bson::Boolean(true), Long).unwrap(), Bson::Int64(1));
+        assert_eq!(
+            conv(Bson::Int64(1 << 40), Long).unwrap(),
+            Bson::Int64(1 << 40)
+        );
+
+        let err = conv(Bson::Double(1e10), Int).unwrap_err();
+        assert!(err.to_string().contains("overflow"), "{}", err);
+        assert!(conv(Bson::Int64(1 << 40), Int).is_err());
+        assert!(conv(Bson::Double(1e19), Long).is_err());
+        assert!(conv(Bson::Double(f64::NAN), Long).is_err());
+        assert!(conv(Bson::String("2.5".into()), Int).is_err());
+        assert!(conv(Bson::DateTime(bson::DateTime::from_millis(5)), Int).is_err());
+        assert_eq!(
+            conv(Bson::DateTime(bson::DateTime::from_millis(5)), Long).unwrap(),
+            Bson::Int64(5)
+        );
+    }
+
+    #[test]
+    fn decimals_keep_every_digit() {
+        use ConvertTarget::*;
+        let digits = "1.000000000000000000000000000001";
+        let dec = conv(Bson::String(digits.into()), Decimal).unwrap();
+        assert_eq!(
+            conv(dec.clone(), String).unwrap(),
+            Bson::String(digits.into())
+        );
+        assert_eq!(conv(dec, Int).unwrap(), Bson::Int32(1));
+
+        // 2^53 + 1 has no double representation
+        let big = conv(Bson::Int64(9_007_199_254_740_993), Decimal).unwrap();
+        assert_eq!(
+            conv(big.clone(), String).unwrap(),
+            Bson::String("9007199254740993".into())
+        );
+        assert_eq!(conv(big, Long).unwrap(), Bson::Int64(9_007_199_254_740_993));
+
+        let half = conv(Bson::Double(2.5), Decimal).unwrap();
+        assert_eq!(conv(half, Double).unwrap(), Bson::Double(2.5));
+        assert!(conv(Bson::String("abc".into()), Decimal).is_err());
+    }
+
+    #[test]
+    fn strings_bools_and_dates() {
+        use ConvertTarget::*;
+        assert_eq!(
+            conv(Bson::Double(2.0), String).unwrap(),
+            Bson::String("2".into())
+        );
+        assert_eq!(
+            conv(Bson::Boolean(false), String).unwrap(),
+            Bson::String("false".into())
+        );
+        assert_eq!(
+            conv(Bson::String(std::string::String::new()), Bool).unwrap(),
+            Bson::Boolean(true)
+        );
+        assert_eq!(conv(Bson::Int64(0), Bool).unwrap(), Bson::Boolean(false));
+
+        let date = bson::DateTime::from_millis(1_522_169_931_538);
+        assert_eq!(
+            conv(Bson::DateTime(date), String).unwrap(),
+            Bson::String("2018-03-27T16:58:51.538Z".into())
+        );
+        assert_eq!(
+            conv(Bson::String("2018-03-27T16:58:51.538Z".into()), Date).unwrap(),
+            Bson::DateTime(date)
+        );
+        assert_eq!(
+            conv(Bson::String("1969-12-31".into()), Date).unwrap(),
+            Bson::DateTime(bson::DateTime::from_millis(-86_400_000))
+        );
+        assert_eq!(
+            conv(Bson::DateTime(bson::DateTime::from_millis(-1)), String).unwrap(),
+            Bson::String("1969-12-31T23:59:59.999Z".into())
+        );
+        assert!(conv(Bson::Int32(5), Date).is_err());
+        assert!(conv(Bson::String("not a date".into()), Date).is_err());
+    }
+}
@@ -0,0 +1,371 @@
+//! Calendar arithmetic for date expressions (`$dateAdd`, `$dateSubtract`, `$dateDiff`).
+//!
+//! Dates are milliseconds since the Unix epoch on the proleptic Gregorian calendar. Units of
+//! a day or longer step the calendar of the expression's timezone, so adding a day across a
+//! DST change keeps the wall-clock time; hours and shorter units are fixed durations. Month
+//! steps clamp the day to the end of a shorter month as MongoDB does: January 31 plus one
+//! month is February 28, or 29 in a leap year.
+//!
+//! Differences count the unit boundaries crossed between two dates, not elapsed time divided
+//! by the unit length: December 31 to January 1 is one year.
+
+use crate::aggregation::timezone::Timezone;
+use bson::Bson;
+
+pub const DAY_MS: i64 = 86_400_000;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum DateUnit {
+    Year,
+    Quarter,
+    Month,
+    Week,
+    Day,
+    Hour,
+    Minute,
+    Second,
+    Millisecond,
+}
+
+impl DateUnit {
+    pub fn parse(s: &str) -> Option<Self> {
+        Some(match s {
+            "year" => DateUnit::Year,
+            "quarter" => DateUnit::Quarter,
+            "month" => DateUnit::Month,
+            "week" => DateUnit::Week,
+            "day" => DateUnit::Day,
+            "hour" => DateUnit::Hour,
+            "minute" => DateUnit::Minute,
+            "second" => DateUnit::Second,
+            "millisecond" => DateUnit::Millisecond,
+            _ => return None,
+        })
+    }
+
+    /// Length of the units that are fixed durations.
+    fn fixed_ms(self) -> Option<i64> {
+        match self {
+            DateUnit::Hour => Some(3_600_000),
+            DateUnit::Minute => Some(60_000),
+            DateUnit::Second => Some(1000),
+            DateUnit::Millisecond => Some(1),
+            _ => None,
+        }
+    }
+}
+
+/// Days of the week as `$dateDiff`'s `startOfWeek` spells them, Sunday first.
+const WEEKDAYS: [&str; 7] = [
+    "sunday",
+    "monday",
+    "tuesday",
+    "wednesday",
+    "thursday",
+    "friday",
+    "saturday",
+];
+
+/// Index from Sunday of a `startOfWeek` day name, full or three-letter, in any case.
+pub fn parse_weekday(s: &str) -> Option<i64> {
+    let s = s.to_ascii_lowercase();
+    WEEKDAYS
+        .iter()
+        .position(|d| *d == s || (s.len() == 3 && d.starts_with(&s)))
+        .map(|i| i as i64)
+}
+
+/// Milliseconds since the epoch of a date operand: a date, a timestamp or an ObjectId.
+pub fn date_millis(v: &Bson) -> Option<i64> {
+    match v {
+        Bson::DateTime(d) => Some(d.timestamp_millis()),
+        Bson::Timestamp(ts) => Some(ts.time as i64 * 1000),
+        Bson::ObjectId(oid) => Some(oid.timestamp().timestamp_millis()),
+        _ => None,
+    }
+}
+
+/// `date_ms` moved by `amount` units, in the calendar of `tz`; `None` when the result does
+/// not fit a BSON date.
+pub fn date_add(date_ms: i64, unit: DateUnit, amount: i64, tz: &Timezone) -> Option<i64> {
+    if let Some(ms) = unit.fixed_ms() {
+        return date_ms.checked_add(amount.checked_mul(ms)?);
+    }
+    let local = tz.to_local(date_ms);
+    let days = local.div_euclid(DAY_MS);
+    let time = local.rem_euclid(DAY_MS);
+    let new_days = match unit {
+        DateUnit::Day => days.checked_add(amount)?,
+        DateUnit::Week => days.checked_add(amount.checked_mul(7)?)?,
+        _ => {
+            let months = amount.checked_mul(match unit {
+                DateUnit::Year => 12,
+                DateUnit::Quarter => 3,
+                _ => 1,
+            })?;
+            let (year, month, day) = civil_from_days(days);
+            let total = (year * 12 + month - 1).checked_add(months)?;
+            let (year, month) = (total.div_euclid(12), total.rem_euclid(12) + 1);
+            // Keep the year range where day counts stay far from overflowing
+            if year.abs() > 300_000_000 {
+                return None;
+            }
+            days_from_civil(year, month, day.min(days_in_month(year, month)))
+        }
+    };
+    let local = new_days.checked_mul(DAY_MS)?.checked_add(time)?;
+    Some(tz.to_utc(local))
+}
+
+/// Number of `unit` boundaries crossed going from `start_ms` to `end_ms`, negative when the
+/// end is earlier. Days and longer units are counted in the calendar of `tz`, with weeks
+/// starting on `start_of_week` (0 for Sunday). Shorter units are counted on boundaries
+/// aligned to the start's local time, so an hour across a DST change is still an hour.
+pub fn date_diff(
+    start_ms: i64,
+    end_ms: i64,
+    unit: DateUnit,
+    tz: &Timezone,
+    start_of_week: i64,
+) -> i64 {
+    if let Some(ms) = unit.fixed_ms() {
+        let offset = tz.offset_ms(start_ms);
+        let start = start_ms.saturating_add(offset);
+        let end = end_ms.saturating_add(offset);
+        return end.div_euclid(ms) - start.div_euclid(ms);
+    }
+    let start = tz.to_local(start_ms).div_euclid(DAY_MS);
+    let end = tz.to_local(end_ms).div_euclid(DAY_MS);
+    match unit {
+        DateUnit::Day => end - start,
+        // 1970-01-01 was a Thursday, day 4 counting from Sunday
+        DateUnit::Week => {
+            let week = |days: i64| (days + 4 - start_of_week).div_euclid(7);
+            week(end) - week(start)
+        }
+        _ => {
+            let (months_per_unit, (y1, m1, _), (y2, m2, _)) = (
+                match unit {
+                    DateUnit::Year => 12,
+                    DateUnit::Quarter => 3,
+                    _ => 1,
+                },
+                civil_from_days(start),
+                civil_from_days(end),
+            );
+            let index = |y: i64, m: i64| (y * 12 + m - 1).div_euclid(months_per_unit);
+            index(y2, m2) - index(y1, m1)
+        }
+    }
+}
+
+/// Proleptic Gregorian (year, month, day) of a count of days since 1970-01-01.
+pub fn civil_from_days(days: i64) -> (i64, i64, i64) {
+    let z = days + 719_468;
+    let era = z.div_euclid(146_097);
+    let doe = z.rem_euclid(146_097);
+    let yoe = (doe - doe / 1460 + doe / 36_524 - doe / 146_096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = doy - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = yoe + era * 400 + i64::from(month <= 2);
+    (year, month, day)
+}
+
+/// Days since 1970-01-01 of a proleptic Gregorian date.
+pub fn days_from_civil(year: i64, month: i64, day: i64) -> i64 {
+    let y = if month <= 2 { year - 1 } else { year };
+    let era = y.div_euclid(400);
+    let yoe = y.rem_euclid(400);
+    let mp = if month > 2 { month - 3 } else { month + 9 };
+    let doy = (153 * mp + 2) / 5 + day - 1;
+    let doe = yoe * 365 + yoe / 4 - yoe / 100 + doy;
+    era * 146_097 + doe - 719_468
+}
+
+pub fn is_leap_year(year: i64) -> bool {
+    year % 4 == 0 && (year % 100 != 0 || year % 400 == 0)
+}
+
+pub fn days_in_month(year: i64, month: i64) -> i64 {
+    match month {
+        2 if is_leap_year(year) => 29,
+        2 => 28,
+        4 | 6 | 9 | 11 => 30,
+        _ => 31,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn ms(year: i64, month: i64, day: i64, hour: i64, minute: i64) -> i64 {
+        days_from_civil(year, month, day) * DAY_MS + hour * 3_600_000 + minute * 60_000
+    }
+
+    #[test]
+    fn civil_round_trips() {
+        for days in [-719_468, -1, 0, 59, 11_016, 19_782, 2_932_896] {
+            let (y, m, d) = civil_from_days(days);
+            assert_eq!(days_from_civil(y, m, d), days);
+        }
+        assert_eq!(civil_from_days(19_782), (2024, 2, 29));
+    }
+
+    #[test]
+    fn months_clamp_to_month_end() {
+        let utc = Timezone::UTC;
+        let jan31 = ms(2024, 1, 31, 12, 0);
+        assert_eq!(
+            date_add(jan31, DateUnit::Month, 1, &utc),
+            Some(ms(2024, 2, 29, 12, 0))
+        );
+        assert_eq!(
+            date_add(ms(2023, 1, 31, 12, 0), DateUnit::Month, 1, &utc),
+            Some(ms(2023, 2, 28, 12, 0))
+        );
+        // Leap day plus a year lands on February 28, minus four years on a leap day again
+        let leap = ms(2024, 2, 29, 0, 0);
+        assert_eq!(
+            date_add(leap, DateUnit::Year, 1, &utc),
+            Some(ms(2025, 2, 28, 0, 0))
+        );
+        assert_eq!(
+            date_add(leap, DateUnit::Year, -4, &utc),
+            Some(ms(2020, 2, 29, 0, 0))
+        );
+        assert_eq!(
+            date_add(ms(2024, 11, 30, 0, 0), DateUnit::Quarter, 1, &utc),
+            Some(ms(2025, 2, 28, 0, 0))
+        );
+        assert_eq!(
+            date_add(ms(2024, 3, 31, 0, 0), DateUnit::Month, -1, &utc),
+            Some(ms(2024, 2, 29, 0, 0))
+        );
+    }
+
+    #[test]
+    fn days_keep_wall_clock_across_fixed_offsets() {
+        let tz = Timezone::Fixed(-5 * 3600);
+        // 2024-03-09T23:00-05:00 plus a day is 2024-03-10T23:00-05:00
+        let start = ms(2024, 3, 10, 4, 0);
+        assert_eq!(
+            date_add(start, DateUnit::Day, 1, &tz),
+            Some(ms(2024, 3, 11, 4, 0))
+        );
+        // In UTC the same instant is already March 10, and a month later is April 10
+        assert_eq!(
+            date_add(start, DateUnit::Month, 1, &Timezone::UTC),
+            Some(ms(2024, 4, 10, 4, 0))
+        );
+        assert_eq!(
+            date_add(start, DateUnit::Month, 1, &tz),
+            Some(ms(2024, 4, 10, 4, 0))
+        );
+        assert_eq!(date_add(i64::MAX - 10, DateUnit::Hour, 1, &tz), None);
+        assert_eq!(date_add(0, DateUnit::Year, i64::MAX / 2, &tz), None);
+    }
+
+    #[test]
+    fn month_diffs_count_boundaries() {
+        let utc = Timezone::UTC;
+        let diff = |a: i64, b: i64, unit| date_diff(a, b, unit, &utc, 0);
+        // A day apart but across a month boundary
+        assert_eq!(
+            diff(ms(2024, 1, 31, 0, 0), ms(2024, 2, 1, 0, 0), DateUnit::Month),
+            1
+        );
+        // Almost two months apart, still one boundary
+        assert_eq!(
+            diff(
+                ms(2024, 1, 1, 0, 0),
+                ms(2024, 2, 29, 23, 59),
+                DateUnit::Month
+            ),
+            1
+        );
+        assert_eq!(
+            diff(
+                ms(2024, 3, 31, 0, 0),
+                ms(2024, 2, 29, 0, 0),
+                DateUnit::Month
+            ),
+            -1
+        );
+        assert_eq!(
+            diff(
+                ms(2023, 12, 31, 23, 59),
+                ms(2024, 1, 1, 0, 0),
+                DateUnit::Year
+            ),
+            1
+        );
+        assert_eq!(
+            diff(
+                ms(2024, 3, 31, 0, 0),
+                ms(2024, 4, 1, 0, 0),
+                DateUnit::Quarter
+            ),
+            1
+        );
+        assert_eq!(
+            diff(
+                ms(2024, 1, 1, 0, 0),
+                ms(2024, 3, 31, 0, 0),
+                DateUnit::Quarter
+            ),
+            0
+        );
+        // Before the epoch the month index keeps counting down
+        assert_eq!(
+            diff(
+                ms(1969, 11, 15, 0, 0),
+                ms(1970, 2, 1, 0, 0),
+                DateUnit::Month
+            ),
+            3
+        );
+        // 30 minutes across a UTC midnight is one day in UTC and none in UTC-05:00
+        let (a, b) = (ms(2024, 1, 1, 23, 45), ms(2024, 1, 2, 0, 15));
+        assert_eq!(diff(a, b, DateUnit::Day), 1);
+        assert_eq!(
+            date_diff(a, b, DateUnit::Day, &Timezone::Fixed(-5 * 3600), 0),
+            0
+        );
+        assert_eq!(diff(a, b, DateUnit::Hour), 1);
+        assert_eq!(diff(a, b, DateUnit::Minute), 30);
+    }
+
+    #[test]
+    fn week_diffs_follow_start_of_week() {
+        let utc = Timezone::UTC;
+        // 2024-01-06 is a Saturday, 2024-01-07 a Sunday and 2024-01-08 a Monday
+        let (sat, sun, mon) = (
+            ms(2024, 1, 6, 12, 0),
+            ms(2024, 1, 7, 12, 0),
+            ms(2024, 1, 8, 12, 0),
+        );
+        assert_eq!(date_diff(sat, sun, DateUnit::Week, &utc, 0), 1);
+        assert_eq!(date_diff(sat, mon, DateUnit::Week, &utc, 0), 1);
+        assert_eq!(date_diff(sat, sun, DateUnit::Week, &utc, 1), 0);
+        assert_eq!(date_diff(sat, mon, DateUnit::Week, &utc, 1), 1);
+        assert_eq!(date_diff(sun, mon, DateUnit::Week, &utc, 1), 1);
+        // Thirteen days inside two Sunday-started weeks is one boundary, not 13 / 7 rounded
+        assert_eq!(
+            date_diff(
+                ms(2024, 1, 7, 0, 0),
+                ms(2024, 1, 20, 0, 0),
+                DateUnit::Week,
+                &utc,
+                0
+            ),
+            1
+        );
+        assert_eq!(date_diff(mon, sat, DateUnit::Week, &utc, 0), -1);
+        assert_eq!(parse_weekday("Mon"), Some(1));
+        assert_eq!(parse_weekday("SATURDAY"), Some(6));
+        assert_eq!(parse_weekday("mo"), None);
+    }
+}
@@ -1,8 +1,13 @@
 use crate::aggregation::memory::MemoryManager;
 use crate::aggregation::pipeline::{Pipeline, Stage};
-use crate::store::PgStore;
-use bson::{Bson, Document};
+use crate::aggregation::stages::union_with;
+use crate::store::{Collation, PgStore};
+use bson::{Bson, Document, doc};
 use std::collections::HashMap;
+use std::time::{Duration, Instant};
+
+/// Most documents a pipeline the engine runs reads from its collection.
+pub const ENGINE_READ_LIMIT: i64 = 100_000;
 
 /// Execution context for pipeline
 pub struct ExecContext<'a> {
@@ -11,34 +16,41 @@ pub struct ExecContext<'a> {
     pub coll: String,
     pub memory: MemoryManager,
     pub vars: HashMap<String, Bson>,
+    /// Collation from the aggregate command, applied to the leading `$match` and to `$sort`.
+    pub collation: Option<Collation>,
 }
 
 impl<'a> ExecContext<'a> {
     pub fn new(pg: Option<&'a PgStore>, db: String, coll: String, allow_disk_use: bool) -> Self {
-        Self {
-            pg,
-            db,
-            coll,
-            memory: MemoryManager::new(allow_disk_use),
-            vars: HashMap::new(),
-        }
+        Self::with_vars(pg, db, coll, allow_disk_use, HashMap::new())
     }
 
+    /// Context with the command's `let` variables. `$$NOW` is fixed here, once per command,
+    /// unless `vars` already carries it from an enclosing pipeline.
     pub fn with_vars(
         pg: Option<&'a PgStore>,
         db: String,
         coll: String,
         allow_disk_use: bool,
-        vars: HashMap<String, Bson>,
+        mut vars: HashMap<String, Bson>,
     ) -> Self {
+        vars.entry(crate::aggregation::expr::NOW_VAR.to_string())
+            .or_insert_with(|| Bson::DateTime(bson::DateTime::now()));
         Self {
             pg,
             db,
             coll,
             memory: MemoryManager::new(allow_disk_use),
             vars,
+            collation: None,
         }
     }
+
+    /// Bound the memory blocking stages may use without `allowDiskUse`.
+    pub fn with_memory_limit(mut self, limit_bytes: usize) -> Self {
+        self.memory = MemoryManager::with_limit(limit_bytes, self.memory.allow_disk_use());
+        self
+    }
 }
 
 /// Execution result
@@ -56,6 +68,127 @@ pub struct WriteStats {
     pub deleted_count: i64,
 }
 
+/// A pipeline PostgreSQL can answer in one query: an optional leading `$match`, then an
+/// optional `$sort`, then any run of `$skip` and `$limit` stages, folded into one `OFFSET`
+/// and `LIMIT`.
+#[derive(Debug, Default, PartialEq)]
+pub struct PushdownQuery {
+    pub filter: Option<Document>,
+    pub sort: Option<Document>,
+    pub skip: i64,
+    pub limit: Option<i64>,
+}
+
+/// The single query equivalent to `stages`, or `None` if any stage needs the engine.
+pub fn pushdown_query(stages: &[Stage]) -> Option<PushdownQuery> {
+    let mut query = PushdownQuery::default();
+    let mut rest = stages;
+    if let [Stage::Match(filter), tail @ ..] = rest {
+        if filter.contains_key("$text")
+            || !crate::translate::expr_filters_translate(filter)
+            || crate::json_schema::in_filter(filter)
+        {
+            return None;
+        }
+        query.filter = Some(filter.clone());
+        rest = tail;
+    }
+    if let [Stage::Sort(spec), tail @ ..] = rest {
+        query.sort = Some(spec.clone());
+        rest = tail;
+    }
+    for stage in rest {
+        match stage {
+            // Skipping after a limit eats into what the limit lets through
+            Stage::Skip(n) => {
+                query.skip = query.skip.saturating_add(*n);
+                query.limit = query.limit.map(|l| l.saturating_sub(*n).max(0));
+            }
+            Stage::Limit(n) => query.limit = Some(query.limit.map_or(*n, |l| l.min(*n))),
+            _ => return None,
+        }
+    }
+    Some(query)
+}
+
+/// The query a pipeline reads its collection with and how many leading stages it answers:
+/// all of them when the pipeline pushes down, else the leading `$match` (and, with
+/// `allowDiskUse`, a `$sort` after it) or none. `None` when the pipeline starts from
+/// another source, such as `$geoNear`, `$sample` or `$documents`.
+pub fn source_query(stages: &[Stage], allow_disk_use: bool) -> Option<(PushdownQuery, usize)> {
+    if let Some(query) = pushdown_query(stages) {
+        return Some((query, stages.len()));
+    }
+    let read = PushdownQuery {
+        limit: Some(ENGINE_READ_LIMIT),
+        ..Default::default()
+    };
+    let unions_in_sql = |pipeline: &[Stage]| union_with::match_only_filter(pipeline).is_some();
+    match stages {
+        [Stage::Match(filter), ..] if filter.contains_key("$text") => None,
+        // An `$expr` SQL cannot express, or a `$jsonSchema`, is evaluated over the whole
+        // collection
+        [Stage::Match(filter), ..]
+            if !crate::translate::expr_filters_translate(filter)
+                || crate::json_schema::in_filter(filter) =>
+        {
+            Some((read, 0))
+        }
+        [Stage::Match(filter), rest @ ..] => match rest.first() {
+            Some(Stage::Sample(_)) => None,
+            Some(Stage::UnionWith { pipeline, .. }) if unions_in_sql(pipeline) => None,
+            Some(Stage::Sort(spec)) if allow_disk_use => Some((
+                PushdownQuery {
+                    filter: Some(filter.clone()),
+                    sort: Some(spec.clone()),
+                    ..read
+                },
+                2,
+            )),
+            _ => Some((
+                PushdownQuery {
+                    filter: Some(filter.clone()),
+                    ..read
+                },
+                1,
+            )),
+        },
+        [
+            Stage::GeoNear(_)
+            | Stage::Sample(_)
+            | Stage::IndexStats
+            | Stage::CollStats(_)
+            | Stage::Documents(_)
+            | Stage::CurrentOp,
+            ..,
+        ] => None,
+        [Stage::UnionWith { pipeline, .. }, ..] if unions_in_sql(pipeline) => None,
+        [Stage::Sort(spec), ..] if allow_disk_use => Some((
+            PushdownQuery {
+                sort: Some(spec.clone()),
+                ..read
+            },
+            1,
+        )),
+        _ => Some((read, 0)),
+    }
+}
+
+/// What one step of [`execute_pipeline_profiled`] did. A step usually runs one stage; a
+/// stage run together with the next, like `$match` then `$sample` in one query, counts
+/// both in `fused`.
+#[derive(Debug, Clone)]
+pub struct StageProfile {
+    /// Position of the step's first stage in the pipeline
+    pub index: usize,
+    /// Stages the step ran
+    pub fused: usize,
+    /// Documents the step passed on
+    pub n_returned: usize,
+    /// Wall-clock time, including reading the collection when the step did
+    pub elapsed: Duration,
+}
+
 /// Document stream trait for lazy evaluation
 #[allow(dead_code)]
 trait DocumentStream {
@@ -66,39 +199,177 @@ trait DocumentStream {
 pub async fn execute_pipeline(
     ctx: &ExecContext<'_>,
     pipeline: Pipeline,
+) -> anyhow::Result<ExecResult> {
+    execute_pipeline_profiled(ctx, pipeline, None).await
+}
+
+/// [`execute_pipeline`], recording each step's output size and time in `profile`.
+pub async fn execute_pipeline_profiled(
+    ctx: &ExecContext<'_>,
+    pipeline: Pipeline,
+    mut profile: Option<&mut Vec<StageProfile>>,
 ) -> anyhow::Result<ExecResult> {
     let mut docs: Vec<Document> = Vec::new();
     let mut main_coll_fetched = false;
+    // The `$match` conditions so far, which a positional `$project` (`field.$`) reads
+    let mut match_filter: Option<Document> = None;
 
-    for stage in pipeline.stages {
-        // Fetch collection if not yet fetched and this is not a $match/$geoNear stage
+    let total = pipeline.stages.len();
+    let mut stages = pipeline.stages.into_iter().peekable();
+    // A step is recorded when the next one starts, once the stages it ran are known
+    let mut step: Option<(usize, Instant)> = None;
+    while let Some(stage) = stages.next() {
+        if let Some(profile) = profile.as_deref_mut() {
+            let index = total - stages.len() - 1;
+            record_step(profile, step.take(), index, docs.len());
+            step = Some((index, Instant::now()));
+        }
+        // Fetch collection if not yet fetched and this is not a $match/$geoNear/$sample stage
         if !main_coll_fetched
-            && !matches!(stage, Stage::Match(_) | Stage::GeoNear(_))
+            && !matches!(
+                stage,
+                Stage::Match(_)
+                    | Stage::GeoNear(_)
+                    | Stage::Sample(_)
+                    | Stage::IndexStats
+                    | Stage::CollStats(_)
+                    | Stage::Documents(_)
+                    | Stage::CurrentOp
+            )
             && let Some(pg) = ctx.pg
         {
+            // With allowDiskUse a leading $sort becomes ORDER BY, so PostgreSQL sorts and
+            // spills past work_mem instead of OxideDB buffering the collection
+            if let Stage::Sort(spec) = &stage
+                && ctx.memory.allow_disk_use()
+            {
+                docs = pg
+                    .find_docs_collated(
+                        &ctx.db,
+                        &ctx.coll,
+                        None,
+                        Some(spec),
+                        None,
+                        ENGINE_READ_LIMIT,
+                        ctx.collation.as_ref(),
+                    )
+                    .await?;
+                main_coll_fetched = true;
+                continue;
+            }
+            // A leading $unionWith whose pipeline only filters reads both collections in
+            // one UNION ALL query
+            if let Stage::UnionWith {
+                coll: other,
+                pipeline: union_pipeline,
+            } = &stage
+                && let Some(other_filter) = union_with::match_only_filter(union_pipeline)
+            {
+                docs = pg
+                    .union_all_docs(
+                        &ctx.db,
+                        &[
+                            (ctx.coll.as_str(), None),
+                            (other.as_str(), other_filter.as_ref()),
+                        ],
+                        ENGINE_READ_LIMIT,
+                        ctx.collation.as_ref(),
+                    )
+                    .await?;
+                main_coll_fetched = true;
+                continue;
+            }
             docs = pg
-                .find_docs(&ctx.db, &ctx.coll, None, None, None, 100_000)
+                .find_docs(&ctx.db, &ctx.coll, None, None, None, ENGINE_READ_LIMIT)
                 .await?;
             main_coll_fetched = true;
         }
 
         match stage {
             Stage::Match(filter) => {
+                let filter = crate::aggregation::expr::bind_filter_vars(&filter, &ctx.vars);
+                // An `$expr` SQL cannot express, or a `$jsonSchema`, is evaluated here, over
+                // the whole collection
+                if !main_coll_fetched
+                    && (!crate::translate::expr_filters_translate(&filter)
+                        || crate::json_schema::in_filter(&filter))
+                    && let Some(pg) = ctx.pg
+                {
+                    docs = pg
+                        .find_docs(&ctx.db, &ctx.coll, None, None, None, ENGINE_READ_LIMIT)
+                        .await?;
+                    main_coll_fetched = true;
+                }
                 if !main_coll_fetched {
-                    // First match - fetch from collection with filter
+                    // First match - fetch from collection with filter, sampling in SQL
+                    // when it is directly followed by $sample
                     if let Some(pg) = ctx.pg {
-                        docs = pg
-                            .find_docs(&ctx.db, &ctx.coll, Some(&filter), None, None, 100_000)
-                            .await?;
+                        if let Some(&Stage::Sample(size)) = stages.peek() {
+                            stages.next();
+                            docs = pg
+                                .sample_docs(&ctx.db, &ctx.coll, Some(&filter), size as i64)
+                                .await?;
+                        } else if let Some(Stage::UnionWith {
+                            coll: other,
+                            pipeline: union_pipeline,
+                        }) = stages.peek()
+                            && let Some(other_filter) =
+                                union_with::match_only_filter(union_pipeline)
+                        {
+                            let other = other.clone();
+                            stages.next();
+                            docs = pg
+                                .union_all_docs(
+                                    &ctx.db,
+                                    &[
+                                        (ctx.coll.as_str(), Some(&filter)),
+                                        (other.as_str(), other_filter.as_ref()),
+                                    ],
+                                    ENGINE_READ_LIMIT,
+                                    ctx.collation.as_ref(),
+                                )
+                                .await?;
+                        } else {
+                            let sort = match stages.peek() {
+                                Some(Stage::Sort(spec)) if ctx.memory.allow_disk_use() => {
+                                    let spec = spec.clone();
+                                    stages.next();
+                                    Some(spec)
+                                }
+                                _ => None,
+                            };
+                            docs = pg
+                                .find_docs_collated(
+                                    &ctx.db,
+                                    &ctx.coll,
+                                    Some(&filter),
+                                    sort.as_ref(),
+                                    None,
+                                    ENGINE_READ_LIMIT,
+                                    ctx.collation.as_ref(),
+                                )
+                                .await?;
+                        }
                         main_coll_fetched = true;
                     }
                 } else {
                     // Filter existing docs
                     docs.retain(|d| document_matches_filter(d, &filter));
                 }
+                match_filter = Some(match match_filter.take() {
+                    Some(prev) => doc! {"$and": [prev, filter]},
+                    None => filter,
+                });
             }
             Stage::Project(spec) => {
-                docs = crate::aggregation::stages::project::execute(docs, &spec, &ctx.vars)?;
+                use crate::aggregation::stages::project;
+                docs = match project::split_positional(&spec)? {
+                    Some((spec, field)) => {
+                        let docs = project::execute(docs, &spec, &ctx.vars)?;
+                        project::apply_positional(docs, &field, match_filter.as_ref())?
+                    }
+                    None => project::execute(docs, &spec, &ctx.vars)?,
+                };
             }
             Stage::AddFields(spec) => {
                 docs = crate::aggregation::stages::add_fields::execute(docs, &spec, &ctx.vars)?;
@@ -124,7 +395,12 @@ pub async fn execute_pipeline(
                 )?;
             }
             Stage::Sort(spec) => {
-                docs = crate::aggregation::stages::sort::execute(docs, &spec)?;
+                ctx.memory.check_blocking("$sort", &docs)?;
+                docs = crate::aggregation::stages::sort::execute_with_collation(
+                    docs,
+                    &spec,
+                    ctx.collation.as_ref(),
+                )?;
             }
             Stage::Limit(n) => {
                 docs = crate::aggregation::stages::limit::execute(docs, n)?;
@@ -136,6 +412,7 @@ pub async fn execute_pipeline(
                 docs = crate::aggregation::stages::count::execute(docs, &field)?;
             }
             Stage::Group { id, accumulators } => {
+                ctx.memory.check_blocking("$group", &docs)?;
                 docs = crate::aggregation::stages::group::execute(
                     docs,
                     &id,
@@ -149,6 +426,7 @@ pub async fn execute_pipeline(
                 default,
                 output,
             } => {
+                ctx.memory.check_blocking("$bucket", &docs)?;
                 docs = crate::aggregation::stages::bucket::execute(
                     docs,
                     &group_by,
@@ -164,6 +442,7 @@ pub async fn execute_pipeline(
                 granularity,
                 output,
             } => {
+                ctx.memory.check_blocking("$bucketAuto", &docs)?;
                 docs = crate::aggregation::stages::bucket_auto::execute(
                     docs,
                     &group_by,
@@ -210,7 +489,15 @@ pub async fn execute_pipeline(
                 )?;
             }
             Stage::Sample(size) => {
-                docs = crate::aggregation::stages::sample::execute(docs, size)?;
+                if !main_coll_fetched && let Some(pg) = ctx.pg {
+                    // Leading $sample is pushed down to PostgreSQL
+                    docs = pg
+                        .sample_docs(&ctx.db, &ctx.coll, None, size as i64)
+                        .await?;
+                    main_coll_fetched = true;
+                } else {
+                    docs = crate::aggregation::stages::sample::execute(docs, size)?;
+                }
             }
             Stage::Facet(facets) => {
                 docs = crate::aggregation::stages::facet::execute(docs, &facets, &ctx.vars)?;
@@ -234,12 +521,36 @@ pub async fn execute_pipeline(
             Stage::GeoNear(spec) => {
                 if let Some(pg) = ctx.pg {
                     docs = crate::aggregation::stages::geo_near::execute(
-                        docs, pg, &ctx.db, &ctx.coll, &spec,
+                        pg, &ctx.db, &ctx.coll, &spec,
+                    )
+                    .await?;
+                    main_coll_fetched = true;
+                }
+            }
+            Stage::CollStats(spec) => {
+                if let Some(pg) = ctx.pg {
+                    docs = crate::aggregation::stages::coll_stats::execute(
+                        pg, &ctx.db, &ctx.coll, &spec,
                     )
                     .await?;
                     main_coll_fetched = true;
                 }
             }
+            Stage::IndexStats => {
+                if let Some(pg) = ctx.pg {
+                    docs = crate::aggregation::stages::index_stats::execute(pg, &ctx.db, &ctx.coll)
+                        .await?;
+                    main_coll_fetched = true;
+                }
+            }
+            Stage::GraphLookup(spec) => {
+                if let Some(pg) = ctx.pg {
+                    docs = crate::aggregation::stages::graph_lookup::execute(
+                        docs, pg, &ctx.db, &spec, &ctx.vars,
+                    )
+                    .await?;
+                }
+            }
             Stage::Out(target_coll) => {
                 if let Some(pg) = ctx.pg {
                     let stats =
@@ -257,9 +568,11 @@ pub async fn execute_pipeline(
                 }
             }
             Stage::SortByCount(expr) => {
+                ctx.memory.check_blocking("$sortByCount", &docs)?;
                 docs = crate::aggregation::stages::sort_by_count::execute(docs, &expr, &ctx.vars)?;
             }
             Stage::SetWindowFields(spec) => {
+                ctx.memory.check_blocking("$setWindowFields", &docs)?;
                 docs =
                     crate::aggregation::stages::set_window_fields::execute(docs, &spec, &ctx.vars)?;
             }
@@ -272,12 +585,40 @@ pub async fn execute_pipeline(
             Stage::Redact(expr) => {
                 docs = crate::aggregation::stages::redact::execute(docs, &expr, &ctx.vars)?;
             }
+            Stage::Documents(spec) => {
+                docs = crate::aggregation::stages::documents::execute(&spec, &ctx.vars)?;
+                main_coll_fetched = true;
+            }
+            Stage::CurrentOp => {
+                return Err(anyhow::anyhow!(
+                    "$currentOp must be run against the 'admin' database with {{aggregate: 1}}"
+                ));
+            }
         }
     }
+    if let Some(profile) = profile {
+        record_step(profile, step, total, docs.len());
+    }
 
     Ok(ExecResult::Cursor(docs))
 }
 
+fn record_step(
+    profile: &mut Vec<StageProfile>,
+    step: Option<(usize, Instant)>,
+    end: usize,
+    n_returned: usize,
+) {
+    if let Some((index, started)) = step {
+        profile.push(StageProfile {
+            index,
+            fused: end - index,
+            n_returned,
+            elapsed: started.elapsed(),
+        });
+    }
+}
+
 /// Check if document matches filter (simplified)
 #[allow(clippy::collapsible_if)]
 pub(crate) fn document_matches_filter(doc: &Document, filter: &Document) -> bool {
@@ -312,6 +653,17 @@ pub(crate) fn document_matches_filter(doc: &Document, filter: &Document) -> bool
                         }
                     }
                 }
+                "$nor" => {
+                    if let Bson::Array(arr) = value {
+                        for cond in arr {
+                            if let Bson::Document(cond_doc) = cond {
+                                if document_matches_filter(doc, cond_doc) {
+                                    return false;
+                                }
+                            }
+                        }
+                    }
+                }
                 "$not" => {
                     if let Bson::Document(cond_doc) = value {
                         if document_matches_filter(doc, cond_doc) {
@@ -319,6 +671,18 @@ pub(crate) fn document_matches_filter(doc: &Document, filter: &Document) -> bool
                         }
                     }
                 }
+                "$expr" => {
+                    if !crate::aggregation::expr::matches_expr(doc, value) {
+                        return false;
+                    }
+                }
+                "$jsonSchema" => {
+                    if let Bson::Document(schema) = value {
+                        if !crate::json_schema::matches(doc, schema) {
+                            return false;
+                        }
+                    }
+                }
                 _ => {}
             }
         } else {
@@ -416,6 +780,11 @@ pub(crate) fn value_matches(doc_val: Option<&Bson>, filter_val: &Bson) -> bool {
                             return false;
                         }
                     }
+                    "$type" => {
+                        if !doc_val.is_some_and(|v| crate::bson_type::matches(v, op_val)) {
+                            return false;
+                        }
+                    }
                     "$regex" => {
                         if let Some(Bson::String(doc_str)) = doc_val {
                             let pattern = match op_val {
@@ -438,3 +807,114 @@ pub(crate) fn value_matches(doc_val: Option<&Bson>, filter_val: &Bson) -> bool {
         _ => doc_val == Some(filter_val),
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    #[test]
+    fn pushdown_query_covers_match_sort_skip_limit() {
+        let stages = vec![
+            Stage::Match(doc! {"status": "A"}),
+            Stage::Sort(doc! {"n": 1}),
+            Stage::Skip(10),
+            Stage::Limit(5),
+        ];
+        assert_eq!(
+            pushdown_query(&stages),
+            Some(PushdownQuery {
+                filter: Some(doc! {"status": "A"}),
+                sort: Some(doc! {"n": 1}),
+                skip: 10,
+                limit: Some(5),
+            })
+        );
+        assert_eq!(pushdown_query(&[]), Some(PushdownQuery::default()));
+        assert_eq!(
+            pushdown_query(&[Stage::Limit(3)]),
+            Some(PushdownQuery {
+                limit: Some(3),
+                ..Default::default()
+            })
+        );
+    }
+
+    #[test]
+    fn pushdown_query_folds_skip_and_limit_runs() {
+        let folded = |stages: &[Stage]| {
+            let q = pushdown_query(stages).unwrap();
+            (q.skip, q.limit)
+        };
+        assert_eq!(
+            folded(&[Stage::Limit(300), Stage::Skip(50)]),
+            (50, Some(250))
+        );
+        assert_eq!(folded(&[Stage::Limit(5), Stage::Skip(10)]), (10, Some(0)));
+        assert_eq!(
+            folded(&[
+                Stage::Skip(10),
+                Stage::Limit(100),
+                Stage::Skip(5),
+                Stage::Limit(20),
+                Stage::Limit(50),
+            ]),
+            (15, Some(20))
+        );
+        assert_eq!(folded(&[Stage::Skip(2), Stage::Skip(3)]), (5, None));
+    }
+
+    #[test]
+    fn source_query_covers_what_the_collection_read_answers() {
+        let covered = |stages: &[Stage], allow_disk_use: bool| {
+            source_query(stages, allow_disk_use).map(|(_, n)| n)
+        };
+        let group = || Stage::Group {
+            id: Bson::Null,
+            accumulators: Document::new(),
+        };
+        assert_eq!(
+            covered(&[Stage::Match(doc! {"a": 1}), Stage::Limit(5)], false),
+            Some(2)
+        );
+        assert_eq!(
+            covered(&[Stage::Match(doc! {"a": 1}), group()], false),
+            Some(1)
+        );
+        assert_eq!(
+            covered(
+                &[
+                    Stage::Match(doc! {"a": 1}),
+                    Stage::Sort(doc! {"a": 1}),
+                    group()
+                ],
+                true
+            ),
+            Some(2)
+        );
+        assert_eq!(covered(&[group()], false), Some(0));
+        assert_eq!(
+            covered(&[Stage::Match(doc! {"a": 1}), Stage::Sample(3)], false),
+            None
+        );
+        assert_eq!(covered(&[Stage::Sample(3), group()], false), None);
+        let (query, _) = source_query(&[Stage::Match(doc! {"a": 1}), group()], false).unwrap();
+        assert_eq!(query.limit, Some(ENGINE_READ_LIMIT));
+    }
+
+    #[test]
+    fn pushdown_query_rejects_engine_stages() {
+        assert_eq!(
+            pushdown_query(&[Stage::Limit(5), Stage::Match(doc! {"a": 1})]),
+            None
+        );
+        assert_eq!(
+            pushdown_query(&[Stage::Match(doc! {"a": 1}), Stage::Project(doc! {"a": 1})]),
+            None
+        );
+        assert_eq!(
+            pushdown_query(&[Stage::Match(doc! {"$text": {"$search": "x"}})]),
+            None
+        );
+    }
+}
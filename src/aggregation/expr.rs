@@ -1,3 +1,5 @@
+use crate::aggregation::Numeric;
+use crate::aggregation::convert::{ConvertTarget, convert};
 use bson::{Bson, Document};
 use std::collections::HashMap;
 
@@ -18,6 +20,10 @@ pub enum Expr {
 
     // User-defined variables
     Var(String), // $$varname
+    Let {
+        vars: Vec<(String, Expr)>,
+        in_expr: Box<Expr>,
+    },
 
     // Arithmetic
     Add(Vec<Expr>),
@@ -48,21 +54,47 @@ pub enum Expr {
     IfNull(Vec<Expr>),
 
     // Type conversion
-    ToString(Box<Expr>),
-    ToInt(Box<Expr>),
-    ToDouble(Box<Expr>),
-    ToBool(Box<Expr>),
-    ToDate(Box<Expr>),
-    ToObjectId(Box<Expr>),
+    To(ConvertTarget, Box<Expr>), // $toInt, $toString, ...
+    Convert {
+        input: Box<Expr>,
+        to: Box<Expr>,
+        on_error: Option<Box<Expr>>,
+        on_null: Option<Box<Expr>>,
+    },
+    Type(Box<Expr>),
 
     // Array
     Array(Vec<Expr>),
     ConcatArrays(Vec<Expr>),
     Size(Box<Expr>),
+    ArrayElemAt(Box<Expr>, Box<Expr>),
+    First(Box<Expr>),
+    Last(Box<Expr>),
+    In(Box<Expr>, Box<Expr>),
     Slice {
         array: Box<Expr>,
-        start: Box<Expr>,
-        end: Option<Box<Expr>>,
+        position: Option<Box<Expr>>,
+        n: Box<Expr>,
+    },
+    SortArray {
+        input: Box<Expr>,
+        sort_by: SortArrayBy,
+    },
+    Filter {
+        input: Box<Expr>,
+        as_var: String,
+        cond: Box<Expr>,
+        limit: Option<Box<Expr>>,
+    },
+    Map {
+        input: Box<Expr>,
+        as_var: String,
+        in_expr: Box<Expr>,
+    },
+    Reduce {
+        input: Box<Expr>,
+        initial_value: Box<Expr>,
+        in_expr: Box<Expr>,
     },
 
     // String
@@ -82,6 +114,21 @@ pub enum Expr {
     Hour(Box<Expr>),
     Minute(Box<Expr>),
     Second(Box<Expr>),
+    /// `$dateAdd`, or `$dateSubtract` when `subtract` is set
+    DateAdd {
+        start_date: Box<Expr>,
+        unit: Box<Expr>,
+        amount: Box<Expr>,
+        timezone: Option<Box<Expr>>,
+        subtract: bool,
+    },
+    DateDiff {
+        start_date: Box<Expr>,
+        end_date: Box<Expr>,
+        unit: Box<Expr>,
+        timezone: Option<Box<Expr>>,
+        start_of_week: Option<Box<Expr>>,
+    },
 
     // Object
     MergeObjects(Vec<Expr>),
@@ -90,8 +137,202 @@ pub enum Expr {
 
     // Meta
     TextScore, // $meta: "textScore"
+    Rand,      // $rand: {}
+}
+
+/// `sortBy` of `$sortArray`: a direction for whole elements, or a sort document over
+/// (possibly dotted) fields of document elements.
+#[derive(Debug, Clone)]
+pub enum SortArrayBy {
+    Value(i32),
+    Fields(Vec<(String, i32)>),
+}
+
+impl SortArrayBy {
+    fn parse(val: &Bson) -> anyhow::Result<Self> {
+        match val {
+            Bson::Document(spec) if !spec.is_empty() => spec
+                .iter()
+                .map(|(k, v)| Ok((k.clone(), sort_direction(v)?)))
+                .collect::<anyhow::Result<Vec<_>>>()
+                .map(SortArrayBy::Fields),
+            Bson::Document(_) => Err(anyhow::anyhow!("$sortArray sortBy must not be empty")),
+            v => sort_direction(v).map(SortArrayBy::Value),
+        }
+    }
+
+    fn compare(&self, a: &Bson, b: &Bson) -> std::cmp::Ordering {
+        let directed =
+            |ord: std::cmp::Ordering, dir: i32| if dir < 0 { ord.reverse() } else { ord };
+        match self {
+            SortArrayBy::Value(dir) => directed(crate::aggregation::bson_cmp(a, b), *dir),
+            SortArrayBy::Fields(fields) => {
+                for (path, dir) in fields {
+                    let ord =
+                        crate::aggregation::bson_cmp(&lookup_path(a, path), &lookup_path(b, path));
+                    if ord != std::cmp::Ordering::Equal {
+                        return directed(ord, *dir);
+                    }
+                }
+                std::cmp::Ordering::Equal
+            }
+        }
+    }
+}
+
+fn sort_direction(val: &Bson) -> anyhow::Result<i32> {
+    match val {
+        Bson::Int32(n @ (1 | -1)) => Ok(*n),
+        Bson::Int64(n @ (1 | -1)) => Ok(*n as i32),
+        Bson::Double(n) if *n == 1.0 || *n == -1.0 => Ok(*n as i32),
+        _ => Err(anyhow::anyhow!("$sortArray sort direction must be 1 or -1")),
+    }
+}
+
+/// Value at dotted `path` inside `val`, or null when any segment is missing.
+fn lookup_path(val: &Bson, path: &str) -> Bson {
+    let mut current = val;
+    for part in path.split('.') {
+        match current {
+            Bson::Document(doc) => match doc.get(part) {
+                Some(v) => current = v,
+                None => return Bson::Null,
+            },
+            _ => return Bson::Null,
+        }
+    }
+    current.clone()
+}
+
+/// Variable an array operator binds each element to when `as` is not given.
+const DEFAULT_ELEMENT_VAR: &str = "this";
+
+/// Required argument `name` of operator document `doc`.
+fn operator_arg<'a>(op: &str, doc: &'a Document, name: &str) -> anyhow::Result<&'a Bson> {
+    doc.get(name)
+        .ok_or_else(|| anyhow::anyhow!("{} missing {}", op, name))
+}
+
+/// Variable name given by `as`, defaulting to `this`.
+fn operator_var(op: &str, doc: &Document) -> anyhow::Result<String> {
+    match doc.get("as") {
+        None => Ok(DEFAULT_ELEMENT_VAR.to_string()),
+        Some(Bson::String(name)) if !name.is_empty() && !name.starts_with('$') => Ok(name.clone()),
+        Some(_) => Err(anyhow::anyhow!("{} 'as' must be a variable name", op)),
+    }
+}
+
+/// Evaluate the `input` of an array operator: `None` for null or missing, an error for
+/// other non-arrays.
+fn eval_array_input(
+    op: &str,
+    input: &Expr,
+    ctx: &ExprEvalContext,
+) -> anyhow::Result<Option<Vec<Bson>>> {
+    match eval_expr(input, ctx)? {
+        Bson::Array(arr) => Ok(Some(arr)),
+        Bson::Null | Bson::Undefined => Ok(None),
+        other => Err(anyhow::anyhow!(
+            "input to {} must be an array not {:?}",
+            op,
+            other.element_type()
+        )),
+    }
+}
+
+/// Integral numeric argument of `op`.
+fn integral_arg(op: &str, val: &Bson) -> anyhow::Result<i64> {
+    match crate::aggregation::coerce_numeric(val) {
+        Some(n) if n.as_f64().fract() == 0.0 => Ok(n.as_i64()),
+        _ => Err(anyhow::anyhow!(
+            "{} requires an integral numeric argument",
+            op
+        )),
+    }
 }
 
+/// `unit` argument of a date operator.
+fn date_unit_arg(op: &str, val: &Bson) -> anyhow::Result<crate::aggregation::dates::DateUnit> {
+    match val {
+        Bson::String(s) => crate::aggregation::dates::DateUnit::parse(s)
+            .ok_or_else(|| anyhow::anyhow!("{} unit must be a valid time unit, found {:?}", op, s)),
+        other => Err(anyhow::anyhow!(
+            "{} unit must evaluate to a string, found {}",
+            op,
+            crate::bson_type::alias_of(other)
+        )),
+    }
+}
+
+/// `timezone` argument of a date operator; UTC when absent.
+fn timezone_arg(
+    op: &str,
+    val: Option<&Bson>,
+) -> anyhow::Result<crate::aggregation::timezone::Timezone> {
+    match val {
+        None => Ok(crate::aggregation::timezone::Timezone::UTC),
+        Some(Bson::String(s)) => crate::aggregation::timezone::Timezone::parse(s)
+            .map_err(|e| anyhow::anyhow!("{}: {}", op, e)),
+        Some(other) => Err(anyhow::anyhow!(
+            "{} timezone must evaluate to a string, found {}",
+            op,
+            crate::bson_type::alias_of(other)
+        )),
+    }
+}
+
+/// Argument of a single-argument operator, which may be given bare (`$op: x`) or as a
+/// one-element list (`$op: [x]`).
+fn single_arg(val: &Bson) -> &Bson {
+    match val {
+        Bson::Array(arr) if arr.len() == 1 => &arr[0],
+        v => v,
+    }
+}
+
+/// Parse the `[a, b]` arguments of a binary operator.
+fn parse_pair(op: &str, val: &Bson) -> anyhow::Result<(Box<Expr>, Box<Expr>)> {
+    let arr = val
+        .as_array()
+        .ok_or_else(|| anyhow::anyhow!("{} requires array", op))?;
+    if arr.len() != 2 {
+        return Err(anyhow::anyhow!("{} requires exactly 2 arguments", op));
+    }
+    Ok((
+        Box::new(parse_expr(&arr[0])?),
+        Box::new(parse_expr(&arr[1])?),
+    ))
+}
+
+/// Value at dotted `path` in `doc`, or `None` when a segment is missing or not a document.
+fn field_value(doc: &Document, path: &str) -> Option<Bson> {
+    let (first, rest) = match path.split_once('.') {
+        Some((first, rest)) => (first, Some(rest)),
+        None => (path, None),
+    };
+    match (doc.get(first)?, rest) {
+        (value, None) => Some(value.clone()),
+        (Bson::Document(inner), Some(rest)) => field_value(inner, rest),
+        _ => None,
+    }
+}
+
+/// [`convert`] for a conversion without `onError`, where a failure fails the expression.
+fn convert_or_raise(value: &Bson, target: ConvertTarget) -> anyhow::Result<Bson> {
+    convert(value, target).map_err(|e| anyhow::anyhow!("{} in $convert with no onError value", e))
+}
+
+/// User variable names start with a lowercase letter (or any non-ASCII character); the
+/// uppercase ones are reserved for system variables.
+fn is_user_var_name(name: &str) -> bool {
+    name.starts_with(|c: char| !c.is_ascii_uppercase() && c != '$' && c != '_')
+        && !name.contains('.')
+}
+
+/// Variable holding the command's `$$NOW`, bound once per command so every document sees
+/// the same instant.
+pub const NOW_VAR: &str = "NOW";
+
 /// Context for expression evaluation
 pub struct ExprEvalContext {
     pub vars: HashMap<String, Bson>,
@@ -320,12 +561,43 @@ fn parse_operator(op: &str, val: &Bson) -> anyhow::Result<Expr> {
             let exprs: Vec<Expr> = arr.iter().map(parse_expr).collect::<Result<Vec<_>, _>>()?;
             Ok(Expr::IfNull(exprs))
         }
-        "$toString" => Ok(Expr::ToString(Box::new(parse_expr(val)?))),
-        "$toInt" => Ok(Expr::ToInt(Box::new(parse_expr(val)?))),
-        "$toDouble" => Ok(Expr::ToDouble(Box::new(parse_expr(val)?))),
-        "$toBool" => Ok(Expr::ToBool(Box::new(parse_expr(val)?))),
-        "$toDate" => Ok(Expr::ToDate(Box::new(parse_expr(val)?))),
-        "$toObjectId" => Ok(Expr::ToObjectId(Box::new(parse_expr(val)?))),
+        "$literal" => Ok(Expr::Literal(val.clone())),
+        "$toString" | "$toInt" | "$toLong" | "$toDouble" | "$toDecimal" | "$toBool" | "$toDate"
+        | "$toObjectId" => {
+            let target = match op {
+                "$toString" => ConvertTarget::String,
+                "$toInt" => ConvertTarget::Int,
+                "$toLong" => ConvertTarget::Long,
+                "$toDouble" => ConvertTarget::Double,
+                "$toDecimal" => ConvertTarget::Decimal,
+                "$toBool" => ConvertTarget::Bool,
+                "$toDate" => ConvertTarget::Date,
+                _ => ConvertTarget::ObjectId,
+            };
+            Ok(Expr::To(target, Box::new(parse_expr(single_arg(val))?)))
+        }
+        "$convert" => {
+            let doc = val
+                .as_document()
+                .ok_or_else(|| anyhow::anyhow!("$convert expects an object of named arguments"))?;
+            if let Some(k) = doc
+                .keys()
+                .find(|k| !matches!(k.as_str(), "input" | "to" | "onError" | "onNull"))
+            {
+                return Err(anyhow::anyhow!("$convert found an unknown argument: {}", k));
+            }
+            let optional = |name: &str| -> anyhow::Result<Option<Box<Expr>>> {
+                doc.get(name)
+                    .map(|v| parse_expr(v).map(Box::new))
+                    .transpose()
+            };
+            Ok(Expr::Convert {
+                input: Box::new(parse_expr(operator_arg(op, doc, "input")?)?),
+                to: Box::new(parse_expr(operator_arg(op, doc, "to")?)?),
+                on_error: optional("onError")?,
+                on_null: optional("onNull")?,
+            })
+        }
         "$concat" => {
             let arr = val
                 .as_array()
@@ -341,6 +613,120 @@ fn parse_operator(op: &str, val: &Bson) -> anyhow::Result<Expr> {
             Ok(Expr::ConcatArrays(exprs))
         }
         "$size" => Ok(Expr::Size(Box::new(parse_expr(val)?))),
+        "$arrayElemAt" => {
+            let (array, index) = parse_pair(op, val)?;
+            Ok(Expr::ArrayElemAt(array, index))
+        }
+        "$in" => {
+            let (needle, array) = parse_pair(op, val)?;
+            Ok(Expr::In(needle, array))
+        }
+        "$first" | "$last" => {
+            let arg = Box::new(parse_expr(single_arg(val))?);
+            Ok(if op == "$first" {
+                Expr::First(arg)
+            } else {
+                Expr::Last(arg)
+            })
+        }
+        "$slice" => {
+            let arr = val
+                .as_array()
+                .ok_or_else(|| anyhow::anyhow!("$slice requires array"))?;
+            match arr.as_slice() {
+                [array, n] => Ok(Expr::Slice {
+                    array: Box::new(parse_expr(array)?),
+                    position: None,
+                    n: Box::new(parse_expr(n)?),
+                }),
+                [array, position, n] => Ok(Expr::Slice {
+                    array: Box::new(parse_expr(array)?),
+                    position: Some(Box::new(parse_expr(position)?)),
+                    n: Box::new(parse_expr(n)?),
+                }),
+                _ => Err(anyhow::anyhow!("$slice requires 2 or 3 arguments")),
+            }
+        }
+        "$filter" => {
+            let doc = val
+                .as_document()
+                .ok_or_else(|| anyhow::anyhow!("$filter requires document"))?;
+            Ok(Expr::Filter {
+                input: Box::new(parse_expr(operator_arg(op, doc, "input")?)?),
+                as_var: operator_var(op, doc)?,
+                cond: Box::new(parse_expr(operator_arg(op, doc, "cond")?)?),
+                limit: doc
+                    .get("limit")
+                    .map(|l| parse_expr(l).map(Box::new))
+                    .transpose()?,
+            })
+        }
+        "$map" => {
+            let doc = val
+                .as_document()
+                .ok_or_else(|| anyhow::anyhow!("$map requires document"))?;
+            Ok(Expr::Map {
+                input: Box::new(parse_expr(operator_arg(op, doc, "input")?)?),
+                as_var: operator_var(op, doc)?,
+                in_expr: Box::new(parse_expr(operator_arg(op, doc, "in")?)?),
+            })
+        }
+        "$let" => {
+            let doc = val
+                .as_document()
+                .ok_or_else(|| anyhow::anyhow!("$let requires document"))?;
+            let vars = operator_arg(op, doc, "vars")?
+                .as_document()
+                .ok_or_else(|| anyhow::anyhow!("$let vars must be a document"))?
+                .iter()
+                .map(|(name, v)| {
+                    // CURRENT is the one system variable $let may rebind
+                    if !is_user_var_name(name) && name != "CURRENT" {
+                        return Err(anyhow::anyhow!("$let invalid variable name: {}", name));
+                    }
+                    Ok((name.clone(), parse_expr(v)?))
+                })
+                .collect::<anyhow::Result<Vec<_>>>()?;
+            Ok(Expr::Let {
+                vars,
+                in_expr: Box::new(parse_expr(operator_arg(op, doc, "in")?)?),
+            })
+        }
+        "$reduce" => {
+            let doc = val
+                .as_document()
+                .ok_or_else(|| anyhow::anyhow!("$reduce requires document"))?;
+            Ok(Expr::Reduce {
+                input: Box::new(parse_expr(operator_arg(op, doc, "input")?)?),
+                initial_value: Box::new(parse_expr(operator_arg(op, doc, "initialValue")?)?),
+                in_expr: Box::new(parse_expr(operator_arg(op, doc, "in")?)?),
+            })
+        }
+        "$mergeObjects" => {
+            let args = match val {
+                Bson::Array(arr) => arr.iter().map(parse_expr).collect::<Result<Vec<_>, _>>()?,
+                v => vec![parse_expr(v)?],
+            };
+            Ok(Expr::MergeObjects(args))
+        }
+        "$type" => Ok(Expr::Type(Box::new(parse_expr(single_arg(val))?))),
+        "$objectToArray" => Ok(Expr::ObjectToArray(Box::new(parse_expr(single_arg(val))?))),
+        "$arrayToObject" => Ok(Expr::ArrayToObject(Box::new(parse_expr(single_arg(val))?))),
+        "$sortArray" => {
+            let doc = val
+                .as_document()
+                .ok_or_else(|| anyhow::anyhow!("$sortArray requires document"))?;
+            let input = doc
+                .get("input")
+                .ok_or_else(|| anyhow::anyhow!("$sortArray missing input"))?;
+            let sort_by = doc
+                .get("sortBy")
+                .ok_or_else(|| anyhow::anyhow!("$sortArray missing sortBy"))?;
+            Ok(Expr::SortArray {
+                input: Box::new(parse_expr(input)?),
+                sort_by: SortArrayBy::parse(sort_by)?,
+            })
+        }
         "$substr" => {
             let arr = val
                 .as_array()
@@ -358,6 +744,56 @@ fn parse_operator(op: &str, val: &Bson) -> anyhow::Result<Expr> {
                 },
             })
         }
+        "$dateAdd" | "$dateSubtract" => {
+            let doc = val
+                .as_document()
+                .ok_or_else(|| anyhow::anyhow!("{} expects an object as its argument", op))?;
+            if let Some(k) = doc
+                .keys()
+                .find(|k| !matches!(k.as_str(), "startDate" | "unit" | "amount" | "timezone"))
+            {
+                return Err(anyhow::anyhow!("Unrecognized argument to {}: {}", op, k));
+            }
+            Ok(Expr::DateAdd {
+                start_date: Box::new(parse_expr(operator_arg(op, doc, "startDate")?)?),
+                unit: Box::new(parse_expr(operator_arg(op, doc, "unit")?)?),
+                amount: Box::new(parse_expr(operator_arg(op, doc, "amount")?)?),
+                timezone: doc
+                    .get("timezone")
+                    .map(|t| parse_expr(t).map(Box::new))
+                    .transpose()?,
+                subtract: op == "$dateSubtract",
+            })
+        }
+        "$dateDiff" => {
+            let doc = val
+                .as_document()
+                .ok_or_else(|| anyhow::anyhow!("$dateDiff expects an object as its argument"))?;
+            if let Some(k) = doc.keys().find(|k| {
+                !matches!(
+                    k.as_str(),
+                    "startDate" | "endDate" | "unit" | "timezone" | "startOfWeek"
+                )
+            }) {
+                return Err(anyhow::anyhow!("Unrecognized argument to $dateDiff: {}", k));
+            }
+            let optional = |name: &str| {
+                doc.get(name)
+                    .map(|e| parse_expr(e).map(Box::new))
+                    .transpose()
+            };
+            Ok(Expr::DateDiff {
+                start_date: Box::new(parse_expr(operator_arg(op, doc, "startDate")?)?),
+                end_date: Box::new(parse_expr(operator_arg(op, doc, "endDate")?)?),
+                unit: Box::new(parse_expr(operator_arg(op, doc, "unit")?)?),
+                timezone: optional("timezone")?,
+                start_of_week: optional("startOfWeek")?,
+            })
+        }
+        "$rand" => match val {
+            Bson::Document(d) if d.is_empty() => Ok(Expr::Rand),
+            _ => Err(anyhow::anyhow!("$rand does not currently accept arguments")),
+        },
         "$toLower" => Ok(Expr::ToLower(Box::new(parse_expr(val)?))),
         "$toUpper" => Ok(Expr::ToUpper(Box::new(parse_expr(val)?))),
         "$meta" => {
@@ -379,42 +815,49 @@ fn parse_operator(op: &str, val: &Bson) -> anyhow::Result<Expr> {
 pub fn eval_expr(expr: &Expr, ctx: &ExprEvalContext) -> anyhow::Result<Bson> {
     match expr {
         Expr::Literal(v) => Ok(v.clone()),
-        Expr::FieldRef(path) => {
-            // Navigate the path in current document
-            let parts: Vec<&str> = path.split('.').collect();
-            let mut current = Bson::Document(ctx.current.clone());
-            for part in &parts {
-                match current {
-                    Bson::Document(doc) => {
-                        current = doc.get(*part).cloned().unwrap_or(Bson::Null);
-                    }
-                    _ => return Ok(Bson::Null),
-                }
-            }
-            Ok(current)
-        }
+        Expr::FieldRef(path) => Ok(field_value(&ctx.current, path).unwrap_or(Bson::Null)),
         Expr::Root => Ok(Bson::Document(ctx.root.clone())),
         Expr::Current => Ok(Bson::Document(ctx.current.clone())),
         Expr::Remove => Ok(Bson::Undefined), // Special marker for $$REMOVE
-        Expr::Now => {
-            // Return current timestamp
-            Ok(Bson::DateTime(bson::DateTime::now()))
-        }
-        Expr::Var(name) => ctx
+        Expr::Now => Ok(ctx
             .vars
-            .get(name)
+            .get(NOW_VAR)
             .cloned()
-            .ok_or_else(|| anyhow::anyhow!("Use of undefined variable: {}", name)),
+            .unwrap_or_else(|| Bson::DateTime(bson::DateTime::now()))),
+        Expr::Var(name) => {
+            // `$$var.a.b` reads a path inside the variable's value
+            let (var, path) = match name.split_once('.') {
+                Some((var, path)) => (var, Some(path)),
+                None => (name.as_str(), None),
+            };
+            let value = match var {
+                "ROOT" => Bson::Document(ctx.root.clone()),
+                "CURRENT" => Bson::Document(ctx.current.clone()),
+                _ => ctx
+                    .vars
+                    .get(var)
+                    .cloned()
+                    .ok_or_else(|| anyhow::anyhow!("Use of undefined variable: {}", var))?,
+            };
+            Ok(match path {
+                Some(path) => lookup_path(&value, path),
+                None => value,
+            })
+        }
         Expr::Add(exprs) => {
             let mut sum_i128: i128 = 0;
             let mut has_double = false;
+            let mut saw_long = false;
             let mut sum_double: f64 = 0.0;
 
             for e in exprs {
                 let val = eval_expr(e, ctx)?;
                 match val {
                     Bson::Int32(n) => sum_i128 += n as i128,
-                    Bson::Int64(n) => sum_i128 += n as i128,
+                    Bson::Int64(n) => {
+                        saw_long = true;
+                        sum_i128 += n as i128;
+                    }
                     Bson::Double(n) => {
                         has_double = true;
                         sum_double += n;
@@ -425,28 +868,34 @@ pub fn eval_expr(expr: &Expr, ctx: &ExprEvalContext) -> anyhow::Result<Bson> {
 
             if has_double {
                 Ok(Bson::Double(sum_double + sum_i128 as f64))
-            } else if sum_i128 >= i32::MIN as i128 && sum_i128 <= i32::MAX as i128 {
-                Ok(Bson::Int32(sum_i128 as i32))
-            } else if sum_i128 >= i64::MIN as i128 && sum_i128 <= i64::MAX as i128 {
-                Ok(Bson::Int64(sum_i128 as i64))
             } else {
-                Ok(Bson::Double(sum_i128 as f64))
+                Ok(crate::aggregation::values::integer_result(
+                    sum_i128, saw_long,
+                ))
             }
         }
         Expr::Subtract(a, b) => {
             let av = eval_expr(a, ctx)?;
             let bv = eval_expr(b, ctx)?;
             match (av, bv) {
-                (Bson::Int32(a), Bson::Int32(b)) => Ok(Bson::Int32(a - b)),
-                (Bson::Int64(a), Bson::Int64(b)) => Ok(Bson::Int64(a - b)),
                 (Bson::Double(a), Bson::Double(b)) => Ok(Bson::Double(a - b)),
                 (a, b) => {
                     let an = crate::aggregation::coerce_numeric(&a);
                     let bn = crate::aggregation::coerce_numeric(&b);
-                    if let (Some(an), Some(bn)) = (an, bn) {
-                        Ok(Bson::Double(an.as_f64() - bn.as_f64()))
-                    } else {
-                        Ok(Bson::Null)
+                    match (an, bn) {
+                        (Some(an @ Numeric::Double(_)), Some(bn))
+                        | (Some(an), Some(bn @ Numeric::Double(_))) => {
+                            Ok(Bson::Double(an.as_f64() - bn.as_f64()))
+                        }
+                        (Some(an), Some(bn)) => {
+                            let saw_long =
+                                matches!(an, Numeric::Int64(_)) || matches!(bn, Numeric::Int64(_));
+                            Ok(crate::aggregation::values::integer_result(
+                                an.as_i64() as i128 - bn.as_i64() as i128,
+                                saw_long,
+                            ))
+                        }
+                        _ => Ok(Bson::Null),
                     }
                 }
             }
@@ -454,13 +903,17 @@ pub fn eval_expr(expr: &Expr, ctx: &ExprEvalContext) -> anyhow::Result<Bson> {
         Expr::Multiply(exprs) => {
             let mut prod: f64 = 1.0;
             let mut is_int = true;
+            let mut saw_long = false;
             let mut prod_i128: i128 = 1;
 
             for e in exprs {
                 let val = eval_expr(e, ctx)?;
                 match val {
-                    Bson::Int32(n) => prod_i128 *= n as i128,
-                    Bson::Int64(n) => prod_i128 *= n as i128,
+                    Bson::Int32(n) => prod_i128 = prod_i128.saturating_mul(n as i128),
+                    Bson::Int64(n) => {
+                        saw_long = true;
+                        prod_i128 = prod_i128.saturating_mul(n as i128);
+                    }
                     Bson::Double(n) => {
                         is_int = false;
                         prod *= n;
@@ -470,13 +923,9 @@ pub fn eval_expr(expr: &Expr, ctx: &ExprEvalContext) -> anyhow::Result<Bson> {
             }
 
             if is_int {
-                if prod_i128 >= i32::MIN as i128 && prod_i128 <= i32::MAX as i128 {
-                    Ok(Bson::Int32(prod_i128 as i32))
-                } else if prod_i128 >= i64::MIN as i128 && prod_i128 <= i64::MAX as i128 {
-                    Ok(Bson::Int64(prod_i128 as i64))
-                } else {
-                    Ok(Bson::Double(prod_i128 as f64))
-                }
+                Ok(crate::aggregation::values::integer_result(
+                    prod_i128, saw_long,
+                ))
             } else {
                 Ok(Bson::Double(prod * prod_i128 as f64))
             }
@@ -583,68 +1032,51 @@ pub fn eval_expr(expr: &Expr, ctx: &ExprEvalContext) -> anyhow::Result<Bson> {
             }
             Ok(Bson::Null)
         }
-        Expr::ToString(e) => {
-            let val = eval_expr(e, ctx)?;
-            Ok(Bson::String(format!("{}", val)))
-        }
-        Expr::ToInt(e) => {
-            let val = eval_expr(e, ctx)?;
-            match val {
-                Bson::Int32(n) => Ok(Bson::Int32(n)),
-                Bson::Int64(n) => Ok(Bson::Int32(n as i32)),
-                Bson::Double(n) => Ok(Bson::Int32(n as i32)),
-                Bson::String(s) => s
-                    .parse::<i32>()
-                    .map(Bson::Int32)
-                    .map_err(|e| anyhow::anyhow!("Cannot convert to int: {}", e)),
-                _ => Ok(Bson::Null),
-            }
-        }
-        Expr::ToDouble(e) => {
-            let val = eval_expr(e, ctx)?;
-            match val {
-                Bson::Int32(n) => Ok(Bson::Double(n as f64)),
-                Bson::Int64(n) => Ok(Bson::Double(n as f64)),
-                Bson::Double(n) => Ok(Bson::Double(n)),
-                Bson::String(s) => s
-                    .parse::<f64>()
-                    .map(Bson::Double)
-                    .map_err(|e| anyhow::anyhow!("Cannot convert to double: {}", e)),
-                _ => Ok(Bson::Null),
-            }
-        }
-        Expr::ToBool(e) => {
-            let val = eval_expr(e, ctx)?;
-            Ok(Bson::Boolean(is_truthy(&val)))
-        }
-        Expr::ToDate(e) => {
-            let val = eval_expr(e, ctx)?;
-            match val {
-                Bson::DateTime(d) => Ok(Bson::DateTime(d)),
-                Bson::Int64(n) => Ok(Bson::DateTime(bson::DateTime::from_millis(n))),
-                Bson::String(_s) => {
-                    // Try to parse ISO date using bson's built-in parser
-                    // bson::DateTime::parse_rfc3339_str is not available, so we use a simple approach
-                    // For now, return null for string dates (would need chrono for full support)
-                    Ok(Bson::Null)
-                }
-                _ => Ok(Bson::Null),
+        Expr::To(target, e) => match eval_expr(e, ctx)? {
+            Bson::Null | Bson::Undefined => Ok(Bson::Null),
+            value => convert_or_raise(&value, *target),
+        },
+        Expr::Convert {
+            input,
+            to,
+            on_error,
+            on_null,
+        } => {
+            let value = eval_expr(input, ctx)?;
+            if matches!(value, Bson::Null | Bson::Undefined) {
+                return on_null
+                    .as_ref()
+                    .map_or(Ok(Bson::Null), |e| eval_expr(e, ctx));
             }
-        }
-        Expr::ToObjectId(e) => {
-            let val = eval_expr(e, ctx)?;
-            match val {
-                Bson::ObjectId(oid) => Ok(Bson::ObjectId(oid)),
-                Bson::String(s) => {
-                    if let Ok(oid) = bson::oid::ObjectId::parse_str(&s) {
-                        Ok(Bson::ObjectId(oid))
-                    } else {
-                        Ok(Bson::Null)
-                    }
-                }
-                _ => Ok(Bson::Null),
+            let target = match eval_expr(to, ctx)? {
+                Bson::Null | Bson::Undefined => return Ok(Bson::Null),
+                to => ConvertTarget::from_bson(&to)
+                    .ok_or_else(|| anyhow::anyhow!("Unknown type name: {}", to))?,
+            };
+            match on_error {
+                Some(on_error) => match convert(&value, target) {
+                    Ok(converted) => Ok(converted),
+                    Err(_) => eval_expr(on_error, ctx),
+                },
+                None => convert_or_raise(&value, target),
             }
         }
+        Expr::Type(e) => {
+            // A missing field reads as null elsewhere, so look it up directly here
+            let value = match e.as_ref() {
+                Expr::FieldRef(path) => field_value(&ctx.current, path),
+                e => match eval_expr(e, ctx)? {
+                    Bson::Undefined => None,
+                    v => Some(v),
+                },
+            };
+            Ok(Bson::String(
+                value
+                    .as_ref()
+                    .map_or("missing", crate::bson_type::alias_of)
+                    .to_string(),
+            ))
+        }
         Expr::Concat(exprs) => {
             let mut result = String::new();
             for e in exprs {
@@ -660,13 +1092,99 @@ pub fn eval_expr(expr: &Expr, ctx: &ExprEvalContext) -> anyhow::Result<Bson> {
         Expr::ConcatArrays(exprs) => {
             let mut result: Vec<Bson> = Vec::new();
             for e in exprs {
-                let val = eval_expr(e, ctx)?;
-                if let Bson::Array(arr) = val {
-                    result.extend(arr);
+                match eval_array_input("$concatArrays", e, ctx)? {
+                    Some(arr) => result.extend(arr),
+                    // Any null or missing argument makes the result null
+                    None => return Ok(Bson::Null),
                 }
             }
             Ok(Bson::Array(result))
         }
+        Expr::ArrayElemAt(array, index) => {
+            let Some(arr) = eval_array_input("$arrayElemAt", array, ctx)? else {
+                return Ok(Bson::Null);
+            };
+            let index = match eval_expr(index, ctx)? {
+                Bson::Null | Bson::Undefined => return Ok(Bson::Null),
+                v => integral_arg("$arrayElemAt", &v)?,
+            };
+            let pos = if index < 0 {
+                arr.len() as i64 + index
+            } else {
+                index
+            };
+            // Out of bounds is missing, not null
+            Ok(usize::try_from(pos)
+                .ok()
+                .and_then(|p| arr.get(p).cloned())
+                .unwrap_or(Bson::Undefined))
+        }
+        Expr::First(e) | Expr::Last(e) => {
+            let op = if matches!(expr, Expr::First(_)) {
+                "$first"
+            } else {
+                "$last"
+            };
+            let Some(arr) = eval_array_input(op, e, ctx)? else {
+                return Ok(Bson::Null);
+            };
+            let elem = if matches!(expr, Expr::First(_)) {
+                arr.into_iter().next()
+            } else {
+                arr.into_iter().next_back()
+            };
+            Ok(elem.unwrap_or(Bson::Undefined))
+        }
+        Expr::In(needle, array) => {
+            let needle = eval_expr(needle, ctx)?;
+            match eval_expr(array, ctx)? {
+                Bson::Array(arr) => Ok(Bson::Boolean(arr.iter().any(|v| {
+                    crate::aggregation::bson_cmp(v, &needle) == std::cmp::Ordering::Equal
+                }))),
+                other => Err(anyhow::anyhow!(
+                    "$in requires an array as a second argument, found: {:?}",
+                    other.element_type()
+                )),
+            }
+        }
+        Expr::Slice { array, position, n } => {
+            let Some(arr) = eval_array_input("$slice", array, ctx)? else {
+                return Ok(Bson::Null);
+            };
+            let len = arr.len() as i64;
+            let n = match eval_expr(n, ctx)? {
+                Bson::Null | Bson::Undefined => return Ok(Bson::Null),
+                v => integral_arg("$slice", &v)?,
+            };
+            let (start, count) = match position {
+                // [array, n]: the first n elements, or the last -n
+                None if n >= 0 => (0, n),
+                None => ((len + n).max(0), -n),
+                Some(position) => {
+                    let position = match eval_expr(position, ctx)? {
+                        Bson::Null | Bson::Undefined => return Ok(Bson::Null),
+                        v => integral_arg("$slice", &v)?,
+                    };
+                    if n <= 0 {
+                        return Err(anyhow::anyhow!(
+                            "$slice count must be positive when a position is given"
+                        ));
+                    }
+                    let start = if position < 0 {
+                        (len + position).max(0)
+                    } else {
+                        position.min(len)
+                    };
+                    (start, n)
+                }
+            };
+            Ok(Bson::Array(
+                arr.into_iter()
+                    .skip(start as usize)
+                    .take(count as usize)
+                    .collect(),
+            ))
+        }
         Expr::Size(e) => {
             let val = eval_expr(e, ctx)?;
             if let Bson::Array(arr) = val {
@@ -675,6 +1193,178 @@ pub fn eval_expr(expr: &Expr, ctx: &ExprEvalContext) -> anyhow::Result<Bson> {
                 Ok(Bson::Null)
             }
         }
+        Expr::Filter {
+            input,
+            as_var,
+            cond,
+            limit,
+        } => {
+            let Some(arr) = eval_array_input("$filter", input, ctx)? else {
+                return Ok(Bson::Null);
+            };
+            let limit = match limit {
+                Some(l) => match eval_expr(l, ctx)? {
+                    Bson::Null => None,
+                    v => match crate::aggregation::coerce_numeric(&v) {
+                        Some(n) if n.as_f64() >= 1.0 && n.as_f64().fract() == 0.0 => {
+                            Some(n.as_i64() as usize)
+                        }
+                        _ => {
+                            return Err(anyhow::anyhow!(
+                                "$filter limit must be a positive integer"
+                            ));
+                        }
+                    },
+                },
+                None => None,
+            };
+            // Bindings live in a scope of their own so they never reach the caller
+            let mut scope =
+                ExprEvalContext::with_vars(ctx.root.clone(), ctx.current.clone(), ctx.vars.clone());
+            let mut result = Vec::new();
+            for elem in arr {
+                if limit.is_some_and(|l| result.len() >= l) {
+                    break;
+                }
+                scope.vars.insert(as_var.clone(), elem.clone());
+                if is_truthy(&eval_expr(cond, &scope)?) {
+                    result.push(elem);
+                }
+            }
+            Ok(Bson::Array(result))
+        }
+        Expr::Let { vars, in_expr } => {
+            // Every binding is evaluated in the enclosing scope, so vars cannot see each
+            // other; an inner $let shadows an outer one of the same name
+            let mut scope =
+                ExprEvalContext::with_vars(ctx.root.clone(), ctx.current.clone(), ctx.vars.clone());
+            for (name, e) in vars {
+                let value = eval_expr(e, ctx)?;
+                // Rebinding CURRENT moves where `$field` paths resolve
+                if name == "CURRENT" {
+                    scope.current = match value {
+                        Bson::Document(doc) => doc,
+                        other => {
+                            return Err(anyhow::anyhow!(
+                                "$let CURRENT must be a document, not {:?}",
+                                other.element_type()
+                            ));
+                        }
+                    };
+                } else {
+                    scope.vars.insert(name.clone(), value);
+                }
+            }
+            eval_expr(in_expr, &scope)
+        }
+        Expr::Map {
+            input,
+            as_var,
+            in_expr,
+        } => {
+            let Some(arr) = eval_array_input("$map", input, ctx)? else {
+                return Ok(Bson::Null);
+            };
+            let mut scope =
+                ExprEvalContext::with_vars(ctx.root.clone(), ctx.current.clone(), ctx.vars.clone());
+            let mut result = Vec::with_capacity(arr.len());
+            for elem in arr {
+                scope.vars.insert(as_var.clone(), elem);
+                result.push(match eval_expr(in_expr, &scope)? {
+                    // $$REMOVE inside an array becomes null, as in MongoDB
+                    Bson::Undefined => Bson::Null,
+                    v => v,
+                });
+            }
+            Ok(Bson::Array(result))
+        }
+        Expr::Reduce {
+            input,
+            initial_value,
+            in_expr,
+        } => {
+            let Some(arr) = eval_array_input("$reduce", input, ctx)? else {
+                return Ok(Bson::Null);
+            };
+            let mut scope =
+                ExprEvalContext::with_vars(ctx.root.clone(), ctx.current.clone(), ctx.vars.clone());
+            let mut value = eval_expr(initial_value, ctx)?;
+            for elem in arr {
+                scope.vars.insert("value".to_string(), value);
+                scope.vars.insert(DEFAULT_ELEMENT_VAR.to_string(), elem);
+                value = eval_expr(in_expr, &scope)?;
+            }
+            Ok(value)
+        }
+        Expr::MergeObjects(exprs) => {
+            let values = exprs
+                .iter()
+                .map(|e| eval_expr(e, ctx))
+                .collect::<anyhow::Result<Vec<_>>>()?;
+            Ok(Bson::Document(crate::aggregation::values::merge_objects(
+                values,
+            )?))
+        }
+        Expr::ObjectToArray(e) => match eval_expr(e, ctx)? {
+            Bson::Document(doc) => Ok(Bson::Array(
+                doc.into_iter()
+                    .map(|(k, v)| Bson::Document(bson::doc! {"k": k, "v": v}))
+                    .collect(),
+            )),
+            Bson::Null | Bson::Undefined => Ok(Bson::Null),
+            other => Err(anyhow::anyhow!(
+                "$objectToArray requires a document input, found: {:?}",
+                other.element_type()
+            )),
+        },
+        Expr::ArrayToObject(e) => {
+            let Some(arr) = eval_array_input("$arrayToObject", e, ctx)? else {
+                return Ok(Bson::Null);
+            };
+            let mut result = Document::new();
+            for elem in arr {
+                let (k, v) = match elem {
+                    Bson::Document(mut pair) if pair.len() == 2 => {
+                        match (pair.remove("k"), pair.remove("v")) {
+                            (Some(Bson::String(k)), Some(v)) => (k, v),
+                            _ => {
+                                return Err(anyhow::anyhow!(
+                                    "$arrayToObject requires documents with exactly 'k' and 'v' fields, 'k' a string"
+                                ));
+                            }
+                        }
+                    }
+                    Bson::Array(pair) if pair.len() == 2 => {
+                        let mut pair = pair.into_iter();
+                        match (pair.next(), pair.next()) {
+                            (Some(Bson::String(k)), Some(v)) => (k, v),
+                            _ => {
+                                return Err(anyhow::anyhow!(
+                                    "$arrayToObject requires [key, value] pairs with a string key"
+                                ));
+                            }
+                        }
+                    }
+                    _ => {
+                        return Err(anyhow::anyhow!(
+                            "$arrayToObject requires an array of {{k, v}} documents or [key, value] pairs"
+                        ));
+                    }
+                };
+                // A repeated key takes the last value
+                result.insert(k, v);
+            }
+            Ok(Bson::Document(result))
+        }
+        Expr::SortArray { input, sort_by } => {
+            // Non-array inputs (including null and missing) yield null
+            let mut arr = match eval_expr(input, ctx)? {
+                Bson::Array(arr) => arr,
+                _ => return Ok(Bson::Null),
+            };
+            arr.sort_by(|a, b| sort_by.compare(a, b));
+            Ok(Bson::Array(arr))
+        }
         Expr::Substr {
             string,
             start,
@@ -711,6 +1401,127 @@ pub fn eval_expr(expr: &Expr, ctx: &ExprEvalContext) -> anyhow::Result<Bson> {
                 Ok(Bson::String(String::new()))
             }
         }
+        Expr::DateAdd {
+            start_date,
+            unit,
+            amount,
+            timezone,
+            subtract,
+        } => {
+            let op = if *subtract {
+                "$dateSubtract"
+            } else {
+                "$dateAdd"
+            };
+            let start = eval_expr(start_date, ctx)?;
+            let unit = eval_expr(unit, ctx)?;
+            let amount = eval_expr(amount, ctx)?;
+            let timezone = timezone.as_ref().map(|t| eval_expr(t, ctx)).transpose()?;
+            if [Some(&start), Some(&unit), Some(&amount), timezone.as_ref()]
+                .into_iter()
+                .flatten()
+                .any(|v| matches!(v, Bson::Null | Bson::Undefined))
+            {
+                return Ok(Bson::Null);
+            }
+            let start = crate::aggregation::dates::date_millis(&start).ok_or_else(|| {
+                anyhow::anyhow!(
+                    "{} requires startDate to be convertible to a date, found {}",
+                    op,
+                    crate::bson_type::alias_of(&start)
+                )
+            })?;
+            let unit = date_unit_arg(op, &unit)?;
+            let mut amount = match &amount {
+                Bson::Int32(_) | Bson::Int64(_) | Bson::Double(_) | Bson::Decimal128(_) => {
+                    integral_arg(op, &amount)?
+                }
+                other => {
+                    return Err(anyhow::anyhow!(
+                        "{} expects integer amount of time units, found {}",
+                        op,
+                        crate::bson_type::alias_of(other)
+                    ));
+                }
+            };
+            if *subtract {
+                amount = amount
+                    .checked_neg()
+                    .ok_or_else(|| anyhow::anyhow!("{} overflowed", op))?;
+            }
+            let tz = timezone_arg(op, timezone.as_ref())?;
+            crate::aggregation::dates::date_add(start, unit, amount, &tz)
+                .map(|ms| Bson::DateTime(bson::DateTime::from_millis(ms)))
+                .ok_or_else(|| anyhow::anyhow!("{} overflowed", op))
+        }
+        Expr::DateDiff {
+            start_date,
+            end_date,
+            unit,
+            timezone,
+            start_of_week,
+        } => {
+            let start = eval_expr(start_date, ctx)?;
+            let end = eval_expr(end_date, ctx)?;
+            let unit = eval_expr(unit, ctx)?;
+            let timezone = timezone.as_ref().map(|t| eval_expr(t, ctx)).transpose()?;
+            let start_of_week = start_of_week
+                .as_ref()
+                .map(|w| eval_expr(w, ctx))
+                .transpose()?;
+            if [
+                Some(&start),
+                Some(&end),
+                Some(&unit),
+                timezone.as_ref(),
+                start_of_week.as_ref(),
+            ]
+            .into_iter()
+            .flatten()
+            .any(|v| matches!(v, Bson::Null | Bson::Undefined))
+            {
+                return Ok(Bson::Null);
+            }
+            let date = |name: &str, v: &Bson| {
+                crate::aggregation::dates::date_millis(v).ok_or_else(|| {
+                    anyhow::anyhow!(
+                        "$dateDiff requires {} to be convertible to a date, found {}",
+                        name,
+                        crate::bson_type::alias_of(v)
+                    )
+                })
+            };
+            let start = date("startDate", &start)?;
+            let end = date("endDate", &end)?;
+            let unit = date_unit_arg("$dateDiff", &unit)?;
+            let tz = timezone_arg("$dateDiff", timezone.as_ref())?;
+            let start_of_week = match &start_of_week {
+                None => 0,
+                Some(Bson::String(s)) => {
+                    crate::aggregation::dates::parse_weekday(s).ok_or_else(|| {
+                        anyhow::anyhow!(
+                            "$dateDiff startOfWeek must be a valid day of the week, found {:?}",
+                            s
+                        )
+                    })?
+                }
+                Some(other) => {
+                    return Err(anyhow::anyhow!(
+                        "$dateDiff startOfWeek must evaluate to a string, found {}",
+                        crate::bson_type::alias_of(other)
+                    ));
+                }
+            };
+            Ok(Bson::Int64(crate::aggregation::dates::date_diff(
+                start,
+                end,
+                unit,
+                &tz,
+                start_of_week,
+            )))
+        }
+        // A fresh draw from [0, 1) on every evaluation, so per document
+        Expr::Rand => Ok(Bson::Double(rand::random::<f64>())),
         Expr::TextScore => {
             // Return 1.0 as default text score (actual score would come from text search)
             Ok(Bson::Double(1.0))
@@ -722,6 +1533,122 @@ pub fn eval_expr(expr: &Expr, ctx: &ExprEvalContext) -> anyhow::Result<Bson> {
     }
 }
 
+/// Variables of a command: `$$NOW` and the values of its `let` document. The values are
+/// expressions evaluated once, over no document, so they may use `$$NOW` but not field
+/// paths.
+pub fn command_vars(
+    let_vars: Option<&Document>,
+    now: bson::DateTime,
+) -> anyhow::Result<HashMap<String, Bson>> {
+    let mut vars = HashMap::from([(NOW_VAR.to_string(), Bson::DateTime(now))]);
+    if let Some(let_vars) = let_vars {
+        let ctx = ExprEvalContext::with_vars(Document::new(), Document::new(), vars.clone());
+        for (name, value) in let_vars {
+            if !is_user_var_name(name) {
+                return Err(anyhow::anyhow!("invalid let variable name: {}", name));
+            }
+            vars.insert(name.clone(), eval_expr(&parse_expr(value)?, &ctx)?);
+        }
+    }
+    Ok(vars)
+}
+
+/// `expr` with each `$$name` that `vars` binds replaced by its value as a `$literal`, so
+/// it can be evaluated, or translated to SQL, without the command's variables. Names an
+/// operator inside `expr` binds for itself (`$let` vars, the `as` of `$map` and `$filter`,
+/// `$$this` and `$$value` of `$reduce`) are left alone.
+pub fn bind_vars(expr: &Bson, vars: &HashMap<String, Bson>) -> Bson {
+    bind_vars_in(expr, vars, &[])
+}
+
+fn bind_vars_in(expr: &Bson, vars: &HashMap<String, Bson>, shadowed: &[String]) -> Bson {
+    match expr {
+        Bson::String(s) if s.starts_with("$$") => {
+            let (var, path) = match s[2..].split_once('.') {
+                Some((var, path)) => (var, Some(path)),
+                None => (&s[2..], None),
+            };
+            match vars.get(var) {
+                Some(value) if !shadowed.iter().any(|name| name == var) => {
+                    let value = match path {
+                        Some(path) => lookup_path(value, path),
+                        None => value.clone(),
+                    };
+                    let mut literal = Document::new();
+                    literal.insert("$literal", value);
+                    Bson::Document(literal)
+                }
+                _ => expr.clone(),
+            }
+        }
+        Bson::Array(items) => Bson::Array(
+            items
+                .iter()
+                .map(|item| bind_vars_in(item, vars, shadowed))
+                .collect(),
+        ),
+        Bson::Document(doc) if doc.contains_key("$literal") => expr.clone(),
+        Bson::Document(doc) => {
+            let mut inner = shadowed.to_vec();
+            if let Some((op, Bson::Document(args))) = doc.iter().next() {
+                match op.as_str() {
+                    "$let" => {
+                        if let Ok(names) = args.get_document("vars") {
+                            inner.extend(names.keys().cloned());
+                        }
+                    }
+                    "$map" | "$filter" => inner.push(
+                        args.get_str("as")
+                            .unwrap_or(DEFAULT_ELEMENT_VAR)
+                            .to_string(),
+                    ),
+                    "$reduce" => inner.extend(["this".to_string(), "value".to_string()]),
+                    _ => {}
+                }
+            }
+            Bson::Document(
+                doc.iter()
+                    .map(|(k, v)| (k.clone(), bind_vars_in(v, vars, &inner)))
+                    .collect(),
+            )
+        }
+        _ => expr.clone(),
+    }
+}
+
+/// `filter` with [`bind_vars`] applied to each `$expr`, including those nested in `$and`,
+/// `$or` and `$nor`.
+pub fn bind_filter_vars(filter: &Document, vars: &HashMap<String, Bson>) -> Document {
+    filter
+        .iter()
+        .map(|(k, v)| {
+            let v = match (k.as_str(), v) {
+                ("$expr", expr) => bind_vars(expr, vars),
+                ("$and" | "$or" | "$nor", Bson::Array(items)) => Bson::Array(
+                    items
+                        .iter()
+                        .map(|item| match item {
+                            Bson::Document(d) => Bson::Document(bind_filter_vars(d, vars)),
+                            other => other.clone(),
+                        })
+                        .collect(),
+                ),
+                _ => v.clone(),
+            };
+            (k.clone(), v)
+        })
+        .collect()
+}
+
+/// Whether the `$expr` condition `expr`, its variables already bound, holds for `doc`. An
+/// expression that fails to parse or evaluate matches nothing.
+pub fn matches_expr(doc: &Document, expr: &Bson) -> bool {
+    let ctx = ExprEvalContext::new(doc.clone(), doc.clone());
+    parse_expr(expr)
+        .and_then(|e| eval_expr(&e, &ctx))
+        .is_ok_and(|v| is_truthy(&v))
+}
+
 fn is_truthy(val: &Bson) -> bool {
     match val {
         Bson::Boolean(b) => *b,
@@ -736,3 +1663,759 @@ fn is_truthy(val: &Bson) -> bool {
         _ => true,
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::{bson, doc};
+
+    fn eval(expr: Bson, doc: Document) -> Bson {
+        let ctx = ExprEvalContext::new(doc.clone(), doc);
+        eval_expr(&parse_expr(&expr).unwrap(), &ctx).unwrap()
+    }
+
+    #[test]
+    fn sort_array_orders_objects_by_nested_key() {
+        let doc = doc! {"team": [
+            {"name": "pat", "stats": {"age": 42, "score": 7}},
+            {"name": "lee", "stats": {"age": 30, "score": 9}},
+            {"name": "kim", "stats": {"age": 30, "score": 3}},
+        ]};
+        let names = |v: Bson| -> Vec<String> {
+            v.as_array()
+                .unwrap()
+                .iter()
+                .map(|m| {
+                    m.as_document()
+                        .unwrap()
+                        .get_str("name")
+                        .unwrap()
+                        .to_string()
+                })
+                .collect()
+        };
+
+        let asc = eval(
+            bson!({"$sortArray": {"input": "$team", "sortBy": {"stats.age": 1}}}),
+            doc.clone(),
+        );
+        // Stable: ties keep their input order
+        assert_eq!(names(asc), ["lee", "kim", "pat"]);
+
+        let multi = eval(
+            bson!({"$sortArray": {"input": "$team", "sortBy": {"stats.age": 1, "stats.score": -1}}}),
+            doc,
+        );
+        assert_eq!(names(multi), ["lee", "kim", "pat"]);
+    }
+
+    #[test]
+    fn sort_array_orders_scalars_and_nulls_non_arrays() {
+        let doc = doc! {"xs": [3, 1, 2], "s": "abc"};
+        assert_eq!(
+            eval(
+                bson!({"$sortArray": {"input": "$xs", "sortBy": -1}}),
+                doc.clone()
+            ),
+            bson!([3, 2, 1])
+        );
+        assert_eq!(
+            eval(
+                bson!({"$sortArray": {"input": "$s", "sortBy": 1}}),
+                doc.clone()
+            ),
+            Bson::Null
+        );
+        assert_eq!(
+            eval(
+                bson!({"$sortArray": {"input": "$missing", "sortBy": 1}}),
+                doc
+            ),
+            Bson::Null
+        );
+        assert!(parse_expr(&bson!({"$sortArray": {"input": "$xs", "sortBy": 2}})).is_err());
+    }
+
+    #[test]
+    fn filter_map_and_reduce_bind_their_variables() {
+        let doc = doc! {"xs": [1, 5, 2, 8], "ys": [{"v": "a"}, {"v": "b"}]};
+        assert_eq!(
+            eval(
+                bson!({"$filter": {"input": "$xs", "as": "x", "cond": {"$gt": ["$$x", 1]}, "limit": 2}}),
+                doc.clone()
+            ),
+            bson!([5, 2])
+        );
+        // Without `as`, elements are bound to $$this
+        assert_eq!(
+            eval(
+                bson!({"$map": {"input": "$ys", "in": "$$this.v"}}),
+                doc.clone()
+            ),
+            bson!(["a", "b"])
+        );
+        assert_eq!(
+            eval(
+                bson!({"$reduce": {"input": "$xs", "initialValue": 0, "in": {"$add": ["$$value", "$$this"]}}}),
+                doc.clone()
+            ),
+            Bson::Int32(16)
+        );
+        assert_eq!(
+            eval(
+                bson!({"$map": {"input": "$missing", "in": "$$this"}}),
+                doc.clone()
+            ),
+            Bson::Null
+        );
+        let ctx = ExprEvalContext::new(doc.clone(), doc);
+        let not_array = parse_expr(&bson!({"$filter": {"input": 3, "cond": true}})).unwrap();
+        assert!(eval_expr(&not_array, &ctx).is_err());
+        let zero_limit =
+            parse_expr(&bson!({"$filter": {"input": "$xs", "cond": true, "limit": 0}})).unwrap();
+        assert!(eval_expr(&zero_limit, &ctx).is_err());
+    }
+
+    #[test]
+    fn nested_map_inside_filter_keeps_bindings_scoped() {
+        let doc = doc! {"orders": [
+            {"id": 1, "items": [{"qty": 1}, {"qty": 1}]},
+            {"id": 2, "items": [{"qty": 1}, {"qty": 3}]},
+            {"id": 3, "items": []},
+        ]};
+        // Orders with an item of quantity >= 2, found by mapping items to their quantities
+        let big = bson!({"$filter": {
+            "input": "$orders",
+            "as": "o",
+            "cond": {"$gt": [
+                {"$size": {"$filter": {
+                    "input": {"$map": {"input": "$$o.items", "as": "i", "in": "$$i.qty"}},
+                    "as": "q",
+                    "cond": {"$gte": ["$$q", 2]},
+                }}},
+                0,
+            ]},
+        }});
+        let ids: Vec<i32> = eval(big, doc.clone())
+            .as_array()
+            .unwrap()
+            .iter()
+            .map(|o| o.as_document().unwrap().get_i32("id").unwrap())
+            .collect();
+        assert_eq!(ids, [2]);
+
+        // An inner binding shadows an outer one of the same name only inside it
+        let shadowed = bson!({"$map": {
+            "input": "$orders",
+            "as": "x",
+            "in": {"$reduce": {
+                "input": {"$map": {"input": "$$x.items", "as": "x", "in": "$$x.qty"}},
+                "initialValue": "$$x.id",
+                "in": {"$add": ["$$value", "$$this"]},
+            }},
+        }});
+        assert_eq!(eval(shadowed, doc.clone()), bson!([3, 6, 3]));
+
+        // And never leaks out of the operator
+        let ctx = ExprEvalContext::new(doc.clone(), doc);
+        let leaked = parse_expr(&bson!({"$concatArrays": [
+            {"$map": {"input": "$orders", "as": "o", "in": "$$o.id"}},
+            {"$map": {"input": [1], "in": "$$o"}},
+        ]}))
+        .unwrap();
+        assert!(eval_expr(&leaked, &ctx).is_err());
+    }
+
+    #[test]
+    fn array_elem_at_first_and_last_index_into_arrays() {
+        let doc = doc! {"xs": [10, 20, 30], "empty": []};
+        let at = |i: i32| eval(bson!({"$arrayElemAt": ["$xs", i]}), doc.clone());
+        assert_eq!(at(0), Bson::Int32(10));
+        assert_eq!(at(-1), Bson::Int32(30));
+        assert_eq!(at(-3), Bson::Int32(10));
+        // Out of bounds is missing, which drops the field from $project/$addFields
+        assert_eq!(at(3), Bson::Undefined);
+        assert_eq!(at(-4), Bson::Undefined);
+        assert_eq!(
+            eval(bson!({"$arrayElemAt": ["$missing", 0]}), doc.clone()),
+            Bson::Null
+        );
+
+        assert_eq!(eval(bson!({"$first": "$xs"}), doc.clone()), Bson::Int32(10));
+        assert_eq!(
+            eval(bson!({"$last": ["$xs"]}), doc.clone()),
+            Bson::Int32(30)
+        );
+        assert_eq!(
+            eval(bson!({"$last": "$empty"}), doc.clone()),
+            Bson::Undefined
+        );
+
+        let docs = vec![doc.clone()];
+        let spec = doc! {"a": {"$arrayElemAt": ["$xs", 5]}, "b": {"$arrayElemAt": ["$xs", 1]}};
+        let out =
+            crate::aggregation::stages::add_fields::execute(docs, &spec, &HashMap::new()).unwrap();
+        assert!(!out[0].contains_key("a"));
+        assert_eq!(out[0].get_i32("b").unwrap(), 20);
+    }
+
+    #[test]
+    fn slice_concat_arrays_and_in() {
+        let doc = doc! {"xs": [1, 2, 3, 4, 5], "ys": [6]};
+        let slice = |args: Bson| eval(bson!({"$slice": args}), doc.clone());
+        assert_eq!(slice(bson!(["$xs", 2])), bson!([1, 2]));
+        assert_eq!(slice(bson!(["$xs", -2])), bson!([4, 5]));
+        assert_eq!(slice(bson!(["$xs", 1, 2])), bson!([2, 3]));
+        assert_eq!(slice(bson!(["$xs", -2, 10])), bson!([4, 5]));
+        assert_eq!(slice(bson!(["$xs", 9, 1])), bson!([]));
+        assert_eq!(slice(bson!(["$missing", 1])), Bson::Null);
+
+        assert_eq!(
+            eval(bson!({"$concatArrays": ["$xs", "$ys"]}), doc.clone()),
+            bson!([1, 2, 3, 4, 5, 6])
+        );
+        assert_eq!(
+            eval(bson!({"$concatArrays": ["$xs", "$missing"]}), doc.clone()),
+            Bson::Null
+        );
+        assert_eq!(eval(bson!({"$size": "$xs"}), doc.clone()), Bson::Int32(5));
+
+        assert_eq!(
+            eval(bson!({"$in": [3, "$xs"]}), doc.clone()),
+            Bson::Boolean(true)
+        );
+        assert_eq!(
+            eval(bson!({"$in": [9, "$xs"]}), doc.clone()),
+            Bson::Boolean(false)
+        );
+        let ctx = ExprEvalContext::new(doc.clone(), doc);
+        let not_array = parse_expr(&bson!({"$in": [1, "$missing"]})).unwrap();
+        assert!(eval_expr(&not_array, &ctx).is_err());
+    }
+
+    #[test]
+    fn object_to_array_and_back_round_trips() {
+        let doc = doc! {"attrs": {"size": "L", "color": "red", "dims": {"w": 2}}};
+        let kv = eval(bson!({"$objectToArray": "$attrs"}), doc.clone());
+        assert_eq!(
+            kv,
+            bson!([
+                {"k": "size", "v": "L"},
+                {"k": "color", "v": "red"},
+                {"k": "dims", "v": {"w": 2}},
+            ])
+        );
+        let back = eval(
+            bson!({"$arrayToObject": {"$objectToArray": "$attrs"}}),
+            doc.clone(),
+        );
+        assert_eq!(
+            back,
+            Bson::Document(doc.get_document("attrs").unwrap().clone())
+        );
+
+        // The [key, value] form, where a repeated key keeps the last value
+        let pairs = doc! {"pairs": [["a", 1], ["b", 2], ["a", 3]]};
+        assert_eq!(
+            eval(bson!({"$arrayToObject": "$pairs"}), pairs),
+            bson!({"a": 3, "b": 2})
+        );
+        assert_eq!(
+            eval(bson!({"$objectToArray": "$missing"}), doc.clone()),
+            Bson::Null
+        );
+        assert_eq!(
+            eval(bson!({"$arrayToObject": "$missing"}), doc.clone()),
+            Bson::Null
+        );
+        let bad = doc! {"pairs": [{"k": 1, "v": 2}]};
+        let ctx = ExprEvalContext::new(bad.clone(), bad);
+        let expr = parse_expr(&bson!({"$arrayToObject": "$pairs"})).unwrap();
+        assert!(eval_expr(&expr, &ctx).is_err());
+    }
+
+    #[test]
+    fn merge_objects_merges_left_to_right_skipping_nulls() {
+        let doc = doc! {
+            "defaults": {"color": "red", "size": "M", "qty": 1},
+            "profile": {"size": "L", "qty": 2},
+            "order": {"qty": 5, "note": "rush"},
+        };
+        assert_eq!(
+            eval(
+                bson!({"$mergeObjects": ["$defaults", null, "$profile", "$missing", "$order"]}),
+                doc.clone()
+            ),
+            bson!({"color": "red", "size": "L", "qty": 5, "note": "rush"})
+        );
+        assert_eq!(
+            eval(bson!({"$mergeObjects": "$profile"}), doc.clone()),
+            bson!({"size": "L", "qty": 2})
+        );
+        let ctx = ExprEvalContext::new(doc.clone(), doc);
+        let bad = parse_expr(&bson!({"$mergeObjects": ["$profile", 3]})).unwrap();
+        assert!(eval_expr(&bad, &ctx).is_err());
+    }
+
+    #[test]
+    fn type_names_every_bson_type() {
+        let oid = bson::oid::ObjectId::new();
+        let doc = doc! {
+            "double": 1.5,
+            "string": "s",
+            "object": {"a": 1},
+            "array": [1],
+            "binData": bson::Binary { subtype: bson::spec::BinarySubtype::Generic, bytes: vec![1] },
+            "objectId": oid,
+            "bool": true,
+            "date": bson::DateTime::from_millis(0),
+            "null": null,
+            "regex": bson::Regex { pattern: "^a".into(), options: String::new() },
+            "javascript": Bson::JavaScriptCode("1".into()),
+            "int": 1i32,
+            "timestamp": bson::Timestamp { time: 1, increment: 1 },
+            "long": 1i64,
+            "decimal": Bson::Decimal128(bson::Decimal128::from_bytes([0; 16])),
+            "minKey": Bson::MinKey,
+            "maxKey": Bson::MaxKey,
+        };
+        for name in doc.keys() {
+            assert_eq!(
+                eval(bson!({"$type": format!("${}", name)}), doc.clone()),
+                Bson::String(name.clone()),
+                "field {}",
+                name
+            );
+        }
+        assert_eq!(
+            eval(bson!({"$type": "$nope"}), doc.clone()),
+            Bson::String("missing".into())
+        );
+        assert_eq!(
+            eval(bson!({"$type": "$object.nope"}), doc.clone()),
+            Bson::String("missing".into())
+        );
+        assert_eq!(
+            eval(bson!({"$type": ["$object.a"]}), doc.clone()),
+            Bson::String("int".into())
+        );
+        // Expressions and literals are typed by their result
+        assert_eq!(
+            eval(
+                bson!({"$type": {"$arrayElemAt": ["$array", 5]}}),
+                doc.clone()
+            ),
+            Bson::String("missing".into())
+        );
+        assert_eq!(
+            eval(bson!({"$type": {"$concat": ["a", "b"]}}), doc),
+            Bson::String("string".into())
+        );
+    }
+
+    #[test]
+    fn convert_handles_errors_and_nulls() {
+        let doc = doc! {"big": 1e10, "n": 7.9, "s": "12", "nil": null};
+        let try_eval = |expr: Bson| {
+            let ctx = ExprEvalContext::new(doc.clone(), doc.clone());
+            eval_expr(&parse_expr(&expr).unwrap(), &ctx)
+        };
+
+        assert_eq!(eval(bson!({"$toInt": "$n"}), doc.clone()), Bson::Int32(7));
+        assert_eq!(
+            eval(bson!({"$toLong": "$big"}), doc.clone()),
+            Bson::Int64(10_000_000_000)
+        );
+        assert_eq!(
+            eval(bson!({"$toDouble": ["$s"]}), doc.clone()),
+            Bson::Double(12.0)
+        );
+        assert_eq!(eval(bson!({"$toInt": "$nope"}), doc.clone()), Bson::Null);
+
+        let err = try_eval(bson!({"$toInt": "$big"})).unwrap_err();
+        assert!(
+            err.to_string().contains("no onError value"),
+            "unexpected error: {}",
+            err
+        );
+        assert_eq!(
+            eval(
+                bson!({"$convert": {"input": "$big", "to": "int", "onError": -1}}),
+                doc.clone()
+            ),
+            Bson::Int32(-1)
+        );
+        assert_eq!(
+            eval(
+                bson!({"$convert": {"input": "$s", "to": 18, "onError": -1}}),
+                doc.clone()
+            ),
+            Bson::Int64(12)
+        );
+        // onNull answers null and missing inputs; without it they convert to null
+        assert_eq!(
+            eval(
+                bson!({"$convert": {"input": "$nil", "to": "int", "onNull": 0}}),
+                doc.clone()
+            ),
+            Bson::Int32(0)
+        );
+        assert_eq!(
+            eval(
+                bson!({"$convert": {"input": "$nope", "to": "string", "onNull": "none"}}),
+                doc.clone()
+            ),
+            Bson::String("none".into())
+        );
+        assert_eq!(
+            eval(
+                bson!({"$convert": {"input": "$nope", "to": "int"}}),
+                doc.clone()
+            ),
+            Bson::Null
+        );
+
+        assert!(try_eval(bson!({"$convert": {"input": "$s", "to": "array"}})).is_err());
+        assert!(parse_expr(&bson!({"$convert": {"input": "$s"}})).is_err());
+        assert!(parse_expr(&bson!({"$convert": {"input": "$s", "to": "int", "x": 1}})).is_err());
+    }
+
+    #[test]
+    fn let_binds_and_shadows_variables() {
+        let doc = doc! {"price": 10, "qty": 3, "discount": 0.5};
+        let total = eval(
+            bson!({"$let": {
+                "vars": {"gross": {"$multiply": ["$price", "$qty"]}},
+                "in": {"$let": {
+                    "vars": {"net": {"$multiply": ["$$gross", "$discount"]}},
+                    "in": {"$subtract": ["$$gross", "$$net"]}
+                }}
+            }}),
+            doc.clone(),
+        );
+        assert_eq!(total, Bson::Double(15.0));
+
+        let shadowed = eval(
+            bson!({"$let": {
+                "vars": {"x": 1},
+                "in": {"$add": [
+                    {"$let": {"vars": {"x": 10}, "in": "$$x"}},
+                    "$$x"
+                ]}
+            }}),
+            doc.clone(),
+        );
+        assert_eq!(shadowed, Bson::Int32(11));
+
+        // Sibling bindings are evaluated in the enclosing scope
+        let ctx = ExprEvalContext::new(doc.clone(), doc.clone());
+        let sibling = parse_expr(&bson!({"$let": {
+            "vars": {"a": 1, "b": "$$a"},
+            "in": "$$b"
+        }}))
+        .unwrap();
+        assert!(eval_expr(&sibling, &ctx).is_err());
+        assert!(parse_expr(&bson!({"$let": {"vars": {"$bad": 1}, "in": 1}})).is_err());
+    }
+
+    #[test]
+    fn system_variables() {
+        let doc = doc! {"_id": 1, "a": {"b": 2}, "hidden": false, "secret": "x"};
+        let now = bson::DateTime::from_millis(1_700_000_000_000);
+        let vars = HashMap::from([(NOW_VAR.to_string(), Bson::DateTime(now))]);
+        let ctx = ExprEvalContext::with_vars(doc.clone(), doc.clone(), vars.clone());
+        let at = |expr: Bson| eval_expr(&parse_expr(&expr).unwrap(), &ctx).unwrap();
+
+        assert_eq!(at(Bson::String("$$NOW".into())), Bson::DateTime(now));
+        assert_eq!(at(Bson::String("$$ROOT.a.b".into())), Bson::Int32(2));
+        assert_eq!(
+            at(Bson::String("$$CURRENT".into())),
+            Bson::Document(doc.clone())
+        );
+        // $let can move CURRENT, and with it every `$field` path
+        assert_eq!(
+            at(bson!({"$let": {"vars": {"CURRENT": "$a"}, "in": "$b"}})),
+            Bson::Int32(2)
+        );
+
+        let spec = doc! {
+            "a": 1,
+            "secret": {"$cond": [{"$eq": ["$hidden", true]}, "$$REMOVE", "$secret"]},
+            "gone": {"$cond": {"if": {"$eq": ["$hidden", false]}, "then": "$$REMOVE", "else": 1}},
+        };
+        let out = crate::aggregation::stages::project::execute(vec![doc], &spec, &vars).unwrap();
+        assert_eq!(out[0], doc! {"a": {"b": 2}, "secret": "x", "_id": 1});
+    }
+
+    #[test]
+    fn command_vars_bind_into_expressions() {
+        let now = bson::DateTime::from_millis(1_700_000_000_000);
+        let vars = command_vars(
+            Some(&doc! {"threshold": {"$add": [40, 2]}, "limits": {"max": 9}}),
+            now,
+        )
+        .unwrap();
+        assert_eq!(vars.get("threshold"), Some(&Bson::Int32(42)));
+        assert!(command_vars(Some(&doc! {"Upper": 1}), now).is_err());
+        assert!(command_vars(Some(&doc! {"x": "$field"}), now).is_ok());
+
+        let bound = bind_vars(
+            &bson!({"$and": [
+                {"$gt": ["$qty", "$$threshold"]},
+                {"$lte": ["$qty", "$$limits.max"]},
+                {"$lt": ["$at", "$$NOW"]},
+                {"$let": {"vars": {"threshold": 0}, "in": "$$threshold"}},
+                {"$map": {"input": "$xs", "as": "threshold", "in": "$$threshold"}},
+                "$$ROOT",
+            ]}),
+            &vars,
+        );
+        assert_eq!(
+            bound,
+            bson!({"$and": [
+                {"$gt": ["$qty", {"$literal": 42}]},
+                {"$lte": ["$qty", {"$literal": 9}]},
+                {"$lt": ["$at", {"$literal": now}]},
+                {"$let": {"vars": {"threshold": 0}, "in": "$$threshold"}},
+                {"$map": {"input": "$xs", "as": "threshold", "in": "$$threshold"}},
+                "$$ROOT",
+            ]})
+        );
+
+        let filter = bind_filter_vars(
+            &doc! {"a": "$$threshold", "$or": [{"$expr": {"$eq": ["$a", "$$threshold"]}}]},
+            &vars,
+        );
+        // Only $expr is an expression; elsewhere `$$threshold` is a plain string
+        assert_eq!(
+            filter,
+            doc! {"a": "$$threshold", "$or": [{"$expr": {"$eq": ["$a", {"$literal": 42}]}}]}
+        );
+        assert!(matches_expr(
+            &doc! {"a": 42},
+            filter.get_array("$or").unwrap()[0]
+                .as_document()
+                .unwrap()
+                .get("$expr")
+                .unwrap()
+        ));
+    }
+
+    #[test]
+    fn date_add_and_subtract() {
+        let date = |s: &str| Bson::DateTime(bson::DateTime::parse_rfc3339_str(s).unwrap());
+        let doc = doc! {"d": date("2024-01-31T10:00:00Z")};
+        assert_eq!(
+            eval(
+                bson!({"$dateAdd": {"startDate": "$d", "unit": "month", "amount": 1}}),
+                doc.clone()
+            ),
+            date("2024-02-29T10:00:00Z")
+        );
+        assert_eq!(
+            eval(
+                bson!({"$dateSubtract": {"startDate": "$d", "unit": "week", "amount": 2i64}}),
+                doc.clone()
+            ),
+            date("2024-01-17T10:00:00Z")
+        );
+        assert_eq!(
+            eval(
+                bson!({"$dateAdd": {"startDate": "$d", "unit": "hour", "amount": 3.0, "timezone": "+05:30"}}),
+                doc.clone()
+            ),
+            date("2024-01-31T13:00:00Z")
+        );
+        // Calendar steps follow the local date: 2024-02-29T20:00Z is already March 1 in
+        // Tokyo, so a month later is April 1 there rather than March 29
+        let leap_evening = doc! {"d": date("2024-02-29T20:00:00Z")};
+        assert_eq!(
+            eval(
+                bson!({"$dateAdd": {"startDate": "$d", "unit": "month", "amount": 1}}),
+                leap_evening.clone()
+            ),
+            date("2024-03-29T20:00:00Z")
+        );
+        assert_eq!(
+            eval(
+                bson!({"$dateAdd": {"startDate": "$d", "unit": "month", "amount": 1, "timezone": "+09:00"}}),
+                leap_evening
+            ),
+            date("2024-03-31T20:00:00Z")
+        );
+        for missing in [
+            bson!({"$dateAdd": {"startDate": "$nope", "unit": "day", "amount": 1}}),
+            bson!({"$dateAdd": {"startDate": "$d", "unit": null, "amount": 1}}),
+            bson!({"$dateAdd": {"startDate": "$d", "unit": "day", "amount": 1, "timezone": null}}),
+        ] {
+            assert_eq!(eval(missing, doc.clone()), Bson::Null);
+        }
+
+        let ctx = ExprEvalContext::new(doc.clone(), doc);
+        for bad in [
+            bson!({"$dateAdd": {"startDate": "$d", "unit": "fortnight", "amount": 1}}),
+            bson!({"$dateAdd": {"startDate": "$d", "unit": "day", "amount": 1.5}}),
+            bson!({"$dateAdd": {"startDate": "$d", "unit": "day", "amount": "1"}}),
+            bson!({"$dateAdd": {"startDate": "2024-01-01", "unit": "day", "amount": 1}}),
+            bson!({"$dateAdd": {"startDate": "$d", "unit": "day", "amount": 1, "timezone": "Nowhere/Special"}}),
+            bson!({"$dateAdd": {"startDate": "$d", "unit": "year", "amount": 1_000_000_000_000i64}}),
+        ] {
+            assert!(
+                eval_expr(&parse_expr(&bad).unwrap(), &ctx).is_err(),
+                "{}",
+                bad
+            );
+        }
+        assert!(parse_expr(&bson!({"$dateAdd": {"startDate": "$d", "unit": "day"}})).is_err());
+    }
+
+    #[test]
+    fn rand_draws_per_evaluation() {
+        let expr = parse_expr(&bson!({"$rand": {}})).unwrap();
+        let ctx = ExprEvalContext::new(doc! {}, doc! {});
+        let draws: Vec<f64> = (0..200)
+            .map(|_| match eval_expr(&expr, &ctx).unwrap() {
+                Bson::Double(v) => v,
+                other => panic!("{:?}", other),
+            })
+            .collect();
+        assert!(draws.iter().all(|v| (0.0..1.0).contains(v)));
+        assert!(draws.windows(2).any(|w| w[0] != w[1]));
+        assert!(parse_expr(&bson!({"$rand": {"seed": 1}})).is_err());
+        assert!(parse_expr(&bson!({"$rand": []})).is_err());
+    }
+
+    #[test]
+    fn date_diff_counts_unit_boundaries() {
+        let date = |s: &str| Bson::DateTime(bson::DateTime::parse_rfc3339_str(s).unwrap());
+        let diff = |start: &str, end: &str, unit: &str, extra: Document| {
+            let mut spec = doc! {"startDate": "$s", "endDate": "$e", "unit": unit};
+            spec.extend(extra);
+            eval(
+                bson!({"$dateDiff": spec}),
+                doc! {"s": date(start), "e": date(end)},
+            )
+        };
+        assert_eq!(
+            diff(
+                "2024-01-31T23:00:00Z",
+                "2024-02-01T01:00:00Z",
+                "month",
+                doc! {}
+            ),
+            Bson::Int64(1)
+        );
+        assert_eq!(
+            diff(
+                "2024-02-01T00:00:00Z",
+                "2024-02-29T23:00:00Z",
+                "month",
+                doc! {}
+            ),
+            Bson::Int64(0)
+        );
+        // In Tokyo both instants are already February 1
+        assert_eq!(
+            diff(
+                "2024-01-31T23:00:00Z",
+                "2024-02-01T01:00:00Z",
+                "month",
+                doc! {"timezone": "+09:00"}
+            ),
+            Bson::Int64(0)
+        );
+        // Saturday to Sunday starts a new week only when weeks start on Sunday
+        assert_eq!(
+            diff(
+                "2024-01-06T12:00:00Z",
+                "2024-01-07T12:00:00Z",
+                "week",
+                doc! {}
+            ),
+            Bson::Int64(1)
+        );
+        assert_eq!(
+            diff(
+                "2024-01-06T12:00:00Z",
+                "2024-01-07T12:00:00Z",
+                "week",
+                doc! {"startOfWeek": "MON"}
+            ),
+            Bson::Int64(0)
+        );
+        assert_eq!(
+            diff(
+                "2024-01-07T00:00:00Z",
+                "2024-01-06T00:00:00Z",
+                "day",
+                doc! {}
+            ),
+            Bson::Int64(-1)
+        );
+        assert_eq!(
+            diff(
+                "2024-01-06T12:00:00Z",
+                "2024-01-07T12:00:00Z",
+                "week",
+                doc! {"startOfWeek": null}
+            ),
+            Bson::Null
+        );
+
+        let ctx = ExprEvalContext::new(doc! {"s": 1}, doc! {"s": 1});
+        for bad in [
+            bson!({"$dateDiff": {"startDate": "$$NOW", "endDate": "$s", "unit": "day"}}),
+            bson!({"$dateDiff": {"startDate": {"$toDate": 0}, "endDate": {"$toDate": 0}, "unit": "day", "startOfWeek": "someday"}}),
+        ] {
+            assert!(
+                eval_expr(&parse_expr(&bad).unwrap(), &ctx).is_err(),
+                "{}",
+                bad
+            );
+        }
+        assert!(
+            parse_expr(&bson!({"$dateDiff": {"startDate": "$s", "endDate": "$e", "unit": "day", "round": 1}}))
+                .is_err()
+        );
+    }
+
+    #[test]
+    fn date_add_days_keep_wall_clock_across_dst() {
+        if !std::path::Path::new("/usr/share/zoneinfo/America/New_York").exists()
+            && std::env::var("TZDIR").is_err()
+        {
+            eprintln!("skipping: no zoneinfo database");
+            return;
+        }
+        let date = |s: &str| Bson::DateTime(bson::DateTime::parse_rfc3339_str(s).unwrap());
+        // Noon EST the day before clocks spring forward
+        let doc = doc! {"d": date("2024-03-09T17:00:00Z")};
+        let add = |unit: &str| {
+            bson!({"$dateAdd": {
+                "startDate": "$d", "unit": unit, "amount": 1, "timezone": "America/New_York",
+            }})
+        };
+        // A calendar day later it is noon EDT, 23 hours on
+        assert_eq!(eval(add("day"), doc.clone()), date("2024-03-10T16:00:00Z"));
+        // Hours stay fixed durations
+        assert_eq!(
+            eval(
+                bson!({"$dateAdd": {"startDate": "$d", "unit": "hour", "amount": 24, "timezone": "America/New_York"}}),
+                doc.clone()
+            ),
+            date("2024-03-10T17:00:00Z")
+        );
+        // Back across the autumn change: noon EDT on November 2 to noon EST on November 3
+        let doc = doc! {"d": date("2024-11-02T16:00:00Z")};
+        assert_eq!(eval(add("day"), doc), date("2024-11-03T17:00:00Z"));
+    }
+
+    #[test]
+    fn sort_array_composes_in_add_fields() {
+        let docs = vec![doc! {"xs": [{"v": 2}, {"v": 1}]}];
+        let spec = doc! {"sorted": {"$sortArray": {"input": "$xs", "sortBy": {"v": 1}}}};
+        let out =
+            crate::aggregation::stages::add_fields::execute(docs, &spec, &HashMap::new()).unwrap();
+        assert_eq!(out[0].get("sorted").unwrap(), &bson!([{"v": 1}, {"v": 2}]));
+    }
+}
@@ -1,6 +1,20 @@
-use bson::Document;
+use bson::{Bson, Document};
 use std::path::PathBuf;
 
+/// Memory a blocking stage may use without `allowDiskUse` (MongoDB's 100MB).
+pub const DEFAULT_AGGREGATION_MEMORY_LIMIT_BYTES: usize = 100 * 1024 * 1024;
+
+/// A blocking stage would hold more than the memory limit and `allowDiskUse` is false.
+/// Reported as `QueryExceededMemoryLimitNoDiskUseAllowed` (code 292).
+#[derive(Debug, thiserror::Error)]
+#[error(
+    "{stage} exceeded memory limit of {limit_bytes} bytes, but didn't allow external sort. Pass allowDiskUse:true to opt in."
+)]
+pub struct MemoryLimitExceeded {
+    pub stage: &'static str,
+    pub limit_bytes: usize,
+}
+
 /// Memory manager for aggregation operations
 pub struct MemoryManager {
     limit_bytes: usize,
@@ -13,7 +27,7 @@ impl MemoryManager {
     /// Create a new memory manager with MongoDB defaults (100MB)
     pub fn new(allow_disk_use: bool) -> Self {
         Self {
-            limit_bytes: 100 * 1024 * 1024, // 100MB default
+            limit_bytes: DEFAULT_AGGREGATION_MEMORY_LIMIT_BYTES,
             allow_disk_use,
             _temp_dir: std::env::temp_dir(),
             current_usage: 0,
@@ -59,6 +73,47 @@ impl MemoryManager {
     pub fn limit(&self) -> usize {
         self.limit_bytes
     }
+
+    /// Fail when `docs`, about to be buffered by the blocking `stage`, exceed the limit and
+    /// disk use is not allowed.
+    pub fn check_blocking(
+        &self,
+        stage: &'static str,
+        docs: &[Document],
+    ) -> Result<(), MemoryLimitExceeded> {
+        if self.allow_disk_use {
+            return Ok(());
+        }
+        let mut total = self.current_usage;
+        for doc in docs {
+            total += approx_document_size(doc);
+            if total > self.limit_bytes {
+                return Err(MemoryLimitExceeded {
+                    stage,
+                    limit_bytes: self.limit_bytes,
+                });
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Rough in-memory footprint of `doc`: its BSON size plus per-value overhead.
+pub fn approx_document_size(doc: &Document) -> usize {
+    doc.iter()
+        .map(|(k, v)| k.len() + approx_value_size(v))
+        .sum::<usize>()
+        + 16
+}
+
+fn approx_value_size(v: &Bson) -> usize {
+    match v {
+        Bson::String(s) | Bson::Symbol(s) | Bson::JavaScriptCode(s) => s.len() + 24,
+        Bson::Document(d) => approx_document_size(d),
+        Bson::Array(items) => items.iter().map(approx_value_size).sum::<usize>() + 24,
+        Bson::Binary(b) => b.bytes.len() + 24,
+        _ => 16,
+    }
 }
 
 /// Temporary file stream for disk spill
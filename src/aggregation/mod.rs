@@ -1,10 +1,14 @@
 pub mod ast;
+pub mod convert;
+pub mod dates;
 pub mod exec;
 pub mod expr;
 pub mod memory;
 pub mod pipeline;
 pub mod sql;
 pub mod stages;
+pub mod timezone;
+pub mod update;
 pub mod values;
 
 pub use exec::{ExecContext, ExecResult, execute_pipeline};
@@ -29,7 +29,7 @@ impl AggregateOptions {
             bypass_document_validation: cmd.get_bool("bypassDocumentValidation").unwrap_or(false),
             read_concern: cmd.get_document("readConcern").ok().cloned(),
             write_concern: cmd.get_document("writeConcern").ok().cloned(),
-            explain: cmd.contains_key("explain"),
+            explain: cmd.get_bool("explain").unwrap_or(false),
         }
     }
 }
@@ -87,6 +87,7 @@ pub enum Stage {
         pipeline: Vec<Stage>,
     },
     GeoNear(crate::aggregation::stages::GeoNearSpec),
+    GraphLookup(crate::aggregation::stages::GraphLookupSpec),
     Out(String),
     Merge(crate::aggregation::stages::MergeSpec),
     SortByCount(Bson),
@@ -94,6 +95,52 @@ pub enum Stage {
     Densify(crate::aggregation::stages::DensifySpec),
     Fill(crate::aggregation::stages::FillSpec),
     Redact(Bson),
+    IndexStats,
+    CollStats(crate::aggregation::stages::CollStatsSpec),
+    /// Literal documents replacing the collection as the pipeline's source
+    Documents(Bson),
+    /// In-progress operations; the server replaces it with their documents
+    CurrentOp,
+}
+
+impl Stage {
+    /// The stage's operator, e.g. `$match`.
+    pub fn name(&self) -> &'static str {
+        match self {
+            Stage::Match(_) => "$match",
+            Stage::Project(_) => "$project",
+            Stage::AddFields(_) => "$addFields",
+            Stage::Set(_) => "$set",
+            Stage::Unset(_) => "$unset",
+            Stage::ReplaceRoot { .. } => "$replaceRoot",
+            Stage::ReplaceWith(_) => "$replaceWith",
+            Stage::Sort(_) => "$sort",
+            Stage::Limit(_) => "$limit",
+            Stage::Skip(_) => "$skip",
+            Stage::Count(_) => "$count",
+            Stage::Group { .. } => "$group",
+            Stage::Bucket { .. } => "$bucket",
+            Stage::BucketAuto { .. } => "$bucketAuto",
+            Stage::Lookup { .. } => "$lookup",
+            Stage::Unwind { .. } => "$unwind",
+            Stage::Sample(_) => "$sample",
+            Stage::Facet(_) => "$facet",
+            Stage::UnionWith { .. } => "$unionWith",
+            Stage::GeoNear(_) => "$geoNear",
+            Stage::GraphLookup(_) => "$graphLookup",
+            Stage::Out(_) => "$out",
+            Stage::Merge(_) => "$merge",
+            Stage::SortByCount(_) => "$sortByCount",
+            Stage::SetWindowFields(_) => "$setWindowFields",
+            Stage::Densify(_) => "$densify",
+            Stage::Fill(_) => "$fill",
+            Stage::Redact(_) => "$redact",
+            Stage::IndexStats => "$indexStats",
+            Stage::CollStats(_) => "$collStats",
+            Stage::Documents(_) => "$documents",
+            Stage::CurrentOp => "$currentOp",
+        }
+    }
 }
 
 /// Parsed pipeline
@@ -136,6 +183,34 @@ impl Pipeline {
                         ));
                     }
                 }
+                Stage::IndexStats => {
+                    if idx != 0 {
+                        return Err(anyhow::anyhow!(
+                            "$indexStats is only valid as the first stage in a pipeline"
+                        ));
+                    }
+                }
+                Stage::CollStats(_) => {
+                    if idx != 0 {
+                        return Err(anyhow::anyhow!(
+                            "$collStats is only valid as the first stage in a pipeline"
+                        ));
+                    }
+                }
+                Stage::Documents(_) => {
+                    if idx != 0 {
+                        return Err(anyhow::anyhow!(
+                            "$documents is only valid as the first stage in a pipeline"
+                        ));
+                    }
+                }
+                Stage::CurrentOp => {
+                    if idx != 0 {
+                        return Err(anyhow::anyhow!(
+                            "$currentOp is only valid as the first stage in a pipeline"
+                        ));
+                    }
+                }
                 Stage::Out(_) => {
                     if has_out || has_merge {
                         return Err(anyhow::anyhow!(
@@ -181,7 +256,7 @@ impl Pipeline {
     }
 
     /// Parse a single stage document
-    fn parse_stage(doc: &Document) -> anyhow::Result<Stage> {
+    pub(crate) fn parse_stage(doc: &Document) -> anyhow::Result<Stage> {
         if doc.is_empty() {
             return Err(anyhow::anyhow!("empty pipeline stage"));
         }
@@ -467,7 +542,11 @@ impl Pipeline {
 
                         // Check for forbidden stages in facet subpipeline
                         match &stage {
-                            Stage::Out(_) | Stage::Merge(_) | Stage::GeoNear(_) => {
+                            Stage::Out(_)
+                            | Stage::Merge(_)
+                            | Stage::GeoNear(_)
+                            | Stage::IndexStats
+                            | Stage::CollStats(_) => {
                                 return Err(anyhow::anyhow!(
                                     "{} stage not allowed in $facet subpipeline",
                                     stage_doc.keys().next().unwrap()
@@ -512,6 +591,10 @@ impl Pipeline {
                 let spec = crate::aggregation::stages::GeoNearSpec::parse(stage_value)?;
                 Ok(Stage::GeoNear(spec))
             }
+            "$graphLookup" => {
+                let spec = crate::aggregation::stages::GraphLookupSpec::parse(stage_value)?;
+                Ok(Stage::GraphLookup(spec))
+            }
             "$out" => {
                 let coll = if let Some(s) = stage_value.as_str() {
                     s.to_string()
@@ -542,14 +625,29 @@ impl Pipeline {
                 Ok(Stage::Fill(spec))
             }
             "$redact" => Ok(Stage::Redact(stage_value.clone())),
+            "$collStats" => {
+                let spec = crate::aggregation::stages::CollStatsSpec::parse(stage_value)?;
+                Ok(Stage::CollStats(spec))
+            }
+            "$indexStats" => {
+                crate::aggregation::stages::index_stats::parse(stage_value)?;
+                Ok(Stage::IndexStats)
+            }
+            "$documents" => Ok(Stage::Documents(stage_value.clone())),
+            "$currentOp" => match stage_value {
+                // Options such as `allUsers` and `idleConnections` do not change what a
+                // single server reports
+                Bson::Document(_) => Ok(Stage::CurrentOp),
+                _ => Err(anyhow::anyhow!("$currentOp options must be an object")),
+            },
             _ => Err(anyhow::anyhow!("Unknown pipeline stage: {}", stage_name)),
         }
     }
 
     /// Validate $match filter restrictions
     fn validate_match_filter(filter: &Document, is_first_stage: bool) -> anyhow::Result<()> {
-        // Check for $where (always forbidden)
-        if filter.contains_key("$where") {
+        // Check for $where (always forbidden), including under $and/$or/$nor
+        if filter.contains_key("$where") || crate::js::nested_where(filter) {
             return Err(anyhow::anyhow!("$where is not allowed in $match"));
         }
 
@@ -1,7 +1,8 @@
 use crate::aggregation::ast::AggregateStage;
 use crate::error::{Error, Result};
 use crate::translate::{
-    build_order_by, build_where_from_filter, escape_single, projection_pushdown_sql,
+    BoundSql, bind_sql, build_order_by, build_where_from_filter, escape_single, jsonpath_exists,
+    jsonpath_path, pg_path_literal, projection_pushdown_sql, sql_quote,
 };
 
 struct SelectState {
@@ -100,7 +101,19 @@ impl SqlBuilder {
         self.state.select = "id, doc".to_string();
     }
 
-    pub fn build(&mut self) -> Result<String> {
+    /// The pipeline as one statement, its values bound as parameters (see [`bind_sql`]).
+    pub fn build(&mut self) -> Result<BoundSql> {
+        let mut built = Ok(());
+        let stmt = bind_sql(0, || {
+            self.build_sql().unwrap_or_else(|e| {
+                built = Err(e);
+                String::new()
+            })
+        });
+        built.map(|()| stmt)
+    }
+
+    fn build_sql(&mut self) -> Result<String> {
         let stages = std::mem::take(&mut self.stages);
         for stage in stages {
             match stage {
@@ -157,33 +170,28 @@ impl SqlBuilder {
                     // Generate lateral join
                     let join_type = if preserve { "LEFT JOIN" } else { "CROSS JOIN" };
 
-                    let ordinality = if let Some(ref idx_field) = include {
-                        format!("WITH ORDINALITY AS elem(value, {})", idx_field)
+                    // The ordinality column has a fixed name; `includeArrayIndex` only
+                    // names the output field
+                    let ordinality = if include.is_some() {
+                        "WITH ORDINALITY AS elem(value, idx)"
                     } else {
-                        "AS elem(value)".to_string()
+                        "AS elem(value)"
                     };
 
-                    // Correct path format for jsonb_array_elements path
-                    let path_segments: Vec<String> = path.split('.').map(escape_single).collect();
-                    let path_pg_fmt = format!("{{{}}}", path_segments.join(","));
-
+                    let pg_path = pg_path_literal(&path);
                     let join_clause = format!(
-                        "{} LATERAL jsonb_array_elements(doc #> '{}') {}",
-                        join_type,
-                        escape_single(&path_pg_fmt),
-                        ordinality
+                        "{} LATERAL jsonb_array_elements(doc #> {}) {}",
+                        join_type, pg_path, ordinality
                     );
 
                     // Post-unwind select list construction
-                    let set_path = path.split('.').collect::<Vec<&str>>();
-                    let pg_path = format!("'{{{}}}'", set_path.join(","));
-
                     let mut new_doc_expr = format!("jsonb_set(doc, {}, elem.value)", pg_path);
 
                     if let Some(idx_field) = include {
                         new_doc_expr = format!(
-                            "jsonb_set({}, '{{{}}}', to_jsonb(elem.{} - 1))",
-                            new_doc_expr, idx_field, idx_field
+                            "jsonb_set({}, {}, to_jsonb(elem.idx - 1))",
+                            new_doc_expr,
+                            pg_path_literal(&idx_field)
                         );
                     }
 
@@ -211,7 +219,7 @@ impl SqlBuilder {
                         .ok_or(Error::Msg("Unsupported group _id expr".into()))?;
 
                     let mut json_pairs = Vec::new();
-                    json_pairs.push("_id".to_string());
+                    json_pairs.push(sql_quote("_id"));
                     json_pairs.push(group_key_sql.clone());
 
                     for (k, v) in spec.iter() {
@@ -242,7 +250,7 @@ impl SqlBuilder {
                                     )));
                                 }
                             };
-                            json_pairs.push(k.to_string());
+                            json_pairs.push(sql_quote(k));
                             json_pairs.push(acc_sql);
                         }
                     }
@@ -283,19 +291,13 @@ impl SqlBuilder {
                     let new_root_sql = match new_root {
                         bson::Bson::String(s) if s.starts_with('$') => {
                             let path = &s[1..];
-                            let segs: Vec<String> = path.split('.').map(escape_single).collect();
-                            let path_str = segs.join("','");
-                            format!("doc #> '{{\"{}\"}}'", path_str)
+                            format!("doc #> {}", pg_path_literal(path))
                         }
                         bson::Bson::Document(d) => {
                             let mut json_pairs = Vec::new();
                             for (k, v) in d.iter() {
                                 if let Some(sql_expr) = translate_expr(v) {
-                                    json_pairs.push(format!(
-                                        "'{}', {}",
-                                        escape_single(k),
-                                        sql_expr
-                                    ));
+                                    json_pairs.push(format!("{}, {}", sql_quote(k), sql_expr));
                                 } else {
                                     return Err(Error::Msg(format!(
                                         "Unsupported expression in $replaceRoot newRoot: {:?}",
@@ -347,10 +349,7 @@ impl SqlBuilder {
                 AggregateStage::GeoNear(spec) => {
                     // $geoNear must be first stage - this is enforced at pipeline validation time
                     // Build distance calculation SQL
-                    let jsonb_path = format!(
-                        "doc->'{}'",
-                        spec.key.replace('"', "\"\"").replace('\'', "''")
-                    );
+                    let jsonb_path = format!("doc->'{}'", escape_single(&spec.key));
 
                     let distance_expr = if spec.spherical {
                         // Haversine distance in meters
@@ -374,12 +373,10 @@ impl SqlBuilder {
                     };
 
                     // Build WHERE clause with query filter and maxDistance
+                    let key_path = jsonpath_path(&spec.key);
                     let mut where_clauses = vec![
-                        format!(
-                            "jsonb_path_exists(doc, '$.\"{}\".type ? (@ == \"Point\")')",
-                            spec.key
-                        ),
-                        format!("jsonb_path_exists(doc, '$.\"{}\".coordinates')", spec.key),
+                        jsonpath_exists(&format!("{}.type ? (@ == \"Point\")", key_path)),
+                        jsonpath_exists(&format!("{}.coordinates", key_path)),
                     ];
 
                     // Add query filter if present
@@ -405,7 +402,7 @@ impl SqlBuilder {
                     let sql = format!(
                         "SELECT id, doc, {} AS \"{}\" FROM {} WHERE {} ORDER BY {} ASC",
                         distance_expr,
-                        spec.distance_field,
+                        spec.distance_field.replace('"', "\"\""),
                         self.current_cte,
                         where_sql,
                         distance_expr
@@ -440,10 +437,7 @@ fn translate_expr(v: &bson::Bson) -> Option<String> {
     match v {
         bson::Bson::String(s) if s.starts_with('$') => {
             let path = &s[1..];
-            // Escape single quotes in path segments
-            let segs: Vec<String> = path.split('.').map(escape_single).collect();
-            let path_str = segs.join("','"); // e.g. 'a','b'
-            Some(format!("doc #> '{{\"{}\"}}'", path_str))
+            Some(format!("doc #> {}", pg_path_literal(path)))
         }
         bson::Bson::Int32(n) => Some(n.to_string()),
         bson::Bson::Int64(n) => Some(n.to_string()),
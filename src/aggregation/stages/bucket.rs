@@ -160,7 +160,8 @@ fn compute_bucket_accumulator(
                     | AccumulatorType::Avg
                     | AccumulatorType::Min
                     | AccumulatorType::Max
-                    | AccumulatorType::Push => {
+                    | AccumulatorType::Push
+                    | AccumulatorType::MergeObjects => {
                         state.values.push(value);
                     }
                 }
@@ -180,11 +181,15 @@ fn compute_bucket_accumulator_result(state: &AccumulatorState) -> anyhow::Result
         AccumulatorType::Sum => {
             let mut sum_i128: i128 = 0;
             let mut has_double = false;
+            let mut saw_long = false;
             let mut sum_double: f64 = 0.0;
             for val in &state.values {
                 match val {
                     Bson::Int32(n) => sum_i128 += *n as i128,
-                    Bson::Int64(n) => sum_i128 += *n as i128,
+                    Bson::Int64(n) => {
+                        saw_long = true;
+                        sum_i128 += *n as i128;
+                    }
                     Bson::Double(n) => {
                         has_double = true;
                         sum_double += *n;
@@ -194,12 +199,10 @@ fn compute_bucket_accumulator_result(state: &AccumulatorState) -> anyhow::Result
             }
             if has_double {
                 Ok(Bson::Double(sum_double + sum_i128 as f64))
-            } else if sum_i128 >= i32::MIN as i128 && sum_i128 <= i32::MAX as i128 {
-                Ok(Bson::Int32(sum_i128 as i32))
-            } else if sum_i128 >= i64::MIN as i128 && sum_i128 <= i64::MAX as i128 {
-                Ok(Bson::Int64(sum_i128 as i64))
             } else {
-                Ok(Bson::Double(sum_i128 as f64))
+                Ok(crate::aggregation::values::integer_result(
+                    sum_i128, saw_long,
+                ))
             }
         }
         AccumulatorType::Avg => compute_accumulator(state),
@@ -208,6 +211,7 @@ fn compute_bucket_accumulator_result(state: &AccumulatorState) -> anyhow::Result
         AccumulatorType::First => compute_accumulator(state),
         AccumulatorType::Last => compute_accumulator(state),
         AccumulatorType::Push => compute_accumulator(state),
+        AccumulatorType::MergeObjects => compute_accumulator(state),
     }
 }
 
@@ -142,7 +142,8 @@ fn compute_bucket_accumulator(
                     | AccumulatorType::Avg
                     | AccumulatorType::Min
                     | AccumulatorType::Max
-                    | AccumulatorType::Push => {
+                    | AccumulatorType::Push
+                    | AccumulatorType::MergeObjects => {
                         state.values.push(value);
                     }
                 }
@@ -0,0 +1,226 @@
+use crate::store::{CollectionStats, PgStore};
+use bson::{Bson, Document, doc};
+
+/// $collStats stage specification
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct CollStatsSpec {
+    pub latency_stats: bool,
+    /// `storageStats.scale`, when storage statistics are requested
+    pub storage_scale: Option<i64>,
+    pub count: bool,
+}
+
+impl CollStatsSpec {
+    pub fn parse(value: &Bson) -> anyhow::Result<Self> {
+        let doc = value
+            .as_document()
+            .ok_or_else(|| anyhow::anyhow!("$collStats value must be a document"))?;
+        let mut spec = Self::default();
+        for (k, v) in doc {
+            match k.as_str() {
+                "latencyStats" => {
+                    v.as_document().ok_or_else(|| {
+                        anyhow::anyhow!("$collStats latencyStats must be a document")
+                    })?;
+                    spec.latency_stats = true;
+                }
+                "storageStats" => {
+                    let opts = v.as_document().ok_or_else(|| {
+                        anyhow::anyhow!("$collStats storageStats must be a document")
+                    })?;
+                    let scale = match opts.get("scale") {
+                        None => 1,
+                        Some(Bson::Int32(n)) => *n as i64,
+                        Some(Bson::Int64(n)) => *n,
+                        Some(Bson::Double(n)) if n.fract() == 0.0 => *n as i64,
+                        Some(_) => {
+                            return Err(anyhow::anyhow!(
+                                "$collStats storageStats scale must be a number"
+                            ));
+                        }
+                    };
+                    if scale < 1 {
+                        return Err(anyhow::anyhow!(
+                            "$collStats storageStats scale must be >= 1"
+                        ));
+                    }
+                    spec.storage_scale = Some(scale);
+                }
+                "count" => {
+                    v.as_document()
+                        .ok_or_else(|| anyhow::anyhow!("$collStats count must be a document"))?;
+                    spec.count = true;
+                }
+                // Accepted for compatibility; OxideDB keeps no per-collection query stats
+                "queryExecStats" => {}
+                other => {
+                    return Err(anyhow::anyhow!(
+                        "unrecognized option to $collStats: {}",
+                        other
+                    ));
+                }
+            }
+        }
+        Ok(spec)
+    }
+}
+
+/// The single statistics document for `db.coll`.
+pub async fn execute(
+    pg: &PgStore,
+    db: &str,
+    coll: &str,
+    spec: &CollStatsSpec,
+) -> anyhow::Result<Vec<Document>> {
+    let stats = if spec.latency_stats || spec.storage_scale.is_some() || spec.count {
+        match pg.collection_stats(db, coll).await? {
+            Some(s) => Some(s),
+            None => {
+                return Err(anyhow::anyhow!(
+                    "Unable to retrieve statistics in $collStats stage :: Collection [{}.{}] not found.",
+                    db,
+                    coll
+                ));
+            }
+        }
+    } else {
+        None
+    };
+    Ok(vec![stats_doc(db, coll, spec, stats.as_ref())])
+}
+
+fn stats_doc(
+    db: &str,
+    coll: &str,
+    spec: &CollStatsSpec,
+    stats: Option<&CollectionStats>,
+) -> Document {
+    let mut out = doc! {
+        "ns": format!("{}.{}", db, coll),
+        "localTime": bson::DateTime::now(),
+    };
+    let Some(stats) = stats else {
+        return out;
+    };
+    if spec.latency_stats {
+        // PostgreSQL counts table activity but not its latency
+        out.insert(
+            "latencyStats",
+            doc! {
+                "reads": {"latency": 0i64, "ops": stats.reads},
+                "writes": {"latency": 0i64, "ops": stats.writes},
+                "commands": {"latency": 0i64, "ops": 0i64},
+                "transactions": {"latency": 0i64, "ops": 0i64},
+            },
+        );
+    }
+    if let Some(scale) = spec.storage_scale {
+        out.insert("storageStats", storage_stats(stats, scale));
+    }
+    if spec.count {
+        out.insert("count", stats.count);
+    }
+    out
+}
+
+fn storage_stats(stats: &CollectionStats, scale: i64) -> Document {
+    let mut index_sizes = Document::new();
+    let mut total_index_size = 0i64;
+    for idx in &stats.indexes {
+        index_sizes.insert(idx.name.clone(), idx.size / scale);
+        total_index_size += idx.size;
+    }
+    let avg_obj_size = if stats.count > 0 {
+        stats.size / stats.count
+    } else {
+        0
+    };
+    doc! {
+        "size": stats.size / scale,
+        "count": stats.count,
+        "avgObjSize": avg_obj_size,
+        "storageSize": stats.storage_size / scale,
+        "nindexes": stats.indexes.len() as i32,
+        "totalIndexSize": total_index_size / scale,
+        "totalSize": (stats.storage_size + total_index_size) / scale,
+        "indexSizes": index_sizes,
+        "scaleFactor": scale,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::store::IndexUsage;
+
+    fn index(name: &str, size: i64) -> IndexUsage {
+        IndexUsage {
+            name: name.into(),
+            spec: doc! {"name": name},
+            ops: 0,
+            since_ms: 0,
+            size,
+        }
+    }
+
+    #[test]
+    fn parse_options() {
+        let spec = CollStatsSpec::parse(&Bson::Document(doc! {
+            "latencyStats": {"histograms": true},
+            "storageStats": {"scale": 1024},
+            "count": {},
+        }))
+        .unwrap();
+        assert_eq!(
+            spec,
+            CollStatsSpec {
+                latency_stats: true,
+                storage_scale: Some(1024),
+                count: true,
+            }
+        );
+        assert_eq!(
+            CollStatsSpec::parse(&Bson::Document(doc! {"storageStats": {}}))
+                .unwrap()
+                .storage_scale,
+            Some(1)
+        );
+        assert!(
+            CollStatsSpec::parse(&Bson::Document(doc! {"storageStats": {"scale": 0}})).is_err()
+        );
+        assert!(CollStatsSpec::parse(&Bson::Document(doc! {"bogus": {}})).is_err());
+        assert!(CollStatsSpec::parse(&Bson::Int32(1)).is_err());
+    }
+
+    #[test]
+    fn storage_stats_are_scaled() {
+        let stats = CollectionStats {
+            count: 4,
+            size: 4096,
+            storage_size: 16384,
+            indexes: vec![index("_id_", 8192), index("a_1", 16384)],
+            reads: 3,
+            writes: 4,
+        };
+        let spec = CollStatsSpec {
+            storage_scale: Some(1024),
+            count: true,
+            ..Default::default()
+        };
+        let d = stats_doc("app", "users", &spec, Some(&stats));
+        assert_eq!(d.get_str("ns").unwrap(), "app.users");
+        assert_eq!(d.get_i64("count").unwrap(), 4);
+        assert!(!d.contains_key("latencyStats"));
+        let s = d.get_document("storageStats").unwrap();
+        assert_eq!(s.get_i64("size").unwrap(), 4);
+        assert_eq!(s.get_i64("avgObjSize").unwrap(), 1024);
+        assert_eq!(s.get_i64("storageSize").unwrap(), 16);
+        assert_eq!(s.get_i32("nindexes").unwrap(), 2);
+        assert_eq!(s.get_i64("totalIndexSize").unwrap(), 24);
+        assert_eq!(s.get_i64("totalSize").unwrap(), 40);
+        assert_eq!(
+            s.get_document("indexSizes").unwrap(),
+            &doc! {"_id_": 8i64, "a_1": 16i64}
+        );
+    }
+}
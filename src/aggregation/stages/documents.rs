@@ -0,0 +1,56 @@
+use crate::aggregation::expr::{ExprEvalContext, eval_expr, parse_expr};
+use bson::{Bson, Document};
+use std::collections::HashMap;
+
+/// The documents a `$documents` stage produces. A literal array is taken as is; any other
+/// expression (`$$docs`, `$literal`, ...) is evaluated once and must yield an array.
+pub fn execute(spec: &Bson, vars: &HashMap<String, Bson>) -> anyhow::Result<Vec<Document>> {
+    let value = match spec {
+        Bson::Array(_) => spec.clone(),
+        _ => {
+            let ctx = ExprEvalContext::with_vars(Document::new(), Document::new(), vars.clone());
+            eval_expr(&parse_expr(spec)?, &ctx)?
+        }
+    };
+    let Bson::Array(items) = value else {
+        return Err(anyhow::anyhow!(
+            "$documents requires an array of objects, found {}",
+            crate::bson_type::alias_of(&value)
+        ));
+    };
+    items
+        .into_iter()
+        .map(|item| match item {
+            Bson::Document(d) => Ok(d),
+            other => Err(anyhow::anyhow!(
+                "$documents requires an array of objects, found an element of type {}",
+                crate::bson_type::alias_of(&other)
+            )),
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    #[test]
+    fn literal_arrays_and_variables_produce_documents() {
+        let spec = Bson::Array(vec![doc! {"x": 1}.into(), doc! {"x": 2}.into()]);
+        assert_eq!(
+            execute(&spec, &HashMap::new()).unwrap(),
+            vec![doc! {"x": 1}, doc! {"x": 2}]
+        );
+
+        let mut vars = HashMap::new();
+        vars.insert("docs".to_string(), Bson::Array(vec![doc! {"y": 1}.into()]));
+        assert_eq!(
+            execute(&Bson::String("$$docs".into()), &vars).unwrap(),
+            vec![doc! {"y": 1}]
+        );
+
+        assert!(execute(&Bson::Int32(1), &HashMap::new()).is_err());
+        assert!(execute(&Bson::Array(vec![Bson::Int32(1)]), &HashMap::new()).is_err());
+    }
+}
@@ -1,6 +1,8 @@
+use crate::aggregation::exec::ENGINE_READ_LIMIT;
+use crate::aggregation::stages::set::set_path_nested;
+use crate::error_codes::{BAD_VALUE, INDEX_NOT_FOUND};
 use crate::store::PgStore;
 use bson::{Bson, Document};
-use std::cmp::Ordering;
 
 /// $geoNear stage specification
 #[derive(Debug, Clone)]
@@ -67,9 +69,13 @@ impl GeoNearSpec {
             .map_err(|_| anyhow::anyhow!("$geoNear requires distanceField"))?
             .to_string();
 
+        if !longitude.is_finite() || !latitude.is_finite() {
+            return Err(anyhow::anyhow!("$geoNear near coordinates must be finite"));
+        }
+
         let spherical = doc.get_bool("spherical").unwrap_or(false);
-        let max_distance = doc.get_f64("maxDistance").ok();
-        let min_distance = doc.get_f64("minDistance").ok();
+        let max_distance = distance_arg(doc, "maxDistance")?;
+        let min_distance = distance_arg(doc, "minDistance")?;
         let query = doc.get_document("query").ok().cloned();
         let include_locs = doc.get_str("includeLocs").ok().map(|s| s.to_string());
         let key = doc.get_str("key").ok().map(|s| s.to_string());
@@ -89,143 +95,111 @@ impl GeoNearSpec {
     }
 }
 
+/// `maxDistance`/`minDistance`: a non-negative number of meters, if given.
+fn distance_arg(doc: &Document, key: &str) -> anyhow::Result<Option<f64>> {
+    let value = match doc.get(key) {
+        None | Some(Bson::Null) => return Ok(None),
+        Some(Bson::Double(v)) => *v,
+        Some(Bson::Int32(v)) => *v as f64,
+        Some(Bson::Int64(v)) => *v as f64,
+        Some(_) => return Err(anyhow::anyhow!("$geoNear {} must be a number", key)),
+    };
+    if !value.is_finite() || value < 0.0 {
+        return Err(anyhow::anyhow!(
+            "$geoNear {} must be a non-negative number",
+            key
+        ));
+    }
+    Ok(Some(value))
+}
+
+/// `$geoNear` could not pick the 2dsphere index holding its points: there is none on the
+/// collection or on `key` (MongoDB's code 27, `IndexNotFound`), or there are several and
+/// no `key` says which (code 2).
+#[derive(Debug, thiserror::Error)]
+#[error("{message}")]
+pub struct GeoIndexError {
+    pub code: i32,
+    pub message: String,
+}
+
+/// Documents nearest to `near` first, with their distance in meters on the sphere stored
+/// in `distanceField`. PostgreSQL filters, measures and orders them (see
+/// [`PgStore::geo_near_docs`]); the points are read from the field of the collection's
+/// 2dsphere index, or from `key` when there are several.
 pub async fn execute(
-    docs: Vec<Document>,
     pg: &PgStore,
     db: &str,
     coll: &str,
     spec: &GeoNearSpec,
 ) -> anyhow::Result<Vec<Document>> {
-    // If we don't have documents yet, fetch from collection
-    let docs = if docs.is_empty() {
-        // Build query filter if specified
-        let filter = spec.query.clone();
-        pg.find_docs(db, coll, filter.as_ref(), None, None, 100_000)
-            .await?
-    } else {
-        docs
-    };
-
-    // Calculate distances for each document
-    let mut docs_with_distance: Vec<(Document, f64)> = Vec::new();
-
-    for doc in docs {
-        // Get the location field from the document
-        // The key field specifies which field contains the GeoJSON point
-        let location = if let Some(ref key) = spec.key {
-            doc.get(key).cloned()
-        } else {
-            // Try to find a 2dsphere index field or look for common location fields
-            doc.get("location")
-                .or_else(|| doc.get("geo"))
-                .or_else(|| doc.get("coordinates"))
-                .cloned()
-        };
-
-        let distance = if let Some(loc) = location {
-            calculate_distance(&spec.near, &loc, spec.spherical)
-        } else {
-            f64::MAX
-        };
-
-        // Apply min/max distance filters
-        if let Some(min) = spec.min_distance
-            && distance < min
-        {
-            continue;
-        }
-        if let Some(max) = spec.max_distance
-            && distance > max
-        {
-            continue;
-        }
-
-        docs_with_distance.push((doc, distance));
-    }
-
-    // Sort by distance
-    docs_with_distance.sort_by(|a, b| a.1.partial_cmp(&b.1).unwrap_or(Ordering::Equal));
-
-    // Build result documents with distance field
-    let mut result = Vec::new();
-
-    for (mut doc, distance) in docs_with_distance {
-        // Apply distance multiplier if specified
-        let final_distance = if let Some(multiplier) = spec.distance_multiplier {
-            distance * multiplier
-        } else {
-            distance
-        };
-
-        // Add distance field
-        doc.insert(&spec.distance_field, Bson::Double(final_distance));
-
-        // Add location field if requested
+    let field = geo_index_field(pg, db, coll, spec.key.as_deref()).await?;
+    let near = pg
+        .geo_near_docs(
+            db,
+            coll,
+            &field,
+            spec.near.longitude,
+            spec.near.latitude,
+            spec.query.as_ref(),
+            spec.min_distance,
+            spec.max_distance,
+            ENGINE_READ_LIMIT,
+        )
+        .await?;
+
+    let mut result = Vec::with_capacity(near.len());
+    for (mut doc, distance) in near {
+        let distance = spec
+            .distance_multiplier
+            .map_or(distance, |multiplier| distance * multiplier);
         if let Some(ref include_locs) = spec.include_locs
-            && let Some(ref key) = spec.key
-            && let Some(loc) = doc.get(key)
+            && let Some(loc) = doc.get(&field).cloned()
         {
-            doc.insert(include_locs, loc.clone());
+            set_path_nested(&mut doc, include_locs, loc);
         }
-
+        set_path_nested(&mut doc, &spec.distance_field, Bson::Double(distance));
         result.push(doc);
     }
-
     Ok(result)
 }
 
-fn calculate_distance(near: &GeoJSONPoint, location: &Bson, spherical: bool) -> f64 {
-    // Extract coordinates from location
-    let (lon, lat) = match location {
-        Bson::Document(doc) => {
-            // GeoJSON format
-            if let Ok(coords) = doc.get_array("coordinates") {
-                if coords.len() >= 2 {
-                    let lon = coords[0]
-                        .as_f64()
-                        .or_else(|| coords[0].as_i64().map(|v| v as f64))
-                        .unwrap_or(0.0);
-                    let lat = coords[1]
-                        .as_f64()
-                        .or_else(|| coords[1].as_i64().map(|v| v as f64))
-                        .unwrap_or(0.0);
-                    (lon, lat)
-                } else {
-                    return f64::MAX;
-                }
-            } else {
-                return f64::MAX;
-            }
+/// The field `$geoNear` reads points from: `key` when given, which must carry a 2dsphere
+/// index, else the collection's only 2dsphere-indexed field.
+async fn geo_index_field(
+    pg: &PgStore,
+    db: &str,
+    coll: &str,
+    key: Option<&str>,
+) -> anyhow::Result<String> {
+    let fields = pg.geo_index_fields(db, coll).await?;
+    match (key, fields.as_slice()) {
+        (Some(key), _) if fields.iter().any(|f| f == key) => Ok(key.to_string()),
+        (Some(key), _) => Err(GeoIndexError {
+            code: INDEX_NOT_FOUND,
+            message: format!(
+                "$geoNear requires a 2dsphere index on '{}' of {}.{}, but none was found",
+                key, db, coll
+            ),
         }
-        Bson::Array(arr) if arr.len() >= 2 => {
-            let lon = arr[0]
-                .as_f64()
-                .or_else(|| arr[0].as_i64().map(|v| v as f64))
-                .unwrap_or(0.0);
-            let lat = arr[1]
-                .as_f64()
-                .or_else(|| arr[1].as_i64().map(|v| v as f64))
-                .unwrap_or(0.0);
-            (lon, lat)
+        .into()),
+        (None, [field]) => Ok(field.clone()),
+        (None, []) => Err(GeoIndexError {
+            code: INDEX_NOT_FOUND,
+            message: format!(
+                "$geoNear requires a 2dsphere index on {}.{}, but none was found",
+                db, coll
+            ),
         }
-        _ => return f64::MAX,
-    };
-
-    if spherical {
-        // Haversine formula for spherical distance
-        let r = 6371000.0; // Earth radius in meters
-        let d_lat = (lat - near.latitude).to_radians();
-        let d_lon = (lon - near.longitude).to_radians();
-        let a = (d_lat / 2.0).sin().powi(2)
-            + near.latitude.to_radians().cos()
-                * lat.to_radians().cos()
-                * (d_lon / 2.0).sin().powi(2);
-        let c = 2.0 * a.sqrt().atan2((1.0 - a).sqrt());
-        r * c
-    } else {
-        // Euclidean distance (flat)
-        let dx = lon - near.longitude;
-        let dy = lat - near.latitude;
-        (dx * dx + dy * dy).sqrt()
+        .into()),
+        (None, _) => Err(GeoIndexError {
+            code: BAD_VALUE,
+            message: format!(
+                "there is more than one 2dsphere index on {}.{}; pass 'key' to choose one \
+                 for $geoNear",
+                db, coll
+            ),
+        }
+        .into()),
     }
 }
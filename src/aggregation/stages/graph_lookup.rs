@@ -0,0 +1,143 @@
+use crate::aggregation::expr::{Expr, ExprEvalContext, eval_expr, parse_expr};
+use crate::store::PgStore;
+use bson::{Bson, Document};
+use std::collections::HashMap;
+
+/// $graphLookup stage specification
+#[derive(Debug, Clone)]
+pub struct GraphLookupSpec {
+    pub from: String,
+    pub start_with: Expr,
+    pub connect_from_field: String,
+    pub connect_to_field: String,
+    pub as_field: String,
+    pub max_depth: Option<i64>,
+    pub depth_field: Option<String>,
+    pub restrict_search_with_match: Option<Document>,
+}
+
+impl GraphLookupSpec {
+    pub fn parse(value: &Bson) -> anyhow::Result<Self> {
+        let doc = value
+            .as_document()
+            .ok_or_else(|| anyhow::anyhow!("$graphLookup value must be a document"))?;
+
+        let from = doc
+            .get_str("from")
+            .map_err(|_| anyhow::anyhow!("$graphLookup requires from"))?
+            .to_string();
+        let start_with = doc
+            .get("startWith")
+            .ok_or_else(|| anyhow::anyhow!("$graphLookup requires startWith"))?;
+        let start_with = parse_expr(start_with)?;
+        let connect_from_field = doc
+            .get_str("connectFromField")
+            .map_err(|_| anyhow::anyhow!("$graphLookup requires connectFromField"))?
+            .to_string();
+        let connect_to_field = doc
+            .get_str("connectToField")
+            .map_err(|_| anyhow::anyhow!("$graphLookup requires connectToField"))?
+            .to_string();
+        let as_field = doc
+            .get_str("as")
+            .map_err(|_| anyhow::anyhow!("$graphLookup requires as"))?
+            .to_string();
+
+        let max_depth = match doc.get("maxDepth") {
+            None => None,
+            Some(Bson::Int32(n)) => Some(*n as i64),
+            Some(Bson::Int64(n)) => Some(*n),
+            Some(Bson::Double(n)) if n.fract() == 0.0 => Some(*n as i64),
+            Some(_) => {
+                return Err(anyhow::anyhow!(
+                    "$graphLookup maxDepth must be a non-negative integer"
+                ));
+            }
+        };
+        if let Some(d) = max_depth
+            && d < 0
+        {
+            return Err(anyhow::anyhow!(
+                "$graphLookup maxDepth must be a non-negative integer"
+            ));
+        }
+
+        let depth_field = match doc.get("depthField") {
+            None => None,
+            Some(Bson::String(s)) => Some(s.clone()),
+            Some(_) => return Err(anyhow::anyhow!("$graphLookup depthField must be a string")),
+        };
+        let restrict_search_with_match = match doc.get("restrictSearchWithMatch") {
+            None => None,
+            Some(Bson::Document(d)) => Some(d.clone()),
+            Some(_) => {
+                return Err(anyhow::anyhow!(
+                    "$graphLookup restrictSearchWithMatch must be a document"
+                ));
+            }
+        };
+
+        Ok(Self {
+            from,
+            start_with,
+            connect_from_field,
+            connect_to_field,
+            as_field,
+            max_depth,
+            depth_field,
+            restrict_search_with_match,
+        })
+    }
+}
+
+/// Execute $graphLookup: evaluate `startWith` for each input document, then walk the
+/// `from` collection for all of them together, a level at a time in PostgreSQL.
+pub async fn execute(
+    docs: Vec<Document>,
+    pg: &PgStore,
+    db: &str,
+    spec: &GraphLookupSpec,
+    vars: &HashMap<String, Bson>,
+) -> anyhow::Result<Vec<Document>> {
+    let mut starts = Vec::with_capacity(docs.len());
+    for doc in &docs {
+        let ctx = ExprEvalContext::with_vars(doc.clone(), doc.clone(), vars.clone());
+        starts.push(match eval_expr(&spec.start_with, &ctx)? {
+            Bson::Array(arr) => arr,
+            other => vec![other],
+        });
+    }
+
+    let found = if starts.iter().all(Vec::is_empty) {
+        vec![Vec::new(); docs.len()]
+    } else {
+        pg.graph_lookup(
+            db,
+            &spec.from,
+            &starts,
+            &spec.connect_from_field,
+            &spec.connect_to_field,
+            spec.max_depth,
+            spec.restrict_search_with_match.as_ref(),
+        )
+        .await?
+    };
+
+    let mut result = Vec::with_capacity(docs.len());
+    for (mut doc, found) in docs.into_iter().zip(found) {
+        let matches: Vec<Bson> = found
+            .into_iter()
+            .map(|(mut found_doc, depth)| {
+                if let Some(ref depth_field) = spec.depth_field {
+                    found_doc.insert(depth_field.clone(), Bson::Int64(depth));
+                }
+                Bson::Document(found_doc)
+            })
+            .collect();
+
+        doc.insert(spec.as_field.clone(), Bson::Array(matches));
+        result.push(doc);
+    }
+
+    Ok(result)
+}
@@ -71,7 +71,8 @@ pub fn execute(
                     | AccumulatorType::Avg
                     | AccumulatorType::Min
                     | AccumulatorType::Max
-                    | AccumulatorType::Push => {
+                    | AccumulatorType::Push
+                    | AccumulatorType::MergeObjects => {
                         state.values.push(value);
                     }
                 }
@@ -113,6 +114,7 @@ pub enum AccumulatorType {
     First,
     Last,
     Push,
+    MergeObjects,
 }
 
 pub fn parse_accumulator_type(op: &str) -> anyhow::Result<AccumulatorType> {
@@ -124,6 +126,7 @@ pub fn parse_accumulator_type(op: &str) -> anyhow::Result<AccumulatorType> {
         "$first" => Ok(AccumulatorType::First),
         "$last" => Ok(AccumulatorType::Last),
         "$push" => Ok(AccumulatorType::Push),
+        "$mergeObjects" => Ok(AccumulatorType::MergeObjects),
         _ => Err(anyhow::anyhow!("Unknown accumulator: {}", op)),
     }
 }
@@ -133,15 +136,22 @@ pub fn compute_accumulator(state: &AccumulatorState) -> anyhow::Result<Bson> {
         AccumulatorType::First => Ok(state.first_value.clone().unwrap_or(Bson::Null)),
         AccumulatorType::Last => Ok(state.last_value.clone().unwrap_or(Bson::Null)),
         AccumulatorType::Push => Ok(Bson::Array(state.values.clone())),
+        AccumulatorType::MergeObjects => Ok(Bson::Document(
+            crate::aggregation::values::merge_objects(state.values.iter().cloned())?,
+        )),
         AccumulatorType::Sum => {
             let mut sum_i128: i128 = 0;
             let mut has_double = false;
+            let mut saw_long = false;
             let mut sum_double: f64 = 0.0;
 
             for val in &state.values {
                 match val {
                     Bson::Int32(n) => sum_i128 += *n as i128,
-                    Bson::Int64(n) => sum_i128 += *n as i128,
+                    Bson::Int64(n) => {
+                        saw_long = true;
+                        sum_i128 += *n as i128;
+                    }
                     Bson::Double(n) => {
                         has_double = true;
                         sum_double += *n;
@@ -152,12 +162,10 @@ pub fn compute_accumulator(state: &AccumulatorState) -> anyhow::Result<Bson> {
 
             if has_double {
                 Ok(Bson::Double(sum_double + sum_i128 as f64))
-            } else if sum_i128 >= i32::MIN as i128 && sum_i128 <= i32::MAX as i128 {
-                Ok(Bson::Int32(sum_i128 as i32))
-            } else if sum_i128 >= i64::MIN as i128 && sum_i128 <= i64::MAX as i128 {
-                Ok(Bson::Int64(sum_i128 as i64))
             } else {
-                Ok(Bson::Double(sum_i128 as f64))
+                Ok(crate::aggregation::values::integer_result(
+                    sum_i128, saw_long,
+                ))
             }
         }
         AccumulatorType::Avg => {
@@ -215,3 +223,31 @@ pub fn compute_accumulator(state: &AccumulatorState) -> anyhow::Result<Bson> {
         }
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    #[test]
+    fn merge_objects_accumulates_later_fields_over_earlier() {
+        let docs = vec![
+            doc! {"g": 1, "part": {"a": 1, "b": 1}},
+            doc! {"g": 1, "part": null},
+            doc! {"g": 1, "part": {"b": 2, "c": 2}},
+            doc! {"g": 1, "part": {"c": 3, "d": 3}},
+        ];
+        let out = execute(
+            docs,
+            &Bson::String("$g".into()),
+            &doc! {"merged": {"$mergeObjects": "$part"}},
+            &HashMap::new(),
+        )
+        .unwrap();
+        assert_eq!(out.len(), 1);
+        assert_eq!(
+            out[0].get_document("merged").unwrap(),
+            &doc! {"a": 1, "b": 2, "c": 3, "d": 3}
+        );
+    }
+}
@@ -0,0 +1,62 @@
+use crate::store::{IndexUsage, PgStore};
+use bson::{Bson, Document, doc};
+
+/// Check the `$indexStats` argument, which must be an empty document.
+pub fn parse(value: &Bson) -> anyhow::Result<()> {
+    match value {
+        Bson::Document(d) if d.is_empty() => Ok(()),
+        _ => Err(anyhow::anyhow!(
+            "$indexStats argument must be an empty object"
+        )),
+    }
+}
+
+/// One document per index on the collection, with its usage counted by PostgreSQL.
+pub async fn execute(pg: &PgStore, db: &str, coll: &str) -> anyhow::Result<Vec<Document>> {
+    let usage = pg.index_usage(db, coll).await?;
+    Ok(usage.into_iter().map(usage_doc).collect())
+}
+
+fn usage_doc(usage: IndexUsage) -> Document {
+    let key = usage.spec.get_document("key").cloned().unwrap_or_default();
+    doc! {
+        "name": usage.name,
+        "key": key,
+        "accesses": {
+            "ops": usage.ops,
+            "since": bson::DateTime::from_millis(usage.since_ms),
+        },
+        "spec": usage.spec,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parse_requires_empty_document() {
+        assert!(parse(&Bson::Document(doc! {})).is_ok());
+        assert!(parse(&Bson::Document(doc! {"a": 1})).is_err());
+        assert!(parse(&Bson::Int32(1)).is_err());
+    }
+
+    #[test]
+    fn usage_doc_reports_accesses() {
+        let d = usage_doc(IndexUsage {
+            name: "age_1".into(),
+            spec: doc! {"key": {"age": 1}, "name": "age_1"},
+            ops: 7,
+            since_ms: 1_700_000_000_000,
+            size: 8192,
+        });
+        assert_eq!(d.get_str("name").unwrap(), "age_1");
+        assert_eq!(d.get_document("key").unwrap(), &doc! {"age": 1});
+        let accesses = d.get_document("accesses").unwrap();
+        assert_eq!(accesses.get_i64("ops").unwrap(), 7);
+        assert_eq!(
+            accesses.get_datetime("since").unwrap().timestamp_millis(),
+            1_700_000_000_000
+        );
+    }
+}
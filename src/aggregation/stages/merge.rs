@@ -168,7 +168,7 @@ pub async fn execute(
                     if let Some(id) = existing_doc.get("_id") {
                         let id_bytes = bson::to_vec(id)?;
                         let bson_bytes = bson::to_vec(&merged)?;
-                        let json = serde_json::to_value(&merged)?;
+                        let json = crate::bson_type::to_jsonb(&merged)?;
 
                         // Delete and re-insert (since we don't have update_by_id exposed)
                         pg.delete_one_by_filter(&target_db, &target_coll, &doc! { "_id": id })
@@ -185,7 +185,7 @@ pub async fn execute(
                     if let Some(id) = existing_doc.get("_id") {
                         let id_bytes = bson::to_vec(id)?;
                         let bson_bytes = bson::to_vec(&doc)?;
-                        let json = serde_json::to_value(&doc)?;
+                        let json = crate::bson_type::to_jsonb(&doc)?;
 
                         pg.delete_one_by_filter(&target_db, &target_coll, &doc! { "_id": id })
                             .await?;
@@ -221,7 +221,7 @@ pub async fn execute(
                         .unwrap_or_else(|| bson::Bson::ObjectId(bson::oid::ObjectId::new()));
                     let id_bytes = bson::to_vec(&id)?;
                     let bson_bytes = bson::to_vec(&doc)?;
-                    let json = serde_json::to_value(&doc)?;
+                    let json = crate::bson_type::to_jsonb(&doc)?;
 
                     pg.insert_one(&target_db, &target_coll, &id_bytes, &bson_bytes, &json)
                         .await?;
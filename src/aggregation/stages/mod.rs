@@ -1,12 +1,16 @@
 pub mod add_fields;
 pub mod bucket;
 pub mod bucket_auto;
+pub mod coll_stats;
 pub mod count;
 pub mod densify;
+pub mod documents;
 pub mod facet;
 pub mod fill;
 pub mod geo_near;
+pub mod graph_lookup;
 pub mod group;
+pub mod index_stats;
 pub mod limit;
 pub mod lookup;
 pub mod match_stage;
@@ -26,8 +30,10 @@ pub mod unset;
 pub mod unwind;
 
 // Re-export stage specs
+pub use coll_stats::CollStatsSpec;
 pub use densify::DensifySpec;
 pub use fill::FillSpec;
 pub use geo_near::GeoNearSpec;
+pub use graph_lookup::GraphLookupSpec;
 pub use merge::MergeSpec;
 pub use set_window_fields::SetWindowFieldsSpec;
@@ -1,5 +1,5 @@
 use crate::aggregation::exec::WriteStats;
-use crate::store::PgStore;
+use crate::store::{PgStore, q_ident};
 use bson::Document;
 
 pub async fn execute(
@@ -26,7 +26,7 @@ pub async fn execute(
             .unwrap_or_else(|| bson::to_vec(&bson::oid::ObjectId::new()).unwrap());
         let bson_bytes = bson::to_vec(&doc)?;
         // Convert bson Document to serde_json::Value
-        let json = serde_json::to_value(&doc)?;
+        let json = crate::bson_type::to_jsonb(&doc)?;
 
         pg.insert_one(db, &temp_coll, &id, &bson_bytes, &json)
             .await?;
@@ -38,10 +38,11 @@ pub async fn execute(
     pg.drop_collection(db, target_coll).await?;
 
     // Rename temp collection to target using raw SQL
-    let schema = format!("mdb_{}", db);
+    let mapping = pg.schema_mapping();
     let rename_sql = format!(
-        "ALTER TABLE IF EXISTS {}.{} RENAME TO {}",
-        schema, temp_coll, target_coll
+        "ALTER TABLE IF EXISTS {} RENAME TO {}",
+        mapping.qualified_table(db, &temp_coll),
+        q_ident(&mapping.table(db, target_coll))
     );
 
     let client = pg.pool().get().await.map_err(|e| anyhow::anyhow!(e))?;
@@ -1,7 +1,19 @@
+use crate::aggregation::exec::{document_matches_filter, value_matches};
 use crate::aggregation::expr::{ExprEvalContext, eval_expr, parse_expr};
+use crate::error_codes::BAD_VALUE;
 use bson::{Bson, Document};
 use std::collections::HashMap;
 
+/// A positional projection (`field.$`) that cannot be applied: more than one in a
+/// projection, one that excludes, or a document with no array element matching the query's
+/// conditions on the field. Carries MongoDB's code for each.
+#[derive(Debug, thiserror::Error)]
+#[error("{message}")]
+pub struct PositionalProjectionError {
+    pub code: i32,
+    pub message: String,
+}
+
 pub fn execute(
     docs: Vec<Document>,
     spec: &Document,
@@ -113,3 +125,179 @@ pub fn execute(
 
     Ok(result)
 }
+
+/// Split a projection's positional key out of it: `{"items.$": 1}` becomes `{"items": 1}`
+/// and the field `items`, which [`apply_positional`] then narrows. `None` when the
+/// projection has no positional key.
+pub fn split_positional(
+    spec: &Document,
+) -> Result<Option<(Document, String)>, PositionalProjectionError> {
+    let mut field = None;
+    let mut rewritten = Document::new();
+    for (key, value) in spec {
+        let Some(path) = key.strip_suffix(".$") else {
+            rewritten.insert(key, value.clone());
+            continue;
+        };
+        if field.is_some() {
+            return Err(PositionalProjectionError {
+                code: 31276,
+                message: "Cannot specify more than one positional projection per query."
+                    .to_string(),
+            });
+        }
+        if !matches!(value, Bson::Int32(1) | Bson::Int64(1) | Bson::Boolean(true)) {
+            return Err(PositionalProjectionError {
+                code: BAD_VALUE,
+                message: format!("positional projection '{}' must be an inclusion", key),
+            });
+        }
+        rewritten.insert(path, 1);
+        field = Some(path.to_string());
+    }
+    Ok(field.map(|f| (rewritten, f)))
+}
+
+/// Narrow the array at `field` in each document to its first element matching every
+/// condition `filter` places on the field or on paths inside it (`items.sku`), as MongoDB's
+/// positional projection does. Conditions are read from the filter's top level and its
+/// `$and`; a document whose array has no matching element is an error (code 51246), as is a
+/// filter with no condition on the field at all.
+pub fn apply_positional(
+    docs: Vec<Document>,
+    field: &str,
+    filter: Option<&Document>,
+) -> Result<Vec<Document>, PositionalProjectionError> {
+    let mut conditions = Vec::new();
+    if let Some(filter) = filter {
+        positional_conditions(filter, field, &mut conditions);
+    }
+    let no_match = || PositionalProjectionError {
+        code: 51246,
+        message: "positional operator '.$' couldn't find a matching element in the array"
+            .to_string(),
+    };
+    let mut result = Vec::with_capacity(docs.len());
+    for mut doc in docs {
+        if let Some(Bson::Array(items)) = path_get_mut(&mut doc, field) {
+            if conditions.is_empty() {
+                return Err(no_match());
+            }
+            let first = items
+                .iter()
+                .find(|item| {
+                    conditions
+                        .iter()
+                        .all(|(sub, cond)| element_matches(item, *sub, cond))
+                })
+                .cloned()
+                .ok_or_else(no_match)?;
+            *items = vec![first];
+        }
+        result.push(doc);
+    }
+    Ok(result)
+}
+
+/// The conditions on `field` (sub-path `None`) and on paths under it (`Some(rest)`).
+fn positional_conditions<'a>(
+    filter: &'a Document,
+    field: &str,
+    out: &mut Vec<(Option<&'a str>, &'a Bson)>,
+) {
+    for (key, value) in filter {
+        if key == "$and" {
+            for cond in value.as_array().into_iter().flatten() {
+                if let Bson::Document(cond) = cond {
+                    positional_conditions(cond, field, out);
+                }
+            }
+        } else if key == field {
+            out.push((None, value));
+        } else if let Some(sub) = key
+            .strip_prefix(field)
+            .and_then(|rest| rest.strip_prefix('.'))
+        {
+            out.push((Some(sub), value));
+        }
+    }
+}
+
+fn element_matches(item: &Bson, sub: Option<&str>, cond: &Bson) -> bool {
+    let Some(sub) = sub else {
+        let elem_match = match cond {
+            Bson::Document(ops) => ops.get("$elemMatch"),
+            _ => None,
+        };
+        return value_matches(Some(item), cond)
+            && match (elem_match, item) {
+                (Some(Bson::Document(m)), Bson::Document(d)) => document_matches_filter(d, m),
+                (Some(m), _) => value_matches(Some(item), m),
+                (None, _) => true,
+            };
+    };
+    let mut value = Some(item);
+    for part in sub.split('.') {
+        value = value.and_then(Bson::as_document).and_then(|d| d.get(part));
+    }
+    value_matches(value, cond)
+}
+
+fn path_get_mut<'a>(doc: &'a mut Document, path: &str) -> Option<&'a mut Bson> {
+    let (head, rest) = match path.split_once('.') {
+        Some((head, rest)) => (head, Some(rest)),
+        None => (path, None),
+    };
+    let value = doc.get_mut(head)?;
+    match (rest, value) {
+        (None, value) => Some(value),
+        (Some(rest), Bson::Document(inner)) => path_get_mut(inner, rest),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    #[test]
+    fn splits_out_the_positional_key() {
+        let (spec, field) = split_positional(&doc! {"name": 1, "grades.$": 1})
+            .unwrap()
+            .unwrap();
+        assert_eq!(spec, doc! {"name": 1, "grades": 1});
+        assert_eq!(field, "grades");
+        assert!(split_positional(&doc! {"name": 1}).unwrap().is_none());
+        let err = split_positional(&doc! {"a.$": 1, "b.$": 1}).unwrap_err();
+        assert_eq!(err.code, 31276);
+    }
+
+    #[test]
+    fn keeps_the_first_matching_element() {
+        let docs = vec![
+            doc! {"_id": "a", "grades": [80, 92, 95]},
+            doc! {"_id": "b", "items": [{"sku": "x", "qty": 1}, {"sku": "y", "qty": 5}]},
+        ];
+        let filter = doc! {"grades": {"$gte": 90}};
+        let out = apply_positional(docs[..1].to_vec(), "grades", Some(&filter)).unwrap();
+        assert_eq!(out, vec![doc! {"_id": "a", "grades": [92]}]);
+
+        let filter =
+            doc! {"$and": [{"items.sku": "y"}], "items": {"$elemMatch": {"qty": {"$gt": 2}}}};
+        let out = apply_positional(docs[1..].to_vec(), "items", Some(&filter)).unwrap();
+        assert_eq!(
+            out,
+            vec![doc! {"_id": "b", "items": [{"sku": "y", "qty": 5}]}]
+        );
+    }
+
+    #[test]
+    fn no_matching_element_is_51246() {
+        let docs = vec![doc! {"grades": [1, 2]}];
+        let err = apply_positional(docs.clone(), "grades", Some(&doc! {"grades": 3})).unwrap_err();
+        assert_eq!(err.code, 51246);
+        let err = apply_positional(docs, "grades", None).unwrap_err();
+        assert_eq!(err.code, 51246);
+    }
+}
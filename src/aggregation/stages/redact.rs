@@ -1,8 +1,22 @@
-use crate::aggregation::expr::{ExprEvalContext, eval_expr, parse_expr};
+use crate::aggregation::expr::{Expr, ExprEvalContext, eval_expr, parse_expr};
 use bson::{Bson, Document};
 use std::collections::HashMap;
 
-/// Redaction result
+/// The `$redact` expression evaluated to something other than `$$DESCEND`, `$$PRUNE` or
+/// `$$KEEP`. Reported with MongoDB's code 17053.
+#[derive(Debug, thiserror::Error)]
+#[error(
+    "$redact's expression should not return anything aside from the variables $$KEEP, $$DESCEND, and $$PRUNE, but returned {value}"
+)]
+pub struct InvalidRedactResult {
+    pub value: String,
+}
+
+impl InvalidRedactResult {
+    pub const CODE: i32 = 17053;
+}
+
+/// What the expression decided for one (sub)document.
 #[derive(Debug, Clone, Copy, PartialEq)]
 enum RedactResult {
     Descend,
@@ -10,107 +24,158 @@ enum RedactResult {
     Keep,
 }
 
+const DECISIONS: [(&str, RedactResult); 3] = [
+    ("DESCEND", RedactResult::Descend),
+    ("PRUNE", RedactResult::Prune),
+    ("KEEP", RedactResult::Keep),
+];
+
+/// `$redact`: evaluate `expr` on each document with `$$CURRENT` bound to it. `$$KEEP`
+/// returns it whole and `$$PRUNE` drops it; `$$DESCEND` keeps its scalar fields and applies
+/// the expression again to every embedded document, including those inside (nested)
+/// arrays, leaving out the ones it prunes. `$$ROOT` stays the top-level document throughout.
 pub fn execute(
     docs: Vec<Document>,
     expr: &Bson,
     vars: &HashMap<String, Bson>,
 ) -> anyhow::Result<Vec<Document>> {
+    let expr = parse_expr(expr)?;
+    let mut vars = vars.clone();
+    for (name, _) in DECISIONS {
+        vars.insert(name.to_string(), Bson::String(format!("$${}", name)));
+    }
     let mut result = Vec::new();
-
     for doc in docs {
-        let ctx = ExprEvalContext::with_vars(doc.clone(), doc.clone(), vars.clone());
-        let redacted = redact_document(&doc, expr, &ctx)?;
-        if let Some(doc) = redacted {
-            result.push(doc);
+        let mut ctx = ExprEvalContext::with_vars(doc.clone(), Document::new(), vars);
+        if let Some(redacted) = redact_document(doc, &expr, &mut ctx)? {
+            result.push(redacted);
         }
+        vars = ctx.vars;
     }
-
     Ok(result)
 }
 
 fn redact_document(
-    doc: &Document,
-    expr: &Bson,
-    ctx: &ExprEvalContext,
+    doc: Document,
+    expr: &Expr,
+    ctx: &mut ExprEvalContext,
 ) -> anyhow::Result<Option<Document>> {
-    let result = evaluate_redact_expr(doc, expr, ctx)?;
-
-    match result {
-        RedactResult::Prune => Ok(None),
-        RedactResult::Keep => Ok(Some(doc.clone())),
-        RedactResult::Descend => {
-            // Recursively process nested documents
-            let mut new_doc = Document::new();
-
-            for (key, value) in doc.iter() {
-                match value {
-                    Bson::Document(nested) => {
-                        // Recursively redact nested document
-                        if let Some(redacted) = redact_document(nested, expr, ctx)? {
-                            new_doc.insert(key.clone(), Bson::Document(redacted));
-                        }
-                    }
-                    Bson::Array(arr) => {
-                        // Redact each element in the array
-                        let mut new_arr = Vec::new();
-                        for item in arr {
-                            if let Bson::Document(item_doc) = item {
-                                if let Some(redacted) = redact_document(item_doc, expr, ctx)? {
-                                    new_arr.push(Bson::Document(redacted));
-                                }
-                            } else {
-                                new_arr.push(item.clone());
-                            }
-                        }
-                        new_doc.insert(key.clone(), Bson::Array(new_arr));
-                    }
-                    _ => {
-                        new_doc.insert(key.clone(), value.clone());
-                    }
+    ctx.current = doc;
+    let value = eval_expr(expr, ctx)?;
+    let decision = value.as_str().and_then(|s| {
+        DECISIONS
+            .iter()
+            .find(|(name, _)| s.strip_prefix("$$") == Some(*name))
+            .map(|(_, d)| *d)
+    });
+    let doc = std::mem::take(&mut ctx.current);
+    match decision {
+        Some(RedactResult::Keep) => Ok(Some(doc)),
+        Some(RedactResult::Prune) => Ok(None),
+        Some(RedactResult::Descend) => {
+            let mut kept = Document::new();
+            for (key, value) in doc {
+                if let Some(value) = redact_value(value, expr, ctx)? {
+                    kept.insert(key, value);
                 }
             }
-
-            Ok(Some(new_doc))
+            Ok(Some(kept))
+        }
+        None => Err(InvalidRedactResult {
+            value: value.to_string(),
         }
+        .into()),
     }
 }
 
-fn evaluate_redact_expr(
-    _doc: &Document,
-    expr: &Bson,
-    ctx: &ExprEvalContext,
-) -> anyhow::Result<RedactResult> {
-    let parsed_expr = parse_expr(expr)?;
-    let result = eval_expr(&parsed_expr, ctx)?;
-
-    match result {
-        Bson::String(s) => {
-            match s.as_str() {
-                "$$DESCEND" => Ok(RedactResult::Descend),
-                "$$PRUNE" => Ok(RedactResult::Prune),
-                "$$KEEP" => Ok(RedactResult::Keep),
-                _ => {
-                    // Check if it's a variable reference or literal
-                    if s.starts_with("$$") {
-                        // It's a system variable - evaluate it
-                        match s.as_str() {
-                            "$$ROOT" | "$$CURRENT" => Ok(RedactResult::Descend),
-                            _ => Ok(RedactResult::Keep),
-                        }
-                    } else {
-                        // Literal string - treat as Keep
-                        Ok(RedactResult::Keep)
-                    }
+/// A field value under a descended document: embedded documents are redacted (None when
+/// pruned), arrays keep their surviving elements, anything else is kept.
+fn redact_value(
+    value: Bson,
+    expr: &Expr,
+    ctx: &mut ExprEvalContext,
+) -> anyhow::Result<Option<Bson>> {
+    Ok(match value {
+        Bson::Document(d) => redact_document(d, expr, ctx)?.map(Bson::Document),
+        Bson::Array(items) => {
+            let mut kept = Vec::with_capacity(items.len());
+            for item in items {
+                if let Some(item) = redact_value(item, expr, ctx)? {
+                    kept.push(item);
                 }
             }
+            Some(Bson::Array(kept))
         }
-        Bson::Document(_) => {
-            // Expression evaluated to a document - descend into it
-            Ok(RedactResult::Descend)
-        }
-        _ => {
-            // Any other value - keep
-            Ok(RedactResult::Keep)
-        }
+        other => Some(other),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    fn level_expr() -> Bson {
+        Bson::Document(doc! {
+            "$cond": {
+                "if": {"$lte": [{"$ifNull": ["$level", 0]}, 1]},
+                "then": "$$DESCEND",
+                "else": "$$PRUNE",
+            }
+        })
+    }
+
+    #[test]
+    fn prunes_subdocuments_by_their_own_fields() {
+        let doc = doc! {
+            "_id": 1,
+            "title": "report",
+            "summary": {"level": 1, "text": "public"},
+            "secret": {"level": 3, "text": "hidden"},
+            "sections": [
+                {"level": 0, "body": "intro", "notes": [{"level": 2}, {"level": 1, "n": 1}]},
+                {"level": 5, "body": "classified"},
+                [{"level": 4}, {"level": 0, "deep": true}],
+                "plain",
+            ],
+        };
+        let out = execute(vec![doc], &level_expr(), &HashMap::new()).unwrap();
+        assert_eq!(
+            out,
+            vec![doc! {
+                "_id": 1,
+                "title": "report",
+                "summary": {"level": 1, "text": "public"},
+                "sections": [
+                    {"level": 0, "body": "intro", "notes": [{"level": 1, "n": 1}]},
+                    [{"level": 0, "deep": true}],
+                    "plain",
+                ],
+            }]
+        );
+    }
+
+    #[test]
+    fn keep_and_prune_apply_to_whole_documents() {
+        let expr = Bson::Document(doc! {
+            "$cond": [{"$eq": ["$public", true]}, "$$KEEP", "$$PRUNE"]
+        });
+        let docs = vec![
+            doc! {"public": true, "inner": {"public": false}},
+            doc! {"public": false},
+        ];
+        let out = execute(docs, &expr, &HashMap::new()).unwrap();
+        assert_eq!(out, vec![doc! {"public": true, "inner": {"public": false}}]);
+    }
+
+    #[test]
+    fn other_results_are_17053() {
+        let err = execute(
+            vec![doc! {"a": 1}],
+            &Bson::String("$a".into()),
+            &HashMap::new(),
+        )
+        .unwrap_err();
+        assert!(err.downcast_ref::<InvalidRedactResult>().is_some());
     }
 }
@@ -2,33 +2,60 @@ use crate::aggregation::expr::{ExprEvalContext, eval_expr, parse_expr};
 use bson::{Bson, Document};
 use std::collections::HashMap;
 
+/// The `$replaceRoot`/`$replaceWith` expression did not produce a document.
+/// Reported with MongoDB's code 40228.
+#[derive(Debug, thiserror::Error)]
+#[error("'newRoot' expression must evaluate to an object, but resulting value was: {value}")]
+pub struct NewRootNotDocument {
+    /// The offending value, or `MISSING` when the expression resolved to nothing
+    pub value: String,
+}
+
+impl NewRootNotDocument {
+    pub const CODE: i32 = 40228;
+}
+
 pub fn execute(
     docs: Vec<Document>,
     replacement: &Bson,
     vars: &HashMap<String, Bson>,
 ) -> anyhow::Result<Vec<Document>> {
-    let mut result = Vec::new();
+    let expr = parse_expr(replacement)?;
+    let mut result = Vec::with_capacity(docs.len());
 
     for doc in docs {
-        let ctx = ExprEvalContext::with_vars(doc.clone(), doc.clone(), vars.clone());
-        let expr = parse_expr(replacement)?;
-        let evaluated = eval_expr(&expr, &ctx)?;
-
-        // Check for $$REMOVE which is not allowed in $replaceRoot
-        if matches!(evaluated, Bson::Undefined) {
-            return Err(anyhow::anyhow!("$replaceRoot with $$REMOVE is not allowed"));
-        }
-
-        // Must be a document
-        if let Bson::Document(new_doc) = evaluated {
-            result.push(new_doc);
-        } else {
-            return Err(anyhow::anyhow!(
-                "$replaceRoot/$replaceWith expression must evaluate to a document, got {:?}",
-                evaluated
-            ));
+        let ctx = ExprEvalContext::with_vars(doc.clone(), doc, vars.clone());
+        match eval_expr(&expr, &ctx)? {
+            Bson::Document(new_doc) => result.push(new_doc),
+            // $$REMOVE evaluates to Undefined
+            Bson::Undefined => {
+                return Err(NewRootNotDocument {
+                    value: "MISSING".to_string(),
+                }
+                .into());
+            }
+            other => {
+                return Err(NewRootNotDocument {
+                    value: other.to_string(),
+                }
+                .into());
+            }
         }
     }
 
     Ok(result)
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    #[test]
+    fn non_document_is_40228() {
+        for d in [doc! {"sub": 5}, doc! {"other": 1}] {
+            let err = execute(vec![d], &Bson::String("$sub".into()), &HashMap::new()).unwrap_err();
+            assert!(err.downcast_ref::<NewRootNotDocument>().is_some());
+        }
+    }
+}
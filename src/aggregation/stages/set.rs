@@ -30,7 +30,7 @@ pub fn execute(
     Ok(result)
 }
 
-fn set_path_nested(doc: &mut Document, path: &str, value: Bson) {
+pub(crate) fn set_path_nested(doc: &mut Document, path: &str, value: Bson) {
     let mut root = Bson::Document(doc.clone());
     let segments: Vec<&str> = path.split('.').collect();
     set_path_bson(&mut root, &segments, value);
@@ -1,13 +1,84 @@
+//! `$setWindowFields`: computes each `output` field over a window of the document's
+//! partition.
+//!
+//! Documents are grouped by `partitionBy` and ordered by `sortBy`, which is also the order
+//! the stage emits them in; the sort is stable, so documents tied on both keep their input
+//! order. A window is either `documents` bounds (positions relative to the current document)
+//! or `range` bounds (offsets from the current document's `sortBy` value, scaled by `unit`
+//! for dates). Without `window` an operator sees the whole partition.
+
+use crate::aggregation::bson_cmp;
 use crate::aggregation::expr::{ExprEvalContext, eval_expr, parse_expr};
+use crate::aggregation::stages::group::{AccumulatorState, AccumulatorType, compute_accumulator};
 use bson::{Bson, Document};
+use std::cmp::Ordering;
 use std::collections::HashMap;
 
 /// $setWindowFields stage specification
 #[derive(Debug, Clone)]
 pub struct SetWindowFieldsSpec {
     pub partition_by: Option<Bson>,
-    pub sort_by: Document,
-    pub output: Document,
+    /// `sortBy` fields and whether each sorts descending
+    pub sort_by: Vec<(String, bool)>,
+    pub output: Vec<WindowOutput>,
+}
+
+/// One `output` field: the operator computing it and the window it sees.
+#[derive(Debug, Clone)]
+pub struct WindowOutput {
+    pub path: String,
+    pub op: WindowOp,
+    pub window: Window,
+}
+
+#[derive(Debug, Clone)]
+pub enum WindowOp {
+    /// An accumulator over the window, applied to the evaluated argument
+    Accumulate(WindowAccumulator, Bson),
+    Count,
+    Rank,
+    DenseRank,
+    DocumentNumber,
+    /// Value of `output` evaluated `by` documents away, or `default` past the partition
+    Shift {
+        output: Bson,
+        by: i64,
+        default: Bson,
+    },
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum WindowAccumulator {
+    Sum,
+    Avg,
+    Min,
+    Max,
+    First,
+    Last,
+    Push,
+    AddToSet,
+    StdDevPop,
+    StdDevSamp,
+}
+
+/// One side of a window.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Bound {
+    Unbounded,
+    Current,
+    Offset(f64),
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub enum Window {
+    /// Positions relative to the current document
+    Documents(Bound, Bound),
+    /// Offsets from the current `sortBy` value; `unit_ms` scales them for dates
+    Range {
+        lower: Bound,
+        upper: Bound,
+        unit_ms: Option<i64>,
+    },
 }
 
 impl SetWindowFieldsSpec {
@@ -15,16 +86,43 @@ impl SetWindowFieldsSpec {
         let doc = value
             .as_document()
             .ok_or_else(|| anyhow::anyhow!("$setWindowFields value must be a document"))?;
+        for key in doc.keys() {
+            if !matches!(key.as_str(), "partitionBy" | "sortBy" | "output") {
+                return Err(anyhow::anyhow!(
+                    "$setWindowFields got unrecognized field: {}",
+                    key
+                ));
+            }
+        }
 
         let partition_by = doc.get("partitionBy").cloned();
-        let sort_by = doc
-            .get_document("sortBy")
-            .map_err(|_| anyhow::anyhow!("$setWindowFields requires sortBy"))?
-            .clone();
-        let output = doc
+        let mut sort_by = Vec::new();
+        if let Some(sort) = doc.get("sortBy") {
+            let sort = sort
+                .as_document()
+                .ok_or_else(|| anyhow::anyhow!("$setWindowFields sortBy must be an object"))?;
+            for (field, dir) in sort {
+                let descending = match dir {
+                    Bson::Int32(1) | Bson::Int64(1) => false,
+                    Bson::Int32(-1) | Bson::Int64(-1) => true,
+                    Bson::Double(n) if *n == 1.0 => false,
+                    Bson::Double(n) if *n == -1.0 => true,
+                    _ => return Err(anyhow::anyhow!("$setWindowFields sortBy must be 1 or -1")),
+                };
+                sort_by.push((field.clone(), descending));
+            }
+        }
+        let output_doc = doc
             .get_document("output")
-            .map_err(|_| anyhow::anyhow!("$setWindowFields requires output"))?
-            .clone();
+            .map_err(|_| anyhow::anyhow!("$setWindowFields requires output"))?;
+
+        let mut output = Vec::with_capacity(output_doc.len());
+        for (path, spec) in output_doc {
+            let spec = spec.as_document().ok_or_else(|| {
+                anyhow::anyhow!("$setWindowFields output field {} must be an object", path)
+            })?;
+            output.push(parse_output(path, spec, &sort_by)?);
+        }
 
         Ok(Self {
             partition_by,
@@ -34,6 +132,229 @@ impl SetWindowFieldsSpec {
     }
 }
 
+fn parse_output(
+    path: &str,
+    spec: &Document,
+    sort_by: &[(String, bool)],
+) -> anyhow::Result<WindowOutput> {
+    let mut op_entry = None;
+    let mut window_spec = None;
+    for (key, value) in spec {
+        if key == "window" {
+            window_spec = Some(value.as_document().ok_or_else(|| {
+                anyhow::anyhow!("'window' field must be an object for output {}", path)
+            })?);
+        } else if key.starts_with('$') && op_entry.is_none() {
+            op_entry = Some((key.as_str(), value));
+        } else {
+            return Err(anyhow::anyhow!(
+                "$setWindowFields output {} has unexpected field: {}",
+                path,
+                key
+            ));
+        }
+    }
+    let (name, arg) = op_entry.ok_or_else(|| {
+        anyhow::anyhow!(
+            "$setWindowFields output {} requires a window operator",
+            path
+        )
+    })?;
+
+    let empty_arg = |op: &str| -> anyhow::Result<()> {
+        match arg {
+            Bson::Document(d) if d.is_empty() => Ok(()),
+            _ => Err(anyhow::anyhow!("{} takes no arguments, pass {{}}", op)),
+        }
+    };
+    let op = match name {
+        "$sum" => WindowOp::Accumulate(WindowAccumulator::Sum, arg.clone()),
+        "$avg" => WindowOp::Accumulate(WindowAccumulator::Avg, arg.clone()),
+        "$min" => WindowOp::Accumulate(WindowAccumulator::Min, arg.clone()),
+        "$max" => WindowOp::Accumulate(WindowAccumulator::Max, arg.clone()),
+        "$first" => WindowOp::Accumulate(WindowAccumulator::First, arg.clone()),
+        "$last" => WindowOp::Accumulate(WindowAccumulator::Last, arg.clone()),
+        "$push" => WindowOp::Accumulate(WindowAccumulator::Push, arg.clone()),
+        "$addToSet" => WindowOp::Accumulate(WindowAccumulator::AddToSet, arg.clone()),
+        "$stdDevPop" => WindowOp::Accumulate(WindowAccumulator::StdDevPop, arg.clone()),
+        "$stdDevSamp" => WindowOp::Accumulate(WindowAccumulator::StdDevSamp, arg.clone()),
+        "$count" => {
+            empty_arg(name)?;
+            WindowOp::Count
+        }
+        "$rank" | "$denseRank" | "$documentNumber" => {
+            empty_arg(name)?;
+            if name != "$documentNumber" && sort_by.len() != 1 {
+                return Err(anyhow::anyhow!(
+                    "{} must be specified with a top level sortBy expression with exactly one element",
+                    name
+                ));
+            }
+            if sort_by.is_empty() {
+                return Err(anyhow::anyhow!("{} requires a sortBy", name));
+            }
+            match name {
+                "$rank" => WindowOp::Rank,
+                "$denseRank" => WindowOp::DenseRank,
+                _ => WindowOp::DocumentNumber,
+            }
+        }
+        "$shift" => {
+            let d = arg
+                .as_document()
+                .ok_or_else(|| anyhow::anyhow!("$shift must be an object"))?;
+            let output = d
+                .get("output")
+                .cloned()
+                .ok_or_else(|| anyhow::anyhow!("$shift requires an 'output' expression"))?;
+            let by = match d.get("by") {
+                Some(Bson::Int32(n)) => *n as i64,
+                Some(Bson::Int64(n)) => *n,
+                Some(Bson::Double(n)) if n.fract() == 0.0 => *n as i64,
+                _ => return Err(anyhow::anyhow!("$shift 'by' must be an integer")),
+            };
+            if sort_by.is_empty() {
+                return Err(anyhow::anyhow!("$shift requires a sortBy"));
+            }
+            WindowOp::Shift {
+                output,
+                by,
+                default: d.get("default").cloned().unwrap_or(Bson::Null),
+            }
+        }
+        _ => return Err(anyhow::anyhow!("Unrecognized window function, {}", name)),
+    };
+
+    let accumulates = matches!(op, WindowOp::Accumulate(..) | WindowOp::Count);
+    let window = match window_spec {
+        None => Window::Documents(Bound::Unbounded, Bound::Unbounded),
+        Some(_) if !accumulates => {
+            return Err(anyhow::anyhow!("{} does not accept a 'window' field", name));
+        }
+        Some(w) => parse_window(w, sort_by)?,
+    };
+    Ok(WindowOutput {
+        path: path.to_string(),
+        op,
+        window,
+    })
+}
+
+fn parse_window(spec: &Document, sort_by: &[(String, bool)]) -> anyhow::Result<Window> {
+    for key in spec.keys() {
+        if !matches!(key.as_str(), "documents" | "range" | "unit") {
+            return Err(anyhow::anyhow!(
+                "'window' has an unexpected argument: {}",
+                key
+            ));
+        }
+    }
+    let bounds = |key: &str, integral: bool| -> anyhow::Result<Option<(Bound, Bound)>> {
+        let Some(v) = spec.get(key) else {
+            return Ok(None);
+        };
+        let arr = match v {
+            Bson::Array(a) if a.len() == 2 => a,
+            _ => return Err(anyhow::anyhow!("Window bounds must be a 2-element array")),
+        };
+        let lower = parse_bound(&arr[0], integral)?;
+        let upper = parse_bound(&arr[1], integral)?;
+        let position = |b: Bound| match b {
+            Bound::Unbounded => None,
+            Bound::Current => Some(0.0),
+            Bound::Offset(n) => Some(n),
+        };
+        if matches!((position(lower), position(upper)), (Some(l), Some(u)) if l > u) {
+            return Err(anyhow::anyhow!(
+                "Lower bound must not exceed upper bound: {:?}",
+                arr
+            ));
+        }
+        Ok(Some((lower, upper)))
+    };
+
+    match (bounds("documents", true)?, bounds("range", false)?) {
+        (Some(_), Some(_)) => Err(anyhow::anyhow!(
+            "'window' cannot set both 'documents' and 'range'"
+        )),
+        (Some(_), None) if spec.contains_key("unit") => Err(anyhow::anyhow!(
+            "'unit' can only be used with range-based windows"
+        )),
+        (Some((lower, upper)), None) => {
+            if (lower, upper) != (Bound::Unbounded, Bound::Unbounded) && sort_by.is_empty() {
+                return Err(anyhow::anyhow!("Document-based bounds require a sortBy"));
+            }
+            Ok(Window::Documents(lower, upper))
+        }
+        (None, Some((lower, upper))) => {
+            if sort_by.len() != 1 {
+                return Err(anyhow::anyhow!(
+                    "Range-based window requires sortBy a single field"
+                ));
+            }
+            let unit_ms = match spec.get("unit") {
+                None => None,
+                Some(Bson::String(u)) => Some(unit_millis(u)?),
+                Some(_) => return Err(anyhow::anyhow!("'unit' must be a string")),
+            };
+            Ok(Window::Range {
+                lower,
+                upper,
+                unit_ms,
+            })
+        }
+        (None, None) => Err(anyhow::anyhow!(
+            "'window' field must specify 'documents' or 'range'"
+        )),
+    }
+}
+
+fn parse_bound(v: &Bson, integral: bool) -> anyhow::Result<Bound> {
+    let n = match v {
+        Bson::String(s) if s == "unbounded" => return Ok(Bound::Unbounded),
+        Bson::String(s) if s == "current" => return Ok(Bound::Current),
+        Bson::Int32(n) => *n as f64,
+        Bson::Int64(n) => *n as f64,
+        Bson::Double(n) if n.is_finite() => *n,
+        _ => {
+            return Err(anyhow::anyhow!(
+                "Window bounds must be 'unbounded', 'current', or a number"
+            ));
+        }
+    };
+    if integral && n.fract() != 0.0 {
+        return Err(anyhow::anyhow!("Document-based bounds must be integers"));
+    }
+    Ok(Bound::Offset(n))
+}
+
+/// Milliseconds in a fixed-length `unit`. Months, quarters and years vary in length and are
+/// not supported.
+fn unit_millis(unit: &str) -> anyhow::Result<i64> {
+    Ok(match unit {
+        "millisecond" => 1,
+        "second" => 1_000,
+        "minute" => 60_000,
+        "hour" => 3_600_000,
+        "day" => 86_400_000,
+        "week" => 7 * 86_400_000,
+        "month" | "quarter" | "year" => {
+            return Err(anyhow::anyhow!(
+                "$setWindowFields range unit '{}' is not supported",
+                unit
+            ));
+        }
+        _ => return Err(anyhow::anyhow!("Unknown time unit value: {}", unit)),
+    })
+}
+
+/// A document with its partition and sort keys.
+struct Row {
+    doc: Document,
+    partition: Bson,
+    sort: Vec<Bson>,
+}
+
 pub fn execute(
     docs: Vec<Document>,
     spec: &SetWindowFieldsSpec,
@@ -43,85 +364,408 @@ pub fn execute(
         return Ok(docs);
     }
 
-    let mut result = docs;
+    let partition_expr = spec.partition_by.as_ref().map(parse_expr).transpose()?;
+    let sort_exprs = spec
+        .sort_by
+        .iter()
+        .map(|(field, _)| parse_expr(&Bson::String(format!("${}", field))))
+        .collect::<anyhow::Result<Vec<_>>>()?;
 
-    // Sort by sortBy specification
-    let mut sort_specs: Vec<(String, i32)> = Vec::new();
-    for (key, value) in spec.sort_by.iter() {
-        let direction = match value {
-            Bson::Int32(n) => *n,
-            Bson::Int64(n) => *n as i32,
-            _ => 1,
+    let mut rows = Vec::with_capacity(docs.len());
+    for doc in docs {
+        let ctx = ExprEvalContext::with_vars(doc.clone(), doc.clone(), vars.clone());
+        let partition = match &partition_expr {
+            Some(e) => eval_expr(e, &ctx)?,
+            None => Bson::Null,
         };
-        sort_specs.push((key.clone(), direction));
+        let sort = sort_exprs
+            .iter()
+            .map(|e| eval_expr(e, &ctx))
+            .collect::<anyhow::Result<Vec<_>>>()?;
+        rows.push(Row {
+            doc,
+            partition,
+            sort,
+        });
     }
+    rows.sort_by(|a, b| {
+        bson_cmp(&a.partition, &b.partition).then_with(|| compare_sort_keys(a, b, &spec.sort_by))
+    });
 
-    result.sort_by(|a, b| {
-        for (field, direction) in &sort_specs {
-            let a_val = a.get(field).unwrap_or(&Bson::Null);
-            let b_val = b.get(field).unwrap_or(&Bson::Null);
-            let cmp = crate::aggregation::bson_cmp(a_val, b_val);
-            if cmp != std::cmp::Ordering::Equal {
-                return if *direction == 1 { cmp } else { cmp.reverse() };
+    // Rows of one partition are contiguous now
+    let mut start = 0;
+    while start < rows.len() {
+        let mut end = start + 1;
+        while end < rows.len()
+            && bson_cmp(&rows[start].partition, &rows[end].partition) == Ordering::Equal
+        {
+            end += 1;
+        }
+        let values = spec
+            .output
+            .iter()
+            .map(|out| compute_output(&rows[start..end], out, &spec.sort_by, vars))
+            .collect::<anyhow::Result<Vec<_>>>()?;
+        for (out, column) in spec.output.iter().zip(values) {
+            for (row, value) in rows[start..end].iter_mut().zip(column) {
+                crate::aggregation::stages::set::set_path_nested(&mut row.doc, &out.path, value);
             }
         }
-        std::cmp::Ordering::Equal
-    });
+        start = end;
+    }
 
-    // Process each output field with window functions
-    // Collect field names first to avoid borrow issues
-    let output_fields: Vec<(String, Bson)> = spec
-        .output
-        .iter()
-        .map(|(k, v)| (k.clone(), v.clone()))
-        .collect();
-
-    for (field_name, window_spec) in output_fields {
-        if let Bson::Document(window_doc) = &window_spec {
-            // Parse window function
-            if let Some((func_name, func_expr)) = window_doc.iter().next() {
-                let window_field = if let Some(stripped) = func_name.strip_prefix('$') {
-                    stripped
-                } else {
-                    func_name.as_str()
-                };
+    Ok(rows.into_iter().map(|r| r.doc).collect())
+}
 
-                // Get window bounds if specified
-                let _window_bounds = window_doc.get_document("window").ok();
-
-                // Pre-compute all values first
-                let mut computed_values: Vec<(usize, Bson)> = Vec::new();
-
-                for (idx, doc) in result.iter().enumerate() {
-                    let ctx = ExprEvalContext::with_vars(doc.clone(), doc.clone(), vars.clone());
-
-                    let value = match window_field {
-                        "sum" | "avg" | "min" | "max" | "count" => {
-                            let expr = parse_expr(func_expr)?;
-                            eval_expr(&expr, &ctx)?
-                        }
-                        "first" | "last" => {
-                            let expr = parse_expr(func_expr)?;
-                            eval_expr(&expr, &ctx)?
-                        }
-                        _ => {
-                            let expr = parse_expr(func_expr)?;
-                            eval_expr(&expr, &ctx)?
-                        }
-                    };
+fn compare_sort_keys(a: &Row, b: &Row, sort_by: &[(String, bool)]) -> Ordering {
+    for ((x, y), (_, descending)) in a.sort.iter().zip(&b.sort).zip(sort_by) {
+        let cmp = bson_cmp(x, y);
+        if cmp != Ordering::Equal {
+            return if *descending { cmp.reverse() } else { cmp };
+        }
+    }
+    Ordering::Equal
+}
 
-                    computed_values.push((idx, value));
+/// Values of one output field for every row of a sorted partition.
+fn compute_output(
+    rows: &[Row],
+    out: &WindowOutput,
+    sort_by: &[(String, bool)],
+    vars: &HashMap<String, Bson>,
+) -> anyhow::Result<Vec<Bson>> {
+    let eval_all = |arg: &Bson| -> anyhow::Result<Vec<Bson>> {
+        let expr = parse_expr(arg)?;
+        rows.iter()
+            .map(|r| {
+                let ctx = ExprEvalContext::with_vars(r.doc.clone(), r.doc.clone(), vars.clone());
+                eval_expr(&expr, &ctx)
+            })
+            .collect()
+    };
+
+    match &out.op {
+        WindowOp::DocumentNumber => Ok((1..=rows.len()).map(|n| Bson::Int32(n as i32)).collect()),
+        WindowOp::Rank | WindowOp::DenseRank => {
+            let dense = matches!(out.op, WindowOp::DenseRank);
+            let mut values = Vec::with_capacity(rows.len());
+            let mut rank = 0;
+            for i in 0..rows.len() {
+                if i == 0 || compare_sort_keys(&rows[i - 1], &rows[i], sort_by) != Ordering::Equal {
+                    rank = if dense { rank + 1 } else { i + 1 };
                 }
+                values.push(Bson::Int32(rank as i32));
+            }
+            Ok(values)
+        }
+        WindowOp::Shift {
+            output,
+            by,
+            default,
+        } => {
+            let shifted = eval_all(output)?;
+            Ok((0..rows.len() as i64)
+                .map(|i| match usize::try_from(i + by) {
+                    Ok(j) if j < shifted.len() => shifted[j].clone(),
+                    _ => default.clone(),
+                })
+                .collect())
+        }
+        WindowOp::Count => (0..rows.len())
+            .map(|i| {
+                let (lo, hi) = window_range(rows, i, &out.window, sort_by)?;
+                Ok(Bson::Int32(hi.saturating_sub(lo) as i32))
+            })
+            .collect(),
+        WindowOp::Accumulate(acc, arg) => {
+            let inputs = eval_all(arg)?;
+            (0..rows.len())
+                .map(|i| {
+                    let (lo, hi) = window_range(rows, i, &out.window, sort_by)?;
+                    accumulate(*acc, inputs.get(lo..hi).unwrap_or(&[]))
+                })
+                .collect()
+        }
+    }
+}
 
-                // Now insert the computed values
-                for (idx, value) in computed_values {
-                    if let Some(doc) = result.get_mut(idx) {
-                        doc.insert(field_name.clone(), value);
-                    }
+/// Half-open range of partition positions inside row `i`'s window.
+fn window_range(
+    rows: &[Row],
+    i: usize,
+    window: &Window,
+    sort_by: &[(String, bool)],
+) -> anyhow::Result<(usize, usize)> {
+    let len = rows.len() as i64;
+    match window {
+        Window::Documents(lower, upper) => {
+            let lo = match lower {
+                Bound::Unbounded => 0,
+                Bound::Current => i as i64,
+                Bound::Offset(n) => i as i64 + *n as i64,
+            };
+            let hi = match upper {
+                Bound::Unbounded => len,
+                Bound::Current => i as i64 + 1,
+                Bound::Offset(n) => i as i64 + *n as i64 + 1,
+            };
+            let lo = lo.clamp(0, len) as usize;
+            let hi = hi.clamp(0, len) as usize;
+            Ok((lo, hi.max(lo)))
+        }
+        Window::Range {
+            lower,
+            upper,
+            unit_ms,
+        } => {
+            // Offsets follow the sort order, so a descending sort flips their sign
+            let sign = if sort_by.first().is_some_and(|(_, desc)| *desc) {
+                -1.0
+            } else {
+                1.0
+            };
+            let key = |r: &Row| range_key(&r.sort[0], *unit_ms).map(|k| k * sign);
+            let current = key(&rows[i])?;
+            let lo_value = match lower {
+                Bound::Unbounded => f64::NEG_INFINITY,
+                Bound::Current => current,
+                Bound::Offset(n) => current + n,
+            };
+            let hi_value = match upper {
+                Bound::Unbounded => f64::INFINITY,
+                Bound::Current => current,
+                Bound::Offset(n) => current + n,
+            };
+            // Keys ascend through the partition, so the window is one contiguous run
+            let mut lo = rows.len();
+            let mut hi = 0;
+            for (j, row) in rows.iter().enumerate() {
+                let k = key(row)?;
+                if k >= lo_value && k <= hi_value {
+                    lo = lo.min(j);
+                    hi = j + 1;
                 }
             }
+            Ok((lo.min(hi), hi))
         }
     }
+}
+
+/// Numeric position of a `sortBy` value on a range window's axis.
+fn range_key(v: &Bson, unit_ms: Option<i64>) -> anyhow::Result<f64> {
+    match (v, unit_ms) {
+        (Bson::DateTime(d), Some(unit)) => Ok(d.timestamp_millis() as f64 / unit as f64),
+        (Bson::DateTime(_), None) => Err(anyhow::anyhow!(
+            "Invalid range: Expected the sortBy field to be a number, but it was a date; specify a 'unit'"
+        )),
+        (_, Some(_)) => Err(anyhow::anyhow!(
+            "Invalid range: Expected the sortBy field to be a date, since 'unit' was specified"
+        )),
+        _ => crate::aggregation::coerce_numeric(v)
+            .map(|n| n.as_f64())
+            .ok_or_else(|| {
+                anyhow::anyhow!("Invalid range: Expected the sortBy field to be a number")
+            }),
+    }
+}
+
+fn accumulate(acc: WindowAccumulator, values: &[Bson]) -> anyhow::Result<Bson> {
+    let group_type = match acc {
+        WindowAccumulator::Sum => AccumulatorType::Sum,
+        WindowAccumulator::Avg => AccumulatorType::Avg,
+        WindowAccumulator::Push => AccumulatorType::Push,
+        WindowAccumulator::First => return Ok(values.first().cloned().unwrap_or(Bson::Null)),
+        WindowAccumulator::Last => return Ok(values.last().cloned().unwrap_or(Bson::Null)),
+        WindowAccumulator::Min | WindowAccumulator::Max => {
+            // Like $group's $min/$max, nulls only win when nothing else is there
+            let best = values
+                .iter()
+                .filter(|v| !matches!(v, Bson::Null | Bson::Undefined))
+                .reduce(|best, v| {
+                    let cmp = bson_cmp(v, best);
+                    let better = if acc == WindowAccumulator::Min {
+                        cmp == Ordering::Less
+                    } else {
+                        cmp == Ordering::Greater
+                    };
+                    if better { v } else { best }
+                });
+            return Ok(best.cloned().unwrap_or(Bson::Null));
+        }
+        WindowAccumulator::AddToSet => {
+            let mut set: Vec<Bson> = Vec::new();
+            for v in values {
+                if !set.contains(v) {
+                    set.push(v.clone());
+                }
+            }
+            return Ok(Bson::Array(set));
+        }
+        WindowAccumulator::StdDevPop | WindowAccumulator::StdDevSamp => {
+            let nums: Vec<f64> = values
+                .iter()
+                .filter(|v| matches!(v, Bson::Int32(_) | Bson::Int64(_) | Bson::Double(_)))
+                .filter_map(|v| crate::aggregation::coerce_numeric(v).map(|n| n.as_f64()))
+                .collect();
+            let n = nums.len() as f64;
+            let denominator = if acc == WindowAccumulator::StdDevSamp {
+                n - 1.0
+            } else {
+                n
+            };
+            if denominator <= 0.0 {
+                return Ok(Bson::Null);
+            }
+            let mean = nums.iter().sum::<f64>() / n;
+            let var = nums.iter().map(|x| (x - mean).powi(2)).sum::<f64>() / denominator;
+            return Ok(Bson::Double(var.sqrt()));
+        }
+    };
+    compute_accumulator(&AccumulatorState {
+        acc_type: group_type,
+        values: values.to_vec(),
+        first_value: None,
+        last_value: None,
+    })
+}
 
-    Ok(result)
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    fn run(docs: Vec<Document>, spec: Document) -> Vec<Document> {
+        let spec = SetWindowFieldsSpec::parse(&Bson::Document(spec)).unwrap();
+        execute(docs, &spec, &HashMap::new()).unwrap()
+    }
+
+    #[test]
+    fn moving_sum_and_average_over_documents_window() {
+        let docs = vec![
+            doc! {"s": "a", "t": 3, "v": 30},
+            doc! {"s": "a", "t": 1, "v": 10},
+            doc! {"s": "b", "t": 1, "v": 5},
+            doc! {"s": "a", "t": 2, "v": 20},
+        ];
+        let out = run(
+            docs,
+            doc! {
+                "partitionBy": "$s",
+                "sortBy": {"t": 1},
+                "output": {
+                    "running": {"$sum": "$v", "window": {"documents": ["unbounded", "current"]}},
+                    "moving": {"$avg": "$v", "window": {"documents": [-1, 0]}},
+                    "total": {"$sum": "$v"},
+                },
+            },
+        );
+        let got: Vec<(i32, i32, f64, i32)> = out
+            .iter()
+            .map(|d| {
+                (
+                    d.get_i32("v").unwrap(),
+                    d.get_i32("running").unwrap(),
+                    d.get_f64("moving").unwrap(),
+                    d.get_i32("total").unwrap(),
+                )
+            })
+            .collect();
+        assert_eq!(
+            got,
+            vec![
+                (10, 10, 10.0, 60),
+                (20, 30, 15.0, 60),
+                (30, 60, 25.0, 60),
+                (5, 5, 5.0, 5),
+            ]
+        );
+    }
+
+    #[test]
+    fn range_window_uses_sort_values() {
+        let docs = vec![
+            doc! {"t": 1, "v": 1},
+            doc! {"t": 2, "v": 2},
+            doc! {"t": 5, "v": 4},
+            doc! {"t": 6, "v": 8},
+        ];
+        let out = run(
+            docs,
+            doc! {
+                "sortBy": {"t": 1},
+                "output": {"near": {"$sum": "$v", "window": {"range": [-1, 0]}}},
+            },
+        );
+        let near: Vec<i32> = out.iter().map(|d| d.get_i32("near").unwrap()).collect();
+        assert_eq!(near, vec![1, 3, 4, 12]);
+    }
+
+    #[test]
+    fn shift_reads_neighbours_with_default() {
+        let docs = vec![doc! {"t": 1, "v": "x"}, doc! {"t": 2, "v": "y"}];
+        let out = run(
+            docs,
+            doc! {
+                "sortBy": {"t": 1},
+                "output": {"prev": {"$shift": {"output": "$v", "by": -1, "default": "none"}}},
+            },
+        );
+        assert_eq!(out[0].get_str("prev").unwrap(), "none");
+        assert_eq!(out[1].get_str("prev").unwrap(), "x");
+    }
+
+    #[test]
+    fn ranks_follow_sql_tie_semantics() {
+        let docs = vec![
+            doc! {"score": 70},
+            doc! {"score": 90},
+            doc! {"score": 80},
+            doc! {"score": 90},
+        ];
+        let out = run(
+            docs,
+            doc! {
+                "sortBy": {"score": -1},
+                "output": {
+                    "rank": {"$rank": {}},
+                    "dense": {"$denseRank": {}},
+                    "n": {"$documentNumber": {}},
+                },
+            },
+        );
+        let got: Vec<(i32, i32, i32, i32)> = out
+            .iter()
+            .map(|d| {
+                (
+                    d.get_i32("score").unwrap(),
+                    d.get_i32("rank").unwrap(),
+                    d.get_i32("dense").unwrap(),
+                    d.get_i32("n").unwrap(),
+                )
+            })
+            .collect();
+        assert_eq!(
+            got,
+            vec![(90, 1, 1, 1), (90, 1, 1, 2), (80, 3, 2, 3), (70, 4, 3, 4)]
+        );
+    }
+
+    #[test]
+    fn rejects_invalid_specs() {
+        for spec in [
+            doc! {"output": {"r": {"$rank": {}}}},
+            doc! {"sortBy": {"a": 1, "b": 1}, "output": {"r": {"$rank": {}}}},
+            doc! {"sortBy": {"a": 1}, "output": {"r": {"$rank": {}, "window": {"documents": [0, 0]}}}},
+            doc! {"output": {"s": {"$sum": "$v", "window": {"documents": [-1, 0]}}}},
+            doc! {"sortBy": {"a": 1}, "output": {"s": {"$sum": "$v", "window": {"documents": [1, 0]}}}},
+            doc! {"sortBy": {"a": 1}, "output": {"s": {"$sum": "$v", "window": {"range": [0, 1], "unit": "month"}}}},
+            doc! {"sortBy": {"a": 1}, "output": {"s": {"$median": "$v"}}},
+        ] {
+            assert!(
+                SetWindowFieldsSpec::parse(&Bson::Document(spec.clone())).is_err(),
+                "{:?}",
+                spec
+            );
+        }
+    }
 }
@@ -1,8 +1,19 @@
 use crate::aggregation::values::bson_cmp;
+use crate::store::Collation;
 use bson::{Bson, Document};
 use std::cmp::Ordering;
 
 pub fn execute(docs: Vec<Document>, spec: &Document) -> anyhow::Result<Vec<Document>> {
+    execute_with_collation(docs, spec, None)
+}
+
+/// Sort comparing strings case-insensitively when `collation` asks for it.
+pub fn execute_with_collation(
+    docs: Vec<Document>,
+    spec: &Document,
+    collation: Option<&Collation>,
+) -> anyhow::Result<Vec<Document>> {
+    let case_insensitive = collation.is_some_and(Collation::case_insensitive);
     let mut sort_specs: Vec<(String, i32)> = Vec::new();
 
     // Parse sort specification
@@ -28,7 +39,12 @@ pub fn execute(docs: Vec<Document>, spec: &Document) -> anyhow::Result<Vec<Docum
             let a_val = a.get(field).unwrap_or(&Bson::Null);
             let b_val = b.get(field).unwrap_or(&Bson::Null);
 
-            let cmp = bson_cmp(a_val, b_val);
+            let cmp = match (a_val, b_val) {
+                (Bson::String(x), Bson::String(y)) if case_insensitive => {
+                    x.to_lowercase().cmp(&y.to_lowercase())
+                }
+                _ => bson_cmp(a_val, b_val),
+            };
 
             if cmp != Ordering::Equal {
                 return if *direction == 1 { cmp } else { cmp.reverse() };
@@ -14,12 +14,19 @@ pub async fn execute(
 ) -> anyhow::Result<Vec<Document>> {
     let mut result = docs;
 
-    // Fetch documents from the other collection
-    let union_docs = pg.find_docs(db, coll, None, None, None, 100_000).await?;
+    // Fetch documents from the other collection, filtering in SQL by any leading $match
+    let leading = pipeline
+        .iter()
+        .take_while(|s| matches!(s, Stage::Match(_)))
+        .count();
+    let filter = combine_matches(&pipeline[..leading]);
+    let union_docs = pg
+        .find_docs(db, coll, filter.as_ref(), None, None, 100_000)
+        .await?;
 
-    // Apply optional pipeline to the union collection documents
+    // Apply the rest of the pipeline to the union collection documents
     let mut processed_union = union_docs;
-    for stage in pipeline {
+    for stage in &pipeline[leading..] {
         match stage {
             Stage::Match(filter) => {
                 processed_union.retain(|d| document_matches_filter(d, filter));
@@ -58,3 +65,60 @@ pub async fn execute(
 
     Ok(result)
 }
+
+/// The filter of a `$unionWith` pipeline made only of `$match` stages, so the whole branch can
+/// run as one side of a SQL `UNION ALL`. `Some(None)` means no filter at all; `None` means some
+/// stage has to run in memory.
+pub fn match_only_filter(pipeline: &[Stage]) -> Option<Option<Document>> {
+    if pipeline.iter().all(|s| matches!(s, Stage::Match(_))) {
+        Some(combine_matches(pipeline))
+    } else {
+        None
+    }
+}
+
+/// AND together the filters of consecutive `$match` stages.
+fn combine_matches(stages: &[Stage]) -> Option<Document> {
+    let mut filters: Vec<Document> = stages
+        .iter()
+        .filter_map(|s| match s {
+            Stage::Match(filter) => Some(filter.clone()),
+            _ => None,
+        })
+        .collect();
+    match filters.len() {
+        0 => None,
+        1 => filters.pop(),
+        _ => {
+            let mut and = Document::new();
+            and.insert(
+                "$and",
+                filters.into_iter().map(Bson::Document).collect::<Vec<_>>(),
+            );
+            Some(and)
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    #[test]
+    fn match_only_pipelines_push_down() {
+        assert_eq!(match_only_filter(&[]), Some(None));
+        assert_eq!(
+            match_only_filter(&[Stage::Match(doc! {"a": 1})]),
+            Some(Some(doc! {"a": 1}))
+        );
+        assert_eq!(
+            match_only_filter(&[Stage::Match(doc! {"a": 1}), Stage::Match(doc! {"b": 2})]),
+            Some(Some(doc! {"$and": [{"a": 1}, {"b": 2}]}))
+        );
+        assert_eq!(
+            match_only_filter(&[Stage::Match(doc! {"a": 1}), Stage::Limit(1)]),
+            None
+        );
+    }
+}
@@ -0,0 +1,438 @@
+//! Time zones for date expressions (`timezone` arguments).
+//!
+//! A zone is `UTC`/`GMT`, a fixed offset (`+05:30`, `-0800`, `+03`) or an Olson name such as
+//! `America/New_York`. Olson zones are read from the system zoneinfo database (`$TZDIR`,
+//! else `/usr/share/zoneinfo`): the TZif transition table covers past changes and its
+//! POSIX TZ footer (`EST5EDT,M3.2.0,M11.1.0`) the years after the last transition. Parsed
+//! zones are cached for the life of the process.
+
+use std::collections::HashMap;
+use std::sync::{Arc, Mutex, OnceLock};
+
+const DAY_SECS: i64 = 86_400;
+
+#[derive(Debug, Clone)]
+pub enum Timezone {
+    /// Offset east of UTC, in seconds
+    Fixed(i64),
+    Zone(Arc<ZoneRules>),
+}
+
+impl Timezone {
+    pub const UTC: Timezone = Timezone::Fixed(0);
+
+    pub fn parse(name: &str) -> anyhow::Result<Self> {
+        if matches!(name, "UTC" | "GMT" | "Z" | "Etc/UTC" | "Etc/GMT") {
+            return Ok(Self::UTC);
+        }
+        if name.starts_with('+') || name.starts_with('-') {
+            return parse_fixed_offset(name)
+                .map(Timezone::Fixed)
+                .ok_or_else(|| anyhow::anyhow!("unrecognized time zone identifier: \"{}\"", name));
+        }
+        load_zone(name).map(Timezone::Zone)
+    }
+
+    /// Offset east of UTC, in milliseconds, at UTC instant `utc_ms`.
+    pub fn offset_ms(&self, utc_ms: i64) -> i64 {
+        match self {
+            Timezone::Fixed(secs) => secs * 1000,
+            Timezone::Zone(rules) => rules.offset_at(utc_ms.div_euclid(1000)) * 1000,
+        }
+    }
+
+    /// Local wall-clock milliseconds of UTC instant `utc_ms`.
+    pub fn to_local(&self, utc_ms: i64) -> i64 {
+        utc_ms.saturating_add(self.offset_ms(utc_ms))
+    }
+
+    /// UTC instant of local wall-clock time `local_ms`. A time skipped by a forward
+    /// transition resolves with the offset in force before it; a repeated time resolves to
+    /// its first occurrence.
+    pub fn to_utc(&self, local_ms: i64) -> i64 {
+        let before = self.offset_ms(local_ms.saturating_sub(2 * DAY_SECS * 1000));
+        let after = self.offset_ms(local_ms.saturating_add(2 * DAY_SECS * 1000));
+        let (first, second) = if before >= after {
+            (before, after)
+        } else {
+            (after, before)
+        };
+        // Try the larger offset (the earlier instant) first so repeated times pick their
+        // first occurrence
+        for offset in [first, second] {
+            let utc = local_ms.saturating_sub(offset);
+            if self.offset_ms(utc) == offset {
+                return utc;
+            }
+        }
+        local_ms.saturating_sub(before)
+    }
+}
+
+/// `+HH:MM`, `+HHMM` or `+HH`, in seconds east of UTC.
+fn parse_fixed_offset(s: &str) -> Option<i64> {
+    let (sign, digits) = match s.split_at(1) {
+        ("+", rest) => (1, rest),
+        ("-", rest) => (-1, rest),
+        _ => return None,
+    };
+    let digits: String = match digits.split_once(':') {
+        Some((h, m)) if h.len() == 2 && m.len() == 2 => format!("{}{}", h, m),
+        Some(_) => return None,
+        None => digits.to_string(),
+    };
+    if !digits.bytes().all(|b| b.is_ascii_digit()) {
+        return None;
+    }
+    let (hours, minutes) = match digits.len() {
+        2 => (digits.parse::<i64>().ok()?, 0),
+        4 => (
+            digits[..2].parse::<i64>().ok()?,
+            digits[2..].parse::<i64>().ok()?,
+        ),
+        _ => return None,
+    };
+    if hours > 23 || minutes > 59 {
+        return None;
+    }
+    Some(sign * (hours * 3600 + minutes * 60))
+}
+
+fn load_zone(name: &str) -> anyhow::Result<Arc<ZoneRules>> {
+    static ZONES: OnceLock<Mutex<HashMap<String, Arc<ZoneRules>>>> = OnceLock::new();
+    let unknown = || anyhow::anyhow!("unrecognized time zone identifier: \"{}\"", name);
+    // Olson names are relative paths of letters, digits, '_', '-', '+' and '/'
+    if name.is_empty()
+        || name.starts_with('/')
+        || name.split('/').any(|part| part.is_empty() || part == "..")
+        || !name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '/' | '_' | '-' | '+'))
+    {
+        return Err(unknown());
+    }
+    let zones = ZONES.get_or_init(|| Mutex::new(HashMap::new()));
+    if let Some(rules) = zones.lock().ok().and_then(|z| z.get(name).cloned()) {
+        return Ok(rules);
+    }
+    let dir = std::env::var("TZDIR").unwrap_or_else(|_| "/usr/share/zoneinfo".to_string());
+    let bytes = std::fs::read(std::path::Path::new(&dir).join(name)).map_err(|_| unknown())?;
+    let rules = Arc::new(ZoneRules::parse_tzif(&bytes).ok_or_else(unknown)?);
+    if let Ok(mut z) = zones.lock() {
+        z.insert(name.to_string(), rules.clone());
+    }
+    Ok(rules)
+}
+
+/// Offsets of an Olson zone over time.
+#[derive(Debug)]
+pub struct ZoneRules {
+    /// (UTC seconds the offset starts at, offset east of UTC in seconds), ascending
+    transitions: Vec<(i64, i64)>,
+    /// Offset before the first transition
+    initial: i64,
+    /// Rule for instants after the last transition
+    footer: Option<PosixTz>,
+}
+
+impl ZoneRules {
+    fn offset_at(&self, utc_secs: i64) -> i64 {
+        match self.transitions.partition_point(|(at, _)| *at <= utc_secs) {
+            0 => self.initial,
+            n if n == self.transitions.len() => match &self.footer {
+                Some(tz) => tz.offset_at(utc_secs),
+                None => self.transitions[n - 1].1,
+            },
+            n => self.transitions[n - 1].1,
+        }
+    }
+
+    /// Parse a TZif file, preferring the 64-bit data block of version 2+ files.
+    fn parse_tzif(data: &[u8]) -> Option<Self> {
+        let header = |d: &[u8]| -> Option<[usize; 6]> {
+            if d.get(..4)? != b"TZif" {
+                return None;
+            }
+            let mut counts = [0usize; 6];
+            for (i, c) in counts.iter_mut().enumerate() {
+                let at = 20 + i * 4;
+                *c = u32::from_be_bytes(d.get(at..at + 4)?.try_into().ok()?) as usize;
+            }
+            Some(counts)
+        };
+        let [isutcnt, isstdcnt, leapcnt, timecnt, typecnt, charcnt] = header(data)?;
+        let v1_len = timecnt * 5 + typecnt * 6 + charcnt + leapcnt * 8 + isstdcnt + isutcnt;
+        let (block, time_size, counts) = if data[4] >= b'2' {
+            let second = data.get(44 + v1_len..)?;
+            (second, 8, header(second)?)
+        } else {
+            (
+                data,
+                4,
+                [isutcnt, isstdcnt, leapcnt, timecnt, typecnt, charcnt],
+            )
+        };
+        let [isutcnt, isstdcnt, leapcnt, timecnt, typecnt, charcnt] = counts;
+        let body = block.get(44..)?;
+
+        let times_end = timecnt * time_size;
+        let idx_end = times_end + timecnt;
+        let types_end = idx_end + typecnt * 6;
+        let data_end = types_end + charcnt + leapcnt * (time_size + 4) + isstdcnt + isutcnt;
+        let types: Vec<(i64, bool)> = body
+            .get(idx_end..types_end)?
+            .chunks(6)
+            .map(|t| {
+                let off = i32::from_be_bytes([t[0], t[1], t[2], t[3]]) as i64;
+                (off, t[4] != 0)
+            })
+            .collect();
+        if types.is_empty() {
+            return None;
+        }
+        let mut transitions = Vec::with_capacity(timecnt);
+        for i in 0..timecnt {
+            let raw = body.get(i * time_size..(i + 1) * time_size)?;
+            let at = if time_size == 8 {
+                i64::from_be_bytes(raw.try_into().ok()?)
+            } else {
+                i32::from_be_bytes(raw.try_into().ok()?) as i64
+            };
+            let ty = *body.get(times_end + i)? as usize;
+            transitions.push((at, types.get(ty)?.0));
+        }
+        // Before the first transition the first standard-time type applies
+        let initial = types.iter().find(|(_, dst)| !dst).unwrap_or(&types[0]).0;
+        let footer = if time_size == 8 {
+            body.get(data_end..)
+                .and_then(|rest| std::str::from_utf8(rest).ok())
+                .map(|s| s.trim_matches('\n'))
+                .filter(|s| !s.is_empty())
+                .and_then(PosixTz::parse)
+        } else {
+            None
+        };
+        Some(Self {
+            transitions,
+            initial,
+            footer,
+        })
+    }
+}
+
+/// A POSIX TZ rule such as `CET-1CEST,M3.5.0,M10.5.0/3`.
+#[derive(Debug, Clone, PartialEq)]
+struct PosixTz {
+    /// Standard offset east of UTC, in seconds
+    std_offset: i64,
+    dst: Option<PosixDst>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+struct PosixDst {
+    offset: i64,
+    start: (DayRule, i64),
+    end: (DayRule, i64),
+}
+
+/// Day of the year a DST change happens on.
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum DayRule {
+    /// `Jn`: day 1..=365, never counting February 29
+    Julian(i64),
+    /// `n`: zero-based day of the year, counting February 29
+    Zero(i64),
+    /// `Mm.w.d`: weekday `d` (0 = Sunday) of week `w` (5 = last) of month `m`
+    Month(i64, i64, i64),
+}
+
+impl PosixTz {
+    fn parse(s: &str) -> Option<Self> {
+        let mut rest = s;
+        skip_name(&mut rest)?;
+        // POSIX offsets count west of UTC
+        let std_offset = -take_time(&mut rest)?;
+        if rest.is_empty() {
+            return Some(Self {
+                std_offset,
+                dst: None,
+            });
+        }
+        skip_name(&mut rest)?;
+        let offset = if rest.starts_with(',') || rest.is_empty() {
+            std_offset + 3600
+        } else {
+            -take_time(&mut rest)?
+        };
+        let rule = |rest: &mut &str| -> Option<(DayRule, i64)> {
+            *rest = rest.strip_prefix(',')?;
+            let day = take_day_rule(rest)?;
+            let time = match rest.strip_prefix('/') {
+                Some(r) => {
+                    *rest = r;
+                    take_time(rest)?
+                }
+                None => 7200,
+            };
+            Some((day, time))
+        };
+        let start = rule(&mut rest)?;
+        let end = rule(&mut rest)?;
+        Some(Self {
+            std_offset,
+            dst: Some(PosixDst { offset, start, end }),
+        })
+    }
+
+    fn offset_at(&self, utc_secs: i64) -> i64 {
+        let Some(dst) = &self.dst else {
+            return self.std_offset;
+        };
+        let (year, _, _) = crate::aggregation::dates::civil_from_days(
+            (utc_secs + self.std_offset).div_euclid(DAY_SECS),
+        );
+        // Transition times are local: the start in standard time, the end in DST
+        let start = dst.start.0.day_in(year) * DAY_SECS + dst.start.1 - self.std_offset;
+        let end = dst.end.0.day_in(year) * DAY_SECS + dst.end.1 - dst.offset;
+        let in_dst = if start < end {
+            utc_secs >= start && utc_secs < end
+        } else {
+            // Southern hemisphere: DST spans the new year
+            utc_secs >= start || utc_secs < end
+        };
+        if in_dst { dst.offset } else { self.std_offset }
+    }
+}
+
+impl DayRule {
+    /// Days since 1970-01-01 of this rule's day in `year`.
+    fn day_in(self, year: i64) -> i64 {
+        use crate::aggregation::dates::{days_from_civil, days_in_month, is_leap_year};
+        let jan1 = days_from_civil(year, 1, 1);
+        match self {
+            DayRule::Julian(n) => jan1 + n - 1 + i64::from(is_leap_year(year) && n >= 60),
+            DayRule::Zero(n) => jan1 + n,
+            DayRule::Month(m, w, d) => {
+                let first = days_from_civil(year, m, 1);
+                // 1970-01-01 was a Thursday
+                let first_weekday = (first + 4).rem_euclid(7);
+                let mut day = first + (d - first_weekday).rem_euclid(7) + (w - 1) * 7;
+                let last = first + days_in_month(year, m) - 1;
+                while day > last {
+                    day -= 7;
+                }
+                day
+            }
+        }
+    }
+}
+
+/// Skip a zone abbreviation: letters, or anything inside `<...>`.
+fn skip_name(s: &mut &str) -> Option<()> {
+    if let Some(rest) = s.strip_prefix('<') {
+        let end = rest.find('>')?;
+        *s = &rest[end + 1..];
+        return Some(());
+    }
+    let len = s
+        .find(|c: char| !c.is_ascii_alphabetic())
+        .unwrap_or(s.len());
+    if len < 3 {
+        return None;
+    }
+    *s = &s[len..];
+    Some(())
+}
+
+/// `[+-]hh[:mm[:ss]]` in seconds.
+fn take_time(s: &mut &str) -> Option<i64> {
+    let (sign, rest) = match s.as_bytes().first()? {
+        b'-' => (-1, &s[1..]),
+        b'+' => (1, &s[1..]),
+        _ => (1, *s),
+    };
+    let len = rest
+        .find(|c: char| !(c.is_ascii_digit() || c == ':'))
+        .unwrap_or(rest.len());
+    let mut secs = 0;
+    let mut unit = 3600;
+    for part in rest[..len].split(':') {
+        secs += part.parse::<i64>().ok()? * unit;
+        unit /= 60;
+    }
+    *s = &rest[len..];
+    Some(sign * secs)
+}
+
+fn take_day_rule(s: &mut &str) -> Option<DayRule> {
+    let number = |s: &mut &str| -> Option<i64> {
+        let len = s.find(|c: char| !c.is_ascii_digit()).unwrap_or(s.len());
+        let n = s[..len].parse().ok()?;
+        *s = &s[len..];
+        Some(n)
+    };
+    if let Some(rest) = s.strip_prefix('M') {
+        *s = rest;
+        let m = number(s)?;
+        *s = s.strip_prefix('.')?;
+        let w = number(s)?;
+        *s = s.strip_prefix('.')?;
+        let d = number(s)?;
+        return Some(DayRule::Month(m, w, d));
+    }
+    if let Some(rest) = s.strip_prefix('J') {
+        *s = rest;
+        return Some(DayRule::Julian(number(s)?));
+    }
+    Some(DayRule::Zero(number(s)?))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn fixed_offsets() {
+        assert_eq!(parse_fixed_offset("+05:30"), Some(19_800));
+        assert_eq!(parse_fixed_offset("-0800"), Some(-28_800));
+        assert_eq!(parse_fixed_offset("+03"), Some(10_800));
+        assert_eq!(parse_fixed_offset("+5"), None);
+        assert_eq!(parse_fixed_offset("+24:00"), None);
+        assert!(Timezone::parse("../etc/passwd").is_err());
+    }
+
+    #[test]
+    fn posix_rules_follow_dst() {
+        let ny = PosixTz::parse("EST5EDT,M3.2.0,M11.1.0").unwrap();
+        // 2024-03-10 06:59:59Z is 01:59:59 EST; a second later clocks jump to 03:00 EDT
+        assert_eq!(ny.offset_at(1_710_053_999), -5 * 3600);
+        assert_eq!(ny.offset_at(1_710_054_000), -4 * 3600);
+        // 2024-11-03 05:59:59Z is 01:59:59 EDT; a second later it is 01:00 EST again
+        assert_eq!(ny.offset_at(1_730_613_599), -4 * 3600);
+        assert_eq!(ny.offset_at(1_730_613_600), -5 * 3600);
+
+        let sydney = PosixTz::parse("AEST-10AEDT,M10.1.0,M4.1.0/3").unwrap();
+        assert_eq!(sydney.offset_at(1_704_067_200), 11 * 3600); // January: summer
+        assert_eq!(sydney.offset_at(1_719_792_000), 10 * 3600); // July: winter
+
+        let fixed = PosixTz::parse("<+0545>-5:45").unwrap();
+        assert_eq!(fixed.offset_at(0), 5 * 3600 + 45 * 60);
+    }
+
+    #[test]
+    fn local_times_in_gaps_and_overlaps() {
+        let ny = Timezone::Zone(Arc::new(ZoneRules {
+            transitions: Vec::new(),
+            initial: -5 * 3600,
+            footer: PosixTz::parse("EST5EDT,M3.2.0,M11.1.0"),
+        }));
+        let hour = 3_600_000;
+        // 2024-03-10T02:30 does not exist in New York; the EST offset applies
+        let local_gap = 1_710_037_800_000; // 2024-03-10T02:30:00 as if UTC
+        assert_eq!(ny.to_utc(local_gap), local_gap + 5 * hour);
+        // 2024-11-03T01:30 happens twice; the first (EDT) occurrence wins
+        let local_overlap = 1_730_597_400_000; // 2024-11-03T01:30:00 as if UTC
+        assert_eq!(ny.to_utc(local_overlap), local_overlap + 4 * hour);
+        assert_eq!(ny.to_local(local_overlap + 4 * hour), local_overlap);
+    }
+}
@@ -0,0 +1,168 @@
+//! Update pipelines: an `update` whose `u` is an array rewrites each matched document through
+//! a restricted aggregation pipeline (MongoDB 4.2+).
+
+use crate::aggregation::pipeline::{Pipeline, Stage};
+use crate::aggregation::stages;
+use bson::{Bson, Document};
+use std::collections::HashMap;
+
+/// Stages MongoDB accepts inside an update pipeline.
+pub const UPDATE_PIPELINE_STAGES: &[&str] = &[
+    "$addFields",
+    "$set",
+    "$project",
+    "$unset",
+    "$replaceRoot",
+    "$replaceWith",
+];
+
+#[derive(Debug, thiserror::Error)]
+pub enum UpdatePipelineError {
+    #[error("{0} is not allowed to be used within an update")]
+    StageNotAllowed(String),
+    #[error(
+        "After applying the update, the (immutable) field '_id' was found to have been altered to _id: {0}"
+    )]
+    IdAltered(Bson),
+}
+
+impl UpdatePipelineError {
+    /// MongoDB error code: InvalidOptions (72) or ImmutableField (66).
+    pub fn code(&self) -> i32 {
+        match self {
+            UpdatePipelineError::StageNotAllowed(_) => 72,
+            UpdatePipelineError::IdAltered(_) => 66,
+        }
+    }
+}
+
+/// Run `pipeline` over `doc` with the command's variables (`$$NOW`, `let`), returning the
+/// replacement document. A result without `_id` keeps the original one; a result with a
+/// different `_id` is rejected.
+pub fn apply_pipeline(
+    doc: &Document,
+    pipeline: &[Bson],
+    vars: &HashMap<String, Bson>,
+) -> anyhow::Result<Document> {
+    let mut docs = vec![doc.clone()];
+    for stage_bson in pipeline {
+        let stage_doc = stage_bson
+            .as_document()
+            .ok_or_else(|| anyhow::anyhow!("update pipeline stage must be a document"))?;
+        if let Some(name) = stage_doc.keys().next()
+            && !UPDATE_PIPELINE_STAGES.contains(&name.as_str())
+        {
+            return Err(UpdatePipelineError::StageNotAllowed(name.clone()).into());
+        }
+        docs = match Pipeline::parse_stage(stage_doc)? {
+            Stage::AddFields(spec) => stages::add_fields::execute(docs, &spec, vars)?,
+            Stage::Set(spec) => stages::set::execute(docs, &spec, vars)?,
+            Stage::Project(spec) => stages::project::execute(docs, &spec, vars)?,
+            Stage::Unset(fields) => stages::unset::execute(docs, &fields)?,
+            Stage::ReplaceRoot { replacement } | Stage::ReplaceWith(replacement) => {
+                stages::replace_root::execute(docs, &replacement, vars)?
+            }
+            other => return Err(anyhow::anyhow!("unexpected update stage {:?}", other)),
+        };
+    }
+    let mut updated = docs
+        .pop()
+        .ok_or_else(|| anyhow::anyhow!("update pipeline produced no document"))?;
+    match (doc.get("_id"), updated.get("_id")) {
+        (Some(id), None) => {
+            let mut with_id = Document::new();
+            with_id.insert("_id", id.clone());
+            with_id.extend(updated);
+            updated = with_id;
+        }
+        (Some(id), Some(new_id)) if id != new_id => {
+            return Err(UpdatePipelineError::IdAltered(new_id.clone()).into());
+        }
+        _ => {}
+    }
+    Ok(updated)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    fn stages(v: Vec<Document>) -> Vec<Bson> {
+        v.into_iter().map(Bson::Document).collect()
+    }
+
+    #[test]
+    fn set_and_unset_reference_existing_fields() {
+        let doc = doc! {"_id": 1, "price": 10, "qty": 3, "tmp": true};
+        let out = apply_pipeline(
+            &doc,
+            &stages(vec![
+                doc! {"$set": {"total": {"$multiply": ["$price", "$qty"]}}},
+                doc! {"$unset": "tmp"},
+            ]),
+            &HashMap::new(),
+        )
+        .unwrap();
+        assert_eq!(out.get_i32("total").unwrap(), 30);
+        assert!(!out.contains_key("tmp"));
+        assert_eq!(out.get_i32("_id").unwrap(), 1);
+    }
+
+    #[test]
+    fn replace_root_keeps_original_id() {
+        let doc = doc! {"_id": 7, "profile": {"name": "ada", "lang": "en"}};
+        let out = apply_pipeline(
+            &doc,
+            &stages(vec![doc! {"$replaceRoot": {"newRoot": "$profile"}}]),
+            &HashMap::new(),
+        )
+        .unwrap();
+        assert_eq!(out, doc! {"_id": 7, "name": "ada", "lang": "en"});
+    }
+
+    #[test]
+    fn rejects_other_stages_and_id_changes() {
+        let doc = doc! {"_id": 1, "a": 1};
+        let err = apply_pipeline(
+            &doc,
+            &stages(vec![doc! {"$group": {"_id": null}}]),
+            &HashMap::new(),
+        )
+        .unwrap_err();
+        assert_eq!(
+            err.downcast_ref::<UpdatePipelineError>().map(|e| e.code()),
+            Some(72)
+        );
+        let err = apply_pipeline(
+            &doc,
+            &stages(vec![doc! {"$set": {"_id": 2}}]),
+            &HashMap::new(),
+        )
+        .unwrap_err();
+        assert_eq!(
+            err.downcast_ref::<UpdatePipelineError>().map(|e| e.code()),
+            Some(66)
+        );
+    }
+
+    #[test]
+    fn now_is_the_commands_and_remove_drops_fields() {
+        let now = bson::DateTime::from_millis(1_700_000_000_000);
+        let vars = HashMap::from([(
+            crate::aggregation::expr::NOW_VAR.to_string(),
+            Bson::DateTime(now),
+        )]);
+        let doc = doc! {"_id": 1, "qty": 0, "note": "empty"};
+        let out = apply_pipeline(
+            &doc,
+            &stages(vec![doc! {"$set": {
+                "updatedAt": "$$NOW",
+                "note": {"$cond": [{"$gt": ["$qty", 0]}, "$note", "$$REMOVE"]},
+            }}]),
+            &vars,
+        )
+        .unwrap();
+        assert_eq!(out, doc! {"_id": 1, "qty": 0, "updatedAt": now});
+    }
+}
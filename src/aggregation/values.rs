@@ -1,4 +1,4 @@
-use bson::Bson;
+use bson::{Bson, Document};
 use std::cmp::Ordering;
 
 /// Compare two BSON values according to MongoDB ordering rules
@@ -81,6 +81,41 @@ impl Numeric {
     }
 }
 
+/// Result of integer arithmetic under MongoDB's widening rules: an int32 when every operand
+/// was an int32 and the value fits, else an int64 when it fits, else a double.
+pub fn integer_result(value: i128, saw_long: bool) -> Bson {
+    if !saw_long && let Ok(n) = i32::try_from(value) {
+        return Bson::Int32(n);
+    }
+    match i64::try_from(value) {
+        Ok(n) => Bson::Int64(n),
+        Err(_) => Bson::Double(value as f64),
+    }
+}
+
+/// Merge documents left to right, later fields overwriting earlier ones (`$mergeObjects`).
+/// Null and missing values are skipped; anything else that is not a document is an error.
+pub fn merge_objects<I: IntoIterator<Item = Bson>>(values: I) -> anyhow::Result<Document> {
+    let mut merged = Document::new();
+    for value in values {
+        match value {
+            Bson::Document(doc) => {
+                for (k, v) in doc {
+                    merged.insert(k, v);
+                }
+            }
+            Bson::Null | Bson::Undefined => {}
+            other => {
+                return Err(anyhow::anyhow!(
+                    "$mergeObjects requires object inputs, but input is of type {:?}",
+                    other.element_type()
+                ));
+            }
+        }
+    }
+    Ok(merged)
+}
+
 /// Coerce a BSON value to a numeric type
 pub fn coerce_numeric(val: &Bson) -> Option<Numeric> {
     match val {
@@ -0,0 +1,324 @@
+//! BSON types as seen through the JSONB copy of a document.
+//!
+//! Every document is stored twice: `doc_bson` keeps the exact BSON and is what reads decode,
+//! while `doc` is JSONB for SQL filtering, sorting and indexing. JSONB has a single number
+//! type, yet most BSON numbers survive the trip: doubles keep their decimal point (`1.0`)
+//! and integers beyond the int32 range can only be int64s. The ambiguous values are int64s
+//! that fit in an int32 and integral doubles of 1e16 or more, which print without a decimal
+//! point. [`to_jsonb`] records those under a reserved top-level `$types` key mapping each
+//! dotted path (array elements by index) to `"long"` or `"double"`; [`restore_tags`] puts the
+//! types back on documents rebuilt from JSONB. Documents without such values carry no tags.
+
+use crate::translate::{pg_path_literal, sql_quote};
+use bson::{Bson, Document};
+use serde_json::{Map, Value};
+
+/// Reserved top-level JSONB key holding the numeric type tags.
+pub const TYPES_KEY: &str = "$types";
+
+/// `$type` aliases and their numeric codes.
+const TYPE_ALIASES: &[(&str, i32)] = &[
+    ("double", 1),
+    ("string", 2),
+    ("object", 3),
+    ("array", 4),
+    ("binData", 5),
+    ("undefined", 6),
+    ("objectId", 7),
+    ("bool", 8),
+    ("date", 9),
+    ("null", 10),
+    ("regex", 11),
+    ("dbPointer", 12),
+    ("javascript", 13),
+    ("symbol", 14),
+    ("javascriptWithScope", 15),
+    ("int", 16),
+    ("timestamp", 17),
+    ("long", 18),
+    ("decimal", 19),
+    ("minKey", -1),
+    ("maxKey", 127),
+];
+
+/// Extended JSON keys marking BSON types that JSONB holds as objects.
+const EXTJSON_MARKERS: &[(&str, &str)] = &[
+    ("binData", "$binary"),
+    ("undefined", "$undefined"),
+    ("objectId", "$oid"),
+    ("date", "$date"),
+    ("regex", "$regularExpression"),
+    ("dbPointer", "$dbPointer"),
+    ("javascript", "$code"),
+    ("symbol", "$symbol"),
+    ("timestamp", "$timestamp"),
+    ("decimal", "$numberDecimal"),
+    ("decimal", "$numberDecimalBytes"),
+    ("minKey", "$minKey"),
+    ("maxKey", "$maxKey"),
+];
+
+/// The `$type` alias of `value`.
+pub fn alias_of(value: &Bson) -> &'static str {
+    match value {
+        Bson::Double(_) => "double",
+        Bson::String(_) => "string",
+        Bson::Document(_) => "object",
+        Bson::Array(_) => "array",
+        Bson::Binary(_) => "binData",
+        Bson::Undefined => "undefined",
+        Bson::ObjectId(_) => "objectId",
+        Bson::Boolean(_) => "bool",
+        Bson::DateTime(_) => "date",
+        Bson::Null => "null",
+        Bson::RegularExpression(_) => "regex",
+        Bson::DbPointer(_) => "dbPointer",
+        Bson::JavaScriptCode(_) => "javascript",
+        Bson::Symbol(_) => "symbol",
+        Bson::JavaScriptCodeWithScope(_) => "javascriptWithScope",
+        Bson::Int32(_) => "int",
+        Bson::Timestamp(_) => "timestamp",
+        Bson::Int64(_) => "long",
+        Bson::Decimal128(_) => "decimal",
+        Bson::MinKey => "minKey",
+        Bson::MaxKey => "maxKey",
+    }
+}
+
+/// Aliases named by a `$type` operand: an alias, a numeric code, `"number"`, or an array of
+/// those. `None` when any of them is unknown.
+pub fn parse_type_spec(spec: &Bson) -> Option<Vec<&'static str>> {
+    fn one(spec: &Bson) -> Option<&'static str> {
+        let code = match spec {
+            Bson::String(s) if s == "number" => return Some("number"),
+            Bson::String(s) => {
+                return TYPE_ALIASES
+                    .iter()
+                    .find(|(alias, _)| alias == s)
+                    .map(|(alias, _)| *alias);
+            }
+            Bson::Int32(n) => *n as i64,
+            Bson::Int64(n) => *n,
+            Bson::Double(f) if f.fract() == 0.0 => *f as i64,
+            _ => return None,
+        };
+        TYPE_ALIASES
+            .iter()
+            .find(|(_, c)| *c as i64 == code)
+            .map(|(alias, _)| *alias)
+    }
+    match spec {
+        Bson::Array(items) => items.iter().map(one).collect(),
+        other => one(other).map(|alias| vec![alias]),
+    }
+}
+
+/// In-memory `$type`: `value` has one of the types in `spec`. Like MongoDB, an array also
+/// matches when any of its elements does.
+pub fn matches(value: &Bson, spec: &Bson) -> bool {
+    let Some(aliases) = parse_type_spec(spec) else {
+        return false;
+    };
+    let is = |v: &Bson| {
+        let alias = alias_of(v);
+        aliases.iter().any(|a| {
+            *a == alias
+                || (*a == "number" && matches!(alias, "double" | "int" | "long" | "decimal"))
+        })
+    };
+    match value {
+        Bson::Array(items) => is(value) || items.iter().any(is),
+        other => is(other),
+    }
+}
+
+/// JSONB encoding of `doc`, with `$types` tags for numbers JSONB cannot tell apart.
+pub fn to_jsonb(doc: &Document) -> serde_json::Result<Value> {
+    let mut json = serde_json::to_value(doc)?;
+    let mut tags = Map::new();
+    for (k, v) in doc.iter() {
+        collect_tags(v, k, &mut tags);
+    }
+    if !tags.is_empty()
+        && let Value::Object(map) = &mut json
+    {
+        map.insert(TYPES_KEY.to_string(), Value::Object(tags));
+    }
+    Ok(json)
+}
+
+fn collect_tags(value: &Bson, path: &str, tags: &mut Map<String, Value>) {
+    match value {
+        Bson::Int64(n) if i32::try_from(*n).is_ok() => {
+            tags.insert(path.to_string(), Value::String("long".into()));
+        }
+        Bson::Double(f) if f.is_finite() && f.fract() == 0.0 && f.abs() >= 1e16 => {
+            tags.insert(path.to_string(), Value::String("double".into()));
+        }
+        Bson::Document(d) => {
+            for (k, v) in d.iter() {
+                collect_tags(v, &format!("{}.{}", path, k), tags);
+            }
+        }
+        Bson::Array(items) => {
+            for (i, v) in items.iter().enumerate() {
+                collect_tags(v, &format!("{}.{}", path, i), tags);
+            }
+        }
+        _ => {}
+    }
+}
+
+/// Give the values tagged in `tags` (a `$types` object) back their BSON types.
+pub fn restore_tags(doc: &mut Document, tags: &Map<String, Value>) {
+    for (path, tag) in tags {
+        let Some(value) = value_at_mut(doc, path) else {
+            continue;
+        };
+        let restored = match (tag.as_str(), &*value) {
+            (Some("long"), Bson::Int32(n)) => Bson::Int64(*n as i64),
+            (Some("double"), Bson::Int32(n)) => Bson::Double(*n as f64),
+            (Some("double"), Bson::Int64(n)) => Bson::Double(*n as f64),
+            _ => continue,
+        };
+        *value = restored;
+    }
+}
+
+fn value_at_mut<'a>(doc: &'a mut Document, path: &str) -> Option<&'a mut Bson> {
+    let mut segs = path.split('.');
+    let mut cur = doc.get_mut(segs.next()?)?;
+    for seg in segs {
+        cur = match cur {
+            Bson::Document(d) => d.get_mut(seg)?,
+            Bson::Array(items) => items.get_mut(seg.parse::<usize>().ok()?)?,
+            _ => return None,
+        };
+    }
+    Some(cur)
+}
+
+/// SQL predicate for `{path: {$type: spec}}` over the JSONB `doc`, or `None` when `spec`
+/// names an unknown type. Numeric types consult the `$types` tags.
+pub fn sql_predicate(path: &str, spec: &Bson) -> Option<String> {
+    let aliases = parse_type_spec(spec)?;
+    let v = format!("(doc #> {})", pg_path_literal(path));
+    let tag = format!("COALESCE(doc->'{}'->>{}, '')", TYPES_KEY, sql_quote(path));
+    let elem_tag = format!(
+        "COALESCE(doc->'{}'->>({} || '.' || (e.i - 1)), '')",
+        TYPES_KEY,
+        sql_quote(path)
+    );
+    let whole: Vec<String> = aliases.iter().map(|a| sql_type_test(a, &v, &tag)).collect();
+    let elems: Vec<String> = aliases
+        .iter()
+        .map(|a| sql_type_test(a, "e.v", &elem_tag))
+        .collect();
+    Some(format!(
+        "(({}) OR EXISTS (SELECT 1 FROM jsonb_array_elements(CASE WHEN jsonb_typeof({}) = 'array' THEN {} ELSE '[]'::jsonb END) WITH ORDINALITY AS e(v, i) WHERE {}))",
+        whole.join(" OR "),
+        v,
+        v,
+        elems.join(" OR ")
+    ))
+}
+
+/// Whether the JSONB value `v`, tagged `tag`, holds BSON type `alias`. Casts sit behind
+/// `CASE` so they only see values of the right JSON type.
+fn sql_type_test(alias: &str, v: &str, tag: &str) -> String {
+    let json_type = |t: &str| format!("jsonb_typeof({}) = '{}'", v, t);
+    let object_with = |cond: String| {
+        format!(
+            "CASE WHEN jsonb_typeof({}) = 'object' THEN {} ELSE false END",
+            v, cond
+        )
+    };
+    let integral = format!("{}::text !~ '[.eE]'", v);
+    let int32 = format!("{}::numeric BETWEEN {} AND {}", v, i32::MIN, i32::MAX);
+    let number = |cond: String| {
+        format!(
+            "CASE WHEN jsonb_typeof({}) = 'number' THEN {} ELSE false END",
+            v, cond
+        )
+    };
+    match alias {
+        "number" => json_type("number"),
+        "double" => number(format!("(NOT {} OR {} = 'double')", integral, tag)),
+        "int" => number(format!("({} AND {} = '' AND {})", integral, tag, int32)),
+        "long" => number(format!(
+            "({} AND ({} = 'long' OR ({} = '' AND NOT {})))",
+            integral, tag, tag, int32
+        )),
+        "string" => json_type("string"),
+        "array" => json_type("array"),
+        "bool" => json_type("boolean"),
+        "null" => json_type("null"),
+        "object" => {
+            let markers: Vec<String> = EXTJSON_MARKERS
+                .iter()
+                .map(|(_, key)| sql_quote(key))
+                .collect();
+            object_with(format!("NOT {} ?| ARRAY[{}]", v, markers.join(", ")))
+        }
+        "javascript" => object_with(format!("{} ? '$code' AND NOT {} ? '$scope'", v, v)),
+        "javascriptWithScope" => object_with(format!("{} ? '$scope'", v)),
+        other => {
+            let markers: Vec<String> = EXTJSON_MARKERS
+                .iter()
+                .filter(|(alias, _)| *alias == other)
+                .map(|(_, key)| sql_quote(key))
+                .collect();
+            if markers.is_empty() {
+                return "false".to_string();
+            }
+            object_with(format!("{} ?| ARRAY[{}]", v, markers.join(", ")))
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    #[test]
+    fn tags_only_ambiguous_numbers() {
+        let d = doc! {"i": 1i32, "l": 2i64, "big": 5_000_000_000i64, "f": 1.5, "arr": [1i32, 3i64], "sub": {"n": 4i64, "e": 1e17}};
+        let json = to_jsonb(&d).unwrap();
+        let tags = json.get(TYPES_KEY).unwrap().as_object().unwrap();
+        assert_eq!(tags.len(), 4);
+        assert_eq!(tags["l"], "long");
+        assert_eq!(tags["arr.1"], "long");
+        assert_eq!(tags["sub.n"], "long");
+        assert_eq!(tags["sub.e"], "double");
+        assert!(
+            to_jsonb(&doc! {"i": 1i32, "f": 2.0})
+                .unwrap()
+                .get(TYPES_KEY)
+                .is_none()
+        );
+    }
+
+    #[test]
+    fn restore_reverses_tags() {
+        let mut d = doc! {"l": 2i32, "arr": [1i32, 3i32], "sub": {"e": 7i32}};
+        let tags =
+            serde_json::json!({"l": "long", "arr.1": "long", "sub.e": "double", "gone": "long"});
+        restore_tags(&mut d, tags.as_object().unwrap());
+        assert_eq!(d, doc! {"l": 2i64, "arr": [1i32, 3i64], "sub": {"e": 7.0}});
+    }
+
+    #[test]
+    fn type_matches_aliases_codes_and_arrays() {
+        assert!(matches(&Bson::Int32(1), &Bson::String("int".into())));
+        assert!(!matches(&Bson::Int32(1), &Bson::String("long".into())));
+        assert!(matches(&Bson::Int64(1), &Bson::Int32(18)));
+        assert!(matches(&Bson::Double(1.0), &Bson::String("number".into())));
+        assert!(matches(
+            &Bson::Array(vec![Bson::String("a".into()), Bson::Int64(2)]),
+            &Bson::String("long".into())
+        ));
+        assert!(!matches(&Bson::Int32(1), &Bson::String("integer".into())));
+        assert!(sql_predicate("a", &Bson::String("integer".into())).is_none());
+    }
+}
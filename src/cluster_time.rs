@@ -0,0 +1,195 @@
+//! The logical clock behind `$clusterTime` and `operationTime`.
+//!
+//! Drivers gossip the highest cluster time they have seen: every reply carries the server's
+//! `$clusterTime`, and commands echo back the latest one the client knows, which moves the
+//! clock forward. The clock is a BSON Timestamp of wall-clock seconds plus an increment,
+//! ticked once per command so each `operationTime` is later than the one before. A
+//! standalone has no keys to sign with, so the signature is the all-zero placeholder MongoDB
+//! uses when authentication is off.
+
+use bson::{Bson, Document, Timestamp, doc, spec::BinarySubtype};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+/// How often a read waiting for `afterClusterTime` re-checks the clock.
+const WAIT_POLL_INTERVAL: Duration = Duration::from_millis(10);
+
+/// A monotonic cluster time, packed as `time << 32 | increment`.
+#[derive(Debug, Default)]
+pub struct LogicalClock {
+    packed: AtomicU64,
+}
+
+impl LogicalClock {
+    pub const fn new() -> Self {
+        Self {
+            packed: AtomicU64::new(0),
+        }
+    }
+
+    /// The latest time handed out or learned.
+    pub fn now(&self) -> Timestamp {
+        unpack(self.packed.load(Ordering::Acquire))
+    }
+
+    /// A time later than every time before it: the current second with increment 1 once the
+    /// wall clock has passed the clock, the next increment otherwise.
+    pub fn tick(&self) -> Timestamp {
+        let wall = wall_seconds();
+        let mut cur = self.packed.load(Ordering::Acquire);
+        loop {
+            let last = unpack(cur);
+            let next = if wall > last.time {
+                Timestamp {
+                    time: wall,
+                    increment: 1,
+                }
+            } else if last.increment == u32::MAX {
+                Timestamp {
+                    time: last.time + 1,
+                    increment: 1,
+                }
+            } else {
+                Timestamp {
+                    time: last.time,
+                    increment: last.increment + 1,
+                }
+            };
+            match self.packed.compare_exchange_weak(
+                cur,
+                pack(next),
+                Ordering::AcqRel,
+                Ordering::Acquire,
+            ) {
+                Ok(_) => return next,
+                Err(actual) => cur = actual,
+            }
+        }
+    }
+
+    /// Move the clock up to `ts` if it is behind; it never moves back.
+    pub fn advance(&self, ts: Timestamp) {
+        self.packed.fetch_max(pack(ts), Ordering::AcqRel);
+    }
+
+    /// Wait until the clock reaches `ts`, for at most `timeout`; false when it ran out.
+    /// Every write is committed before its reply is stamped, so once the clock has reached
+    /// a time all writes stamped up to it are visible. A time in the future is reached when
+    /// the wall clock passes its second.
+    pub async fn wait_for(&self, ts: Timestamp, timeout: Option<Duration>) -> bool {
+        let deadline = timeout.map(|t| Instant::now() + t);
+        loop {
+            if pack(self.now()) >= pack(ts) {
+                return true;
+            }
+            if wall_seconds() > ts.time {
+                self.tick();
+                continue;
+            }
+            if deadline.is_some_and(|d| Instant::now() >= d) {
+                return false;
+            }
+            tokio::time::sleep(WAIT_POLL_INTERVAL).await;
+        }
+    }
+}
+
+fn wall_seconds() -> u32 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs() as u32)
+        .unwrap_or(0)
+}
+
+fn pack(ts: Timestamp) -> u64 {
+    ((ts.time as u64) << 32) | ts.increment as u64
+}
+
+fn unpack(v: u64) -> Timestamp {
+    Timestamp {
+        time: (v >> 32) as u32,
+        increment: v as u32,
+    }
+}
+
+/// The `clusterTime` of a command's `$clusterTime` field, if it carries one.
+pub fn from_command(cmd: &Document) -> Option<Timestamp> {
+    match cmd.get_document("$clusterTime").ok()?.get("clusterTime")? {
+        Bson::Timestamp(ts) => Some(*ts),
+        _ => None,
+    }
+}
+
+/// The `$clusterTime` document replies carry.
+pub fn reply_field(ts: Timestamp) -> Document {
+    doc! {
+        "clusterTime": ts,
+        "signature": {
+            "hash": bson::Binary { subtype: BinarySubtype::Generic, bytes: vec![0; 20] },
+            "keyId": 0i64,
+        },
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn ticks_are_strictly_increasing() {
+        let clock = LogicalClock::new();
+        let mut last = clock.tick();
+        for _ in 0..1000 {
+            let next = clock.tick();
+            assert!(pack(next) > pack(last), "{:?} after {:?}", next, last);
+            last = next;
+        }
+        assert_eq!(clock.now(), last);
+    }
+
+    #[test]
+    fn advances_from_gossip_but_never_back() {
+        let clock = LogicalClock::new();
+        let ahead = Timestamp {
+            time: u32::MAX - 1,
+            increment: 7,
+        };
+        clock.advance(ahead);
+        assert_eq!(clock.now(), ahead);
+        clock.advance(Timestamp {
+            time: 1,
+            increment: 1,
+        });
+        assert_eq!(clock.now(), ahead);
+        let next = clock.tick();
+        assert_eq!((next.time, next.increment), (u32::MAX - 1, 8));
+    }
+
+    #[tokio::test]
+    async fn waits_for_times_the_clock_reaches() {
+        let clock = LogicalClock::new();
+        let reached = clock.tick();
+        assert!(clock.wait_for(reached, Some(Duration::ZERO)).await);
+        let past_second = Timestamp {
+            time: wall_seconds() - 1,
+            increment: u32::MAX,
+        };
+        assert!(clock.wait_for(past_second, None).await);
+        let far = Timestamp {
+            time: wall_seconds() + 3600,
+            increment: 1,
+        };
+        assert!(!clock.wait_for(far, Some(Duration::from_millis(20))).await);
+    }
+
+    #[test]
+    fn reads_cluster_time_from_commands() {
+        let ts = Timestamp {
+            time: 42,
+            increment: 3,
+        };
+        let cmd = doc! {"find": "c", "$clusterTime": reply_field(ts)};
+        assert_eq!(from_command(&cmd), Some(ts));
+        assert_eq!(from_command(&doc! {"find": "c"}), None);
+    }
+}
@@ -2,13 +2,102 @@ use crate::error::{Error, Result};
 use serde::Deserialize;
 use std::fs;
 
+/// MongoDB's default `maxBsonObjectSize` (16MB).
+pub const DEFAULT_MAX_BSON_OBJECT_SIZE: usize = 16 * 1024 * 1024;
+
+/// MongoDB's default `slowms` (100ms).
+pub const DEFAULT_SLOW_OP_THRESHOLD_MS: u64 = 100;
+
+/// MongoDB's default `ttlMonitorSleepSecs` (60s).
+pub const DEFAULT_TTL_MONITOR_SLEEP_SECS: u64 = 60;
+
 #[derive(Debug, Clone, Deserialize)]
 pub struct Config {
     pub listen_addr: String,
     pub postgres_url: Option<String>,
+    /// Read-only replica DSN serving reads sent with a `secondary` or `secondaryPreferred`
+    /// read preference
+    #[serde(default)]
+    pub postgres_read_url: Option<String>,
     pub log_level: Option<String>,
+    /// Log output format: "text" (default) or "json"
+    #[serde(default)]
+    pub log_format: Option<String>,
+    /// OTLP/gRPC collector endpoint for OpenTelemetry span export (requires the `otel` feature)
+    #[serde(default)]
+    pub otlp_endpoint: Option<String>,
     pub cursor_timeout_secs: Option<u64>,
     pub cursor_sweep_interval_secs: Option<u64>,
+    /// Seconds between passes of the TTL monitor, which deletes documents expired by TTL
+    /// indexes (like MongoDB's `ttlMonitorSleepSecs`)
+    #[serde(default)]
+    pub ttl_monitor_sleep_secs: Option<u64>,
+    /// Close client connections that send no request for this many seconds (0 or unset: never)
+    #[serde(default)]
+    pub connection_idle_timeout_secs: Option<u64>,
+    /// Close client connections this many seconds after they were accepted, once the current
+    /// request has been answered (0 or unset: never)
+    #[serde(default)]
+    pub connection_max_lifetime_secs: Option<u64>,
+    /// Largest document accepted on insert/upsert, in bytes; advertised in `hello`/`buildInfo`
+    pub max_bson_object_size: Option<usize>,
+    /// Commands slower than this many milliseconds are logged as slow operations (like
+    /// MongoDB's `slowms`)
+    #[serde(alias = "slowOpThresholdMs")]
+    pub slow_op_threshold_ms: Option<u64>,
+    /// Address (host:port) for the Prometheus `/metrics` HTTP endpoint; disabled when unset
+    #[serde(default)]
+    pub metrics_addr: Option<String>,
+    /// Address (host:port) for the `/healthz` and `/readyz` HTTP probes; disabled when unset
+    #[serde(default)]
+    pub health_addr: Option<String>,
+    /// Query shapes kept prepared for reuse (LRU); 0 disables statement caching
+    #[serde(default)]
+    pub statement_cache_size: Option<usize>,
+    /// Allow `$where` JavaScript predicates (like mongod's `security.javascriptEnabled`)
+    #[serde(default)]
+    pub javascript_enabled: Option<bool>,
+    /// Turn Extended JSON type wrappers (`{"$oid": ...}`, `{"$date": ...}`) in inserted
+    /// documents into the typed values they stand for
+    #[serde(default)]
+    pub extended_json_import: Option<bool>,
+    /// Require clients to authenticate and check each command against the roles of their
+    /// user (like mongod's `security.authorization`)
+    #[serde(default)]
+    pub authorization_enabled: Option<bool>,
+    /// Client addresses (CIDR ranges) allowed to connect; anyone may when empty or unset
+    #[serde(default)]
+    pub ip_allowlist: Option<Vec<String>>,
+    /// Client addresses (CIDR ranges) refused even when the allowlist admits them
+    #[serde(default)]
+    pub ip_denylist: Option<Vec<String>>,
+    /// Apply role changes and dropped users to connections already authenticated as the
+    /// user, rather than from the user's next authentication
+    #[serde(default)]
+    pub refresh_user_roles: Option<bool>,
+    /// Writes per second allowed to a database (`"app"`) or collection (`"app.events"`);
+    /// unlisted namespaces are unlimited
+    #[serde(default)]
+    pub write_limits: Option<std::collections::BTreeMap<String, f64>>,
+    /// How databases map onto PostgreSQL: "schema_per_database" (default) or "single_schema"
+    #[serde(default)]
+    pub schema_layout: Option<crate::schema_map::SchemaLayout>,
+    /// Prefix of each database's schema, or of table names in the single-schema layout
+    #[serde(default)]
+    pub schema_prefix: Option<String>,
+    /// Schema holding every collection in the single-schema layout
+    #[serde(default)]
+    pub shared_schema: Option<String>,
+    /// Bytes a blocking aggregation stage may buffer when `allowDiskUse` is false
+    #[serde(default)]
+    pub aggregation_memory_limit_bytes: Option<usize>,
+    /// Reject a `find` without a limit when PostgreSQL estimates it reads more than this many
+    /// rows; 0 or unset disables the cap
+    #[serde(default)]
+    pub max_scan_rows: Option<u64>,
+    /// Unordered inserts of at least this many documents are loaded with `COPY`; 0 disables
+    #[serde(default)]
+    pub copy_insert_threshold: Option<usize>,
     #[serde(default)]
     pub shadow: Option<ShadowConfig>,
     // Server TLS configuration
@@ -28,9 +117,35 @@ impl Default for Config {
             // Default to Mongo's standard port locally
             listen_addr: "127.0.0.1:27017".to_string(),
             postgres_url: None,
+            postgres_read_url: None,
             log_level: None,
+            log_format: None,
+            otlp_endpoint: None,
             cursor_timeout_secs: Some(300),
             cursor_sweep_interval_secs: Some(30),
+            ttl_monitor_sleep_secs: Some(DEFAULT_TTL_MONITOR_SLEEP_SECS),
+            connection_idle_timeout_secs: None,
+            connection_max_lifetime_secs: None,
+            max_bson_object_size: Some(DEFAULT_MAX_BSON_OBJECT_SIZE),
+            slow_op_threshold_ms: Some(DEFAULT_SLOW_OP_THRESHOLD_MS),
+            metrics_addr: None,
+            health_addr: None,
+            statement_cache_size: Some(crate::stmt_cache::DEFAULT_STATEMENT_CACHE_SIZE),
+            javascript_enabled: Some(true),
+            extended_json_import: Some(false),
+            authorization_enabled: Some(false),
+            refresh_user_roles: Some(false),
+            ip_allowlist: None,
+            ip_denylist: None,
+            write_limits: None,
+            schema_layout: Some(crate::schema_map::SchemaLayout::SchemaPerDatabase),
+            schema_prefix: Some(crate::schema_map::DEFAULT_SCHEMA_PREFIX.to_string()),
+            shared_schema: Some(crate::schema_map::DEFAULT_SHARED_SCHEMA.to_string()),
+            aggregation_memory_limit_bytes: Some(
+                crate::aggregation::memory::DEFAULT_AGGREGATION_MEMORY_LIMIT_BYTES,
+            ),
+            max_scan_rows: None,
+            copy_insert_threshold: Some(crate::store::DEFAULT_COPY_INSERT_THRESHOLD),
             shadow: None,
             tls_cert_file: None,
             tls_key_file: None,
@@ -61,6 +176,7 @@ impl Config {
         listen_addr: Option<String>,
         postgres_url: Option<String>,
         log_level: Option<String>,
+        log_format: Option<String>,
         shadow_enabled: Option<bool>,
         shadow_addr: Option<String>,
         shadow_db_prefix: Option<String>,
@@ -76,6 +192,9 @@ impl Config {
         if let Some(ll) = log_level {
             self.log_level = Some(ll);
         }
+        if let Some(lf) = log_format {
+            self.log_format = Some(lf);
+        }
         if shadow_enabled.is_some()
             || shadow_addr.is_some()
             || shadow_db_prefix.is_some()
@@ -126,6 +245,55 @@ impl Config {
                 )));
             }
         }
+        if let Some(ref url) = self.postgres_read_url {
+            if !url.starts_with("postgres://") && !url.starts_with("postgresql://") {
+                return Err(Error::Msg(format!(
+                    "postgres_read_url '{}' must start with postgres:// or postgresql://",
+                    url
+                )));
+            }
+            if self.postgres_url.is_none() {
+                return Err(Error::Msg(
+                    "postgres_read_url requires postgres_url".to_string(),
+                ));
+            }
+        }
+
+        if let Some(ref format) = self.log_format {
+            if crate::logging::LogFormat::parse(format).is_none() {
+                return Err(Error::Msg(format!(
+                    "log_format '{}' must be \"text\" or \"json\"",
+                    format
+                )));
+            }
+        }
+
+        if let Some(size) = self.max_bson_object_size {
+            if size == 0 || size > i32::MAX as usize {
+                return Err(Error::Msg(format!(
+                    "max_bson_object_size must be between 1 and {}, got {}",
+                    i32::MAX,
+                    size
+                )));
+            }
+        }
+
+        if let Some(ref addr) = self.metrics_addr {
+            if !addr.contains(':') {
+                return Err(Error::Msg(format!(
+                    "metrics_addr '{}' must be in host:port format",
+                    addr
+                )));
+            }
+        }
+        if let Some(ref addr) = self.health_addr {
+            if !addr.contains(':') {
+                return Err(Error::Msg(format!(
+                    "health_addr '{}' must be in host:port format",
+                    addr
+                )));
+            }
+        }
 
         // Validate shadow config if enabled
         if let Some(ref shadow) = self.shadow {
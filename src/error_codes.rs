@@ -0,0 +1,157 @@
+//! MongoDB error codes and the `codeName` drivers expect alongside them.
+//!
+//! Drivers branch on `code` (retrying, ignoring duplicates, recreating a missing
+//! namespace), so replies should use the code MongoDB itself returns for a failure rather
+//! than a generic one. Storage failures are classified from the PostgreSQL message by
+//! [`store_error_code`].
+
+pub const INTERNAL_ERROR: i32 = 1;
+pub const BAD_VALUE: i32 = 2;
+pub const FAILED_TO_PARSE: i32 = 9;
+pub const USER_NOT_FOUND: i32 = 11;
+pub const UNAUTHORIZED: i32 = 13;
+pub const TYPE_MISMATCH: i32 = 14;
+pub const AUTHENTICATION_FAILED: i32 = 18;
+pub const NAMESPACE_NOT_FOUND: i32 = 26;
+pub const INDEX_NOT_FOUND: i32 = 27;
+pub const ROLE_NOT_FOUND: i32 = 31;
+pub const NAMESPACE_EXISTS: i32 = 48;
+pub const MAX_TIME_MS_EXPIRED: i32 = 50;
+pub const COMMAND_NOT_FOUND: i32 = 59;
+pub const INVALID_OPTIONS: i32 = 72;
+pub const OPERATION_FAILED: i32 = 96;
+pub const WRITE_CONFLICT: i32 = 112;
+pub const COMMAND_NOT_SUPPORTED: i32 = 115;
+pub const DOCUMENT_VALIDATION_FAILURE: i32 = 121;
+pub const MECHANISM_UNAVAILABLE: i32 = 334;
+pub const CANNOT_GROW_DOCUMENT_IN_CAPPED_NAMESPACE: i32 = 10003;
+pub const BSON_OBJECT_TOO_LARGE: i32 = 10334;
+pub const DUPLICATE_KEY: i32 = 11000;
+/// A command without `$db`; MongoDB reports this location code.
+pub const MISSING_DB: i32 = 40571;
+/// A write refused by `write_limits`. MongoDB has no equivalent, so this is OxideDB's own
+/// code; drivers retry on the `RetryableWriteError` label the reply carries.
+pub const WRITE_RATE_LIMITED: i32 = 46200;
+/// `createUser` for a user that already exists; MongoDB reports this location code.
+pub const USER_EXISTS: i32 = 51003;
+/// A `$regex` that does not compile.
+pub const INVALID_REGEX: i32 = 51091;
+
+/// The `codeName` MongoDB pairs with `code`. Codes without a name of their own are
+/// assertion locations, reported as `Location<code>`.
+pub fn code_name(code: i32) -> String {
+    let name = match code {
+        1 => "InternalError",
+        2 => "BadValue",
+        4 => "NoSuchKey",
+        8 => "UnknownError",
+        9 => "FailedToParse",
+        11 => "UserNotFound",
+        13 => "Unauthorized",
+        14 => "TypeMismatch",
+        16 => "InvalidLength",
+        18 => "AuthenticationFailed",
+        20 => "IllegalOperation",
+        26 => "NamespaceNotFound",
+        27 => "IndexNotFound",
+        31 => "RoleNotFound",
+        40 => "ConflictingUpdateOperations",
+        43 => "CursorNotFound",
+        48 => "NamespaceExists",
+        50 => "MaxTimeMSExpired",
+        52 => "InvalidIdField",
+        59 => "CommandNotFound",
+        66 => "ImmutableField",
+        67 => "CannotCreateIndex",
+        68 => "IndexAlreadyExists",
+        72 => "InvalidOptions",
+        73 => "InvalidNamespace",
+        85 => "IndexOptionsConflict",
+        86 => "IndexKeySpecsConflict",
+        96 => "OperationFailed",
+        112 => "WriteConflict",
+        115 => "CommandNotSupported",
+        121 => "DocumentValidationFailure",
+        139 => "JSInterpreterFailure",
+        166 => "CommandNotSupportedOnView",
+        168 => "InvalidPipelineOperator",
+        238 => "NotImplemented",
+        241 => "ConversionFailure",
+        251 => "NoSuchTransaction",
+        263 => "OperationNotSupportedInTransaction",
+        290 => "TransactionExceededLifetimeLimitSeconds",
+        292 => "QueryExceededMemoryLimitNoDiskUseAllowed",
+        334 => "MechanismUnavailable",
+        10003 => "CannotGrowDocumentInCappedNamespace",
+        10334 => "BSONObjectTooLarge",
+        11000 => "DuplicateKey",
+        11600 => "InterruptedAtShutdown",
+        46200 => "WriteRateLimitExceeded",
+        _ => return format!("Location{}", code),
+    };
+    name.to_string()
+}
+
+/// The code for a failed PostgreSQL statement, from its error message: unique violations
+/// (and unique indexes that existing rows violate) are duplicate keys, missing tables missing namespaces, cancelled statements expired
+/// time limits, serialization failures write conflicts and bad patterns invalid regexes.
+/// Anything else is internal.
+pub fn store_error_code(msg: &str) -> i32 {
+    if msg.contains("duplicate key value violates unique constraint")
+        || msg.contains("could not create unique index")
+    {
+        DUPLICATE_KEY
+    } else if msg.contains("relation") && msg.contains("does not exist") {
+        NAMESPACE_NOT_FOUND
+    } else if msg.contains("canceling statement due to statement timeout") {
+        MAX_TIME_MS_EXPIRED
+    } else if msg.contains("could not serialize access") || msg.contains("deadlock detected") {
+        WRITE_CONFLICT
+    } else if msg.contains("invalid regular expression") {
+        INVALID_REGEX
+    } else {
+        INTERNAL_ERROR
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn names_known_codes_and_locations() {
+        assert_eq!(code_name(BAD_VALUE), "BadValue");
+        assert_eq!(code_name(DUPLICATE_KEY), "DuplicateKey");
+        assert_eq!(code_name(NAMESPACE_NOT_FOUND), "NamespaceNotFound");
+        assert_eq!(code_name(MISSING_DB), "Location40571");
+    }
+
+    #[test]
+    fn classifies_postgres_failures() {
+        assert_eq!(
+            store_error_code(
+                "db error: ERROR: duplicate key value violates unique constraint \"users_pkey\""
+            ),
+            DUPLICATE_KEY
+        );
+        assert_eq!(
+            store_error_code("db error: ERROR: could not create unique index \"users_email_1\""),
+            DUPLICATE_KEY
+        );
+        assert_eq!(
+            store_error_code("db error: ERROR: relation \"mdb_app.users\" does not exist"),
+            NAMESPACE_NOT_FOUND
+        );
+        assert_eq!(
+            store_error_code("db error: ERROR: canceling statement due to statement timeout"),
+            MAX_TIME_MS_EXPIRED
+        );
+        assert_eq!(
+            store_error_code(
+                "db error: ERROR: invalid regular expression: parentheses () not balanced"
+            ),
+            INVALID_REGEX
+        );
+        assert_eq!(store_error_code("connection reset"), INTERNAL_ERROR);
+    }
+}
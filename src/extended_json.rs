@@ -0,0 +1,163 @@
+//! Recognition of MongoDB Extended JSON type wrappers in inserted documents.
+//!
+//! Data dumped as Extended JSON and loaded by a tool that does not parse it arrives with
+//! its typed values spelled out as documents: `{"$oid": "..."}` instead of an ObjectId,
+//! `{"$date": ...}` instead of a Date. With `extended_json_import` enabled, inserts turn
+//! each embedded document that is a complete wrapper, in canonical or relaxed form, into
+//! the value it stands for. Documents that merely have `$`-prefixed keys are left alone,
+//! as is anything the `bson` crate's Extended JSON parser does not accept as a wrapper.
+
+use bson::{Bson, Document};
+
+/// Replace the Extended JSON wrappers among `doc`'s values, at any depth, with the typed
+/// values they describe.
+pub fn decode_wrappers(doc: &mut Document) {
+    for (_, value) in doc.iter_mut() {
+        decode_value(value);
+    }
+}
+
+fn decode_value(value: &mut Bson) {
+    match value {
+        Bson::Document(d) => {
+            if let Some(typed) = as_wrapper(d) {
+                *value = typed;
+            } else {
+                decode_wrappers(d);
+            }
+        }
+        Bson::Array(items) => items.iter_mut().for_each(decode_value),
+        _ => {}
+    }
+}
+
+/// The value `d` stands for when it is a wrapper: every key starts with `$` and the
+/// Extended JSON parser reads it as something other than a document.
+fn as_wrapper(d: &Document) -> Option<Bson> {
+    if d.is_empty() || !d.keys().all(|k| k.starts_with('$')) {
+        return None;
+    }
+    let json = Bson::Document(d.clone()).into_relaxed_extjson();
+    match Bson::try_from(json) {
+        Ok(Bson::Document(_)) | Err(_) => None,
+        Ok(typed) => Some(typed),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::{
+        Binary, DateTime, Decimal128, JavaScriptCodeWithScope, Regex, Timestamp, doc,
+        oid::ObjectId, spec::BinarySubtype,
+    };
+
+    /// 1.10: coefficient 110, exponent -2.
+    fn decimal_1_10() -> Decimal128 {
+        let mut bytes = [0u8; 16];
+        bytes[..8].copy_from_slice(&110u64.to_le_bytes());
+        bytes[8..].copy_from_slice(&0x303C_0000_0000_0000u64.to_le_bytes());
+        Decimal128::from_bytes(bytes)
+    }
+
+    /// The values each wrapper stands for.
+    fn typed_values() -> Vec<Bson> {
+        vec![
+            Bson::ObjectId(ObjectId::parse_str("65a1b2c3d4e5f60718293a4b").unwrap()),
+            Bson::DateTime(DateTime::from_millis(1_700_000_000_123)),
+            Bson::DateTime(DateTime::from_millis(-5_000)),
+            Bson::Int64(9_007_199_254_740_993),
+            Bson::Int32(42),
+            Bson::Double(2.5),
+            Bson::Decimal128(decimal_1_10()),
+            Bson::Binary(Binary {
+                subtype: BinarySubtype::Generic,
+                bytes: vec![1, 2, 3],
+            }),
+            Bson::Timestamp(Timestamp {
+                time: 1_700_000_000,
+                increment: 7,
+            }),
+            Bson::RegularExpression(Regex {
+                pattern: "^a".into(),
+                options: "i".into(),
+            }),
+            Bson::JavaScriptCode("function() { return 1; }".into()),
+            Bson::JavaScriptCodeWithScope(JavaScriptCodeWithScope {
+                code: "x".into(),
+                scope: doc! {"x": 1i32},
+            }),
+            Bson::Symbol("sym".into()),
+            Bson::MinKey,
+            Bson::MaxKey,
+            Bson::Undefined,
+        ]
+    }
+
+    /// How a tool that does not parse Extended JSON would send `json`: plain documents,
+    /// strings and numbers.
+    fn literal(json: serde_json::Value) -> Bson {
+        match json {
+            serde_json::Value::Object(map) => Bson::Document(
+                map.into_iter()
+                    .map(|(k, v)| (k, literal(v)))
+                    .collect::<Document>(),
+            ),
+            serde_json::Value::Array(items) => {
+                Bson::Array(items.into_iter().map(literal).collect())
+            }
+            serde_json::Value::String(s) => Bson::String(s),
+            serde_json::Value::Number(n) => match n.as_i64() {
+                Some(i) => Bson::Int64(i),
+                None => Bson::Double(n.as_f64().unwrap()),
+            },
+            serde_json::Value::Bool(b) => Bson::Boolean(b),
+            serde_json::Value::Null => Bson::Null,
+        }
+    }
+
+    fn round_trip(value: &Bson, json: serde_json::Value) {
+        let mut doc = doc! {"v": literal(json.clone()), "nested": [{"v": literal(json)}]};
+        decode_wrappers(&mut doc);
+        assert_eq!(doc.get("v"), Some(value), "{:?}", doc);
+        assert_eq!(
+            doc.get_array("nested").unwrap()[0]
+                .as_document()
+                .unwrap()
+                .get("v"),
+            Some(value)
+        );
+    }
+
+    #[test]
+    fn decodes_canonical_wrappers() {
+        for value in typed_values() {
+            round_trip(&value, value.clone().into_canonical_extjson());
+        }
+    }
+
+    #[test]
+    fn decodes_relaxed_wrappers() {
+        for value in typed_values() {
+            let json = value.clone().into_relaxed_extjson();
+            // Relaxed numbers and doubles are plain JSON numbers, not wrappers
+            if !json.is_object() {
+                continue;
+            }
+            round_trip(&value, json);
+        }
+    }
+
+    #[test]
+    fn leaves_other_dollar_fields_alone() {
+        let original = doc! {
+            "price": {"$oid": 5i32},
+            "op": {"$set": {"a": 1i32}},
+            "mixed": {"$date": "2024-01-01T00:00:00Z", "note": "x"},
+            "empty": {},
+        };
+        let mut doc = original.clone();
+        decode_wrappers(&mut doc);
+        assert_eq!(doc, original);
+    }
+}
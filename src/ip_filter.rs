@@ -0,0 +1,165 @@
+//! Client address filtering: the `ip_allowlist` and `ip_denylist` CIDR ranges.
+//!
+//! Connections are checked as they are accepted, before anything is read from them, so a
+//! disallowed peer never reaches the handshake; this is separate from authentication. A
+//! peer in the denylist is always refused. When the allowlist is non-empty, a peer must
+//! also fall in one of its ranges. IPv4 peers connecting over an IPv6 socket (as
+//! `::ffff:a.b.c.d`) are matched as the IPv4 address.
+
+use std::net::IpAddr;
+
+use crate::config::Config;
+use crate::error::{Error, Result};
+
+/// A CIDR range such as `10.0.0.0/8` or `fd00::/8`; a bare address is a range of one.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Cidr {
+    network: IpAddr,
+    prefix: u8,
+}
+
+impl Cidr {
+    pub fn parse(s: &str) -> Result<Self> {
+        let (addr, prefix) = match s.trim().split_once('/') {
+            Some((addr, prefix)) => (addr, Some(prefix)),
+            None => (s.trim(), None),
+        };
+        let network: IpAddr = addr
+            .parse()
+            .map_err(|_| Error::Msg(format!("invalid IP address in CIDR range '{}'", s)))?;
+        let max = if network.is_ipv4() { 32 } else { 128 };
+        let prefix = match prefix {
+            Some(p) => p
+                .parse::<u8>()
+                .ok()
+                .filter(|p| *p <= max)
+                .ok_or_else(|| Error::Msg(format!("invalid prefix length in '{}'", s)))?,
+            None => max,
+        };
+        // An IPv4-mapped range (`::ffff:a.b.c.d/n`) is matched as the IPv4 range it maps;
+        // one shorter than the mapping's 96-bit prefix reaches beyond it and is refused
+        let (network, prefix) = match network.to_canonical() {
+            IpAddr::V4(v4) if network.is_ipv6() => match prefix.checked_sub(96) {
+                Some(prefix) => (IpAddr::V4(v4), prefix),
+                None => {
+                    return Err(Error::Msg(format!(
+                        "invalid prefix length in '{}': an IPv4-mapped range needs at least /96",
+                        s
+                    )));
+                }
+            },
+            network => (network, prefix),
+        };
+        Ok(Self { network, prefix })
+    }
+
+    pub fn contains(&self, ip: IpAddr) -> bool {
+        match (self.network, ip.to_canonical()) {
+            (IpAddr::V4(net), IpAddr::V4(ip)) => prefix_matches(
+                u32::from(net) as u128,
+                u32::from(ip) as u128,
+                self.prefix,
+                32,
+            ),
+            (IpAddr::V6(net), IpAddr::V6(ip)) => {
+                prefix_matches(u128::from(net), u128::from(ip), self.prefix, 128)
+            }
+            _ => false,
+        }
+    }
+}
+
+/// Whether the top `prefix` of `bits` bits of `a` and `b` agree.
+fn prefix_matches(a: u128, b: u128, prefix: u8, bits: u32) -> bool {
+    let shift = bits - prefix as u32;
+    shift >= bits || (a >> shift) == (b >> shift)
+}
+
+/// The allow and deny ranges connections are checked against.
+#[derive(Debug, Clone, Default)]
+pub struct IpFilter {
+    allow: Vec<Cidr>,
+    deny: Vec<Cidr>,
+}
+
+impl IpFilter {
+    /// The filter from `ip_allowlist` and `ip_denylist`; an invalid range is an error, so
+    /// a typo fails startup instead of opening or closing the server unexpectedly.
+    pub fn from_config(cfg: &Config) -> Result<Self> {
+        let parse = |ranges: &Option<Vec<String>>| -> Result<Vec<Cidr>> {
+            ranges.iter().flatten().map(|r| Cidr::parse(r)).collect()
+        };
+        Ok(Self {
+            allow: parse(&cfg.ip_allowlist)?,
+            deny: parse(&cfg.ip_denylist)?,
+        })
+    }
+
+    /// Why a connection from `ip` is refused, or None when it may proceed.
+    pub fn rejection(&self, ip: IpAddr) -> Option<&'static str> {
+        if self.deny.iter().any(|c| c.contains(ip)) {
+            Some("address is in ip_denylist")
+        } else if !self.allow.is_empty() && !self.allow.iter().any(|c| c.contains(ip)) {
+            Some("address is not in ip_allowlist")
+        } else {
+            None
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn ip(s: &str) -> IpAddr {
+        s.parse().unwrap()
+    }
+
+    #[test]
+    fn parses_and_matches_ranges() {
+        let net = Cidr::parse("10.1.0.0/16").unwrap();
+        assert!(net.contains(ip("10.1.200.3")));
+        assert!(!net.contains(ip("10.2.0.1")));
+        assert!(net.contains(ip("::ffff:10.1.0.9")));
+        assert!(!net.contains(ip("fd00::1")));
+
+        let host = Cidr::parse("192.168.1.5").unwrap();
+        assert!(host.contains(ip("192.168.1.5")));
+        assert!(!host.contains(ip("192.168.1.6")));
+
+        assert!(Cidr::parse("0.0.0.0/0").unwrap().contains(ip("8.8.8.8")));
+        assert!(Cidr::parse("fd00::/8").unwrap().contains(ip("fdab::1")));
+        assert!(Cidr::parse("10.0.0.0/33").is_err());
+
+        // IPv4-mapped ranges match as the IPv4 range they map
+        let mapped = Cidr::parse("::ffff:10.0.0.0/104").unwrap();
+        assert!(mapped.contains(ip("10.200.0.1")));
+        assert!(mapped.contains(ip("::ffff:10.0.0.1")));
+        assert!(!mapped.contains(ip("11.0.0.1")));
+        assert!(
+            Cidr::parse("::ffff:10.0.0.1")
+                .unwrap()
+                .contains(ip("10.0.0.1"))
+        );
+        assert!(Cidr::parse("::ffff:10.0.0.0/64").is_err());
+        assert!(Cidr::parse("example.com/8").is_err());
+    }
+
+    #[test]
+    fn denylist_wins_over_allowlist() {
+        let cfg = Config {
+            ip_allowlist: Some(vec!["127.0.0.0/8".into()]),
+            ip_denylist: Some(vec!["127.0.0.2".into()]),
+            ..Config::default()
+        };
+        let filter = IpFilter::from_config(&cfg).unwrap();
+        assert_eq!(filter.rejection(ip("127.0.0.1")), None);
+        assert!(filter.rejection(ip("127.0.0.2")).is_some());
+        assert!(filter.rejection(ip("10.0.0.1")).is_some());
+        assert_eq!(
+            IpFilter::default().rejection(ip("10.0.0.1")),
+            None,
+            "no ranges allow everyone"
+        );
+    }
+}
@@ -0,0 +1,1177 @@
+//! Minimal JavaScript evaluator for `$where` predicates.
+//!
+//! Covers what legacy `$where` filters typically use: a `function () { ... }` or bare
+//! expression over `this`/`obj`, property access, comparison, arithmetic and logical
+//! operators, the ternary, `var`/`let`/`const` locals, `if`/`else`, and a handful of string,
+//! array, `Date` and `Math` methods. Loops, user functions and regex literals are rejected at
+//! compile time, so every evaluation terminates.
+//!
+//! Written here rather than embedding an engine such as QuickJS or Boa: `$where` is
+//! deprecated and only needs this subset, an engine would bring a native or very large
+//! dependency, and it would need timeouts and a sandbox to bound what a predicate may do.
+//! Without loops or function definitions a predicate's cost is bounded by its size.
+
+use crate::error::{Error, Result};
+use bson::{Bson, Document};
+use std::cmp::Ordering;
+use std::fmt;
+use std::sync::Arc;
+
+/// Deepest statement/expression nesting accepted, keeping the recursive parser off the
+/// stack limit. Each link of an operator, member or call chain counts as a level too, as
+/// it nests the tree the evaluator (and `Drop`) then recurse through.
+const MAX_DEPTH: usize = 100;
+
+/// A compiled `$where` predicate.
+#[derive(Debug)]
+pub struct Predicate {
+    body: Vec<Stmt>,
+    /// Function syntax yields its `return` value; a bare expression yields its last statement.
+    is_function: bool,
+}
+
+/// Whether `filter` uses `$where` below its top level, under `$and`, `$or`, `$nor` or
+/// `$not`. Only a top-level `$where` is evaluated, so such filters are refused.
+pub fn nested_where(filter: &Document) -> bool {
+    filter.iter().any(|(k, v)| match (k.as_str(), v) {
+        ("$and" | "$or" | "$nor", Bson::Array(items)) => items
+            .iter()
+            .filter_map(Bson::as_document)
+            .any(|d| d.contains_key("$where") || nested_where(d)),
+        ("$not", Bson::Document(d)) => d.contains_key("$where") || nested_where(d),
+        _ => false,
+    })
+}
+
+impl Predicate {
+    /// Parse `source`: either `function () { ... }` or a bare expression such as
+    /// `this.a > this.b`.
+    pub fn compile(source: &str) -> Result<Self> {
+        let mut parser = Parser {
+            tokens: lex(source)?,
+            pos: 0,
+            depth: 0,
+        };
+        parser.program()
+    }
+
+    /// Whether `doc`, bound to `this` and `obj`, satisfies the predicate.
+    pub fn matches(&self, doc: &Document) -> Result<bool> {
+        let mut env = Env {
+            this: Value::from_document(doc),
+            locals: Vec::new(),
+        };
+        let value = match env.exec_block(&self.body)? {
+            Flow::Return(v) => v,
+            Flow::Normal(_) if self.is_function => Value::Undefined,
+            Flow::Normal(last) => last.unwrap_or(Value::Undefined),
+        };
+        Ok(value.truthy())
+    }
+}
+
+fn syntax(msg: impl fmt::Display) -> Error {
+    Error::Msg(format!("SyntaxError: {}", msg))
+}
+
+fn type_error(msg: impl fmt::Display) -> Error {
+    Error::Msg(format!("TypeError: {}", msg))
+}
+
+fn reference_error(name: &str) -> Error {
+    Error::Msg(format!("ReferenceError: {} is not defined", name))
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Tok {
+    Num(f64),
+    Str(String),
+    Ident(String),
+    Punct(&'static str),
+}
+
+impl fmt::Display for Tok {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Tok::Num(n) => write!(f, "{}", num_to_string(*n)),
+            Tok::Str(s) => write!(f, "{:?}", s),
+            Tok::Ident(w) => write!(f, "{}", w),
+            Tok::Punct(p) => write!(f, "'{}'", p),
+        }
+    }
+}
+
+/// Longest first, so `===` is not lexed as `==` followed by `=`.
+const PUNCTS: &[&str] = &[
+    "===", "!==", "==", "!=", "<=", ">=", "&&", "||", "<", ">", "+", "-", "*", "/", "%", "!", "(",
+    ")", "{", "}", "[", "]", ".", ",", ";", "?", ":", "=",
+];
+
+fn lex(src: &str) -> Result<Vec<Tok>> {
+    let chars: Vec<char> = src.chars().collect();
+    let mut out = Vec::new();
+    let mut i = 0;
+    while i < chars.len() {
+        let c = chars[i];
+        if c.is_whitespace() {
+            i += 1;
+            continue;
+        }
+        if c == '/' && chars.get(i + 1) == Some(&'/') {
+            while i < chars.len() && chars[i] != '\n' {
+                i += 1;
+            }
+            continue;
+        }
+        if c == '/' && chars.get(i + 1) == Some(&'*') {
+            let end = (i + 2..chars.len().saturating_sub(1))
+                .find(|&j| chars[j] == '*' && chars[j + 1] == '/')
+                .ok_or_else(|| syntax("unterminated comment"))?;
+            i = end + 2;
+            continue;
+        }
+        if c.is_ascii_digit() || (c == '.' && chars.get(i + 1).is_some_and(char::is_ascii_digit)) {
+            let start = i;
+            if c == '0' && matches!(chars.get(i + 1), Some('x' | 'X')) {
+                i += 2;
+                while i < chars.len() && chars[i].is_ascii_hexdigit() {
+                    i += 1;
+                }
+                let hex: String = chars[start + 2..i].iter().collect();
+                let n = i64::from_str_radix(&hex, 16)
+                    .map_err(|_| syntax(format!("invalid number 0x{}", hex)))?;
+                out.push(Tok::Num(n as f64));
+                continue;
+            }
+            while i < chars.len() && (chars[i].is_ascii_digit() || chars[i] == '.') {
+                i += 1;
+            }
+            if i < chars.len() && matches!(chars[i], 'e' | 'E') {
+                i += 1;
+                if i < chars.len() && matches!(chars[i], '+' | '-') {
+                    i += 1;
+                }
+                while i < chars.len() && chars[i].is_ascii_digit() {
+                    i += 1;
+                }
+            }
+            let text: String = chars[start..i].iter().collect();
+            let n = text
+                .parse::<f64>()
+                .map_err(|_| syntax(format!("invalid number {}", text)))?;
+            out.push(Tok::Num(n));
+            continue;
+        }
+        if c == '"' || c == '\'' {
+            let mut s = String::new();
+            i += 1;
+            loop {
+                let ch = *chars.get(i).ok_or_else(|| syntax("unterminated string"))?;
+                i += 1;
+                if ch == c {
+                    break;
+                }
+                if ch == '\\' {
+                    let esc = *chars.get(i).ok_or_else(|| syntax("unterminated string"))?;
+                    i += 1;
+                    s.push(match esc {
+                        'n' => '\n',
+                        't' => '\t',
+                        'r' => '\r',
+                        '0' => '\0',
+                        other => other,
+                    });
+                } else {
+                    s.push(ch);
+                }
+            }
+            out.push(Tok::Str(s));
+            continue;
+        }
+        if c.is_alphabetic() || c == '_' || c == '$' {
+            let start = i;
+            while i < chars.len()
+                && (chars[i].is_alphanumeric() || chars[i] == '_' || chars[i] == '$')
+            {
+                i += 1;
+            }
+            out.push(Tok::Ident(chars[start..i].iter().collect()));
+            continue;
+        }
+        let rest: String = chars[i..chars.len().min(i + 3)].iter().collect();
+        match PUNCTS.iter().copied().find(|p| rest.starts_with(p)) {
+            Some(p) => {
+                out.push(Tok::Punct(p));
+                i += p.len();
+            }
+            None => return Err(syntax(format!("unexpected character '{}'", c))),
+        }
+    }
+    Ok(out)
+}
+
+#[derive(Debug)]
+enum Stmt {
+    Let(String, Option<Expr>),
+    Assign(String, Expr),
+    Return(Option<Expr>),
+    If(Expr, Vec<Stmt>, Vec<Stmt>),
+    Block(Vec<Stmt>),
+    Expr(Expr),
+}
+
+#[derive(Debug)]
+enum Expr {
+    Lit(Value),
+    This,
+    Ident(String),
+    Array(Vec<Expr>),
+    Member(Box<Expr>, Box<Expr>),
+    Call(Box<Expr>, Vec<Expr>),
+    Unary(&'static str, Box<Expr>),
+    Binary(&'static str, Box<Expr>, Box<Expr>),
+    Cond(Box<Expr>, Box<Expr>, Box<Expr>),
+}
+
+/// Binary operators from lowest to highest precedence.
+const BINARY_LEVELS: &[&[&str]] = &[
+    &["||"],
+    &["&&"],
+    &["===", "!==", "==", "!="],
+    &["<", "<=", ">", ">="],
+    &["+", "-"],
+    &["*", "/", "%"],
+];
+
+struct Parser {
+    tokens: Vec<Tok>,
+    pos: usize,
+    depth: usize,
+}
+
+impl Parser {
+    fn peek(&self) -> Option<&Tok> {
+        self.tokens.get(self.pos)
+    }
+
+    fn is_punct(&self, p: &str) -> bool {
+        matches!(self.peek(), Some(Tok::Punct(q)) if *q == p)
+    }
+
+    fn is_keyword(&self, k: &str) -> bool {
+        matches!(self.peek(), Some(Tok::Ident(w)) if w == k)
+    }
+
+    fn eat_punct(&mut self, p: &str) -> bool {
+        let found = self.is_punct(p);
+        if found {
+            self.pos += 1;
+        }
+        found
+    }
+
+    fn expect_punct(&mut self, p: &str) -> Result<()> {
+        if self.eat_punct(p) {
+            Ok(())
+        } else {
+            Err(self.unexpected())
+        }
+    }
+
+    fn unexpected(&self) -> Error {
+        match self.peek() {
+            Some(t) => syntax(format!("unexpected token {}", t)),
+            None => syntax("unexpected end of input"),
+        }
+    }
+
+    fn ident(&mut self) -> Result<String> {
+        match self.peek() {
+            Some(Tok::Ident(w)) => {
+                let w = w.clone();
+                self.pos += 1;
+                Ok(w)
+            }
+            _ => Err(self.unexpected()),
+        }
+    }
+
+    fn enter(&mut self) -> Result<()> {
+        self.depth += 1;
+        if self.depth > MAX_DEPTH {
+            return Err(syntax("nested too deeply"));
+        }
+        Ok(())
+    }
+
+    fn program(&mut self) -> Result<Predicate> {
+        if self.is_keyword("function") {
+            self.pos += 1;
+            if matches!(self.peek(), Some(Tok::Ident(_))) {
+                self.pos += 1;
+            }
+            self.expect_punct("(")?;
+            if !self.eat_punct(")") {
+                loop {
+                    self.ident()?;
+                    if self.eat_punct(")") {
+                        break;
+                    }
+                    self.expect_punct(",")?;
+                }
+            }
+            let body = self.block()?;
+            self.eat_punct(";");
+            if self.peek().is_some() {
+                return Err(self.unexpected());
+            }
+            return Ok(Predicate {
+                body,
+                is_function: true,
+            });
+        }
+        let mut body = Vec::new();
+        while self.peek().is_some() {
+            body.push(self.statement()?);
+        }
+        Ok(Predicate {
+            body,
+            is_function: false,
+        })
+    }
+
+    fn block(&mut self) -> Result<Vec<Stmt>> {
+        self.expect_punct("{")?;
+        let mut stmts = Vec::new();
+        while !self.eat_punct("}") {
+            if self.peek().is_none() {
+                return Err(self.unexpected());
+            }
+            stmts.push(self.statement()?);
+        }
+        Ok(stmts)
+    }
+
+    fn statement(&mut self) -> Result<Stmt> {
+        self.enter()?;
+        let stmt = self.statement_inner();
+        self.depth -= 1;
+        stmt
+    }
+
+    fn statement_inner(&mut self) -> Result<Stmt> {
+        if self.eat_punct(";") {
+            return Ok(Stmt::Block(Vec::new()));
+        }
+        if self.is_punct("{") {
+            return Ok(Stmt::Block(self.block()?));
+        }
+        if self.is_keyword("var") || self.is_keyword("let") || self.is_keyword("const") {
+            self.pos += 1;
+            let name = self.ident()?;
+            let init = if self.eat_punct("=") {
+                Some(self.expression()?)
+            } else {
+                None
+            };
+            self.end_statement()?;
+            return Ok(Stmt::Let(name, init));
+        }
+        if self.is_keyword("return") {
+            self.pos += 1;
+            let value = if self.is_punct(";") || self.is_punct("}") || self.peek().is_none() {
+                None
+            } else {
+                Some(self.expression()?)
+            };
+            self.end_statement()?;
+            return Ok(Stmt::Return(value));
+        }
+        if self.is_keyword("if") {
+            self.pos += 1;
+            self.expect_punct("(")?;
+            let cond = self.expression()?;
+            self.expect_punct(")")?;
+            let then = self.branch()?;
+            let otherwise = if self.is_keyword("else") {
+                self.pos += 1;
+                self.branch()?
+            } else {
+                Vec::new()
+            };
+            return Ok(Stmt::If(cond, then, otherwise));
+        }
+        if let (Some(Tok::Ident(name)), Some(Tok::Punct("="))) =
+            (self.tokens.get(self.pos), self.tokens.get(self.pos + 1))
+        {
+            let name = name.clone();
+            self.pos += 2;
+            let value = self.expression()?;
+            self.end_statement()?;
+            return Ok(Stmt::Assign(name, value));
+        }
+        let expr = self.expression()?;
+        self.end_statement()?;
+        Ok(Stmt::Expr(expr))
+    }
+
+    fn branch(&mut self) -> Result<Vec<Stmt>> {
+        if self.is_punct("{") {
+            self.block()
+        } else {
+            Ok(vec![self.statement()?])
+        }
+    }
+
+    /// Statements end at `;`, before `}`, or at the end of input.
+    fn end_statement(&mut self) -> Result<()> {
+        if self.eat_punct(";") || self.is_punct("}") || self.peek().is_none() {
+            Ok(())
+        } else {
+            Err(self.unexpected())
+        }
+    }
+
+    fn expression(&mut self) -> Result<Expr> {
+        self.enter()?;
+        let expr = self.conditional();
+        self.depth -= 1;
+        expr
+    }
+
+    fn conditional(&mut self) -> Result<Expr> {
+        let cond = self.binary(0)?;
+        if !self.eat_punct("?") {
+            return Ok(cond);
+        }
+        let then = self.expression()?;
+        self.expect_punct(":")?;
+        let otherwise = self.expression()?;
+        Ok(Expr::Cond(
+            Box::new(cond),
+            Box::new(then),
+            Box::new(otherwise),
+        ))
+    }
+
+    fn binary(&mut self, level: usize) -> Result<Expr> {
+        if level == BINARY_LEVELS.len() {
+            return self.unary();
+        }
+        let mut lhs = self.binary(level + 1)?;
+        let mut links = 0;
+        while let Some(op) = BINARY_LEVELS[level]
+            .iter()
+            .copied()
+            .find(|op| self.is_punct(op))
+        {
+            self.pos += 1;
+            self.enter()?;
+            links += 1;
+            let rhs = self.binary(level + 1)?;
+            lhs = Expr::Binary(op, Box::new(lhs), Box::new(rhs));
+        }
+        self.depth -= links;
+        Ok(lhs)
+    }
+
+    fn unary(&mut self) -> Result<Expr> {
+        let op = if self.is_keyword("typeof") {
+            "typeof"
+        } else if let Some(op) = ["!", "-", "+"].into_iter().find(|op| self.is_punct(op)) {
+            op
+        } else {
+            return self.postfix();
+        };
+        self.pos += 1;
+        self.enter()?;
+        let operand = self.unary();
+        self.depth -= 1;
+        Ok(Expr::Unary(op, Box::new(operand?)))
+    }
+
+    fn postfix(&mut self) -> Result<Expr> {
+        let mut expr = self.primary()?;
+        let mut links = 0;
+        loop {
+            if self.is_punct(".") || self.is_punct("[") || self.is_punct("(") {
+                self.enter()?;
+                links += 1;
+            }
+            if self.eat_punct(".") {
+                let name = self.ident()?;
+                expr = Expr::Member(Box::new(expr), Box::new(Expr::Lit(Value::Str(name))));
+            } else if self.eat_punct("[") {
+                let key = self.expression()?;
+                self.expect_punct("]")?;
+                expr = Expr::Member(Box::new(expr), Box::new(key));
+            } else if self.eat_punct("(") {
+                let args = self.list(")")?;
+                expr = Expr::Call(Box::new(expr), args);
+            } else {
+                self.depth -= links;
+                return Ok(expr);
+            }
+        }
+    }
+
+    /// Comma-separated expressions up to and including `close`.
+    fn list(&mut self, close: &str) -> Result<Vec<Expr>> {
+        let mut items = Vec::new();
+        if self.eat_punct(close) {
+            return Ok(items);
+        }
+        loop {
+            items.push(self.expression()?);
+            if self.eat_punct(close) {
+                return Ok(items);
+            }
+            self.expect_punct(",")?;
+        }
+    }
+
+    fn primary(&mut self) -> Result<Expr> {
+        let tok = self.peek().cloned().ok_or_else(|| self.unexpected())?;
+        self.pos += 1;
+        match tok {
+            Tok::Num(n) => Ok(Expr::Lit(Value::Num(n))),
+            Tok::Str(s) => Ok(Expr::Lit(Value::Str(s))),
+            Tok::Punct("(") => {
+                let expr = self.expression()?;
+                self.expect_punct(")")?;
+                Ok(expr)
+            }
+            Tok::Punct("[") => Ok(Expr::Array(self.list("]")?)),
+            Tok::Ident(w) => Ok(match w.as_str() {
+                "this" => Expr::This,
+                "true" => Expr::Lit(Value::Bool(true)),
+                "false" => Expr::Lit(Value::Bool(false)),
+                "null" => Expr::Lit(Value::Null),
+                "undefined" => Expr::Lit(Value::Undefined),
+                "NaN" => Expr::Lit(Value::Num(f64::NAN)),
+                "Infinity" => Expr::Lit(Value::Num(f64::INFINITY)),
+                "function" | "new" | "for" | "while" | "do" | "switch" | "try" | "throw"
+                | "delete" | "in" | "instanceof" | "var" | "let" | "const" | "return" | "if"
+                | "else" => return Err(syntax(format!("'{}' is not supported in $where", w))),
+                _ => Expr::Ident(w),
+            }),
+            _ => {
+                self.pos -= 1;
+                Err(self.unexpected())
+            }
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+enum Value {
+    Undefined,
+    Null,
+    Bool(bool),
+    Num(f64),
+    Str(String),
+    /// Milliseconds since the epoch
+    Date(f64),
+    Array(Arc<Vec<Value>>),
+    Object(Arc<Vec<(String, Value)>>),
+}
+
+impl Value {
+    fn from_document(doc: &Document) -> Value {
+        Value::Object(Arc::new(
+            doc.iter()
+                .map(|(k, v)| (k.clone(), Value::from_bson(v)))
+                .collect(),
+        ))
+    }
+
+    fn from_bson(b: &Bson) -> Value {
+        match b {
+            Bson::Double(n) => Value::Num(*n),
+            Bson::Int32(n) => Value::Num(*n as f64),
+            Bson::Int64(n) => Value::Num(*n as f64),
+            Bson::String(s) | Bson::Symbol(s) => Value::Str(s.clone()),
+            Bson::Boolean(b) => Value::Bool(*b),
+            Bson::Null => Value::Null,
+            Bson::Undefined => Value::Undefined,
+            Bson::Array(items) => {
+                Value::Array(Arc::new(items.iter().map(Value::from_bson).collect()))
+            }
+            Bson::Document(d) => Value::from_document(d),
+            Bson::DateTime(dt) => Value::Date(dt.timestamp_millis() as f64),
+            Bson::ObjectId(oid) => Value::Str(oid.to_hex()),
+            other => Value::Str(other.to_string()),
+        }
+    }
+
+    fn truthy(&self) -> bool {
+        match self {
+            Value::Undefined | Value::Null => false,
+            Value::Bool(b) => *b,
+            Value::Num(n) => *n != 0.0 && !n.is_nan(),
+            Value::Str(s) => !s.is_empty(),
+            Value::Date(_) | Value::Array(_) | Value::Object(_) => true,
+        }
+    }
+
+    fn type_of(&self) -> &'static str {
+        match self {
+            Value::Undefined => "undefined",
+            Value::Bool(_) => "boolean",
+            Value::Num(_) => "number",
+            Value::Str(_) => "string",
+            Value::Null | Value::Date(_) | Value::Array(_) | Value::Object(_) => "object",
+        }
+    }
+
+    /// Objects and arrays as the primitive JS compares them by.
+    fn to_primitive(&self) -> Value {
+        match self {
+            Value::Array(_) | Value::Object(_) => Value::Str(self.to_js_string()),
+            Value::Date(ms) => Value::Num(*ms),
+            other => other.clone(),
+        }
+    }
+
+    fn to_number(&self) -> f64 {
+        match self {
+            Value::Undefined | Value::Object(_) => f64::NAN,
+            Value::Null => 0.0,
+            Value::Bool(b) => f64::from(u8::from(*b)),
+            Value::Num(n) | Value::Date(n) => *n,
+            Value::Str(s) => {
+                let t = s.trim();
+                if t.is_empty() {
+                    0.0
+                } else {
+                    t.parse().unwrap_or(f64::NAN)
+                }
+            }
+            Value::Array(items) => match items.as_slice() {
+                [] => 0.0,
+                [only] => only.to_number(),
+                _ => f64::NAN,
+            },
+        }
+    }
+
+    fn to_js_string(&self) -> String {
+        match self {
+            Value::Undefined => "undefined".into(),
+            Value::Null => "null".into(),
+            Value::Bool(b) => b.to_string(),
+            Value::Num(n) => num_to_string(*n),
+            Value::Str(s) => s.clone(),
+            Value::Date(ms) => bson::DateTime::from_millis(*ms as i64)
+                .try_to_rfc3339_string()
+                .unwrap_or_else(|_| "Invalid Date".into()),
+            Value::Array(items) => join(items, ","),
+            Value::Object(_) => "[object Object]".into(),
+        }
+    }
+
+    fn member(&self, key: &Value) -> Result<Value> {
+        let key = key.to_js_string();
+        let index = || key.parse::<usize>().ok();
+        Ok(match self {
+            Value::Undefined | Value::Null => {
+                return Err(type_error(format!(
+                    "Cannot read property '{}' of {}",
+                    key,
+                    self.to_js_string()
+                )));
+            }
+            Value::Object(fields) => fields
+                .iter()
+                .find(|(k, _)| *k == key)
+                .map(|(_, v)| v.clone())
+                .unwrap_or(Value::Undefined),
+            Value::Array(items) if key == "length" => Value::Num(items.len() as f64),
+            Value::Array(items) => index()
+                .and_then(|i| items.get(i))
+                .cloned()
+                .unwrap_or(Value::Undefined),
+            Value::Str(s) if key == "length" => Value::Num(s.encode_utf16().count() as f64),
+            Value::Str(s) => index()
+                .and_then(|i| s.encode_utf16().nth(i))
+                .map(|unit| Value::Str(String::from_utf16_lossy(&[unit])))
+                .unwrap_or(Value::Undefined),
+            _ => Value::Undefined,
+        })
+    }
+
+    fn call_method(&self, method: &str, args: &[Value]) -> Result<Value> {
+        let arg = |i: usize| args.get(i).cloned().unwrap_or(Value::Undefined);
+        Ok(match (self, method) {
+            (Value::Str(s), "indexOf") => Value::Num(
+                s.find(&arg(0).to_js_string())
+                    .map(|i| s[..i].encode_utf16().count() as f64)
+                    .unwrap_or(-1.0),
+            ),
+            (Value::Str(s), "includes") => Value::Bool(s.contains(&arg(0).to_js_string())),
+            (Value::Str(s), "startsWith") => Value::Bool(s.starts_with(&arg(0).to_js_string())),
+            (Value::Str(s), "endsWith") => Value::Bool(s.ends_with(&arg(0).to_js_string())),
+            (Value::Str(s), "toLowerCase") => Value::Str(s.to_lowercase()),
+            (Value::Str(s), "toUpperCase") => Value::Str(s.to_uppercase()),
+            (Value::Str(s), "trim") => Value::Str(s.trim().to_string()),
+            (Value::Str(s), "substring") => {
+                let units: Vec<u16> = s.encode_utf16().collect();
+                let clamp = |v: Value| {
+                    let n = v.to_number();
+                    if n.is_nan() {
+                        0
+                    } else {
+                        (n.max(0.0) as usize).min(units.len())
+                    }
+                };
+                let start = clamp(arg(0));
+                let end = if args.len() > 1 {
+                    clamp(arg(1))
+                } else {
+                    units.len()
+                };
+                let (start, end) = (start.min(end), start.max(end));
+                Value::Str(String::from_utf16_lossy(&units[start..end]))
+            }
+            (Value::Array(items), "indexOf") => Value::Num(
+                items
+                    .iter()
+                    .position(|v| strict_equals(v, &arg(0)))
+                    .map(|i| i as f64)
+                    .unwrap_or(-1.0),
+            ),
+            (Value::Array(items), "includes") => {
+                Value::Bool(items.iter().any(|v| strict_equals(v, &arg(0))))
+            }
+            (Value::Array(items), "join") => {
+                let sep = match arg(0) {
+                    Value::Undefined => ",".to_string(),
+                    v => v.to_js_string(),
+                };
+                Value::Str(join(items, &sep))
+            }
+            (Value::Date(ms), "getTime" | "valueOf") => Value::Num(*ms),
+            (Value::Undefined | Value::Null, _) => {
+                return Err(type_error(format!(
+                    "Cannot read property '{}' of {}",
+                    method,
+                    self.to_js_string()
+                )));
+            }
+            (_, "toString") => Value::Str(self.to_js_string()),
+            _ => return Err(type_error(format!("{} is not a function", method))),
+        })
+    }
+}
+
+/// `Array.prototype.join`: holes, `null` and `undefined` become empty strings.
+fn join(items: &[Value], sep: &str) -> String {
+    items
+        .iter()
+        .map(|v| match v {
+            Value::Undefined | Value::Null => String::new(),
+            v => v.to_js_string(),
+        })
+        .collect::<Vec<_>>()
+        .join(sep)
+}
+
+fn num_to_string(n: f64) -> String {
+    if n.is_nan() {
+        "NaN".into()
+    } else if n.is_infinite() {
+        String::from(if n > 0.0 { "Infinity" } else { "-Infinity" })
+    } else if n.fract() == 0.0 && n.abs() < 1e21 {
+        // Also prints -0 as "0", like JS
+        format!("{}", n as i64)
+    } else {
+        format!("{}", n)
+    }
+}
+
+fn strict_equals(l: &Value, r: &Value) -> bool {
+    match (l, r) {
+        (Value::Undefined, Value::Undefined) | (Value::Null, Value::Null) => true,
+        (Value::Bool(a), Value::Bool(b)) => a == b,
+        (Value::Num(a), Value::Num(b)) => a == b,
+        (Value::Str(a), Value::Str(b)) => a == b,
+        // Objects compare by identity
+        (Value::Array(a), Value::Array(b)) => Arc::ptr_eq(a, b),
+        (Value::Object(a), Value::Object(b)) => Arc::ptr_eq(a, b),
+        _ => false,
+    }
+}
+
+fn loose_equals(l: &Value, r: &Value) -> bool {
+    match (l, r) {
+        (Value::Undefined | Value::Null, Value::Undefined | Value::Null) => true,
+        (Value::Undefined | Value::Null, _) | (_, Value::Undefined | Value::Null) => false,
+        (Value::Str(a), Value::Str(b)) => a == b,
+        (
+            Value::Array(_) | Value::Object(_) | Value::Date(_),
+            Value::Array(_) | Value::Object(_) | Value::Date(_),
+        ) => strict_equals(l, r),
+        (Value::Array(_) | Value::Object(_), _) => loose_equals(&l.to_primitive(), r),
+        (_, Value::Array(_) | Value::Object(_)) => loose_equals(l, &r.to_primitive()),
+        _ => l.to_number() == r.to_number(),
+    }
+}
+
+fn binary(op: &str, l: &Value, r: &Value) -> Value {
+    match op {
+        "===" => Value::Bool(strict_equals(l, r)),
+        "!==" => Value::Bool(!strict_equals(l, r)),
+        "==" => Value::Bool(loose_equals(l, r)),
+        "!=" => Value::Bool(!loose_equals(l, r)),
+        "<" | "<=" | ">" | ">=" => {
+            let ord = match (l.to_primitive(), r.to_primitive()) {
+                (Value::Str(a), Value::Str(b)) => Some(a.cmp(&b)),
+                (a, b) => a.to_number().partial_cmp(&b.to_number()),
+            };
+            Value::Bool(ord.is_some_and(|o| match op {
+                "<" => o == Ordering::Less,
+                "<=" => o != Ordering::Greater,
+                ">" => o == Ordering::Greater,
+                _ => o != Ordering::Less,
+            }))
+        }
+        "+" => match (l.to_primitive(), r.to_primitive()) {
+            (a @ Value::Str(_), b) | (a, b @ Value::Str(_)) => {
+                Value::Str(a.to_js_string() + &b.to_js_string())
+            }
+            (a, b) => Value::Num(a.to_number() + b.to_number()),
+        },
+        "-" => Value::Num(l.to_number() - r.to_number()),
+        "*" => Value::Num(l.to_number() * r.to_number()),
+        "/" => Value::Num(l.to_number() / r.to_number()),
+        "%" => Value::Num(l.to_number() % r.to_number()),
+        _ => Value::Undefined,
+    }
+}
+
+fn math(method: &str, args: &[Value]) -> Result<Value> {
+    let n = |i: usize| args.get(i).map(Value::to_number).unwrap_or(f64::NAN);
+    let fold = |init: f64, pick: fn(f64, f64) -> f64| {
+        args.iter().map(Value::to_number).fold(init, |a, b| {
+            if a.is_nan() || b.is_nan() {
+                f64::NAN
+            } else {
+                pick(a, b)
+            }
+        })
+    };
+    Ok(Value::Num(match method {
+        "abs" => n(0).abs(),
+        "floor" => n(0).floor(),
+        "ceil" => n(0).ceil(),
+        "round" => (n(0) + 0.5).floor(),
+        "sqrt" => n(0).sqrt(),
+        "pow" => n(0).powf(n(1)),
+        "min" => fold(f64::INFINITY, f64::min),
+        "max" => fold(f64::NEG_INFINITY, f64::max),
+        _ => return Err(type_error(format!("Math.{} is not a function", method))),
+    }))
+}
+
+fn global_function(name: &str, args: &[Value]) -> Result<Value> {
+    let arg = args.first().cloned().unwrap_or(Value::Undefined);
+    Ok(match name {
+        "isNaN" => Value::Bool(arg.to_number().is_nan()),
+        "Number" if args.is_empty() => Value::Num(0.0),
+        "Number" => Value::Num(arg.to_number()),
+        "String" if args.is_empty() => Value::Str(String::new()),
+        "String" => Value::Str(arg.to_js_string()),
+        "Boolean" => Value::Bool(arg.truthy()),
+        _ => return Err(reference_error(name)),
+    })
+}
+
+enum Flow {
+    /// Completed without `return`, with the value of the last expression statement
+    Normal(Option<Value>),
+    Return(Value),
+}
+
+struct Env {
+    this: Value,
+    locals: Vec<(String, Value)>,
+}
+
+impl Env {
+    fn exec_block(&mut self, stmts: &[Stmt]) -> Result<Flow> {
+        let mut last = None;
+        for stmt in stmts {
+            match self.exec(stmt)? {
+                Flow::Return(v) => return Ok(Flow::Return(v)),
+                Flow::Normal(Some(v)) => last = Some(v),
+                Flow::Normal(None) => {}
+            }
+        }
+        Ok(Flow::Normal(last))
+    }
+
+    fn exec(&mut self, stmt: &Stmt) -> Result<Flow> {
+        match stmt {
+            Stmt::Let(name, init) => {
+                let v = match init {
+                    Some(e) => self.eval(e)?,
+                    None => Value::Undefined,
+                };
+                self.set(name, v);
+                Ok(Flow::Normal(None))
+            }
+            Stmt::Assign(name, e) => {
+                let v = self.eval(e)?;
+                self.set(name, v.clone());
+                Ok(Flow::Normal(Some(v)))
+            }
+            Stmt::Return(e) => Ok(Flow::Return(match e {
+                Some(e) => self.eval(e)?,
+                None => Value::Undefined,
+            })),
+            Stmt::If(cond, then, otherwise) => {
+                if self.eval(cond)?.truthy() {
+                    self.exec_block(then)
+                } else {
+                    self.exec_block(otherwise)
+                }
+            }
+            Stmt::Block(stmts) => self.exec_block(stmts),
+            Stmt::Expr(e) => Ok(Flow::Normal(Some(self.eval(e)?))),
+        }
+    }
+
+    fn set(&mut self, name: &str, v: Value) {
+        match self.locals.iter_mut().find(|(n, _)| n == name) {
+            Some(slot) => slot.1 = v,
+            None => self.locals.push((name.to_string(), v)),
+        }
+    }
+
+    fn is_local(&self, name: &str) -> bool {
+        self.locals.iter().any(|(n, _)| n == name)
+    }
+
+    fn lookup(&self, name: &str) -> Result<Value> {
+        if let Some((_, v)) = self.locals.iter().find(|(n, _)| n == name) {
+            return Ok(v.clone());
+        }
+        match name {
+            "obj" => Ok(self.this.clone()),
+            _ => Err(reference_error(name)),
+        }
+    }
+
+    fn eval(&mut self, expr: &Expr) -> Result<Value> {
+        Ok(match expr {
+            Expr::Lit(v) => v.clone(),
+            Expr::This => self.this.clone(),
+            Expr::Ident(name) => self.lookup(name)?,
+            Expr::Array(items) => Value::Array(Arc::new(
+                items
+                    .iter()
+                    .map(|e| self.eval(e))
+                    .collect::<Result<Vec<_>>>()?,
+            )),
+            Expr::Member(obj, key) => {
+                let obj = self.eval(obj)?;
+                let key = self.eval(key)?;
+                obj.member(&key)?
+            }
+            Expr::Call(callee, args) => self.call(callee, args)?,
+            // `typeof` of an undeclared name is "undefined" rather than an error
+            Expr::Unary("typeof", operand) => match operand.as_ref() {
+                Expr::Ident(name) => Value::Str(
+                    self.lookup(name)
+                        .map(|v| v.type_of())
+                        .unwrap_or("undefined")
+                        .into(),
+                ),
+                e => Value::Str(self.eval(e)?.type_of().into()),
+            },
+            Expr::Unary(op, operand) => {
+                let v = self.eval(operand)?;
+                match *op {
+                    "!" => Value::Bool(!v.truthy()),
+                    "-" => Value::Num(-v.to_number()),
+                    _ => Value::Num(v.to_number()),
+                }
+            }
+            Expr::Binary("&&", l, r) => {
+                let lv = self.eval(l)?;
+                if lv.truthy() { self.eval(r)? } else { lv }
+            }
+            Expr::Binary("||", l, r) => {
+                let lv = self.eval(l)?;
+                if lv.truthy() { lv } else { self.eval(r)? }
+            }
+            Expr::Binary(op, l, r) => {
+                let lv = self.eval(l)?;
+                let rv = self.eval(r)?;
+                binary(op, &lv, &rv)
+            }
+            Expr::Cond(cond, then, otherwise) => {
+                if self.eval(cond)?.truthy() {
+                    self.eval(then)?
+                } else {
+                    self.eval(otherwise)?
+                }
+            }
+        })
+    }
+
+    fn call(&mut self, callee: &Expr, args: &[Expr]) -> Result<Value> {
+        let args = args
+            .iter()
+            .map(|e| self.eval(e))
+            .collect::<Result<Vec<_>>>()?;
+        match callee {
+            Expr::Member(obj, key) => {
+                let Expr::Lit(Value::Str(method)) = key.as_ref() else {
+                    return Err(type_error("computed method calls are not supported"));
+                };
+                if let Expr::Ident(global) = obj.as_ref()
+                    && !self.is_local(global)
+                {
+                    match global.as_str() {
+                        "Math" => return math(method, &args),
+                        "Array" if method == "isArray" => {
+                            return Ok(Value::Bool(matches!(args.first(), Some(Value::Array(_)))));
+                        }
+                        _ => {}
+                    }
+                }
+                self.eval(obj)?.call_method(method, &args)
+            }
+            Expr::Ident(name) if !self.is_local(name) => global_function(name, &args),
+            _ => Err(type_error("expression is not a function")),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    fn eval(src: &str, doc: &Document) -> bool {
+        Predicate::compile(src).unwrap().matches(doc).unwrap()
+    }
+
+    #[test]
+    fn function_and_bare_expression_forms() {
+        let d = doc! {"a": 5i32, "b": 3.5, "name": "Ada", "tags": ["x", "y"]};
+        assert!(eval("function () { return this.a > this.b; }", &d));
+        assert!(eval("function() { return obj.name == 'Ada' }", &d));
+        assert!(eval("this.a > this.b", &d));
+        assert!(!eval("this.a < this.b", &d));
+        // A function that falls off the end returns undefined
+        assert!(!eval("function () { this.a > 1; }", &d));
+        assert!(eval(
+            "this.tags.length === 2 && this.tags.indexOf('y') == 1",
+            &d
+        ));
+        assert!(eval(
+            "this.tags.includes('x') && this.tags[0] + this.tags[1] === 'xy'",
+            &d
+        ));
+    }
+
+    #[test]
+    fn locals_branches_and_builtins() {
+        let d = doc! {"first": "Ada", "last": "Lovelace", "born": 1815i64, "n": {"k": -2.6}};
+        let src = "function () {
+            var full = this.first + ' ' + this.last;
+            if (full.length > 20) return false;
+            else if (!full.startsWith('Ada')) { return false; }
+            const age = 1852 - this.born;
+            return age === 37 && Math.abs(Math.round(this.n.k)) === 3
+                ? full.toUpperCase().endsWith('LOVELACE')
+                : false;
+        }";
+        assert!(eval(src, &d));
+        assert!(eval(
+            "typeof this.missing === 'undefined' && typeof nope == 'undefined'",
+            &d
+        ));
+        assert!(eval("this.missing == null && this.born == '1815'", &d));
+        assert!(!eval("this.missing === null", &d));
+        assert!(eval(
+            "Math.max(1, this.born, 3) === 1815 && isNaN(this.first)",
+            &d
+        ));
+    }
+
+    #[test]
+    fn runtime_errors_surface() {
+        let p = Predicate::compile("this.missing.field == 1").unwrap();
+        let err = p.matches(&doc! {}).unwrap_err().to_string();
+        assert!(
+            err.contains("Cannot read property 'field' of undefined"),
+            "{}",
+            err
+        );
+        let p = Predicate::compile("nope > 1").unwrap();
+        assert!(
+            p.matches(&doc! {})
+                .unwrap_err()
+                .to_string()
+                .contains("ReferenceError")
+        );
+    }
+
+    #[test]
+    fn rejects_unsupported_syntax() {
+        for src in [
+            "while (true) {}",
+            "function () { for (;;) {} }",
+            "/a/.test(this.name)",
+            "this.a = ",
+            "'unterminated",
+            "function () { return 1; } extra",
+        ] {
+            assert!(Predicate::compile(src).is_err(), "{}", src);
+        }
+        let deep = format!("{}1{}", "(".repeat(200), ")".repeat(200));
+        assert!(Predicate::compile(&deep).is_err());
+    }
+
+    #[test]
+    fn rejects_long_chains() {
+        let terms = 100_000;
+        for src in [
+            vec!["1"; terms].join("+"),
+            format!("this{}", ".a".repeat(terms)),
+            format!("f{}", "()".repeat(terms)),
+            format!("this{}", "[0]".repeat(terms)),
+        ] {
+            assert!(Predicate::compile(&src).is_err(), "{}", &src[..20]);
+        }
+        assert!(eval(&vec!["1"; 50].join("+"), &doc! {}));
+    }
+
+    #[test]
+    fn strings_count_utf16_units() {
+        let d = doc! {"s": "a😀b"};
+        assert!(eval(
+            "this.s.length === 4 && this.s.indexOf('b') === 3 && this.s[3] === 'b'",
+            &d
+        ));
+        assert!(eval(
+            "this.s.substring(3) === 'b' && this.s.substring(1, 3) === '😀'",
+            &d
+        ));
+    }
+
+    #[test]
+    fn finds_where_under_logical_operators() {
+        assert!(!nested_where(&doc! {"$where": "true", "a": 1i32}));
+        assert!(nested_where(
+            &doc! {"$or": [{"a": 1i32}, {"$where": "true"}]}
+        ));
+        assert!(nested_where(
+            &doc! {"$and": [{"$nor": [{"$where": "this.a > 1"}]}]}
+        ));
+        assert!(!nested_where(&doc! {"$and": [{"a": {"$gt": 1i32}}]}));
+    }
+}
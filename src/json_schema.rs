@@ -0,0 +1,287 @@
+//! In-memory evaluation of `$jsonSchema`, MongoDB's dialect of JSON Schema draft 4.
+//!
+//! Collection validators are mostly written as `{$jsonSchema: ...}`, and are checked against
+//! each document a write produces. `find` and `$match` filters may use it too; SQL does not
+//! evaluate it, so those conditions are matched in memory. The keywords MongoDB supports are
+//! understood except `pattern`, `patternProperties` and `dependencies`, which are not
+//! checked: a schema using them behaves as if they were absent (and `additionalProperties`
+//! is then not enforced either, since the pattern-matched names cannot be told apart).
+
+use crate::aggregation::bson_cmp;
+use crate::bson_type::{alias_of, parse_type_spec};
+use bson::{Bson, Document};
+use std::cmp::Ordering;
+
+/// Whether `doc` satisfies `schema`.
+pub fn matches(doc: &Document, schema: &Document) -> bool {
+    check(&Bson::Document(doc.clone()), schema)
+}
+
+/// Whether `filter` uses `$jsonSchema`, at its top level or under `$and`, `$or`, `$nor` and
+/// `$not`. SQL does not evaluate it, so such filters are matched in memory.
+pub fn in_filter(filter: &Document) -> bool {
+    filter.iter().any(|(k, v)| uses_schema(k, v))
+}
+
+/// Split `filter` into its top-level conditions without `$jsonSchema`, which SQL evaluates,
+/// and those using it, which are matched in memory against what the first part selects.
+pub fn split_filter(filter: &Document) -> (Document, Document) {
+    let mut sql = Document::new();
+    let mut in_memory = Document::new();
+    for (k, v) in filter {
+        if uses_schema(k, v) {
+            in_memory.insert(k, v.clone());
+        } else {
+            sql.insert(k, v.clone());
+        }
+    }
+    (sql, in_memory)
+}
+
+fn uses_schema(key: &str, value: &Bson) -> bool {
+    match (key, value) {
+        ("$jsonSchema", _) => true,
+        ("$and" | "$or" | "$nor", Bson::Array(items)) => items
+            .iter()
+            .any(|item| item.as_document().is_some_and(in_filter)),
+        ("$not", Bson::Document(d)) => in_filter(d),
+        _ => false,
+    }
+}
+
+/// Whether `value` satisfies every keyword of `schema`. Keywords that constrain another type
+/// (`minLength` on a number, `required` on a string) hold trivially, as in JSON Schema.
+fn check(value: &Bson, schema: &Document) -> bool {
+    schema.iter().all(|(keyword, arg)| match keyword.as_str() {
+        "bsonType" => parse_type_spec(arg).is_some_and(|aliases| {
+            let alias = alias_of(value);
+            aliases.iter().any(|a| {
+                *a == alias
+                    || (*a == "number" && matches!(alias, "double" | "int" | "long" | "decimal"))
+            })
+        }),
+        "type" => json_types(arg).iter().any(|t| Some(*t) == json_type(value)),
+        "enum" => arg
+            .as_array()
+            .is_some_and(|options| options.iter().any(|o| same_value(o, value))),
+        "minimum" => number_bound(value, arg, schema, "exclusiveMinimum", Ordering::Greater),
+        "maximum" => number_bound(value, arg, schema, "exclusiveMaximum", Ordering::Less),
+        "multipleOf" => match (as_f64(value), as_f64(arg)) {
+            (Some(n), Some(m)) if m > 0.0 => (n / m).fract() == 0.0,
+            _ => true,
+        },
+        "minLength" => with_len(value, arg, |len, n| len >= n),
+        "maxLength" => with_len(value, arg, |len, n| len <= n),
+        "minItems" => with_len(value, arg, |len, n| len >= n),
+        "maxItems" => with_len(value, arg, |len, n| len <= n),
+        "minProperties" => with_len(value, arg, |len, n| len >= n),
+        "maxProperties" => with_len(value, arg, |len, n| len <= n),
+        "uniqueItems" => match value {
+            Bson::Array(items) if arg.as_bool() == Some(true) => items
+                .iter()
+                .enumerate()
+                .all(|(i, a)| items[..i].iter().all(|b| !same_value(a, b))),
+            _ => true,
+        },
+        "items" => match (value, arg) {
+            (Bson::Array(items), Bson::Document(s)) => items.iter().all(|v| check(v, s)),
+            (Bson::Array(items), Bson::Array(schemas)) => items
+                .iter()
+                .zip(schemas)
+                .all(|(v, s)| s.as_document().is_none_or(|s| check(v, s))),
+            _ => true,
+        },
+        "additionalItems" => match (value, schema.get("items")) {
+            (Bson::Array(items), Some(Bson::Array(positional))) => items
+                .iter()
+                .skip(positional.len())
+                .all(|v| allowed_extra(v, arg)),
+            _ => true,
+        },
+        "required" => match (value, arg) {
+            (Bson::Document(d), Bson::Array(names)) => names
+                .iter()
+                .all(|n| n.as_str().is_some_and(|n| d.contains_key(n))),
+            _ => true,
+        },
+        "properties" => match (value, arg) {
+            (Bson::Document(d), Bson::Document(props)) => {
+                props.iter().all(|(name, s)| match (d.get(name), s) {
+                    (Some(v), Bson::Document(s)) => check(v, s),
+                    _ => true,
+                })
+            }
+            _ => true,
+        },
+        "additionalProperties" => match value {
+            Bson::Document(_) if schema.contains_key("patternProperties") => true,
+            Bson::Document(d) => {
+                let props = schema.get_document("properties").ok();
+                d.iter()
+                    .filter(|(name, _)| !props.is_some_and(|p| p.contains_key(name.as_str())))
+                    .all(|(_, v)| allowed_extra(v, arg))
+            }
+            _ => true,
+        },
+        "allOf" => subschemas(arg).all(|s| check(value, s)),
+        "anyOf" => subschemas(arg).any(|s| check(value, s)),
+        "oneOf" => subschemas(arg).filter(|s| check(value, s)).count() == 1,
+        "not" => arg.as_document().is_none_or(|s| !check(value, s)),
+        _ => true,
+    })
+}
+
+/// The JSON Schema `type` of `value`; BSON types JSON has no name for have none.
+fn json_type(value: &Bson) -> Option<&'static str> {
+    match value {
+        Bson::Document(_) => Some("object"),
+        Bson::Array(_) => Some("array"),
+        Bson::Int32(_) | Bson::Int64(_) | Bson::Double(_) | Bson::Decimal128(_) => Some("number"),
+        Bson::Boolean(_) => Some("boolean"),
+        Bson::String(_) => Some("string"),
+        Bson::Null => Some("null"),
+        _ => None,
+    }
+}
+
+/// The names a `type` keyword allows: one name or an array of them.
+fn json_types(arg: &Bson) -> Vec<&str> {
+    match arg {
+        Bson::String(t) => vec![t.as_str()],
+        Bson::Array(ts) => ts.iter().filter_map(Bson::as_str).collect(),
+        _ => Vec::new(),
+    }
+}
+
+/// `minimum`/`maximum` for numbers: `value` compares to `bound` as `want`, or equals it
+/// unless the schema's `exclusive` flag is set.
+fn number_bound(
+    value: &Bson,
+    bound: &Bson,
+    schema: &Document,
+    exclusive: &str,
+    want: Ordering,
+) -> bool {
+    if json_type(value) != Some("number") || json_type(bound) != Some("number") {
+        return true;
+    }
+    match bson_cmp(value, bound) {
+        Ordering::Equal => !schema.get_bool(exclusive).unwrap_or(false),
+        ord => ord == want,
+    }
+}
+
+/// A length keyword: `ok(len, n)` for the characters of a string, the elements of an array
+/// or the fields of a document.
+fn with_len(value: &Bson, arg: &Bson, ok: impl Fn(usize, usize) -> bool) -> bool {
+    let Some(n) = as_f64(arg) else {
+        return true;
+    };
+    let len = match value {
+        Bson::String(s) => s.chars().count(),
+        Bson::Array(items) => items.len(),
+        Bson::Document(d) => d.len(),
+        _ => return true,
+    };
+    ok(len, n.max(0.0) as usize)
+}
+
+/// `additionalItems`/`additionalProperties`: `false` forbids extras, a schema constrains them.
+fn allowed_extra(value: &Bson, arg: &Bson) -> bool {
+    match arg {
+        Bson::Boolean(allowed) => *allowed,
+        Bson::Document(s) => check(value, s),
+        _ => true,
+    }
+}
+
+fn subschemas(arg: &Bson) -> impl Iterator<Item = &Document> {
+    arg.as_array()
+        .into_iter()
+        .flatten()
+        .filter_map(Bson::as_document)
+}
+
+/// Equality for `enum` and `uniqueItems`, where numbers of different types are equal.
+fn same_value(a: &Bson, b: &Bson) -> bool {
+    match (json_type(a), json_type(b)) {
+        (Some("number"), Some("number")) => bson_cmp(a, b) == Ordering::Equal,
+        _ => a == b,
+    }
+}
+
+fn as_f64(v: &Bson) -> Option<f64> {
+    match v {
+        Bson::Int32(n) => Some(*n as f64),
+        Bson::Int64(n) => Some(*n as f64),
+        Bson::Double(f) => Some(*f),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    #[test]
+    fn checks_required_and_property_types() {
+        let schema = doc! {
+            "bsonType": "object",
+            "required": ["name", "age"],
+            "properties": {
+                "name": {"bsonType": "string", "minLength": 1},
+                "age": {"bsonType": "int", "minimum": 0, "maximum": 150},
+            },
+        };
+        assert!(matches(&doc! {"name": "ann", "age": 30}, &schema));
+        assert!(!matches(&doc! {"name": "ann"}, &schema));
+        assert!(!matches(&doc! {"name": "ann", "age": "30"}, &schema));
+        assert!(!matches(&doc! {"name": "", "age": 30}, &schema));
+        assert!(!matches(&doc! {"name": "ann", "age": -1}, &schema));
+    }
+
+    #[test]
+    fn checks_arrays_enums_and_extras() {
+        let schema = doc! {
+            "properties": {
+                "tags": {"bsonType": "array", "items": {"enum": ["a", "b"]}, "uniqueItems": true},
+                "n": {"type": "number", "minimum": 1, "exclusiveMinimum": true},
+            },
+            "additionalProperties": false,
+        };
+        assert!(matches(&doc! {"tags": ["a", "b"], "n": 2.5}, &schema));
+        assert!(!matches(&doc! {"tags": ["a", "a"]}, &schema));
+        assert!(!matches(&doc! {"tags": ["c"]}, &schema));
+        assert!(!matches(&doc! {"n": 1}, &schema));
+        assert!(!matches(&doc! {"other": 1}, &schema));
+    }
+
+    #[test]
+    fn splits_schema_conditions_from_filters() {
+        let filter = doc! {
+            "status": "active",
+            "$nor": [{"$jsonSchema": {"required": ["email"]}}],
+            "$or": [{"a": 1}, {"b": 2}],
+        };
+        assert!(in_filter(&filter));
+        assert!(!in_filter(&doc! {"$or": [{"a": 1}], "$jsonSchemaX": 1}));
+        let (sql, in_memory) = split_filter(&filter);
+        assert_eq!(sql, doc! {"status": "active", "$or": [{"a": 1}, {"b": 2}]});
+        assert_eq!(
+            in_memory,
+            doc! {"$nor": [{"$jsonSchema": {"required": ["email"]}}]}
+        );
+    }
+
+    #[test]
+    fn combines_subschemas() {
+        let schema = doc! {
+            "anyOf": [{"required": ["email"]}, {"required": ["phone"]}],
+            "not": {"required": ["password"]},
+        };
+        assert!(matches(&doc! {"email": "x@y"}, &schema));
+        assert!(!matches(&doc! {"name": "ann"}, &schema));
+        assert!(!matches(&doc! {"phone": "1", "password": "p"}, &schema));
+    }
+}
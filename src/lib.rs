@@ -1,11 +1,26 @@
 pub mod aggregation;
+pub mod bson_type;
+pub mod cluster_time;
 pub mod config;
 pub mod error;
+pub mod error_codes;
+pub mod extended_json;
+pub mod ip_filter;
+pub mod js;
+pub mod json_schema;
+pub mod logging;
+pub mod metrics;
 pub mod namespace;
 pub mod protocol;
+pub mod rw_concern;
+pub mod schema_map;
 pub mod scram;
 pub mod server;
 pub mod session;
 pub mod shadow;
+pub mod stmt_cache;
 pub mod store;
+pub mod telemetry;
 pub mod translate;
+pub mod users;
+pub mod write_limits;
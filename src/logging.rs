@@ -0,0 +1,139 @@
+//! Log output format and per-command log entries.
+
+use bson::{Bson, Document};
+use std::time::Duration;
+
+/// Fields whose values are replaced before a command is logged (auth payloads, passwords).
+const REDACTED_FIELDS: [&str; 5] = ["payload", "pwd", "password", "digestPassword", "key"];
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum LogFormat {
+    Text,
+    Json,
+}
+
+impl LogFormat {
+    pub fn parse(s: &str) -> Option<Self> {
+        match s.to_ascii_lowercase().as_str() {
+            "text" | "compact" => Some(Self::Text),
+            "json" => Some(Self::Json),
+            _ => None,
+        }
+    }
+}
+
+/// Emit the one-per-command log entry. Runs inside the command span, so `conn_id` and
+/// `op_id` (also attached to every SQL statement logged at debug) come along with it.
+pub fn log_command(
+    db: &str,
+    collection: &str,
+    command: &str,
+    duration: Duration,
+    reply: &Document,
+) {
+    let ok = match reply.get("ok") {
+        Some(Bson::Double(v)) => *v != 0.0,
+        Some(Bson::Int32(v)) => *v != 0,
+        _ => true,
+    };
+    let rows = reply_row_count(reply);
+    tracing::info!(
+        target: "oxidedb::command",
+        db,
+        collection,
+        command,
+        duration_ms = duration.as_secs_f64() * 1000.0,
+        rows,
+        ok,
+        "command"
+    );
+}
+
+/// Emit the slow-operation warning (target `oxidedb::slow`, always enabled at `warn`).
+pub fn log_slow_command(command: &str, ns: &str, duration: Duration, sql: &[String]) {
+    tracing::warn!(
+        target: "oxidedb::slow",
+        command,
+        ns,
+        duration_ms = duration.as_secs_f64() * 1000.0,
+        sql = %sql.join("; "),
+        "slow operation"
+    );
+}
+
+/// Rows affected or returned by a command: `n` for writes, the first/next batch size for cursors.
+pub fn reply_row_count(reply: &Document) -> Option<i64> {
+    match reply.get("n") {
+        Some(Bson::Int32(n)) => return Some(*n as i64),
+        Some(Bson::Int64(n)) => return Some(*n),
+        _ => {}
+    }
+    let cursor = reply.get_document("cursor").ok()?;
+    cursor
+        .get_array("firstBatch")
+        .or_else(|_| cursor.get_array("nextBatch"))
+        .ok()
+        .map(|b| b.len() as i64)
+}
+
+/// Copy of `cmd` with credential-bearing fields (at any depth) replaced by `"<redacted>"`.
+pub fn redact_command(cmd: &Document) -> Document {
+    let mut out = Document::new();
+    for (k, v) in cmd {
+        if REDACTED_FIELDS.contains(&k.as_str()) {
+            out.insert(k.clone(), "<redacted>");
+        } else {
+            out.insert(k.clone(), redact_value(v));
+        }
+    }
+    out
+}
+
+fn redact_value(v: &Bson) -> Bson {
+    match v {
+        Bson::Document(d) => Bson::Document(redact_command(d)),
+        Bson::Array(a) => Bson::Array(a.iter().map(redact_value).collect()),
+        other => other.clone(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    #[test]
+    fn redacts_auth_payloads_at_any_depth() {
+        let cmd = doc! {
+            "hello": 1i32,
+            "speculativeAuthenticate": {"saslStart": 1i32, "mechanism": "SCRAM-SHA-256", "payload": "n,,n=u,r=abc"},
+            "$db": "admin",
+        };
+        let redacted = redact_command(&cmd);
+        let spec = redacted.get_document("speculativeAuthenticate").unwrap();
+        assert_eq!(spec.get_str("payload").unwrap(), "<redacted>");
+        assert_eq!(spec.get_str("mechanism").unwrap(), "SCRAM-SHA-256");
+        assert_eq!(redacted.get_str("$db").unwrap(), "admin");
+
+        let create = doc! {"createUser": "app", "pwd": "hunter2", "roles": []};
+        assert_eq!(
+            redact_command(&create).get_str("pwd").unwrap(),
+            "<redacted>"
+        );
+    }
+
+    #[test]
+    fn counts_rows_from_writes_and_cursors() {
+        assert_eq!(reply_row_count(&doc! {"n": 3i32, "ok": 1.0}), Some(3));
+        let find = doc! {"cursor": {"id": 0i64, "ns": "db.c", "firstBatch": [{"a": 1}, {"a": 2}]}, "ok": 1.0};
+        assert_eq!(reply_row_count(&find), Some(2));
+        assert_eq!(reply_row_count(&doc! {"ok": 1.0}), None);
+    }
+
+    #[test]
+    fn parses_log_format() {
+        assert_eq!(LogFormat::parse("JSON"), Some(LogFormat::Json));
+        assert_eq!(LogFormat::parse("text"), Some(LogFormat::Text));
+        assert_eq!(LogFormat::parse("xml"), None);
+    }
+}
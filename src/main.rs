@@ -1,5 +1,7 @@
 use clap::Parser;
-use oxidedb::{config::Config, server};
+use oxidedb::{config::Config, logging::LogFormat, server, telemetry};
+use tracing_subscriber::layer::SubscriberExt;
+use tracing_subscriber::util::SubscriberInitExt;
 
 #[tokio::main]
 async fn main() -> anyhow::Result<()> {
@@ -26,22 +28,66 @@ async fn main() -> anyhow::Result<()> {
     } else {
         "info".to_string()
     };
-
-    // Initialize logging with chosen filter
-    tracing_subscriber::fmt()
-        .with_env_filter(tracing_subscriber::EnvFilter::new(filter_spec))
-        .compact()
+    // Slow-op warnings are emitted regardless of the general log level
+    let filter_spec = format!("{},oxidedb::slow=warn", filter_spec);
+
+    // Log format: CLI (--log-format / OXIDEDB_LOG_FORMAT) > config.toml log_format > text
+    let log_format = cli
+        .log_format
+        .as_deref()
+        .or(cfg_file.log_format.as_deref())
+        .and_then(LogFormat::parse)
+        .unwrap_or(LogFormat::Text);
+
+    // OTLP endpoint: CLI (--otlp-endpoint / OXIDEDB_OTLP_ENDPOINT) > config.toml otlp_endpoint
+    let otlp_endpoint = cli
+        .otlp_endpoint
+        .clone()
+        .or_else(|| cfg_file.otlp_endpoint.clone());
+    #[cfg(feature = "otel")]
+    let (otel_layer, otel_error) = match otlp_endpoint.as_deref() {
+        Some(endpoint) => match telemetry::otlp_layer(endpoint) {
+            Ok(layer) => (Some(layer), None),
+            Err(e) => (None, Some(e)),
+        },
+        None => (None, None),
+    };
+    #[cfg(not(feature = "otel"))]
+    let otel_layer: Option<tracing_subscriber::layer::Identity> = None;
+
+    // Initialize logging with chosen filter and format
+    let (json_layer, text_layer) = match log_format {
+        LogFormat::Json => (
+            Some(tracing_subscriber::fmt::layer().json().flatten_event(true)),
+            None,
+        ),
+        LogFormat::Text => (None, Some(tracing_subscriber::fmt::layer().compact())),
+    };
+    tracing_subscriber::registry()
+        .with(tracing_subscriber::EnvFilter::new(filter_spec))
+        .with(json_layer)
+        .with(text_layer)
+        .with(otel_layer)
         .init();
 
     if let Err(e) = cfg_file_res.as_ref() {
         tracing::warn!(error = %format!("{e:?}"), "invalid config; using defaults");
     }
+    #[cfg(feature = "otel")]
+    if let Some(e) = otel_error {
+        tracing::warn!(error = %e, "failed to initialize OpenTelemetry export; spans not exported");
+    }
+    #[cfg(not(feature = "otel"))]
+    if otlp_endpoint.is_some() {
+        tracing::warn!("otlp_endpoint is set but oxidedb was built without the `otel` feature");
+    }
 
     // Load from config file (if present), then override with CLI/env.
     let cfg = cfg_file.with_overrides(
         cli.listen_addr.clone(),
         cli.postgres_url.clone(),
         cli.log_level.clone(),
+        cli.log_format.clone(),
         cli.shadow_enabled,
         cli.shadow_addr.clone(),
         cli.shadow_db_prefix.clone(),
@@ -53,6 +99,7 @@ async fn main() -> anyhow::Result<()> {
     if let Err(e) = server::run(cfg).await {
         tracing::error!(error = %format!("{e:?}"), "server terminated with error");
     }
+    telemetry::shutdown();
 
     Ok(())
 }
@@ -80,6 +127,14 @@ struct Cli {
     #[arg(long = "log-level", env = "OXIDEDB_LOG_LEVEL")]
     log_level: Option<String>,
 
+    /// Log output format: text or json
+    #[arg(long = "log-format", env = "OXIDEDB_LOG_FORMAT")]
+    log_format: Option<String>,
+
+    /// OpenTelemetry OTLP/gRPC collector endpoint (requires the `otel` feature)
+    #[arg(long = "otlp-endpoint", env = "OXIDEDB_OTLP_ENDPOINT")]
+    otlp_endpoint: Option<String>,
+
     /// Shadow: enable/disable upstream comparison
     #[arg(long = "shadow-enabled", env = "OXIDEDB_SHADOW_ENABLED")]
     shadow_enabled: Option<bool>,
@@ -0,0 +1,266 @@
+//! Per-command Prometheus metrics: request counts, latency histograms and error codes,
+//! labelled by command name and database, and request counts by client application.
+
+use bson::{Bson, Document};
+use std::collections::HashMap;
+use std::fmt::Write;
+use std::sync::Mutex;
+use std::time::Duration;
+
+/// Upper bounds (in seconds) of the command latency histogram buckets.
+pub const LATENCY_BUCKETS: [f64; 12] = [
+    0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0,
+];
+
+/// Error code reported when a failed reply carries no `code` (Mongo's `UnknownError`).
+const UNKNOWN_ERROR_CODE: i32 = 8;
+
+#[derive(Default)]
+struct CommandStats {
+    count: u64,
+    sum_secs: f64,
+    buckets: [u64; LATENCY_BUCKETS.len()],
+}
+
+/// Counters keyed by `(command, db)`; errors additionally by Mongo error code. Requests
+/// are also counted by the `appName` their client reported.
+#[derive(Default)]
+pub struct CommandMetrics {
+    commands: Mutex<HashMap<(String, String), CommandStats>>,
+    errors: Mutex<HashMap<(String, String, i32), u64>>,
+    apps: Mutex<HashMap<String, u64>>,
+}
+
+impl CommandMetrics {
+    /// Record one completed command and the error codes found in its reply.
+    pub fn record(&self, command: &str, db: &str, duration: Duration, error_codes: &[i32]) {
+        let secs = duration.as_secs_f64();
+        if let Ok(mut commands) = self.commands.lock() {
+            let stats = commands
+                .entry((command.to_string(), db.to_string()))
+                .or_default();
+            stats.count += 1;
+            stats.sum_secs += secs;
+            // Buckets are cumulative, as Prometheus expects
+            for (i, le) in LATENCY_BUCKETS.iter().enumerate() {
+                if secs <= *le {
+                    stats.buckets[i] += 1;
+                }
+            }
+        }
+        if error_codes.is_empty() {
+            return;
+        }
+        if let Ok(mut errors) = self.errors.lock() {
+            for code in error_codes {
+                *errors
+                    .entry((command.to_string(), db.to_string(), *code))
+                    .or_insert(0) += 1;
+            }
+        }
+    }
+
+    /// Record one command from a client that reported application name `app`.
+    pub fn record_app(&self, app: &str) {
+        if let Ok(mut apps) = self.apps.lock() {
+            *apps.entry(app.to_string()).or_insert(0) += 1;
+        }
+    }
+
+    /// Append the per-command series in Prometheus text exposition format.
+    pub fn render(&self, out: &mut String) {
+        let commands = match self.commands.lock() {
+            Ok(c) => c,
+            Err(_) => return,
+        };
+        let mut keys: Vec<&(String, String)> = commands.keys().collect();
+        keys.sort();
+
+        out.push_str(
+            "# HELP oxidedb_command_requests_total Commands handled, by command and database\n\
+             # TYPE oxidedb_command_requests_total counter\n",
+        );
+        for key in &keys {
+            let _ = writeln!(
+                out,
+                "oxidedb_command_requests_total{{{}}} {}",
+                labels(&key.0, &key.1),
+                commands[*key].count
+            );
+        }
+        out.push('\n');
+
+        out.push_str(
+            "# HELP oxidedb_command_duration_seconds Command latency in seconds\n\
+             # TYPE oxidedb_command_duration_seconds histogram\n",
+        );
+        for key in &keys {
+            let stats = &commands[*key];
+            let base = labels(&key.0, &key.1);
+            for (i, le) in LATENCY_BUCKETS.iter().enumerate() {
+                let _ = writeln!(
+                    out,
+                    "oxidedb_command_duration_seconds_bucket{{{},le=\"{}\"}} {}",
+                    base, le, stats.buckets[i]
+                );
+            }
+            let _ = writeln!(
+                out,
+                "oxidedb_command_duration_seconds_bucket{{{},le=\"+Inf\"}} {}",
+                base, stats.count
+            );
+            let _ = writeln!(
+                out,
+                "oxidedb_command_duration_seconds_sum{{{}}} {}",
+                base, stats.sum_secs
+            );
+            let _ = writeln!(
+                out,
+                "oxidedb_command_duration_seconds_count{{{}}} {}",
+                base, stats.count
+            );
+        }
+        drop(commands);
+        out.push('\n');
+
+        out.push_str(
+            "# HELP oxidedb_command_errors_total Command errors, by command, database and Mongo error code\n\
+             # TYPE oxidedb_command_errors_total counter\n",
+        );
+        if let Ok(errors) = self.errors.lock() {
+            let mut entries: Vec<(&(String, String, i32), &u64)> = errors.iter().collect();
+            entries.sort();
+            for ((command, db, code), n) in entries {
+                let _ = writeln!(
+                    out,
+                    "oxidedb_command_errors_total{{{},code=\"{}\"}} {}",
+                    labels(command, db),
+                    code,
+                    n
+                );
+            }
+        }
+        out.push('\n');
+
+        out.push_str(
+            "# HELP oxidedb_app_requests_total Commands handled, by client application name\n\
+             # TYPE oxidedb_app_requests_total counter\n",
+        );
+        if let Ok(apps) = self.apps.lock() {
+            let mut entries: Vec<(&String, &u64)> = apps.iter().collect();
+            entries.sort();
+            for (app, n) in entries {
+                let _ = writeln!(
+                    out,
+                    "oxidedb_app_requests_total{{app_name=\"{}\"}} {}",
+                    escape_label(app),
+                    n
+                );
+            }
+        }
+    }
+}
+
+/// Error codes carried by a command reply: the top-level code when `ok` is 0,
+/// plus the code of every `writeErrors` entry.
+pub fn reply_error_codes(reply: &Document) -> Vec<i32> {
+    let mut codes = Vec::new();
+    let ok = match reply.get("ok") {
+        Some(Bson::Double(v)) => *v,
+        Some(Bson::Int32(v)) => *v as f64,
+        Some(Bson::Int64(v)) => *v as f64,
+        _ => 1.0,
+    };
+    if ok == 0.0 {
+        codes.push(error_code(reply));
+    }
+    if let Ok(write_errors) = reply.get_array("writeErrors") {
+        for we in write_errors {
+            if let Bson::Document(d) = we {
+                codes.push(error_code(d));
+            }
+        }
+    }
+    codes
+}
+
+fn error_code(doc: &Document) -> i32 {
+    match doc.get("code") {
+        Some(Bson::Int32(c)) => *c,
+        Some(Bson::Int64(c)) => *c as i32,
+        _ => UNKNOWN_ERROR_CODE,
+    }
+}
+
+fn labels(command: &str, db: &str) -> String {
+    format!(
+        "command=\"{}\",db=\"{}\"",
+        escape_label(command),
+        escape_label(db)
+    )
+}
+
+/// Escape a label value per the Prometheus text format.
+pub fn escape_label(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    #[test]
+    fn renders_counters_histogram_and_errors() {
+        let m = CommandMetrics::default();
+        m.record("find", "app", Duration::from_millis(3), &[]);
+        m.record("find", "app", Duration::from_millis(30), &[26]);
+        let mut out = String::new();
+        m.render(&mut out);
+        assert!(out.contains("oxidedb_command_requests_total{command=\"find\",db=\"app\"} 2"));
+        assert!(out.contains(
+            "oxidedb_command_duration_seconds_bucket{command=\"find\",db=\"app\",le=\"0.005\"} 1"
+        ));
+        assert!(out.contains(
+            "oxidedb_command_duration_seconds_bucket{command=\"find\",db=\"app\",le=\"+Inf\"} 2"
+        ));
+        assert!(
+            out.contains("oxidedb_command_errors_total{command=\"find\",db=\"app\",code=\"26\"} 1")
+        );
+    }
+
+    #[test]
+    fn counts_requests_by_app_name() {
+        let m = CommandMetrics::default();
+        m.record_app("billing");
+        m.record_app("billing");
+        m.record_app("web \"v2\"");
+        let mut out = String::new();
+        m.render(&mut out);
+        assert!(out.contains("oxidedb_app_requests_total{app_name=\"billing\"} 2"));
+        assert!(out.contains("oxidedb_app_requests_total{app_name=\"web \\\"v2\\\"\"} 1"));
+    }
+
+    #[test]
+    fn collects_top_level_and_write_error_codes() {
+        assert!(reply_error_codes(&doc! {"ok": 1.0}).is_empty());
+        assert_eq!(
+            reply_error_codes(&doc! {"ok": 0.0, "code": 59i32, "errmsg": "x"}),
+            vec![59]
+        );
+        let reply = doc! {
+            "n": 1i32,
+            "writeErrors": [{"index": 1i32, "code": 11000i32, "errmsg": "dup"}],
+            "ok": 1.0,
+        };
+        assert_eq!(reply_error_codes(&reply), vec![11000]);
+    }
+
+    #[test]
+    fn escapes_label_values() {
+        assert_eq!(escape_label("a\"b\\c\nd"), "a\\\"b\\\\c\\nd");
+    }
+}
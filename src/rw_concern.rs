@@ -0,0 +1,331 @@
+//! The cluster-wide read and write concern defaults `getDefaultRWConcern` reports and
+//! `setDefaultRWConcern` changes.
+//!
+//! Operations without a `readConcern` or `writeConcern` of their own use these. Until a
+//! default is set the implicit ones apply: `local` reads and `w: 1` writes, which is what
+//! OxideDB does anyway, since a write is acknowledged once PostgreSQL has committed it.
+//! A single PostgreSQL primary satisfies every valid level and `w` alike, so the defaults
+//! are validated and attached to the commands they apply to rather than changing how
+//! those run.
+
+use bson::{Bson, DateTime, Document, Timestamp, doc};
+
+/// Commands that take the default read concern when they carry none.
+const READ_COMMANDS: [&str; 4] = ["find", "aggregate", "count", "distinct"];
+
+/// Commands that take the default write concern when they carry none.
+const WRITE_COMMANDS: [&str; 5] = [
+    "insert",
+    "update",
+    "delete",
+    "findAndModify",
+    "findandmodify",
+];
+
+/// The defaults and when they last changed.
+#[derive(Debug, Clone)]
+pub struct RwConcernDefaults {
+    /// Set by `setDefaultRWConcern`; the implicit default applies while unset
+    pub read_concern: Option<Document>,
+    pub write_concern: Option<Document>,
+    /// Cluster time and wall-clock time of the last change, if there was one
+    pub update_op_time: Option<Timestamp>,
+    pub update_wall_clock_time: Option<DateTime>,
+    /// When this server last loaded the defaults
+    pub local_update_wall_clock_time: DateTime,
+}
+
+impl Default for RwConcernDefaults {
+    fn default() -> Self {
+        Self {
+            read_concern: None,
+            write_concern: None,
+            update_op_time: None,
+            update_wall_clock_time: None,
+            local_update_wall_clock_time: DateTime::now(),
+        }
+    }
+}
+
+impl RwConcernDefaults {
+    /// The `readConcern` operations without one of their own use.
+    pub fn effective_read_concern(&self) -> Document {
+        self.read_concern
+            .clone()
+            .unwrap_or_else(|| doc! {"level": "local"})
+    }
+
+    /// The `writeConcern` operations without one of their own use.
+    pub fn effective_write_concern(&self) -> Document {
+        self.write_concern
+            .clone()
+            .unwrap_or_else(|| doc! {"w": 1i32, "wtimeout": 0i32})
+    }
+
+    /// `setDefaultRWConcern`: replace the defaults the command sets, stamped with the
+    /// cluster time `now`. An empty `defaultReadConcern` unsets the read default; the write
+    /// default cannot be unset once set. Nothing changes unless both are valid.
+    pub fn set(&mut self, cmd: &Document, now: Timestamp) -> Result<(), String> {
+        let read = match cmd.get("defaultReadConcern") {
+            None => None,
+            Some(Bson::Document(rc)) => {
+                validate_default_read_concern(rc)?;
+                Some(rc)
+            }
+            Some(_) => return Err("'defaultReadConcern' must be an object".into()),
+        };
+        let write = match cmd.get("defaultWriteConcern") {
+            None => None,
+            Some(Bson::Document(wc)) => {
+                validate_default_write_concern(wc)?;
+                if wc.is_empty() && self.write_concern.is_some() {
+                    return Err(
+                        "The global default write concern cannot be unset once it is set".into(),
+                    );
+                }
+                Some(wc)
+            }
+            Some(_) => return Err("'defaultWriteConcern' must be an object".into()),
+        };
+        if read.is_none() && write.is_none() {
+            return Err(
+                "At least one of the 'defaultReadConcern' or 'defaultWriteConcern' fields must be present"
+                    .into(),
+            );
+        }
+        if let Some(rc) = read {
+            self.read_concern = (!rc.is_empty()).then(|| rc.clone());
+        }
+        if let Some(wc) = write.filter(|wc| !wc.is_empty()) {
+            self.write_concern = Some(wc.clone());
+        }
+        let wall = DateTime::now();
+        self.update_op_time = Some(now);
+        self.update_wall_clock_time = Some(wall);
+        self.local_update_wall_clock_time = wall;
+        Ok(())
+    }
+
+    /// Attach the defaults that were set to a command that carries no concern of its own.
+    /// Operations in a transaction take theirs from the transaction instead.
+    pub fn apply(&self, cmd: &mut Document) {
+        if cmd.contains_key("autocommit") {
+            return;
+        }
+        let name = cmd.keys().next().cloned().unwrap_or_default();
+        if let Some(rc) = &self.read_concern
+            && READ_COMMANDS.contains(&name.as_str())
+            && !cmd.contains_key("readConcern")
+        {
+            cmd.insert("readConcern", rc.clone());
+        }
+        if let Some(wc) = &self.write_concern
+            && WRITE_COMMANDS.contains(&name.as_str())
+            && !cmd.contains_key("writeConcern")
+        {
+            cmd.insert("writeConcern", wc.clone());
+        }
+    }
+
+    /// The reply of `getDefaultRWConcern`, without `ok`. A default that was never set is
+    /// reported with the implicit value and source `implicit`.
+    pub fn reply(&self) -> Document {
+        let source = |set: bool| if set { "global" } else { "implicit" };
+        let mut reply = doc! {
+            "defaultReadConcern": self.effective_read_concern(),
+            "defaultWriteConcern": self.effective_write_concern(),
+        };
+        if let Some(ts) = self.update_op_time {
+            reply.insert("updateOpTime", ts);
+        }
+        if let Some(t) = self.update_wall_clock_time {
+            reply.insert("updateWallClockTime", t);
+        }
+        reply.insert(
+            "defaultReadConcernSource",
+            source(self.read_concern.is_some()),
+        );
+        reply.insert(
+            "defaultWriteConcernSource",
+            source(self.write_concern.is_some()),
+        );
+        reply.insert(
+            "localUpdateWallClockTime",
+            self.local_update_wall_clock_time,
+        );
+        reply
+    }
+}
+
+/// A default read concern names only a `level`, and one of `local`, `available` or
+/// `majority`: `snapshot` and `linearizable` reads must be asked for explicitly.
+fn validate_default_read_concern(rc: &Document) -> Result<(), String> {
+    for (key, value) in rc {
+        match (key.as_str(), value) {
+            ("level", Bson::String(level)) => match level.as_str() {
+                "local" | "available" | "majority" => {}
+                "snapshot" | "linearizable" => {
+                    return Err(format!(
+                        "Default read concern level '{}' is not supported",
+                        level
+                    ));
+                }
+                _ => {
+                    return Err(format!(
+                        "Enumeration value '{}' for field 'level' is not a valid value",
+                        level
+                    ));
+                }
+            },
+            ("level", _) => return Err("'level' must be a string".into()),
+            (other, _) => {
+                return Err(format!(
+                    "'{}' is not allowed in the default read concern",
+                    other
+                ));
+            }
+        }
+    }
+    Ok(())
+}
+
+/// A write concern's `w` is a non-negative number or a name (`majority`), `j` and `fsync`
+/// booleans and `wtimeout` a number. A default must acknowledge writes, so `w: 0` is refused.
+fn validate_default_write_concern(wc: &Document) -> Result<(), String> {
+    for (key, value) in wc {
+        match (key.as_str(), value) {
+            ("w", Bson::String(tag)) if !tag.is_empty() => {}
+            ("w", w) => match as_f64(w) {
+                Some(n) if n == 0.0 => {
+                    return Err("The default write concern cannot be unacknowledged (w: 0)".into());
+                }
+                Some(n) if n > 0.0 && n.fract() == 0.0 => {}
+                _ => return Err("w has to be a non-negative integer or a non-empty string".into()),
+            },
+            ("j" | "fsync", Bson::Boolean(_)) => {}
+            ("j" | "fsync", _) => return Err(format!("'{}' must be a boolean", key)),
+            ("wtimeout", t) if as_f64(t).is_some_and(|t| t >= 0.0) => {}
+            ("wtimeout", _) => return Err("'wtimeout' must be a non-negative number".into()),
+            (other, _) => {
+                return Err(format!("unrecognized write concern field: {}", other));
+            }
+        }
+    }
+    Ok(())
+}
+
+fn as_f64(v: &Bson) -> Option<f64> {
+    match v {
+        Bson::Int32(n) => Some(*n as f64),
+        Bson::Int64(n) => Some(*n as f64),
+        Bson::Double(f) => Some(*f),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn reports_implicit_defaults_until_set() {
+        let mut defaults = RwConcernDefaults::default();
+        let reply = defaults.reply();
+        assert_eq!(
+            reply.get_document("defaultReadConcern").unwrap(),
+            &doc! {"level": "local"}
+        );
+        assert_eq!(
+            reply
+                .get_document("defaultWriteConcern")
+                .unwrap()
+                .get_i32("w")
+                .unwrap(),
+            1
+        );
+        assert_eq!(
+            reply.get_str("defaultReadConcernSource").unwrap(),
+            "implicit"
+        );
+        assert!(!reply.contains_key("updateOpTime"));
+        assert!(reply.get_datetime("localUpdateWallClockTime").is_ok());
+
+        defaults.write_concern = Some(doc! {"w": "majority", "wtimeout": 0i32});
+        defaults.update_op_time = Some(Timestamp {
+            time: 1,
+            increment: 1,
+        });
+        let reply = defaults.reply();
+        assert_eq!(
+            reply
+                .get_document("defaultWriteConcern")
+                .unwrap()
+                .get_str("w")
+                .unwrap(),
+            "majority"
+        );
+        assert_eq!(
+            reply.get_str("defaultWriteConcernSource").unwrap(),
+            "global"
+        );
+        assert_eq!(
+            reply.get_str("defaultReadConcernSource").unwrap(),
+            "implicit"
+        );
+        assert!(reply.get_timestamp("updateOpTime").is_ok());
+    }
+
+    #[test]
+    fn sets_validated_defaults_and_applies_them() {
+        let mut defaults = RwConcernDefaults::default();
+        let now = Timestamp {
+            time: 5,
+            increment: 2,
+        };
+        for bad in [
+            doc! {},
+            doc! {"defaultReadConcern": {"level": "snapshot"}},
+            doc! {"defaultReadConcern": {"level": "nearest"}},
+            doc! {"defaultWriteConcern": {"w": 0i32}},
+            doc! {"defaultWriteConcern": {"w": -1i32}},
+            doc! {"defaultWriteConcern": {"w": 1i32, "j": "yes"}},
+            doc! {"defaultReadConcern": {"level": "majority"}, "defaultWriteConcern": {"x": 1i32}},
+        ] {
+            assert!(defaults.set(&bad, now).is_err(), "{:?}", bad);
+        }
+        assert!(defaults.read_concern.is_none() && defaults.update_op_time.is_none());
+
+        let cmd = doc! {
+            "setDefaultRWConcern": 1i32,
+            "defaultReadConcern": {"level": "majority"},
+            "defaultWriteConcern": {"w": "majority", "wtimeout": 500i32},
+        };
+        defaults.set(&cmd, now).unwrap();
+        assert_eq!(defaults.update_op_time, Some(now));
+
+        let mut find = doc! {"find": "c", "filter": {}};
+        defaults.apply(&mut find);
+        assert_eq!(
+            find.get_document("readConcern").unwrap(),
+            &doc! {"level": "majority"}
+        );
+        let mut insert = doc! {"insert": "c", "writeConcern": {"w": 1i32}};
+        defaults.apply(&mut insert);
+        assert_eq!(
+            insert.get_document("writeConcern").unwrap(),
+            &doc! {"w": 1i32}
+        );
+        let mut in_txn = doc! {"delete": "c", "autocommit": false};
+        defaults.apply(&mut in_txn);
+        assert!(!in_txn.contains_key("writeConcern"));
+
+        // The read default can be unset, the write default cannot
+        defaults.set(&doc! {"defaultReadConcern": {}}, now).unwrap();
+        assert!(defaults.read_concern.is_none());
+        assert!(
+            defaults
+                .set(&doc! {"defaultWriteConcern": {}}, now)
+                .is_err()
+        );
+    }
+}
@@ -0,0 +1,196 @@
+//! Where MongoDB databases and collections live in PostgreSQL.
+//!
+//! By default every database gets its own schema (`mdb_<db>`) holding one table per
+//! collection. The `single_schema` layout instead keeps every collection in one shared
+//! schema, naming each table `<prefix><db>.<coll>`; MongoDB database names cannot contain a
+//! `.`, so the first dot always separates the database from the collection. Names longer
+//! than PostgreSQL keeps are shortened with a hash of the whole name (see
+//! [`fit_identifier`]). Metadata stays in `mdb_meta` either way, so `listDatabases` and
+//! `listCollections` report logical names whatever the layout.
+
+use crate::config::Config;
+use crate::store::q_ident;
+use serde::Deserialize;
+use sha2::{Digest, Sha256};
+
+/// Schema (or table) prefix used when `schema_prefix` is not configured.
+pub const DEFAULT_SCHEMA_PREFIX: &str = "mdb_";
+
+/// Shared schema used by the `single_schema` layout when `shared_schema` is not configured.
+pub const DEFAULT_SHARED_SCHEMA: &str = "oxidedb";
+
+/// Longest identifier PostgreSQL keeps (`NAMEDATALEN - 1`); it silently truncates longer
+/// ones, which could leave two collections sharing a table.
+const MAX_IDENTIFIER_BYTES: usize = 63;
+
+/// Hex digits of the name's SHA-256 kept in a shortened identifier.
+const IDENTIFIER_HASH_DIGITS: usize = 12;
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum SchemaLayout {
+    /// One schema per database, one table per collection
+    #[default]
+    SchemaPerDatabase,
+    /// One shared schema, one `<prefix><db>.<coll>` table per collection
+    SingleSchema,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SchemaMapping {
+    layout: SchemaLayout,
+    prefix: String,
+    shared_schema: String,
+}
+
+impl Default for SchemaMapping {
+    fn default() -> Self {
+        Self::new(
+            SchemaLayout::SchemaPerDatabase,
+            DEFAULT_SCHEMA_PREFIX,
+            DEFAULT_SHARED_SCHEMA,
+        )
+    }
+}
+
+impl SchemaMapping {
+    pub fn new(layout: SchemaLayout, prefix: &str, shared_schema: &str) -> Self {
+        Self {
+            layout,
+            prefix: prefix.to_string(),
+            shared_schema: shared_schema.to_string(),
+        }
+    }
+
+    pub fn from_config(cfg: &Config) -> Self {
+        Self::new(
+            cfg.schema_layout.unwrap_or_default(),
+            cfg.schema_prefix
+                .as_deref()
+                .unwrap_or(DEFAULT_SCHEMA_PREFIX),
+            cfg.shared_schema
+                .as_deref()
+                .unwrap_or(DEFAULT_SHARED_SCHEMA),
+        )
+    }
+
+    pub fn layout(&self) -> SchemaLayout {
+        self.layout
+    }
+
+    /// Schema holding the collections of `db`.
+    pub fn schema(&self, db: &str) -> String {
+        match self.layout {
+            SchemaLayout::SchemaPerDatabase => format!("{}{}", self.prefix, db),
+            SchemaLayout::SingleSchema => self.shared_schema.clone(),
+        }
+    }
+
+    /// Table backing `db.coll`, unqualified.
+    pub fn table(&self, db: &str, coll: &str) -> String {
+        match self.layout {
+            SchemaLayout::SchemaPerDatabase => coll.to_string(),
+            SchemaLayout::SingleSchema => fit_identifier(format!("{}{}.{}", self.prefix, db, coll)),
+        }
+    }
+
+    /// Quoted `schema.table` backing `db.coll`.
+    pub fn qualified_table(&self, db: &str, coll: &str) -> String {
+        format!(
+            "{}.{}",
+            q_ident(&self.schema(db)),
+            q_ident(&self.table(db, coll))
+        )
+    }
+
+    /// PostgreSQL name of index `name` on `db.coll`. Index names are unique per schema, so
+    /// the shared layout qualifies them with the collection's full name.
+    pub fn index(&self, db: &str, coll: &str, name: &str) -> String {
+        match self.layout {
+            SchemaLayout::SchemaPerDatabase => name.to_string(),
+            SchemaLayout::SingleSchema => {
+                fit_identifier(format!("{}{}.{}.{}", self.prefix, db, coll, name))
+            }
+        }
+    }
+
+    /// Whether `db` owns its schema, so dropping the database drops the schema.
+    pub fn owns_schema(&self) -> bool {
+        self.layout == SchemaLayout::SchemaPerDatabase
+    }
+}
+
+/// `name` when PostgreSQL keeps it whole, otherwise as much of it as fits before `_` and
+/// the start of its SHA-256, so names sharing a long prefix still map to distinct
+/// identifiers.
+fn fit_identifier(name: String) -> String {
+    if name.len() <= MAX_IDENTIFIER_BYTES {
+        return name;
+    }
+    let hash: String = Sha256::digest(name.as_bytes())
+        .iter()
+        .map(|b| format!("{:02x}", b))
+        .take(IDENTIFIER_HASH_DIGITS / 2)
+        .collect();
+    let mut end = MAX_IDENTIFIER_BYTES - IDENTIFIER_HASH_DIGITS - 1;
+    while !name.is_char_boundary(end) {
+        end -= 1;
+    }
+    format!("{}_{}", &name[..end], hash)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn schema_per_database_keeps_existing_names() {
+        let m = SchemaMapping::default();
+        assert_eq!(m.schema("app"), "mdb_app");
+        assert_eq!(m.table("app", "users"), "users");
+        assert_eq!(m.qualified_table("app", "users"), "\"mdb_app\".\"users\"");
+        assert_eq!(m.index("app", "users", "age_1"), "age_1");
+        assert!(m.owns_schema());
+
+        let m = SchemaMapping::new(SchemaLayout::SchemaPerDatabase, "mongo_", "unused");
+        assert_eq!(m.schema("app"), "mongo_app");
+    }
+
+    #[test]
+    fn single_schema_prefixes_tables_and_indexes() {
+        let m = SchemaMapping::new(SchemaLayout::SingleSchema, "mdb_", "docs");
+        assert_eq!(m.schema("app"), "docs");
+        assert_eq!(m.schema("other"), "docs");
+        assert_eq!(m.table("app", "users.archive"), "mdb_app.users.archive");
+        assert_eq!(
+            m.qualified_table("app", "users"),
+            "\"docs\".\"mdb_app.users\""
+        );
+        assert_eq!(m.index("app", "users", "age_1"), "mdb_app.users.age_1");
+        assert!(!m.owns_schema());
+    }
+
+    #[test]
+    fn single_schema_shortens_names_past_the_identifier_limit() {
+        let m = SchemaMapping::new(SchemaLayout::SingleSchema, "mdb_", "docs");
+        let coll = format!("events.{}", "x".repeat(60));
+        let table = m.table("analytics", &coll);
+        assert_eq!(table.len(), MAX_IDENTIFIER_BYTES);
+        assert!(table.starts_with("mdb_analytics.events.xxx"));
+        // Same prefix past the limit, different names
+        let other = m.table("analytics", &format!("{}y", coll));
+        assert_eq!(other.len(), MAX_IDENTIFIER_BYTES);
+        assert_ne!(table, other);
+        assert_eq!(m.table("analytics", &coll), table);
+
+        let a = m.index("analytics", &coll, "created_at_1");
+        let b = m.index("analytics", &coll, "created_at_-1");
+        assert!(a.len() <= MAX_IDENTIFIER_BYTES && b.len() <= MAX_IDENTIFIER_BYTES);
+        assert_ne!(a, b);
+
+        // Multi-byte characters are never split
+        let wide = m.table("app", &"é".repeat(40));
+        assert!(wide.len() <= MAX_IDENTIFIER_BYTES);
+        assert!(wide.is_char_boundary(wide.len() - IDENTIFIER_HASH_DIGITS - 1));
+    }
+}
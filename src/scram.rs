@@ -1,4 +1,5 @@
-// SCRAM-SHA-256 authentication for MongoDB shadow upstream
+// SCRAM-SHA-256 authentication: the client side for the MongoDB shadow upstream, and the
+// server side clients authenticate to OxideDB with
 // Implements RFC 5802 (SCRAM) with SHA-256
 
 use anyhow::{Context, Result, anyhow};
@@ -14,8 +15,12 @@ use tokio::io::{AsyncReadExt, AsyncWriteExt};
 use tokio::net::TcpStream;
 use tokio::time::{Duration, timeout};
 
-const SCRAM_MECHANISM: &str = "SCRAM-SHA-256";
+pub const SCRAM_MECHANISM: &str = "SCRAM-SHA-256";
 const CLIENT_NONCE_LEN: usize = 24;
+/// PBKDF2 iterations for new credentials (MongoDB's `scramSHA256IterationCount` default)
+pub const SERVER_ITERATION_COUNT: u32 = 15000;
+/// Salt length for new credentials, the digest length less 4 bytes as MongoDB uses
+const SALT_LEN: usize = 28;
 
 /// SCRAM-SHA-256 authentication state
 pub struct ScramAuth {
@@ -237,6 +242,178 @@ impl ScramAuth {
     }
 }
 
+/// The SCRAM-SHA-256 credentials stored for a user: enough to check a client's proof and
+/// prove the server knows the password, without the password itself.
+#[derive(Debug, Clone, PartialEq)]
+pub struct ScramCredentials {
+    pub iteration_count: u32,
+    pub salt: Vec<u8>,
+    pub stored_key: Vec<u8>,
+    pub server_key: Vec<u8>,
+}
+
+impl ScramCredentials {
+    /// Credentials for `password` with a fresh random salt. The password is used as given,
+    /// without SASLprep, which leaves ASCII passwords unchanged.
+    pub fn derive(password: &str) -> Self {
+        let mut salt = vec![0u8; SALT_LEN];
+        rand::thread_rng().fill_bytes(&mut salt);
+        Self::derive_with(password, salt, SERVER_ITERATION_COUNT)
+    }
+
+    pub fn derive_with(password: &str, salt: Vec<u8>, iteration_count: u32) -> Self {
+        let salted_password = pbkdf2_hmac_sha256(password, &salt, iteration_count);
+        let client_key = hmac_sha256(&salted_password, b"Client Key");
+        Self {
+            iteration_count,
+            salt,
+            stored_key: sha256(&client_key),
+            server_key: hmac_sha256(&salted_password, b"Server Key"),
+        }
+    }
+
+    /// Credentials no password matches, so a conversation for a user that does not exist
+    /// fails the same way as one with a wrong password.
+    pub fn unknown_user() -> Self {
+        let mut salt = vec![0u8; SALT_LEN];
+        rand::thread_rng().fill_bytes(&mut salt);
+        Self {
+            iteration_count: SERVER_ITERATION_COUNT,
+            salt,
+            stored_key: Vec::new(),
+            server_key: Vec::new(),
+        }
+    }
+
+    /// The `credentials["SCRAM-SHA-256"]` document of a `system.users` entry.
+    pub fn to_document(&self) -> Document {
+        doc! {
+            "iterationCount": self.iteration_count as i32,
+            "salt": BASE64.encode(&self.salt),
+            "storedKey": BASE64.encode(&self.stored_key),
+            "serverKey": BASE64.encode(&self.server_key),
+        }
+    }
+
+    pub fn from_document(doc: &Document) -> Option<Self> {
+        let bytes = |key: &str| BASE64.decode(doc.get_str(key).ok()?).ok();
+        Some(Self {
+            iteration_count: u32::try_from(doc.get_i32("iterationCount").ok()?).ok()?,
+            salt: bytes("salt")?,
+            stored_key: bytes("storedKey")?,
+            server_key: bytes("serverKey")?,
+        })
+    }
+}
+
+/// A client-first-message, as received by `saslStart`.
+#[derive(Debug, Clone)]
+pub struct ClientFirst {
+    /// The user the client authenticates as
+    pub username: String,
+    bare: String,
+    nonce: String,
+}
+
+/// Parse a client-first-message. The GS2 header (`n,,`) is optional, since the shadow
+/// client above sends the bare message.
+pub fn parse_client_first(message: &str) -> Result<ClientFirst> {
+    let bare = if message.starts_with("n,") || message.starts_with("y,") {
+        message.splitn(3, ',').nth(2).unwrap_or("")
+    } else if message.starts_with("p=") {
+        return Err(anyhow!("channel binding is not supported"));
+    } else {
+        message
+    };
+    let mut username = None;
+    let mut nonce = None;
+    for part in bare.split(',') {
+        if let Some(n) = part.strip_prefix("n=") {
+            username = Some(n.replace("=2C", ",").replace("=3D", "="));
+        } else if let Some(r) = part.strip_prefix("r=") {
+            nonce = Some(r.to_string());
+        }
+    }
+    match (username, nonce) {
+        (Some(username), Some(nonce)) if !username.is_empty() && !nonce.is_empty() => {
+            Ok(ClientFirst {
+                username,
+                bare: bare.to_string(),
+                nonce,
+            })
+        }
+        _ => Err(anyhow!("invalid client-first-message")),
+    }
+}
+
+/// The server side of one SCRAM-SHA-256 conversation, between `saslStart` and
+/// `saslContinue`.
+#[derive(Debug, Clone)]
+pub struct ScramServer {
+    client_first_bare: String,
+    server_first: String,
+    nonce: String,
+    credentials: ScramCredentials,
+}
+
+impl ScramServer {
+    /// Answer `client_first` for a user with `credentials`.
+    pub fn new(client_first: &ClientFirst, credentials: ScramCredentials) -> Self {
+        let nonce = format!("{}{}", client_first.nonce, generate_nonce());
+        let server_first = format!(
+            "r={},s={},i={}",
+            nonce,
+            BASE64.encode(&credentials.salt),
+            credentials.iteration_count
+        );
+        Self {
+            client_first_bare: client_first.bare.clone(),
+            server_first,
+            nonce,
+            credentials,
+        }
+    }
+
+    /// The server-first-message to send back.
+    pub fn server_first(&self) -> &str {
+        &self.server_first
+    }
+
+    /// Check the client-final-message's proof, returning the server-final-message that
+    /// proves the server knows the credentials too.
+    pub fn finish(&self, client_final: &str) -> Result<String> {
+        let (without_proof, proof) = client_final
+            .rsplit_once(",p=")
+            .ok_or_else(|| anyhow!("client-final-message has no proof"))?;
+        let nonce = without_proof
+            .split(',')
+            .find_map(|part| part.strip_prefix("r="))
+            .ok_or_else(|| anyhow!("client-final-message has no nonce"))?;
+        if nonce != self.nonce {
+            return Err(anyhow!("nonce mismatch"));
+        }
+        let proof = BASE64.decode(proof).context("invalid base64 proof")?;
+        let auth_message = format!(
+            "{},{},{}",
+            self.client_first_bare, self.server_first, without_proof
+        );
+        let client_signature = hmac_sha256(&self.credentials.stored_key, auth_message.as_bytes());
+        if proof.len() != client_signature.len() {
+            return Err(anyhow!("invalid proof"));
+        }
+        let client_key: Vec<u8> = proof
+            .iter()
+            .zip(client_signature.iter())
+            .map(|(a, b)| a ^ b)
+            .collect();
+        if sha256(&client_key) != self.credentials.stored_key {
+            return Err(anyhow!("invalid proof"));
+        }
+        let server_signature = hmac_sha256(&self.credentials.server_key, auth_message.as_bytes());
+        Ok(format!("v={}", BASE64.encode(server_signature)))
+    }
+}
+
 /// Generate a random nonce
 fn generate_nonce() -> String {
     let mut bytes = vec![0u8; CLIENT_NONCE_LEN];
@@ -334,6 +511,46 @@ mod tests {
         assert_eq!(client_first.len(), 9 + 32); // "n=user,r=" + nonce
     }
 
+    /// The shadow client authenticates against the server side with the right password
+    /// only.
+    fn converse(stored: &str, given: &str) -> Result<String> {
+        let credentials = ScramCredentials::derive_with(stored, b"0123456789abcdef".to_vec(), 4096);
+        let mut client = ScramAuth::new("ann".to_string(), given.to_string(), "app".to_string());
+        let client_first = parse_client_first(&format!("n,,{}", client.build_client_first()))?;
+        assert_eq!(client_first.username, "ann");
+        let server = ScramServer::new(&client_first, credentials);
+        client.parse_server_first(server.server_first())?;
+        let server_final = server.finish(&client.build_client_final()?)?;
+        client.verify_server_final(&server_final)?;
+        Ok(server_final)
+    }
+
+    #[test]
+    fn server_checks_client_proofs() {
+        assert!(converse("secret", "secret").unwrap().starts_with("v="));
+        assert!(converse("secret", "guess").is_err());
+
+        let credentials = ScramCredentials::derive("secret");
+        assert_eq!(credentials.salt.len(), SALT_LEN);
+        assert_eq!(
+            ScramCredentials::from_document(&credentials.to_document()),
+            Some(credentials)
+        );
+        let client_first = parse_client_first("n,,n=ann,r=abc").unwrap();
+        let server = ScramServer::new(&client_first, ScramCredentials::unknown_user());
+        let forged = format!("c=biws,r={},p={}", server.nonce, BASE64.encode([0u8; 32]));
+        assert!(server.finish(&forged).is_err());
+    }
+
+    #[test]
+    fn parses_client_first_messages() {
+        let first = parse_client_first("n,,n=a=2Cb=3Dc,r=nonce").unwrap();
+        assert_eq!(first.username, "a,b=c");
+        assert_eq!(first.bare, "n=a=2Cb=3Dc,r=nonce");
+        assert!(parse_client_first("n,,r=nonce").is_err());
+        assert!(parse_client_first("p=tls-unique,,n=a,r=x").is_err());
+    }
+
     #[test]
     fn test_parse_server_first() {
         let mut auth = ScramAuth::new("user".to_string(), "pass".to_string(), "admin".to_string());
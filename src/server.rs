@@ -1,14 +1,32 @@
+use crate::aggregation::stages::project::{
+    PositionalProjectionError, apply_positional, split_positional,
+};
+use crate::aggregation::stages::redact::InvalidRedactResult;
+use crate::aggregation::stages::replace_root::NewRootNotDocument;
 use crate::config::{Config, ShadowConfig};
 use crate::error::Result;
+use crate::error_codes::{
+    AUTHENTICATION_FAILED, BAD_VALUE, BSON_OBJECT_TOO_LARGE,
+    CANNOT_GROW_DOCUMENT_IN_CAPPED_NAMESPACE, COMMAND_NOT_FOUND, COMMAND_NOT_SUPPORTED,
+    DOCUMENT_VALIDATION_FAILURE, DUPLICATE_KEY, FAILED_TO_PARSE, INDEX_NOT_FOUND, INVALID_OPTIONS,
+    MAX_TIME_MS_EXPIRED, MECHANISM_UNAVAILABLE, MISSING_DB, NAMESPACE_EXISTS, NAMESPACE_NOT_FOUND,
+    OPERATION_FAILED, ROLE_NOT_FOUND, TYPE_MISMATCH, UNAUTHORIZED, USER_EXISTS, USER_NOT_FOUND,
+    WRITE_RATE_LIMITED, code_name, store_error_code,
+};
+use crate::ip_filter::IpFilter;
 use crate::protocol::{
     MessageHeader, OP_MSG, OP_QUERY, decode_op_query, encode_op_msg, encode_op_reply,
 };
+use crate::rw_concern::RwConcernDefaults;
 use crate::session::{
     ERROR_ILLEGAL_OPERATION, ERROR_NO_SUCH_TRANSACTION, ERROR_TRANSACTION_EXPIRED, SessionManager,
 };
 use crate::shadow::{ShadowSession, compare_docs};
-use crate::store::PgStore;
+use crate::store::{DocCursor, ExplainVerbosity, PgStore, Validator};
+use crate::users::{Action, ConnectionAuth, USERS_COLLECTION, USERS_DB};
+use crate::write_limits::WriteLimiter;
 use bson::{Bson, Document, doc};
+use tracing::Instrument;
 
 use std::sync::atomic::{AtomicI32, AtomicU32, AtomicU64, Ordering};
 use std::time::{Duration, Instant};
@@ -27,6 +45,47 @@ struct BucketSpec {
 }
 
 static REQ_ID: AtomicI32 = AtomicI32::new(1);
+static CONN_SEQ: AtomicU64 = AtomicU64::new(1);
+
+tokio::task_local! {
+    /// Client connection serving the current command.
+    static CONNECTION_ID: u64;
+    /// Logical session (`lsid`) the current command runs under, if any.
+    static SESSION_ID: Option<Uuid>;
+    /// Application name the connection's client reported in its handshake, if any.
+    static APP_NAME: Option<String>;
+    /// Authentication state of the connection serving the current command.
+    static CONNECTION_AUTH: Arc<std::sync::Mutex<ConnectionAuth>>;
+}
+
+/// How long a client connection may stay open, from `connection_idle_timeout_secs` and
+/// `connection_max_lifetime_secs`. Separate from the PostgreSQL pool's own limits.
+#[derive(Clone, Copy, Debug, Default, PartialEq)]
+struct ConnectionLimits {
+    idle_timeout: Option<Duration>,
+    max_lifetime: Option<Duration>,
+}
+
+impl ConnectionLimits {
+    fn from_config(cfg: &Config) -> Self {
+        let secs = |v: Option<u64>| v.filter(|s| *s > 0).map(Duration::from_secs);
+        Self {
+            idle_timeout: secs(cfg.connection_idle_timeout_secs),
+            max_lifetime: secs(cfg.connection_max_lifetime_secs),
+        }
+    }
+
+    /// When a connection opened at `opened` and waiting for a request since `now` must be
+    /// closed, and which limit closes it.
+    fn deadline(&self, opened: Instant, now: Instant) -> Option<(Instant, &'static str)> {
+        let idle = self.idle_timeout.map(|d| (now + d, "idle timeout"));
+        let lifetime = self.max_lifetime.map(|d| (opened + d, "max lifetime"));
+        match (idle, lifetime) {
+            (Some(i), Some(l)) => Some(if l.0 <= i.0 { l } else { i }),
+            (i, l) => i.or(l),
+        }
+    }
+}
 
 use std::collections::HashMap;
 use std::sync::Arc;
@@ -37,12 +96,65 @@ struct CursorEntry {
     docs: Vec<Document>,
     pos: usize,
     last_access: Instant,
+    /// Client connection that opened the cursor
+    conn: Option<u64>,
+    /// Logical session that opened the cursor
+    lsid: Option<Uuid>,
+    tail: Option<TailState>,
+    /// Open PostgreSQL cursor that `getMore` fetches from instead of `docs`
+    held: Option<DocCursor>,
+}
+
+/// Position of a tailable cursor: each `getMore` re-queries for documents after `last_id`.
+#[derive(Clone)]
+struct TailState {
+    db: String,
+    coll: String,
+    filter: Option<Document>,
+    last_id: Option<Vec<u8>>,
+    await_data: bool,
+}
+
+/// How long an await-data `getMore` blocks for new documents when it has no `maxTimeMS`.
+const DEFAULT_AWAIT_DATA_TIMEOUT: Duration = Duration::from_secs(1);
+/// Interval at which a waiting await-data `getMore` re-checks for new documents.
+const AWAIT_DATA_POLL_INTERVAL: Duration = Duration::from_millis(50);
+
+/// An in-progress command, reported by `currentOp`.
+struct CurrentOp {
+    ns: String,
+    command: Document,
+    comment: Option<Bson>,
+    app_name: Option<String>,
+    started: Instant,
+}
+
+static OP_SEQ: AtomicU64 = AtomicU64::new(1);
+
+/// Logical clock stamping `operationTime` and `$clusterTime` on every reply.
+static CLUSTER_CLOCK: crate::cluster_time::LogicalClock = crate::cluster_time::LogicalClock::new();
+
+/// Removes an operation from `AppState::current_ops` once its command finishes (or is dropped).
+struct CurrentOpGuard<'a> {
+    state: &'a AppState,
+    opid: u64,
+}
+
+impl Drop for CurrentOpGuard<'_> {
+    fn drop(&mut self) {
+        if let Ok(mut ops) = self.state.current_ops.lock() {
+            ops.remove(&self.opid);
+        }
+    }
 }
 
 pub struct AppState {
     pub store: Option<PgStore>,
+    /// Read replica from `postgres_read_url`, serving secondary read preferences
+    pub read_store: Option<PgStore>,
     pub started_at: Instant,
     cursors: Mutex<HashMap<i64, CursorEntry>>,
+    current_ops: std::sync::Mutex<HashMap<u64, CurrentOp>>,
     pub shadow: Option<std::sync::Arc<ShadowConfig>>,
     // Shadow metrics
     pub shadow_attempts: std::sync::atomic::AtomicU64,
@@ -60,6 +172,40 @@ pub struct AppState {
     pub delete_count: AtomicU64,
     pub error_count: AtomicU64,
     pub active_connections: AtomicU32,
+    /// Per-command counters and latency histograms for the `/metrics` endpoint
+    pub command_metrics: crate::metrics::CommandMetrics,
+    /// Bound address of the `/metrics` HTTP endpoint, when enabled
+    pub metrics_addr: Option<std::net::SocketAddr>,
+    /// Bound address of the `/healthz` and `/readyz` HTTP endpoint, when enabled
+    pub health_addr: Option<std::net::SocketAddr>,
+    /// Commands slower than this are logged under `oxidedb::slow` (and profiled at level 1);
+    /// adjustable at runtime through the `profile` command's `slowms`
+    pub slow_op_threshold_ms: AtomicU64,
+    /// Database profiler level per database (0 off, 1 slow ops, 2 all ops)
+    profiling_levels: std::sync::Mutex<HashMap<String, i32>>,
+    /// Cluster-wide read/write concern defaults (`getDefaultRWConcern`)
+    rw_concern_defaults: std::sync::Mutex<RwConcernDefaults>,
+    /// Largest accepted document, in bytes
+    pub max_bson_object_size: usize,
+    /// Whether `$where` predicates are evaluated (`javascript_enabled`)
+    pub javascript_enabled: bool,
+    /// Whether inserts decode Extended JSON type wrappers (`extended_json_import`)
+    pub extended_json_import: bool,
+    /// Whether commands require an authenticated user whose roles allow them
+    /// (`authorization_enabled`)
+    pub authorization_enabled: bool,
+    /// Whether connections pick up changes to their user's roles (`refresh_user_roles`)
+    pub refresh_user_roles: bool,
+    /// Bumped by every change to existing users, so connections can tell their roles
+    /// may be stale
+    users_generation: AtomicU64,
+    /// Write rate limits per database or collection (`write_limits`), replaceable at
+    /// runtime through `oxidedbSetWriteLimits`
+    pub write_limiter: WriteLimiter,
+    /// Bytes a blocking aggregation stage may buffer without `allowDiskUse`
+    pub aggregation_memory_limit_bytes: usize,
+    /// Rows a `find` without a limit may be estimated to read (`max_scan_rows`)
+    pub max_scan_rows: Option<u64>,
 }
 
 impl AppState {
@@ -95,6 +241,16 @@ impl AppState {
         self.error_count.fetch_add(1, Ordering::Relaxed);
     }
 
+    /// Record a completed command: totals, per-command latency and any error codes in the reply
+    pub fn record_command(&self, command: &str, db: &str, duration: Duration, reply: &Document) {
+        self.record_request(duration);
+        let codes = crate::metrics::reply_error_codes(reply);
+        if !codes.is_empty() {
+            self.record_error();
+        }
+        self.command_metrics.record(command, db, duration, &codes);
+    }
+
     /// Increment active connection count
     pub fn increment_connections(&self) {
         self.active_connections.fetch_add(1, Ordering::Relaxed);
@@ -122,20 +278,63 @@ impl AppState {
     }
 }
 
+/// Store for `postgres_read_url`, laid out like the primary. The replica is read-only, so
+/// it is never bootstrapped; a bad DSN is logged and reads stay on the primary.
+async fn connect_read_store(cfg: &Config) -> Option<PgStore> {
+    let url = cfg.postgres_read_url.as_ref()?;
+    match PgStore::connect(url).await {
+        Ok(pg) => Some(
+            pg.with_statement_cache_size(
+                cfg.statement_cache_size
+                    .unwrap_or(crate::stmt_cache::DEFAULT_STATEMENT_CACHE_SIZE),
+            )
+            .with_schema_mapping(crate::schema_map::SchemaMapping::from_config(cfg)),
+        ),
+        Err(e) => {
+            tracing::error!(error = %format!("{e:?}"), "failed to connect to read replica; reading from primary");
+            None
+        }
+    }
+}
+
 pub async fn run(cfg: Config) -> Result<()> {
+    let ip_filter = IpFilter::from_config(&cfg)?;
+    let write_limits = crate::write_limits::limits_from_config(&cfg)?;
     let listener = TcpListener::bind(&cfg.listen_addr).await?;
     tracing::info!(listen_addr = %cfg.listen_addr, "oxidedb listening");
+    let metrics_listener = bind_metrics_listener(&cfg).await?;
+    let metrics_addr = match metrics_listener {
+        Some(ref l) => Some(l.local_addr()?),
+        None => None,
+    };
+    let health_listener = bind_health_listener(&cfg).await?;
+    let health_addr = match health_listener {
+        Some(ref l) => Some(l.local_addr()?),
+        None => None,
+    };
 
     let state = if let Some(url) = cfg.postgres_url.clone() {
         match PgStore::connect(&url).await {
             Ok(pg) => {
+                let pg = pg
+                    .with_statement_cache_size(
+                        cfg.statement_cache_size
+                            .unwrap_or(crate::stmt_cache::DEFAULT_STATEMENT_CACHE_SIZE),
+                    )
+                    .with_schema_mapping(crate::schema_map::SchemaMapping::from_config(&cfg))
+                    .with_copy_insert_threshold(
+                        cfg.copy_insert_threshold
+                            .unwrap_or(crate::store::DEFAULT_COPY_INSERT_THRESHOLD),
+                    );
                 if let Err(e) = pg.bootstrap().await {
                     tracing::error!(error = %format!("{e:?}"), "failed to bootstrap metadata");
                 }
                 AppState {
                     store: Some(pg),
+                    read_store: connect_read_store(&cfg).await,
                     started_at: Instant::now(),
                     cursors: Mutex::new(HashMap::new()),
+                    current_ops: std::sync::Mutex::new(HashMap::new()),
                     shadow: cfg.shadow.as_ref().map(|s| std::sync::Arc::new(s.clone())),
                     shadow_attempts: std::sync::atomic::AtomicU64::new(0),
                     shadow_matches: std::sync::atomic::AtomicU64::new(0),
@@ -150,14 +349,38 @@ pub async fn run(cfg: Config) -> Result<()> {
                     delete_count: AtomicU64::new(0),
                     error_count: AtomicU64::new(0),
                     active_connections: AtomicU32::new(0),
+                    command_metrics: crate::metrics::CommandMetrics::default(),
+                    metrics_addr,
+                    health_addr,
+                    slow_op_threshold_ms: AtomicU64::new(
+                        cfg.slow_op_threshold_ms
+                            .unwrap_or(crate::config::DEFAULT_SLOW_OP_THRESHOLD_MS),
+                    ),
+                    profiling_levels: std::sync::Mutex::new(HashMap::new()),
+                    rw_concern_defaults: std::sync::Mutex::new(RwConcernDefaults::default()),
+                    max_bson_object_size: cfg
+                        .max_bson_object_size
+                        .unwrap_or(crate::config::DEFAULT_MAX_BSON_OBJECT_SIZE),
+                    javascript_enabled: cfg.javascript_enabled.unwrap_or(true),
+                    extended_json_import: cfg.extended_json_import.unwrap_or(false),
+                    authorization_enabled: cfg.authorization_enabled.unwrap_or(false),
+                    refresh_user_roles: cfg.refresh_user_roles.unwrap_or(false),
+                    write_limiter: WriteLimiter::new(write_limits.clone()),
+                    users_generation: AtomicU64::new(0),
+                    aggregation_memory_limit_bytes: cfg.aggregation_memory_limit_bytes.unwrap_or(
+                        crate::aggregation::memory::DEFAULT_AGGREGATION_MEMORY_LIMIT_BYTES,
+                    ),
+                    max_scan_rows: cfg.max_scan_rows.filter(|n| *n > 0),
                 }
             }
             Err(e) => {
                 tracing::error!(error = %format!("{e:?}"), "failed to connect to postgres; continuing without store");
                 AppState {
                     store: None,
+                    read_store: None,
                     started_at: Instant::now(),
                     cursors: Mutex::new(HashMap::new()),
+                    current_ops: std::sync::Mutex::new(HashMap::new()),
                     shadow: cfg.shadow.as_ref().map(|s| std::sync::Arc::new(s.clone())),
                     shadow_attempts: std::sync::atomic::AtomicU64::new(0),
                     shadow_matches: std::sync::atomic::AtomicU64::new(0),
@@ -172,14 +395,38 @@ pub async fn run(cfg: Config) -> Result<()> {
                     delete_count: AtomicU64::new(0),
                     error_count: AtomicU64::new(0),
                     active_connections: AtomicU32::new(0),
+                    command_metrics: crate::metrics::CommandMetrics::default(),
+                    metrics_addr,
+                    health_addr,
+                    slow_op_threshold_ms: AtomicU64::new(
+                        cfg.slow_op_threshold_ms
+                            .unwrap_or(crate::config::DEFAULT_SLOW_OP_THRESHOLD_MS),
+                    ),
+                    profiling_levels: std::sync::Mutex::new(HashMap::new()),
+                    rw_concern_defaults: std::sync::Mutex::new(RwConcernDefaults::default()),
+                    max_bson_object_size: cfg
+                        .max_bson_object_size
+                        .unwrap_or(crate::config::DEFAULT_MAX_BSON_OBJECT_SIZE),
+                    javascript_enabled: cfg.javascript_enabled.unwrap_or(true),
+                    extended_json_import: cfg.extended_json_import.unwrap_or(false),
+                    authorization_enabled: cfg.authorization_enabled.unwrap_or(false),
+                    refresh_user_roles: cfg.refresh_user_roles.unwrap_or(false),
+                    write_limiter: WriteLimiter::new(write_limits.clone()),
+                    users_generation: AtomicU64::new(0),
+                    aggregation_memory_limit_bytes: cfg.aggregation_memory_limit_bytes.unwrap_or(
+                        crate::aggregation::memory::DEFAULT_AGGREGATION_MEMORY_LIMIT_BYTES,
+                    ),
+                    max_scan_rows: cfg.max_scan_rows.filter(|n| *n > 0),
                 }
             }
         }
     } else {
         AppState {
             store: None,
+            read_store: None,
             started_at: Instant::now(),
             cursors: Mutex::new(HashMap::new()),
+            current_ops: std::sync::Mutex::new(HashMap::new()),
             shadow: cfg.shadow.as_ref().map(|s| std::sync::Arc::new(s.clone())),
             shadow_attempts: std::sync::atomic::AtomicU64::new(0),
             shadow_matches: std::sync::atomic::AtomicU64::new(0),
@@ -194,6 +441,28 @@ pub async fn run(cfg: Config) -> Result<()> {
             delete_count: AtomicU64::new(0),
             error_count: AtomicU64::new(0),
             active_connections: AtomicU32::new(0),
+            command_metrics: crate::metrics::CommandMetrics::default(),
+            metrics_addr,
+            health_addr,
+            slow_op_threshold_ms: AtomicU64::new(
+                cfg.slow_op_threshold_ms
+                    .unwrap_or(crate::config::DEFAULT_SLOW_OP_THRESHOLD_MS),
+            ),
+            profiling_levels: std::sync::Mutex::new(HashMap::new()),
+            rw_concern_defaults: std::sync::Mutex::new(RwConcernDefaults::default()),
+            max_bson_object_size: cfg
+                .max_bson_object_size
+                .unwrap_or(crate::config::DEFAULT_MAX_BSON_OBJECT_SIZE),
+            javascript_enabled: cfg.javascript_enabled.unwrap_or(true),
+            extended_json_import: cfg.extended_json_import.unwrap_or(false),
+            authorization_enabled: cfg.authorization_enabled.unwrap_or(false),
+            refresh_user_roles: cfg.refresh_user_roles.unwrap_or(false),
+            write_limiter: WriteLimiter::new(write_limits.clone()),
+            users_generation: AtomicU64::new(0),
+            aggregation_memory_limit_bytes: cfg
+                .aggregation_memory_limit_bytes
+                .unwrap_or(crate::aggregation::memory::DEFAULT_AGGREGATION_MEMORY_LIMIT_BYTES),
+            max_scan_rows: cfg.max_scan_rows.filter(|n| *n > 0),
         }
     };
     let state = Arc::new(state);
@@ -249,10 +518,7 @@ pub async fn run(cfg: Config) -> Result<()> {
         loop {
             tokio::select! {
                 _ = tokio::time::sleep(cleanup_interval) => {
-                    let removed = session_cleanup_state
-                        .session_manager
-                        .cleanup_expired_sessions()
-                        .await;
+                    let removed = reap_expired_sessions(&session_cleanup_state).await;
                     if removed > 0 {
                         tracing::debug!(removed_sessions = removed, "cleaned up expired sessions");
                     }
@@ -265,7 +531,57 @@ pub async fn run(cfg: Config) -> Result<()> {
         }
     });
 
+    // Spawn the TTL monitor with shutdown support
+    let ttl_sleep = Duration::from_secs(
+        cfg.ttl_monitor_sleep_secs
+            .unwrap_or(crate::config::DEFAULT_TTL_MONITOR_SLEEP_SECS),
+    );
+    let ttl_monitor_state = state.clone();
+    let mut ttl_monitor_shutdown = shutdown_tx.subscribe();
+    tokio::spawn(async move {
+        loop {
+            tokio::select! {
+                _ = tokio::time::sleep(ttl_sleep) => {
+                    delete_expired_documents(&ttl_monitor_state).await;
+                }
+                _ = ttl_monitor_shutdown.recv() => {
+                    tracing::debug!("TTL monitor shutting down");
+                    break;
+                }
+            }
+        }
+    });
+
+    // Prometheus metrics endpoint with shutdown support
+    if let Some(metrics_listener) = metrics_listener {
+        let metrics_state = state.clone();
+        let mut metrics_shutdown = shutdown_tx.subscribe();
+        tokio::spawn(async move {
+            tokio::select! {
+                _ = serve_metrics(metrics_listener, metrics_state) => {}
+                _ = metrics_shutdown.recv() => {
+                    tracing::debug!("metrics endpoint shutting down");
+                }
+            }
+        });
+    }
+
+    // Health probes with shutdown support
+    if let Some(health_listener) = health_listener {
+        let health_state = state.clone();
+        let mut health_shutdown = shutdown_tx.subscribe();
+        tokio::spawn(async move {
+            tokio::select! {
+                _ = serve_health(health_listener, health_state) => {}
+                _ = health_shutdown.recv() => {
+                    tracing::debug!("health endpoint shutting down");
+                }
+            }
+        });
+    }
+
     // Accept loop with shutdown support
+    let limits = ConnectionLimits::from_config(&cfg);
     let mut connection_handles: Vec<tokio::task::JoinHandle<()>> = Vec::new();
 
     loop {
@@ -278,13 +594,19 @@ pub async fn run(cfg: Config) -> Result<()> {
                         continue;
                     }
                 };
+                if let Some(reason) = ip_filter.rejection(addr.ip()) {
+                    tracing::warn!(%addr, reason, "rejected connection");
+                    continue;
+                }
                 tracing::debug!(%addr, "accepted connection");
                 state.increment_connections();
                 let state = state.clone();
                 let mut shutdown_rx_conn = shutdown_tx.subscribe();
+                let conn_id = CONN_SEQ.fetch_add(1, Ordering::Relaxed);
+                let conn_span = tracing::info_span!("conn", conn_id, app_name = tracing::field::Empty);
                 let handle = tokio::spawn(async move {
                     tokio::select! {
-                        res = handle_connection(state.clone(), socket) => {
+                        res = handle_connection(state.clone(), socket, conn_id, limits).instrument(conn_span) => {
                             if let Err(e) = res {
                                 tracing::debug!(error = %format!("{e:?}"), "connection closed with error");
                             }
@@ -325,21 +647,45 @@ pub async fn spawn_with_shutdown(
 )> {
     use tokio::sync::watch;
 
+    let ip_filter = IpFilter::from_config(&cfg)?;
+    let write_limits = crate::write_limits::limits_from_config(&cfg)?;
     // Allow ephemeral port usage in tests (e.g., 127.0.0.1:0)
     let listener = TcpListener::bind(&cfg.listen_addr).await?;
     let local_addr = listener.local_addr()?;
+    let metrics_listener = bind_metrics_listener(&cfg).await?;
+    let metrics_addr = match metrics_listener {
+        Some(ref l) => Some(l.local_addr()?),
+        None => None,
+    };
+    let health_listener = bind_health_listener(&cfg).await?;
+    let health_addr = match health_listener {
+        Some(ref l) => Some(l.local_addr()?),
+        None => None,
+    };
 
     // Build state (mirrors run())
     let state = if let Some(url) = cfg.postgres_url.clone() {
         match PgStore::connect(&url).await {
             Ok(pg) => {
+                let pg = pg
+                    .with_statement_cache_size(
+                        cfg.statement_cache_size
+                            .unwrap_or(crate::stmt_cache::DEFAULT_STATEMENT_CACHE_SIZE),
+                    )
+                    .with_schema_mapping(crate::schema_map::SchemaMapping::from_config(&cfg))
+                    .with_copy_insert_threshold(
+                        cfg.copy_insert_threshold
+                            .unwrap_or(crate::store::DEFAULT_COPY_INSERT_THRESHOLD),
+                    );
                 if let Err(e) = pg.bootstrap().await {
                     tracing::error!(error = %format!("{e:?}"), "failed to bootstrap metadata");
                 }
                 AppState {
                     store: Some(pg),
+                    read_store: connect_read_store(&cfg).await,
                     started_at: Instant::now(),
                     cursors: Mutex::new(HashMap::new()),
+                    current_ops: std::sync::Mutex::new(HashMap::new()),
                     shadow: cfg.shadow.as_ref().map(|s| std::sync::Arc::new(s.clone())),
                     shadow_attempts: std::sync::atomic::AtomicU64::new(0),
                     shadow_matches: std::sync::atomic::AtomicU64::new(0),
@@ -354,14 +700,38 @@ pub async fn spawn_with_shutdown(
                     delete_count: AtomicU64::new(0),
                     error_count: AtomicU64::new(0),
                     active_connections: AtomicU32::new(0),
+                    command_metrics: crate::metrics::CommandMetrics::default(),
+                    metrics_addr,
+                    health_addr,
+                    slow_op_threshold_ms: AtomicU64::new(
+                        cfg.slow_op_threshold_ms
+                            .unwrap_or(crate::config::DEFAULT_SLOW_OP_THRESHOLD_MS),
+                    ),
+                    profiling_levels: std::sync::Mutex::new(HashMap::new()),
+                    rw_concern_defaults: std::sync::Mutex::new(RwConcernDefaults::default()),
+                    max_bson_object_size: cfg
+                        .max_bson_object_size
+                        .unwrap_or(crate::config::DEFAULT_MAX_BSON_OBJECT_SIZE),
+                    javascript_enabled: cfg.javascript_enabled.unwrap_or(true),
+                    extended_json_import: cfg.extended_json_import.unwrap_or(false),
+                    authorization_enabled: cfg.authorization_enabled.unwrap_or(false),
+                    refresh_user_roles: cfg.refresh_user_roles.unwrap_or(false),
+                    write_limiter: WriteLimiter::new(write_limits.clone()),
+                    users_generation: AtomicU64::new(0),
+                    aggregation_memory_limit_bytes: cfg.aggregation_memory_limit_bytes.unwrap_or(
+                        crate::aggregation::memory::DEFAULT_AGGREGATION_MEMORY_LIMIT_BYTES,
+                    ),
+                    max_scan_rows: cfg.max_scan_rows.filter(|n| *n > 0),
                 }
             }
             Err(e) => {
                 tracing::error!(error = %format!("{e:?}"), "failed to connect to postgres; continuing without store");
                 AppState {
                     store: None,
+                    read_store: None,
                     started_at: Instant::now(),
                     cursors: Mutex::new(HashMap::new()),
+                    current_ops: std::sync::Mutex::new(HashMap::new()),
                     shadow: cfg.shadow.as_ref().map(|s| std::sync::Arc::new(s.clone())),
                     shadow_attempts: std::sync::atomic::AtomicU64::new(0),
                     shadow_matches: std::sync::atomic::AtomicU64::new(0),
@@ -376,14 +746,38 @@ pub async fn spawn_with_shutdown(
                     delete_count: AtomicU64::new(0),
                     error_count: AtomicU64::new(0),
                     active_connections: AtomicU32::new(0),
+                    command_metrics: crate::metrics::CommandMetrics::default(),
+                    metrics_addr,
+                    health_addr,
+                    slow_op_threshold_ms: AtomicU64::new(
+                        cfg.slow_op_threshold_ms
+                            .unwrap_or(crate::config::DEFAULT_SLOW_OP_THRESHOLD_MS),
+                    ),
+                    profiling_levels: std::sync::Mutex::new(HashMap::new()),
+                    rw_concern_defaults: std::sync::Mutex::new(RwConcernDefaults::default()),
+                    max_bson_object_size: cfg
+                        .max_bson_object_size
+                        .unwrap_or(crate::config::DEFAULT_MAX_BSON_OBJECT_SIZE),
+                    javascript_enabled: cfg.javascript_enabled.unwrap_or(true),
+                    extended_json_import: cfg.extended_json_import.unwrap_or(false),
+                    authorization_enabled: cfg.authorization_enabled.unwrap_or(false),
+                    refresh_user_roles: cfg.refresh_user_roles.unwrap_or(false),
+                    write_limiter: WriteLimiter::new(write_limits.clone()),
+                    users_generation: AtomicU64::new(0),
+                    aggregation_memory_limit_bytes: cfg.aggregation_memory_limit_bytes.unwrap_or(
+                        crate::aggregation::memory::DEFAULT_AGGREGATION_MEMORY_LIMIT_BYTES,
+                    ),
+                    max_scan_rows: cfg.max_scan_rows.filter(|n| *n > 0),
                 }
             }
         }
     } else {
         AppState {
             store: None,
+            read_store: None,
             started_at: Instant::now(),
             cursors: Mutex::new(HashMap::new()),
+            current_ops: std::sync::Mutex::new(HashMap::new()),
             shadow: cfg.shadow.as_ref().map(|s| std::sync::Arc::new(s.clone())),
             shadow_attempts: std::sync::atomic::AtomicU64::new(0),
             shadow_matches: std::sync::atomic::AtomicU64::new(0),
@@ -398,6 +792,28 @@ pub async fn spawn_with_shutdown(
             delete_count: AtomicU64::new(0),
             error_count: AtomicU64::new(0),
             active_connections: AtomicU32::new(0),
+            command_metrics: crate::metrics::CommandMetrics::default(),
+            metrics_addr,
+            health_addr,
+            slow_op_threshold_ms: AtomicU64::new(
+                cfg.slow_op_threshold_ms
+                    .unwrap_or(crate::config::DEFAULT_SLOW_OP_THRESHOLD_MS),
+            ),
+            profiling_levels: std::sync::Mutex::new(HashMap::new()),
+            rw_concern_defaults: std::sync::Mutex::new(RwConcernDefaults::default()),
+            max_bson_object_size: cfg
+                .max_bson_object_size
+                .unwrap_or(crate::config::DEFAULT_MAX_BSON_OBJECT_SIZE),
+            javascript_enabled: cfg.javascript_enabled.unwrap_or(true),
+            extended_json_import: cfg.extended_json_import.unwrap_or(false),
+            authorization_enabled: cfg.authorization_enabled.unwrap_or(false),
+            refresh_user_roles: cfg.refresh_user_roles.unwrap_or(false),
+            write_limiter: WriteLimiter::new(write_limits.clone()),
+            users_generation: AtomicU64::new(0),
+            aggregation_memory_limit_bytes: cfg
+                .aggregation_memory_limit_bytes
+                .unwrap_or(crate::aggregation::memory::DEFAULT_AGGREGATION_MEMORY_LIMIT_BYTES),
+            max_scan_rows: cfg.max_scan_rows.filter(|n| *n > 0),
         }
     };
     let state = std::sync::Arc::new(state);
@@ -429,7 +845,7 @@ pub async fn spawn_with_shutdown(
         loop {
             tokio::select! {
                 _ = tokio::time::sleep(cleanup_interval) => {
-                    let removed = session_cleanup_state.session_manager.cleanup_expired_sessions().await;
+                    let removed = reap_expired_sessions(&session_cleanup_state).await;
                     if removed > 0 {
                         tracing::debug!(removed_sessions = removed, "cleaned up expired sessions");
                     }
@@ -441,8 +857,65 @@ pub async fn spawn_with_shutdown(
         }
     });
 
+    // TTL monitor with shutdown
+    let ttl_sleep = Duration::from_secs(
+        cfg.ttl_monitor_sleep_secs
+            .unwrap_or(crate::config::DEFAULT_TTL_MONITOR_SLEEP_SECS),
+    );
+    let ttl_monitor_state = state.clone();
+    let mut ttl_monitor_shutdown = shutdown_rx.clone();
+    tokio::spawn(async move {
+        loop {
+            tokio::select! {
+                _ = tokio::time::sleep(ttl_sleep) => {
+                    delete_expired_documents(&ttl_monitor_state).await;
+                }
+                _ = ttl_monitor_shutdown.changed() => {
+                    if *ttl_monitor_shutdown.borrow() { break; }
+                }
+            }
+        }
+    });
+
+    // Prometheus metrics endpoint with shutdown
+    if let Some(metrics_listener) = metrics_listener {
+        let metrics_state = state.clone();
+        let mut metrics_shutdown = shutdown_rx.clone();
+        tokio::spawn(async move {
+            let serve = serve_metrics(metrics_listener, metrics_state);
+            tokio::pin!(serve);
+            loop {
+                tokio::select! {
+                    _ = &mut serve => break,
+                    _ = metrics_shutdown.changed() => {
+                        if *metrics_shutdown.borrow() { break; }
+                    }
+                }
+            }
+        });
+    }
+
+    // Health probes with shutdown
+    if let Some(health_listener) = health_listener {
+        let health_state = state.clone();
+        let mut health_shutdown = shutdown_rx.clone();
+        tokio::spawn(async move {
+            let serve = serve_health(health_listener, health_state);
+            tokio::pin!(serve);
+            loop {
+                tokio::select! {
+                    _ = &mut serve => break,
+                    _ = health_shutdown.changed() => {
+                        if *health_shutdown.borrow() { break; }
+                    }
+                }
+            }
+        });
+    }
+
     // Accept loop with shutdown
     let state_accept = state.clone();
+    let limits = ConnectionLimits::from_config(&cfg);
     let handle = tokio::spawn(async move {
         let listener = listener;
         loop {
@@ -452,10 +925,16 @@ pub async fn spawn_with_shutdown(
                         Ok(v) => v,
                         Err(e) => { return Err(e.into()); }
                     };
+                    if let Some(reason) = ip_filter.rejection(addr.ip()) {
+                        tracing::warn!(%addr, reason, "rejected connection");
+                        continue;
+                    }
                     tracing::debug!(%addr, "accepted connection");
                     let state = state_accept.clone();
+                    let conn_id = CONN_SEQ.fetch_add(1, Ordering::Relaxed);
+                    let conn_span = tracing::info_span!("conn", conn_id, app_name = tracing::field::Empty);
                     tokio::spawn(async move {
-                        if let Err(e) = handle_connection(state, socket).await {
+                        if let Err(e) = handle_connection(state, socket, conn_id, limits).instrument(conn_span).await {
                             tracing::debug!(error = %format!("{e:?}"), "connection closed with error");
                         }
                     });
@@ -471,7 +950,111 @@ pub async fn spawn_with_shutdown(
     Ok((state, local_addr, shutdown_tx, handle))
 }
 
-async fn handle_connection(state: Arc<AppState>, mut socket: TcpStream) -> Result<()> {
+/// Sessions a connection remembers for [`release_connection`]. Past this many, those that
+/// have ended are forgotten, and sessions beyond it are left to the session timeout.
+const MAX_CONNECTION_LSIDS: usize = 1024;
+
+/// What a client connection holds until it closes, released by [`release_connection`] when
+/// the connection's task ends, however it ends.
+struct ConnectionGuard {
+    state: Arc<AppState>,
+    conn_id: u64,
+    /// Sessions the connection's requests used
+    lsids: std::collections::HashSet<Uuid>,
+    last_request: Instant,
+}
+
+impl ConnectionGuard {
+    /// Remember `lsid` as used by this connection, within [`MAX_CONNECTION_LSIDS`].
+    async fn note_lsid(&mut self, lsid: Option<Uuid>) {
+        let Some(lsid) = lsid else { return };
+        if self.lsids.len() >= MAX_CONNECTION_LSIDS && !self.lsids.contains(&lsid) {
+            let live: std::collections::HashSet<Uuid> = self
+                .state
+                .session_manager
+                .lsids()
+                .await
+                .into_iter()
+                .collect();
+            self.lsids.retain(|l| live.contains(l));
+            if self.lsids.len() >= MAX_CONNECTION_LSIDS {
+                return;
+            }
+        }
+        self.lsids.insert(lsid);
+    }
+}
+
+impl Drop for ConnectionGuard {
+    fn drop(&mut self) {
+        let state = self.state.clone();
+        let conn_id = self.conn_id;
+        let lsids = std::mem::take(&mut self.lsids);
+        let last_request = self.last_request;
+        // Releasing waits on locks, so it finishes on its own task
+        if let Ok(runtime) = tokio::runtime::Handle::try_current() {
+            runtime.spawn(async move {
+                release_connection(&state, conn_id, &lsids, last_request).await;
+            });
+        }
+    }
+}
+
+/// Free what a closed connection still holds: the cursors it opened, and open transactions
+/// of sessions it used that no other connection has touched since its last request.
+async fn release_connection(
+    state: &AppState,
+    conn_id: u64,
+    lsids: &std::collections::HashSet<Uuid>,
+    last_request: Instant,
+) {
+    state
+        .cursors
+        .lock()
+        .await
+        .retain(|_, e| e.conn != Some(conn_id));
+    for lsid in lsids {
+        if let Some(session) = state.session_manager.get_session(*lsid).await {
+            let mut s = session.lock().await;
+            if s.in_transaction
+                && s.last_write_time <= last_request
+                && let Err(e) = s.abort_transaction().await
+            {
+                tracing::warn!(%lsid, error = %e, "failed to abort transaction of closed connection");
+            }
+        }
+    }
+}
+
+/// Remember the `client.application.name` of a `hello` or `isMaster` handshake, the
+/// `appName` of the client's connection string, for the rest of the connection. It is
+/// recorded on the connection's log span and reported by `currentOp` and the metrics.
+fn note_app_name(app_name: &mut Option<String>, cmd: &Document) {
+    if !matches!(
+        cmd.keys().next().map(String::as_str),
+        Some("hello" | "isMaster" | "ismaster")
+    ) {
+        return;
+    }
+    let Some(name) = cmd
+        .get_document("client")
+        .and_then(|c| c.get_document("application"))
+        .and_then(|a| a.get_str("name"))
+        .ok()
+    else {
+        return;
+    };
+    tracing::Span::current().record("app_name", name);
+    tracing::debug!(app_name = %name, "client handshake");
+    *app_name = Some(name.to_string());
+}
+
+async fn handle_connection(
+    state: Arc<AppState>,
+    mut socket: TcpStream,
+    conn_id: u64,
+    limits: ConnectionLimits,
+) -> Result<()> {
     // Per-connection shadow session (lazy connect)
     let shadow_session = state.shadow.as_ref().and_then(|cfg| {
         if cfg.enabled {
@@ -480,10 +1063,41 @@ async fn handle_connection(state: Arc<AppState>, mut socket: TcpStream) -> Resul
             None
         }
     });
+    let opened = Instant::now();
+    let mut conn = ConnectionGuard {
+        state: state.clone(),
+        conn_id,
+        lsids: std::collections::HashSet::new(),
+        last_request: opened,
+    };
+    let mut app_name = None;
+    let auth = Arc::new(std::sync::Mutex::new(ConnectionAuth::new(
+        socket.peer_addr().is_ok_and(|a| a.ip().is_loopback()),
+    )));
     loop {
-        // Read header
+        // Read header, closing the connection if a limit passes first. Limits are only
+        // checked between requests, so a running command is never cut short.
         let mut header_buf = [0u8; 16];
-        if let Err(e) = socket.read_exact(&mut header_buf).await {
+        let read = match limits.deadline(opened, Instant::now()) {
+            Some((deadline, limit)) => {
+                let read = if deadline > Instant::now() {
+                    tokio::time::timeout_at(deadline.into(), socket.read_exact(&mut header_buf))
+                        .await
+                        .ok()
+                } else {
+                    None
+                };
+                match read {
+                    Some(r) => r,
+                    None => {
+                        tracing::debug!(limit, "closing client connection");
+                        break;
+                    }
+                }
+            }
+            None => socket.read_exact(&mut header_buf).await,
+        };
+        if let Err(e) = read {
             if e.kind() == std::io::ErrorKind::UnexpectedEof
                 || e.kind() == std::io::ErrorKind::UnexpectedEof
             {
@@ -533,11 +1147,23 @@ async fn handle_connection(state: Arc<AppState>, mut socket: TcpStream) -> Resul
                             .next()
                             .map(|(k, _)| k.clone())
                             .unwrap_or_else(|| "".to_string());
-                        tracing::debug!(command=%cmd_name, db=%db.as_deref().unwrap_or(""), cmd=?cmd, "received OP_MSG");
-                        (
-                            handle_command(&state, db.as_deref(), cmd.clone()).await,
-                            Some(cmd),
-                        )
+                        tracing::debug!(command=%cmd_name, db=%db.as_deref().unwrap_or(""), cmd=?crate::logging::redact_command(&cmd), "received OP_MSG");
+                        conn.note_lsid(extract_lsid(&cmd)).await;
+                        note_app_name(&mut app_name, &cmd);
+                        let reply = CONNECTION_ID
+                            .scope(
+                                conn_id,
+                                APP_NAME.scope(
+                                    app_name.clone(),
+                                    CONNECTION_AUTH.scope(
+                                        auth.clone(),
+                                        handle_command(&state, db.as_deref(), cmd.clone()),
+                                    ),
+                                ),
+                            )
+                            .await;
+                        conn.last_request = Instant::now();
+                        (reply, Some(cmd))
                     }
                     None => {
                         tracing::warn!("malformed OP_MSG body; sending ok:0");
@@ -621,8 +1247,22 @@ async fn handle_connection(state: Arc<AppState>, mut socket: TcpStream) -> Resul
                             .next()
                             .map(|(k, _)| k.clone())
                             .unwrap_or_else(|| "".to_string());
-                        tracing::debug!(command=%cmd_name, db=%db.as_deref().unwrap_or(""), cmd=?cmd, "received OP_QUERY");
-                        let reply_doc = handle_command(&state, db.as_deref(), cmd).await;
+                        tracing::debug!(command=%cmd_name, db=%db.as_deref().unwrap_or(""), cmd=?crate::logging::redact_command(&cmd), "received OP_QUERY");
+                        conn.note_lsid(extract_lsid(&cmd)).await;
+                        note_app_name(&mut app_name, &cmd);
+                        let reply_doc = CONNECTION_ID
+                            .scope(
+                                conn_id,
+                                APP_NAME.scope(
+                                    app_name.clone(),
+                                    CONNECTION_AUTH.scope(
+                                        auth.clone(),
+                                        handle_command(&state, db.as_deref(), cmd),
+                                    ),
+                                ),
+                            )
+                            .await;
+                        conn.last_request = Instant::now();
                         let request_id = REQ_ID.fetch_add(1, Ordering::Relaxed);
                         let resp = encode_op_reply(
                             std::slice::from_ref(&reply_doc),
@@ -699,29 +1339,737 @@ async fn handle_connection(state: Arc<AppState>, mut socket: TcpStream) -> Resul
 }
 
 async fn handle_command(state: &AppState, db: Option<&str>, mut cmd: Document) -> Document {
+    unwrap_query_modifiers(&mut cmd);
+    hoist_query_comment(&mut cmd);
+    if let Ok(defaults) = state.rw_concern_defaults.lock() {
+        defaults.apply(&mut cmd);
+    }
+    let comment = cmd.get("comment").cloned();
+    let opid = OP_SEQ.fetch_add(1, Ordering::Relaxed);
+    let _op_guard = register_current_op(state, opid, db, &cmd, comment.clone());
+    let cmd_name = cmd.keys().next().cloned().unwrap_or_default();
+    let collection = match cmd.get(&cmd_name) {
+        Some(Bson::String(c)) => c.clone(),
+        _ => String::new(),
+    };
+    let ns = match (db, collection.is_empty()) {
+        (Some(d), false) => format!("{}.{}", d, collection),
+        (Some(d), true) => format!("{}.$cmd", d),
+        (None, _) => String::new(),
+    };
+    // `op_id` ties this command to the SQL it issues (logged under `oxidedb::sql`); the other
+    // fields become OpenTelemetry attributes when export is enabled
+    let span = tracing::info_span!(
+        "command",
+        op_id = opid,
+        otel.name = %cmd_name,
+        otel.kind = "server",
+        db.system = "mongodb",
+        db.operation = %cmd_name,
+        db.namespace = %ns,
+        rows = tracing::field::Empty,
+    );
+    crate::telemetry::set_remote_parent(&span, &cmd);
+    // Only keep a copy of the command when the profiler may record it
+    let profile_level = db.map(|d| profiling_level(state, d)).unwrap_or(0);
+    let profiled_cmd = (profile_level > 0).then(|| cmd.clone());
+    // A client that has seen a later cluster time moves the clock up to it
+    if let Some(ts) = crate::cluster_time::from_command(&cmd) {
+        CLUSTER_CLOCK.advance(ts);
+    }
+    let lsid = extract_lsid(&cmd);
+    if let Some(lsid) = lsid {
+        // Any command on a session keeps it from expiring
+        state.session_manager.get_or_create_session(lsid).await;
+    }
+    let started = Instant::now();
+    let dispatch = async {
+        match comment {
+            Some(c) => {
+                let text = match c {
+                    Bson::String(s) => s,
+                    other => other.into_relaxed_extjson().to_string(),
+                };
+                crate::store::with_query_comment(&text, dispatch_command(state, db, cmd)).await
+            }
+            None => dispatch_command(state, db, cmd).await,
+        }
+    };
+    // Keep the issued SQL in case the command ends up in the slow-op log
+    let (reply, sql) = crate::store::capture_sql(SESSION_ID.scope(lsid, dispatch))
+        .instrument(span.clone())
+        .await;
+    let elapsed = started.elapsed();
+    if let Some(rows) = crate::logging::reply_row_count(&reply) {
+        span.record("rows", rows);
+    }
+    state.record_command(&cmd_name, db.unwrap_or(""), elapsed, &reply);
+    if let Ok(Some(app)) = APP_NAME.try_with(|a| a.clone()) {
+        state.command_metrics.record_app(&app);
+    }
+    let slow_threshold = Duration::from_millis(state.slow_op_threshold_ms.load(Ordering::Relaxed));
+    span.in_scope(|| {
+        crate::logging::log_command(db.unwrap_or(""), &collection, &cmd_name, elapsed, &reply);
+        if elapsed > slow_threshold {
+            crate::logging::log_slow_command(&cmd_name, &ns, elapsed, &sql);
+        }
+    });
+    if let (Some(d), Some(profiled)) = (db, profiled_cmd)
+        && (profile_level == 2 || elapsed > slow_threshold)
+        && collection != PROFILE_COLLECTION
+    {
+        record_profile_entry(state, d, &ns, &profiled, elapsed, &reply).await;
+    }
+    let mut reply = reply;
+    reply.insert("operationTime", CLUSTER_CLOCK.tick());
+    reply.insert(
+        "$clusterTime",
+        crate::cluster_time::reply_field(CLUSTER_CLOCK.now()),
+    );
+    reply
+}
+
+/// Unwrap the legacy `$query` form. Old drivers send an `OP_QUERY` command wrapped as
+/// `{$query: {...}, $readPreference: ...}`, and old tools send a `find` whose filter is
+/// `{$query: ..., $orderby: ..., $hint: ..., $explain: true}`. The filter becomes what
+/// `$query` holds, and `$orderby`, `$hint`, `$comment` and `$maxTimeMS` the command's
+/// `sort`, `hint`, `comment` and `maxTimeMS` unless it sets them itself. A true `$explain`
+/// turns the `find` into an `explain` of it.
+fn unwrap_query_modifiers(cmd: &mut Document) {
+    if let Some((key, Bson::Document(inner))) = cmd.iter().next()
+        && key == "$query"
+    {
+        let inner = inner.clone();
+        *cmd = inner;
+    }
+    if cmd.keys().next().map(String::as_str) != Some("find") {
+        return;
+    }
+    let Some(key) = ["filter", "query"].into_iter().find(|k| {
+        cmd.get_document(k)
+            .is_ok_and(|f| matches!(f.get("$query"), Some(Bson::Document(_))))
+    }) else {
+        return;
+    };
+    let Some(Bson::Document(mut wrapped)) = cmd.remove(key) else {
+        return;
+    };
+    if let Some(filter) = wrapped.remove("$query") {
+        cmd.insert("filter", filter);
+    }
+    for (modifier, option) in [
+        ("$orderby", "sort"),
+        ("$hint", "hint"),
+        ("$comment", "comment"),
+        ("$maxTimeMS", "maxTimeMS"),
+    ] {
+        if let Some(v) = wrapped.remove(modifier)
+            && !cmd.contains_key(option)
+        {
+            cmd.insert(option, v);
+        }
+    }
+    let explain = match wrapped.get("$explain") {
+        Some(Bson::Boolean(b)) => *b,
+        v => bson_number(v).is_some_and(|n| n != 0),
+    };
+    if explain {
+        let db = cmd.remove("$db");
+        let mut wrapper = doc! {"explain": std::mem::take(cmd)};
+        if let Some(db) = db {
+            wrapper.insert("$db", db);
+        }
+        *cmd = wrapper;
+    }
+}
+
+/// Move the legacy `$comment` of a command's query (`filter` or `query`, or the `q` of
+/// `update` and `delete` statements) out of the predicate. The first one found becomes the
+/// command's `comment` unless it already has one, so it is reported and tagged onto SQL
+/// the same way.
+fn hoist_query_comment(cmd: &mut Document) {
+    let mut found = None;
+    let mut take = |filter: &mut Document| {
+        if let Some(c) = filter.remove("$comment") {
+            found.get_or_insert(c);
+        }
+    };
+    for key in ["filter", "query"] {
+        if let Ok(filter) = cmd.get_document_mut(key) {
+            take(filter);
+        }
+    }
+    for key in ["updates", "deletes"] {
+        if let Ok(statements) = cmd.get_array_mut(key) {
+            for statement in statements {
+                if let Some(filter) = statement
+                    .as_document_mut()
+                    .and_then(|s| s.get_document_mut("q").ok())
+                {
+                    take(filter);
+                }
+            }
+        }
+    }
+    if let Some(c) = found
+        && !cmd.contains_key("comment")
+    {
+        cmd.insert("comment", c);
+    }
+}
+
+fn register_current_op<'a>(
+    state: &'a AppState,
+    opid: u64,
+    db: Option<&str>,
+    cmd: &Document,
+    comment: Option<Bson>,
+) -> CurrentOpGuard<'a> {
+    // Keep only the command name/target and comment; full bodies (e.g. insert batches) can be large
+    let mut command = Document::new();
+    if let Some((k, v)) = cmd.iter().next() {
+        command.insert(k.clone(), v.clone());
+    }
+    if let Some(ref c) = comment {
+        command.insert("comment", c.clone());
+    }
+    let ns = match (db, cmd.iter().next()) {
+        (Some(d), Some((_, Bson::String(coll)))) => format!("{}.{}", d, coll),
+        (Some(d), _) => format!("{}.$cmd", d),
+        (None, _) => String::new(),
+    };
+    if let Ok(mut ops) = state.current_ops.lock() {
+        ops.insert(
+            opid,
+            CurrentOp {
+                ns,
+                command,
+                comment,
+                app_name: APP_NAME.try_with(|a| a.clone()).ok().flatten(),
+                started: Instant::now(),
+            },
+        );
+    }
+    CurrentOpGuard { state, opid }
+}
+
+/// A command [`dispatch_command`] handles, as `listCommands` reports it.
+struct CommandInfo {
+    name: &'static str,
+    help: &'static str,
+    admin_only: bool,
+    requires_auth: bool,
+    /// What a caller needs its roles to allow when `authorization` is enabled
+    action: Action,
+}
+
+/// Every command name (aliases included) `dispatch_command` matches, in its order; a test
+/// checks the two stay in step.
+const COMMANDS: &[CommandInfo] = &[
+    CommandInfo {
+        name: "hello",
+        help: "Check if this server is primary and report its limits",
+        admin_only: false,
+        requires_auth: false,
+        action: Action::Open,
+    },
+    CommandInfo {
+        name: "ismaster",
+        help: "Legacy alias of hello",
+        admin_only: false,
+        requires_auth: false,
+        action: Action::Open,
+    },
+    CommandInfo {
+        name: "isMaster",
+        help: "Legacy alias of hello",
+        admin_only: false,
+        requires_auth: false,
+        action: Action::Open,
+    },
+    CommandInfo {
+        name: "ping",
+        help: "Check that the server is responding",
+        admin_only: false,
+        requires_auth: false,
+        action: Action::Open,
+    },
+    CommandInfo {
+        name: "buildInfo",
+        help: "Report the server version and build",
+        admin_only: false,
+        requires_auth: false,
+        action: Action::Open,
+    },
+    CommandInfo {
+        name: "buildinfo",
+        help: "Alias of buildInfo",
+        admin_only: false,
+        requires_auth: false,
+        action: Action::Open,
+    },
+    CommandInfo {
+        name: "listCommands",
+        help: "List the commands this server handles",
+        admin_only: false,
+        requires_auth: false,
+        action: Action::Open,
+    },
+    CommandInfo {
+        name: "listDatabases",
+        help: "List databases with their sizes",
+        admin_only: true,
+        requires_auth: true,
+        action: Action::ListDatabases,
+    },
+    CommandInfo {
+        name: "listCollections",
+        help: "List the collections and views of a database",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::List,
+    },
+    CommandInfo {
+        name: "serverStatus",
+        help: "Report server counters and uptime",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Cluster,
+    },
+    CommandInfo {
+        name: "create",
+        help: "Create a collection or view",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Schema,
+    },
+    CommandInfo {
+        name: "drop",
+        help: "Drop a collection",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Schema,
+    },
+    CommandInfo {
+        name: "dropDatabase",
+        help: "Drop a database",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::DbAdmin,
+    },
+    CommandInfo {
+        name: "getNextSequence",
+        help: "Draw the next value of a named sequence",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Write,
+    },
+    CommandInfo {
+        name: "insert",
+        help: "Insert documents",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Write,
+    },
+    CommandInfo {
+        name: "update",
+        help: "Update documents",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Write,
+    },
+    CommandInfo {
+        name: "delete",
+        help: "Delete documents",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Write,
+    },
+    CommandInfo {
+        name: "findAndModify",
+        help: "Update or remove a document and return it",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Write,
+    },
+    CommandInfo {
+        name: "findandmodify",
+        help: "Alias of findAndModify",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Write,
+    },
+    CommandInfo {
+        name: "aggregate",
+        help: "Run an aggregation pipeline",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Find,
+    },
+    CommandInfo {
+        name: "find",
+        help: "Query documents",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Find,
+    },
+    CommandInfo {
+        name: "explain",
+        help: "Report the query plan of a command",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Find,
+    },
+    CommandInfo {
+        name: "getMore",
+        help: "Fetch the next batch of a cursor",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Authenticated,
+    },
+    CommandInfo {
+        name: "createIndexes",
+        help: "Create indexes on a collection",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Schema,
+    },
+    CommandInfo {
+        name: "dropIndexes",
+        help: "Drop indexes from a collection",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Schema,
+    },
+    CommandInfo {
+        name: "listIndexes",
+        help: "List the indexes of a collection",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::List,
+    },
+    CommandInfo {
+        name: "killCursors",
+        help: "Close cursors",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Authenticated,
+    },
+    CommandInfo {
+        name: "oxidedbShadowMetrics",
+        help: "OxideDB: report shadow comparison counters",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Cluster,
+    },
+    CommandInfo {
+        name: "oxidedbClearCache",
+        help: "OxideDB: flush cached metadata and query shapes",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Cluster,
+    },
+    CommandInfo {
+        name: "oxidedbExportExtendedJson",
+        help: "OxideDB: return documents as canonical Extended JSON",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Find,
+    },
+    CommandInfo {
+        name: "oxidedbExplainSQL",
+        help: "OxideDB: show the SQL and parameters a find or aggregate would run",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Find,
+    },
+    CommandInfo {
+        name: "oxidedbDryRunBulkWrite",
+        help: "OxideDB: run bulk write operations in a rolled-back transaction",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Write,
+    },
+    CommandInfo {
+        name: "oxidedbMetrics",
+        help: "OxideDB: return Prometheus metrics text",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Cluster,
+    },
+    CommandInfo {
+        name: "startTransaction",
+        help: "Start a transaction on a session",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Authenticated,
+    },
+    CommandInfo {
+        name: "commitTransaction",
+        help: "Commit a session's transaction",
+        admin_only: true,
+        requires_auth: true,
+        action: Action::Authenticated,
+    },
+    CommandInfo {
+        name: "abortTransaction",
+        help: "Abort a session's transaction",
+        admin_only: true,
+        requires_auth: true,
+        action: Action::Authenticated,
+    },
+    CommandInfo {
+        name: "endSessions",
+        help: "End logical sessions",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Authenticated,
+    },
+    CommandInfo {
+        name: "refreshSessions",
+        help: "Keep logical sessions from expiring",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Authenticated,
+    },
+    CommandInfo {
+        name: "killSessions",
+        help: "Kill logical sessions and their operations",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Authenticated,
+    },
+    CommandInfo {
+        name: "killAllSessions",
+        help: "Kill all sessions of the given users",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Cluster,
+    },
+    CommandInfo {
+        name: "killAllSessionsByPattern",
+        help: "Kill sessions matching patterns",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::Cluster,
+    },
+    CommandInfo {
+        name: "currentOp",
+        help: "Report operations in progress",
+        admin_only: true,
+        requires_auth: true,
+        action: Action::Cluster,
+    },
+    CommandInfo {
+        name: "profile",
+        help: "Get or set the profiling level of a database",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::DbAdmin,
+    },
+    CommandInfo {
+        name: "setProfilingLevel",
+        help: "Alias of profile",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::DbAdmin,
+    },
+    CommandInfo {
+        name: "validate",
+        help: "Check a collection's data and indexes",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::DbAdmin,
+    },
+    CommandInfo {
+        name: "reIndex",
+        help: "Rebuild a collection's indexes",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::DbAdmin,
+    },
+    CommandInfo {
+        name: "collMod",
+        help: "Change collection or index options",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::DbAdmin,
+    },
+    CommandInfo {
+        name: "getDefaultRWConcern",
+        help: "Report the default read and write concerns",
+        admin_only: true,
+        requires_auth: true,
+        action: Action::Cluster,
+    },
+    CommandInfo {
+        name: "setDefaultRWConcern",
+        help: "Set the default read and write concerns",
+        admin_only: true,
+        requires_auth: true,
+        action: Action::Cluster,
+    },
+    CommandInfo {
+        name: "oxidedbGetWriteLimits",
+        help: "OxideDB: report the write rate limits",
+        admin_only: true,
+        requires_auth: true,
+        action: Action::Cluster,
+    },
+    CommandInfo {
+        name: "oxidedbSetWriteLimits",
+        help: "OxideDB: replace the write rate limits until restart",
+        admin_only: true,
+        requires_auth: true,
+        action: Action::Cluster,
+    },
+    CommandInfo {
+        name: "saslStart",
+        help: "Begin a SCRAM-SHA-256 authentication conversation",
+        admin_only: false,
+        requires_auth: false,
+        action: Action::Open,
+    },
+    CommandInfo {
+        name: "saslContinue",
+        help: "Continue a SCRAM-SHA-256 authentication conversation",
+        admin_only: false,
+        requires_auth: false,
+        action: Action::Open,
+    },
+    CommandInfo {
+        name: "logout",
+        help: "End the connection's authenticated session",
+        admin_only: false,
+        requires_auth: false,
+        action: Action::Open,
+    },
+    CommandInfo {
+        name: "createUser",
+        help: "Create a user with built-in roles",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::UserAdmin,
+    },
+    CommandInfo {
+        name: "updateUser",
+        help: "Change a user's password, roles or customData",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::UserAdmin,
+    },
+    CommandInfo {
+        name: "dropUser",
+        help: "Remove a user",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::UserAdmin,
+    },
+    CommandInfo {
+        name: "usersInfo",
+        help: "Report users and their roles, with credentials on request",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::UserAdmin,
+    },
+    CommandInfo {
+        name: "grantRolesToUser",
+        help: "Grant built-in roles to a user",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::UserAdmin,
+    },
+    CommandInfo {
+        name: "revokeRolesFromUser",
+        help: "Revoke roles from a user",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::UserAdmin,
+    },
+    CommandInfo {
+        name: "dropAllUsersFromDatabase",
+        help: "Remove every user of a database",
+        admin_only: false,
+        requires_auth: true,
+        action: Action::UserAdmin,
+    },
+];
+
+/// `listCommands`: the commands this server handles, keyed by name.
+fn list_commands_reply() -> Document {
+    let mut commands = Document::new();
+    for c in COMMANDS {
+        commands.insert(
+            c.name,
+            doc! {
+                "help": c.help,
+                "adminOnly": c.admin_only,
+                "requiresAuth": c.requires_auth,
+                "secondaryOk": true,
+                "apiVersions": [],
+                "deprecatedApiVersions": [],
+            },
+        );
+    }
+    doc! { "commands": commands, "ok": 1.0 }
+}
+
+async fn dispatch_command(state: &AppState, db: Option<&str>, mut cmd: Document) -> Document {
     // command name is the first key in the doc
     let cmd_name = cmd.iter().next().map(|(k, _)| k.as_str()).unwrap_or("");
+    if state.authorization_enabled
+        && let Some(err_doc) = authorization_error(state, db, cmd_name, &cmd).await
+    {
+        return err_doc;
+    }
+    if let Some(err_doc) = write_limit_error(state, db, cmd_name, &cmd) {
+        return err_doc;
+    }
+    if matches!(
+        cmd_name,
+        "insert" | "update" | "delete" | "findAndModify" | "findandmodify" | "createIndexes"
+    ) && let Some(err_doc) = view_write_error(state, db, &cmd).await
+    {
+        return err_doc;
+    }
+    if let Err(err_doc) = await_cluster_time(&cmd).await {
+        return err_doc;
+    }
     match cmd_name {
-        "hello" | "ismaster" | "isMaster" => hello_reply(),
+        "hello" | "ismaster" | "isMaster" => {
+            let mut reply = hello_reply(state.max_bson_object_size);
+            if knows_sasl_user(state, &cmd).await {
+                reply.insert("saslSupportedMechs", vec![crate::scram::SCRAM_MECHANISM]);
+            }
+            reply
+        }
         "ping" => doc! { "ok": 1.0 },
-        "buildInfo" | "buildinfo" => build_info_reply(),
+        "buildInfo" | "buildinfo" => build_info_reply(state.max_bson_object_size),
+        "listCommands" => list_commands_reply(),
         "listDatabases" => list_databases_reply(state, &cmd).await,
-        "listCollections" => list_collections_reply(state, db).await,
+        "listCollections" => list_collections_reply(state, db, &cmd).await,
         "serverStatus" => server_status_reply(state).await,
         "create" => create_collection_reply(state, db, &cmd).await,
         "drop" => drop_collection_reply(state, db, &cmd).await,
         "dropDatabase" => drop_database_reply(state, db).await,
+        "getNextSequence" => get_next_sequence_reply(state, db, &cmd).await,
         "insert" => insert_reply(state, db, &mut cmd).await,
-        "update" => update_reply(state, db, &cmd).await,
-        "delete" => delete_reply(state, db, &cmd).await,
+        "update" => crate::store::with_index_hints(update_reply(state, db, &cmd)).await,
+        "delete" => crate::store::with_index_hints(delete_reply(state, db, &cmd)).await,
         "findAndModify" | "findandmodify" => find_and_modify_reply(state, db, &cmd).await,
         "aggregate" => aggregate_reply(state, db, &cmd).await,
         "find" => find_reply(state, db, &cmd).await,
+        "explain" => explain_reply(state, db, &cmd).await,
         "getMore" => get_more_reply(state, &cmd).await,
         "createIndexes" => create_indexes_reply(state, db, &cmd).await,
         "dropIndexes" => drop_indexes_reply(state, db, &cmd).await,
+        "listIndexes" => list_indexes_reply(state, db, &cmd).await,
         "killCursors" => kill_cursors_reply(state, &cmd).await,
         "oxidedbShadowMetrics" => shadow_metrics_reply(state).await,
+        "oxidedbClearCache" => clear_cache_reply(state).await,
+        "oxidedbExportExtendedJson" => export_extended_json_reply(state, db, &cmd).await,
+        "oxidedbExplainSQL" => explain_sql_reply(state, db, &cmd).await,
+        "oxidedbDryRunBulkWrite" => dry_run_bulk_write_reply(state, db, &cmd).await,
         "oxidedbMetrics" => {
             let metrics_text = metrics_reply(state).await;
             doc! { "metrics": metrics_text, "ok": 1.0 }
@@ -730,52 +2078,705 @@ async fn handle_command(state: &AppState, db: Option<&str>, mut cmd: Document) -
         "commitTransaction" => commit_transaction_reply(state, db, &cmd).await,
         "abortTransaction" => abort_transaction_reply(state, db, &cmd).await,
         "endSessions" => end_sessions_reply(state, &cmd).await,
+        "refreshSessions" => refresh_sessions_reply(state, &cmd).await,
+        "killSessions" => kill_sessions_reply(state, &cmd).await,
+        "killAllSessions" => kill_all_sessions_reply(state, &cmd).await,
+        "killAllSessionsByPattern" => kill_all_sessions_by_pattern_reply(state, &cmd).await,
+        "currentOp" => current_op_reply(state, &cmd),
+        "profile" | "setProfilingLevel" => profile_reply(state, db, &cmd),
+        "validate" => validate_reply(state, db, &cmd).await,
+        "reIndex" => reindex_reply(state, db, &cmd).await,
+        "collMod" => coll_mod_reply(state, db, &cmd).await,
+        "getDefaultRWConcern" => get_default_rw_concern_reply(state),
+        "setDefaultRWConcern" => set_default_rw_concern_reply(state, db, &cmd),
+        "oxidedbGetWriteLimits" => get_write_limits_reply(state),
+        "oxidedbSetWriteLimits" => set_write_limits_reply(state, db, &cmd),
+        "saslStart" => sasl_start_reply(state, db, &cmd).await,
+        "saslContinue" => sasl_continue_reply(&cmd),
+        "logout" => logout_reply(),
+        "createUser" => create_user_reply(state, db, &cmd).await,
+        "updateUser" => update_user_reply(state, db, &cmd).await,
+        "dropUser" => drop_user_reply(state, db, &cmd).await,
+        "usersInfo" => users_info_reply(state, db, &cmd).await,
+        "grantRolesToUser" => change_user_roles_reply(state, db, &cmd, true).await,
+        "revokeRolesFromUser" => change_user_roles_reply(state, db, &cmd, false).await,
+        "dropAllUsersFromDatabase" => drop_all_users_reply(state, db).await,
         _ => {
-            tracing::debug!(cmd = ?cmd, "unrecognized command; replying ok:0");
-            error_doc(59, format!("Command '{}' not implemented", cmd_name))
+            tracing::debug!(cmd = ?crate::logging::redact_command(&cmd), "unrecognized command; replying ok:0");
+            error_doc(
+                COMMAND_NOT_FOUND,
+                format!("Command '{}' not implemented", cmd_name),
+            )
         }
     }
 }
 
-fn hello_reply() -> Document {
-    doc! {
-        "ismaster": true,
-        "isWritablePrimary": true,
-        "helloOk": true,
-        "minWireVersion": 0i32,
-        // Advertise compatibility for MongoDB 4.2+ clients
-        // Node.js driver v6 requires >= 8
-        "maxWireVersion": 8i32,
-        "maxBsonObjectSize": 16_777_216i32, // 16MB
-        "maxMessageSizeBytes": 48_000_000i32,
-        "maxWriteBatchSize": 100_000i32,
-        "logicalSessionTimeoutMinutes": 30i32,
-        "ok": 1.0
-    }
+/// Whether the `saslSupportedMechs` user (`<db>.<user>`) of a `hello` exists and can
+/// authenticate with SCRAM-SHA-256, which `hello` then reports.
+async fn knows_sasl_user(state: &AppState, cmd: &Document) -> bool {
+    let Some((db, user)) = cmd
+        .get_str("saslSupportedMechs")
+        .ok()
+        .and_then(|u| u.split_once('.'))
+    else {
+        return false;
+    };
+    let Some(ref pg) = state.store else {
+        return false;
+    };
+    matches!(find_user(pg, user, db).await, Ok(Some(u)) if crate::users::credentials_of(&u).is_some())
 }
 
-#[cfg(test)]
-mod hello_tests {
-    use super::hello_reply;
+/// What running `cmd_name` needs, from [`COMMANDS`], or None for a command the dispatcher
+/// does not know. `explain` needs what the command it explains does, an aggregation that
+/// ends in `$out` or `$merge` needs to write, and reading or changing `admin.system.users`
+/// through any namespace the command names is user administration.
+fn required_action(db: &str, cmd_name: &str, cmd: &Document) -> Option<Action> {
+    let info = COMMANDS.iter().find(|c| c.name == cmd_name)?;
+    let action = match cmd_name {
+        "explain" => {
+            let inner = cmd.get_document("explain").ok()?;
+            let inner_name = inner.keys().next()?;
+            return required_action(db, inner_name, inner);
+        }
+        "aggregate"
+            if cmd.get_array("pipeline").is_ok_and(|p| {
+                p.iter().any(|stage| {
+                    stage
+                        .as_document()
+                        .is_some_and(|d| d.contains_key("$out") || d.contains_key("$merge"))
+                })
+            }) =>
+        {
+            Action::Write
+        }
+        _ => info.action,
+    };
+    let users_collection = command_namespaces(db, cmd_name, cmd)
+        .iter()
+        .any(|ns| is_users_namespace(ns));
+    Some(match action {
+        Action::Find | Action::Write | Action::List | Action::Schema if users_collection => {
+            Action::UserAdmin
+        }
+        action => action,
+    })
+}
 
-    #[test]
-    fn advertises_wire_version_8() {
-        let d = hello_reply();
-        assert_eq!(d.get_i32("maxWireVersion").unwrap(), 8);
-        assert!(d.get_bool("helloOk").unwrap_or(false));
-        assert!(d.get_bool("isWritablePrimary").unwrap_or(false));
-    }
+fn is_users_namespace((db, coll): &(String, String)) -> bool {
+    db == USERS_DB && coll == USERS_COLLECTION
 }
 
-fn error_doc(code: i32, msg: impl Into<String>) -> Document {
-    doc! { "ok": 0.0, "errmsg": msg.into(), "code": code }
+/// Every namespace `cmd` names, as `(db, coll)`: the collection it runs on, the one a
+/// `create` defines its view on, and those its pipeline reads with `$lookup`,
+/// `$graphLookup` and `$unionWith` (sub-pipelines included) or writes with `$out` and
+/// `$merge`. Views among them are not expanded.
+fn command_namespaces(db: &str, cmd_name: &str, cmd: &Document) -> Vec<(String, String)> {
+    if cmd_name == "explain" {
+        return match cmd.get_document("explain") {
+            Ok(inner) => inner
+                .keys()
+                .next()
+                .map(|name| command_namespaces(db, name, inner))
+                .unwrap_or_default(),
+            Err(_) => Vec::new(),
+        };
+    }
+    let mut out = Vec::new();
+    for key in [cmd_name, "viewOn"] {
+        if let Ok(coll) = cmd.get_str(key) {
+            out.push((db.to_string(), coll.to_string()));
+        }
+    }
+    if let Ok(pipeline) = cmd.get_array("pipeline") {
+        pipeline_namespaces(db, pipeline, &mut out);
+    }
+    out
 }
 
-/// Extract $text search parameters from a filter document.
-/// Returns Some((search, language, case_sensitive, diacritic_sensitive)) if $text is present.
-/// Returns None if no $text operator.
-/// Returns error document if $text is malformed or combined with disallowed operators.
-fn extract_text_search_params(
+/// Add the namespaces the stages of `pipeline`, running on `db`, read or write to `out`.
+fn pipeline_namespaces(db: &str, pipeline: &[Bson], out: &mut Vec<(String, String)>) {
+    // `coll` or `{db, coll}`
+    let target = |spec: Option<&Bson>| match spec {
+        Some(Bson::String(coll)) => Some((db.to_string(), coll.clone())),
+        Some(Bson::Document(ns)) => Some((
+            ns.get_str("db").unwrap_or(db).to_string(),
+            ns.get_str("coll").ok()?.to_string(),
+        )),
+        _ => None,
+    };
+    for stage in pipeline.iter().filter_map(Bson::as_document) {
+        for (name, spec) in stage {
+            match (name.as_str(), spec) {
+                ("$out", _) | ("$merge" | "$unionWith", Bson::String(_)) => {
+                    out.extend(target(Some(spec)))
+                }
+                ("$merge", Bson::Document(d)) => out.extend(target(d.get("into"))),
+                ("$lookup" | "$graphLookup" | "$unionWith", Bson::Document(d)) => {
+                    let from = target(d.get("from").or_else(|| d.get("coll")));
+                    if let Ok(sub) = d.get_array("pipeline") {
+                        let sub_db = from.as_ref().map_or(db, |(from_db, _)| from_db.as_str());
+                        pipeline_namespaces(sub_db, sub, out);
+                    }
+                    out.extend(from);
+                }
+                ("$facet", Bson::Document(d)) => {
+                    for sub in d.values() {
+                        if let Bson::Array(sub) = sub {
+                            pipeline_namespaces(db, sub, out);
+                        }
+                    }
+                }
+                _ => {}
+            }
+        }
+    }
+}
+
+/// Whether `cmd` reaches `admin.system.users`, directly or through the views it names,
+/// whose definitions are followed as far as views may nest.
+async fn reaches_users_collection(
+    state: &AppState,
+    db: &str,
+    cmd_name: &str,
+    cmd: &Document,
+) -> bool {
+    let mut pending = command_namespaces(db, cmd_name, cmd);
+    let mut seen = Vec::new();
+    while let Some(ns) = pending.pop() {
+        if is_users_namespace(&ns) {
+            return true;
+        }
+        if seen.contains(&ns) || seen.len() > MAX_VIEW_DEPTH * 16 {
+            continue;
+        }
+        if let Some(ref pg) = state.store
+            && let Ok(Some(view)) = pg.view_definition(&ns.0, &ns.1).await
+        {
+            pending.push((ns.0.clone(), view.view_on));
+            let stages: Vec<Bson> = view.pipeline.into_iter().map(Bson::Document).collect();
+            pipeline_namespaces(&ns.0, &stages, &mut pending);
+        }
+        seen.push(ns);
+    }
+    false
+}
+
+/// Every `(action, db)` the caller's roles must allow to run `cmd`, which needs `action` on
+/// `action_db`: the command's other databases need reading, or `action` for the one an
+/// aggregation writes to, and granting or revoking a role needs user administration on
+/// every database the role is administered from.
+fn required_grants(
+    db: &str,
+    cmd_name: &str,
+    cmd: &Document,
+    action: Action,
+    action_db: &str,
+) -> Vec<(Action, String)> {
+    let mut grants = vec![(action, action_db.to_string())];
+    let write_target = aggregate_write_target(db, cmd).filter(|_| cmd_name == "aggregate");
+    for ns in command_namespaces(db, cmd_name, cmd) {
+        if ns.0 == db {
+            continue;
+        }
+        let needed = if write_target.as_ref() == Some(&ns) {
+            action
+        } else {
+            Action::Find
+        };
+        grants.push((needed, ns.0));
+    }
+    if matches!(
+        cmd_name,
+        "createUser" | "updateUser" | "grantRolesToUser" | "revokeRolesFromUser"
+    ) && let Some(roles) = cmd.get("roles")
+        && let Ok(roles) = crate::users::parse_roles(roles, db)
+    {
+        for role in &roles {
+            for role_db in crate::users::administering_dbs(role) {
+                grants.push((Action::UserAdmin, role_db.to_string()));
+            }
+        }
+    }
+    grants.dedup();
+    grants
+}
+
+/// With `authorization` enabled, the reply refusing a command the connection may not run:
+/// any but the handshake and authentication commands before it authenticates, then those
+/// no role of its user allows on `db`. Until the first user exists, a client on the
+/// loopback interface may create it on `admin` without authenticating (MongoDB's
+/// localhost exception).
+async fn authorization_error(
+    state: &AppState,
+    db: Option<&str>,
+    cmd_name: &str,
+    cmd: &Document,
+) -> Option<Document> {
+    let dbname = db.unwrap_or("");
+    let Some(mut action) = required_action(dbname, cmd_name, cmd) else {
+        // Not in `COMMANDS`, so nothing says what it may touch
+        return Some(error_doc(
+            UNAUTHORIZED,
+            format!(
+                "not authorized on {} to execute command {}",
+                dbname, cmd_name
+            ),
+        ));
+    };
+    if action == Action::Open {
+        return None;
+    }
+    let (user, localhost) = CONNECTION_AUTH
+        .try_with(|auth| {
+            auth.lock()
+                .map(|auth| (auth.user.clone(), auth.localhost))
+                .unwrap_or((None, false))
+        })
+        .unwrap_or((None, false));
+    let user = match user {
+        Some(user) => refreshed_user(state, user).await,
+        None => None,
+    };
+    let Some(user) = user else {
+        if localhost
+            && cmd_name == "createUser"
+            && dbname == USERS_DB
+            && let Some(ref pg) = state.store
+            && matches!(pg.count_docs(USERS_DB, USERS_COLLECTION, None).await, Ok(0))
+        {
+            tracing::info!("creating the first user through the localhost exception");
+            return None;
+        }
+        return Some(error_doc(
+            UNAUTHORIZED,
+            format!("Command {} requires authentication", cmd_name),
+        ));
+    };
+    // `admin.system.users`, however it is reached, takes user administration on `admin`
+    let mut action_db = dbname;
+    if matches!(
+        action,
+        Action::Find | Action::Write | Action::List | Action::Schema | Action::UserAdmin
+    ) && reaches_users_collection(state, dbname, cmd_name, cmd).await
+    {
+        action = Action::UserAdmin;
+        action_db = USERS_DB;
+    }
+    if action == Action::Authenticated
+        || required_grants(dbname, cmd_name, cmd, action, action_db)
+            .iter()
+            .all(|(action, db)| crate::users::allows(&user.roles, *action, db))
+    {
+        return None;
+    }
+    tracing::info!(user = %user.user, db = %dbname, command = %cmd_name, "command not authorized");
+    Some(error_doc(
+        UNAUTHORIZED,
+        format!(
+            "not authorized on {} to execute command {}",
+            dbname, cmd_name
+        ),
+    ))
+}
+
+/// `readConcern.afterClusterTime`: hold the command until the cluster time has reached the
+/// given Timestamp, for at most `maxTimeMS` when the command sets one. Writes commit before
+/// their reply is stamped, so the read then sees every write up to that time.
+async fn await_cluster_time(cmd: &Document) -> std::result::Result<(), Document> {
+    let Some(after) = cmd
+        .get_document("readConcern")
+        .ok()
+        .and_then(|rc| rc.get("afterClusterTime"))
+    else {
+        return Ok(());
+    };
+    let Bson::Timestamp(ts) = after else {
+        return Err(error_doc(
+            TYPE_MISMATCH,
+            "'readConcern.afterClusterTime' must be a timestamp",
+        ));
+    };
+    let timeout = bson_number(cmd.get("maxTimeMS"))
+        .filter(|ms| *ms > 0)
+        .map(|ms| Duration::from_millis(ms as u64));
+    if CLUSTER_CLOCK.wait_for(*ts, timeout).await {
+        Ok(())
+    } else {
+        Err(error_doc(
+            MAX_TIME_MS_EXPIRED,
+            "operation exceeded time limit",
+        ))
+    }
+}
+
+/// Collection the database profiler writes to, in each profiled database.
+const PROFILE_COLLECTION: &str = "system.profile";
+/// Entries kept in `system.profile`; older ones are trimmed as new ones arrive.
+const PROFILE_MAX_ENTRIES: i64 = 1000;
+/// Commands larger than this are stored as `{$truncated: ...}`, as MongoDB does.
+const PROFILE_MAX_COMMAND_BYTES: usize = 50 * 1024;
+
+fn profiling_level(state: &AppState, db: &str) -> i32 {
+    state
+        .profiling_levels
+        .lock()
+        .ok()
+        .and_then(|levels| levels.get(db).copied())
+        .unwrap_or(0)
+}
+
+fn bson_number(v: Option<&Bson>) -> Option<i64> {
+    match v? {
+        Bson::Int32(n) => Some(*n as i64),
+        Bson::Int64(n) => Some(*n),
+        Bson::Double(n) => Some(*n as i64),
+        _ => None,
+    }
+}
+
+/// `profile` / `setProfilingLevel`: set the level for this database (-1 only reads it) and
+/// optionally the global `slowms`.
+fn profile_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let level = match bson_number(cmd.iter().next().map(|(_, v)| v)) {
+        Some(l) if (-1..=2).contains(&l) => l as i32,
+        Some(l) => return error_doc(2, format!("Invalid profiling level: {}", l)),
+        None => return error_doc(2, "Profiling level must be a number"),
+    };
+    let slowms = bson_number(cmd.get("slowms"));
+    if let Some(ms) = slowms
+        && ms < 0
+    {
+        return error_doc(2, "slowms must be non-negative");
+    }
+
+    let was = profiling_level(state, dbname);
+    if level >= 0
+        && let Ok(mut levels) = state.profiling_levels.lock()
+    {
+        levels.insert(dbname.to_string(), level);
+    }
+    if let Some(ms) = slowms {
+        state
+            .slow_op_threshold_ms
+            .store(ms as u64, Ordering::Relaxed);
+    }
+    doc! {
+        "was": was,
+        "slowms": state.slow_op_threshold_ms.load(Ordering::Relaxed) as i64,
+        "sampleRate": 1.0,
+        "ok": 1.0,
+    }
+}
+
+/// Append a profiler entry for a completed command to `<db>.system.profile`.
+async fn record_profile_entry(
+    state: &AppState,
+    db: &str,
+    ns: &str,
+    cmd: &Document,
+    elapsed: Duration,
+    reply: &Document,
+) {
+    let pg = match state.store.as_ref() {
+        Some(pg) => pg,
+        None => return,
+    };
+    let cmd_name = cmd.keys().next().map(|k| k.as_str()).unwrap_or("");
+    let op = match cmd_name {
+        "find" => "query",
+        "insert" => "insert",
+        "update" => "update",
+        "delete" => "remove",
+        "getMore" => "getmore",
+        _ => "command",
+    };
+
+    let mut command = crate::logging::redact_command(cmd);
+    command.remove("$db");
+    let command_len = bson::to_vec(&command).map(|b| b.len()).unwrap_or(0);
+    if command_len > PROFILE_MAX_COMMAND_BYTES {
+        let text = Bson::Document(command).into_relaxed_extjson().to_string();
+        let cut = text
+            .char_indices()
+            .map(|(i, _)| i)
+            .take_while(|i| *i <= PROFILE_MAX_COMMAND_BYTES)
+            .last()
+            .unwrap_or(0);
+        command = doc! {"$truncated": &text[..cut]};
+        if let Some(c) = cmd.get("comment") {
+            command.insert("comment", c.clone());
+        }
+    }
+
+    let mut entry = doc! {
+        "_id": bson::oid::ObjectId::new(),
+        "op": op,
+        "ns": ns,
+        "command": command,
+    };
+    if let Some(n) = crate::logging::reply_row_count(reply) {
+        let key = match op {
+            "insert" => "ninserted",
+            "update" => "nMatched",
+            "remove" => "ndeleted",
+            _ => "nreturned",
+        };
+        entry.insert(key, n);
+    }
+    if let Some(Bson::Double(ok)) = reply.get("ok")
+        && *ok == 0.0
+    {
+        if let Some(code) = reply.get("code") {
+            entry.insert("errCode", code.clone());
+        }
+        if let Some(msg) = reply.get("errmsg") {
+            entry.insert("errMsg", msg.clone());
+        }
+    }
+    entry.insert(
+        "responseLength",
+        bson::to_vec(reply).map(|b| b.len() as i64).unwrap_or(0),
+    );
+    entry.insert("millis", elapsed.as_millis() as i64);
+    entry.insert("ts", bson::DateTime::now());
+
+    let (idb, bson_bytes, json) = match (
+        id_bytes(entry.get("_id")),
+        bson::to_vec(&entry),
+        crate::bson_type::to_jsonb(&entry),
+    ) {
+        (Some(idb), Ok(b), Ok(j)) => (idb, b, j),
+        _ => return,
+    };
+    if let Err(e) = pg
+        .insert_capped(
+            db,
+            PROFILE_COLLECTION,
+            &idb,
+            &bson_bytes,
+            &json,
+            PROFILE_MAX_ENTRIES,
+        )
+        .await
+    {
+        tracing::debug!(db = %db, error = %e, "failed to record profiler entry");
+    }
+}
+
+fn current_op_reply(state: &AppState, cmd: &Document) -> Document {
+    // Remaining top-level fields act as a filter over the reported operations
+    let mut filter = Document::new();
+    for (k, v) in cmd.iter() {
+        if k != "currentOp" && !k.starts_with('$') {
+            filter.insert(k.clone(), v.clone());
+        }
+    }
+    let inprog: Vec<Bson> = current_op_entries(state)
+        .into_iter()
+        .filter(|entry| crate::aggregation::exec::document_matches_filter(entry, &filter))
+        .map(Bson::Document)
+        .collect();
+    doc! { "inprog": inprog, "ok": 1.0 }
+}
+
+/// One document per in-progress operation, in `opid` order.
+fn current_op_entries(state: &AppState) -> Vec<Document> {
+    let mut entries = Vec::new();
+    if let Ok(ops) = state.current_ops.lock() {
+        let mut ids: Vec<&u64> = ops.keys().collect();
+        ids.sort();
+        for opid in ids {
+            let op = &ops[opid];
+            let elapsed = op.started.elapsed();
+            let mut entry = doc! {
+                "opid": *opid as i64,
+                "active": true,
+                "op": "command",
+                "ns": op.ns.clone(),
+                "command": op.command.clone(),
+                "secs_running": elapsed.as_secs() as i64,
+                "microsecs_running": elapsed.as_micros() as i64,
+            };
+            if let Some(ref c) = op.comment {
+                entry.insert("comment", c.clone());
+            }
+            if let Some(ref app) = op.app_name {
+                entry.insert("appName", app.clone());
+            }
+            entries.push(entry);
+        }
+    }
+    entries
+}
+
+fn hello_reply(max_bson_object_size: usize) -> Document {
+    doc! {
+        "ismaster": true,
+        "isWritablePrimary": true,
+        "helloOk": true,
+        "minWireVersion": 0i32,
+        // Advertise compatibility for MongoDB 4.2+ clients
+        // Node.js driver v6 requires >= 8
+        "maxWireVersion": 8i32,
+        "maxBsonObjectSize": max_bson_object_size as i32,
+        "maxMessageSizeBytes": 48_000_000i32,
+        "maxWriteBatchSize": MAX_WRITE_BATCH_SIZE as i32,
+        "logicalSessionTimeoutMinutes": crate::session::LOGICAL_SESSION_TIMEOUT_MINUTES as i32,
+        "ok": 1.0
+    }
+}
+
+#[cfg(test)]
+mod hello_tests {
+    use super::hello_reply;
+
+    #[test]
+    fn advertises_wire_version_8() {
+        let d = hello_reply(crate::config::DEFAULT_MAX_BSON_OBJECT_SIZE);
+        assert_eq!(d.get_i32("maxWireVersion").unwrap(), 8);
+        assert!(d.get_bool("helloOk").unwrap_or(false));
+        assert_eq!(
+            d.get_i32("logicalSessionTimeoutMinutes").unwrap() as u64,
+            crate::session::LOGICAL_SESSION_TIMEOUT_MINUTES
+        );
+        assert!(d.get_bool("isWritablePrimary").unwrap_or(false));
+        assert_eq!(d.get_i32("maxBsonObjectSize").unwrap(), 16 * 1024 * 1024);
+    }
+}
+
+fn error_doc(code: i32, msg: impl Into<String>) -> Document {
+    doc! { "ok": 0.0, "errmsg": msg.into(), "code": code, "codeName": code_name(code) }
+}
+
+/// Error reply for a command that needs PostgreSQL on a server started without
+/// `postgres_url`.
+fn no_storage_error() -> Document {
+    error_doc(COMMAND_NOT_SUPPORTED, "No storage configured")
+}
+
+/// Error reply for a failed storage operation, coded from the PostgreSQL message so a
+/// unique violation reads as DuplicateKey and a missing table as NamespaceNotFound.
+fn store_error(msg: String) -> Document {
+    error_doc(store_error_code(&msg), msg)
+}
+
+/// Error for a document that exceeds `maxBsonObjectSize`, or None when it fits.
+fn check_bson_size(state: &AppState, size: usize) -> Option<Document> {
+    if size <= state.max_bson_object_size {
+        return None;
+    }
+    Some(doc! {
+        "code": BSON_OBJECT_TOO_LARGE,
+        "codeName": "BSONObjectTooLarge",
+        "errmsg": format!(
+            "object to insert too large. size in bytes: {}, max size: {}",
+            size, state.max_bson_object_size
+        ),
+    })
+}
+
+/// Error for a document that an update grew past `maxBsonObjectSize`, or grew at all in a
+/// capped collection, whose documents keep their size; None when the update may be written.
+fn check_updated_size(
+    state: &AppState,
+    coll: &str,
+    before: &Document,
+    after: &Document,
+) -> Option<Document> {
+    let size = |d: &Document| bson::to_vec(d).map(|b| b.len()).unwrap_or(0);
+    let new_size = size(after);
+    if new_size > state.max_bson_object_size {
+        return Some(error_doc(
+            BSON_OBJECT_TOO_LARGE,
+            format!(
+                "Resulting document after update is larger than {}",
+                state.max_bson_object_size
+            ),
+        ));
+    }
+    let old_size = size(before);
+    if is_capped(coll) && new_size > old_size {
+        return Some(error_doc(
+            CANNOT_GROW_DOCUMENT_IN_CAPPED_NAMESPACE,
+            format!(
+                "Cannot change the size of a document in a capped collection: {} != {}",
+                old_size, new_size
+            ),
+        ));
+    }
+    None
+}
+
+/// Whether `coll` is capped. The profiler's `system.profile` is the only capped collection;
+/// `create` does not offer the option.
+fn is_capped(coll: &str) -> bool {
+    coll == PROFILE_COLLECTION
+}
+
+/// The validator the documents `cmd` writes to `db.coll` must match: None when the
+/// collection has none or the command sets `bypassDocumentValidation`.
+async fn write_validator(
+    pg: &PgStore,
+    db: &str,
+    coll: &str,
+    cmd: &Document,
+) -> std::result::Result<Option<Validator>, Document> {
+    if cmd.get_bool("bypassDocumentValidation").unwrap_or(false) {
+        return Ok(None);
+    }
+    pg.collection_validator(db, coll)
+        .await
+        .map_err(|e| store_error(format!("validator lookup failed: {}", e)))
+}
+
+/// Error for a document that fails the collection's validator, or None when it passes.
+/// `orig` is the document an update started from: under `validationLevel: "moderate"` one
+/// that already failed may keep failing. Under `validationAction: "warn"` failures are only
+/// logged.
+fn check_validator(
+    validator: Option<&Validator>,
+    doc: &Document,
+    orig: Option<&Document>,
+) -> Option<Document> {
+    let validator = validator?;
+    let passes =
+        |d: &Document| crate::aggregation::exec::document_matches_filter(d, &validator.filter);
+    if passes(doc) || (validator.moderate && orig.is_some_and(|o| !passes(o))) {
+        return None;
+    }
+    let id = doc.get("_id").cloned().unwrap_or(Bson::Null);
+    if validator.warn {
+        tracing::warn!(_id = %id, "document failed validation");
+        return None;
+    }
+    Some(doc! {
+        "code": DOCUMENT_VALIDATION_FAILURE,
+        "codeName": code_name(DOCUMENT_VALIDATION_FAILURE),
+        "errmsg": "Document failed validation",
+        "errInfo": { "failingDocumentId": id },
+    })
+}
+
+/// Whether an update changed a document's stored value. Compares the encoded bytes, as
+/// MongoDB does, so field order, numeric type and NaN all count: `$set` to the same value
+/// leaves a document matched but not modified.
+fn doc_changed(before: &Document, after: &Document) -> bool {
+    match (bson::to_vec(before), bson::to_vec(after)) {
+        (Ok(a), Ok(b)) => a != b,
+        _ => before != after,
+    }
+}
+
+/// Extract $text search parameters from a filter document.
+/// Returns Some((search, language, case_sensitive, diacritic_sensitive)) if $text is present.
+/// Returns None if no $text operator.
+/// Returns error document if $text is malformed or combined with disallowed operators.
+fn extract_text_search_params(
     filter: &Document,
 ) -> std::result::Result<Option<(String, String, bool, bool)>, Document> {
     if let Some(text_val) = filter.get("$text") {
@@ -783,44 +2784,736 @@ fn extract_text_search_params(
             // Extract $search (required)
             let search = match text_doc.get("$search").and_then(|s| s.as_str()) {
                 Some(s) => s.to_string(),
-                None => return Err(error_doc(9, "$text requires $search")),
+                None => return Err(error_doc(FAILED_TO_PARSE, "$text requires $search")),
             };
 
-            // Extract optional parameters
-            let language = text_doc
-                .get("$language")
-                .and_then(|l| l.as_str())
-                .unwrap_or("english")
-                .to_string();
-            let case_sensitive = text_doc
-                .get("$caseSensitive")
-                .and_then(|c| c.as_bool())
-                .unwrap_or(false);
-            let diacritic_sensitive = text_doc
-                .get("$diacriticSensitive")
-                .and_then(|d| d.as_bool())
-                .unwrap_or(false);
+            // Extract optional parameters
+            let language = text_doc
+                .get("$language")
+                .and_then(|l| l.as_str())
+                .unwrap_or("english")
+                .to_string();
+            let case_sensitive = text_doc
+                .get("$caseSensitive")
+                .and_then(|c| c.as_bool())
+                .unwrap_or(false);
+            let diacritic_sensitive = text_doc
+                .get("$diacriticSensitive")
+                .and_then(|d| d.as_bool())
+                .unwrap_or(false);
+
+            // Check for disallowed combinations
+            // $text cannot be combined with $near or $nearSphere
+            if filter.contains_key("$near") || filter.contains_key("$nearSphere") {
+                return Err(error_doc(2, "text query cannot be combined with $near"));
+            }
+
+            return Ok(Some((
+                search,
+                language,
+                case_sensitive,
+                diacritic_sensitive,
+            )));
+        } else {
+            return Err(error_doc(FAILED_TO_PARSE, "$text must be a document"));
+        }
+    }
+    Ok(None)
+}
+
+/// `getDefaultRWConcern`: the cluster-wide read and write concern defaults. There is no
+/// separate on-disk copy, so `inMemory` reads the same ones.
+fn get_default_rw_concern_reply(state: &AppState) -> Document {
+    let mut reply = match state.rw_concern_defaults.lock() {
+        Ok(defaults) => defaults.reply(),
+        Err(_) => return error_doc(1, "read/write concern defaults unavailable"),
+    };
+    reply.insert("ok", 1.0);
+    reply
+}
+
+/// `setDefaultRWConcern`: replace the cluster-wide defaults for as long as the server runs
+/// and reply with the new ones.
+fn set_default_rw_concern_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    if db != Some("admin") {
+        return error_doc(
+            13,
+            "setDefaultRWConcern may only be run against the admin database.",
+        );
+    }
+    let mut reply = match state.rw_concern_defaults.lock() {
+        Ok(mut defaults) => match defaults.set(cmd, CLUSTER_CLOCK.tick()) {
+            Ok(()) => defaults.reply(),
+            Err(msg) => return error_doc(BAD_VALUE, msg),
+        },
+        Err(_) => return error_doc(1, "read/write concern defaults unavailable"),
+    };
+    reply.insert("ok", 1.0);
+    reply
+}
+
+/// `oxidedbGetWriteLimits`: the write limits in force, in writes per second by namespace.
+fn get_write_limits_reply(state: &AppState) -> Document {
+    let limits = crate::write_limits::limits_to_document(&state.write_limiter.limits());
+    doc! { "limits": limits, "ok": 1.0 }
+}
+
+/// `oxidedbSetWriteLimits`: replace every write limit with `limits` for as long as the
+/// server runs; an empty document lifts them all.
+fn set_write_limits_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    if db != Some("admin") {
+        return error_doc(
+            UNAUTHORIZED,
+            "oxidedbSetWriteLimits may only be run against the admin database.",
+        );
+    }
+    let Ok(limits) = cmd.get_document("limits") else {
+        return error_doc(
+            BAD_VALUE,
+            "oxidedbSetWriteLimits requires a limits document",
+        );
+    };
+    match crate::write_limits::limits_from_document(limits) {
+        Ok(limits) => state.write_limiter.set_limits(limits),
+        Err(msg) => return error_doc(BAD_VALUE, msg),
+    }
+    get_write_limits_reply(state)
+}
+
+/// The reply refusing a write command that would go over `write_limits`. It carries the
+/// label drivers retry on: `RetryableWriteError`, or `TransientTransactionError` inside a
+/// transaction, where the whole transaction has to be retried.
+fn write_limit_error(
+    state: &AppState,
+    db: Option<&str>,
+    cmd_name: &str,
+    cmd: &Document,
+) -> Option<Document> {
+    let writes = match cmd_name {
+        "insert" => cmd.get_array("documents").map_or(0, |d| d.len()),
+        "update" => cmd.get_array("updates").map_or(0, |u| u.len()),
+        "delete" => cmd.get_array("deletes").map_or(0, |d| d.len()),
+        // The rest are charged once the stage knows how many it wrote
+        "findAndModify" | "findandmodify" | "aggregate" => 1,
+        _ => return None,
+    };
+    let (dbname, coll) = match cmd_name {
+        "aggregate" => aggregate_write_target(db?, cmd)?,
+        _ => (db?.to_string(), cmd.get_str(cmd_name).ok()?.to_string()),
+    };
+    let ns = state
+        .write_limiter
+        .admit(&dbname, &coll, writes.max(1) as u64)
+        .err()?;
+    let label = if extract_autocommit(cmd) == Some(false) {
+        "TransientTransactionError"
+    } else {
+        "RetryableWriteError"
+    };
+    let mut reply = error_doc(
+        WRITE_RATE_LIMITED,
+        format!("Write rate limit of {} exceeded; retry later", ns),
+    );
+    reply.insert("errorLabels", vec![label]);
+    Some(reply)
+}
+
+/// The namespace an aggregation's final `$out` or `$merge` writes to, as `(db, coll)`.
+/// `$out` always writes to the aggregation's own database.
+fn aggregate_write_target(db: &str, cmd: &Document) -> Option<(String, String)> {
+    let stage = cmd.get_array("pipeline").ok()?.last()?.as_document()?;
+    let target = match (stage.get("$out"), stage.get("$merge")) {
+        (Some(Bson::String(coll)), _) => coll.as_str(),
+        (Some(Bson::Document(out)), _) => out.get_str("coll").ok()?,
+        (_, Some(Bson::Document(merge))) => match merge.get("into")? {
+            Bson::String(coll) => coll.as_str(),
+            Bson::Document(into) => {
+                let into_db = into.get_str("db").unwrap_or(db);
+                return Some((into_db.to_string(), into.get_str("coll").ok()?.to_string()));
+            }
+            _ => return None,
+        },
+        _ => return None,
+    };
+    Some((db.to_string(), target.to_string()))
+}
+
+/// The SASL `payload` of `saslStart` or `saslContinue`, as binary data or a string.
+fn sasl_payload(cmd: &Document) -> Option<Vec<u8>> {
+    match cmd.get("payload")? {
+        Bson::Binary(b) => Some(b.bytes.clone()),
+        Bson::String(s) => Some(s.as_bytes().to_vec()),
+        _ => None,
+    }
+}
+
+fn sasl_reply(payload: &str, done: bool) -> Document {
+    doc! {
+        "conversationId": 1i32,
+        "done": done,
+        "payload": bson::Binary {
+            subtype: bson::spec::BinarySubtype::Generic,
+            bytes: payload.as_bytes().to_vec(),
+        },
+        "ok": 1.0,
+    }
+}
+
+/// The `system.users` document of `user` on `db`, if there is one.
+async fn find_user(
+    pg: &PgStore,
+    user: &str,
+    db: &str,
+) -> std::result::Result<Option<Document>, Document> {
+    let id = crate::users::user_id(user, db);
+    match pg
+        .find_by_id_docs(USERS_DB, USERS_COLLECTION, id.as_bytes(), 1)
+        .await
+    {
+        Ok(mut docs) => Ok(docs.pop()),
+        Err(e) => Err(store_error(format!("user lookup failed: {}", e))),
+    }
+}
+
+/// `saslStart`: begin a SCRAM-SHA-256 conversation for a user of `$db`, the client's
+/// `authSource`. A user that does not exist gets a conversation like any other, which
+/// then fails the same way a wrong password does.
+async fn sasl_start_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let mechanism = cmd.get_str("mechanism").unwrap_or("");
+    if mechanism != crate::scram::SCRAM_MECHANISM {
+        return error_doc(
+            MECHANISM_UNAVAILABLE,
+            format!(
+                "Received authentication for mechanism {} which is not enabled",
+                mechanism
+            ),
+        );
+    }
+    let Some(payload) = sasl_payload(cmd) else {
+        return error_doc(BAD_VALUE, "saslStart requires a payload");
+    };
+    let client_first = match crate::scram::parse_client_first(&String::from_utf8_lossy(&payload)) {
+        Ok(c) => c,
+        Err(e) => return error_doc(BAD_VALUE, e.to_string()),
+    };
+    let Some(ref pg) = state.store else {
+        return no_storage_error();
+    };
+    let generation = state.users_generation.load(Ordering::Acquire);
+    let user = match find_user(pg, &client_first.username, dbname).await {
+        Ok(u) => u,
+        Err(err) => return err,
+    };
+    let credentials = user
+        .as_ref()
+        .and_then(crate::users::credentials_of)
+        .unwrap_or_else(crate::scram::ScramCredentials::unknown_user);
+    let scram = crate::scram::ScramServer::new(&client_first, credentials);
+    let reply = sasl_reply(scram.server_first(), false);
+    let conversation = crate::users::Conversation {
+        user: client_first.username,
+        db: dbname.to_string(),
+        roles: user
+            .as_ref()
+            .map(crate::users::roles_of)
+            .unwrap_or_default(),
+        generation,
+        scram,
+    };
+    let started = CONNECTION_AUTH.try_with(|auth| match auth.lock() {
+        Ok(mut auth) => {
+            auth.conversation = Some(conversation);
+            true
+        }
+        Err(_) => false,
+    });
+    if !matches!(started, Ok(true)) {
+        return error_doc(1, "authentication state unavailable");
+    }
+    reply
+}
+
+/// `saslContinue`: check the client's proof and, when it holds, authenticate the
+/// connection as the conversation's user. A client that does not skip the empty exchange
+/// gets a final empty reply after success.
+fn sasl_continue_reply(cmd: &Document) -> Document {
+    let payload = sasl_payload(cmd).unwrap_or_default();
+    let outcome = CONNECTION_AUTH.try_with(|auth| {
+        let mut auth = auth.lock().ok()?;
+        let Some(conversation) = auth.conversation.take() else {
+            // The empty exchange after a completed conversation
+            return (auth.user.is_some() && payload.is_empty()).then(|| Ok(String::new()));
+        };
+        Some(
+            match conversation
+                .scram
+                .finish(&String::from_utf8_lossy(&payload))
+            {
+                Ok(server_final) => {
+                    tracing::info!(user = %conversation.user, db = %conversation.db, "authenticated");
+                    auth.user = Some(crate::users::AuthenticatedUser {
+                        user: conversation.user,
+                        db: conversation.db,
+                        roles: conversation.roles,
+                        generation: conversation.generation,
+                    });
+                    Ok(server_final)
+                }
+                Err(e) => {
+                    tracing::info!(user = %conversation.user, db = %conversation.db, error = %e, "authentication failed");
+                    Err(())
+                }
+            },
+        )
+    });
+    match outcome.ok().flatten() {
+        Some(Ok(server_final)) => sasl_reply(&server_final, true),
+        _ => error_doc(AUTHENTICATION_FAILED, "Authentication failed."),
+    }
+}
+
+/// `logout`: drop the connection's authenticated user.
+fn logout_reply() -> Document {
+    let _ = CONNECTION_AUTH.try_with(|auth| {
+        if let Ok(mut auth) = auth.lock() {
+            auth.user = None;
+            auth.conversation = None;
+        }
+    });
+    doc! { "ok": 1.0 }
+}
+
+/// The `roles` argument of `createUser` or `updateUser` on `db`.
+fn user_roles_arg(
+    roles: &Bson,
+    db: &str,
+) -> std::result::Result<Vec<crate::users::RoleRef>, Document> {
+    crate::users::parse_roles(roles, db).map_err(|e| match e {
+        crate::users::RoleError::Invalid(msg) => error_doc(BAD_VALUE, msg),
+        crate::users::RoleError::NotFound(msg) => error_doc(ROLE_NOT_FOUND, msg),
+    })
+}
+
+/// The password of `createUser` or `updateUser`.
+fn user_pwd_arg(pwd: &Bson) -> std::result::Result<&str, Document> {
+    match pwd {
+        Bson::String(p) if p.is_empty() => Err(error_doc(BAD_VALUE, "Password cannot be empty")),
+        Bson::String(p) => Ok(p),
+        _ => Err(error_doc(TYPE_MISMATCH, "'pwd' must be a string")),
+    }
+}
+
+/// The error for a `mechanisms` list naming anything but SCRAM-SHA-256, the only
+/// credentials OxideDB computes.
+fn user_mechanisms_error(cmd: &Document) -> Option<Document> {
+    let mechanisms = match cmd.get("mechanisms")? {
+        Bson::Array(m) if !m.is_empty() => m,
+        _ => return Some(error_doc(BAD_VALUE, "mechanisms field must not be empty")),
+    };
+    mechanisms.iter().find_map(|m| match m.as_str() {
+        Some(crate::scram::SCRAM_MECHANISM) => None,
+        Some(other) => Some(error_doc(
+            BAD_VALUE,
+            format!("Unknown auth mechanism '{}'", other),
+        )),
+        None => Some(error_doc(TYPE_MISMATCH, "mechanisms must be strings")),
+    })
+}
+
+/// `createUser`: store a user of `$db` with SCRAM-SHA-256 credentials for `pwd` and the
+/// built-in `roles` it is granted.
+async fn create_user_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let user = match cmd.get_str("createUser") {
+        Ok(u) if !u.is_empty() => u,
+        _ => return error_doc(BAD_VALUE, "User name must be a non-empty string"),
+    };
+    let pwd = match cmd.get("pwd").map(user_pwd_arg) {
+        Some(Ok(p)) => p,
+        Some(Err(err)) => return err,
+        None => {
+            return error_doc(
+                BAD_VALUE,
+                "Must provide a 'pwd' field for all user documents",
+            );
+        }
+    };
+    let roles = match cmd.get("roles").map(|r| user_roles_arg(r, dbname)) {
+        Some(Ok(r)) => r,
+        Some(Err(err)) => return err,
+        None => {
+            return error_doc(
+                BAD_VALUE,
+                "\"createUser\" command requires a \"roles\" array",
+            );
+        }
+    };
+    if let Some(err) = user_mechanisms_error(cmd) {
+        return err;
+    }
+    let Some(ref pg) = state.store else {
+        return no_storage_error();
+    };
+    let credentials = crate::scram::ScramCredentials::derive(pwd);
+    let mut user_doc = crate::users::user_document(user, dbname, &credentials, &roles);
+    if let Ok(custom) = cmd.get_document("customData") {
+        user_doc.insert("customData", custom.clone());
+    }
+    let (bson_bytes, json) = match (
+        bson::to_vec(&user_doc),
+        crate::bson_type::to_jsonb(&user_doc),
+    ) {
+        (Ok(b), Ok(j)) => (b, j),
+        _ => return error_doc(1, "could not encode user document"),
+    };
+    let id = crate::users::user_id(user, dbname);
+    match pg
+        .insert_one(
+            USERS_DB,
+            USERS_COLLECTION,
+            id.as_bytes(),
+            &bson_bytes,
+            &json,
+        )
+        .await
+    {
+        Ok(0) => error_doc(
+            USER_EXISTS,
+            format!("User \"{}@{}\" already exists", user, dbname),
+        ),
+        Ok(_) => doc! { "ok": 1.0 },
+        Err(e) => store_error(format!("createUser failed: {}", e)),
+    }
+}
+
+/// `updateUser`: replace a user's password, roles or `customData`. Connections already
+/// authenticated as the user see new roles on their next command with
+/// `refresh_user_roles`, and once they authenticate again otherwise.
+async fn update_user_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let Ok(user) = cmd.get_str("updateUser") else {
+        return error_doc(BAD_VALUE, "User name must be a non-empty string");
+    };
+    let pwd = match cmd.get("pwd").map(user_pwd_arg).transpose() {
+        Ok(p) => p,
+        Err(err) => return err,
+    };
+    let roles = match cmd
+        .get("roles")
+        .map(|r| user_roles_arg(r, dbname))
+        .transpose()
+    {
+        Ok(r) => r,
+        Err(err) => return err,
+    };
+    let custom = cmd.get_document("customData").ok();
+    if pwd.is_none() && roles.is_none() && custom.is_none() {
+        return error_doc(
+            BAD_VALUE,
+            "Must specify at least one field to update in updateUser",
+        );
+    }
+    let Some(ref pg) = state.store else {
+        return no_storage_error();
+    };
+    let mut user_doc = match existing_user(pg, user, dbname).await {
+        Ok(u) => u,
+        Err(err) => return err,
+    };
+    if let Some(pwd) = pwd {
+        let credentials = crate::scram::ScramCredentials::derive(pwd);
+        user_doc.insert(
+            "credentials",
+            crate::users::credentials_document(&credentials),
+        );
+    }
+    if let Some(roles) = roles {
+        let roles: Vec<Document> = roles.iter().map(|r| r.to_document()).collect();
+        user_doc.insert("roles", roles);
+    }
+    if let Some(custom) = custom {
+        user_doc.insert("customData", custom.clone());
+    }
+    match save_user(state, pg, &user_doc).await {
+        Ok(()) => doc! { "ok": 1.0 },
+        Err(e) => store_error(format!("updateUser failed: {}", e)),
+    }
+}
+
+/// The `system.users` document of `user` on `db`, or the `UserNotFound` reply.
+async fn existing_user(
+    pg: &PgStore,
+    user: &str,
+    db: &str,
+) -> std::result::Result<Document, Document> {
+    match find_user(pg, user, db).await? {
+        Some(u) => Ok(u),
+        None => Err(error_doc(
+            USER_NOT_FOUND,
+            format!("Could not find user \"{}\" for db \"{}\"", user, db),
+        )),
+    }
+}
+
+/// Write back a changed `system.users` document, marking the roles connections hold as
+/// possibly stale.
+async fn save_user(state: &AppState, pg: &PgStore, user_doc: &Document) -> Result<()> {
+    let id = user_doc.get_str("_id").unwrap_or_default();
+    pg.update_doc_by_id(USERS_DB, USERS_COLLECTION, id.as_bytes(), user_doc)
+        .await?;
+    state.users_generation.fetch_add(1, Ordering::AcqRel);
+    Ok(())
+}
+
+/// `dropUser`: remove a user of `$db`. Connections authenticated as the user lose it on
+/// their next command with `refresh_user_roles`, and stay authenticated until they close
+/// or log out otherwise.
+async fn drop_user_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let Ok(user) = cmd.get_str("dropUser") else {
+        return error_doc(BAD_VALUE, "User name must be a non-empty string");
+    };
+    let Some(ref pg) = state.store else {
+        return no_storage_error();
+    };
+    let filter = doc! { "_id": crate::users::user_id(user, dbname) };
+    match pg
+        .delete_one_by_filter(USERS_DB, USERS_COLLECTION, &filter)
+        .await
+    {
+        Ok(0) => error_doc(
+            USER_NOT_FOUND,
+            format!("User \"{}@{}\" not found", user, dbname),
+        ),
+        Ok(_) => {
+            state.users_generation.fetch_add(1, Ordering::AcqRel);
+            doc! { "ok": 1.0 }
+        }
+        Err(e) if e.to_string().contains("does not exist") => error_doc(
+            USER_NOT_FOUND,
+            format!("User \"{}@{}\" not found", user, dbname),
+        ),
+        Err(e) => store_error(format!("dropUser failed: {}", e)),
+    }
+}
+
+/// `grantRolesToUser` and `revokeRolesFromUser`: add `roles` to a user of `$db` or take
+/// them away, replying with the user's roles afterwards. Roles are named as for
+/// `createUser`; granting one the user holds, or revoking one it does not, changes
+/// nothing.
+async fn change_user_roles_reply(
+    state: &AppState,
+    db: Option<&str>,
+    cmd: &Document,
+    grant: bool,
+) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let cmd_name = if grant {
+        "grantRolesToUser"
+    } else {
+        "revokeRolesFromUser"
+    };
+    let Ok(user) = cmd.get_str(cmd_name) else {
+        return error_doc(BAD_VALUE, "User name must be a non-empty string");
+    };
+    let changed = match cmd.get("roles").map(|r| user_roles_arg(r, dbname)) {
+        Some(Ok(r)) if !r.is_empty() => r,
+        Some(Err(err)) => return err,
+        _ => {
+            return error_doc(
+                BAD_VALUE,
+                format!(
+                    "\"{}\" command requires a non-empty \"roles\" array",
+                    cmd_name
+                ),
+            );
+        }
+    };
+    let Some(ref pg) = state.store else {
+        return no_storage_error();
+    };
+    let mut user_doc = match existing_user(pg, user, dbname).await {
+        Ok(u) => u,
+        Err(err) => return err,
+    };
+    let mut roles = crate::users::roles_of(&user_doc);
+    if grant {
+        for role in changed {
+            if !roles.contains(&role) {
+                roles.push(role);
+            }
+        }
+    } else {
+        roles.retain(|r| !changed.contains(r));
+    }
+    let roles: Vec<Document> = roles.iter().map(|r| r.to_document()).collect();
+    user_doc.insert("roles", roles.clone());
+    match save_user(state, pg, &user_doc).await {
+        Ok(()) => doc! { "roles": roles, "ok": 1.0 },
+        Err(e) => store_error(format!("{} failed: {}", cmd_name, e)),
+    }
+}
 
-            // Check for disallowed combinations
-            // $text cannot be combined with $near or $nearSphere
-            if filter.contains_key("$near") || filter.contains_key("$nearSphere") {
-                return Err(error_doc(2, "text query cannot be combined with $near"));
+/// `dropAllUsersFromDatabase`: remove every user of `$db`, replying with how many there
+/// were.
+async fn drop_all_users_reply(state: &AppState, db: Option<&str>) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let Some(ref pg) = state.store else {
+        return no_storage_error();
+    };
+    match pg
+        .delete_many_by_filter(USERS_DB, USERS_COLLECTION, &doc! { "db": dbname })
+        .await
+    {
+        Ok(n) => {
+            if n > 0 {
+                state.users_generation.fetch_add(1, Ordering::AcqRel);
             }
+            doc! { "n": n as i32, "ok": 1.0 }
+        }
+        Err(e) if e.to_string().contains("does not exist") => doc! { "n": 0i32, "ok": 1.0 },
+        Err(e) => store_error(format!("dropAllUsersFromDatabase failed: {}", e)),
+    }
+}
 
-            return Ok(Some((
-                search,
-                language,
-                case_sensitive,
-                diacritic_sensitive,
-            )));
-        } else {
-            return Err(error_doc(9, "$text must be a document"));
+/// With `refresh_user_roles`, the connection's user as it stands after changes made to
+/// users since it last looked: its current roles, or no user once it has been dropped.
+/// Without the setting, or when nothing changed, the user as it authenticated.
+async fn refreshed_user(
+    state: &AppState,
+    user: crate::users::AuthenticatedUser,
+) -> Option<crate::users::AuthenticatedUser> {
+    let generation = state.users_generation.load(Ordering::Acquire);
+    if !state.refresh_user_roles || user.generation == generation {
+        return Some(user);
+    }
+    let Some(ref pg) = state.store else {
+        return Some(user);
+    };
+    let refreshed = match find_user(pg, &user.user, &user.db).await {
+        Ok(Some(doc)) => Some(crate::users::AuthenticatedUser {
+            roles: crate::users::roles_of(&doc),
+            generation,
+            ..user
+        }),
+        Ok(None) => {
+            tracing::info!(user = %user.user, db = %user.db, "authenticated user was dropped");
+            None
+        }
+        Err(_) => return Some(user),
+    };
+    let _ = CONNECTION_AUTH.try_with(|auth| {
+        if let Ok(mut auth) = auth.lock() {
+            auth.user = refreshed.clone();
         }
+    });
+    refreshed
+}
+
+/// The `_id`s of the users a `usersInfo` argument names on `db`: a name, a `{user, db}`
+/// document, or a list of either.
+fn users_info_ids(arg: &Bson, db: &str) -> std::result::Result<Vec<Bson>, Document> {
+    let id = |item: &Bson| match item {
+        Bson::String(user) => Ok(Bson::String(crate::users::user_id(user, db))),
+        Bson::Document(d) => match (d.get_str("user"), d.get_str("db")) {
+            (Ok(user), Ok(user_db)) => Ok(Bson::String(crate::users::user_id(user, user_db))),
+            _ => Err(error_doc(
+                BAD_VALUE,
+                "User documents must have string fields 'user' and 'db'",
+            )),
+        },
+        _ => Err(error_doc(
+            BAD_VALUE,
+            "usersInfo must name users by name or {user, db} document",
+        )),
+    };
+    match arg {
+        Bson::Array(items) => items.iter().map(id).collect(),
+        item => Ok(vec![id(item)?]),
+    }
+}
+
+/// `usersInfo`: the users of `$db` (`usersInfo: 1`), of every database
+/// (`{forAllDBs: true}`) or those named, optionally narrowed by `filter`. Credentials are
+/// left out unless `showCredentials` is set; `customData` is shown unless
+/// `showCustomData` is false.
+async fn users_info_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let arg = cmd.get("usersInfo").cloned().unwrap_or(Bson::Null);
+    let for_all_dbs = matches!(&arg, Bson::Document(d) if d.get_bool("forAllDBs").unwrap_or(false));
+    let mut filter = if for_all_dbs {
+        if dbname != USERS_DB {
+            return error_doc(
+                BAD_VALUE,
+                "usersInfo with forAllDBs must be run against the admin database",
+            );
+        }
+        Document::new()
+    } else if bson_number(Some(&arg)) == Some(1) {
+        doc! { "db": dbname }
+    } else {
+        match users_info_ids(&arg, dbname) {
+            Ok(ids) => doc! { "_id": { "$in": ids } },
+            Err(err) => return err,
+        }
+    };
+    match cmd.get("filter") {
+        None => {}
+        Some(Bson::Document(f)) => {
+            filter = doc! { "$and": [filter, f.clone()] };
+        }
+        Some(_) => return error_doc(TYPE_MISMATCH, "'filter' must be a document"),
+    }
+    let show_credentials = cmd.get_bool("showCredentials").unwrap_or(false);
+    let show_custom_data = cmd.get_bool("showCustomData").unwrap_or(true);
+    let Some(ref pg) = state.store else {
+        return no_storage_error();
+    };
+    match pg
+        .find_docs(
+            USERS_DB,
+            USERS_COLLECTION,
+            Some(&filter),
+            Some(&doc! { "_id": 1 }),
+            None,
+            i64::MAX,
+        )
+        .await
+    {
+        Ok(users) => {
+            let users: Vec<Document> = users
+                .iter()
+                .map(|u| crate::users::user_info(u, show_credentials, show_custom_data))
+                .collect();
+            doc! { "users": users, "ok": 1.0 }
+        }
+        Err(e) => store_error(format!("usersInfo failed: {}", e)),
     }
-    Ok(None)
 }
 
-fn build_info_reply() -> Document {
+fn build_info_reply(max_bson_object_size: usize) -> Document {
     doc! {
         "version": env!("CARGO_PKG_VERSION"),
         "gitVersion": "",
@@ -831,7 +3524,7 @@ fn build_info_reply() -> Document {
         "javascriptEngine": "none",
         "bits": 64i32,
         "debug": false,
-        "maxBsonObjectSize": 16_777_216i32,
+        "maxBsonObjectSize": max_bson_object_size as i32,
         "ok": 1.0
     }
 }
@@ -865,10 +3558,24 @@ async fn list_databases_reply(state: &AppState, cmd: &Document) -> Document {
     reply
 }
 
-async fn list_collections_reply(state: &AppState, db: Option<&str>) -> Document {
+async fn list_collections_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
     let dbname = db.unwrap_or("");
+    let filter = match cmd.get("filter") {
+        None | Some(Bson::Null) => Document::new(),
+        Some(Bson::Document(f)) => f.clone(),
+        Some(other) => {
+            return error_doc(
+                14,
+                format!(
+                    "\"filter\" had the wrong type. Expected object, found {}",
+                    crate::bson_type::alias_of(other)
+                ),
+            );
+        }
+    };
+    let name_only = cmd.get_bool("nameOnly").unwrap_or(false);
     let names = if let Some(ref pg) = state.store {
-        match pg.list_collections(dbname).await {
+        match pg.list_collections_with_options(dbname).await {
             Ok(v) => v,
             Err(e) => {
                 tracing::warn!(error = %format!("{e:?}"), "list_collections failed; returning empty");
@@ -879,13 +3586,23 @@ async fn list_collections_reply(state: &AppState, db: Option<&str>) -> Document
         Vec::new()
     };
     let mut first_batch = Vec::with_capacity(names.len());
-    for n in names {
-        first_batch.push(doc! {
-            "name": n,
-            "type": "collection",
-            "options": doc!{},
-            "info": doc!{"readOnly": false},
-        });
+    for (n, options) in names {
+        let entry = collection_info(n, options);
+        // The filter matches against the full entry, as MongoDB does with nameOnly
+        if !crate::aggregation::exec::document_matches_filter(&entry, &filter) {
+            continue;
+        }
+        if name_only {
+            let mut short = Document::new();
+            for key in ["name", "type"] {
+                if let Some(v) = entry.get(key) {
+                    short.insert(key, v.clone());
+                }
+            }
+            first_batch.push(short);
+        } else {
+            first_batch.push(entry);
+        }
     }
     let ns = format!("{}.$cmd.listCollections", dbname);
     doc! {
@@ -894,41 +3611,512 @@ async fn list_collections_reply(state: &AppState, db: Option<&str>) -> Document
     }
 }
 
-fn parse_db_from_fqn(fqn: &str) -> Option<String> {
-    // format: "<db>.$cmd" or "<db>.<coll>"
-    fqn.split('.').next().map(|s| s.to_string())
-}
-
-async fn server_status_reply(state: &AppState) -> Document {
-    let uptime = state.started_at.elapsed().as_secs_f64();
-    doc! {
-        "version": env!("CARGO_PKG_VERSION"),
-        "process": "oxidedb",
-        "uptime": uptime,
-        "ok": 1.0
+/// The `listCollections` entry for collection `name`, created with `options`.
+fn collection_info(name: String, options: Document) -> Document {
+    if options.contains_key("viewOn") {
+        return doc! {
+            "name": name,
+            "type": "view",
+            "options": options,
+            "info": {"readOnly": true},
+        };
+    }
+    doc! {
+        "name": name,
+        "type": "collection",
+        "options": options,
+        "info": {"readOnly": false},
+        "idIndex": {"v": 2i32, "key": {"_id": 1i32}, "name": "_id_"},
+    }
+}
+
+fn parse_db_from_fqn(fqn: &str) -> Option<String> {
+    // format: "<db>.$cmd" or "<db>.<coll>"
+    fqn.split('.').next().map(|s| s.to_string())
+}
+
+async fn server_status_reply(state: &AppState) -> Document {
+    let uptime = state.started_at.elapsed().as_secs_f64();
+    let mut reply = doc! {
+        "version": env!("CARGO_PKG_VERSION"),
+        "process": "oxidedb",
+        "uptime": uptime,
+    };
+    if let Some(pg) = &state.store {
+        let stats = pg.statement_cache_stats();
+        reply.insert(
+            "statementCache",
+            doc! {
+                "capacity": stats.capacity as i64,
+                "size": stats.size as i64,
+                "hits": stats.hits as i64,
+                "misses": stats.misses as i64,
+                "evictions": stats.evictions as i64,
+            },
+        );
+    }
+    reply.insert("ok", 1.0);
+    reply
+}
+
+async fn shadow_metrics_reply(state: &AppState) -> Document {
+    let attempts = state
+        .shadow_attempts
+        .load(std::sync::atomic::Ordering::Relaxed);
+    let matches = state
+        .shadow_matches
+        .load(std::sync::atomic::Ordering::Relaxed);
+    let mismatches = state
+        .shadow_mismatches
+        .load(std::sync::atomic::Ordering::Relaxed);
+    let timeouts = state
+        .shadow_timeouts
+        .load(std::sync::atomic::Ordering::Relaxed);
+
+    doc! {
+        "shadow": {
+            "attempts": attempts as i64,
+            "matches": matches as i64,
+            "mismatches": mismatches as i64,
+            "timeouts": timeouts as i64,
+        },
+        "ok": 1.0
+    }
+}
+
+/// `oxidedbDryRunBulkWrite`, an OxideDB extension: runs the `ops` of a bulk write on one
+/// collection, written as the shell's `bulkWrite` takes them, inside a transaction that is
+/// rolled back. Each operation goes through the ordinary `insert`, `update` or `delete`
+/// path, so the reply shows the counts and write errors the bulk write would produce
+/// without changing any data.
+async fn dry_run_bulk_write_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let coll = match cmd.get_str("oxidedbDryRunBulkWrite") {
+        Ok(c) => c,
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid oxidedbDryRunBulkWrite"),
+    };
+    let ops = match cmd.get_array("ops") {
+        Ok(a) if !a.is_empty() => a,
+        _ => return error_doc(FAILED_TO_PARSE, "Missing ops"),
+    };
+    let ordered = cmd.get_bool("ordered").unwrap_or(true);
+    let mut commands = Vec::with_capacity(ops.len());
+    for op in ops {
+        match bulk_op_command(coll, op) {
+            Ok(c) => commands.push(c),
+            Err(err_doc) => return err_doc,
+        }
+    }
+    let pg = match &state.store {
+        Some(pg) => pg,
+        None => return no_storage_error(),
+    };
+    let run = async {
+        let (mut inserted, mut matched, mut modified, mut deleted) = (0i64, 0i64, 0i64, 0i64);
+        let mut upserted: Vec<Document> = Vec::new();
+        let mut write_errors: Vec<Document> = Vec::new();
+        for (i, mut command) in commands.into_iter().enumerate() {
+            // A failed operation is undone on its own, leaving the rest of the run usable
+            pg.savepoint("bulk_op").await?;
+            let reply = match command.keys().next().map(String::as_str) {
+                Some("insert") => insert_reply(state, Some(dbname), &mut command).await,
+                Some("update") => {
+                    crate::store::with_index_hints(update_reply(state, Some(dbname), &command))
+                        .await
+                }
+                _ => {
+                    crate::store::with_index_hints(delete_reply(state, Some(dbname), &command))
+                        .await
+                }
+            };
+            let error = if reply.get_f64("ok").unwrap_or(0.0) != 1.0 {
+                let mut e = doc! {"index": i as i32};
+                for key in ["code", "codeName", "errmsg"] {
+                    if let Some(v) = reply.get(key) {
+                        e.insert(key, v.clone());
+                    }
+                }
+                Some(e)
+            } else if let Ok(errors) = reply.get_array("writeErrors")
+                && let Some(Bson::Document(first)) = errors.first()
+            {
+                let mut e = first.clone();
+                e.insert("index", i as i32);
+                Some(e)
+            } else {
+                None
+            };
+            if let Some(e) = error {
+                pg.rollback_to_savepoint("bulk_op").await?;
+                write_errors.push(e);
+                if ordered {
+                    break;
+                }
+                continue;
+            }
+            let n = bson_number(reply.get("n")).unwrap_or(0);
+            match command.keys().next().map(String::as_str) {
+                Some("insert") => inserted += n,
+                Some("update") => {
+                    let ups = reply
+                        .get_array("upserted")
+                        .map(|u| u.as_slice())
+                        .unwrap_or(&[]);
+                    for up in ups.iter().filter_map(Bson::as_document) {
+                        let id = up.get("_id").cloned().unwrap_or(Bson::Null);
+                        upserted.push(doc! {"index": i as i32, "_id": id});
+                    }
+                    matched += n - ups.len() as i64;
+                    modified += bson_number(reply.get("nModified")).unwrap_or(0);
+                }
+                _ => deleted += n,
+            }
+        }
+        let mut reply = doc! {
+            "dryRun": true,
+            "nInserted": inserted,
+            "nMatched": matched,
+            "nModified": modified,
+            "nDeleted": deleted,
+            "nUpserted": upserted.len() as i64,
+            "upserted": upserted,
+        };
+        if !write_errors.is_empty() {
+            reply.insert("writeErrors", write_errors);
+        }
+        reply.insert("ok", 1.0);
+        Ok::<Document, crate::error::Error>(reply)
+    };
+    match pg.dry_run(run).await {
+        Ok(Ok(reply)) => reply,
+        Ok(Err(e)) | Err(e) => store_error(e.to_string()),
+    }
+}
+
+/// The single-operation `insert`, `update` or `delete` command carrying out bulk write
+/// operation `op` (`{insertOne: {...}}`, `{updateMany: {...}}` and so on) on `coll`.
+fn bulk_op_command(coll: &str, op: &Bson) -> std::result::Result<Document, Document> {
+    let Some((kind, Bson::Document(args))) = op.as_document().and_then(|d| d.iter().next()) else {
+        return Err(error_doc(
+            FAILED_TO_PARSE,
+            "Each bulk write operation must be an object",
+        ));
+    };
+    let field = |name: &str| -> std::result::Result<Bson, Document> {
+        args.get(name)
+            .cloned()
+            .ok_or_else(|| error_doc(FAILED_TO_PARSE, format!("{} requires '{}'", kind, name)))
+    };
+    let mut statement = Document::new();
+    match kind.as_str() {
+        "insertOne" => Ok(doc! {"insert": coll, "documents": [field("document")?]}),
+        "updateOne" | "updateMany" | "replaceOne" => {
+            statement.insert("q", field("filter")?);
+            let u = if kind == "replaceOne" {
+                field("replacement")?
+            } else {
+                field("update")?
+            };
+            statement.insert("u", u);
+            statement.insert("multi", kind == "updateMany");
+            for key in ["upsert", "collation", "arrayFilters", "hint"] {
+                if let Some(v) = args.get(key) {
+                    statement.insert(key, v.clone());
+                }
+            }
+            Ok(doc! {"update": coll, "updates": [statement]})
+        }
+        "deleteOne" | "deleteMany" => {
+            statement.insert("q", field("filter")?);
+            statement.insert("limit", if kind == "deleteOne" { 1i32 } else { 0i32 });
+            for key in ["collation", "hint"] {
+                if let Some(v) = args.get(key) {
+                    statement.insert(key, v.clone());
+                }
+            }
+            Ok(doc! {"delete": coll, "deletes": [statement]})
+        }
+        other => Err(error_doc(
+            BAD_VALUE,
+            format!("Unknown bulk write operation: {}", other),
+        )),
+    }
+}
+
+/// `oxidedbExportExtendedJson`, an OxideDB extension for debugging: runs a `find` with the
+/// command's `filter`, `sort`, `projection`, `hint`, `collation` and `limit` (101 by
+/// default) and returns each document as a canonical Extended JSON string, which keeps
+/// every BSON type (`$numberInt`, `$numberLong`, `$date`, ...) visible.
+async fn export_extended_json_reply(
+    state: &AppState,
+    db: Option<&str>,
+    cmd: &Document,
+) -> Document {
+    let coll = match cmd.get_str("oxidedbExportExtendedJson") {
+        Ok(c) => c,
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid oxidedbExportExtendedJson"),
+    };
+    let mut find = doc! {"find": coll};
+    for key in ["filter", "sort", "projection", "hint", "collation"] {
+        if let Some(v) = cmd.get(key) {
+            find.insert(key, v.clone());
+        }
+    }
+    let limit = match bson_number(cmd.get("limit")) {
+        Some(n) if n > 0 => n,
+        Some(n) if n < 0 => return error_doc(BAD_VALUE, "limit must be non-negative"),
+        _ => DEFAULT_BATCH_SIZE,
+    };
+    find.insert("limit", limit);
+    find.insert("singleBatch", true);
+    let reply = find_reply(state, db, &find).await;
+    let Ok(batch) = reply
+        .get_document("cursor")
+        .and_then(|c| c.get_array("firstBatch"))
+    else {
+        return reply;
+    };
+    let documents: Vec<String> = batch
+        .iter()
+        .map(|d| d.clone().into_canonical_extjson().to_string())
+        .collect();
+    doc! {
+        "ns": format!("{}.{}", db.unwrap_or_default(), coll),
+        "documents": documents,
+        "ok": 1.0,
+    }
+}
+
+/// `oxidedbExplainSQL`, an OxideDB extension for debugging: takes a `find` or `aggregate`
+/// command and returns, without running it, the statement OxideDB would send PostgreSQL to
+/// read the collection, with the literal values it binds listed apart from the SQL text.
+/// `inMemory` reports filter conditions checked after the rows are read, `engineStages` the
+/// pipeline stages the engine runs over them. Nothing is redacted: the statement names the
+/// schema and table and the parameters carry the filter's values.
+async fn explain_sql_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let inner = match cmd.get_document("oxidedbExplainSQL") {
+        Ok(d) => d,
+        Err(_) => {
+            return error_doc(
+                FAILED_TO_PARSE,
+                "oxidedbExplainSQL requires a find or aggregate command",
+            );
+        }
+    };
+    let pg = match state.store.as_ref() {
+        Some(pg) => pg,
+        None => return no_storage_error(),
+    };
+    let reply = match inner.iter().next().map(|(k, v)| (k.as_str(), v)) {
+        Some(("find", Bson::String(coll))) => match pg.view_definition(dbname, coll).await {
+            Ok(Some(_)) => {
+                let agg = find_on_view_command(coll, inner);
+                explain_aggregate_sql(pg, dbname, coll, &agg).await
+            }
+            _ => explain_find_sql(pg, dbname, coll, inner).await,
+        },
+        Some(("aggregate", Bson::String(coll))) => {
+            explain_aggregate_sql(pg, dbname, coll, inner).await
+        }
+        Some(("aggregate", _)) => Err(error_doc(
+            BAD_VALUE,
+            "oxidedbExplainSQL needs an aggregate on a collection; {aggregate: 1} reads none",
+        )),
+        _ => {
+            let name = inner.keys().next().map(String::as_str).unwrap_or("");
+            Err(error_doc(
+                COMMAND_NOT_FOUND,
+                format!("oxidedbExplainSQL is not implemented for '{}'", name),
+            ))
+        }
+    };
+    match reply {
+        Ok(mut reply) => {
+            reply.insert("ok", 1.0);
+            reply
+        }
+        Err(err_doc) => err_doc,
+    }
+}
+
+/// The statement `find` sends, taking its filter, sort, projection and limit the way
+/// [`find_reply`] does.
+async fn explain_find_sql(
+    pg: &PgStore,
+    dbname: &str,
+    coll: &str,
+    cmd: &Document,
+) -> std::result::Result<Document, Document> {
+    let limit = bson_number(cmd.get("limit")).unwrap_or(0).saturating_abs();
+    let filter = cmd
+        .get_document("filter")
+        .ok()
+        .or(cmd.get_document("query").ok());
+    let vars = command_vars_arg(cmd, bson::DateTime::now())?;
+    let bound_filter = filter.map(|f| bind_expr_filter(f, &vars)).transpose()?;
+    let filter = bound_filter.as_ref();
+    if filter.is_some_and(|f| f.contains_key("$text")) {
+        return Err(error_doc(
+            BAD_VALUE,
+            "oxidedbExplainSQL does not support $text queries",
+        ));
+    }
+    let natural_hint = cmd
+        .get_document("hint")
+        .ok()
+        .filter(|h| h.len() == 1 && h.contains_key("$natural"));
+    let sort = cmd.get_document("sort").ok().or(natural_hint);
+    let projection = cmd.get_document("projection").ok();
+    let positional = match projection.map(split_positional) {
+        Some(Ok(p)) => p,
+        Some(Err(e)) => return Err(error_doc(e.code, e.message)),
+        None => None,
+    };
+    let projection = positional.as_ref().map(|(spec, _)| spec).or(projection);
+    let collation = effective_collation(pg, dbname, coll, cmd).await?;
+
+    let mut reply = doc! {"namespace": format!("{}.{}", dbname, coll)};
+    // `$where` and `$jsonSchema` conditions are matched in memory over every document
+    // their siblings select, read whole and unlimited
+    if filter.is_some_and(crate::js::nested_where) {
+        return Err(nested_where_error());
+    }
+    let (filter, projection, fetch_limit) = match filter {
+        Some(f) if f.contains_key("$where") || crate::json_schema::in_filter(f) => {
+            let (mut sql, mut in_memory) = crate::json_schema::split_filter(f);
+            let fetch_limit = match sql.remove("$where") {
+                Some(code) => {
+                    in_memory.insert("$where", code);
+                    WHERE_SCAN_LIMIT + 1
+                }
+                None => i64::MAX,
+            };
+            reply.insert("inMemory", in_memory);
+            (Some(sql).filter(|f| !f.is_empty()), None, fetch_limit)
+        }
+        _ => (
+            filter.cloned(),
+            projection,
+            if limit > 0 { limit } else { i64::MAX },
+        ),
+    };
+    let id_bytes = filter
+        .as_ref()
+        .and_then(|f| f.get("_id"))
+        .and_then(id_bytes_bson);
+    let (sql, parameters) = match id_bytes {
+        Some(id) => {
+            let id_hex: String = id.iter().map(|b| format!("{:02x}", b)).collect();
+            (
+                pg.find_by_id_statement(dbname, coll),
+                vec![format!("\\x{}", id_hex), fetch_limit.to_string()],
+            )
+        }
+        None => pg.find_statement(
+            dbname,
+            coll,
+            filter.as_ref(),
+            sort,
+            projection,
+            fetch_limit,
+            collation.as_ref(),
+        ),
+    };
+    reply.insert("sql", sql);
+    reply.insert("parameters", parameters);
+    Ok(reply)
+}
+
+/// The statement an `aggregate` reads its collection with: the held cursor of a pipeline
+/// PostgreSQL answers whole, else the read feeding the stages after those it answers.
+async fn explain_aggregate_sql(
+    pg: &PgStore,
+    dbname: &str,
+    coll: &str,
+    cmd: &Document,
+) -> std::result::Result<Document, Document> {
+    use crate::aggregation::exec::{ENGINE_READ_LIMIT, pushdown_query, source_query};
+
+    let mut pipeline = crate::aggregation::Pipeline::parse(cmd)
+        .map_err(|e| error_doc(FAILED_TO_PARSE, format!("Failed to parse pipeline: {}", e)))?;
+    let (source, view_stages) = resolve_view(pg, dbname, coll).await?;
+    pipeline.stages.splice(0..0, view_stages);
+    let vars = command_vars_arg(cmd, bson::DateTime::now())?;
+    for stage in pipeline.stages.iter_mut() {
+        if let crate::aggregation::Stage::Match(filter) = stage {
+            *filter = crate::aggregation::expr::bind_filter_vars(filter, &vars);
+        }
+    }
+    let collation = effective_collation(pg, dbname, &source, cmd).await?;
+
+    let (sql, parameters, engine_stages) = if let Some(query) = pushdown_query(&pipeline.stages) {
+        let (sql, parameters) = pg.doc_cursor_statement(
+            dbname,
+            &source,
+            query.filter.as_ref(),
+            query.sort.as_ref(),
+            query.skip,
+            query.limit,
+            collation.as_ref(),
+        );
+        (sql, parameters, Vec::new())
+    } else {
+        let Some((query, fused)) = source_query(&pipeline.stages, pipeline.options.allow_disk_use)
+        else {
+            let first = pipeline.stages.first().map_or("", |s| s.name());
+            return Err(error_doc(
+                BAD_VALUE,
+                format!(
+                    "oxidedbExplainSQL cannot show the query of a pipeline starting with {}",
+                    first
+                ),
+            ));
+        };
+        let (sql, parameters) = pg.find_statement(
+            dbname,
+            &source,
+            query.filter.as_ref(),
+            query.sort.as_ref(),
+            None,
+            query.limit.unwrap_or(ENGINE_READ_LIMIT),
+            collation.as_ref(),
+        );
+        let engine_stages: Vec<&str> = pipeline.stages[fused..].iter().map(|s| s.name()).collect();
+        (sql, parameters, engine_stages)
+    };
+    let mut reply = doc! {
+        "namespace": format!("{}.{}", dbname, source),
+        "sql": sql,
+        "parameters": parameters,
+    };
+    if !engine_stages.is_empty() {
+        reply.insert("engineStages", engine_stages);
     }
+    Ok(reply)
 }
 
-async fn shadow_metrics_reply(state: &AppState) -> Document {
-    let attempts = state
-        .shadow_attempts
-        .load(std::sync::atomic::Ordering::Relaxed);
-    let matches = state
-        .shadow_matches
-        .load(std::sync::atomic::Ordering::Relaxed);
-    let mismatches = state
-        .shadow_mismatches
-        .load(std::sync::atomic::Ordering::Relaxed);
-    let timeouts = state
-        .shadow_timeouts
-        .load(std::sync::atomic::Ordering::Relaxed);
-
+/// Flush the store's metadata caches, reporting how many entries each held.
+async fn clear_cache_reply(state: &AppState) -> Document {
+    let pg = match &state.store {
+        Some(pg) => pg,
+        None => return no_storage_error(),
+    };
+    let cleared = pg.clear_caches().await;
+    tracing::info!(?cleared, "cleared metadata caches");
     doc! {
-        "shadow": {
-            "attempts": attempts as i64,
-            "matches": matches as i64,
-            "mismatches": mismatches as i64,
-            "timeouts": timeouts as i64,
+        "cleared": {
+            "databases": cleared.databases as i64,
+            "collections": cleared.collections as i64,
+            "collations": cleared.collations as i64,
+            "views": cleared.views as i64,
+            "statements": cleared.statements as i64,
         },
         "ok": 1.0
     }
@@ -952,7 +4140,7 @@ async fn metrics_reply(state: &AppState) -> String {
     let shadow_mismatches = state.shadow_mismatches.load(Ordering::Relaxed);
     let shadow_timeouts = state.shadow_timeouts.load(Ordering::Relaxed);
 
-    format!(
+    let mut out = format!(
         "# HELP oxidedb_requests_total Total number of requests\n\
          # TYPE oxidedb_requests_total counter\n\
          oxidedb_requests_total {}\n\n\
@@ -1005,79 +4193,751 @@ async fn metrics_reply(state: &AppState) -> String {
         shadow_matches,
         shadow_mismatches,
         shadow_timeouts,
-    )
+    );
+
+    if let Some(pg) = state.store.as_ref() {
+        let status = pg.pool().status();
+        out.push_str(&format!(
+            "\n# HELP oxidedb_pg_pool_max_size Maximum number of backend connections\n\
+             # TYPE oxidedb_pg_pool_max_size gauge\n\
+             oxidedb_pg_pool_max_size {}\n\n\
+             # HELP oxidedb_pg_pool_size Backend connections currently open\n\
+             # TYPE oxidedb_pg_pool_size gauge\n\
+             oxidedb_pg_pool_size {}\n\n\
+             # HELP oxidedb_pg_pool_available Idle backend connections\n\
+             # TYPE oxidedb_pg_pool_available gauge\n\
+             oxidedb_pg_pool_available {}\n\n\
+             # HELP oxidedb_pg_pool_waiting Requests waiting for a backend connection\n\
+             # TYPE oxidedb_pg_pool_waiting gauge\n\
+             oxidedb_pg_pool_waiting {}\n",
+            status.max_size,
+            status.size,
+            status.available.max(0),
+            (-status.available).max(0),
+        ));
+    }
+
+    out.push('\n');
+    state.command_metrics.render(&mut out);
+    state.write_limiter.render(&mut out);
+    out
+}
+
+async fn bind_metrics_listener(cfg: &Config) -> Result<Option<TcpListener>> {
+    match cfg.metrics_addr {
+        Some(ref addr) => {
+            let listener = TcpListener::bind(addr).await?;
+            tracing::info!(metrics_addr = %listener.local_addr()?, "metrics endpoint listening");
+            Ok(Some(listener))
+        }
+        None => Ok(None),
+    }
+}
+
+/// Serve the Prometheus text exposition on `GET /metrics` over plain HTTP/1.1.
+async fn serve_metrics(listener: TcpListener, state: Arc<AppState>) {
+    loop {
+        let (mut socket, addr) = match listener.accept().await {
+            Ok(v) => v,
+            Err(e) => {
+                tracing::error!(error = %format!("{e:?}"), "failed to accept metrics connection");
+                continue;
+            }
+        };
+        tracing::debug!(%addr, "accepted metrics connection");
+        let state = state.clone();
+        tokio::spawn(async move {
+            if let Err(e) = handle_metrics_http(&state, &mut socket).await {
+                tracing::debug!(error = %format!("{e:?}"), "metrics connection closed with error");
+            }
+        });
+    }
+}
+
+/// Method and path (without query string) of an HTTP/1.1 request. Only the request head is
+/// read; scrapers and probes don't send bodies.
+async fn read_http_request(socket: &mut TcpStream) -> std::io::Result<(String, String)> {
+    let mut buf = Vec::with_capacity(1024);
+    let mut chunk = [0u8; 1024];
+    while !buf.windows(4).any(|w| w == b"\r\n\r\n") && buf.len() < 8192 {
+        let n = socket.read(&mut chunk).await?;
+        if n == 0 {
+            break;
+        }
+        buf.extend_from_slice(&chunk[..n]);
+    }
+    let head = String::from_utf8_lossy(&buf);
+    let mut request_line = head.lines().next().unwrap_or("").split_whitespace();
+    let method = request_line.next().unwrap_or("");
+    let path = request_line.next().unwrap_or("");
+    let path = path.split('?').next().unwrap_or("");
+    Ok((method.to_string(), path.to_string()))
+}
+
+/// Write a complete response and close the connection.
+async fn write_http_response(
+    socket: &mut TcpStream,
+    status: &str,
+    content_type: &str,
+    body: &str,
+) -> std::io::Result<()> {
+    let response = format!(
+        "HTTP/1.1 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+        status,
+        content_type,
+        body.len(),
+        body
+    );
+    socket.write_all(response.as_bytes()).await?;
+    socket.shutdown().await
+}
+
+async fn handle_metrics_http(state: &AppState, socket: &mut TcpStream) -> std::io::Result<()> {
+    let (method, path) = read_http_request(socket).await?;
+    let (status, content_type, body) = match (method.as_str(), path.as_str()) {
+        ("GET", "/metrics") => (
+            "200 OK",
+            "text/plain; version=0.0.4; charset=utf-8",
+            metrics_reply(state).await,
+        ),
+        ("GET", _) => (
+            "404 Not Found",
+            "text/plain; charset=utf-8",
+            "not found\n".to_string(),
+        ),
+        _ => (
+            "405 Method Not Allowed",
+            "text/plain; charset=utf-8",
+            "method not allowed\n".to_string(),
+        ),
+    };
+    write_http_response(socket, status, content_type, &body).await
+}
+
+/// How long `/readyz` waits for a PostgreSQL connection before reporting not ready.
+const READINESS_TIMEOUT: Duration = Duration::from_secs(2);
+
+async fn bind_health_listener(cfg: &Config) -> Result<Option<TcpListener>> {
+    match cfg.health_addr {
+        Some(ref addr) => {
+            let listener = TcpListener::bind(addr).await?;
+            tracing::info!(health_addr = %listener.local_addr()?, "health endpoint listening");
+            Ok(Some(listener))
+        }
+        None => Ok(None),
+    }
+}
+
+/// Serve `GET /healthz` (the process is up) and `GET /readyz` (PostgreSQL is reachable)
+/// for liveness and readiness probes.
+async fn serve_health(listener: TcpListener, state: Arc<AppState>) {
+    loop {
+        let (mut socket, addr) = match listener.accept().await {
+            Ok(v) => v,
+            Err(e) => {
+                tracing::error!(error = %format!("{e:?}"), "failed to accept health connection");
+                continue;
+            }
+        };
+        tracing::debug!(%addr, "accepted health connection");
+        let state = state.clone();
+        tokio::spawn(async move {
+            if let Err(e) = handle_health_http(&state, &mut socket).await {
+                tracing::debug!(error = %format!("{e:?}"), "health connection closed with error");
+            }
+        });
+    }
+}
+
+async fn handle_health_http(state: &AppState, socket: &mut TcpStream) -> std::io::Result<()> {
+    let (method, path) = read_http_request(socket).await?;
+    let (status, body) = match (method.as_str(), path.as_str()) {
+        ("GET", "/healthz") => ("200 OK", "ok\n".to_string()),
+        ("GET", "/readyz") => match readiness(state).await {
+            Ok(()) => ("200 OK", "ready\n".to_string()),
+            Err(reason) => {
+                tracing::warn!(%reason, "readiness check failed");
+                (
+                    "503 Service Unavailable",
+                    format!("not ready: {}\n", reason),
+                )
+            }
+        },
+        ("GET", _) => ("404 Not Found", "not found\n".to_string()),
+        _ => ("405 Method Not Allowed", "method not allowed\n".to_string()),
+    };
+    write_http_response(socket, status, "text/plain; charset=utf-8", &body).await
+}
+
+/// Whether the server can serve commands: storage is configured and a pooled PostgreSQL
+/// connection answers within [`READINESS_TIMEOUT`].
+async fn readiness(state: &AppState) -> std::result::Result<(), String> {
+    let pg = state
+        .store
+        .as_ref()
+        .ok_or_else(|| "no storage configured".to_string())?;
+    pg.ping(READINESS_TIMEOUT).await.map_err(|e| e.to_string())
 }
 
 async fn create_collection_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
     let dbname = match db {
         Some(d) => d,
-        None => return error_doc(59, "Missing $db"),
+        None => return error_doc(MISSING_DB, "Missing $db"),
     };
     let coll = match cmd.get_str("create") {
         Ok(c) => c,
-        Err(_) => return error_doc(9, "Invalid create"),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid create"),
+    };
+    if cmd.contains_key("viewOn") {
+        return create_view_reply(state, dbname, coll, cmd).await;
+    }
+    let collation = match parse_collation(cmd) {
+        Ok(c) => c,
+        Err(err_doc) => return err_doc,
+    };
+    let auto_increment = match parse_auto_increment(cmd) {
+        Ok(a) => a,
+        Err(err_doc) => return err_doc,
+    };
+    let fillfactor = match parse_storage_engine(cmd) {
+        Ok(f) => f,
+        Err(err_doc) => return err_doc,
     };
     if let Some(ref pg) = state.store {
-        match pg.ensure_collection(dbname, coll).await {
+        // The table is created with its fillfactor, so one PostgreSQL refuses leaves
+        // nothing behind
+        if let Some(f) = fillfactor
+            && let Err(e) = pg.ensure_collection_with_fillfactor(dbname, coll, f).await
+        {
+            return store_error(format!("create failed: {}", e));
+        }
+        // The default collation, the validator, the auto-increment field and the storage
+        // engine options are recorded with the collection, so `listCollections` reports them
+        let mut options = Document::new();
+        if let (Some(c), Ok(spec)) = (collation, cmd.get_document("collation"))
+            && !c.is_simple()
+        {
+            options.insert("collation", spec.clone());
+        }
+        for key in [
+            "validator",
+            "validationLevel",
+            "validationAction",
+            "storageEngine",
+        ] {
+            if let Some(v) = cmd.get(key) {
+                options.insert(key, v.clone());
+            }
+        }
+        if let Some((ref field, start)) = auto_increment {
+            options.insert(
+                "autoIncrement",
+                doc! { "field": field.as_str(), "start": start },
+            );
+        }
+        let res = if options.is_empty() {
+            pg.ensure_collection(dbname, coll).await
+        } else {
+            pg.set_collection_options(dbname, coll, &options).await
+        };
+        let res = match (res, auto_increment) {
+            (Ok(()), Some((_, start))) => pg.create_auto_increment(dbname, coll, start).await,
+            (res, _) => res,
+        };
+        match res {
             Ok(_) => doc! { "ok": 1.0 },
-            Err(e) => error_doc(59, format!("create failed: {}", e)),
+            Err(e) => store_error(format!("create failed: {}", e)),
         }
     } else {
-        error_doc(13, "No storage configured")
+        no_storage_error()
+    }
+}
+
+/// The `autoIncrement: {field, start}` option of `create`: the top-level field inserts
+/// fill from a sequence, and the sequence's first value (1 unless given).
+fn parse_auto_increment(cmd: &Document) -> std::result::Result<Option<(String, i64)>, Document> {
+    let spec = match cmd.get("autoIncrement") {
+        None => return Ok(None),
+        Some(Bson::Document(d)) => d,
+        Some(_) => return Err(error_doc(14, "'autoIncrement' must be an object")),
+    };
+    let field = match spec.get_str("field") {
+        Ok(f) => f,
+        Err(_) => return Err(error_doc(2, "'autoIncrement.field' must be a string")),
+    };
+    if field.is_empty() || field.starts_with('$') || field.contains('.') {
+        return Err(error_doc(
+            2,
+            format!(
+                "'autoIncrement.field' must be a top-level field name, got '{}'",
+                field
+            ),
+        ));
+    }
+    if field == "_id" {
+        return Err(error_doc(
+            2,
+            "'autoIncrement.field' cannot be _id; documents keep their ObjectId _id",
+        ));
+    }
+    let start = match spec.get("start") {
+        None => 1,
+        Some(v) => match bson_number(Some(v)) {
+            Some(n) => n,
+            None => return Err(error_doc(14, "'autoIncrement.start' must be a number")),
+        },
+    };
+    Ok(Some((field.to_string(), start)))
+}
+
+/// The `fillfactor` of a `storageEngine: {postgresql: {fillfactor}}` option of `create`
+/// or `collMod`. Options for other engines are accepted and left alone, as mongod does for
+/// engines it is not running.
+fn parse_storage_engine(cmd: &Document) -> std::result::Result<Option<i32>, Document> {
+    let engines = match cmd.get("storageEngine") {
+        None => return Ok(None),
+        Some(Bson::Document(d)) => d,
+        Some(_) => {
+            return Err(error_doc(
+                TYPE_MISMATCH,
+                "'storageEngine' must be an object",
+            ));
+        }
+    };
+    let mut fillfactor = None;
+    for (engine, options) in engines {
+        let Bson::Document(options) = options else {
+            return Err(error_doc(
+                BAD_VALUE,
+                format!("'storageEngine.{}' has to be an embedded document", engine),
+            ));
+        };
+        if engine != "postgresql" {
+            continue;
+        }
+        for (key, value) in options {
+            if key != "fillfactor" {
+                return Err(error_doc(
+                    INVALID_OPTIONS,
+                    format!("unknown storageEngine.postgresql option '{}'", key),
+                ));
+            }
+            match bson_number(Some(value)) {
+                Some(n)
+                    if (10..=100).contains(&n)
+                        && !matches!(value, Bson::Double(f) if f.fract() != 0.0) =>
+                {
+                    fillfactor = Some(n as i32)
+                }
+                _ => {
+                    return Err(error_doc(
+                        BAD_VALUE,
+                        "storageEngine.postgresql.fillfactor must be a whole number from 10 to 100",
+                    ));
+                }
+            }
+        }
+    }
+    Ok(fillfactor)
+}
+
+/// `getNextSequence: <coll>`: draw the next value of the collection's `autoIncrement`
+/// sequence, for clients that want the number before they insert.
+async fn get_next_sequence_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let coll = match cmd.get_str("getNextSequence") {
+        Ok(c) => c,
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid getNextSequence"),
+    };
+    let Some(ref pg) = state.store else {
+        return no_storage_error();
+    };
+    match pg.auto_increment_field(dbname, coll).await {
+        Ok(Some(_)) => {}
+        Ok(None) => {
+            return error_doc(
+                2,
+                format!(
+                    "Collection {}.{} was not created with autoIncrement",
+                    dbname, coll
+                ),
+            );
+        }
+        Err(e) => return store_error(format!("getNextSequence failed: {}", e)),
+    }
+    match pg.next_auto_increment(dbname, coll, 1).await {
+        Ok(values) => doc! { "value": values[0], "ok": 1.0 },
+        Err(e) => store_error(format!("getNextSequence failed: {}", e)),
+    }
+}
+
+/// Give the documents of an insert into an `autoIncrement` collection that lack its field
+/// the next values of its sequence, in document order. Documents that carry the field keep
+/// their own value.
+async fn fill_auto_increment(
+    pg: &PgStore,
+    db: &str,
+    coll: &str,
+    docs: &mut [Bson],
+) -> std::result::Result<(), Document> {
+    let field = match pg.auto_increment_field(db, coll).await {
+        Ok(Some(f)) => f,
+        Ok(None) => return Ok(()),
+        Err(e) => return Err(store_error(format!("insert failed: {}", e))),
+    };
+    let missing: Vec<usize> = docs
+        .iter()
+        .enumerate()
+        .filter_map(|(i, b)| match b {
+            Bson::Document(d) if !d.contains_key(&field) => Some(i),
+            _ => None,
+        })
+        .collect();
+    if missing.is_empty() {
+        return Ok(());
+    }
+    let values = pg
+        .next_auto_increment(db, coll, missing.len() as i64)
+        .await
+        .map_err(|e| store_error(format!("insert failed: {}", e)))?;
+    for (i, value) in missing.into_iter().zip(values) {
+        if let Bson::Document(d) = &mut docs[i] {
+            d.insert(field.clone(), value);
+        }
+    }
+    Ok(())
+}
+
+/// Views nest at most this deep, as in MongoDB; deeper chains (or cycles) fail with
+/// ViewDepthLimitExceeded.
+const MAX_VIEW_DEPTH: usize = 20;
+
+/// `create` with `viewOn`: record a read-only view over `viewOn` through `pipeline`.
+async fn create_view_reply(state: &AppState, dbname: &str, name: &str, cmd: &Document) -> Document {
+    let view_on = match cmd.get_str("viewOn") {
+        Ok(v) if !v.is_empty() => v,
+        Ok(_) => return error_doc(73, "'viewOn' cannot be empty"),
+        Err(_) => return error_doc(14, "'viewOn' must be a string"),
+    };
+    let pipeline = match cmd.get("pipeline") {
+        None => Vec::new(),
+        Some(Bson::Array(stages)) => {
+            let mut docs = Vec::with_capacity(stages.len());
+            for stage in stages {
+                match stage {
+                    Bson::Document(d) => docs.push(d.clone()),
+                    _ => return error_doc(14, "'pipeline' must be an array of objects"),
+                }
+            }
+            docs
+        }
+        Some(_) => return error_doc(14, "'pipeline' must be an array"),
+    };
+    // Parse up front so a broken definition fails here rather than on every read
+    let parsed = match crate::aggregation::Pipeline::parse(&doc! { "pipeline": pipeline.clone() }) {
+        Ok(p) => p,
+        Err(e) => return error_doc(FAILED_TO_PARSE, format!("Invalid view pipeline: {}", e)),
+    };
+    if parsed.stages.iter().any(|s| {
+        matches!(
+            s,
+            crate::aggregation::Stage::Out(_) | crate::aggregation::Stage::Merge(_)
+        )
+    }) {
+        return error_doc(2, "$out and $merge cannot be used in a view definition");
+    }
+    let Some(ref pg) = state.store else {
+        return no_storage_error();
+    };
+    match pg.create_view(dbname, name, view_on, &pipeline).await {
+        Ok(true) => doc! { "ok": 1.0 },
+        Ok(false) => error_doc(
+            NAMESPACE_EXISTS,
+            format!("Namespace {}.{} already exists", dbname, name),
+        ),
+        Err(e) => store_error(format!("create failed: {}", e)),
+    }
+}
+
+/// Resolve `coll` through any views: the collection finally read and the view stages to
+/// run ahead of the caller's pipeline (innermost view first). Plain collections resolve to
+/// themselves with no stages.
+async fn resolve_view(
+    pg: &PgStore,
+    dbname: &str,
+    coll: &str,
+) -> std::result::Result<(String, Vec<crate::aggregation::Stage>), Document> {
+    let mut source = coll.to_string();
+    let mut stages = Vec::new();
+    for _ in 0..=MAX_VIEW_DEPTH {
+        let view = match pg.view_definition(dbname, &source).await {
+            Ok(Some(v)) => v,
+            Ok(None) => return Ok((source, stages)),
+            Err(e) => return Err(store_error(format!("view lookup failed: {}", e))),
+        };
+        let mut parsed = Vec::with_capacity(view.pipeline.len());
+        for stage in &view.pipeline {
+            match crate::aggregation::Pipeline::parse_stage(stage) {
+                Ok(s) => parsed.push(s),
+                Err(e) => {
+                    return Err(error_doc(
+                        FAILED_TO_PARSE,
+                        format!("Invalid pipeline for view {}.{}: {}", dbname, source, e),
+                    ));
+                }
+            }
+        }
+        stages.splice(0..0, parsed);
+        source = view.view_on;
     }
+    Err(error_doc(
+        149,
+        format!(
+            "View depth too deep or view cycle detected; maximum depth is {}",
+            MAX_VIEW_DEPTH
+        ),
+    ))
+}
+
+/// Writes and index builds address collections; on a view they fail as in MongoDB.
+async fn view_write_error(state: &AppState, db: Option<&str>, cmd: &Document) -> Option<Document> {
+    let (pg, dbname) = (state.store.as_ref()?, db?);
+    let coll = cmd.iter().next()?.1.as_str()?;
+    match pg.view_definition(dbname, coll).await {
+        Ok(Some(_)) => Some(error_doc(
+            166,
+            format!("Namespace {}.{} is a view, not a collection", dbname, coll),
+        )),
+        _ => None,
+    }
+}
+
+/// Rewrite `find` on a view as the equivalent `aggregate`, which resolves the view.
+fn find_on_view_command(view: &str, cmd: &Document) -> Document {
+    let mut pipeline = Vec::new();
+    if let Ok(filter) = cmd
+        .get_document("filter")
+        .or_else(|_| cmd.get_document("query"))
+    {
+        pipeline.push(doc! { "$match": filter.clone() });
+    }
+    if let Ok(sort) = cmd.get_document("sort")
+        && !sort.is_empty()
+    {
+        pipeline.push(doc! { "$sort": sort.clone() });
+    }
+    if let Some(skip) = bson_number(cmd.get("skip"))
+        && skip > 0
+    {
+        pipeline.push(doc! { "$skip": skip });
+    }
+    if let Some(limit) = bson_number(cmd.get("limit"))
+        && limit != 0
+    {
+        pipeline.push(doc! { "$limit": limit.saturating_abs() });
+    }
+    if let Ok(projection) = cmd.get_document("projection")
+        && !projection.is_empty()
+    {
+        pipeline.push(doc! { "$project": projection.clone() });
+    }
+    let mut cursor = Document::new();
+    if let Some(b) = cmd.get("batchSize") {
+        cursor.insert("batchSize", b.clone());
+    }
+    let mut agg = doc! { "aggregate": view, "pipeline": pipeline, "cursor": cursor };
+    for key in [
+        "let",
+        "collation",
+        "maxTimeMS",
+        "comment",
+        "$readPreference",
+    ] {
+        if let Some(v) = cmd.get(key) {
+            agg.insert(key, v.clone());
+        }
+    }
+    agg
 }
 
 async fn drop_collection_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
     let dbname = match db {
         Some(d) => d,
-        None => return error_doc(59, "Missing $db"),
+        None => return error_doc(MISSING_DB, "Missing $db"),
     };
     let coll = match cmd.get_str("drop") {
         Ok(c) => c,
-        Err(_) => return error_doc(9, "Invalid drop"),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid drop"),
     };
     if let Some(ref pg) = state.store {
         match pg.drop_collection(dbname, coll).await {
             Ok(_) => doc! { "nIndexesWas": 0i32, "ns": format!("{}.{}", dbname, coll), "ok": 1.0 },
-            Err(e) => error_doc(59, format!("drop failed: {}", e)),
+            Err(e) => store_error(format!("drop failed: {}", e)),
         }
     } else {
-        error_doc(13, "No storage configured")
+        no_storage_error()
     }
 }
 
 async fn drop_database_reply(state: &AppState, db: Option<&str>) -> Document {
     let dbname = match db {
         Some(d) => d,
-        None => return error_doc(59, "Missing $db"),
+        None => return error_doc(MISSING_DB, "Missing $db"),
     };
     if let Some(ref pg) = state.store {
         match pg.drop_database(dbname).await {
             Ok(_) => doc! { "dropped": dbname, "ok": 1.0 },
-            Err(e) => error_doc(59, format!("dropDatabase failed: {}", e)),
+            Err(e) => store_error(format!("dropDatabase failed: {}", e)),
         }
     } else {
-        error_doc(13, "No storage configured")
+        no_storage_error()
+    }
+}
+
+async fn validate_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let coll = match cmd.get_str("validate") {
+        Ok(c) => c,
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid validate"),
+    };
+    let full = cmd.get_bool("full").unwrap_or(false);
+    if state.store.is_none() {
+        return no_storage_error();
+    }
+    let pg = state.store.as_ref().unwrap();
+    let ns = format!("{}.{}", dbname, coll);
+
+    match pg.list_collections(dbname).await {
+        Ok(colls) if colls.iter().any(|c| c == coll) => {}
+        Ok(_) => {
+            return error_doc(
+                NAMESPACE_NOT_FOUND,
+                format!("Collection '{}' does not exist to validate.", ns),
+            );
+        }
+        Err(e) => return store_error(format!("validate failed: {}", e)),
+    }
+
+    let report = match pg.validate_collection(dbname, coll, full).await {
+        Ok(r) => r,
+        Err(e) => return store_error(format!("validate failed: {}", e)),
+    };
+    let index_names = pg.list_index_names(dbname, coll).await.unwrap_or_default();
+
+    // The primary key on id backs the implicit _id_ index
+    let mut keys_per_index = doc! { "_id_": report.nrecords };
+    for name in &index_names {
+        keys_per_index.insert(name.clone(), report.nrecords);
+    }
+    doc! {
+        "ns": ns,
+        "nInvalidDocuments": report.n_invalid_documents,
+        "nrecords": report.nrecords,
+        "nIndexes": (index_names.len() + 1) as i32,
+        "keysPerIndex": keys_per_index,
+        "valid": report.errors.is_empty(),
+        "repaired": false,
+        "warnings": report.warnings,
+        "errors": report.errors,
+        "extraIndexEntries": [],
+        "missingIndexEntries": [],
+        "corruptRecords": [],
+        "ok": 1.0,
+    }
+}
+
+async fn reindex_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let coll = match cmd.get_str("reIndex") {
+        Ok(c) => c,
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid reIndex"),
+    };
+    if state.store.is_none() {
+        return no_storage_error();
+    }
+    let pg = state.store.as_ref().unwrap();
+
+    match pg.list_collections(dbname).await {
+        Ok(colls) if colls.iter().any(|c| c == coll) => {}
+        Ok(_) => {
+            return error_doc(
+                NAMESPACE_NOT_FOUND,
+                format!("collection {}.{} does not exist", dbname, coll),
+            );
+        }
+        Err(e) => return store_error(format!("reIndex failed: {}", e)),
+    }
+
+    match pg.reindex_collection(dbname, coll).await {
+        Ok(names) => {
+            // Report the primary key under its Mongo name
+            let pkey = format!("{}_pkey", coll);
+            let indexes: Vec<Bson> = names
+                .iter()
+                .map(|n| {
+                    let name = if *n == pkey { "_id_" } else { n.as_str() };
+                    Bson::Document(doc! { "name": name })
+                })
+                .collect();
+            let n = indexes.len() as i32;
+            doc! { "nIndexesWas": n, "nIndexes": n, "indexes": indexes, "ok": 1.0 }
+        }
+        Err(e) => store_error(format!("reIndex failed: {}", e)),
     }
 }
 
 async fn insert_reply(state: &AppState, db: Option<&str>, cmd: &mut Document) -> Document {
     let dbname = match db {
         Some(d) => d,
-        None => return error_doc(59, "Missing $db"),
+        None => return error_doc(MISSING_DB, "Missing $db"),
     };
     let coll: String = match cmd.get_str("insert") {
         Ok(c) => c.to_string(),
-        Err(_) => return error_doc(9, "Invalid insert"),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid insert"),
     };
-    let docs_bson: Vec<bson::Bson> = match cmd.get_array("documents") {
+    let mut docs_bson: Vec<bson::Bson> = match cmd.get_array("documents") {
         Ok(a) => a.clone(),
         Err(_) => {
-            tracing::warn!(collection=%coll, cmd=?cmd, "insert missing 'documents' array");
-            return error_doc(9, "Missing documents");
+            tracing::warn!(collection=%coll, cmd=?crate::logging::redact_command(&cmd), "insert missing 'documents' array");
+            return error_doc(FAILED_TO_PARSE, "Missing documents");
         }
     };
+    if docs_bson.len() > MAX_WRITE_BATCH_SIZE {
+        return error_doc(
+            16,
+            format!(
+                "Write batch sizes must be between 1 and {}. Got {} operations.",
+                MAX_WRITE_BATCH_SIZE,
+                docs_bson.len()
+            ),
+        );
+    }
+    if state.extended_json_import {
+        for d in docs_bson.iter_mut() {
+            if let Bson::Document(d) = d {
+                crate::extended_json::decode_wrappers(d);
+            }
+        }
+    }
+    // An ordered insert stops at its first failing document
+    let ordered = cmd.get_bool("ordered").unwrap_or(true);
     if let Some(ref pg) = state.store {
+        if let Err(err_doc) = fill_auto_increment(pg, dbname, &coll, &mut docs_bson).await {
+            return err_doc;
+        }
+        let validator = match write_validator(pg, dbname, &coll, cmd).await {
+            Ok(v) => v,
+            Err(err_doc) => return err_doc,
+        };
         // Check if we're in a transaction
         let in_transaction = if let Some(lsid) = extract_lsid(cmd) {
             if let Some(autocommit) = extract_autocommit(cmd) {
@@ -1109,112 +4969,79 @@ async fn insert_reply(state: &AppState, db: Option<&str>, cmd: &mut Document) ->
                 let session = session_arc.lock().await;
                 if let Some(ref client) = session.postgres_client {
                     for (i, b) in docs_bson.iter().enumerate() {
-                        if let bson::Bson::Document(d0) = b {
-                            let mut d = d0.clone();
-                            ensure_id(&mut d);
-                            match id_bytes(d.get("_id")) {
-                                    Some(idb) => {
-                                        let json = match serde_json::to_value(&d) {
-                                            Ok(v) => v,
-                                            Err(e) => {
-                                                write_errors.push(
-                                                    doc! {"index": i as i32, "code": 2, "errmsg": e.to_string()},
-                                                );
-                                                continue;
-                                            }
-                                        };
-                                        let bson_bytes = match bson::to_vec(&d) {
-                                            Ok(v) => v,
-                                            Err(e) => {
-                                                write_errors.push(
-                                                    doc! {"index": i as i32, "code": 2, "errmsg": e.to_string()},
-                                                );
-                                                continue;
-                                            }
-                                        };
-
-                                        match pg.insert_one_with_client(
-                                            client,
-                                            dbname,
-                                            &coll,
-                                            &idb,
-                                            &bson_bytes,
-                                            &json,
-                                        ).await {
-                                            Ok(n) => {
-                                                if n == 1 {
-                                                    inserted += 1;
-                                                } else {
-                                                    write_errors.push(doc!{"index": i as i32, "code": 11000i32, "errmsg": "duplicate key"});
-                                                }
-                                            }
-                                            Err(e) => write_errors.push(
-                                                doc! {"index": i as i32, "code": 59i32, "errmsg": e.to_string()},
-                                            ),
-                                        }
-                                    }
-                                    None => write_errors.push(
-                                        doc! {"index": i as i32, "code": 2i32, "errmsg": "unsupported _id type"},
-                                    ),
+                        let row = match insert_row(state, i, b, validator.as_ref()) {
+                            Ok(row) => row,
+                            Err(we) => {
+                                write_errors.push(we);
+                                if ordered {
+                                    break;
                                 }
-                        } else {
-                            write_errors.push(
-                                    doc! {"index": i as i32, "code": 2i32, "errmsg": "document must be object"},
-                                );
+                                continue;
+                            }
+                        };
+                        match pg
+                            .insert_one_with_client(
+                                client, dbname, &coll, &row.id, &row.bson, &row.json,
+                            )
+                            .await
+                        {
+                            Ok(1) => inserted += 1,
+                            Ok(_) => write_errors.push(duplicate_id_error(i, dbname, &coll, b)),
+                            Err(e) => write_errors.push(insert_write_error(
+                                i,
+                                dbname,
+                                &coll,
+                                &e.to_string(),
+                            )),
+                        }
+                        if ordered && !write_errors.is_empty() {
+                            break;
                         }
                     }
                 }
             }
         } else {
-            // Not in transaction - use pool
+            // Not in transaction - batched multi-row inserts through the pool. Documents
+            // that cannot be stored are reported without reaching PostgreSQL; an ordered
+            // insert writes only those before the first of them.
+            let mut indexes = Vec::with_capacity(docs_bson.len());
+            let mut rows = Vec::with_capacity(docs_bson.len());
+            let mut rejected: Vec<Document> = Vec::new();
             for (i, b) in docs_bson.iter().enumerate() {
-                if let bson::Bson::Document(d0) = b {
-                    let mut d = d0.clone();
-                    ensure_id(&mut d);
-                    match id_bytes(d.get("_id")) {
-                        Some(idb) => {
-                            let json = match serde_json::to_value(&d) {
-                                Ok(v) => v,
-                                Err(e) => {
-                                    write_errors.push(
-                                        doc! {"index": i as i32, "code": 2, "errmsg": e.to_string()},
-                                    );
-                                    continue;
-                                }
-                            };
-                            let bson_bytes = match bson::to_vec(&d) {
-                                Ok(v) => v,
-                                Err(e) => {
-                                    write_errors.push(
-                                        doc! {"index": i as i32, "code": 2, "errmsg": e.to_string()},
-                                    );
-                                    continue;
-                                }
-                            };
-
-                            match pg.insert_one(dbname, &coll, &idb, &bson_bytes, &json).await {
-                                Ok(n) => {
-                                    if n == 1 {
-                                        inserted += 1;
-                                    } else {
-                                        write_errors.push(doc!{"index": i as i32, "code": 11000i32, "errmsg": "duplicate key"});
-                                    }
-                                }
-                                Err(e) => write_errors.push(
-                                    doc! {"index": i as i32, "code": 59i32, "errmsg": e.to_string()},
-                                ),
+                match insert_row(state, i, b, validator.as_ref()) {
+                    Ok(row) => {
+                        indexes.push(i);
+                        rows.push(row);
+                    }
+                    Err(we) => {
+                        rejected.push(we);
+                        if ordered {
+                            break;
+                        }
+                    }
+                }
+            }
+            match pg.insert_many(dbname, &coll, &rows, ordered).await {
+                Ok(outcomes) => {
+                    for (i, outcome) in indexes.iter().zip(outcomes) {
+                        match outcome {
+                            crate::store::InsertOutcome::Inserted => inserted += 1,
+                            crate::store::InsertOutcome::Duplicate => write_errors
+                                .push(duplicate_id_error(*i, dbname, &coll, &docs_bson[*i])),
+                            crate::store::InsertOutcome::Failed(msg) => {
+                                write_errors.push(insert_write_error(*i, dbname, &coll, &msg))
                             }
                         }
-                        None => write_errors.push(
-                            doc! {"index": i as i32, "code": 2i32, "errmsg": "unsupported _id type"},
-                        ),
                     }
-                } else {
-                    write_errors.push(
-                        doc! {"index": i as i32, "code": 2i32, "errmsg": "document must be object"},
-                    );
                 }
+                Err(e) => return store_error(format!("insert failed: {}", e)),
+            }
+            // An ordered insert that stopped on a database error never reached the rejected
+            // document
+            if !ordered || write_errors.is_empty() {
+                write_errors.extend(rejected);
             }
+            write_errors.sort_by_key(|we| we.get_i32("index").unwrap_or(0));
         }
 
         let mut reply = doc! { "n": inserted as i32, "ok": 1.0 };
@@ -1223,50 +5050,150 @@ async fn insert_reply(state: &AppState, db: Option<&str>, cmd: &mut Document) ->
         }
         reply
     } else {
-        error_doc(13, "No storage configured")
+        no_storage_error()
+    }
+}
+
+/// DuplicateKey write error for document `i` of an insert, whose `_id` is already taken,
+/// worded as MongoDB words it.
+fn duplicate_id_error(i: usize, db: &str, coll: &str, doc: &Bson) -> Document {
+    let id = doc
+        .as_document()
+        .and_then(|d| d.get("_id"))
+        .cloned()
+        .unwrap_or(Bson::Null);
+    doc! {
+        "index": i as i32,
+        "code": DUPLICATE_KEY,
+        "keyPattern": {"_id": 1},
+        "keyValue": {"_id": id.clone()},
+        "errmsg": format!(
+            "E11000 duplicate key error collection: {}.{} index: _id_ dup key: {{ _id: {} }}",
+            db, coll, id
+        ),
+    }
+}
+
+/// Write error for document `i` of an insert that PostgreSQL refused with `msg`. A unique
+/// violation on a secondary index is a DuplicateKey naming the index.
+fn insert_write_error(i: usize, db: &str, coll: &str, msg: &str) -> Document {
+    let code = store_error_code(msg);
+    let errmsg = match msg.split("unique constraint \"").nth(1) {
+        Some(rest) if code == DUPLICATE_KEY => format!(
+            "E11000 duplicate key error collection: {}.{} index: {}",
+            db,
+            coll,
+            rest.split('"').next().unwrap_or(rest)
+        ),
+        _ => msg.to_string(),
+    };
+    doc! { "index": i as i32, "code": code, "errmsg": errmsg }
+}
+
+/// Largest number of documents one `insert` command may carry, advertised by `hello`.
+const MAX_WRITE_BATCH_SIZE: usize = 100_000;
+
+/// Document `i` of an `insert`, with its `_id` filled in and encoded for storage, or the
+/// write error reporting why it cannot be stored or fails `validator`.
+fn insert_row(
+    state: &AppState,
+    i: usize,
+    b: &bson::Bson,
+    validator: Option<&Validator>,
+) -> std::result::Result<crate::store::InsertRow, Document> {
+    let bson::Bson::Document(d0) = b else {
+        return Err(doc! {"index": i as i32, "code": 2i32, "errmsg": "document must be object"});
+    };
+    let mut d = d0.clone();
+    ensure_id(&mut d);
+    let Some(id) = id_bytes(d.get("_id")) else {
+        return Err(doc! {"index": i as i32, "code": 2i32, "errmsg": "unsupported _id type"});
+    };
+    if let Some(err) = check_validator(validator, &d, None) {
+        return Err(write_error(i, err));
+    }
+    let json = crate::bson_type::to_jsonb(&d)
+        .map_err(|e| doc! {"index": i as i32, "code": 2, "errmsg": e.to_string()})?;
+    let bson = bson::to_vec(&d)
+        .map_err(|e| doc! {"index": i as i32, "code": 2, "errmsg": e.to_string()})?;
+    if let Some(err) = check_bson_size(state, bson.len()) {
+        let mut we = doc! {"index": i as i32};
+        we.extend(err);
+        return Err(we);
     }
+    Ok(crate::store::InsertRow { id, bson, json })
 }
 
 async fn update_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
     let dbname = match db {
         Some(d) => d,
-        None => return error_doc(59, "Missing $db"),
+        None => return error_doc(MISSING_DB, "Missing $db"),
     };
     let coll = match cmd.get_str("update") {
         Ok(c) => c,
-        Err(_) => return error_doc(9, "Invalid update"),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid update"),
     };
     let updates = match cmd.get_array("updates") {
         Ok(a) => a,
         Err(_) => {
-            tracing::warn!(collection=%coll, cmd=?cmd, "update missing 'updates' array");
-            return error_doc(9, "Missing updates");
+            tracing::warn!(collection=%coll, cmd=?crate::logging::redact_command(&cmd), "update missing 'updates' array");
+            return error_doc(FAILED_TO_PARSE, "Missing updates");
         }
     };
     if updates.is_empty() {
-        return error_doc(9, "Empty updates");
+        return error_doc(FAILED_TO_PARSE, "Empty updates");
     }
     if state.store.is_none() {
-        return error_doc(13, "No storage configured");
+        return no_storage_error();
     }
     let pg = state.store.as_ref().unwrap();
 
+    // One clock reading per command, so `$$NOW` and every field `$currentDate` stamps agree
+    let now = bson::DateTime::now();
+    let vars = match command_vars_arg(cmd, now) {
+        Ok(v) => v,
+        Err(err_doc) => return err_doc,
+    };
+    let validator = match write_validator(pg, dbname, coll, cmd).await {
+        Ok(v) => v,
+        Err(err_doc) => return err_doc,
+    };
+
     let mut matched_total = 0i32;
     let mut modified_total = 0i32;
 
     let mut upserted_entries: Vec<Document> = Vec::new();
-    for (spec_index, upd_b) in updates.iter().enumerate() {
+    // A statement that fails against the stored documents is reported in `writeErrors`
+    // under its index; an ordered update stops there, an unordered one moves on
+    let ordered = cmd.get_bool("ordered").unwrap_or(true);
+    let mut write_errors: Vec<Document> = Vec::new();
+    'statements: for (spec_index, upd_b) in updates.iter().enumerate() {
+        if ordered && !write_errors.is_empty() {
+            break;
+        }
         let spec = match upd_b {
             bson::Bson::Document(d) => d,
-            _ => return error_doc(9, "Invalid update spec"),
+            _ => return error_doc(FAILED_TO_PARSE, "Invalid update spec"),
         };
         let filter = match spec.get_document("q") {
             Ok(d) => d.clone(),
-            Err(_) => return error_doc(9, "Missing q"),
+            Err(_) => return error_doc(FAILED_TO_PARSE, "Missing q"),
         };
-        let udoc = match spec.get_document("u") {
-            Ok(d) => d.clone(),
-            Err(_) => return error_doc(9, "Missing u"),
+        if let Some(err) = reject_find_only(&filter) {
+            return err;
+        }
+        let filter = match bind_expr_filter(&filter, &vars) {
+            Ok(f) => f,
+            Err(err_doc) => return err_doc,
+        };
+        if let Err(err_doc) = apply_write_hint(pg, dbname, coll, spec).await {
+            return err_doc;
+        }
+        // An array `u` is an update pipeline; a document holds update operators
+        let (udoc, update_pipeline) = match spec.get("u") {
+            Some(Bson::Document(d)) => (d.clone(), None),
+            Some(Bson::Array(stages)) => (Document::new(), Some(stages.clone())),
+            _ => return error_doc(FAILED_TO_PARSE, "Missing u"),
         };
         let multi = spec.get_bool("multi").unwrap_or(false);
         let upsert = spec.get_bool("upsert").unwrap_or(false);
@@ -1276,14 +5203,22 @@ async fn update_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Doc
         let rename_doc = udoc.get_document("$rename").ok().cloned();
         let push_doc = udoc.get_document("$push").ok().cloned();
         let pull_doc = udoc.get_document("$pull").ok().cloned();
+        let bit_doc = udoc.get_document("$bit").ok().cloned();
+        let current_date_doc = udoc.get_document("$currentDate").ok().cloned();
         if set_doc.is_none()
             && unset_doc.is_none()
             && inc_doc.is_none()
             && rename_doc.is_none()
             && push_doc.is_none()
             && pull_doc.is_none()
+            && bit_doc.is_none()
+            && current_date_doc.is_none()
+            && update_pipeline.is_none()
         {
-            return error_doc(9, "Only $set/$unset/$inc/$rename/$push/$pull supported");
+            return error_doc(
+                FAILED_TO_PARSE,
+                "Only $set/$unset/$inc/$rename/$push/$pull/$bit/$currentDate supported",
+            );
         }
 
         // Validate array index segments (disallow negative indexes)
@@ -1310,7 +5245,7 @@ async fn update_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Doc
                     v,
                     bson::Bson::Int32(_) | bson::Bson::Int64(_) | bson::Bson::Double(_)
                 ) {
-                    return error_doc(2, "$inc requires numeric value");
+                    return error_doc(TYPE_MISMATCH, "Cannot increment with non-numeric argument");
                 }
             }
         }
@@ -1349,149 +5284,281 @@ async fn update_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Doc
         }
 
         if multi {
-            // Fetch docs by filter and update each
-            let docs = match pg
-                .find_docs(dbname, coll, Some(&filter), None, None, 10_000)
-                .await
-            {
-                Ok(v) => v,
-                Err(e) => return error_doc(59, format!("find failed: {}", e)),
-            };
-            if docs.is_empty() {
-                if upsert {
-                    // Upsert: insert one synthesized document
-                    if let Err(e) = pg.ensure_collection(dbname, coll).await {
-                        return error_doc(59, format!("ensure_collection failed: {}", e));
-                    }
-                    let mut new_doc = bson::Document::new();
-                    for (k, v) in filter.iter() {
-                        match v {
-                            bson::Bson::Document(d) => {
-                                if let Some(eqv) = d.get("$eq") {
-                                    new_doc.insert(k.clone(), eqv.clone());
-                                }
-                            }
-                            other => {
-                                new_doc.insert(k.clone(), other.clone());
+            // Page through the matches in id order, apply the update to each page in memory
+            // and write back the documents it changed with one statement per page
+            let mut after: Option<Vec<u8>> = None;
+            let mut matched_any = false;
+            loop {
+                let batch = match pg
+                    .find_batch_for_update(
+                        dbname,
+                        coll,
+                        &filter,
+                        after.as_deref(),
+                        MULTI_UPDATE_BATCH_ROWS,
+                    )
+                    .await
+                {
+                    Ok(v) => v,
+                    Err(e) => {
+                        write_errors.push(write_error(
+                            spec_index,
+                            store_error(format!("find failed: {}", e)),
+                        ));
+                        continue 'statements;
+                    }
+                };
+                let last_page = (batch.len() as i64) < MULTI_UPDATE_BATCH_ROWS;
+                after = batch.last().map(|(id, _)| id.clone());
+                matched_any |= !batch.is_empty();
+                let mut changed: Vec<(Vec<u8>, Document)> = Vec::new();
+                for (idb, mut d) in batch {
+                    // remember original
+                    let orig = d.clone();
+                    if let Some(ref stages) = update_pipeline {
+                        match crate::aggregation::update::apply_pipeline(&d, stages, &vars) {
+                            Ok(updated) => d = updated,
+                            Err(e) => {
+                                write_errors
+                                    .push(write_error(spec_index, update_pipeline_error(e)));
+                                continue 'statements;
                             }
                         }
                     }
+                    // $set
                     if let Some(ref sets) = set_doc {
                         for (k, v) in sets.iter() {
-                            set_path_nested(&mut new_doc, k, v.clone());
+                            set_path_nested(&mut d, k, v.clone());
                         }
                     }
+                    // $unset
                     if let Some(ref unsets) = unset_doc {
                         for (k, _v) in unsets.iter() {
-                            unset_path_nested(&mut new_doc, k);
+                            unset_path_nested(&mut d, k);
                         }
                     }
+                    // $inc
                     if let Some(ref incs) = inc_doc {
                         for (k, v) in incs.iter() {
-                            if !apply_inc(&mut new_doc, k, v.clone()) {
-                                return error_doc(2, "$inc requires numeric field");
+                            if !apply_inc(&mut d, k, v.clone()) {
+                                continue;
                             }
                         }
                     }
+                    // $rename
                     if let Some(ref ren) = rename_doc {
                         for (from, to_b) in ren.iter() {
-                            if let bson::Bson::String(to) = to_b {
-                                apply_rename(&mut new_doc, from, to);
+                            if let bson::Bson::String(to) = to_b
+                                && let Err(err) = apply_rename(&mut d, from, to)
+                            {
+                                write_errors.push(write_error(spec_index, err));
+                                continue 'statements;
                             }
                         }
                     }
+                    // $push
                     if let Some(ref pushes) = push_doc {
                         for (k, v) in pushes.iter() {
-                            if !apply_push(&mut new_doc, k, v.clone()) {
-                                return error_doc(2, "$push on non-array");
+                            if !apply_push(&mut d, k, v.clone()) {
+                                write_errors.push(write_error(
+                                    spec_index,
+                                    error_doc(2, "$push on non-array"),
+                                ));
+                                continue 'statements;
                             }
                         }
                     }
+                    // $pull
                     if let Some(ref pulls) = pull_doc {
                         for (k, v) in pulls.iter() {
-                            apply_pull(&mut new_doc, k, v.clone());
+                            apply_pull(&mut d, k, v.clone());
                         }
                     }
-                    ensure_id(&mut new_doc);
-                    let idb = match new_doc.get("_id").and_then(id_bytes_bson) {
-                        Some(v) => v,
-                        None => return error_doc(2, "unsupported _id type"),
-                    };
-                    let json = match serde_json::to_value(&new_doc) {
-                        Ok(v) => v,
-                        Err(e) => return error_doc(2, e.to_string()),
-                    };
-                    let bson_bytes = match bson::to_vec(&new_doc) {
-                        Ok(v) => v,
-                        Err(e) => return error_doc(2, e.to_string()),
-                    };
-                    match pg.insert_one(dbname, coll, &idb, &bson_bytes, &json).await {
-                        Ok(n) => {
-                            if n == 1 {
-                                matched_total += 1;
-                                upserted_entries.push(doc!{"index": (spec_index as i32), "_id": new_doc.get("_id").cloned().unwrap_or(bson::Bson::Null)});
+                    if let Some(ref bits) = bit_doc {
+                        for (k, v) in bits.iter() {
+                            if let Err(err) = apply_bit(&mut d, k, v) {
+                                write_errors.push(write_error(spec_index, err));
+                                continue 'statements;
                             }
                         }
-                        Err(e) => return error_doc(59, format!("insert failed: {}", e)),
+                    }
+                    if let Some(ref dates) = current_date_doc {
+                        for (k, v) in dates.iter() {
+                            if let Err(err) = apply_current_date(&mut d, k, v, now) {
+                                write_errors.push(write_error(spec_index, err));
+                                continue 'statements;
+                            }
+                        }
+                    }
+                    if let Some(err) = check_updated_size(state, coll, &orig, &d) {
+                        write_errors.push(write_error(spec_index, err));
+                        continue 'statements;
+                    }
+                    if let Some(err) = check_validator(validator.as_ref(), &d, Some(&orig)) {
+                        write_errors.push(write_error(spec_index, err));
+                        continue 'statements;
+                    }
+                    matched_total += 1;
+                    if doc_changed(&orig, &d) {
+                        changed.push((idb, d));
                     }
                 }
-                continue;
+                match pg.update_docs_by_id(dbname, coll, &changed).await {
+                    Ok(n) => modified_total += n as i32,
+                    Err(e) => {
+                        write_errors.push(write_error(
+                            spec_index,
+                            store_error(format!("update failed: {}", e)),
+                        ));
+                        continue 'statements;
+                    }
+                }
+                if last_page {
+                    break;
+                }
             }
-            for mut d in docs {
-                let idb = match d.get("_id").and_then(id_bytes_bson) {
-                    Some(v) => v,
-                    None => continue,
-                };
-                // remember original
-                let orig = d.clone();
-                // $set
+            if !matched_any && upsert {
+                // Upsert: insert one synthesized document
+                if let Err(e) = pg.ensure_collection(dbname, coll).await {
+                    write_errors.push(write_error(
+                        spec_index,
+                        store_error(format!("ensure_collection failed: {}", e)),
+                    ));
+                    continue 'statements;
+                }
+                let mut new_doc = bson::Document::new();
+                for (k, v) in filter.iter() {
+                    match v {
+                        bson::Bson::Document(d) => {
+                            if let Some(eqv) = d.get("$eq") {
+                                new_doc.insert(k.clone(), eqv.clone());
+                            }
+                        }
+                        other => {
+                            new_doc.insert(k.clone(), other.clone());
+                        }
+                    }
+                }
                 if let Some(ref sets) = set_doc {
                     for (k, v) in sets.iter() {
-                        set_path_nested(&mut d, k, v.clone());
+                        set_path_nested(&mut new_doc, k, v.clone());
                     }
                 }
-                // $unset
                 if let Some(ref unsets) = unset_doc {
                     for (k, _v) in unsets.iter() {
-                        unset_path_nested(&mut d, k);
+                        unset_path_nested(&mut new_doc, k);
                     }
                 }
-                // $inc
                 if let Some(ref incs) = inc_doc {
                     for (k, v) in incs.iter() {
-                        if !apply_inc(&mut d, k, v.clone()) {
-                            continue;
+                        if !apply_inc(&mut new_doc, k, v.clone()) {
+                            write_errors.push(write_error(
+                                spec_index,
+                                error_doc(
+                                    TYPE_MISMATCH,
+                                    "Cannot apply $inc to a value of non-numeric type",
+                                ),
+                            ));
+                            continue 'statements;
                         }
                     }
                 }
-                // $rename
                 if let Some(ref ren) = rename_doc {
                     for (from, to_b) in ren.iter() {
-                        if let bson::Bson::String(to) = to_b {
-                            apply_rename(&mut d, from, to);
+                        if let bson::Bson::String(to) = to_b
+                            && let Err(err) = apply_rename(&mut new_doc, from, to)
+                        {
+                            write_errors.push(write_error(spec_index, err));
+                            continue 'statements;
                         }
                     }
                 }
-                // $push
                 if let Some(ref pushes) = push_doc {
                     for (k, v) in pushes.iter() {
-                        if !apply_push(&mut d, k, v.clone()) {
-                            return error_doc(2, "$push on non-array");
+                        if !apply_push(&mut new_doc, k, v.clone()) {
+                            write_errors
+                                .push(write_error(spec_index, error_doc(2, "$push on non-array")));
+                            continue 'statements;
                         }
                     }
                 }
-                // $pull
                 if let Some(ref pulls) = pull_doc {
                     for (k, v) in pulls.iter() {
-                        apply_pull(&mut d, k, v.clone());
+                        apply_pull(&mut new_doc, k, v.clone());
                     }
                 }
-                if let Err(e) = pg.update_doc_by_id(dbname, coll, &idb, &d).await {
-                    tracing::warn!("update_doc_by_id failed: {}", e);
-                } else {
-                    matched_total += 1;
-                    if d != orig {
-                        modified_total += 1;
+                if let Some(ref bits) = bit_doc {
+                    for (k, v) in bits.iter() {
+                        if let Err(err) = apply_bit(&mut new_doc, k, v) {
+                            write_errors.push(write_error(spec_index, err));
+                            continue 'statements;
+                        }
+                    }
+                }
+                if let Some(ref dates) = current_date_doc {
+                    for (k, v) in dates.iter() {
+                        if let Err(err) = apply_current_date(&mut new_doc, k, v, now) {
+                            write_errors.push(write_error(spec_index, err));
+                            continue 'statements;
+                        }
+                    }
+                }
+                if let Some(ref stages) = update_pipeline {
+                    match crate::aggregation::update::apply_pipeline(&new_doc, stages, &vars) {
+                        Ok(updated) => new_doc = updated,
+                        Err(e) => {
+                            write_errors.push(write_error(spec_index, update_pipeline_error(e)));
+                            continue 'statements;
+                        }
+                    }
+                }
+                ensure_id(&mut new_doc);
+                let idb = match new_doc.get("_id").and_then(id_bytes_bson) {
+                    Some(v) => v,
+                    None => {
+                        write_errors.push(write_error(
+                            spec_index,
+                            error_doc(2, "unsupported _id type"),
+                        ));
+                        continue 'statements;
+                    }
+                };
+                let json = match crate::bson_type::to_jsonb(&new_doc) {
+                    Ok(v) => v,
+                    Err(e) => {
+                        write_errors.push(write_error(spec_index, error_doc(2, e.to_string())));
+                        continue 'statements;
+                    }
+                };
+                let bson_bytes = match bson::to_vec(&new_doc) {
+                    Ok(v) => v,
+                    Err(e) => {
+                        write_errors.push(write_error(spec_index, error_doc(2, e.to_string())));
+                        continue 'statements;
+                    }
+                };
+                if let Some(mut err) = check_bson_size(state, bson_bytes.len()) {
+                    err.insert("ok", 0.0);
+                    write_errors.push(write_error(spec_index, err));
+                    continue 'statements;
+                }
+                if let Some(err) = check_validator(validator.as_ref(), &new_doc, None) {
+                    write_errors.push(write_error(spec_index, err));
+                    continue 'statements;
+                }
+                match pg.insert_one(dbname, coll, &idb, &bson_bytes, &json).await {
+                    Ok(n) => {
+                        if n == 1 {
+                            matched_total += 1;
+                            upserted_entries.push(doc!{"index": (spec_index as i32), "_id": new_doc.get("_id").cloned().unwrap_or(bson::Bson::Null)});
+                        }
+                    }
+                    Err(e) => {
+                        write_errors.push(write_error(
+                            spec_index,
+                            store_error(format!("insert failed: {}", e)),
+                        ));
+                        continue 'statements;
                     }
                 }
             }
@@ -1499,10 +5566,25 @@ async fn update_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Doc
             // Single
             let found = match pg.find_one_for_update(dbname, coll, &filter).await {
                 Ok(v) => v,
-                Err(e) => return error_doc(59, format!("find failed: {}", e)),
+                Err(e) => {
+                    write_errors.push(write_error(
+                        spec_index,
+                        store_error(format!("find failed: {}", e)),
+                    ));
+                    continue 'statements;
+                }
             };
             if let Some((idb, mut doc0)) = found {
                 let orig = doc0.clone();
+                if let Some(ref stages) = update_pipeline {
+                    match crate::aggregation::update::apply_pipeline(&doc0, stages, &vars) {
+                        Ok(updated) => doc0 = updated,
+                        Err(e) => {
+                            write_errors.push(write_error(spec_index, update_pipeline_error(e)));
+                            continue 'statements;
+                        }
+                    }
+                }
                 if let Some(ref sets) = set_doc {
                     for (k, v) in sets.iter() {
                         set_path_nested(&mut doc0, k, v.clone());
@@ -1516,21 +5598,33 @@ async fn update_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Doc
                 if let Some(ref incs) = inc_doc {
                     for (k, v) in incs.iter() {
                         if !apply_inc(&mut doc0, k, v.clone()) {
-                            return error_doc(2, "$inc requires numeric field");
+                            write_errors.push(write_error(
+                                spec_index,
+                                error_doc(
+                                    TYPE_MISMATCH,
+                                    "Cannot apply $inc to a value of non-numeric type",
+                                ),
+                            ));
+                            continue 'statements;
                         }
                     }
                 }
                 if let Some(ref ren) = rename_doc {
                     for (from, to_b) in ren.iter() {
-                        if let bson::Bson::String(to) = to_b {
-                            apply_rename(&mut doc0, from, to);
+                        if let bson::Bson::String(to) = to_b
+                            && let Err(err) = apply_rename(&mut doc0, from, to)
+                        {
+                            write_errors.push(write_error(spec_index, err));
+                            continue 'statements;
                         }
                     }
                 }
                 if let Some(ref pushes) = push_doc {
                     for (k, v) in pushes.iter() {
                         if !apply_push(&mut doc0, k, v.clone()) {
-                            return error_doc(2, "$push on non-array");
+                            write_errors
+                                .push(write_error(spec_index, error_doc(2, "$push on non-array")));
+                            continue 'statements;
                         }
                     }
                 }
@@ -1539,18 +5633,51 @@ async fn update_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Doc
                         apply_pull(&mut doc0, k, v.clone());
                     }
                 }
-                match pg.update_doc_by_id(dbname, coll, &idb, &doc0).await {
-                    Ok(_n) => {
-                        matched_total += 1;
-                        if doc0 != orig {
-                            modified_total += 1;
+                if let Some(ref bits) = bit_doc {
+                    for (k, v) in bits.iter() {
+                        if let Err(err) = apply_bit(&mut doc0, k, v) {
+                            write_errors.push(write_error(spec_index, err));
+                            continue 'statements;
+                        }
+                    }
+                }
+                if let Some(ref dates) = current_date_doc {
+                    for (k, v) in dates.iter() {
+                        if let Err(err) = apply_current_date(&mut doc0, k, v, now) {
+                            write_errors.push(write_error(spec_index, err));
+                            continue 'statements;
                         }
                     }
-                    Err(e) => return error_doc(59, format!("update failed: {}", e)),
+                }
+                if let Some(err) = check_updated_size(state, coll, &orig, &doc0) {
+                    write_errors.push(write_error(spec_index, err));
+                    continue 'statements;
+                }
+                if let Some(err) = check_validator(validator.as_ref(), &doc0, Some(&orig)) {
+                    write_errors.push(write_error(spec_index, err));
+                    continue 'statements;
+                }
+                matched_total += 1;
+                if !doc_changed(&orig, &doc0) {
+                    continue 'statements;
+                }
+                match pg.update_doc_by_id(dbname, coll, &idb, &doc0).await {
+                    Ok(_n) => modified_total += 1,
+                    Err(e) => {
+                        write_errors.push(write_error(
+                            spec_index,
+                            store_error(format!("update failed: {}", e)),
+                        ));
+                        continue 'statements;
+                    }
                 }
             } else if upsert {
                 if let Err(e) = pg.ensure_collection(dbname, coll).await {
-                    return error_doc(59, format!("ensure_collection failed: {}", e));
+                    write_errors.push(write_error(
+                        spec_index,
+                        store_error(format!("ensure_collection failed: {}", e)),
+                    ));
+                    continue 'statements;
                 }
                 let mut new_doc = bson::Document::new();
                 for (k, v) in filter.iter() {
@@ -1578,21 +5705,33 @@ async fn update_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Doc
                 if let Some(ref incs) = inc_doc {
                     for (k, v) in incs.iter() {
                         if !apply_inc(&mut new_doc, k, v.clone()) {
-                            return error_doc(2, "$inc requires numeric field");
+                            write_errors.push(write_error(
+                                spec_index,
+                                error_doc(
+                                    TYPE_MISMATCH,
+                                    "Cannot apply $inc to a value of non-numeric type",
+                                ),
+                            ));
+                            continue 'statements;
                         }
                     }
                 }
                 if let Some(ref ren) = rename_doc {
                     for (from, to_b) in ren.iter() {
-                        if let bson::Bson::String(to) = to_b {
-                            apply_rename(&mut new_doc, from, to);
+                        if let bson::Bson::String(to) = to_b
+                            && let Err(err) = apply_rename(&mut new_doc, from, to)
+                        {
+                            write_errors.push(write_error(spec_index, err));
+                            continue 'statements;
                         }
                     }
                 }
                 if let Some(ref pushes) = push_doc {
                     for (k, v) in pushes.iter() {
                         if !apply_push(&mut new_doc, k, v.clone()) {
-                            return error_doc(2, "$push on non-array");
+                            write_errors
+                                .push(write_error(spec_index, error_doc(2, "$push on non-array")));
+                            continue 'statements;
                         }
                     }
                 }
@@ -1601,19 +5740,65 @@ async fn update_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Doc
                         apply_pull(&mut new_doc, k, v.clone());
                     }
                 }
+                if let Some(ref bits) = bit_doc {
+                    for (k, v) in bits.iter() {
+                        if let Err(err) = apply_bit(&mut new_doc, k, v) {
+                            write_errors.push(write_error(spec_index, err));
+                            continue 'statements;
+                        }
+                    }
+                }
+                if let Some(ref dates) = current_date_doc {
+                    for (k, v) in dates.iter() {
+                        if let Err(err) = apply_current_date(&mut new_doc, k, v, now) {
+                            write_errors.push(write_error(spec_index, err));
+                            continue 'statements;
+                        }
+                    }
+                }
+                if let Some(ref stages) = update_pipeline {
+                    match crate::aggregation::update::apply_pipeline(&new_doc, stages, &vars) {
+                        Ok(updated) => new_doc = updated,
+                        Err(e) => {
+                            write_errors.push(write_error(spec_index, update_pipeline_error(e)));
+                            continue 'statements;
+                        }
+                    }
+                }
                 ensure_id(&mut new_doc);
                 let idb = match new_doc.get("_id").and_then(id_bytes_bson) {
                     Some(v) => v,
-                    None => return error_doc(2, "unsupported _id type"),
+                    None => {
+                        write_errors.push(write_error(
+                            spec_index,
+                            error_doc(2, "unsupported _id type"),
+                        ));
+                        continue 'statements;
+                    }
                 };
-                let json = match serde_json::to_value(&new_doc) {
+                let json = match crate::bson_type::to_jsonb(&new_doc) {
                     Ok(v) => v,
-                    Err(e) => return error_doc(2, e.to_string()),
+                    Err(e) => {
+                        write_errors.push(write_error(spec_index, error_doc(2, e.to_string())));
+                        continue 'statements;
+                    }
                 };
                 let bson_bytes = match bson::to_vec(&new_doc) {
                     Ok(v) => v,
-                    Err(e) => return error_doc(2, e.to_string()),
+                    Err(e) => {
+                        write_errors.push(write_error(spec_index, error_doc(2, e.to_string())));
+                        continue 'statements;
+                    }
                 };
+                if let Some(mut err) = check_bson_size(state, bson_bytes.len()) {
+                    err.insert("ok", 0.0);
+                    write_errors.push(write_error(spec_index, err));
+                    continue 'statements;
+                }
+                if let Some(err) = check_validator(validator.as_ref(), &new_doc, None) {
+                    write_errors.push(write_error(spec_index, err));
+                    continue 'statements;
+                }
                 match pg.insert_one(dbname, coll, &idb, &bson_bytes, &json).await {
                     Ok(n) => {
                         if n == 1 {
@@ -1621,7 +5806,13 @@ async fn update_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Doc
                             upserted_entries.push(doc!{"index": (spec_index as i32), "_id": new_doc.get("_id").cloned().unwrap_or(bson::Bson::Null)});
                         }
                     }
-                    Err(e) => return error_doc(59, format!("insert failed: {}", e)),
+                    Err(e) => {
+                        write_errors.push(write_error(
+                            spec_index,
+                            store_error(format!("insert failed: {}", e)),
+                        ));
+                        continue 'statements;
+                    }
                 }
             }
         }
@@ -1630,20 +5821,36 @@ async fn update_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Doc
     if !upserted_entries.is_empty() {
         reply.insert("upserted", upserted_entries);
     }
+    if !write_errors.is_empty() {
+        reply.insert("writeErrors", write_errors);
+    }
     reply
 }
 
+/// Matching documents a multi-document update reads and writes back per statement.
+const MULTI_UPDATE_BATCH_ROWS: i64 = 1000;
+
+/// Entry of `writeErrors` for statement `index`, from the error reply it would otherwise
+/// have returned.
+fn write_error(index: usize, mut err: Document) -> Document {
+    err.remove("ok");
+    err.remove("codeName");
+    let mut we = doc! { "index": index as i32 };
+    we.extend(err);
+    we
+}
+
 async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
     let dbname = match db {
         Some(d) => d,
-        None => return error_doc(59, "Missing $db"),
+        None => return error_doc(MISSING_DB, "Missing $db"),
     };
     let coll = match cmd.get_str("findAndModify") {
         Ok(c) => c,
-        Err(_) => return error_doc(9, "Invalid findAndModify"),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid findAndModify"),
     };
     if state.store.is_none() {
-        return error_doc(13, "No storage configured");
+        return no_storage_error();
     }
     let pg = state.store.as_ref().unwrap();
 
@@ -1652,6 +5859,9 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
         .ok()
         .cloned()
         .unwrap_or_else(bson::Document::new);
+    if let Some(err) = reject_find_only(&filter) {
+        return err;
+    }
     let sort = cmd.get_document("sort").ok().cloned();
     let new_return = cmd.get_bool("new").unwrap_or(false);
     let remove = cmd.get_bool("remove").unwrap_or(false);
@@ -1664,25 +5874,29 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
         .or_else(|| cmd.get_document("projection").ok().cloned());
 
     if remove && update_doc.is_some() {
-        return error_doc(9, "Cannot specify both remove and update");
+        return error_doc(FAILED_TO_PARSE, "Cannot specify both remove and update");
     }
     if !remove && update_doc.is_none() {
-        return error_doc(9, "Missing update or remove");
+        return error_doc(FAILED_TO_PARSE, "Missing update or remove");
     }
+    let validator = match write_validator(pg, dbname, coll, cmd).await {
+        Ok(v) => v,
+        Err(err_doc) => return err_doc,
+    };
 
     // Ensure collection exists if we may insert (upsert)
     if upsert && let Err(e) = pg.ensure_collection(dbname, coll).await {
-        return error_doc(59, format!("ensure_collection failed: {}", e));
+        return store_error(format!("ensure_collection failed: {}", e));
     }
 
     // Transactional path using pooled connection
     let mut client = match pg.get_client().await {
         Ok(c) => c,
-        Err(e) => return error_doc(59, format!("tx client failed: {}", e)),
+        Err(e) => return store_error(format!("tx client failed: {}", e)),
     };
     let tx = match client.transaction().await {
         Ok(t) => t,
-        Err(e) => return error_doc(59, format!("tx begin failed: {}", e)),
+        Err(e) => return store_error(format!("tx begin failed: {}", e)),
     };
     let found = match pg
         .find_one_for_update_sorted_tx(&tx, dbname, coll, &filter, sort.as_ref())
@@ -1691,7 +5905,7 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
         Ok(v) => v,
         Err(e) => {
             let _ = tx.rollback().await;
-            return error_doc(59, format!("find failed: {}", e));
+            return store_error(format!("find failed: {}", e));
         }
     };
     if let Some((idb, mut current)) = found {
@@ -1701,7 +5915,7 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
             match pg.delete_by_id_tx(&tx, dbname, coll, &idb).await {
                 Ok(n) => {
                     if let Err(e) = tx.commit().await {
-                        return error_doc(59, format!("tx commit failed: {}", e));
+                        return store_error(format!("tx commit failed: {}", e));
                     }
                     let mut value = before;
                     if let Some(ref p) = proj {
@@ -1711,7 +5925,7 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
                 }
                 Err(e) => {
                     let _ = tx.rollback().await;
-                    error_doc(59, format!("delete failed: {}", e))
+                    store_error(format!("delete failed: {}", e))
                 }
             }
         } else {
@@ -1723,15 +5937,24 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
             let rename_doc = udoc.get_document("$rename").ok().cloned();
             let push_doc = udoc.get_document("$push").ok().cloned();
             let pull_doc = udoc.get_document("$pull").ok().cloned();
+            let bit_doc = udoc.get_document("$bit").ok().cloned();
+            let current_date_doc = udoc.get_document("$currentDate").ok().cloned();
+            // One clock reading per update, so every field it stamps agrees
+            let now = bson::DateTime::now();
             if set_doc.is_none()
                 && unset_doc.is_none()
                 && inc_doc.is_none()
                 && rename_doc.is_none()
                 && push_doc.is_none()
                 && pull_doc.is_none()
+                && bit_doc.is_none()
+                && current_date_doc.is_none()
             {
                 let _ = tx.rollback().await;
-                return error_doc(9, "Only $set/$unset/$inc/$rename/$push/$pull supported");
+                return error_doc(
+                    FAILED_TO_PARSE,
+                    "Only $set/$unset/$inc/$rename/$push/$pull/$bit/$currentDate supported",
+                );
             }
             if let Some(ref sets) = set_doc {
                 for (k, v) in sets.iter() {
@@ -1747,7 +5970,10 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
                 for (k, v) in incs.iter() {
                     if !apply_inc(&mut current, k, v.clone()) {
                         let _ = tx.rollback().await;
-                        return error_doc(2, "$inc requires numeric field");
+                        return error_doc(
+                            TYPE_MISMATCH,
+                            "Cannot apply $inc to a value of non-numeric type",
+                        );
                     }
                 }
             }
@@ -1768,7 +5994,10 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
                     return err;
                 }
                 for (from, to) in pairs {
-                    apply_rename(&mut current, &from, &to);
+                    if let Err(err) = apply_rename(&mut current, &from, &to) {
+                        let _ = tx.rollback().await;
+                        return err;
+                    }
                 }
             }
             if let Some(ref pushes) = push_doc {
@@ -1784,14 +6013,39 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
                     apply_pull(&mut current, k, v.clone());
                 }
             }
+            if let Some(ref bits) = bit_doc {
+                for (k, v) in bits.iter() {
+                    if let Err(err) = apply_bit(&mut current, k, v) {
+                        let _ = tx.rollback().await;
+                        return err;
+                    }
+                }
+            }
+            if let Some(ref dates) = current_date_doc {
+                for (k, v) in dates.iter() {
+                    if let Err(err) = apply_current_date(&mut current, k, v, now) {
+                        let _ = tx.rollback().await;
+                        return err;
+                    }
+                }
+            }
 
+            if let Some(err) = check_updated_size(state, coll, &before, &current) {
+                let _ = tx.rollback().await;
+                return err;
+            }
+            if let Some(mut err) = check_validator(validator.as_ref(), &current, Some(&before)) {
+                let _ = tx.rollback().await;
+                err.insert("ok", 0.0);
+                return err;
+            }
             match pg
                 .update_doc_by_id_tx(&tx, dbname, coll, &idb, &current)
                 .await
             {
                 Ok(_n) => {
                     if let Err(e) = tx.commit().await {
-                        return error_doc(59, format!("tx commit failed: {}", e));
+                        return store_error(format!("tx commit failed: {}", e));
                     }
                     let value = if new_return { current } else { before };
                     let value = if let Some(ref p) = proj {
@@ -1803,7 +6057,7 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
                 }
                 Err(e) => {
                     let _ = tx.rollback().await;
-                    error_doc(59, format!("update failed: {}", e))
+                    store_error(format!("update failed: {}", e))
                 }
             }
         }
@@ -1836,6 +6090,10 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
             let rename_doc = udoc.get_document("$rename").ok().cloned();
             let push_doc = udoc.get_document("$push").ok().cloned();
             let pull_doc = udoc.get_document("$pull").ok().cloned();
+            let bit_doc = udoc.get_document("$bit").ok().cloned();
+            let current_date_doc = udoc.get_document("$currentDate").ok().cloned();
+            // One clock reading per update, so every field it stamps agrees
+            let now = bson::DateTime::now();
             if let Some(ref sets) = set_doc {
                 for (k, v) in sets.iter() {
                     set_path_nested(&mut new_doc, k, v.clone());
@@ -1849,7 +6107,10 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
             if let Some(ref incs) = inc_doc {
                 for (k, v) in incs.iter() {
                     if !apply_inc(&mut new_doc, k, v.clone()) {
-                        return error_doc(2, "$inc requires numeric field");
+                        return error_doc(
+                            TYPE_MISMATCH,
+                            "Cannot apply $inc to a value of non-numeric type",
+                        );
                     }
                 }
             }
@@ -1864,7 +6125,9 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
                     return err;
                 }
                 for (from, to) in pairs {
-                    apply_rename(&mut new_doc, &from, &to);
+                    if let Err(err) = apply_rename(&mut new_doc, &from, &to) {
+                        return err;
+                    }
                 }
             }
             if let Some(ref pushes) = push_doc {
@@ -1879,6 +6142,20 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
                     apply_pull(&mut new_doc, k, v.clone());
                 }
             }
+            if let Some(ref bits) = bit_doc {
+                for (k, v) in bits.iter() {
+                    if let Err(err) = apply_bit(&mut new_doc, k, v) {
+                        return err;
+                    }
+                }
+            }
+            if let Some(ref dates) = current_date_doc {
+                for (k, v) in dates.iter() {
+                    if let Err(err) = apply_current_date(&mut new_doc, k, v, now) {
+                        return err;
+                    }
+                }
+            }
         }
         ensure_id(&mut new_doc);
         let idb = match new_doc.get("_id").and_then(id_bytes_bson) {
@@ -1889,18 +6166,26 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
             Ok(v) => v,
             Err(e) => return error_doc(2, e.to_string()),
         };
-        let json = match serde_json::to_value(&new_doc) {
+        if let Some(mut err) = check_bson_size(state, bson_bytes.len()) {
+            err.insert("ok", 0.0);
+            return err;
+        }
+        if let Some(mut err) = check_validator(validator.as_ref(), &new_doc, None) {
+            err.insert("ok", 0.0);
+            return err;
+        }
+        let json = match crate::bson_type::to_jsonb(&new_doc) {
             Ok(v) => v,
             Err(e) => return error_doc(2, e.to_string()),
         };
         // Insert in its own transaction
         let mut client2 = match pg.get_client().await {
             Ok(c) => c,
-            Err(e) => return error_doc(59, format!("tx client failed: {}", e)),
+            Err(e) => return store_error(format!("tx client failed: {}", e)),
         };
         let tx2 = match client2.transaction().await {
             Ok(t) => t,
-            Err(e) => return error_doc(59, format!("tx begin failed: {}", e)),
+            Err(e) => return store_error(format!("tx begin failed: {}", e)),
         };
         match pg
             .insert_one_tx(&tx2, dbname, coll, &idb, &bson_bytes, &json)
@@ -1908,7 +6193,7 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
         {
             Ok(n) => {
                 if let Err(e) = tx2.commit().await {
-                    return error_doc(59, format!("tx commit failed: {}", e));
+                    return store_error(format!("tx commit failed: {}", e));
                 }
                 let value = if new_return {
                     let mut v = new_doc.clone();
@@ -1929,7 +6214,7 @@ async fn find_and_modify_reply(state: &AppState, db: Option<&str>, cmd: &Documen
             }
             Err(e) => {
                 let _ = tx2.rollback().await;
-                error_doc(59, format!("insert failed: {}", e))
+                store_error(format!("insert failed: {}", e))
             }
         }
     }
@@ -2101,11 +6386,63 @@ fn get_path_bson_value(doc: &Document, path: &str) -> Option<bson::Bson> {
     Some(cur)
 }
 
-fn apply_rename(doc: &mut Document, from: &str, to: &str) {
-    if let Some(val) = get_path_bson_value(doc, from) {
-        unset_path_nested(doc, from);
-        set_path_nested(doc, to, val);
+/// Maps an update pipeline failure to its MongoDB error code.
+fn update_pipeline_error(e: anyhow::Error) -> Document {
+    if let Some(err) = e.downcast_ref::<crate::aggregation::update::UpdatePipelineError>() {
+        return error_doc(err.code(), err.to_string());
+    }
+    if let Some(err) = e.downcast_ref::<NewRootNotDocument>() {
+        return error_doc(NewRootNotDocument::CODE, err.to_string());
+    }
+    error_doc(2, format!("update pipeline failed: {}", e))
+}
+
+/// Move the value at `from` to `to`; a missing source is a no-op. Like MongoDB, neither path
+/// may pass through an array, and the destination may not pass through a non-document.
+fn apply_rename(doc: &mut Document, from: &str, to: &str) -> std::result::Result<(), Document> {
+    check_rename_path(doc, from, false)?;
+    let val = match get_path_bson_value(doc, from) {
+        Some(v) => v,
+        None => return Ok(()),
+    };
+    check_rename_path(doc, to, true)?;
+    unset_path_nested(doc, from);
+    set_path_nested(doc, to, val);
+    Ok(())
+}
+
+/// Reject a `$rename` path whose parent crosses an array (code 2) or, for the destination,
+/// a scalar it would have to replace (code 28).
+fn check_rename_path(
+    doc: &Document,
+    path: &str,
+    destination: bool,
+) -> std::result::Result<(), Document> {
+    let segs = parse_path(path);
+    let mut cur = doc;
+    for (i, seg) in segs[..segs.len() - 1].iter().enumerate() {
+        let code = match cur.get(*seg) {
+            Some(bson::Bson::Document(d)) => {
+                cur = d;
+                continue;
+            }
+            None => return Ok(()),
+            Some(bson::Bson::Array(_)) => 2,
+            Some(_) if destination => 28,
+            Some(_) => return Ok(()),
+        };
+        return Err(error_doc(
+            code,
+            format!(
+                "cannot use the part ({} of {}) to traverse the element ({{{}: {}}})",
+                segs[i + 1],
+                path,
+                seg,
+                cur.get(*seg).unwrap()
+            ),
+        ));
     }
+    Ok(())
 }
 
 fn number_as_f64(b: &bson::Bson) -> Option<f64> {
@@ -2176,6 +6513,118 @@ fn apply_inc(doc: &mut Document, path: &str, delta: bson::Bson) -> bool {
     }
 }
 
+/// `$bit` on the integer at `path`: `spec` holds `and`/`or`/`xor` operands applied in order.
+/// A missing field starts at 0; the result is a long when either side is.
+fn apply_bit(
+    doc: &mut Document,
+    path: &str,
+    spec: &bson::Bson,
+) -> std::result::Result<(), Document> {
+    let ops = match spec {
+        bson::Bson::Document(d) if !d.is_empty() => d,
+        _ => {
+            return Err(error_doc(
+                2,
+                format!(
+                    "The $bit modifier for field '{}' must be a document like {{or: 4}}",
+                    path
+                ),
+            ));
+        }
+    };
+    let mut cur = match get_path_bson_value(doc, path) {
+        None => bson::Bson::Int32(0),
+        Some(v @ (bson::Bson::Int32(_) | bson::Bson::Int64(_))) => v,
+        Some(other) => {
+            return Err(error_doc(
+                2,
+                format!(
+                    "Cannot apply $bit to a value of non-integral type. The field '{}' has type {:?}",
+                    path,
+                    other.element_type()
+                ),
+            ));
+        }
+    };
+    for (op, operand) in ops.iter() {
+        let apply = |a: i64, b: i64| match op.as_str() {
+            "and" => Some(a & b),
+            "or" => Some(a | b),
+            "xor" => Some(a ^ b),
+            _ => None,
+        };
+        cur = match (&cur, operand) {
+            (bson::Bson::Int32(a), bson::Bson::Int32(b)) => {
+                apply(*a as i64, *b as i64).map(|v| bson::Bson::Int32(v as i32))
+            }
+            (bson::Bson::Int32(a), bson::Bson::Int64(b)) => {
+                apply(*a as i64, *b).map(bson::Bson::Int64)
+            }
+            (bson::Bson::Int64(a), bson::Bson::Int32(b)) => {
+                apply(*a, *b as i64).map(bson::Bson::Int64)
+            }
+            (bson::Bson::Int64(a), bson::Bson::Int64(b)) => apply(*a, *b).map(bson::Bson::Int64),
+            _ => {
+                return Err(error_doc(
+                    2,
+                    format!(
+                        "The $bit modifier field must be an Integer(32/64 bit); a '{:?}' is not supported here",
+                        operand.element_type()
+                    ),
+                ));
+            }
+        }
+        .ok_or_else(|| {
+            error_doc(
+                2,
+                format!(
+                    "The $bit modifier only supports 'and', 'or', and 'xor', not '{}' which is an unknown operator",
+                    op
+                ),
+            )
+        })?;
+    }
+    set_path_nested(doc, path, cur);
+    Ok(())
+}
+
+/// `$currentDate`: `true` (or `{$type: "date"}`) stores `now` as a Date, `{$type: "timestamp"}`
+/// as a Timestamp.
+fn apply_current_date(
+    doc: &mut Document,
+    path: &str,
+    spec: &bson::Bson,
+    now: bson::DateTime,
+) -> std::result::Result<(), Document> {
+    let value = match spec {
+        bson::Bson::Boolean(_) => bson::Bson::DateTime(now),
+        bson::Bson::Document(d) => match d.get_str("$type") {
+            Ok("date") if d.len() == 1 => bson::Bson::DateTime(now),
+            Ok("timestamp") if d.len() == 1 => bson::Bson::Timestamp(bson::Timestamp {
+                time: (now.timestamp_millis() / 1000) as u32,
+                increment: 1,
+            }),
+            _ => {
+                return Err(error_doc(
+                    2,
+                    "The '$type' string field is required to be 'date' or 'timestamp': {$currentDate: {field : {$type: 'date'}}}",
+                ));
+            }
+        },
+        other => {
+            return Err(error_doc(
+                2,
+                format!(
+                    "{:?} is not valid type for $currentDate. Please use a boolean ('true') or a $type expression ({{$type: 'timestamp/date'}}).",
+                    other.element_type()
+                ),
+            ));
+        }
+    };
+    set_path_nested(doc, path, value);
+    Ok(())
+}
+
 fn apply_push(doc: &mut Document, path: &str, val: bson::Bson) -> bool {
     // Support:
     // - { $push: { a: v }}
@@ -3217,6 +7666,14 @@ fn field_matches(doc: &Document, field: &str, expected: &bson::Bson) -> bool {
                             return false;
                         }
                     }
+                    "$type" => {
+                        if !actual
+                            .as_ref()
+                            .is_some_and(|v| crate::bson_type::matches(v, op_val))
+                        {
+                            return false;
+                        }
+                    }
                     "$exists" => {
                         let exists = actual.is_some();
                         let want_exists = op_val.as_bool().unwrap_or(true);
@@ -3526,47 +7983,115 @@ fn apply_project_with_expr(input: &Document, proj: &Document) -> Document {
 async fn delete_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
     let dbname = match db {
         Some(d) => d,
-        None => return error_doc(59, "Missing $db"),
+        None => return error_doc(MISSING_DB, "Missing $db"),
     };
     let coll = match cmd.get_str("delete") {
         Ok(c) => c,
-        Err(_) => return error_doc(9, "Invalid delete"),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid delete"),
     };
     let deletes = match cmd.get_array("deletes") {
         Ok(a) => a,
         Err(_) => {
-            tracing::warn!(collection=%coll, cmd=?cmd, "delete missing 'deletes' array");
-            return error_doc(9, "Missing deletes");
+            tracing::warn!(collection=%coll, cmd=?crate::logging::redact_command(&cmd), "delete missing 'deletes' array");
+            return error_doc(FAILED_TO_PARSE, "Missing deletes");
         }
     };
     if deletes.is_empty() {
-        return error_doc(9, "Empty deletes");
+        return error_doc(FAILED_TO_PARSE, "Empty deletes");
     }
-    let first = match &deletes[0] {
-        bson::Bson::Document(d) => d,
-        _ => return error_doc(9, "Invalid delete spec"),
-    };
-    let filter = match first.get_document("q") {
-        Ok(d) => d.clone(),
-        Err(_) => return error_doc(9, "Missing q"),
-    };
-    let limit = first.get_i32("limit").unwrap_or(1);
     if state.store.is_none() {
-        return error_doc(13, "No storage configured");
+        return no_storage_error();
     }
     let pg = state.store.as_ref().unwrap();
-    if limit == 0 {
-        match pg.delete_many_by_filter(dbname, coll, &filter).await {
-            Ok(n) => doc! {"n": (n as i32), "ok": 1.0},
-            Err(e) => error_doc(59, format!("delete failed: {}", e)),
+    let vars = match command_vars_arg(cmd, bson::DateTime::now()) {
+        Ok(v) => v,
+        Err(err_doc) => return err_doc,
+    };
+    // Every statement is parsed, and its hint resolved, before any runs, so a malformed one
+    // fails the command without deleting anything
+    let mut statements = Vec::with_capacity(deletes.len());
+    for spec in deletes {
+        let spec = match spec {
+            bson::Bson::Document(d) => d,
+            _ => return error_doc(FAILED_TO_PARSE, "Invalid delete spec"),
+        };
+        let filter = match spec.get_document("q") {
+            Ok(d) => d.clone(),
+            Err(_) => return error_doc(FAILED_TO_PARSE, "Missing q"),
+        };
+        if let Some(err) = reject_find_only(&filter) {
+            return err;
         }
-    } else if limit == 1 {
-        match pg.delete_one_by_filter(dbname, coll, &filter).await {
-            Ok(n) => doc! {"n": (n as i32), "ok": 1.0},
-            Err(e) => error_doc(59, format!("delete failed: {}", e)),
+        let filter = match bind_expr_filter(&filter, &vars) {
+            Ok(f) => f,
+            Err(err_doc) => return err_doc,
+        };
+        let limit = match spec.get("limit").map(|v| bson_number(Some(v))) {
+            None => 1,
+            Some(Some(l @ (0 | 1))) => l,
+            Some(_) => return error_doc(2, "Only limit 0 (many) or 1 supported"),
+        };
+        if let Err(err_doc) = apply_write_hint(pg, dbname, coll, spec).await {
+            return err_doc;
         }
-    } else {
-        error_doc(2, "Only limit 0 (many) or 1 supported")
+        statements.push((filter, limit, crate::store::index_hinted()));
+    }
+
+    // Statements run in order. An ordered delete stops at the first that fails; an
+    // unordered one reports each failure in `writeErrors` and carries on. `n` totals the
+    // documents every statement deleted.
+    let ordered = cmd.get_bool("ordered").unwrap_or(true);
+    let mut deleted = 0i64;
+    let mut write_errors: Vec<Document> = Vec::new();
+    for (index, (filter, limit, hinted)) in statements.into_iter().enumerate() {
+        if ordered && !write_errors.is_empty() {
+            break;
+        }
+        crate::store::set_index_hint(hinted);
+        let res = if limit == 0 {
+            pg.delete_many_by_filter(dbname, coll, &filter).await
+        } else {
+            pg.delete_one_by_filter(dbname, coll, &filter).await
+        };
+        match res {
+            Ok(n) => deleted += n as i64,
+            Err(e) => write_errors.push(write_error(
+                index,
+                store_error(format!("delete failed: {}", e)),
+            )),
+        }
+    }
+    let mut reply = doc! {"n": deleted as i32, "ok": 1.0};
+    if !write_errors.is_empty() {
+        reply.insert("writeErrors", write_errors);
+    }
+    reply
+}
+
+/// The first stage of an `{aggregate: 1}` pipeline as the `$documents` source the engine
+/// runs from, or an error reply when the stage needs a collection.
+fn collectionless_source(
+    state: &AppState,
+    db: &str,
+    first: &crate::aggregation::Stage,
+) -> std::result::Result<crate::aggregation::Stage, Document> {
+    match first {
+        crate::aggregation::Stage::Documents(_) => Ok(first.clone()),
+        crate::aggregation::Stage::CurrentOp if db == "admin" => {
+            let entries = current_op_entries(state)
+                .into_iter()
+                .map(Bson::Document)
+                .collect();
+            Ok(crate::aggregation::Stage::Documents(Bson::Array(entries)))
+        }
+        crate::aggregation::Stage::CurrentOp => Err(error_doc(
+            73,
+            "$currentOp must be run against the 'admin' database with {aggregate: 1}",
+        )),
+        _ => Err(error_doc(
+            73,
+            "{aggregate: 1} is not valid for a pipeline that does not start with $documents or $currentOp",
+        )),
     }
 }
 
@@ -3576,50 +8101,141 @@ async fn aggregate_reply(state: &AppState, db: Option<&str>, cmd: &Document) ->
         Ok(d) => d.to_string(),
         Err(_) => match db {
             Some(d) => d.to_string(),
-            None => return error_doc(59, "Missing $db"),
+            None => return error_doc(MISSING_DB, "Missing $db"),
         },
     };
 
-    // Extract collection name from aggregate field
+    // Extract collection name from aggregate field; `aggregate: 1` runs a pipeline that
+    // supplies its own documents
+    let collectionless = matches!(
+        cmd.get("aggregate"),
+        Some(Bson::Int32(1)) | Some(Bson::Int64(1))
+    ) || matches!(cmd.get("aggregate"), Some(Bson::Double(n)) if *n == 1.0);
     let coll = match cmd.get_str("aggregate") {
         Ok(c) => c.to_string(),
-        Err(_) => return error_doc(9, "Invalid aggregate"),
+        Err(_) if collectionless => "$cmd.aggregate".to_string(),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid aggregate"),
     };
 
     // Check storage is configured
     if state.store.is_none() {
-        return error_doc(13, "No storage configured");
+        return no_storage_error();
     }
-    let pg = state.store.as_ref().unwrap();
 
     // Parse the pipeline using the new aggregation system
-    let pipeline = match crate::aggregation::Pipeline::parse(cmd) {
+    let mut pipeline = match crate::aggregation::Pipeline::parse(cmd) {
         Ok(p) => p,
         Err(e) => {
             tracing::warn!(collection=%coll, error=%e, "Failed to parse aggregation pipeline");
-            return error_doc(9, format!("Failed to parse pipeline: {}", e));
+            return error_doc(FAILED_TO_PARSE, format!("Failed to parse pipeline: {}", e));
+        }
+    };
+
+    match (collectionless, pipeline.stages.first()) {
+        (true, Some(first)) => match collectionless_source(state, &dbname, first) {
+            Ok(source) => pipeline.stages[0] = source,
+            Err(err_doc) => return err_doc,
+        },
+        (true, None) => {
+            return error_doc(73, "{aggregate: 1} is not valid for an empty pipeline");
+        }
+        (false, Some(crate::aggregation::Stage::Documents(_))) => {
+            return error_doc(73, "$documents can only be run with {aggregate: 1}");
+        }
+        (false, Some(crate::aggregation::Stage::CurrentOp)) => {
+            return error_doc(73, "$currentOp can only be run with {aggregate: 1}");
+        }
+        (false, _) => {}
+    }
+
+    // A view reads its collection through the view's own pipeline, run ahead of this one;
+    // the cursor keeps the view's namespace
+    let mut view_len = 0;
+    let source = if collectionless {
+        coll.clone()
+    } else {
+        match resolve_view(state.store.as_ref().unwrap(), &dbname, &coll).await {
+            Ok((source, view_stages)) => {
+                view_len = view_stages.len();
+                pipeline.stages.splice(0..0, view_stages);
+                source
+            }
+            Err(err_doc) => return err_doc,
+        }
+    };
+
+    // `let` variables are bound into `$match` filters up front, so a leading one can still
+    // run as SQL
+    let vars = match command_vars_arg(cmd, bson::DateTime::now()) {
+        Ok(v) => v,
+        Err(err_doc) => return err_doc,
+    };
+    for stage in pipeline.stages.iter_mut() {
+        if let crate::aggregation::Stage::Match(filter) = stage {
+            *filter = crate::aggregation::expr::bind_filter_vars(filter, &vars);
         }
+    }
+
+    // $out and $merge write, so they always run against the primary
+    let writes = pipeline.stages.iter().any(|s| {
+        matches!(
+            s,
+            crate::aggregation::Stage::Out(_) | crate::aggregation::Stage::Merge(_)
+        )
+    });
+    let pg = match read_store(state, cmd) {
+        Some(pg) if !writes => pg,
+        _ => state.store.as_ref().unwrap(),
     };
 
     // Extract cursor options for batch size
     let cursor_spec = cmd.get_document("cursor").unwrap_or(&doc! {}).clone();
-    let batch_size = cursor_spec.get_i32("batchSize").unwrap_or(101) as i64;
+    let batch_size = match batch_size_arg(&cursor_spec) {
+        Ok(b) => b.unwrap_or(DEFAULT_BATCH_SIZE),
+        Err(err_doc) => return err_doc,
+    };
+
+    let collation = if collectionless {
+        parse_collation(cmd)
+    } else {
+        effective_collation(pg, &dbname, &source, cmd).await
+    };
+    let collation = match collation {
+        Ok(c) => c,
+        Err(err_doc) => return err_doc,
+    };
 
     // Create execution context with let variables
     let allow_disk_use = pipeline.options.allow_disk_use;
-    let let_vars: std::collections::HashMap<String, Bson> = pipeline
-        .options
-        .let_vars
-        .iter()
-        .map(|(k, v)| (k.clone(), v.clone()))
-        .collect();
-    let ctx = crate::aggregation::ExecContext::with_vars(
+    let mut ctx = crate::aggregation::ExecContext::with_vars(
         Some(pg),
         dbname.clone(),
-        coll.clone(),
+        source.clone(),
         allow_disk_use,
-        let_vars,
-    );
+        vars,
+    )
+    .with_memory_limit(state.aggregation_memory_limit_bytes);
+    ctx.collation = collation;
+
+    if pipeline.options.explain {
+        return aggregate_explain_reply(&ctx, &coll, cmd, pipeline, view_len).await;
+    }
+
+    // Pipelines PostgreSQL can run on its own stream through a held cursor instead of
+    // being materialized
+    if let Some(query) = crate::aggregation::exec::pushdown_query(&pipeline.stages) {
+        return held_aggregate_reply(
+            state,
+            pg,
+            &dbname,
+            &coll,
+            &source,
+            &query,
+            ctx.collation.as_ref(),
+            batch_size,
+        )
+        .await;
+    }
 
     // Execute the pipeline
     match crate::aggregation::execute_pipeline(&ctx, pipeline).await {
@@ -3646,6 +8262,13 @@ async fn aggregate_reply(state: &AppState, db: Option<&str>, cmd: &Document) ->
             doc! { "cursor": cursor_doc, "ok": 1.0 }
         }
         Ok(crate::aggregation::ExecResult::WriteOut(stats)) => {
+            // One write was admitted up front; charge the target the rest
+            let written = stats.inserted_count + stats.modified_count + stats.deleted_count;
+            if let Some((target_db, target)) = aggregate_write_target(&dbname, cmd) {
+                state
+                    .write_limiter
+                    .charge(&target_db, &target, (written - 1).max(0) as u64);
+            }
             // Return write statistics for $out/$merge operations
             let mut result = doc! { "ok": 1.0 };
             if stats.inserted_count > 0 {
@@ -3662,11 +8285,238 @@ async fn aggregate_reply(state: &AppState, db: Option<&str>, cmd: &Document) ->
             }
             result
         }
-        Err(e) => {
-            tracing::error!(collection=%coll, error=%e, "Aggregation pipeline execution failed");
-            error_doc(59, format!("aggregate failed: {}", e))
+        Err(e) => aggregate_error(&coll, e),
+    }
+}
+
+/// The reply for a pipeline that failed while running.
+fn aggregate_error(coll: &str, e: anyhow::Error) -> Document {
+    if let Some(limit) = e.downcast_ref::<crate::aggregation::memory::MemoryLimitExceeded>() {
+        return error_doc(292, limit.to_string());
+    }
+    if let Some(err) = e.downcast_ref::<NewRootNotDocument>() {
+        return error_doc(NewRootNotDocument::CODE, err.to_string());
+    }
+    if let Some(err) = e.downcast_ref::<InvalidRedactResult>() {
+        return error_doc(InvalidRedactResult::CODE, err.to_string());
+    }
+    if let Some(err) = e.downcast_ref::<PositionalProjectionError>() {
+        return error_doc(err.code, err.message.clone());
+    }
+    if let Some(err) = e.downcast_ref::<crate::aggregation::stages::geo_near::GeoIndexError>() {
+        return error_doc(err.code, err.message.clone());
+    }
+    tracing::error!(collection=%coll, error=%e, "Aggregation pipeline execution failed");
+    store_error(format!("aggregate failed: {}", e))
+}
+
+/// `aggregate` with `explain: true`: runs the pipeline and reports, stage by stage, how
+/// many documents each returned and how long it took. The stages PostgreSQL answers in the
+/// query that reads the collection are folded into a leading `$cursor` stage, which lists
+/// them in `fusedStages` and carries that query's `EXPLAIN ANALYZE` plan; the others are
+/// timed as the engine runs them.
+async fn aggregate_explain_reply(
+    ctx: &crate::aggregation::ExecContext<'_>,
+    coll: &str,
+    cmd: &Document,
+    pipeline: crate::aggregation::Pipeline,
+    view_len: usize,
+) -> Document {
+    use crate::aggregation::Stage;
+    use crate::aggregation::exec::{StageProfile, execute_pipeline_profiled, source_query};
+
+    if pipeline
+        .stages
+        .iter()
+        .any(|s| matches!(s, Stage::Out(_) | Stage::Merge(_)))
+    {
+        return error_doc(
+            BAD_VALUE,
+            "explain runs the pipeline, so it cannot include $out or $merge",
+        );
+    }
+    let pg = match ctx.pg {
+        Some(pg) => pg,
+        None => return no_storage_error(),
+    };
+    let names: Vec<&'static str> = pipeline.stages.iter().map(Stage::name).collect();
+    // The command's own stages follow those of the view it reads
+    let specs = cmd
+        .get_array("pipeline")
+        .map(|a| a.as_slice())
+        .unwrap_or(&[]);
+    let stage_spec = |i: usize| {
+        i.checked_sub(view_len)
+            .and_then(|j| specs.get(j))
+            .and_then(Bson::as_document)
+            .and_then(|d| d.iter().next())
+            .map(|(_, v)| v.clone())
+            .unwrap_or_else(|| Bson::Document(Document::new()))
+    };
+
+    let mut stages = Vec::new();
+    let source = source_query(&pipeline.stages, ctx.memory.allow_disk_use());
+    let fused = source.as_ref().map_or(0, |(_, n)| *n);
+    if let Some((query, _)) = &source {
+        let plan = match pg
+            .explain_docs(
+                &ctx.db,
+                &ctx.coll,
+                query.filter.as_ref(),
+                query.sort.as_ref(),
+                query.skip,
+                query.limit,
+                ctx.collation.as_ref(),
+                ExplainVerbosity::ExecutionStats,
+            )
+            .await
+        {
+            Ok(p) => Some(p),
+            // A missing collection reads nothing
+            Err(e) if store_error_code(&e.to_string()) == NAMESPACE_NOT_FOUND => None,
+            Err(e) => return store_error(format!("explain failed: {}", e)),
+        };
+        let (n_returned, millis, examined) = plan.as_ref().map_or((0, 0.0, 0), analyzed_stats);
+        let mut winning_plan = match plan.as_ref().and_then(find_index_scan) {
+            Some(index) => doc! {"stage": "IXSCAN", "indexName": index},
+            None => doc! {"stage": "COLLSCAN"},
+        };
+        if let Some(b) = plan.as_ref().and_then(|p| bson::to_bson(p).ok()) {
+            winning_plan.insert("postgresPlan", b);
+        }
+        let mut stage = doc! {
+            "$cursor": {
+                "queryPlanner": {
+                    "namespace": format!("{}.{}", ctx.db, ctx.coll),
+                    "parsedQuery": query.filter.clone().unwrap_or_default(),
+                    "winningPlan": winning_plan,
+                },
+                "executionStats": {
+                    "nReturned": n_returned,
+                    "executionTimeMillis": millis.round() as i64,
+                    "totalDocsExamined": examined,
+                },
+            },
+        };
+        if fused > 0 {
+            stage.insert("fusedStages", names[..fused].to_vec());
+        }
+        stage.insert("nReturned", n_returned);
+        stage.insert("executionTimeMillisEstimate", millis.round() as i64);
+        stages.push(Bson::Document(stage));
+    }
+
+    // Stages left to the engine run for real; those the query answered are not run twice
+    if fused < names.len() {
+        let mut profile: Vec<StageProfile> = Vec::new();
+        if let Err(e) = execute_pipeline_profiled(ctx, pipeline, Some(&mut profile)).await {
+            return aggregate_error(coll, e);
+        }
+        for step in profile.iter().filter(|p| p.index >= fused) {
+            let mut stage = Document::new();
+            stage.insert(names[step.index], stage_spec(step.index));
+            if step.fused > 1 {
+                stage.insert(
+                    "fusedStages",
+                    names[step.index..step.index + step.fused].to_vec(),
+                );
+            }
+            stage.insert("nReturned", step.n_returned as i64);
+            stage.insert(
+                "executionTimeMillisEstimate",
+                step.elapsed.as_millis() as i64,
+            );
+            stages.push(Bson::Document(stage));
         }
     }
+
+    doc! {
+        "explainVersion": "1",
+        "stages": stages,
+        "command": cmd.clone(),
+        "ok": 1.0,
+    }
+}
+
+/// Rows returned, execution time in milliseconds and rows read from tables, from an
+/// `EXPLAIN (ANALYZE, FORMAT JSON)` plan.
+fn analyzed_stats(plan: &serde_json::Value) -> (i64, f64, i64) {
+    fn rows(node: &serde_json::Value, key: &str) -> f64 {
+        let loops = node
+            .get("Actual Loops")
+            .and_then(|v| v.as_f64())
+            .unwrap_or(1.0);
+        node.get(key).and_then(|v| v.as_f64()).unwrap_or(0.0) * loops
+    }
+    fn examined(node: &serde_json::Value) -> f64 {
+        let own = if node.get("Relation Name").is_some() {
+            rows(node, "Actual Rows") + rows(node, "Rows Removed by Filter")
+        } else {
+            0.0
+        };
+        let children = node
+            .get("Plans")
+            .and_then(|v| v.as_array())
+            .map_or(0.0, |plans| plans.iter().map(examined).sum());
+        own + children
+    }
+    let top = plan.get(0);
+    let root = top.and_then(|t| t.get("Plan"));
+    let millis = top
+        .and_then(|t| t.get("Execution Time"))
+        .and_then(|v| v.as_f64())
+        .unwrap_or(0.0);
+    (
+        root.map_or(0.0, |r| rows(r, "Actual Rows")) as i64,
+        millis,
+        root.map_or(0.0, examined) as i64,
+    )
+}
+
+/// `aggregate` over a pipeline that is a single query: declare a PostgreSQL cursor for it,
+/// return the first `batch_size` documents and keep the cursor open for `getMore`. `source`
+/// is the collection read, which differs from `coll` when `coll` is a view.
+#[allow(clippy::too_many_arguments)]
+async fn held_aggregate_reply(
+    state: &AppState,
+    pg: &PgStore,
+    dbname: &str,
+    coll: &str,
+    source: &str,
+    query: &crate::aggregation::exec::PushdownQuery,
+    collation: Option<&crate::store::Collation>,
+    batch_size: i64,
+) -> Document {
+    let mut held = match pg
+        .open_doc_cursor(
+            dbname,
+            source,
+            query.filter.as_ref(),
+            query.sort.as_ref(),
+            query.skip,
+            query.limit,
+            collation,
+        )
+        .await
+    {
+        Ok(c) => c,
+        Err(e) => return store_error(format!("aggregate failed: {}", e)),
+    };
+    let first_batch = if batch_size > 0 {
+        match held.fetch(batch_size as usize).await {
+            Ok(v) => v,
+            Err(e) => return store_error(format!("aggregate failed: {}", e)),
+        }
+    } else {
+        Vec::new()
+    };
+    let ns = format!("{}.{}", dbname, coll);
+    let cursor_id = if held.is_exhausted() {
+        0i64
+    } else {
+        new_held_cursor(state, ns.clone(), held).await
+    };
+    doc! { "cursor": {"firstBatch": first_batch, "id": cursor_id, "ns": ns}, "ok": 1.0 }
 }
 
 #[allow(dead_code)]
@@ -3677,13 +8527,13 @@ async fn handle_out_stage(
     docs: Vec<Document>,
 ) -> Document {
     if state.store.is_none() {
-        return error_doc(13, "No storage configured");
+        return no_storage_error();
     }
     let pg = state.store.as_ref().unwrap();
 
     // Ensure the target collection exists
     if let Err(e) = pg.ensure_collection(dbname, target_coll).await {
-        return error_doc(59, format!("Failed to create target collection: {}", e));
+        return store_error(format!("Failed to create target collection: {}", e));
     }
 
     // Delete all existing documents in the target collection
@@ -3693,7 +8543,7 @@ async fn handle_out_stage(
     {
         Ok(_) => {}
         Err(e) => {
-            return error_doc(59, format!("Failed to clear target collection: {}", e));
+            return store_error(format!("Failed to clear target collection: {}", e));
         }
     }
 
@@ -3708,7 +8558,7 @@ async fn handle_out_stage(
                 continue;
             }
         };
-        let json = match serde_json::to_value(&d) {
+        let json = match crate::bson_type::to_jsonb(&d) {
             Ok(v) => v,
             Err(_) => continue,
         };
@@ -3742,7 +8592,7 @@ async fn handle_merge_stage(
     docs: Vec<Document>,
 ) -> Document {
     if state.store.is_none() {
-        return error_doc(13, "No storage configured");
+        return no_storage_error();
     }
     let pg = state.store.as_ref().unwrap();
 
@@ -3753,10 +8603,17 @@ async fn handle_merge_stage(
             // Support { into: { coll: "name" } } format
             match d.get_str("coll") {
                 Ok(s) => s.to_string(),
-                Err(_) => return error_doc(9, "$merge 'into' must specify a collection"),
+                Err(_) => {
+                    return error_doc(FAILED_TO_PARSE, "$merge 'into' must specify a collection");
+                }
             }
         }
-        _ => return error_doc(9, "$merge 'into' must be a string or document"),
+        _ => {
+            return error_doc(
+                FAILED_TO_PARSE,
+                "$merge 'into' must be a string or document",
+            );
+        }
     };
 
     // Get merge options with defaults
@@ -3766,7 +8623,7 @@ async fn handle_merge_stage(
 
     // Ensure the target collection exists
     if let Err(e) = pg.ensure_collection(dbname, &target_coll).await {
-        return error_doc(59, format!("Failed to ensure target collection: {}", e));
+        return store_error(format!("Failed to ensure target collection: {}", e));
     }
 
     let mut matched_count = 0i32;
@@ -3804,11 +8661,15 @@ async fn handle_merge_stage(
             match when_matched {
                 "merge" => {
                     // Merge fields from source into existing document
+                    let before = existing_doc.clone();
                     for (k, v) in doc.iter() {
                         if k != "_id" {
                             set_path_nested(&mut existing_doc, k, v.clone());
                         }
                     }
+                    if !doc_changed(&before, &existing_doc) {
+                        continue;
+                    }
                     if pg
                         .update_doc_by_id(dbname, &target_coll, &idb, &existing_doc)
                         .await
@@ -3823,6 +8684,9 @@ async fn handle_merge_stage(
                     // Replace entire document but keep _id
                     let id_val = existing_doc.get("_id").cloned();
                     doc.insert("_id", id_val.unwrap_or(bson::Bson::Null));
+                    if !doc_changed(&existing_doc, &doc) {
+                        continue;
+                    }
                     if pg
                         .update_doc_by_id(dbname, &target_coll, &idb, &doc)
                         .await
@@ -3837,15 +8701,22 @@ async fn handle_merge_stage(
                     // Do nothing, keep existing document
                 }
                 "fail" => {
-                    return error_doc(59, "Document already exists in target collection");
+                    return error_doc(
+                        DUPLICATE_KEY,
+                        "Document already exists in target collection",
+                    );
                 }
                 _ => {
                     // Default to merge
+                    let before = existing_doc.clone();
                     for (k, v) in doc.iter() {
                         if k != "_id" {
                             set_path_nested(&mut existing_doc, k, v.clone());
                         }
                     }
+                    if !doc_changed(&before, &existing_doc) {
+                        continue;
+                    }
                     if pg
                         .update_doc_by_id(dbname, &target_coll, &idb, &existing_doc)
                         .await
@@ -3865,7 +8736,7 @@ async fn handle_merge_stage(
                         Some(v) => v,
                         None => continue,
                     };
-                    let json = match serde_json::to_value(&doc) {
+                    let json = match crate::bson_type::to_jsonb(&doc) {
                         Ok(v) => v,
                         Err(_) => continue,
                     };
@@ -3896,7 +8767,7 @@ async fn handle_merge_stage(
                         Some(v) => v,
                         None => continue,
                     };
-                    let json = match serde_json::to_value(&doc) {
+                    let json = match crate::bson_type::to_jsonb(&doc) {
                         Ok(v) => v,
                         Err(_) => continue,
                     };
@@ -3930,40 +8801,284 @@ async fn handle_merge_stage(
     }
 }
 
+/// JSInterpreterFailure
+const ERROR_JS_INTERPRETER_FAILURE: i32 = 139;
+
+/// Most documents a `$where` predicate is evaluated against. They are loaded whole, so a
+/// query whose other conditions select more is refused instead.
+const WHERE_SCAN_LIMIT: i64 = 100_000;
+
+/// The error reply for a `$where` nested under a logical operator, which is not evaluated.
+fn nested_where_error() -> Document {
+    error_doc(
+        BAD_VALUE,
+        "$where is only supported at the top level of a filter",
+    )
+}
+
+/// Compile a `$where` predicate, or the error reply when it is disabled or malformed.
+fn compile_where(
+    state: &AppState,
+    code: &bson::Bson,
+) -> std::result::Result<crate::js::Predicate, Document> {
+    if !state.javascript_enabled {
+        return Err(error_doc(
+            2,
+            "$where is disabled on this server (javascript_enabled = false)",
+        ));
+    }
+    let source = match code {
+        bson::Bson::String(s) | bson::Bson::JavaScriptCode(s) => s.as_str(),
+        bson::Bson::JavaScriptCodeWithScope(c) => c.code.as_str(),
+        _ => return Err(error_doc(2, "$where got bad type")),
+    };
+    crate::js::Predicate::compile(source).map_err(|e| {
+        error_doc(
+            ERROR_JS_INTERPRETER_FAILURE,
+            format!("$where compile error: {}", e),
+        )
+    })
+}
+
+/// Keep the documents `pred` accepts (at most `limit` when positive), projecting them only
+/// after the predicate has seen them whole.
+fn apply_where(
+    pred: &crate::js::Predicate,
+    docs: Vec<Document>,
+    projection: Option<&Document>,
+    limit: i64,
+) -> std::result::Result<Vec<Document>, Document> {
+    let mut out = Vec::new();
+    for d in docs {
+        if limit > 0 && out.len() as i64 >= limit {
+            break;
+        }
+        match pred.matches(&d) {
+            Ok(true) => out.push(match projection {
+                Some(p) => apply_project_with_expr(&d, p),
+                None => d,
+            }),
+            Ok(false) => {}
+            Err(e) => {
+                return Err(error_doc(
+                    ERROR_JS_INTERPRETER_FAILURE,
+                    format!("$where evaluation failed: {}", e),
+                ));
+            }
+        }
+    }
+    Ok(out)
+}
+
+/// `$where` and `$jsonSchema` are only evaluated by `find`; other commands would silently
+/// ignore them.
+fn reject_find_only(filter: &Document) -> Option<Document> {
+    if filter.contains_key("$where") || crate::js::nested_where(filter) {
+        return Some(error_doc(2, "$where is only supported by find"));
+    }
+    crate::json_schema::in_filter(filter).then(|| {
+        error_doc(
+            2,
+            "$jsonSchema in a query is only supported by find and $match",
+        )
+    })
+}
+
+/// The command's variables, `$$NOW` and its `let` values, or the error reply for an
+/// invalid `let`.
+fn command_vars_arg(
+    cmd: &Document,
+    now: bson::DateTime,
+) -> std::result::Result<HashMap<String, Bson>, Document> {
+    crate::aggregation::expr::command_vars(cmd.get_document("let").ok(), now)
+        .map_err(|e| error_doc(2, format!("invalid let: {}", e)))
+}
+
+/// `filter` with the command's variables bound into its `$expr` conditions, or the error
+/// reply when one of them has no SQL translation (filters run entirely in PostgreSQL).
+fn bind_expr_filter(
+    filter: &Document,
+    vars: &HashMap<String, Bson>,
+) -> std::result::Result<Document, Document> {
+    let bound = crate::aggregation::expr::bind_filter_vars(filter, vars);
+    if !crate::translate::expr_filters_translate(&bound) {
+        return Err(error_doc(
+            2,
+            "$expr in a query filter supports comparisons, $and, $or, $not and arithmetic over fields, literals and let variables",
+        ));
+    }
+    Ok(bound)
+}
+
+/// Resolve a write statement's `hint` and mark the statement hinted or not for the store
+/// (see [`crate::store::set_index_hint`]). A hint naming no index is a BadValue error.
+async fn apply_write_hint(
+    pg: &PgStore,
+    db: &str,
+    coll: &str,
+    spec: &Document,
+) -> std::result::Result<(), Document> {
+    let hint = match spec.get("hint") {
+        None => None,
+        Some(Bson::Document(d)) if d.is_empty() => None,
+        // A `$natural` hint asks for a collection scan, which needs no index
+        Some(Bson::Document(d)) if d.contains_key("$natural") => None,
+        Some(h @ (Bson::String(_) | Bson::Document(_))) => Some(h),
+        Some(_) => {
+            return Err(error_doc(
+                FAILED_TO_PARSE,
+                "hint must be a string or an object",
+            ));
+        }
+    };
+    if let Some(hint) = hint {
+        match pg.resolve_hint(db, coll, hint).await {
+            Ok(Some(_)) => {}
+            Ok(None) => {
+                return Err(error_doc(
+                    2,
+                    "hint provided does not correspond to an existing index",
+                ));
+            }
+            Err(e) => return Err(store_error(format!("hint lookup failed: {}", e))),
+        }
+    }
+    crate::store::set_index_hint(hint.is_some());
+    Ok(())
+}
+
+/// Documents per batch when a cursor command has no `batchSize`.
+const DEFAULT_BATCH_SIZE: i64 = 101;
+
+/// The command's `batchSize`, rejecting negative values like mongod.
+/// Store serving a read command. The `secondary` and `secondaryPreferred` read preferences
+/// go to the `postgres_read_url` replica when one is configured; every other mode, and any
+/// read inside a transaction, stays on the primary.
+fn read_store<'a>(state: &'a AppState, cmd: &Document) -> Option<&'a PgStore> {
+    let mode = cmd
+        .get_document("$readPreference")
+        .ok()
+        .and_then(|rp| rp.get_str("mode").ok());
+    if matches!(mode, Some("secondary" | "secondaryPreferred"))
+        && !cmd.contains_key("txnNumber")
+        && let Some(replica) = state.read_store.as_ref()
+    {
+        return Some(replica);
+    }
+    state.store.as_ref()
+}
+
+fn batch_size_arg(cmd: &Document) -> std::result::Result<Option<i64>, Document> {
+    let batch_size = match cmd.get("batchSize") {
+        None => return Ok(None),
+        Some(Bson::Int32(v)) => *v as i64,
+        Some(Bson::Int64(v)) => *v,
+        Some(Bson::Double(v)) if v.fract() == 0.0 => *v as i64,
+        Some(_) => return Err(error_doc(14, "batchSize must be a number")),
+    };
+    if batch_size < 0 {
+        return Err(error_doc(
+            2,
+            format!(
+                "BatchSize value must be non-negative, but received: {}",
+                batch_size
+            ),
+        ));
+    }
+    Ok(Some(batch_size))
+}
+
 async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
     let dbname = match db {
         Some(d) => d,
-        None => return error_doc(59, "Missing $db"),
+        None => return error_doc(MISSING_DB, "Missing $db"),
     };
     let coll = match cmd.get_str("find") {
         Ok(c) => c,
-        Err(_) => return error_doc(9, "Invalid find"),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid find"),
     };
+    if let Some(ref pg) = state.store
+        && let Ok(Some(_)) = pg.view_definition(dbname, coll).await
+    {
+        let mut agg = find_on_view_command(coll, cmd);
+        agg.insert("$db", dbname);
+        return aggregate_reply(state, db, &agg).await;
+    }
     let limit = cmd
         .get_i64("limit")
         .ok()
         .or(cmd.get_i32("limit").ok().map(|v| v as i64))
         .unwrap_or(0);
-    let batch_size = cmd
-        .get_i64("batchSize")
-        .ok()
-        .or(cmd.get_i32("batchSize").ok().map(|v| v as i64))
-        .unwrap_or(0);
-    let first_batch_limit = if limit > 0 {
-        limit
-    } else if batch_size > 0 {
-        batch_size
-    } else {
-        101
+    // A negative limit is the legacy spelling of `singleBatch`: return up to abs(limit)
+    // documents and close the cursor
+    let single_batch = limit < 0 || cmd.get_bool("singleBatch").unwrap_or(false);
+    let limit = limit.saturating_abs();
+    let batch_size = match batch_size_arg(cmd) {
+        Ok(b) => b,
+        Err(err_doc) => return err_doc,
+    };
+    // `batchSize` sizes only the first batch (0 opens the cursor without returning any
+    // documents); `limit` bounds the whole result
+    let mut first_batch_limit = match batch_size {
+        Some(b) if !(single_batch && b == 0) => b,
+        _ if single_batch && limit > 0 => limit,
+        _ => DEFAULT_BATCH_SIZE,
     };
+    if limit > 0 {
+        first_batch_limit = first_batch_limit.min(limit);
+    }
+    let keep_cursor_open = batch_size == Some(0) && !single_batch;
     let filter = cmd
         .get_document("filter")
         .ok()
         .or(cmd.get_document("query").ok());
-    let sort = cmd.get_document("sort").ok();
+    let vars = match command_vars_arg(cmd, bson::DateTime::now()) {
+        Ok(v) => v,
+        Err(err_doc) => return err_doc,
+    };
+    let bound_filter = match filter.map(|f| bind_expr_filter(f, &vars)).transpose() {
+        Ok(f) => f,
+        Err(err_doc) => return err_doc,
+    };
+    let filter = bound_filter.as_ref();
+    // Without a sort, `hint: {$natural: ±1}` asks for insertion order (or its reverse)
+    let natural_hint = cmd
+        .get_document("hint")
+        .ok()
+        .filter(|h| h.len() == 1 && h.contains_key("$natural"));
+    let sort = cmd.get_document("sort").ok().or(natural_hint);
     let projection = cmd.get_document("projection").ok();
+    // A positional projection (`items.$`) reads its array whole and narrows it to the
+    // element the filter matched once the documents are read
+    let positional = match projection.map(split_positional) {
+        Some(Ok(p)) => p,
+        Some(Err(e)) => return error_doc(e.code, e.message),
+        None => None,
+    };
+    let projection = positional.as_ref().map(|(spec, _)| spec).or(projection);
 
-    if let Some(ref pg) = state.store {
+    if let Some(pg) = read_store(state, cmd) {
+        let collation = match effective_collation(pg, dbname, coll, cmd).await {
+            Ok(c) => c,
+            Err(err_doc) => return err_doc,
+        };
+        let tailable = cmd.get_bool("tailable").unwrap_or(false);
+        let await_data = cmd.get_bool("awaitData").unwrap_or(false);
+        if await_data && !tailable {
+            return error_doc(2, "Cannot set 'awaitData' without also setting 'tailable'");
+        }
+        if tailable {
+            return tailable_find_reply(
+                state,
+                pg,
+                dbname,
+                coll,
+                filter,
+                await_data,
+                first_batch_limit,
+            )
+            .await;
+        }
         // Check for $text query and handle it specially
         let text_query_result = if let Some(f) = filter {
             match extract_text_search_params(f) {
@@ -3974,10 +9089,8 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
                             // Route to find_with_text_search
                             let limit_val = if limit > 0 {
                                 limit
-                            } else if batch_size > 0 {
-                                batch_size
                             } else {
-                                101
+                                first_batch_limit.max(DEFAULT_BATCH_SIZE)
                             };
                             match pg
                                 .find_with_text_search(
@@ -4046,17 +9159,76 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
                     remainder.push(d);
                 }
             }
-            let ns = format!("{}.{}", dbname, coll);
-            let mut cursor_doc = doc! { "ns": ns.clone(), "firstBatch": first_batch };
-            let cursor_id = if !remainder.is_empty() {
-                new_cursor(state, ns, remainder).await
-            } else {
-                0i64
-            };
-            if cursor_id != 0 {
-                cursor_doc.insert("id", cursor_id);
+            let ns = format!("{}.{}", dbname, coll);
+            let mut cursor_doc = doc! { "ns": ns.clone(), "firstBatch": first_batch };
+            let cursor_id = if !single_batch && (!remainder.is_empty() || keep_cursor_open) {
+                new_cursor(state, ns, remainder).await
+            } else {
+                0i64
+            };
+            cursor_doc.insert("id", cursor_id);
+            return doc! { "ok": 1.0, "cursor": cursor_doc };
+        }
+
+        // `$where` and the conditions using `$jsonSchema` run in-process over every document
+        // matching their sibling conditions, so those are fetched whole and unlimited;
+        // projection and limit apply afterwards
+        if filter.is_some_and(crate::js::nested_where) {
+            return nested_where_error();
+        }
+        let where_pred = match filter.and_then(|f| f.get("$where")) {
+            Some(code) => match compile_where(state, code) {
+                Ok(p) => Some(p),
+                Err(err_doc) => return err_doc,
+            },
+            None => None,
+        };
+        let (sibling_filter, schema_conditions) = match filter {
+            Some(f) if where_pred.is_some() || crate::json_schema::in_filter(f) => {
+                let (mut sql, in_memory) = crate::json_schema::split_filter(f);
+                sql.remove("$where");
+                (Some(sql), in_memory)
+            }
+            _ => (None, Document::new()),
+        };
+        // One row past the cap tells a `$where` scan that would exceed it
+        let in_memory_limit = if where_pred.is_some() {
+            WHERE_SCAN_LIMIT + 1
+        } else {
+            i64::MAX
+        };
+        let (filter, fetch_projection, fetch_limit) = match &sibling_filter {
+            Some(sql) => (Some(sql).filter(|f| !f.is_empty()), None, in_memory_limit),
+            None => (filter, projection, if limit > 0 { limit } else { i64::MAX }),
+        };
+        // Without a limit of its own, a query PostgreSQL expects to read more rows than
+        // `max_scan_rows` is refused before it runs. Lookups by `_id` read through the
+        // primary key.
+        let by_id = filter
+            .and_then(|f| f.get("_id"))
+            .and_then(id_bytes_bson)
+            .is_some();
+        if let Some(cap) = state.max_scan_rows
+            && limit == 0
+            && !by_id
+        {
+            match pg
+                .estimate_docs_examined(dbname, coll, filter, sort, collation.as_ref())
+                .await
+            {
+                Ok(rows) if rows > cap as f64 => {
+                    return error_doc(
+                        OPERATION_FAILED,
+                        format!(
+                            "query is estimated to examine {} documents, more than max_scan_rows ({}); add a limit or a more selective indexed filter",
+                            rows.round() as i64,
+                            cap
+                        ),
+                    );
+                }
+                Ok(_) => {}
+                Err(e) => tracing::debug!("estimate_docs_examined failed: {}", e),
             }
-            return doc! { "ok": 1.0, "cursor": cursor_doc };
         }
 
         // Check if we're in a transaction
@@ -4094,7 +9266,7 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
                                             dbname,
                                             coll,
                                             &idb,
-                                            first_batch_limit * 10,
+                                            fetch_limit,
                                         )
                                         .await
                                     {
@@ -4106,14 +9278,15 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
                                     }
                                 } else {
                                     match pg
-                                        .find_docs_with_client(
+                                        .find_docs_with_client_collated(
                                             client,
                                             dbname,
                                             coll,
                                             Some(f),
                                             sort,
-                                            projection,
-                                            first_batch_limit * 10,
+                                            fetch_projection,
+                                            fetch_limit,
+                                            collation.as_ref(),
                                         )
                                         .await
                                     {
@@ -4126,14 +9299,15 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
                                 }
                             } else {
                                 match pg
-                                    .find_docs_with_client(
+                                    .find_docs_with_client_collated(
                                         client,
                                         dbname,
                                         coll,
                                         Some(f),
                                         sort,
-                                        projection,
-                                        first_batch_limit * 10,
+                                        fetch_projection,
+                                        fetch_limit,
+                                        collation.as_ref(),
                                     )
                                     .await
                                 {
@@ -4146,14 +9320,15 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
                             }
                         } else {
                             match pg
-                                .find_docs_with_client(
+                                .find_docs_with_client_collated(
                                     client,
                                     dbname,
                                     coll,
                                     None,
                                     sort,
-                                    projection,
-                                    first_batch_limit * 10,
+                                    fetch_projection,
+                                    fetch_limit,
+                                    collation.as_ref(),
                                 )
                                 .await
                             {
@@ -4178,10 +9353,7 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
             if let Some(f) = filter {
                 if let Some(idv) = f.get("_id") {
                     if let Some(idb) = id_bytes_bson(idv) {
-                        match pg
-                            .find_by_id_docs(dbname, coll, &idb, first_batch_limit * 10)
-                            .await
-                        {
+                        match pg.find_by_id_docs(dbname, coll, &idb, fetch_limit).await {
                             Ok(v) => v,
                             Err(e) => {
                                 tracing::warn!("find_by_id failed: {}", e);
@@ -4190,13 +9362,14 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
                         }
                     } else {
                         match pg
-                            .find_docs(
+                            .find_docs_collated(
                                 dbname,
                                 coll,
                                 Some(f),
                                 sort,
-                                projection,
-                                first_batch_limit * 10,
+                                fetch_projection,
+                                fetch_limit,
+                                collation.as_ref(),
                             )
                             .await
                         {
@@ -4209,13 +9382,14 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
                     }
                 } else {
                     match pg
-                        .find_docs(
+                        .find_docs_collated(
                             dbname,
                             coll,
                             Some(f),
                             sort,
-                            projection,
-                            first_batch_limit * 10,
+                            fetch_projection,
+                            fetch_limit,
+                            collation.as_ref(),
                         )
                         .await
                     {
@@ -4228,7 +9402,15 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
                 }
             } else {
                 match pg
-                    .find_docs(dbname, coll, None, sort, projection, first_batch_limit * 10)
+                    .find_docs_collated(
+                        dbname,
+                        coll,
+                        None,
+                        sort,
+                        fetch_projection,
+                        fetch_limit,
+                        collation.as_ref(),
+                    )
                     .await
                 {
                     Ok(v) => v,
@@ -4240,6 +9422,50 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
             }
         };
 
+        let docs = match (&sibling_filter, &where_pred) {
+            (None, _) => docs,
+            (Some(_), where_pred) => {
+                if where_pred.is_some() && docs.len() as i64 > WHERE_SCAN_LIMIT {
+                    return error_doc(
+                        OPERATION_FAILED,
+                        format!(
+                            "$where would be evaluated against more than {} documents; narrow the query with other conditions",
+                            WHERE_SCAN_LIMIT
+                        ),
+                    );
+                }
+                let docs: Vec<Document> = docs
+                    .into_iter()
+                    .filter(|d| document_matches_filter(d, &schema_conditions))
+                    .collect();
+                match where_pred {
+                    Some(pred) => match apply_where(pred, docs, projection, limit) {
+                        Ok(d) => d,
+                        Err(err_doc) => return err_doc,
+                    },
+                    None => docs
+                        .into_iter()
+                        .take(if limit > 0 {
+                            limit as usize
+                        } else {
+                            usize::MAX
+                        })
+                        .map(|d| match projection {
+                            Some(p) => apply_project_with_expr(&d, p),
+                            None => d,
+                        })
+                        .collect(),
+                }
+            }
+        };
+        let docs = match &positional {
+            Some((_, field)) => match apply_positional(docs, field, bound_filter.as_ref()) {
+                Ok(d) => d,
+                Err(e) => return error_doc(e.code, e.message),
+            },
+            None => docs,
+        };
+
         let mut first_batch: Vec<Document> = Vec::new();
         let mut remainder: Vec<Document> = Vec::new();
         for (idx, d) in docs.into_iter().enumerate() {
@@ -4251,7 +9477,7 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
         }
         let ns = format!("{}.{}", dbname, coll);
         let mut cursor_doc = doc! { "ns": ns.clone(), "firstBatch": first_batch };
-        let cursor_id = if !remainder.is_empty() {
+        let cursor_id = if !single_batch && (!remainder.is_empty() || keep_cursor_open) {
             new_cursor(state, ns, remainder).await
         } else {
             0i64
@@ -4259,7 +9485,306 @@ async fn find_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Docum
         cursor_doc.insert("id", cursor_id);
         doc! { "cursor": cursor_doc, "ok": 1.0 }
     } else {
-        error_doc(13, "No storage configured")
+        no_storage_error()
+    }
+}
+
+/// `explain` of a `find`: the PostgreSQL plan of the translated query, summarised as a
+/// MongoDB-style `winningPlan` (`IXSCAN` when an index is used, `COLLSCAN` otherwise).
+/// From `executionStats` verbosity the query runs under `EXPLAIN ANALYZE` and its counts
+/// and timings are reported; `allPlansExecution` adds buffer usage and runs the plan
+/// PostgreSQL picks with the winning strategy disabled, reported as the rejected plan when
+/// it differs. An `aggregate` is explained as with its own `explain: true`.
+async fn explain_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let inner = match cmd.get_document("explain") {
+        Ok(d) => d,
+        Err(_) => return error_doc(FAILED_TO_PARSE, "explain requires a command document"),
+    };
+    let verbosity = match cmd.get("verbosity") {
+        None => ExplainVerbosity::QueryPlanner,
+        Some(Bson::String(v)) => match ExplainVerbosity::parse(v) {
+            Some(v) => v,
+            None => {
+                return error_doc(
+                    BAD_VALUE,
+                    "verbosity string must be one of {'queryPlanner', 'executionStats', 'allPlansExecution'}",
+                );
+            }
+        },
+        Some(_) => return error_doc(TYPE_MISMATCH, "verbosity must be a string"),
+    };
+    // Writes explain the query matching the documents of their first statement
+    let (coll, query, write) = match inner.iter().next().map(|(k, v)| (k.as_str(), v)) {
+        Some(("find", Bson::String(c))) => (c.as_str(), inner.clone(), false),
+        Some((name @ ("update" | "delete"), Bson::String(c))) => {
+            let list = if name == "update" {
+                "updates"
+            } else {
+                "deletes"
+            };
+            let stmt = match inner
+                .get_array(list)
+                .ok()
+                .and_then(|a| a.first())
+                .and_then(Bson::as_document)
+            {
+                Some(stmt) => stmt,
+                None => {
+                    return error_doc(
+                        FAILED_TO_PARSE,
+                        format!("explain of {} requires {}", name, list),
+                    );
+                }
+            };
+            let single = if name == "update" {
+                !stmt.get_bool("multi").unwrap_or(false)
+            } else {
+                bson_number(stmt.get("limit")) != Some(0)
+            };
+            let mut query = doc! {"filter": stmt.get_document("q").cloned().unwrap_or_default()};
+            if single {
+                query.insert("limit", 1i64);
+            }
+            for key in ["hint", "collation"] {
+                if let Some(v) = stmt.get(key) {
+                    query.insert(key, v.clone());
+                }
+            }
+            (c.as_str(), query, true)
+        }
+        Some(("aggregate", _)) => {
+            let mut agg = inner.clone();
+            agg.insert("explain", true);
+            return aggregate_reply(state, Some(dbname), &agg).await;
+        }
+        _ => {
+            let name = inner.keys().next().map(String::as_str).unwrap_or("");
+            return error_doc(
+                COMMAND_NOT_FOUND,
+                format!("explain is not implemented for '{}'", name),
+            );
+        }
+    };
+    let pg = match state.store.as_ref() {
+        Some(pg) => pg,
+        None => return no_storage_error(),
+    };
+    let collation = match effective_collation(pg, dbname, coll, &query).await {
+        Ok(c) => c,
+        Err(err_doc) => return err_doc,
+    };
+    let filter = query.get_document("filter").ok();
+    let sort = query.get_document("sort").ok();
+    let limit = query
+        .get_i64("limit")
+        .ok()
+        .or(query.get_i32("limit").ok().map(|v| v as i64))
+        .unwrap_or(0);
+    let plan = crate::store::with_index_hints(async {
+        if write {
+            apply_write_hint(pg, dbname, coll, &query).await?;
+        }
+        pg.explain_find(
+            dbname,
+            coll,
+            filter,
+            sort,
+            limit,
+            collation.as_ref(),
+            verbosity,
+        )
+        .await
+        .map_err(|e| error_doc(2, format!("explain failed: {}", e)))
+    })
+    .await;
+    let plan = match plan {
+        Ok(p) => p,
+        Err(err_doc) => return err_doc,
+    };
+    let winner = find_index_scan(&plan);
+    // PostgreSQL keeps only the plan it chose; the runner-up is the one it picks without
+    // the winning strategy
+    let mut alternatives = Vec::new();
+    if verbosity == ExplainVerbosity::AllPlansExecution {
+        let settings: &[&str] = if winner.is_some() {
+            &[
+                "enable_indexscan = off",
+                "enable_indexonlyscan = off",
+                "enable_bitmapscan = off",
+            ]
+        } else {
+            &["enable_seqscan = off"]
+        };
+        match pg
+            .explain_find_without(
+                dbname,
+                coll,
+                filter,
+                sort,
+                limit,
+                collation.as_ref(),
+                settings,
+            )
+            .await
+        {
+            Ok(alt) if find_index_scan(&alt) != winner => alternatives.push(alt),
+            Ok(_) => {}
+            Err(e) => return error_doc(2, format!("explain failed: {}", e)),
+        }
+    }
+    let query_planner = doc! {
+        "namespace": format!("{}.{}", dbname, coll),
+        "parsedQuery": filter.cloned().unwrap_or_default(),
+        "winningPlan": plan_summary(&plan),
+        "rejectedPlans": alternatives.iter().map(|p| Bson::Document(plan_summary(p))).collect::<Vec<_>>(),
+    };
+    if verbosity == ExplainVerbosity::QueryPlanner {
+        return doc! {
+            "queryPlanner": query_planner,
+            "command": inner.clone(),
+            "ok": 1.0,
+        };
+    }
+    let (n_returned, millis, examined) = analyzed_stats(&plan);
+    let mut execution_stats = doc! {
+        "executionSuccess": true,
+        "nReturned": n_returned,
+        "executionTimeMillis": millis.round() as i64,
+        "totalDocsExamined": examined,
+        "executionStages": plan_execution_stages(&plan),
+    };
+    if verbosity == ExplainVerbosity::AllPlansExecution {
+        // As in MongoDB, the candidates are listed only when there was more than one
+        let all_plans: Vec<Bson> = if alternatives.is_empty() {
+            Vec::new()
+        } else {
+            std::iter::once(&plan)
+                .chain(&alternatives)
+                .map(|p| {
+                    let (n_returned, millis, examined) = analyzed_stats(p);
+                    Bson::Document(doc! {
+                        "nReturned": n_returned,
+                        "executionTimeMillisEstimate": millis.round() as i64,
+                        "totalDocsExamined": examined,
+                        "executionStages": plan_execution_stages(p),
+                    })
+                })
+                .collect()
+        };
+        execution_stats.insert("allPlansExecution", all_plans);
+        let planning = plan
+            .get(0)
+            .and_then(|t| t.get("Planning Time"))
+            .and_then(|v| v.as_f64())
+            .unwrap_or(0.0);
+        execution_stats.insert("postgresPlanningTimeMillis", planning);
+        execution_stats.insert("postgresBuffers", plan_buffers(&plan));
+    }
+    doc! {
+        "queryPlanner": query_planner,
+        "executionStats": execution_stats,
+        "command": inner.clone(),
+        "ok": 1.0,
+    }
+}
+
+/// The MongoDB-style summary of an `EXPLAIN (FORMAT JSON)` plan: `IXSCAN` with the index
+/// it scans, or `COLLSCAN`, carrying the PostgreSQL plan itself as `postgresPlan`.
+fn plan_summary(plan: &serde_json::Value) -> Document {
+    let mut summary = plan_stage(plan);
+    if let Ok(b) = bson::to_bson(plan) {
+        summary.insert("postgresPlan", b);
+    }
+    summary
+}
+
+/// The `executionStages` of an analyzed plan: its stage with the rows it returned and read.
+fn plan_execution_stages(plan: &serde_json::Value) -> Document {
+    let (n_returned, millis, examined) = analyzed_stats(plan);
+    let mut stages = plan_stage(plan);
+    stages.insert("nReturned", n_returned);
+    stages.insert("executionTimeMillisEstimate", millis.round() as i64);
+    stages.insert("docsExamined", examined);
+    stages
+}
+
+fn plan_stage(plan: &serde_json::Value) -> Document {
+    match find_index_scan(plan) {
+        Some(index) => doc! {"stage": "IXSCAN", "indexName": index},
+        None => doc! {"stage": "COLLSCAN"},
+    }
+}
+
+/// Blocks the whole statement hit, read, dirtied and wrote, from the root node of an
+/// `EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON)` plan, whose counts include its children's.
+fn plan_buffers(plan: &serde_json::Value) -> Document {
+    let root = plan.get(0).and_then(|t| t.get("Plan"));
+    let blocks = |key: &str| {
+        root.and_then(|r| r.get(key))
+            .and_then(|v| v.as_i64())
+            .unwrap_or(0)
+    };
+    doc! {
+        "sharedHit": blocks("Shared Hit Blocks"),
+        "sharedRead": blocks("Shared Read Blocks"),
+        "sharedDirtied": blocks("Shared Dirtied Blocks"),
+        "sharedWritten": blocks("Shared Written Blocks"),
+        "localHit": blocks("Local Hit Blocks"),
+        "localRead": blocks("Local Read Blocks"),
+        "tempRead": blocks("Temp Read Blocks"),
+        "tempWritten": blocks("Temp Written Blocks"),
+    }
+}
+
+/// Name of the first index an `EXPLAIN (FORMAT JSON)` plan scans, if any.
+fn find_index_scan(plan: &serde_json::Value) -> Option<String> {
+    match plan {
+        serde_json::Value::Array(items) => items.iter().find_map(find_index_scan),
+        serde_json::Value::Object(node) => {
+            if let Some(name) = node.get("Index Name").and_then(|v| v.as_str()) {
+                return Some(name.to_string());
+            }
+            node.get("Plan")
+                .into_iter()
+                .chain(node.get("Plans"))
+                .find_map(find_index_scan)
+        }
+        _ => None,
+    }
+}
+
+/// The command's `collation`, else the collection's default one.
+async fn effective_collation(
+    pg: &PgStore,
+    db: &str,
+    coll: &str,
+    cmd: &Document,
+) -> std::result::Result<Option<crate::store::Collation>, Document> {
+    if let Some(c) = parse_collation(cmd)? {
+        return Ok(Some(c));
+    }
+    match pg.default_collation(db, coll).await {
+        Ok(c) => Ok(c),
+        Err(e) => {
+            tracing::warn!("default_collation failed: {}", e);
+            Ok(None)
+        }
+    }
+}
+
+/// The command's `collation`, or an error reply for options we cannot honour.
+fn parse_collation(
+    cmd: &Document,
+) -> std::result::Result<Option<crate::store::Collation>, Document> {
+    match cmd.get_document("collation") {
+        Ok(c) => crate::store::Collation::parse(c)
+            .map(Some)
+            .map_err(|e| error_doc(2, e.to_string())),
+        Err(_) => Ok(None),
     }
 }
 
@@ -4292,27 +9817,196 @@ fn id_bytes_bson(b: &bson::Bson) -> Option<Vec<u8>> {
 static CURSOR_SEQ: AtomicI32 = AtomicI32::new(1000);
 
 async fn new_cursor(state: &AppState, ns: String, docs: Vec<Document>) -> i64 {
+    insert_cursor(state, ns, docs, None, None).await
+}
+
+async fn new_tailable_cursor(state: &AppState, ns: String, tail: TailState) -> i64 {
+    insert_cursor(state, ns, Vec::new(), Some(tail), None).await
+}
+
+async fn new_held_cursor(state: &AppState, ns: String, held: DocCursor) -> i64 {
+    insert_cursor(state, ns, Vec::new(), None, Some(held)).await
+}
+
+async fn insert_cursor(
+    state: &AppState,
+    ns: String,
+    docs: Vec<Document>,
+    tail: Option<TailState>,
+    held: Option<DocCursor>,
+) -> i64 {
     let id = CURSOR_SEQ.fetch_add(1, Ordering::Relaxed) as i64;
     let entry = CursorEntry {
         ns,
         docs,
         pos: 0,
         last_access: Instant::now(),
+        conn: CONNECTION_ID.try_with(|id| *id).ok(),
+        lsid: SESSION_ID.try_with(|id| *id).ok().flatten(),
+        tail,
+        held,
     };
     let mut map = state.cursors.lock().await;
     map.insert(id, entry);
     id
 }
 
+/// `find` with `tailable: true`: the cursor stays open after the last document and later
+/// `getMore`s return documents inserted since (in `_id` order).
+async fn tailable_find_reply(
+    state: &AppState,
+    pg: &PgStore,
+    dbname: &str,
+    coll: &str,
+    filter: Option<&Document>,
+    await_data: bool,
+    batch_size: i64,
+) -> Document {
+    let docs = match pg
+        .find_docs_after_id(dbname, coll, filter, None, batch_size)
+        .await
+    {
+        Ok(v) => v,
+        Err(e) => return error_doc(2, format!("find failed: {}", e)),
+    };
+    let tail = TailState {
+        db: dbname.to_string(),
+        coll: coll.to_string(),
+        filter: filter.cloned(),
+        last_id: docs
+            .last()
+            .and_then(|d| d.get("_id"))
+            .and_then(id_bytes_bson),
+        await_data,
+    };
+    let ns = format!("{}.{}", dbname, coll);
+    let cursor_id = new_tailable_cursor(state, ns.clone(), tail).await;
+    doc! { "cursor": {"firstBatch": docs, "id": cursor_id, "ns": ns}, "ok": 1.0 }
+}
+
+/// `getMore` on a tailable cursor. Await-data cursors wait up to `maxTimeMS` for new
+/// documents and return an empty batch (keeping the cursor open) if none arrive.
+async fn tailable_get_more(
+    state: &AppState,
+    cursor_id: i64,
+    ns: String,
+    mut tail: TailState,
+    batch_size: i64,
+    cmd: &Document,
+) -> Document {
+    let pg = match state.store.as_ref() {
+        Some(pg) => pg,
+        None => return no_storage_error(),
+    };
+    let wait = if tail.await_data {
+        cmd.get_i64("maxTimeMS")
+            .ok()
+            .or(cmd.get_i32("maxTimeMS").ok().map(|v| v as i64))
+            .map(|ms| Duration::from_millis(ms.max(0) as u64))
+            .unwrap_or(DEFAULT_AWAIT_DATA_TIMEOUT)
+    } else {
+        Duration::ZERO
+    };
+    let deadline = Instant::now() + wait;
+    let docs = loop {
+        let docs = match pg
+            .find_docs_after_id(
+                &tail.db,
+                &tail.coll,
+                tail.filter.as_ref(),
+                tail.last_id.as_deref(),
+                batch_size,
+            )
+            .await
+        {
+            Ok(v) => v,
+            Err(e) => return error_doc(2, format!("getMore failed: {}", e)),
+        };
+        let now = Instant::now();
+        if !docs.is_empty() || now >= deadline {
+            break docs;
+        }
+        tokio::time::sleep(AWAIT_DATA_POLL_INTERVAL.min(deadline - now)).await;
+    };
+    if let Some(id) = docs
+        .last()
+        .and_then(|d| d.get("_id"))
+        .and_then(id_bytes_bson)
+    {
+        tail.last_id = Some(id);
+    }
+    let mut map = state.cursors.lock().await;
+    // The cursor may have been killed while we were waiting
+    let id = match map.get_mut(&cursor_id) {
+        Some(entry) => {
+            entry.tail = Some(tail);
+            entry.last_access = Instant::now();
+            cursor_id
+        }
+        None => 0i64,
+    };
+    doc! { "cursor": {"id": id, "ns": ns, "nextBatch": docs}, "ok": 1.0 }
+}
+
+/// `getMore` on a cursor backed by an open PostgreSQL cursor: fetch the next batch and
+/// drop the entry once the rows run out.
+async fn held_get_more(
+    state: &AppState,
+    cursor_id: i64,
+    ns: String,
+    mut held: DocCursor,
+    batch_size: usize,
+) -> Document {
+    let docs = match held.fetch(batch_size).await {
+        Ok(v) => v,
+        Err(e) => {
+            state.cursors.lock().await.remove(&cursor_id);
+            return error_doc(2, format!("getMore failed: {}", e));
+        }
+    };
+    let mut map = state.cursors.lock().await;
+    // The cursor may have been killed while we were fetching
+    let id = match map.get_mut(&cursor_id) {
+        Some(entry) if !held.is_exhausted() => {
+            entry.held = Some(held);
+            entry.last_access = Instant::now();
+            cursor_id
+        }
+        Some(_) => {
+            map.remove(&cursor_id);
+            0i64
+        }
+        None => 0i64,
+    };
+    doc! { "cursor": {"id": id, "ns": ns, "nextBatch": docs}, "ok": 1.0 }
+}
+
 async fn get_more_reply(state: &AppState, cmd: &Document) -> Document {
     let cursor_id = match cmd.get_i64("getMore") {
         Ok(v) => v,
-        Err(_) => return error_doc(9, "Invalid getMore"),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid getMore"),
+    };
+    // getMore treats a missing or zero batchSize as the default batch
+    let batch_size = match batch_size_arg(cmd) {
+        Ok(Some(b)) if b > 0 => b as usize,
+        Ok(_) => DEFAULT_BATCH_SIZE as usize,
+        Err(err_doc) => return err_doc,
     };
-    let batch_size = cmd.get_i32("batchSize").unwrap_or(101) as usize;
     let mut map = state.cursors.lock().await;
     if let Some(entry) = map.get_mut(&cursor_id) {
         let ns = entry.ns.clone();
+        if let Some(tail) = entry.tail.clone() {
+            // Release the cursor map while waiting for new documents
+            entry.last_access = Instant::now();
+            drop(map);
+            return tailable_get_more(state, cursor_id, ns, tail, batch_size as i64, cmd).await;
+        }
+        if let Some(held) = entry.held.take() {
+            // Release the cursor map while PostgreSQL fetches the batch
+            entry.last_access = Instant::now();
+            drop(map);
+            return held_get_more(state, cursor_id, ns, held, batch_size).await;
+        }
         let start = entry.pos;
         let end = (start + batch_size).min(entry.docs.len());
         let mut next_batch = Vec::with_capacity(end - start);
@@ -4355,20 +10049,18 @@ async fn prune_cursors_once(state: &AppState, ttl: Duration) {
 
 // Helper to extract UUID from lsid document
 fn extract_lsid(cmd: &Document) -> Option<Uuid> {
-    cmd.get_document("lsid").ok().and_then(|lsid_doc| {
-        lsid_doc.get("id").and_then(|bson_val| {
-            if let bson::Bson::Binary(binary) = bson_val {
-                // UUID is stored as a Binary with subtype 4
-                if binary.subtype == bson::spec::BinarySubtype::Uuid {
-                    Uuid::from_slice(binary.bytes.as_slice()).ok()
-                } else {
-                    None
-                }
-            } else {
-                None
-            }
-        })
-    })
+    cmd.get_document("lsid").ok().and_then(lsid_uuid)
+}
+
+// Helper to read the UUID of an `{id: UUID}` session document
+fn lsid_uuid(lsid_doc: &Document) -> Option<Uuid> {
+    match lsid_doc.get("id") {
+        // UUID is stored as a Binary with subtype 4
+        Some(bson::Bson::Binary(binary)) if binary.subtype == bson::spec::BinarySubtype::Uuid => {
+            Uuid::from_slice(binary.bytes.as_slice()).ok()
+        }
+        _ => None,
+    }
 }
 
 // Helper to extract txnNumber from command
@@ -4410,7 +10102,7 @@ async fn start_transaction_reply(state: &AppState, _db: Option<&str>, cmd: &Docu
     // Get the pool from store
     let pg = match state.store.as_ref() {
         Some(pg) => pg,
-        None => return error_doc(13, "No storage configured"),
+        None => return no_storage_error(),
     };
 
     // Start the transaction
@@ -4498,20 +10190,160 @@ async fn abort_transaction_reply(state: &AppState, _db: Option<&str>, cmd: &Docu
 async fn end_sessions_reply(state: &AppState, cmd: &Document) -> Document {
     let ids = match cmd.get_array("endSessions") {
         Ok(arr) => arr,
-        Err(_) => return error_doc(ERROR_ILLEGAL_OPERATION, "Missing endSessions array"),
+        Err(_) => return error_doc(ERROR_ILLEGAL_OPERATION, "Missing endSessions array"),
+    };
+
+    for id_bson in ids {
+        if let Some(uuid) = id_bson.as_document().and_then(lsid_uuid) {
+            state.session_manager.end_session(uuid).await;
+        }
+    }
+
+    doc! { "ok": 1.0 }
+}
+
+async fn refresh_sessions_reply(state: &AppState, cmd: &Document) -> Document {
+    let ids = match cmd.get_array("refreshSessions") {
+        Ok(arr) => arr,
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Missing refreshSessions array"),
+    };
+    let mut lsids = Vec::with_capacity(ids.len());
+    for id_bson in ids {
+        match id_bson.as_document().and_then(lsid_uuid) {
+            Some(uuid) => lsids.push(uuid),
+            None => {
+                return error_doc(
+                    FAILED_TO_PARSE,
+                    "refreshSessions entries must be {id: UUID}",
+                );
+            }
+        }
+    }
+    state.session_manager.refresh_sessions(&lsids).await;
+    doc! { "ok": 1.0 }
+}
+
+/// Expire sessions idle for longer than `logicalSessionTimeoutMinutes`, rolling back their
+/// transactions and closing the cursors they opened. Returns how many were removed.
+async fn reap_expired_sessions(state: &AppState) -> usize {
+    let expired = state.session_manager.cleanup_expired_sessions().await;
+    if !expired.is_empty() {
+        state
+            .cursors
+            .lock()
+            .await
+            .retain(|_, e| !e.lsid.is_some_and(|l| expired.contains(&l)));
+    }
+    expired.len()
+}
+
+/// One pass of the TTL monitor: delete the documents each TTL index has expired. Reads the
+/// indexes afresh, so a `collMod` changing `expireAfterSeconds` applies from the next pass.
+async fn delete_expired_documents(state: &AppState) {
+    let Some(pg) = state.store.as_ref() else {
+        return;
+    };
+    let indexes = match pg.ttl_indexes().await {
+        Ok(indexes) => indexes,
+        Err(e) => {
+            tracing::warn!("listing TTL indexes failed: {}", e);
+            return;
+        }
+    };
+    for ttl in indexes {
+        match pg.delete_expired(&ttl).await {
+            Ok(0) => {}
+            Ok(n) => {
+                tracing::debug!(db=%ttl.db, coll=%ttl.coll, index=%ttl.name, deleted=n, "TTL monitor deleted expired documents")
+            }
+            Err(e) => {
+                tracing::warn!(db=%ttl.db, coll=%ttl.coll, index=%ttl.name, "TTL delete failed: {}", e)
+            }
+        }
+    }
+}
+
+/// Kill every session `matches` selects: close the cursors it opened, roll back its open
+/// transaction and drop it from the registry.
+async fn kill_matching_sessions(state: &AppState, matches: impl Fn(&Uuid) -> bool) {
+    state
+        .cursors
+        .lock()
+        .await
+        .retain(|_, e| !e.lsid.as_ref().is_some_and(&matches));
+    for lsid in state.session_manager.lsids().await {
+        if matches(&lsid) {
+            state.session_manager.end_session(lsid).await;
+        }
+    }
+}
+
+async fn kill_sessions_reply(state: &AppState, cmd: &Document) -> Document {
+    let ids = match cmd.get_array("killSessions") {
+        Ok(arr) => arr,
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Missing killSessions array"),
+    };
+    let mut lsids = std::collections::HashSet::new();
+    for id_bson in ids {
+        match id_bson.as_document().and_then(lsid_uuid) {
+            Some(uuid) => {
+                lsids.insert(uuid);
+            }
+            None => return error_doc(FAILED_TO_PARSE, "killSessions entries must be {id: UUID}"),
+        }
+    }
+    kill_matching_sessions(state, |lsid| lsids.contains(lsid)).await;
+    doc! { "ok": 1.0 }
+}
+
+/// `killAllSessions: [users]`. An empty list kills every session; oxidedb does not
+/// authenticate clients, so no session belongs to a named user.
+async fn kill_all_sessions_reply(state: &AppState, cmd: &Document) -> Document {
+    let users = match cmd.get_array("killAllSessions") {
+        Ok(arr) => arr,
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Missing killAllSessions array"),
+    };
+    if users.is_empty() {
+        kill_matching_sessions(state, |_| true).await;
+    }
+    doc! { "ok": 1.0 }
+}
+
+/// `killAllSessionsByPattern: [patterns]`. An empty pattern matches every session and
+/// `{lsid: {id: UUID}}` matches one; patterns naming users, roles or a `uid` match nothing,
+/// as sessions carry no user.
+async fn kill_all_sessions_by_pattern_reply(state: &AppState, cmd: &Document) -> Document {
+    let patterns = match cmd.get_array("killAllSessionsByPattern") {
+        Ok(arr) => arr,
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Missing killAllSessionsByPattern array"),
     };
-
-    for id_bson in ids {
-        if let Some(lsid_doc) = id_bson.as_document()
-            && let Some(bson_val) = lsid_doc.get("id")
-            && let bson::Bson::Binary(binary) = bson_val
-            && binary.subtype == bson::spec::BinarySubtype::Uuid
-            && let Ok(uuid) = Uuid::from_slice(binary.bytes.as_slice())
+    let mut all = false;
+    let mut lsids = std::collections::HashSet::new();
+    for pattern in patterns {
+        let pattern = match pattern.as_document() {
+            Some(p) => p,
+            None => {
+                return error_doc(
+                    FAILED_TO_PARSE,
+                    "killAllSessionsByPattern entries must be documents",
+                );
+            }
+        };
+        if let Some(lsid) = pattern.get("lsid") {
+            match lsid.as_document().and_then(lsid_uuid) {
+                Some(uuid) => {
+                    lsids.insert(uuid);
+                }
+                None => return error_doc(FAILED_TO_PARSE, "Pattern lsid must be {id: UUID}"),
+            }
+        } else if !["uid", "users", "roles"]
+            .iter()
+            .any(|k| pattern.contains_key(k))
         {
-            state.session_manager.end_session(uuid).await;
+            all = true;
         }
     }
-
+    kill_matching_sessions(state, |lsid| all || lsids.contains(lsid)).await;
     doc! { "ok": 1.0 }
 }
 
@@ -4519,12 +10351,13 @@ async fn end_sessions_reply(state: &AppState, cmd: &Document) -> Document {
 mod tests {
     use super::*;
 
-    #[tokio::test]
-    async fn prune_removes_idle_cursors() {
-        let state = AppState {
+    fn empty_state() -> AppState {
+        AppState {
             store: None,
+            read_store: None,
             started_at: Instant::now(),
             cursors: Mutex::new(HashMap::new()),
+            current_ops: std::sync::Mutex::new(HashMap::new()),
             shadow: None,
             shadow_attempts: std::sync::atomic::AtomicU64::new(0),
             shadow_matches: std::sync::atomic::AtomicU64::new(0),
@@ -4539,7 +10372,97 @@ mod tests {
             delete_count: AtomicU64::new(0),
             error_count: AtomicU64::new(0),
             active_connections: AtomicU32::new(0),
+            command_metrics: crate::metrics::CommandMetrics::default(),
+            metrics_addr: None,
+            health_addr: None,
+            slow_op_threshold_ms: AtomicU64::new(crate::config::DEFAULT_SLOW_OP_THRESHOLD_MS),
+            profiling_levels: std::sync::Mutex::new(HashMap::new()),
+            rw_concern_defaults: std::sync::Mutex::new(RwConcernDefaults::default()),
+            max_bson_object_size: crate::config::DEFAULT_MAX_BSON_OBJECT_SIZE,
+            javascript_enabled: true,
+            extended_json_import: false,
+            authorization_enabled: false,
+            refresh_user_roles: false,
+            write_limiter: WriteLimiter::default(),
+            users_generation: AtomicU64::new(0),
+            aggregation_memory_limit_bytes:
+                crate::aggregation::memory::DEFAULT_AGGREGATION_MEMORY_LIMIT_BYTES,
+            max_scan_rows: None,
+        }
+    }
+
+    #[test]
+    fn connection_limits_pick_the_earliest_deadline() {
+        let opened = Instant::now();
+        let now = opened + Duration::from_secs(50);
+        let cfg = Config {
+            connection_idle_timeout_secs: Some(30),
+            connection_max_lifetime_secs: Some(60),
+            ..Config::default()
+        };
+        let limits = ConnectionLimits::from_config(&cfg);
+        assert_eq!(
+            limits.deadline(opened, now),
+            Some((opened + Duration::from_secs(60), "max lifetime"))
+        );
+        assert_eq!(
+            limits.deadline(opened, opened),
+            Some((opened + Duration::from_secs(30), "idle timeout"))
+        );
+
+        let cfg = Config {
+            connection_idle_timeout_secs: Some(0),
+            ..Config::default()
         };
+        assert_eq!(
+            ConnectionLimits::from_config(&cfg).deadline(opened, now),
+            None
+        );
+    }
+
+    #[tokio::test]
+    async fn secondary_read_preferences_use_the_replica() {
+        let mut state = empty_state();
+        state.store = Some(PgStore::connect("postgres://primary/db").await.unwrap());
+        let dsn = |cmd: Document| read_store(&state, &cmd).map(|pg| pg.dsn().to_string());
+        // Without a replica every read stays on the primary
+        assert_eq!(
+            dsn(doc! {"find": "c", "$readPreference": {"mode": "secondary"}}).as_deref(),
+            Some("postgres://primary/db")
+        );
+
+        state.read_store = Some(PgStore::connect("postgres://replica/db").await.unwrap());
+        let dsn = |cmd: Document| read_store(&state, &cmd).map(|pg| pg.dsn().to_string());
+        for mode in ["secondary", "secondaryPreferred"] {
+            assert_eq!(
+                dsn(doc! {"find": "c", "$readPreference": {"mode": mode}}).as_deref(),
+                Some("postgres://replica/db")
+            );
+        }
+        for mode in ["primary", "primaryPreferred", "nearest"] {
+            assert_eq!(
+                dsn(doc! {"find": "c", "$readPreference": {"mode": mode}}).as_deref(),
+                Some("postgres://primary/db")
+            );
+        }
+        assert_eq!(
+            dsn(doc! {"find": "c"}).as_deref(),
+            Some("postgres://primary/db")
+        );
+        assert_eq!(
+            dsn(doc! {
+                "find": "c",
+                "txnNumber": 1i64,
+                "$readPreference": {"mode": "secondary"},
+            })
+            .as_deref(),
+            Some("postgres://primary/db")
+        );
+    }
+
+    #[tokio::test]
+    async fn prune_removes_idle_cursors() {
+        let state = empty_state();
         {
             let mut map = state.cursors.lock().await;
             map.insert(
@@ -4549,6 +10472,10 @@ mod tests {
                     docs: vec![],
                     pos: 0,
                     last_access: Instant::now() - Duration::from_secs(100),
+                    conn: None,
+                    lsid: None,
+                    tail: None,
+                    held: None,
                 },
             );
         }
@@ -4556,12 +10483,599 @@ mod tests {
         let map = state.cursors.lock().await;
         assert!(map.is_empty());
     }
+
+    #[tokio::test]
+    async fn kill_sessions_closes_only_their_cursors() {
+        let state = empty_state();
+        let (a, b) = (Uuid::new_v4(), Uuid::new_v4());
+        let mine = SESSION_ID
+            .scope(Some(a), new_cursor(&state, "db.coll".into(), vec![doc! {}]))
+            .await;
+        let theirs = SESSION_ID
+            .scope(Some(b), new_cursor(&state, "db.coll".into(), vec![doc! {}]))
+            .await;
+        let sessionless = new_cursor(&state, "db.coll".into(), vec![doc! {}]).await;
+        let lsid = doc! {"id": Bson::Binary(bson::Binary {
+            subtype: bson::spec::BinarySubtype::Uuid,
+            bytes: a.as_bytes().to_vec(),
+        })};
+
+        let reply = kill_sessions_reply(&state, &doc! {"killSessions": [lsid]}).await;
+        assert_eq!(reply.get_f64("ok").unwrap(), 1.0);
+        {
+            let map = state.cursors.lock().await;
+            assert!(!map.contains_key(&mine));
+            assert!(map.contains_key(&theirs) && map.contains_key(&sessionless));
+        }
+
+        // A pattern naming users matches nothing; an empty one matches every session
+        let users = doc! {"killAllSessionsByPattern": [{"users": [{"user": "u", "db": "admin"}]}]};
+        kill_all_sessions_by_pattern_reply(&state, &users).await;
+        assert!(state.cursors.lock().await.contains_key(&theirs));
+        kill_all_sessions_by_pattern_reply(&state, &doc! {"killAllSessionsByPattern": [{}]}).await;
+        let map = state.cursors.lock().await;
+        assert!(!map.contains_key(&theirs));
+        assert!(map.contains_key(&sessionless));
+    }
+
+    #[tokio::test]
+    async fn reaper_expires_unused_sessions_and_their_cursors() {
+        let mut state = empty_state();
+        state.session_manager =
+            std::sync::Arc::new(SessionManager::with_timeout(Duration::from_millis(20)));
+        let lsid = Uuid::new_v4();
+        let lsid_doc = doc! {"id": Bson::Binary(bson::Binary {
+            subtype: bson::spec::BinarySubtype::Uuid,
+            bytes: lsid.as_bytes().to_vec(),
+        })};
+        let reply =
+            handle_command(&state, Some("admin"), doc! {"refreshSessions": [lsid_doc]}).await;
+        assert_eq!(reply.get_f64("ok").unwrap(), 1.0);
+        let id = SESSION_ID
+            .scope(
+                Some(lsid),
+                new_cursor(&state, "db.coll".into(), vec![doc! {}, doc! {}]),
+            )
+            .await;
+
+        // Still in use
+        assert_eq!(reap_expired_sessions(&state).await, 0);
+        tokio::time::sleep(Duration::from_millis(40)).await;
+        assert_eq!(reap_expired_sessions(&state).await, 1);
+        assert!(!state.session_manager.has_session(lsid).await);
+
+        let reply = get_more_reply(&state, &doc! {"getMore": id, "collection": "coll"}).await;
+        let cursor = reply.get_document("cursor").unwrap();
+        assert_eq!(cursor.get_i64("id").unwrap(), 0);
+        assert!(cursor.get_array("nextBatch").unwrap().is_empty());
+    }
+
+    #[test]
+    fn list_commands_matches_the_dispatcher() {
+        let source = include_str!("server.rs");
+        let start = source
+            .find("async fn dispatch_command(")
+            .expect("dispatch_command");
+        let arms = &source[start..];
+        let arms =
+            &arms[arms.find("match cmd_name {").unwrap()..arms.find("        _ => {").unwrap()];
+        let mut dispatched = Vec::new();
+        for line in arms.lines() {
+            let Some((names, _)) = line.trim_start().split_once(" =>") else {
+                continue;
+            };
+            if !names.starts_with('"') {
+                continue;
+            }
+            for name in names.split('|') {
+                dispatched.push(name.trim().trim_matches('"').to_string());
+            }
+        }
+        let listed: Vec<String> = COMMANDS.iter().map(|c| c.name.to_string()).collect();
+        assert_eq!(listed, dispatched);
+
+        let reply = list_commands_reply();
+        let find = reply
+            .get_document("commands")
+            .unwrap()
+            .get_document("find")
+            .unwrap();
+        assert!(find.get_bool("requiresAuth").unwrap());
+        assert!(!find.get_bool("adminOnly").unwrap());
+    }
+
+    #[test]
+    fn required_actions_follow_the_command() {
+        assert_eq!(
+            required_action("app", "find", &doc! {"find": "c"}),
+            Some(Action::Find)
+        );
+        assert_eq!(
+            required_action("app", "insert", &doc! {"insert": "c"}),
+            Some(Action::Write)
+        );
+        assert_eq!(
+            required_action("app", "explain", &doc! {"explain": {"delete": "c"}}),
+            Some(Action::Write)
+        );
+        assert_eq!(
+            required_action(
+                "app",
+                "aggregate",
+                &doc! {"aggregate": "c", "pipeline": [{"$out": "d"}]}
+            ),
+            Some(Action::Write)
+        );
+        assert_eq!(
+            required_action("admin", "find", &doc! {"find": "system.users"}),
+            Some(Action::UserAdmin)
+        );
+        assert_eq!(
+            required_action("app", "saslStart", &doc! {"saslStart": 1}),
+            Some(Action::Open)
+        );
+        assert_eq!(required_action("app", "nope", &doc! {"nope": 1}), None);
+    }
+
+    #[test]
+    fn aggregate_writes_are_charged_to_their_target() {
+        let target = |pipeline: Vec<Document>| {
+            aggregate_write_target("app", &doc! {"aggregate": "src", "pipeline": pipeline})
+        };
+        let ns = |db: &str, coll: &str| Some((db.to_string(), coll.to_string()));
+        assert_eq!(target(vec![doc! {"$out": "dst"}]), ns("app", "dst"));
+        assert_eq!(
+            target(vec![doc! {"$out": {"db": "app", "coll": "dst"}}]),
+            ns("app", "dst")
+        );
+        assert_eq!(
+            target(vec![
+                doc! {"$merge": {"into": {"db": "other", "coll": "dst"}}}
+            ]),
+            ns("other", "dst")
+        );
+        assert_eq!(
+            target(vec![doc! {"$merge": {"into": "dst"}}]),
+            ns("app", "dst")
+        );
+        assert_eq!(target(vec![doc! {"$match": {}}]), None);
+    }
+
+    /// The reply `authorization_error` gives a connection authenticated with `roles` on
+    /// `app`, or None when it may run `cmd`.
+    async fn authorization_as(roles: &[(&str, &str)], db: &str, cmd: Document) -> Option<Document> {
+        let state = empty_state();
+        let auth = ConnectionAuth {
+            user: Some(crate::users::AuthenticatedUser {
+                user: "me".to_string(),
+                db: "app".to_string(),
+                roles: roles
+                    .iter()
+                    .map(|(role, db)| crate::users::RoleRef {
+                        role: role.to_string(),
+                        db: db.to_string(),
+                    })
+                    .collect(),
+                generation: 0,
+            }),
+            ..ConnectionAuth::default()
+        };
+        let cmd_name = cmd.keys().next().unwrap().clone();
+        CONNECTION_AUTH
+            .scope(Arc::new(std::sync::Mutex::new(auth)), async {
+                authorization_error(&state, Some(db), &cmd_name, &cmd).await
+            })
+            .await
+    }
+
+    #[tokio::test]
+    async fn granting_a_role_needs_user_admin_where_it_applies() {
+        let grant = doc! {"grantRolesToUser": "me", "roles": [{"role": "root", "db": "admin"}]};
+        let err = authorization_as(&[("userAdmin", "app")], "app", grant.clone()).await;
+        assert_eq!(err.unwrap().get_i32("code").unwrap(), UNAUTHORIZED);
+        let create = doc! {
+            "createUser": "boss",
+            "pwd": "pw",
+            "roles": ["readWrite", {"role": "readAnyDatabase", "db": "admin"}],
+        };
+        let err = authorization_as(&[("dbOwner", "app")], "app", create.clone()).await;
+        assert_eq!(err.unwrap().get_i32("code").unwrap(), UNAUTHORIZED);
+
+        assert!(
+            authorization_as(
+                &[("userAdmin", "app")],
+                "app",
+                doc! {
+                    "grantRolesToUser": "me", "roles": ["readWrite"],
+                }
+            )
+            .await
+            .is_none()
+        );
+        let admins = [("userAdmin", "app"), ("userAdmin", "admin")];
+        assert!(authorization_as(&admins, "app", grant).await.is_none());
+        assert!(authorization_as(&admins, "app", create).await.is_none());
+    }
+
+    #[tokio::test]
+    async fn cross_database_merge_needs_write_on_its_target() {
+        let merge = doc! {
+            "aggregate": "c",
+            "pipeline": [{"$merge": {"into": {"db": "other", "coll": "dst"}}}],
+            "cursor": {},
+        };
+        let err = authorization_as(&[("readWrite", "app")], "app", merge.clone()).await;
+        assert_eq!(err.unwrap().get_i32("code").unwrap(), UNAUTHORIZED);
+        let readers = [("readWrite", "app"), ("read", "other")];
+        assert!(
+            authorization_as(&readers, "app", merge.clone())
+                .await
+                .is_some()
+        );
+        let writers = [("readWrite", "app"), ("readWrite", "other")];
+        assert!(authorization_as(&writers, "app", merge).await.is_none());
+
+        // Reading another database through $lookup needs only read there
+        let lookup = doc! {
+            "aggregate": "c",
+            "pipeline": [{"$lookup": {"from": {"db": "other", "coll": "d"}, "as": "d"}}],
+            "cursor": {},
+        };
+        assert!(
+            authorization_as(&readers, "app", lookup.clone())
+                .await
+                .is_none()
+        );
+        assert!(
+            authorization_as(&[("read", "app")], "app", lookup)
+                .await
+                .is_some()
+        );
+    }
+
+    #[test]
+    fn system_users_is_user_admin_however_it_is_named() {
+        let lookup = doc! {
+            "aggregate": "c",
+            "pipeline": [{"$facet": {"a": [{"$lookup": {
+                "from": "c",
+                "pipeline": [{"$unionWith": {"coll": "system.users"}}],
+                "as": "u",
+            }}]}}],
+        };
+        assert_eq!(
+            required_action("admin", "aggregate", &lookup),
+            Some(Action::UserAdmin)
+        );
+        let merge = doc! {
+            "aggregate": "c",
+            "pipeline": [{"$merge": {"into": {"db": "admin", "coll": "system.users"}}}],
+        };
+        assert_eq!(
+            required_action("app", "aggregate", &merge),
+            Some(Action::UserAdmin)
+        );
+        assert_eq!(
+            required_action(
+                "admin",
+                "create",
+                &doc! {"create": "v", "viewOn": "system.users", "pipeline": []}
+            ),
+            Some(Action::UserAdmin)
+        );
+        assert_eq!(
+            required_action(
+                "app",
+                "explain",
+                &doc! {"explain": {"find": "c"}, "verbosity": "queryPlanner"}
+            ),
+            Some(Action::Find)
+        );
+    }
+
+    #[test]
+    fn summarises_analyzed_plans() {
+        let plan = serde_json::json!([{
+            "Plan": {
+                "Node Type": "Limit",
+                "Actual Rows": 2.0,
+                "Actual Loops": 1.0,
+                "Shared Hit Blocks": 7,
+                "Shared Read Blocks": 3,
+                "Plans": [{
+                    "Node Type": "Index Scan",
+                    "Index Name": "users_age_1",
+                    "Relation Name": "users",
+                    "Actual Rows": 2.0,
+                    "Actual Loops": 1.0,
+                    "Rows Removed by Filter": 1.0,
+                }],
+            },
+            "Planning Time": 0.2,
+            "Execution Time": 1.4,
+        }]);
+        let stages = plan_execution_stages(&plan);
+        assert_eq!(stages.get_str("stage").unwrap(), "IXSCAN");
+        assert_eq!(stages.get_str("indexName").unwrap(), "users_age_1");
+        assert_eq!(stages.get_i64("nReturned").unwrap(), 2);
+        assert_eq!(stages.get_i64("docsExamined").unwrap(), 3);
+        let buffers = plan_buffers(&plan);
+        assert_eq!(buffers.get_i64("sharedHit").unwrap(), 7);
+        assert_eq!(buffers.get_i64("sharedRead").unwrap(), 3);
+        assert_eq!(buffers.get_i64("tempWritten").unwrap(), 0);
+    }
+
+    #[test]
+    fn unwraps_legacy_query_modifiers() {
+        let mut cmd = doc! {
+            "find": "users",
+            "filter": {
+                "$query": {"age": {"$gt": 30}},
+                "$orderby": {"age": -1},
+                "$hint": "age_1",
+                "$comment": "legacy",
+                "$maxTimeMS": 500,
+            },
+            "$db": "app",
+        };
+        unwrap_query_modifiers(&mut cmd);
+        assert_eq!(
+            cmd,
+            doc! {
+                "find": "users",
+                "$db": "app",
+                "filter": {"age": {"$gt": 30}},
+                "sort": {"age": -1},
+                "hint": "age_1",
+                "comment": "legacy",
+                "maxTimeMS": 500,
+            }
+        );
+
+        // The command's own options win, and $explain wraps the find in an explain
+        let mut cmd = doc! {
+            "find": "users",
+            "query": {"$query": {}, "$orderby": {"a": 1}, "$explain": true},
+            "sort": {"b": 1},
+            "$db": "app",
+        };
+        unwrap_query_modifiers(&mut cmd);
+        assert_eq!(
+            cmd,
+            doc! {"explain": {"find": "users", "sort": {"b": 1}, "filter": {}}, "$db": "app"}
+        );
+
+        // An OP_QUERY command envelope
+        let mut cmd = doc! {
+            "$query": {"find": "users", "filter": {"$query": {"a": 1}}},
+            "$readPreference": {"mode": "secondaryPreferred"},
+        };
+        unwrap_query_modifiers(&mut cmd);
+        assert_eq!(cmd, doc! {"find": "users", "filter": {"a": 1}});
+
+        // Filters without $query are left alone
+        let mut cmd = doc! {"find": "users", "filter": {"a": 1, "$comment": "x"}};
+        let original = cmd.clone();
+        unwrap_query_modifiers(&mut cmd);
+        assert_eq!(cmd, original);
+    }
+
+    #[test]
+    fn legacy_query_comment_becomes_the_command_comment() {
+        let mut cmd = doc! {"find": "users", "filter": {"a": 1, "$comment": "old"}};
+        hoist_query_comment(&mut cmd);
+        assert_eq!(
+            cmd,
+            doc! {"find": "users", "filter": {"a": 1}, "comment": "old"}
+        );
+
+        let mut cmd = doc! {
+            "delete": "users",
+            "deletes": [{"q": {"$comment": "first", "a": 1}, "limit": 1}, {"q": {"$comment": "second"}, "limit": 0}],
+            "comment": "option",
+        };
+        hoist_query_comment(&mut cmd);
+        assert_eq!(cmd.get_str("comment").unwrap(), "option");
+        let deletes = cmd.get_array("deletes").unwrap();
+        assert_eq!(
+            deletes[0].as_document().unwrap().get_document("q").unwrap(),
+            &doc! {"a": 1}
+        );
+        assert!(
+            deletes[1]
+                .as_document()
+                .unwrap()
+                .get_document("q")
+                .unwrap()
+                .is_empty()
+        );
+    }
+
+    #[test]
+    fn current_op_reports_comment_until_done() {
+        let state = empty_state();
+        let cmd = doc! {"find": "users", "comment": "trace-42", "$db": "app"};
+        {
+            let _guard =
+                register_current_op(&state, 7, Some("app"), &cmd, cmd.get("comment").cloned());
+            let reply = current_op_reply(&state, &doc! {"currentOp": 1, "comment": "trace-42"});
+            let inprog = reply.get_array("inprog").unwrap();
+            assert_eq!(inprog.len(), 1);
+            let op = inprog[0].as_document().unwrap();
+            assert_eq!(op.get_str("ns").unwrap(), "app.users");
+            assert_eq!(op.get_str("comment").unwrap(), "trace-42");
+        }
+        let reply = current_op_reply(&state, &doc! {"currentOp": 1});
+        assert!(reply.get_array("inprog").unwrap().is_empty());
+    }
+
+    #[test]
+    fn collectionless_pipelines_start_from_documents() {
+        use crate::aggregation::Stage;
+        let state = empty_state();
+        let cmd = doc! {"aggregate": 1, "comment": "ops", "$db": "admin"};
+        let _guard =
+            register_current_op(&state, 3, Some("admin"), &cmd, cmd.get("comment").cloned());
+        match collectionless_source(&state, "admin", &Stage::CurrentOp) {
+            Ok(Stage::Documents(Bson::Array(ops))) => {
+                assert_eq!(ops.len(), 1);
+                let op = ops[0].as_document().unwrap();
+                assert_eq!(op.get_i64("opid").unwrap(), 3);
+                assert_eq!(op.get_str("comment").unwrap(), "ops");
+            }
+            other => panic!("unexpected source: {:?}", other),
+        }
+
+        let err = collectionless_source(&state, "app", &Stage::CurrentOp).unwrap_err();
+        assert_eq!(err.get_i32("code").unwrap(), 73);
+        let err = collectionless_source(&state, "app", &Stage::Limit(1)).unwrap_err();
+        assert_eq!(err.get_i32("code").unwrap(), 73);
+        assert!(
+            collectionless_source(&state, "app", &Stage::Documents(Bson::Array(vec![]))).is_ok()
+        );
+    }
+
+    #[test]
+    fn find_on_view_becomes_aggregate() {
+        let cmd = doc! {
+            "find": "adults",
+            "filter": {"age": {"$gte": 30}},
+            "sort": {"age": -1},
+            "skip": 1i32,
+            "limit": -2i64,
+            "projection": {"name": 1},
+            "batchSize": 5i32,
+            "comment": "view read",
+        };
+        let agg = find_on_view_command("adults", &cmd);
+        assert_eq!(agg.get_str("aggregate").unwrap(), "adults");
+        assert_eq!(
+            agg.get_array("pipeline").unwrap(),
+            &vec![
+                Bson::Document(doc! {"$match": {"age": {"$gte": 30}}}),
+                Bson::Document(doc! {"$sort": {"age": -1}}),
+                Bson::Document(doc! {"$skip": 1i64}),
+                Bson::Document(doc! {"$limit": 2i64}),
+                Bson::Document(doc! {"$project": {"name": 1}}),
+            ]
+        );
+        assert_eq!(
+            agg.get_document("cursor").unwrap(),
+            &doc! {"batchSize": 5i32}
+        );
+        assert_eq!(agg.get_str("comment").unwrap(), "view read");
+
+        let agg = find_on_view_command("adults", &doc! {"find": "adults"});
+        assert!(agg.get_array("pipeline").unwrap().is_empty());
+    }
+
+    #[test]
+    fn bit_toggles_individual_bits() {
+        let mut d = doc! {"flags": 0b0101i32};
+        apply_bit(&mut d, "flags", &Bson::Document(doc! {"or": 0b0010i32})).unwrap();
+        assert_eq!(d.get_i32("flags").unwrap(), 0b0111);
+        apply_bit(&mut d, "flags", &Bson::Document(doc! {"and": !0b0001i32})).unwrap();
+        assert_eq!(d.get_i32("flags").unwrap(), 0b0110);
+        apply_bit(&mut d, "flags", &Bson::Document(doc! {"xor": 0b1100i32})).unwrap();
+        assert_eq!(d.get_i32("flags").unwrap(), 0b1010);
+
+        // Missing fields start at 0; a long operand widens the result
+        apply_bit(&mut d, "s.bits", &Bson::Document(doc! {"or": 1i64 << 33})).unwrap();
+        assert_eq!(
+            get_path_bson_value(&d, "s.bits"),
+            Some(Bson::Int64(1 << 33))
+        );
+        apply_bit(&mut d, "flags", &Bson::Document(doc! {"or": 1i64 << 32})).unwrap();
+        assert_eq!(d.get_i64("flags").unwrap(), (1 << 32) | 0b1010);
+    }
+
+    #[test]
+    fn bit_rejects_non_integers() {
+        let mut d = doc! {"f": 1.5, "s": "x", "n": 1i32};
+        for (path, spec) in [
+            ("f", doc! {"or": 1i32}),
+            ("s", doc! {"and": 1i32}),
+            ("n", doc! {"or": 1.0}),
+            ("n", doc! {"nand": 1i32}),
+        ] {
+            let err = apply_bit(&mut d, path, &Bson::Document(spec)).unwrap_err();
+            assert_eq!(err.get_i32("code").unwrap(), 2);
+        }
+        assert!(apply_bit(&mut d, "n", &Bson::Int32(1)).is_err());
+        assert_eq!(d, doc! {"f": 1.5, "s": "x", "n": 1i32});
+    }
+
+    #[test]
+    fn current_date_stamps_one_instant() {
+        let now = bson::DateTime::from_millis(1_700_000_000_123);
+        let mut d = doc! {};
+        apply_current_date(&mut d, "a", &Bson::Boolean(true), now).unwrap();
+        apply_current_date(&mut d, "b.c", &Bson::Document(doc! {"$type": "date"}), now).unwrap();
+        apply_current_date(
+            &mut d,
+            "t",
+            &Bson::Document(doc! {"$type": "timestamp"}),
+            now,
+        )
+        .unwrap();
+        assert_eq!(d.get_datetime("a").unwrap(), &now);
+        assert_eq!(get_path_bson_value(&d, "b.c"), Some(Bson::DateTime(now)));
+        assert_eq!(d.get_timestamp("t").unwrap().time, 1_700_000_000);
+
+        for bad in [Bson::Int32(1), Bson::Document(doc! {"$type": "clock"})] {
+            let err = apply_current_date(&mut d, "x", &bad, now).unwrap_err();
+            assert_eq!(err.get_i32("code").unwrap(), 2);
+        }
+    }
+
+    #[test]
+    fn rename_moves_nested_values() {
+        let mut d = doc! {"a": {"b": 1, "keep": true}};
+        apply_rename(&mut d, "a.b", "a.c").unwrap();
+        assert_eq!(d, doc! {"a": {"keep": true, "c": 1}});
+
+        let mut d = doc! {"x": {"y": {"z": {"v": "deep"}}}};
+        apply_rename(&mut d, "x.y.z.v", "p.q.r").unwrap();
+        assert_eq!(d, doc! {"x": {"y": {"z": {}}}, "p": {"q": {"r": "deep"}}});
+
+        // Renaming a whole array is fine; only traversing one is not
+        let mut d = doc! {"tags": ["a", "b"]};
+        apply_rename(&mut d, "tags", "labels").unwrap();
+        assert_eq!(d, doc! {"labels": ["a", "b"]});
+    }
+
+    #[test]
+    fn rename_of_missing_source_is_a_no_op() {
+        let mut d = doc! {"a": {"b": 1}};
+        apply_rename(&mut d, "a.missing", "a.c").unwrap();
+        apply_rename(&mut d, "nope.deeper", "z").unwrap();
+        assert_eq!(d, doc! {"a": {"b": 1}});
+    }
+
+    #[test]
+    fn rename_through_array_fails() {
+        let mut d = doc! {"a": [{"b": 1}]};
+        let err = apply_rename(&mut d, "a.0.b", "c").unwrap_err();
+        assert_eq!(err.get_i32("code").unwrap(), 2);
+        assert!(
+            err.get_str("errmsg")
+                .unwrap()
+                .starts_with("cannot use the part (0 of a.0.b) to traverse")
+        );
+
+        let mut d = doc! {"a": 1, "list": [1, 2]};
+        let err = apply_rename(&mut d, "a", "list.x").unwrap_err();
+        assert_eq!(err.get_i32("code").unwrap(), 2);
+        let err = apply_rename(&mut d, "list", "a.x").unwrap_err();
+        assert_eq!(err.get_i32("code").unwrap(), 28);
+        assert_eq!(d, doc! {"a": 1, "list": [1, 2]});
+    }
 }
 
 async fn kill_cursors_reply(state: &AppState, cmd: &Document) -> Document {
     let cursors = match cmd.get_array("cursors") {
         Ok(a) => a,
-        Err(_) => return error_doc(9, "Missing cursors"),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Missing cursors"),
     };
     let mut killed: Vec<i64> = Vec::new();
     let mut not_found: Vec<i64> = Vec::new();
@@ -4592,18 +11106,18 @@ async fn kill_cursors_reply(state: &AppState, cmd: &Document) -> Document {
 async fn create_indexes_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
     let dbname = match db {
         Some(d) => d,
-        None => return error_doc(59, "Missing $db"),
+        None => return error_doc(MISSING_DB, "Missing $db"),
     };
     let coll = match cmd.get_str("createIndexes") {
         Ok(c) => c,
-        Err(_) => return error_doc(9, "Invalid createIndexes"),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid createIndexes"),
     };
     let indexes = match cmd.get_array("indexes") {
         Ok(a) => a,
-        Err(_) => return error_doc(9, "Missing indexes"),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Missing indexes"),
     };
     if state.store.is_none() {
-        return error_doc(13, "No storage configured");
+        return no_storage_error();
     }
     let pg = state.store.as_ref().unwrap();
     // Ensure collection exists so index DDL succeeds
@@ -4624,6 +11138,36 @@ async fn create_indexes_reply(state: &AppState, db: Option<&str>, cmd: &Document
             Ok(k) => k,
             Err(_) => continue,
         };
+        match spec_doc.get("partialFilterExpression") {
+            None => {}
+            Some(Bson::Document(filter)) => {
+                if spec_doc.get_bool("sparse").unwrap_or(false) {
+                    return error_doc(
+                        67,
+                        "cannot mix \"partialFilterExpression\" and \"sparse\" options",
+                    );
+                }
+                if key.values().any(|v| matches!(v, Bson::String(_))) {
+                    return error_doc(
+                        67,
+                        "partialFilterExpression is only supported on ascending and descending indexes",
+                    );
+                }
+                if let Some(expr) = unsupported_partial_filter(filter, true) {
+                    return error_doc(
+                        67,
+                        format!("Expression not supported in partial index: {}", expr),
+                    );
+                }
+            }
+            Some(_) => {
+                return error_doc(TYPE_MISMATCH, "partialFilterExpression must be an object");
+            }
+        }
+        let collation = match effective_collation(pg, dbname, coll, spec_doc).await {
+            Ok(c) => c,
+            Err(err_doc) => return err_doc,
+        };
         let spec_json = match bson::to_bson(spec_doc) {
             Ok(b) => match serde_json::to_value(&b) {
                 Ok(v) => v,
@@ -4654,9 +11198,21 @@ async fn create_indexes_reply(state: &AppState, db: Option<&str>, cmd: &Document
                     _ => 1,
                 };
                 if let Err(e) = pg
-                    .create_index_single_field(dbname, coll, name, field, order, &spec_json)
+                    .create_index_single_field_collated(
+                        dbname,
+                        coll,
+                        name,
+                        field,
+                        order,
+                        &spec_json,
+                        collation.as_ref(),
+                    )
                     .await
                 {
+                    // Existing documents that break a unique index fail the command
+                    if store_error_code(&e.to_string()) == DUPLICATE_KEY {
+                        return store_error(e.to_string());
+                    }
                     tracing::warn!("create_index(single) failed: {}", e);
                 } else {
                     created += 1;
@@ -4673,9 +11229,19 @@ async fn create_indexes_reply(state: &AppState, db: Option<&str>, cmd: &Document
                 fields.push((k.to_string(), ord));
             }
             if let Err(e) = pg
-                .create_index_compound(dbname, coll, name, &fields, &spec_json)
+                .create_index_compound_collated(
+                    dbname,
+                    coll,
+                    name,
+                    &fields,
+                    &spec_json,
+                    collation.as_ref(),
+                )
                 .await
             {
+                if store_error_code(&e.to_string()) == DUPLICATE_KEY {
+                    return store_error(e.to_string());
+                }
                 tracing::warn!("create_index(compound) failed: {}", e);
             } else {
                 created += 1;
@@ -4685,17 +11251,223 @@ async fn create_indexes_reply(state: &AppState, db: Option<&str>, cmd: &Document
     doc! { "createdIndexes": created, "ok": 1.0 }
 }
 
+/// The first expression in `filter` a partial index cannot be built from, if any. Like
+/// MongoDB we accept equalities, `$exists: true`, range comparisons and `$in` on fields,
+/// combined with `$and` and `$or` at the top level.
+fn unsupported_partial_filter(filter: &Document, top_level: bool) -> Option<String> {
+    for (k, v) in filter.iter() {
+        match k.as_str() {
+            "$and" | "$or" if top_level => {
+                let Bson::Array(items) = v else {
+                    return Some(k.clone());
+                };
+                for item in items {
+                    let Bson::Document(d) = item else {
+                        return Some(k.clone());
+                    };
+                    if let Some(expr) = unsupported_partial_filter(d, false) {
+                        return Some(expr);
+                    }
+                }
+            }
+            _ if k.starts_with('$') => return Some(k.clone()),
+            _ => match v {
+                Bson::Document(ops) if ops.keys().any(|op| op.starts_with('$')) => {
+                    for (op, arg) in ops {
+                        match op.as_str() {
+                            "$eq" | "$gt" | "$gte" | "$lt" | "$lte" | "$in" => {}
+                            "$exists" if matches!(arg, Bson::Boolean(true)) => {}
+                            _ => return Some(op.clone()),
+                        }
+                    }
+                }
+                Bson::RegularExpression(_) => return Some("$regex".to_string()),
+                _ => {}
+            },
+        }
+    }
+    None
+}
+
+/// `collMod` with `index: {name | keyPattern, expireAfterSeconds}`: change how long a TTL
+/// index keeps documents, or make a single-field index a TTL index. The TTL monitor reads
+/// the new value on its next pass. Replies with `expireAfterSeconds_old`, when the index
+/// had one, and `expireAfterSeconds_new`. `storageEngine` sets the table's fillfactor;
+/// both options are checked before either is applied. Other `collMod` options are not
+/// supported.
+async fn coll_mod_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let coll = match cmd.get_str("collMod") {
+        Ok(c) => c,
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid collMod"),
+    };
+    let Some(pg) = state.store.as_ref() else {
+        return no_storage_error();
+    };
+    // Every option is checked before any is applied, so a bad one changes nothing
+    let fillfactor = match parse_storage_engine(cmd) {
+        Ok(f) => f,
+        Err(err_doc) => return err_doc,
+    };
+    let index = match cmd.get("index") {
+        Some(Bson::Document(index)) => Some(index),
+        Some(_) => return error_doc(TYPE_MISMATCH, "collMod 'index' must be an object"),
+        None if cmd.contains_key("storageEngine") => None,
+        None => {
+            return error_doc(
+                INVALID_OPTIONS,
+                "collMod only supports changing an index's expireAfterSeconds or the storageEngine fillfactor",
+            );
+        }
+    };
+    let expiry = match index {
+        Some(index) => match coll_mod_index_expiry(pg, dbname, coll, index).await {
+            Ok(expiry) => Some(expiry),
+            Err(err_doc) => return err_doc,
+        },
+        None => None,
+    };
+    if let Some(fillfactor) = fillfactor
+        && let Err(e) = pg.set_fillfactor(dbname, coll, fillfactor).await
+    {
+        return store_error(e.to_string());
+    }
+    let Some((name, expire_after_secs)) = expiry else {
+        return doc! { "ok": 1.0 };
+    };
+    match pg
+        .set_index_expiry(dbname, coll, &name, expire_after_secs)
+        .await
+    {
+        Ok(old) => {
+            let mut reply = Document::new();
+            if let Some(old) = old {
+                reply.insert("expireAfterSeconds_old", old);
+            }
+            reply.insert("expireAfterSeconds_new", expire_after_secs);
+            reply.insert("ok", 1.0);
+            reply
+        }
+        Err(e) => store_error(e.to_string()),
+    }
+}
+
+/// The index a `collMod` `index` option names and the `expireAfterSeconds` to give it,
+/// once the index is known to be one that can expire documents.
+async fn coll_mod_index_expiry(
+    pg: &PgStore,
+    dbname: &str,
+    coll: &str,
+    index: &Document,
+) -> std::result::Result<(String, i64), Document> {
+    let target = match (index.get("name"), index.get("keyPattern")) {
+        (Some(name @ Bson::String(_)), None) => name,
+        (None, Some(pattern @ Bson::Document(_))) => pattern,
+        _ => {
+            return Err(error_doc(
+                BAD_VALUE,
+                "collMod 'index' must identify the index by either 'name' or 'keyPattern'",
+            ));
+        }
+    };
+    let expire_after_secs = match index.get("expireAfterSeconds") {
+        None => {
+            return Err(error_doc(
+                BAD_VALUE,
+                "collMod 'index' needs 'expireAfterSeconds'",
+            ));
+        }
+        Some(v) => match bson_number(Some(v)) {
+            Some(n) if (0..=i32::MAX as i64).contains(&n) => n,
+            Some(_) => {
+                return Err(error_doc(
+                    BAD_VALUE,
+                    "TTL index 'expireAfterSeconds' option must be within an acceptable range",
+                ));
+            }
+            None => {
+                return Err(error_doc(
+                    TYPE_MISMATCH,
+                    "expireAfterSeconds must be a number",
+                ));
+            }
+        },
+    };
+    let ns = format!("{}.{}", dbname, coll);
+    let specs = match pg.list_indexes(dbname, coll).await {
+        Ok(Some(specs)) => specs,
+        Ok(None) => {
+            return Err(error_doc(
+                NAMESPACE_NOT_FOUND,
+                format!("ns does not exist: {}", ns),
+            ));
+        }
+        Err(e) => return Err(store_error(e.to_string())),
+    };
+    let name = match pg.resolve_hint(dbname, coll, target).await {
+        Ok(Some(name)) => name,
+        Ok(None) => {
+            return Err(error_doc(
+                INDEX_NOT_FOUND,
+                format!("cannot find index {} for ns {}", target, ns),
+            ));
+        }
+        Err(e) => return Err(store_error(e.to_string())),
+    };
+    let single_field = specs
+        .iter()
+        .find(|s| s.get_str("name") == Ok(name.as_str()))
+        .and_then(|s| s.get_document("key").ok())
+        .is_some_and(|key| key.len() == 1);
+    if name == "_id_" || !single_field {
+        return Err(error_doc(
+            INVALID_OPTIONS,
+            format!(
+                "index {} cannot expire documents: TTL indexes are single-field indexes other than _id",
+                name
+            ),
+        ));
+    }
+    Ok((name, expire_after_secs))
+}
+
+async fn list_indexes_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
+    let dbname = match db {
+        Some(d) => d,
+        None => return error_doc(MISSING_DB, "Missing $db"),
+    };
+    let coll = match cmd.get_str("listIndexes") {
+        Ok(c) => c,
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid listIndexes"),
+    };
+    let Some(pg) = state.store.as_ref() else {
+        return no_storage_error();
+    };
+    let ns = format!("{}.{}", dbname, coll);
+    match pg.list_indexes(dbname, coll).await {
+        Ok(Some(specs)) => doc! {
+            "cursor": {"id": 0i64, "ns": ns, "firstBatch": specs},
+            "ok": 1.0
+        },
+        Ok(None) => error_doc(NAMESPACE_NOT_FOUND, format!("ns does not exist: {}", ns)),
+        Err(e) => store_error(e.to_string()),
+    }
+}
+
 async fn drop_indexes_reply(state: &AppState, db: Option<&str>, cmd: &Document) -> Document {
     let dbname = match db {
         Some(d) => d,
-        None => return error_doc(59, "Missing $db"),
+        None => return error_doc(MISSING_DB, "Missing $db"),
     };
     let coll = match cmd.get_str("dropIndexes") {
         Ok(c) => c,
-        Err(_) => return error_doc(9, "Invalid dropIndexes"),
+        Err(_) => return error_doc(FAILED_TO_PARSE, "Invalid dropIndexes"),
     };
     if state.store.is_none() {
-        return error_doc(13, "No storage configured");
+        return no_storage_error();
     }
     let pg = state.store.as_ref().unwrap();
     if let Ok(name) = cmd.get_str("index") {
@@ -4716,5 +11488,5 @@ async fn drop_indexes_reply(state: &AppState, db: Option<&str>, cmd: &Document)
             return doc! { "nIndexesWas": (if ok { 1 } else { 0 }), "ok": 1.0 };
         }
     }
-    error_doc(9, "Missing index name")
+    error_doc(FAILED_TO_PARSE, "Missing index name")
 }
@@ -9,7 +9,11 @@ use uuid::Uuid;
 pub const ERROR_UNAUTHORIZED: i32 = 13;
 pub const ERROR_ILLEGAL_OPERATION: i32 = 20;
 pub const ERROR_NO_SUCH_TRANSACTION: i32 = 251;
-pub const ERROR_TRANSACTION_EXPIRED: i32 = 211;
+pub const ERROR_TRANSACTION_EXPIRED: i32 = 290;
+
+/// Idle time after which a session expires, advertised by `hello` as
+/// `logicalSessionTimeoutMinutes`
+pub const LOGICAL_SESSION_TIMEOUT_MINUTES: u64 = 30;
 
 /// Result of a write operation for retryable writes
 #[derive(Clone, Debug)]
@@ -205,7 +209,7 @@ impl SessionManager {
     pub fn new() -> Self {
         Self {
             sessions: Mutex::new(HashMap::new()),
-            timeout: Duration::from_secs(30 * 60), // 30 minutes default
+            timeout: Duration::from_secs(LOGICAL_SESSION_TIMEOUT_MINUTES * 60),
             transaction_timeout: Duration::from_secs(60), // 1 minute transaction timeout
         }
     }
@@ -242,24 +246,36 @@ impl SessionManager {
         sessions.get(&lsid).cloned()
     }
 
-    /// End (remove) a session
+    /// End (remove) a session, rolling back any in-progress transaction
     pub async fn end_session(&self, lsid: Uuid) {
-        let mut sessions = self.sessions.lock().await;
-        if let Some(session) = sessions.remove(&lsid) {
-            // Abort any in-progress transaction
-            if let Ok(mut s) = session.try_lock()
-                && s.in_transaction
+        // Release the registry before waiting on a session a running command may hold
+        let removed = self.sessions.lock().await.remove(&lsid);
+        if let Some(session) = removed {
+            let mut s = session.lock().await;
+            if s.in_transaction
+                && let Err(e) = s.abort_transaction().await
             {
-                #[allow(clippy::let_underscore_future)]
-                let _ = s.abort_transaction();
+                tracing::warn!(%lsid, error = %e, "failed to abort transaction of ended session");
             }
         }
     }
 
-    /// Clean up expired sessions
-    pub async fn cleanup_expired_sessions(&self) -> usize {
+    /// IDs of all registered sessions
+    pub async fn lsids(&self) -> Vec<Uuid> {
+        let sessions = self.sessions.lock().await;
+        sessions.keys().copied().collect()
+    }
+
+    /// Refresh the sessions in `lsids`, registering any not seen before
+    pub async fn refresh_sessions(&self, lsids: &[Uuid]) {
+        for lsid in lsids {
+            self.get_or_create_session(*lsid).await;
+        }
+    }
+
+    /// Clean up expired sessions, rolling back their transactions. Returns the removed IDs.
+    pub async fn cleanup_expired_sessions(&self) -> Vec<Uuid> {
         let mut sessions = self.sessions.lock().await;
-        let before_count = sessions.len();
 
         // Collect expired session IDs
         let expired: Vec<Uuid> = sessions
@@ -280,18 +296,22 @@ impl SessionManager {
             .map(|(id, _)| *id)
             .collect();
 
-        // Remove expired sessions
-        for id in &expired {
-            if let Some(session) = sessions.remove(id)
-                && let Ok(mut s) = session.try_lock()
-                && s.in_transaction
+        // Remove expired sessions, then roll back outside the registry lock
+        let removed: Vec<(Uuid, Arc<Mutex<Session>>)> = expired
+            .iter()
+            .filter_map(|id| sessions.remove(id).map(|s| (*id, s)))
+            .collect();
+        drop(sessions);
+        for (lsid, session) in &removed {
+            let mut s = session.lock().await;
+            if s.in_transaction
+                && let Err(e) = s.abort_transaction().await
             {
-                #[allow(clippy::let_underscore_future)]
-                let _ = s.abort_transaction();
+                tracing::warn!(%lsid, error = %e, "failed to abort transaction of expired session");
             }
         }
 
-        before_count - sessions.len()
+        expired
     }
 
     /// Get the number of active sessions
@@ -335,6 +355,20 @@ mod tests {
         assert!(!session.is_expired(Duration::from_secs(30 * 60)));
     }
 
+    #[tokio::test]
+    async fn test_cleanup_removes_idle_sessions() {
+        let manager = SessionManager::with_timeout(Duration::from_millis(20));
+        let idle = Uuid::new_v4();
+        let active = Uuid::new_v4();
+        manager.get_or_create_session(idle).await;
+        tokio::time::sleep(Duration::from_millis(40)).await;
+        manager.refresh_sessions(&[active]).await;
+
+        assert_eq!(manager.cleanup_expired_sessions().await, vec![idle]);
+        assert!(!manager.has_session(idle).await);
+        assert!(manager.has_session(active).await);
+    }
+
     #[test]
     fn test_retryable_write_storage() {
         let lsid = Uuid::new_v4();
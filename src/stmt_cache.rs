@@ -0,0 +1,156 @@
+//! Prepared-statement cache for repeated query shapes.
+//!
+//! A query's shape is the SQL the translator generates under
+//! [`bind_sql`](crate::translate::bind_sql), which binds every value as a parameter, so
+//! `{name: "a"}` and `{name: "b"}` share one shape.
+//! Shapes are tracked in a process-wide LRU that feeds the `serverStatus` hit/miss counters;
+//! the prepared statements themselves live in each pooled connection's statement cache.
+
+use std::collections::{BTreeMap, HashMap};
+use std::sync::Mutex;
+use std::sync::atomic::{AtomicU64, Ordering};
+
+/// Shapes remembered when `statement_cache_size` is not configured.
+pub const DEFAULT_STATEMENT_CACHE_SIZE: usize = 256;
+
+/// Hit/miss counters reported under `serverStatus.statementCache`.
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
+pub struct StatementCacheStats {
+    pub capacity: usize,
+    pub size: usize,
+    pub hits: u64,
+    pub misses: u64,
+    pub evictions: u64,
+}
+
+#[derive(Default)]
+struct Lru {
+    tick: u64,
+    entries: HashMap<String, Entry>,
+    order: BTreeMap<u64, String>,
+}
+
+struct Entry {
+    last_used: u64,
+    preparable: bool,
+}
+
+/// LRU of query shapes seen by the store, bounded to `capacity` entries.
+pub struct StatementCache {
+    capacity: usize,
+    lru: Mutex<Lru>,
+    hits: AtomicU64,
+    misses: AtomicU64,
+    evictions: AtomicU64,
+}
+
+impl StatementCache {
+    /// A cache remembering up to `capacity` shapes; 0 disables statement caching.
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            capacity,
+            lru: Mutex::new(Lru::default()),
+            hits: AtomicU64::new(0),
+            misses: AtomicU64::new(0),
+            evictions: AtomicU64::new(0),
+        }
+    }
+
+    pub fn capacity(&self) -> usize {
+        self.capacity
+    }
+
+    /// Record a use of `shape`, evicting the least recently used shape when full. Returns
+    /// whether the shape was already cached, or `None` when it should run unprepared
+    /// (caching disabled, or the shape previously failed to prepare).
+    pub fn lookup(&self, shape: &str) -> Option<bool> {
+        if self.capacity == 0 {
+            return None;
+        }
+        let mut guard = self.lru.lock().ok()?;
+        let lru = &mut *guard;
+        lru.tick += 1;
+        let tick = lru.tick;
+        if let Some(entry) = lru.entries.get_mut(shape) {
+            if !entry.preparable {
+                return None;
+            }
+            let previous = std::mem::replace(&mut entry.last_used, tick);
+            lru.order.remove(&previous);
+            lru.order.insert(tick, shape.to_string());
+            self.hits.fetch_add(1, Ordering::Relaxed);
+            return Some(true);
+        }
+        if lru.entries.len() >= self.capacity
+            && let Some((_, oldest)) = lru.order.pop_first()
+        {
+            lru.entries.remove(&oldest);
+            self.evictions.fetch_add(1, Ordering::Relaxed);
+        }
+        lru.entries.insert(
+            shape.to_string(),
+            Entry {
+                last_used: tick,
+                preparable: true,
+            },
+        );
+        lru.order.insert(tick, shape.to_string());
+        self.misses.fetch_add(1, Ordering::Relaxed);
+        Some(false)
+    }
+
+    /// Stop preparing `shape` (Postgres could not infer its parameter types).
+    pub fn mark_unpreparable(&self, shape: &str) {
+        if let Ok(mut lru) = self.lru.lock()
+            && let Some(entry) = lru.entries.get_mut(shape)
+        {
+            entry.preparable = false;
+        }
+    }
+
+    /// Forget every shape, returning how many were cached.
+    pub fn clear(&self) -> usize {
+        match self.lru.lock() {
+            Ok(mut lru) => {
+                let n = lru.entries.len();
+                lru.entries.clear();
+                lru.order.clear();
+                n
+            }
+            Err(_) => 0,
+        }
+    }
+
+    pub fn stats(&self) -> StatementCacheStats {
+        StatementCacheStats {
+            capacity: self.capacity,
+            size: self.lru.lock().map(|l| l.entries.len()).unwrap_or(0),
+            hits: self.hits.load(Ordering::Relaxed),
+            misses: self.misses.load(Ordering::Relaxed),
+            evictions: self.evictions.load(Ordering::Relaxed),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn evicts_least_recently_used_shape() {
+        let cache = StatementCache::new(2);
+        assert_eq!(cache.lookup("a"), Some(false));
+        assert_eq!(cache.lookup("b"), Some(false));
+        assert_eq!(cache.lookup("a"), Some(true));
+        assert_eq!(cache.lookup("c"), Some(false)); // evicts "b"
+        assert_eq!(cache.lookup("a"), Some(true));
+        assert_eq!(cache.lookup("b"), Some(false));
+        let stats = cache.stats();
+        assert_eq!((stats.hits, stats.misses, stats.evictions), (2, 4, 2));
+        assert_eq!(stats.size, 2);
+
+        cache.mark_unpreparable("b");
+        assert_eq!(cache.lookup("b"), None);
+        assert_eq!(StatementCache::new(0).lookup("a"), None);
+    }
+}
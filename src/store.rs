@@ -1,17 +1,487 @@
 use crate::error::{Error, Result};
-use crate::translate::translate_expression;
+use crate::schema_map::SchemaMapping;
+use crate::stmt_cache::{DEFAULT_STATEMENT_CACHE_SIZE, StatementCache, StatementCacheStats};
+use crate::translate::{
+    BoundSql, bind_sql, escape_single, json_literal_from_bson, jsonpath_exists, jsonpath_path,
+    pg_path_literal, sql_quote, translate_expression,
+};
 use deadpool_postgres::{Manager, ManagerConfig, Pool, RecyclingMethod};
-use std::collections::HashSet;
+use std::collections::{HashMap, HashSet};
 use std::str::FromStr;
 use std::time::Instant;
 use tokio::sync::RwLock;
-use tokio_postgres::{NoTls, Transaction};
+use tokio_postgres::types::{ToSql, Type};
+use tokio_postgres::{GenericClient, NoTls, Transaction};
+use tracing::Instrument;
+
+tokio::task_local! {
+    /// Comment of the command currently being served, attached to every SQL statement it issues.
+    static QUERY_COMMENT: String;
+    /// SQL issued by the current command, collected by `capture_sql`.
+    static CAPTURED_SQL: std::cell::RefCell<Vec<String>>;
+    /// Whether the write statement being served carries an index `hint`.
+    static INDEX_HINT: std::cell::Cell<bool>;
+    /// Connection of the dry run being served, inside the transaction it rolls back.
+    static DRY_RUN: std::sync::Arc<tokio::sync::Mutex<deadpool_postgres::Client>>;
+}
+
+/// Run `fut` with `comment` prefixed as `/* comment */` to every SQL statement it issues, so
+/// PostgreSQL logs and `pg_stat_activity` can be correlated with the originating Mongo operation.
+pub async fn with_query_comment<F: std::future::Future>(comment: &str, fut: F) -> F::Output {
+    // Neutralize comment delimiters so the text cannot terminate the comment early
+    let sanitized = comment.replace("*/", "* /").replace("/*", "/ *");
+    QUERY_COMMENT.scope(sanitized, fut).await
+}
+
+/// Run `fut`, a write command whose statements may carry an index `hint`, each marked with
+/// [`set_index_hint`] as it is served.
+pub async fn with_index_hints<F: std::future::Future>(fut: F) -> F::Output {
+    INDEX_HINT.scope(std::cell::Cell::new(false), fut).await
+}
+
+/// Mark whether the statement now served under [`with_index_hints`] hints an index. While
+/// set, the queries that match its documents run with sequential scans disabled, so the
+/// planner reaches for the index; PostgreSQL has no way to name the index itself.
+pub fn set_index_hint(hinted: bool) {
+    let _ = INDEX_HINT.try_with(|h| h.set(hinted));
+}
+
+/// Whether the statement now served hints an index, as last set by [`set_index_hint`].
+pub fn index_hinted() -> bool {
+    INDEX_HINT.try_with(|h| h.get()).unwrap_or(false)
+}
+
+/// Whether the statements now served belong to a [`PgStore::dry_run`].
+pub fn dry_run_active() -> bool {
+    DRY_RUN.try_with(|_| ()).is_ok()
+}
+
+/// A connection for one store operation: taken from the pool, or during a
+/// [`PgStore::dry_run`] the connection holding its transaction.
+enum PgConn {
+    Pooled(deadpool_postgres::Client),
+    Pinned(tokio::sync::OwnedMutexGuard<deadpool_postgres::Client>),
+}
+
+impl std::ops::Deref for PgConn {
+    type Target = deadpool_postgres::ClientWrapper;
+
+    fn deref(&self) -> &Self::Target {
+        match self {
+            PgConn::Pooled(client) => client,
+            PgConn::Pinned(client) => client,
+        }
+    }
+}
+
+impl std::ops::DerefMut for PgConn {
+    fn deref_mut(&mut self) -> &mut Self::Target {
+        match self {
+            PgConn::Pooled(client) => client,
+            PgConn::Pinned(client) => client,
+        }
+    }
+}
+
+/// [`query_bound`] in a transaction of its own that disables sequential scans. A dry run
+/// is already inside a transaction, so there the hint is dropped and the query runs as is.
+async fn query_hinted(
+    client: &mut deadpool_postgres::ClientWrapper,
+    stmt: &BoundSql,
+) -> std::result::Result<Vec<tokio_postgres::Row>, tokio_postgres::Error> {
+    if dry_run_active() {
+        return query_bound(&**client, stmt, &[]).await;
+    }
+    let tx = client.transaction().await?;
+    tx.batch_execute("SET LOCAL enable_seqscan = off").await?;
+    let rows = query_bound(&*tx, stmt, &[]).await?;
+    tx.commit().await?;
+    Ok(rows)
+}
+
+/// [`execute_bound`] in a transaction of its own that disables sequential scans.
+async fn execute_hinted(
+    client: &mut deadpool_postgres::ClientWrapper,
+    stmt: &BoundSql,
+) -> std::result::Result<u64, tokio_postgres::Error> {
+    if dry_run_active() {
+        return execute_bound(&**client, stmt, &[]).await;
+    }
+    let tx = client.transaction().await?;
+    tx.batch_execute("SET LOCAL enable_seqscan = off").await?;
+    let n = execute_bound(&*tx, stmt, &[]).await?;
+    tx.commit().await?;
+    Ok(n)
+}
+
+/// Upper bound on statements kept by `capture_sql` for a single command.
+const CAPTURED_SQL_LIMIT: usize = 20;
+
+/// Run `fut`, returning its output along with the SQL statements it issued (at most
+/// `CAPTURED_SQL_LIMIT`), for the slow-operation log.
+pub async fn capture_sql<F: std::future::Future>(fut: F) -> (F::Output, Vec<String>) {
+    CAPTURED_SQL
+        .scope(std::cell::RefCell::new(Vec::new()), async {
+            let out = fut.await;
+            (out, CAPTURED_SQL.with(|c| c.take()))
+        })
+        .await
+}
+
+fn annotate_sql(sql: &str) -> String {
+    let sql = QUERY_COMMENT
+        .try_with(|c| format!("/* {} */ {}", c, sql))
+        .unwrap_or_else(|_| sql.to_string());
+    note_sql(&sql);
+    sql
+}
+
+/// Capture and log `sql` as issued by the current command.
+fn note_sql(sql: &str) {
+    let _ = CAPTURED_SQL.try_with(|c| {
+        let mut captured = c.borrow_mut();
+        if captured.len() < CAPTURED_SQL_LIMIT {
+            captured.push(sql.to_string());
+        }
+    });
+    // Emitted inside the command span, so it carries the originating op_id
+    tracing::debug!(target: "oxidedb::sql", sql = %sql, "executing sql");
+}
+
+/// Child span of the current command for one backend statement; exported as an
+/// OpenTelemetry client span when tracing export is enabled.
+fn sql_span(sql: &str) -> tracing::Span {
+    tracing::info_span!(
+        "pg.query",
+        otel.kind = "client",
+        db.system = "postgresql",
+        db.statement = %sql,
+    )
+}
+
+/// Run a generated statement, binding the caller's own `params` (`$1` onward, each with its
+/// type) and then the values the translator bound (see [`bind_sql`]).
+async fn query_bound<C: GenericClient>(
+    client: &C,
+    stmt: &BoundSql,
+    params: &[(&(dyn ToSql + Sync), Type)],
+) -> std::result::Result<Vec<tokio_postgres::Row>, tokio_postgres::Error> {
+    let prepared = client
+        .prepare_typed(&annotate_sql(&stmt.sql), &param_types(params, stmt))
+        .instrument(sql_span(&stmt.sql))
+        .await?;
+    client
+        .query(&prepared, &bound_args(params, stmt))
+        .instrument(sql_span(&stmt.sql))
+        .await
+}
+
+/// [`query_bound`] for statements returning a row count.
+async fn execute_bound<C: GenericClient>(
+    client: &C,
+    stmt: &BoundSql,
+    params: &[(&(dyn ToSql + Sync), Type)],
+) -> std::result::Result<u64, tokio_postgres::Error> {
+    let prepared = client
+        .prepare_typed(&annotate_sql(&stmt.sql), &param_types(params, stmt))
+        .instrument(sql_span(&stmt.sql))
+        .await?;
+    client
+        .execute(&prepared, &bound_args(params, stmt))
+        .instrument(sql_span(&stmt.sql))
+        .await
+}
+
+/// Load `rows` into `table` with one binary `COPY`, all or nothing.
+async fn copy_rows(
+    client: &tokio_postgres::Client,
+    table: &str,
+    rows: &[InsertRow],
+) -> std::result::Result<u64, tokio_postgres::Error> {
+    use tokio_postgres::binary_copy::BinaryCopyInWriter;
+
+    let sql = format!("COPY {} (id, doc_bson, doc) FROM STDIN BINARY", table);
+    let sink = client
+        .copy_in(&annotate_sql(&sql))
+        .instrument(sql_span(&sql))
+        .await?;
+    let writer = BinaryCopyInWriter::new(sink, &[Type::BYTEA, Type::BYTEA, Type::JSONB]);
+    tokio::pin!(writer);
+    for row in rows {
+        writer
+            .as_mut()
+            .write(&[&row.id, &row.bson, &row.json])
+            .await?;
+    }
+    writer.finish().await
+}
+
+/// One multi-row `INSERT` of `rows` into `table`, reporting for each row whether it was
+/// inserted; `ON CONFLICT DO NOTHING` skips an `_id` that already exists.
+async fn insert_chunk<C: GenericClient>(
+    client: &C,
+    table: &str,
+    rows: &[InsertRow],
+) -> std::result::Result<Vec<bool>, tokio_postgres::Error> {
+    let values: Vec<String> = (0..rows.len())
+        .map(|i| format!("(${}, ${}, ${})", 3 * i + 1, 3 * i + 2, 3 * i + 3))
+        .collect();
+    let sql = format!(
+        "INSERT INTO {} (id, doc_bson, doc) VALUES {} ON CONFLICT (id) DO NOTHING RETURNING id",
+        table,
+        values.join(", ")
+    );
+    let mut params: Vec<&(dyn ToSql + Sync)> = Vec::with_capacity(rows.len() * 3);
+    for row in rows {
+        params.push(&row.id);
+        params.push(&row.bson);
+        params.push(&row.json);
+    }
+    let returned = client
+        .query(&annotate_sql(&sql), &params)
+        .instrument(sql_span(&sql))
+        .await?;
+    // Rows go in in order, so of two rows sharing an `_id` the first is the one inserted
+    let mut inserted: HashSet<Vec<u8>> = returned.iter().map(|r| r.get(0)).collect();
+    Ok(rows.iter().map(|row| inserted.remove(&row.id)).collect())
+}
+
+/// Types `stmt` is prepared with: those of the caller's own parameters, then `text` for each
+/// bound value. Declared up front, a value whose clause the translator dropped may go unused.
+fn param_types(params: &[(&(dyn ToSql + Sync), Type)], stmt: &BoundSql) -> Vec<Type> {
+    params
+        .iter()
+        .map(|(_, ty)| ty.clone())
+        .chain(std::iter::repeat_n(Type::TEXT, stmt.params.len()))
+        .collect()
+}
+
+fn bound_args<'a>(
+    params: &[(&'a (dyn ToSql + Sync), Type)],
+    stmt: &'a BoundSql,
+) -> Vec<&'a (dyn ToSql + Sync)> {
+    let mut args: Vec<&(dyn ToSql + Sync)> = params.iter().map(|(p, _)| *p).collect();
+    args.extend(stmt.params.iter().map(|v| v as &(dyn ToSql + Sync)));
+    args
+}
+
+/// Collections with fewer estimated rows than this are always sampled exactly.
+const SAMPLE_TABLESAMPLE_MIN_ROWS: i64 = 100_000;
+/// `TABLESAMPLE` is only used when the requested size is below this fraction of the table.
+const SAMPLE_TABLESAMPLE_MAX_FRACTION: f64 = 0.05;
+/// Over-sampling factor applied to the `TABLESAMPLE` percentage so short pages rarely
+/// leave the result below the requested size.
+const SAMPLE_TABLESAMPLE_OVERSAMPLE: f64 = 4.0;
+
+/// Result of `PgStore::validate_collection`.
+#[derive(Debug, Default)]
+pub struct ValidationReport {
+    pub nrecords: i64,
+    pub n_invalid_documents: i64,
+    pub warnings: Vec<String>,
+    pub errors: Vec<String>,
+}
+
+/// Usage of one index, reported by [`PgStore::index_usage`].
+#[derive(Debug, Clone)]
+pub struct IndexUsage {
+    pub name: String,
+    pub spec: bson::Document,
+    /// Index scans PostgreSQL has counted
+    pub ops: i64,
+    /// When PostgreSQL started counting: the last statistics reset, or server start
+    pub since_ms: i64,
+    /// On-disk size of the index, in bytes
+    pub size: i64,
+}
+
+/// How much `explain` reports, from its `verbosity`: the chosen plan only, the plan run
+/// with `ANALYZE`, or that plus buffer usage and output columns (`BUFFERS, VERBOSE`).
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ExplainVerbosity {
+    QueryPlanner,
+    ExecutionStats,
+    AllPlansExecution,
+}
+
+impl ExplainVerbosity {
+    pub fn parse(verbosity: &str) -> Option<Self> {
+        match verbosity {
+            "queryPlanner" => Some(Self::QueryPlanner),
+            "executionStats" => Some(Self::ExecutionStats),
+            "allPlansExecution" => Some(Self::AllPlansExecution),
+            _ => None,
+        }
+    }
+
+    /// The options of the `EXPLAIN` statement.
+    fn explain_options(self) -> &'static str {
+        match self {
+            Self::QueryPlanner => "FORMAT JSON",
+            Self::ExecutionStats => "ANALYZE, FORMAT JSON",
+            Self::AllPlansExecution => "ANALYZE, BUFFERS, VERBOSE, FORMAT JSON",
+        }
+    }
+}
+
+/// A TTL index: documents whose `field` holds a date more than `expire_after_secs` in the
+/// past are removed by the TTL monitor. Listed by [`PgStore::ttl_indexes`].
+#[derive(Debug, Clone, PartialEq)]
+pub struct TtlIndex {
+    pub db: String,
+    pub coll: String,
+    pub name: String,
+    pub field: String,
+    pub expire_after_secs: i64,
+}
+
+/// Size and activity of a collection's table, reported by [`PgStore::collection_stats`].
+#[derive(Debug, Clone)]
+pub struct CollectionStats {
+    pub count: i64,
+    /// Total BSON size of the documents
+    pub size: i64,
+    /// Size of the table on disk (heap and TOAST), without indexes
+    pub storage_size: i64,
+    pub indexes: Vec<IndexUsage>,
+    /// Sequential and index scans started on the table
+    pub reads: i64,
+    /// Rows inserted, updated and deleted
+    pub writes: i64,
+}
+
+/// A document ready for [`PgStore::insert_many`]: its `_id` key, BSON encoding and jsonb
+/// mirror.
+#[derive(Debug, Clone)]
+pub struct InsertRow {
+    pub id: Vec<u8>,
+    pub bson: Vec<u8>,
+    pub json: serde_json::Value,
+}
+
+/// What happened to one row of [`PgStore::insert_many`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum InsertOutcome {
+    Inserted,
+    /// The `_id` already exists, in the collection or earlier in the batch
+    Duplicate,
+    Failed(String),
+}
+
+/// Rows per multi-row `INSERT`. At three bind parameters a row this stays far below
+/// PostgreSQL's limit of 65535 per statement.
+pub const INSERT_CHUNK_ROWS: usize = 1000;
+
+/// Smallest unordered insert loaded with `COPY` when `copy_insert_threshold` is not
+/// configured.
+pub const DEFAULT_COPY_INSERT_THRESHOLD: usize = 5000;
+
+/// Entry counts dropped by [`PgStore::clear_caches`].
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
+pub struct ClearedCaches {
+    pub databases: usize,
+    pub collections: usize,
+    pub collations: usize,
+    pub views: usize,
+    /// Query shapes; the statements each connection prepared for them are dropped too
+    pub statements: usize,
+}
+
+/// A read-only view: the collection it reads from and the pipeline applied on top.
+#[derive(Debug, Clone, PartialEq)]
+pub struct ViewDefinition {
+    pub view_on: String,
+    pub pipeline: Vec<bson::Document>,
+}
+
+/// The `validator` a collection was created with, which the documents writes produce must
+/// match, and how strictly it applies.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Validator {
+    pub filter: bson::Document,
+    /// `validationLevel: "moderate"`: updates to documents that already fail are let through.
+    pub moderate: bool,
+    /// `validationAction: "warn"`: failing documents are logged and written anyway.
+    pub warn: bool,
+}
+
+/// Name of the cursor a [`DocCursor`] declares; each cursor owns its connection, so one
+/// name is enough.
+const DOC_CURSOR_NAME: &str = "oxidedb_doc_cursor";
+
+/// Server-side PostgreSQL cursor over a query's documents, opened by
+/// [`PgStore::open_doc_cursor`]. It holds its pooled connection inside a read-only
+/// transaction until the rows run out, then commits and hands the connection back.
+pub struct DocCursor {
+    client: Option<deadpool_postgres::Object>,
+}
+
+impl DocCursor {
+    /// Whether every row has been fetched (the connection is already released).
+    pub fn is_exhausted(&self) -> bool {
+        self.client.is_none()
+    }
+
+    /// Next `n` documents. Fewer than `n` means the cursor is exhausted and closed.
+    pub async fn fetch(&mut self, n: usize) -> Result<Vec<bson::Document>> {
+        let Some(client) = self.client.as_ref() else {
+            return Ok(Vec::new());
+        };
+        let sql = format!("FETCH FORWARD {} FROM {}", n, DOC_CURSOR_NAME);
+        let rows = client
+            .query(sql.as_str(), &[])
+            .instrument(sql_span(&sql))
+            .await
+            .map_err(err_msg)?;
+        let mut out = Vec::with_capacity(rows.len());
+        for r in &rows {
+            let bson_bytes: Option<Vec<u8>> = r.try_get(0).ok();
+            if let Some(bytes) = bson_bytes
+                && let Ok(doc) = bson::Document::from_reader(&mut std::io::Cursor::new(bytes))
+            {
+                out.push(doc);
+                continue;
+            }
+            out.push(to_doc_from_json(r.get(1)));
+        }
+        if out.len() < n {
+            self.close().await?;
+        }
+        Ok(out)
+    }
+
+    /// Close the cursor and return its connection to the pool.
+    pub async fn close(&mut self) -> Result<()> {
+        if let Some(client) = self.client.take() {
+            client.batch_execute("COMMIT").await.map_err(err_msg)?;
+        }
+        Ok(())
+    }
+}
+
+impl Drop for DocCursor {
+    fn drop(&mut self) {
+        // Dropped mid-transaction (killed or timed out): keep the connection out of the
+        // pool rather than hand back an open transaction.
+        if let Some(client) = self.client.take() {
+            drop(deadpool_postgres::Object::take(client));
+        }
+    }
+}
 
 pub struct PgStore {
     pool: Pool,
     dsn: String,
     databases_cache: RwLock<HashSet<String>>, // known databases
     collections_cache: RwLock<HashSet<(String, String)>>, // known (db, coll)
+    collation_cache: RwLock<HashMap<(String, String), Option<Collation>>>, // default collations
+    view_cache: RwLock<HashMap<(String, String), Option<ViewDefinition>>>, // view definitions
+    auto_increment_cache: RwLock<HashMap<(String, String), Option<String>>>, // autoIncrement fields
+    validator_cache: RwLock<HashMap<(String, String), Option<Validator>>>, // document validators
+    postgis_cache: RwLock<Option<bool>>,      // whether the PostGIS extension is installed
+    stmt_cache: StatementCache,               // prepared query shapes
+    mapping: SchemaMapping,                   // database/collection to schema/table names
+    copy_insert_threshold: usize,             // smallest unordered insert sent with COPY
 }
 
 impl PgStore {
@@ -30,16 +500,113 @@ impl PgStore {
             dsn: url.to_string(),
             databases_cache: RwLock::new(HashSet::new()),
             collections_cache: RwLock::new(HashSet::new()),
+            collation_cache: RwLock::new(HashMap::new()),
+            view_cache: RwLock::new(HashMap::new()),
+            auto_increment_cache: RwLock::new(HashMap::new()),
+            validator_cache: RwLock::new(HashMap::new()),
+            postgis_cache: RwLock::new(None),
+            stmt_cache: StatementCache::new(DEFAULT_STATEMENT_CACHE_SIZE),
+            mapping: SchemaMapping::default(),
+            copy_insert_threshold: DEFAULT_COPY_INSERT_THRESHOLD,
         })
     }
 
+    /// Lay databases and collections out in PostgreSQL according to `mapping`.
+    pub fn with_schema_mapping(mut self, mapping: SchemaMapping) -> Self {
+        self.mapping = mapping;
+        self
+    }
+
+    pub fn schema_mapping(&self) -> &SchemaMapping {
+        &self.mapping
+    }
+
+    /// Keep up to `size` query shapes prepared (0 disables statement caching).
+    pub fn with_statement_cache_size(mut self, size: usize) -> Self {
+        self.stmt_cache = StatementCache::new(size);
+        self
+    }
+
+    /// Load unordered inserts of at least `rows` documents with `COPY` (0 disables).
+    pub fn with_copy_insert_threshold(mut self, rows: usize) -> Self {
+        self.copy_insert_threshold = rows;
+        self
+    }
+
+    pub fn statement_cache_stats(&self) -> StatementCacheStats {
+        self.stmt_cache.stats()
+    }
+
     pub fn pool(&self) -> &Pool {
         &self.pool
     }
 
+    /// Connection for one operation: the dry run's when one is being served, else a pooled one.
+    async fn client(&self) -> Result<PgConn> {
+        if let Ok(pinned) = DRY_RUN.try_with(|c| c.clone()) {
+            return Ok(PgConn::Pinned(pinned.lock_owned().await));
+        }
+        Ok(PgConn::Pooled(self.pool.get().await.map_err(err_msg)?))
+    }
+
+    /// Run `fut` as a dry run: every statement the store issues for it goes to one connection,
+    /// inside a transaction that is rolled back once `fut` completes, so its writes are
+    /// checked against constraints and indexes but never kept. Sequence values it draws are
+    /// not returned. Document cursors still read committed data from the pool.
+    pub async fn dry_run<F: std::future::Future>(&self, fut: F) -> Result<F::Output> {
+        let client = self.pool.get().await.map_err(err_msg)?;
+        client.batch_execute("BEGIN").await.map_err(err_msg)?;
+        let pinned = std::sync::Arc::new(tokio::sync::Mutex::new(client));
+        let out = DRY_RUN.scope(pinned.clone(), fut).await;
+        let rolled_back = pinned.lock().await.batch_execute("ROLLBACK").await;
+        if let Err(e) = rolled_back {
+            // Keep a connection that may still hold the writes out of the pool
+            if let Ok(client) = std::sync::Arc::try_unwrap(pinned) {
+                drop(deadpool_postgres::Object::take(client.into_inner()));
+            }
+            return Err(err_msg(e));
+        }
+        Ok(out)
+    }
+
+    /// Mark savepoint `name` in the running [`PgStore::dry_run`].
+    pub async fn savepoint(&self, name: &str) -> Result<()> {
+        let client = self.client().await?;
+        client
+            .batch_execute(&format!("SAVEPOINT {}", q_ident(name)))
+            .await
+            .map_err(err_msg)
+    }
+
+    /// Undo everything the running [`PgStore::dry_run`] did since savepoint `name`, which
+    /// also recovers its transaction from a failed statement.
+    pub async fn rollback_to_savepoint(&self, name: &str) -> Result<()> {
+        let client = self.client().await?;
+        client
+            .batch_execute(&format!("ROLLBACK TO SAVEPOINT {}", q_ident(name)))
+            .await
+            .map_err(err_msg)
+    }
+
+    /// Check out a pooled connection and run a trivial query, giving up after `timeout`.
+    pub async fn ping(&self, timeout: std::time::Duration) -> Result<()> {
+        let check = async {
+            let client = self.client().await?;
+            client.simple_query("SELECT 1").await.map_err(err_msg)?;
+            Ok(())
+        };
+        match tokio::time::timeout(timeout, check).await {
+            Ok(res) => res,
+            Err(_) => Err(Error::Msg(format!(
+                "no PostgreSQL connection within {}ms",
+                timeout.as_millis()
+            ))),
+        }
+    }
+
     pub async fn bootstrap(&self) -> Result<()> {
         // Create metadata schema and tables
-        let client = self.pool.get().await.map_err(err_msg)?;
+        let client = self.client().await?;
         client
             .batch_execute(
                 r#"
@@ -52,6 +619,8 @@ impl PgStore {
                     coll TEXT NOT NULL,
                     PRIMARY KEY (db, coll)
                 );
+                ALTER TABLE mdb_meta.collections
+                    ADD COLUMN IF NOT EXISTS options JSONB NOT NULL DEFAULT '{}'::jsonb;
                 CREATE TABLE IF NOT EXISTS mdb_meta.indexes (
                     db TEXT NOT NULL,
                     coll TEXT NOT NULL,
@@ -64,11 +633,49 @@ impl PgStore {
             )
             .await
             .map_err(|e| Error::Msg(e.to_string()))?;
+
+        // Tables created before collections kept an insertion sequence gain one now, so
+        // `$natural` order also works on collections that are only read
+        let sequenced: HashSet<(String, String)> = client
+            .query(
+                "SELECT table_schema::text, table_name::text FROM information_schema.columns WHERE column_name = 'seq'",
+                &[],
+            )
+            .await
+            .map_err(err_msg)?
+            .into_iter()
+            .map(|r| (r.get(0), r.get(1)))
+            .collect();
+        let tables: HashSet<(String, String)> = client
+            .query(
+                "SELECT table_schema::text, table_name::text FROM information_schema.tables",
+                &[],
+            )
+            .await
+            .map_err(err_msg)?
+            .into_iter()
+            .map(|r| (r.get(0), r.get(1)))
+            .collect();
+        let collections = client
+            .query("SELECT db, coll FROM mdb_meta.collections", &[])
+            .await
+            .map_err(err_msg)?;
+        for r in collections {
+            let (db, coll): (String, String) = (r.get(0), r.get(1));
+            let table = (self.mapping.schema(&db), self.mapping.table(&db, &coll));
+            // Views have no table
+            if tables.contains(&table) && !sequenced.contains(&table) {
+                client
+                    .batch_execute(&self.natural_order_ddl(&db, &coll))
+                    .await
+                    .map_err(err_msg)?;
+            }
+        }
         Ok(())
     }
 
     pub async fn list_databases(&self) -> Result<Vec<String>> {
-        let client = self.pool.get().await.map_err(err_msg)?;
+        let client = self.client().await?;
         let rows = client
             .query("SELECT db FROM mdb_meta.databases ORDER BY db", &[])
             .await
@@ -77,7 +684,7 @@ impl PgStore {
     }
 
     pub async fn list_collections(&self, db: &str) -> Result<Vec<String>> {
-        let client = self.pool.get().await.map_err(err_msg)?;
+        let client = self.client().await?;
         let rows = client
             .query(
                 "SELECT coll FROM mdb_meta.collections WHERE db = $1 ORDER BY coll",
@@ -88,140 +695,625 @@ impl PgStore {
         Ok(rows.into_iter().map(|r| r.get::<_, String>(0)).collect())
     }
 
-    pub async fn ensure_database(&self, db: &str) -> Result<()> {
-        // Fast path: cache
-        if self.is_known_db(db).await {
-            return Ok(());
-        }
-        let t = Instant::now();
-        let schema = schema_name(db);
-        let q_schema = q_ident(&schema);
-        let ddl = format!("CREATE SCHEMA IF NOT EXISTS {}", q_schema);
-        let client = self.pool.get().await.map_err(err_msg)?;
-        client.batch_execute(&ddl).await.map_err(err_msg)?;
-        client
-            .execute(
-                "INSERT INTO mdb_meta.databases(db) VALUES($1) ON CONFLICT (db) DO NOTHING",
+    /// Collections of `db` with the options they were created with.
+    pub async fn list_collections_with_options(
+        &self,
+        db: &str,
+    ) -> Result<Vec<(String, bson::Document)>> {
+        let client = self.client().await?;
+        let rows = client
+            .query(
+                "SELECT coll, options FROM mdb_meta.collections WHERE db = $1 ORDER BY coll",
                 &[&db],
             )
             .await
             .map_err(err_msg)?;
-        self.mark_db_known(db).await;
-        tracing::debug!(op="ensure_database", db=%db, elapsed_ms=?t.elapsed().as_millis());
-        Ok(())
+        Ok(rows
+            .into_iter()
+            .map(|r| (r.get::<_, String>(0), to_doc_from_json(r.get(1))))
+            .collect())
     }
 
-    pub async fn ensure_collection(&self, db: &str, coll: &str) -> Result<()> {
-        // Fast path: cache
-        if self.is_known_collection(db, coll).await {
-            return Ok(());
-        }
-        self.ensure_database(db).await?;
-        let t = Instant::now();
-        let schema = schema_name(db);
-        let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let idx_name = format!("idx_{}_doc_gin", coll);
-        let q_idx_name = q_ident(&idx_name);
-        let ddl = format!(
-            "CREATE TABLE IF NOT EXISTS {}.{} (id bytea PRIMARY KEY, doc jsonb NOT NULL, doc_bson bytea NOT NULL);\nCREATE INDEX IF NOT EXISTS {} ON {}.{} USING GIN (doc jsonb_path_ops)",
-            q_schema, q_table, q_idx_name, q_schema, q_table
-        );
-        let client = self.pool.get().await.map_err(err_msg)?;
-        client.batch_execute(&ddl).await.map_err(err_msg)?;
+    /// Create the collection if needed and record its `create` options.
+    pub async fn set_collection_options(
+        &self,
+        db: &str,
+        coll: &str,
+        options: &bson::Document,
+    ) -> Result<()> {
+        self.ensure_collection(db, coll).await?;
+        let json = serde_json::to_value(options).map_err(err_msg)?;
+        let client = self.client().await?;
         client
             .execute(
-                "INSERT INTO mdb_meta.collections(db, coll) VALUES($1,$2) ON CONFLICT (db, coll) DO NOTHING",
-                &[&db, &coll],
+                "UPDATE mdb_meta.collections SET options = $3 WHERE db = $1 AND coll = $2",
+                &[&db, &coll, &json],
             )
             .await
             .map_err(err_msg)?;
-        self.mark_collection_known(db, coll).await;
-        tracing::debug!(op="ensure_collection", db=%db, coll=%coll, elapsed_ms=?t.elapsed().as_millis());
+        self.forget_collation(db, Some(coll)).await;
         Ok(())
     }
 
-    pub async fn drop_collection(&self, db: &str, coll: &str) -> Result<()> {
-        let schema = schema_name(db);
-        let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let ddl = format!("DROP TABLE IF EXISTS {}.{}", q_schema, q_table);
-        let client = self.pool.get().await.map_err(err_msg)?;
+    /// Set the `fillfactor` of `db.coll`'s table and record it with the collection as
+    /// `storageEngine.postgresql.fillfactor`. PostgreSQL applies it to pages filled from
+    /// now on; pages already written keep their packing until the table is rewritten.
+    pub async fn set_fillfactor(&self, db: &str, coll: &str, fillfactor: i32) -> Result<()> {
+        let ddl = format!(
+            "ALTER TABLE {} SET (fillfactor = {})",
+            self.mapping.qualified_table(db, coll),
+            fillfactor
+        );
+        let client = self.client().await?;
         client.batch_execute(&ddl).await.map_err(err_msg)?;
         client
             .execute(
-                "DELETE FROM mdb_meta.collections WHERE db = $1 AND coll = $2",
-                &[&db, &coll],
+                "UPDATE mdb_meta.collections SET options = jsonb_set(
+                    options || jsonb_build_object('storageEngine', COALESCE(options->'storageEngine', '{}'::jsonb)),
+                    '{storageEngine,postgresql}',
+                    COALESCE(options#>'{storageEngine,postgresql}', '{}'::jsonb) || jsonb_build_object('fillfactor', $3::int)
+                ) WHERE db = $1 AND coll = $2",
+                &[&db, &coll, &fillfactor],
             )
             .await
             .map_err(err_msg)?;
         Ok(())
     }
 
-    pub async fn drop_database(&self, db: &str) -> Result<()> {
-        let schema = schema_name(db);
-        let q_schema = q_ident(&schema);
-        let ddl = format!("DROP SCHEMA IF EXISTS {} CASCADE", q_schema);
-        let client = self.pool.get().await.map_err(err_msg)?;
+    /// Create the PostgreSQL sequence behind the `autoIncrement` option of `db.coll`, whose
+    /// first value is `start`. The sequence is owned by the table, so dropping the collection
+    /// drops it too.
+    pub async fn create_auto_increment(&self, db: &str, coll: &str, start: i64) -> Result<()> {
+        self.ensure_collection(db, coll).await?;
+        let ddl = format!(
+            "CREATE SEQUENCE IF NOT EXISTS {} START WITH {} MINVALUE {} OWNED BY {}.id",
+            self.auto_increment_sequence(db, coll),
+            start,
+            start.min(1),
+            self.mapping.qualified_table(db, coll)
+        );
+        let client = self.client().await?;
         client.batch_execute(&ddl).await.map_err(err_msg)?;
-        client
-            .execute("DELETE FROM mdb_meta.collections WHERE db = $1", &[&db])
+        Ok(())
+    }
+
+    /// The field `db.coll` fills from its sequence, if it was created with `autoIncrement`.
+    pub async fn auto_increment_field(&self, db: &str, coll: &str) -> Result<Option<String>> {
+        let key = (db.to_string(), coll.to_string());
+        if let Some(f) = self.auto_increment_cache.read().await.get(&key) {
+            return Ok(f.clone());
+        }
+        let client = self.client().await?;
+        let row = client
+            .query_opt(
+                "SELECT options FROM mdb_meta.collections WHERE db = $1 AND coll = $2",
+                &[&db, &coll],
+            )
             .await
             .map_err(err_msg)?;
-        client
-            .execute("DELETE FROM mdb_meta.databases WHERE db = $1", &[&db])
+        let field = row
+            .map(|r| to_doc_from_json(r.get(0)))
+            .and_then(|opts| opts.get_document("autoIncrement").ok().cloned())
+            .and_then(|spec| spec.get_str("field").ok().map(str::to_string));
+        self.auto_increment_cache
+            .write()
             .await
-            .map_err(err_msg)?;
-        Ok(())
+            .insert(key, field.clone());
+        Ok(field)
     }
 
-    pub async fn insert_one(
-        &self,
-        db: &str,
-        coll: &str,
-        id: &[u8],
-        bson_bytes: &[u8],
-        json: &serde_json::Value,
-    ) -> Result<u64> {
-        self.ensure_collection(db, coll).await?;
-        let schema = schema_name(db);
-        let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+    /// Draw `n` ascending values from the `autoIncrement` sequence of `db.coll`.
+    /// `nextval` never hands the same value out twice, whatever runs concurrently, and
+    /// values drawn by a write that later fails are not reused.
+    pub async fn next_auto_increment(&self, db: &str, coll: &str, n: i64) -> Result<Vec<i64>> {
         let sql = format!(
-            "INSERT INTO {}.{} (id, doc_bson, doc) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING",
-            q_schema, q_table
+            "SELECT nextval('{}') FROM generate_series(1, $1::bigint) ORDER BY 1",
+            self.auto_increment_sequence(db, coll).replace('\'', "''")
         );
-        let t = Instant::now();
-        let client = self.pool.get().await.map_err(err_msg)?;
-        let n = client
-            .execute(&sql, &[&id, &bson_bytes, &json])
+        let client = self.client().await?;
+        let rows = client
+            .query(&annotate_sql(&sql), &[&n])
+            .instrument(sql_span(&sql))
             .await
             .map_err(err_msg)?;
-        tracing::debug!(op="insert_one", db=%db, coll=%coll, elapsed_ms=?t.elapsed().as_millis());
-        Ok(n)
+        Ok(rows.iter().map(|r| r.get(0)).collect())
     }
 
-    /// Insert with a specific client (for transaction support)
-    pub async fn insert_one_with_client(
-        &self,
-        client: &tokio_postgres::Client,
-        db: &str,
-        coll: &str,
-        id: &[u8],
-        bson_bytes: &[u8],
-        json: &serde_json::Value,
-    ) -> Result<u64> {
-        self.ensure_collection(db, coll).await?;
-        let schema = schema_name(db);
+    /// Quoted name of the sequence behind the `autoIncrement` option of `db.coll`.
+    fn auto_increment_sequence(&self, db: &str, coll: &str) -> String {
+        format!(
+            "{}.{}",
+            q_ident(&self.mapping.schema(db)),
+            q_ident(
+                &self
+                    .mapping
+                    .index(db, coll, &format!("seq_{}_auto_increment", coll))
+            )
+        )
+    }
+
+    /// The collection's default collation, if it was created with one.
+    pub async fn default_collation(&self, db: &str, coll: &str) -> Result<Option<Collation>> {
+        let key = (db.to_string(), coll.to_string());
+        if let Some(c) = self.collation_cache.read().await.get(&key) {
+            return Ok(c.clone());
+        }
+        let client = self.client().await?;
+        let row = client
+            .query_opt(
+                "SELECT options FROM mdb_meta.collections WHERE db = $1 AND coll = $2",
+                &[&db, &coll],
+            )
+            .await
+            .map_err(err_msg)?;
+        let collation = row
+            .map(|r| to_doc_from_json(r.get(0)))
+            .and_then(|opts| opts.get_document("collation").ok().cloned())
+            .and_then(|d| Collation::parse(&d).ok());
+        self.collation_cache
+            .write()
+            .await
+            .insert(key, collation.clone());
+        Ok(collation)
+    }
+
+    /// Record a view of `db` over `view_on`. Views have a metadata row but no table.
+    /// Returns `false` when a collection or view named `name` already exists.
+    pub async fn create_view(
+        &self,
+        db: &str,
+        name: &str,
+        view_on: &str,
+        pipeline: &[bson::Document],
+    ) -> Result<bool> {
+        self.ensure_database(db).await?;
+        let options = bson::doc! { "viewOn": view_on, "pipeline": pipeline.to_vec() };
+        let json = serde_json::to_value(&options).map_err(err_msg)?;
+        let client = self.client().await?;
+        let n = client
+            .execute(
+                "INSERT INTO mdb_meta.collections(db, coll, options) VALUES($1,$2,$3) ON CONFLICT (db, coll) DO NOTHING",
+                &[&db, &name, &json],
+            )
+            .await
+            .map_err(err_msg)?;
+        self.forget_collation(db, Some(name)).await;
+        Ok(n == 1)
+    }
+
+    /// The definition of `db.coll` if it is a view, `None` for collections.
+    pub async fn view_definition(&self, db: &str, coll: &str) -> Result<Option<ViewDefinition>> {
+        let key = (db.to_string(), coll.to_string());
+        if let Some(v) = self.view_cache.read().await.get(&key) {
+            return Ok(v.clone());
+        }
+        let client = self.client().await?;
+        let row = client
+            .query_opt(
+                "SELECT options FROM mdb_meta.collections WHERE db = $1 AND coll = $2",
+                &[&db, &coll],
+            )
+            .await
+            .map_err(err_msg)?;
+        let view = row.map(|r| to_doc_from_json(r.get(0))).and_then(|opts| {
+            let view_on = opts.get_str("viewOn").ok()?.to_string();
+            let pipeline = opts
+                .get_array("pipeline")
+                .map(|a| a.iter().filter_map(|s| s.as_document().cloned()).collect())
+                .unwrap_or_default();
+            Some(ViewDefinition { view_on, pipeline })
+        });
+        self.view_cache.write().await.insert(key, view.clone());
+        Ok(view)
+    }
+
+    /// The validator of `db.coll`, if it was created with one whose `validationLevel` is not
+    /// `"off"`.
+    pub async fn collection_validator(&self, db: &str, coll: &str) -> Result<Option<Validator>> {
+        let key = (db.to_string(), coll.to_string());
+        if let Some(v) = self.validator_cache.read().await.get(&key) {
+            return Ok(v.clone());
+        }
+        let client = self.client().await?;
+        let row = client
+            .query_opt(
+                "SELECT options FROM mdb_meta.collections WHERE db = $1 AND coll = $2",
+                &[&db, &coll],
+            )
+            .await
+            .map_err(err_msg)?;
+        let validator = row.map(|r| to_doc_from_json(r.get(0))).and_then(|opts| {
+            let filter = opts.get_document("validator").ok()?.clone();
+            let level = opts.get_str("validationLevel").unwrap_or("strict");
+            if level == "off" || filter.is_empty() {
+                return None;
+            }
+            Some(Validator {
+                filter,
+                moderate: level == "moderate",
+                warn: opts.get_str("validationAction") == Ok("warn"),
+            })
+        });
+        self.validator_cache
+            .write()
+            .await
+            .insert(key, validator.clone());
+        Ok(validator)
+    }
+
+    pub async fn ensure_database(&self, db: &str) -> Result<()> {
+        // Fast path: cache
+        if self.is_known_db(db).await {
+            return Ok(());
+        }
+        let t = Instant::now();
+        let schema = self.mapping.schema(db);
+        let q_schema = q_ident(&schema);
+        let ddl = format!("CREATE SCHEMA IF NOT EXISTS {}", q_schema);
+        let client = self.client().await?;
+        client.batch_execute(&ddl).await.map_err(err_msg)?;
+        client
+            .execute(
+                "INSERT INTO mdb_meta.databases(db) VALUES($1) ON CONFLICT (db) DO NOTHING",
+                &[&db],
+            )
+            .await
+            .map_err(err_msg)?;
+        self.mark_db_known(db).await;
+        tracing::debug!(op="ensure_database", db=%db, elapsed_ms=?t.elapsed().as_millis());
+        Ok(())
+    }
+
+    pub async fn ensure_collection(&self, db: &str, coll: &str) -> Result<()> {
+        // Fast path: cache
+        if self.is_known_collection(db, coll).await {
+            return Ok(());
+        }
+        self.create_collection_table(db, coll, None).await
+    }
+
+    /// Create `db.coll` if needed with its table's `fillfactor`, set in the same transaction
+    /// as the table is created, so a fillfactor PostgreSQL refuses leaves no collection
+    /// behind. A table that already exists takes the new fillfactor.
+    pub async fn ensure_collection_with_fillfactor(
+        &self,
+        db: &str,
+        coll: &str,
+        fillfactor: i32,
+    ) -> Result<()> {
+        self.create_collection_table(db, coll, Some(fillfactor))
+            .await
+    }
+
+    async fn create_collection_table(
+        &self,
+        db: &str,
+        coll: &str,
+        fillfactor: Option<i32>,
+    ) -> Result<()> {
+        self.ensure_database(db).await?;
+        let t = Instant::now();
+        let schema = self.mapping.schema(db);
+        let q_schema = q_ident(&schema);
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let idx_name = self
+            .mapping
+            .index(db, coll, &format!("idx_{}_doc_gin", coll));
+        let q_idx_name = q_ident(&idx_name);
+        let mut ddl = format!(
+            "CREATE TABLE IF NOT EXISTS {}.{} (id bytea PRIMARY KEY, doc jsonb NOT NULL, doc_bson bytea NOT NULL);\nCREATE INDEX IF NOT EXISTS {} ON {}.{} USING GIN (doc jsonb_path_ops);\n{}",
+            q_schema,
+            q_table,
+            q_idx_name,
+            q_schema,
+            q_table,
+            self.natural_order_ddl(db, coll)
+        );
+        if let Some(fillfactor) = fillfactor {
+            ddl.push_str(&format!(
+                ";\nALTER TABLE {}.{} SET (fillfactor = {})",
+                q_schema, q_table, fillfactor
+            ));
+        }
+        // One simple-query batch runs as one transaction
+        let client = self.client().await?;
+        client.batch_execute(&ddl).await.map_err(err_msg)?;
+        client
+            .execute(
+                "INSERT INTO mdb_meta.collections(db, coll) VALUES($1,$2) ON CONFLICT (db, coll) DO NOTHING",
+                &[&db, &coll],
+            )
+            .await
+            .map_err(err_msg)?;
+        self.mark_collection_known(db, coll).await;
+        tracing::debug!(op="ensure_collection", db=%db, coll=%coll, elapsed_ms=?t.elapsed().as_millis());
+        Ok(())
+    }
+
+    /// DDL giving `db.coll` its insertion sequence: a `seq` identity column, numbered as rows
+    /// arrive and never changed by updates, and an index on it. `$natural` order is `seq`
+    /// order. Adding the column to an existing table numbers its rows in physical order.
+    fn natural_order_ddl(&self, db: &str, coll: &str) -> String {
+        let q_schema = q_ident(&self.mapping.schema(db));
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let q_idx = q_ident(
+            &self
+                .mapping
+                .index(db, coll, &format!("idx_{}_natural", coll)),
+        );
+        format!(
+            "ALTER TABLE {}.{} ADD COLUMN IF NOT EXISTS seq bigint GENERATED BY DEFAULT AS IDENTITY;\nCREATE INDEX IF NOT EXISTS {} ON {}.{} (seq)",
+            q_schema, q_table, q_idx, q_schema, q_table
+        )
+    }
+
+    pub async fn drop_collection(&self, db: &str, coll: &str) -> Result<()> {
+        let schema = self.mapping.schema(db);
+        let q_schema = q_ident(&schema);
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let ddl = format!("DROP TABLE IF EXISTS {}.{}", q_schema, q_table);
+        let client = self.client().await?;
+        client.batch_execute(&ddl).await.map_err(err_msg)?;
+        client
+            .execute(
+                "DELETE FROM mdb_meta.collections WHERE db = $1 AND coll = $2",
+                &[&db, &coll],
+            )
+            .await
+            .map_err(err_msg)?;
+        self.forget_collection(db, Some(coll)).await;
+        Ok(())
+    }
+
+    pub async fn drop_database(&self, db: &str) -> Result<()> {
+        let ddl = if self.mapping.owns_schema() {
+            let q_schema = q_ident(&self.mapping.schema(db));
+            format!("DROP SCHEMA IF EXISTS {} CASCADE", q_schema)
+        } else {
+            // The schema is shared with other databases: drop only this database's tables
+            self.list_collections(db)
+                .await?
+                .iter()
+                .map(|coll| {
+                    format!(
+                        "DROP TABLE IF EXISTS {};",
+                        self.mapping.qualified_table(db, coll)
+                    )
+                })
+                .collect::<String>()
+        };
+        let client = self.client().await?;
+        client.batch_execute(&ddl).await.map_err(err_msg)?;
+        client
+            .execute("DELETE FROM mdb_meta.collections WHERE db = $1", &[&db])
+            .await
+            .map_err(err_msg)?;
+        client
+            .execute("DELETE FROM mdb_meta.databases WHERE db = $1", &[&db])
+            .await
+            .map_err(err_msg)?;
+        self.databases_cache.write().await.remove(db);
+        self.forget_collection(db, None).await;
+        Ok(())
+    }
+
+    /// Flush the known-database, known-collection, default-collation, view and query-shape
+    /// caches, and every pooled connection's prepared statements, so the next command
+    /// re-reads them from Postgres and prepares its statement again. Returns how many
+    /// entries were dropped; the prepared statements are not counted.
+    pub async fn clear_caches(&self) -> ClearedCaches {
+        let mut dbs = self.databases_cache.write().await;
+        let mut colls = self.collections_cache.write().await;
+        let mut collations = self.collation_cache.write().await;
+        let mut views = self.view_cache.write().await;
+        let cleared = ClearedCaches {
+            databases: dbs.len(),
+            collections: colls.len(),
+            collations: collations.len(),
+            views: views.len(),
+            statements: self.stmt_cache.clear(),
+        };
+        dbs.clear();
+        colls.clear();
+        collations.clear();
+        views.clear();
+        // Every pooled connection's prepared statements go too, checked out or idle
+        self.pool.manager().statement_caches.clear();
+        self.auto_increment_cache.write().await.clear();
+        self.validator_cache.write().await.clear();
+        cleared
+    }
+
+    pub async fn insert_one(
+        &self,
+        db: &str,
+        coll: &str,
+        id: &[u8],
+        bson_bytes: &[u8],
+        json: &serde_json::Value,
+    ) -> Result<u64> {
+        self.ensure_collection(db, coll).await?;
+        let schema = self.mapping.schema(db);
+        let q_schema = q_ident(&schema);
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let sql = format!(
+            "INSERT INTO {}.{} (id, doc_bson, doc) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING",
+            q_schema, q_table
+        );
+        let t = Instant::now();
+        let client = self.client().await?;
+        let n = client
+            .execute(&annotate_sql(&sql), &[&id, &bson_bytes, &json])
+            .instrument(sql_span(&sql))
+            .await
+            .map_err(err_msg)?;
+        tracing::debug!(op="insert_one", db=%db, coll=%coll, elapsed_ms=?t.elapsed().as_millis());
+        Ok(n)
+    }
+
+    /// Insert `rows` with one multi-row `INSERT` per [`INSERT_CHUNK_ROWS`] rows, returning
+    /// an outcome for each row attempted. A chunk that fails as a whole (say on a secondary
+    /// unique index) is replayed row by row so each failure is reported against its own
+    /// row. With `ordered`, every chunk runs in a transaction that is rolled back and
+    /// replayed when any of its rows is not inserted, and the outcomes end at the first row
+    /// that was not: nothing after it is written.
+    ///
+    /// Unordered batches of at least `copy_insert_threshold` rows are first loaded with a
+    /// single `COPY`. `COPY` cannot skip duplicates, so if any row fails it writes nothing
+    /// and the batch takes the `INSERT` path to find out which.
+    pub async fn insert_many(
+        &self,
+        db: &str,
+        coll: &str,
+        rows: &[InsertRow],
+        ordered: bool,
+    ) -> Result<Vec<InsertOutcome>> {
+        self.ensure_collection(db, coll).await?;
+        let table = self.mapping.qualified_table(db, coll);
+        let t = Instant::now();
+        let client = self.client().await?;
+        // A dry run is one transaction: a failed statement must only undo itself, so each is
+        // wrapped in a savepoint, and COPY is not attempted
+        let dry_run = dry_run_active();
+        if !ordered
+            && !dry_run
+            && self.copy_insert_threshold > 0
+            && rows.len() >= self.copy_insert_threshold
+        {
+            match copy_rows(&client, &table, rows).await {
+                Ok(_) => {
+                    tracing::debug!(op="insert_many_copy", db=%db, coll=%coll, rows=rows.len(), elapsed_ms=?t.elapsed().as_millis());
+                    return Ok(vec![InsertOutcome::Inserted; rows.len()]);
+                }
+                Err(e) => {
+                    tracing::debug!(db=%db, coll=%coll, error=%e, "COPY insert failed; inserting with INSERT");
+                }
+            }
+        }
+        let mut outcomes = Vec::with_capacity(rows.len());
+        'chunks: for chunk in rows.chunks(INSERT_CHUNK_ROWS) {
+            if dry_run {
+                client
+                    .batch_execute("SAVEPOINT insert_chunk")
+                    .await
+                    .map_err(err_msg)?;
+            } else if ordered {
+                client.batch_execute("BEGIN").await.map_err(err_msg)?;
+            }
+            let batch = insert_chunk(&**client, &table, chunk).await;
+            let clean = matches!(&batch, Ok(inserted) if inserted.iter().all(|i| *i));
+            let keep = if ordered { clean } else { batch.is_ok() };
+            if dry_run {
+                let end = if keep {
+                    "RELEASE SAVEPOINT insert_chunk"
+                } else {
+                    "ROLLBACK TO SAVEPOINT insert_chunk"
+                };
+                client.batch_execute(end).await.map_err(err_msg)?;
+            } else if ordered {
+                let end = if clean { "COMMIT" } else { "ROLLBACK" };
+                client.batch_execute(end).await.map_err(err_msg)?;
+            }
+            match batch {
+                Ok(inserted) if clean || !ordered => {
+                    outcomes.extend(inserted.into_iter().map(|i| {
+                        if i {
+                            InsertOutcome::Inserted
+                        } else {
+                            InsertOutcome::Duplicate
+                        }
+                    }));
+                }
+                _ => {
+                    for row in chunk {
+                        if dry_run {
+                            client
+                                .batch_execute("SAVEPOINT insert_row")
+                                .await
+                                .map_err(err_msg)?;
+                        }
+                        let outcome = match insert_chunk(
+                            &**client,
+                            &table,
+                            std::slice::from_ref(row),
+                        )
+                        .await
+                        {
+                            Ok(inserted) if inserted[0] => InsertOutcome::Inserted,
+                            Ok(_) => InsertOutcome::Duplicate,
+                            Err(e) => InsertOutcome::Failed(e.to_string()),
+                        };
+                        if dry_run {
+                            let end = if matches!(outcome, InsertOutcome::Failed(_)) {
+                                "ROLLBACK TO SAVEPOINT insert_row"
+                            } else {
+                                "RELEASE SAVEPOINT insert_row"
+                            };
+                            client.batch_execute(end).await.map_err(err_msg)?;
+                        }
+                        let stop = ordered && outcome != InsertOutcome::Inserted;
+                        outcomes.push(outcome);
+                        if stop {
+                            break 'chunks;
+                        }
+                    }
+                }
+            }
+        }
+        tracing::debug!(op="insert_many", db=%db, coll=%coll, rows=outcomes.len(), elapsed_ms=?t.elapsed().as_millis());
+        Ok(outcomes)
+    }
+
+    /// Insert into a collection kept to its newest `max_docs` documents (in `_id` ObjectId
+    /// order), used for `system.profile`.
+    pub async fn insert_capped(
+        &self,
+        db: &str,
+        coll: &str,
+        id: &[u8],
+        bson_bytes: &[u8],
+        json: &serde_json::Value,
+        max_docs: i64,
+    ) -> Result<()> {
+        self.insert_one(db, coll, id, bson_bytes, json).await?;
+        let schema = self.mapping.schema(db);
+        let q_schema = q_ident(&schema);
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let sql = format!(
+            "DELETE FROM {}.{} WHERE id IN (SELECT id FROM {}.{} ORDER BY seq DESC OFFSET $1)",
+            q_schema, q_table, q_schema, q_table
+        );
+        let client = self.client().await?;
+        client
+            .execute(&annotate_sql(&sql), &[&max_docs])
+            .instrument(sql_span(&sql))
+            .await
+            .map_err(err_msg)?;
+        Ok(())
+    }
+
+    /// Insert with a specific client (for transaction support)
+    pub async fn insert_one_with_client(
+        &self,
+        client: &tokio_postgres::Client,
+        db: &str,
+        coll: &str,
+        id: &[u8],
+        bson_bytes: &[u8],
+        json: &serde_json::Value,
+    ) -> Result<u64> {
+        self.ensure_collection(db, coll).await?;
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         let sql = format!(
             "INSERT INTO {}.{} (id, doc_bson, doc) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING",
             q_schema, q_table
         );
         let t = Instant::now();
         let n = client
-            .execute(&sql, &[&id, &bson_bytes, &json])
+            .execute(&annotate_sql(&sql), &[&id, &bson_bytes, &json])
+            .instrument(sql_span(&sql))
             .await
             .map_err(err_msg)?;
         tracing::debug!(op="insert_one_with_client", db=%db, coll=%coll, elapsed_ms=?t.elapsed().as_millis());
@@ -234,16 +1326,20 @@ impl PgStore {
         coll: &str,
         limit: i64,
     ) -> Result<Vec<bson::Document>> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         let sql = format!(
             "SELECT doc_bson, doc FROM {}.{} ORDER BY id ASC LIMIT $1",
             q_schema, q_table
         );
         let t = Instant::now();
-        let client = self.pool.get().await.map_err(err_msg)?;
-        let rows = match client.query(&sql, &[&limit]).await {
+        let client = self.client().await?;
+        let rows = match client
+            .query(&annotate_sql(&sql), &[&limit])
+            .instrument(sql_span(&sql))
+            .await
+        {
             Ok(r) => r,
             Err(e) => {
                 let msg = e.to_string();
@@ -277,16 +1373,14 @@ impl PgStore {
         id: &[u8],
         limit: i64,
     ) -> Result<Vec<bson::Document>> {
-        let schema = schema_name(db);
-        let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let sql = format!(
-            "SELECT doc_bson, doc FROM {}.{} WHERE id = $1 LIMIT $2",
-            q_schema, q_table
-        );
+        let sql = self.find_by_id_statement(db, coll);
         let t = Instant::now();
-        let client = self.pool.get().await.map_err(err_msg)?;
-        let rows = match client.query(&sql, &[&id, &limit]).await {
+        let client = self.client().await?;
+        let rows = match client
+            .query(&annotate_sql(&sql), &[&id, &limit])
+            .instrument(sql_span(&sql))
+            .await
+        {
             Ok(r) => r,
             Err(e) => {
                 let msg = e.to_string();
@@ -322,15 +1416,19 @@ impl PgStore {
         id: &[u8],
         limit: i64,
     ) -> Result<Vec<bson::Document>> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         let sql = format!(
             "SELECT doc_bson, doc FROM {}.{} WHERE id = $1 LIMIT $2",
             q_schema, q_table
         );
         let t = Instant::now();
-        let rows = match client.query(&sql, &[&id, &limit]).await {
+        let rows = match client
+            .query(&annotate_sql(&sql), &[&id, &limit])
+            .instrument(sql_span(&sql))
+            .await
+        {
             Ok(r) => r,
             Err(e) => {
                 let msg = e.to_string();
@@ -366,9 +1464,9 @@ impl PgStore {
         filter: &bson::Document,
         limit: i64,
     ) -> Result<Vec<bson::Document>> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
 
         let mut where_clauses: Vec<String> = Vec::new();
 
@@ -387,21 +1485,22 @@ impl PgStore {
                                     && let Some(pred) = build_elem_match_pred(&path, em)
                                 {
                                     let jsonpath = format!("{}[*] ? ({})", path, pred);
-                                    where_clauses.push(format!(
-                                        "jsonb_path_exists(doc, '{}')",
-                                        escape_single(&jsonpath)
-                                    ));
+                                    where_clauses.push(jsonpath_exists(&jsonpath));
                                 }
                             }
+                            "$type" => {
+                                // An unknown type name matches nothing
+                                where_clauses.push(
+                                    crate::bson_type::sql_predicate(k, val)
+                                        .unwrap_or_else(|| "FALSE".to_string()),
+                                );
+                            }
                             "$exists" => {
                                 let exists = matches!(val, bson::Bson::Boolean(true));
                                 let clause = if exists {
-                                    format!("jsonb_path_exists(doc, '{}')", escape_single(&path))
+                                    jsonpath_exists(&path)
                                 } else {
-                                    format!(
-                                        "NOT jsonb_path_exists(doc, '{}')",
-                                        escape_single(&path)
-                                    )
+                                    format!("NOT {}", jsonpath_exists(&path))
                                 };
                                 where_clauses.push(clause);
                             }
@@ -417,16 +1516,14 @@ impl PgStore {
                                         where_clauses.push("FALSE".to_string());
                                     } else {
                                         let predicate = preds.join(" || ");
-                                        let p1 = format!(
-                                            "jsonb_path_exists(doc, '{} ? ({} )')",
-                                            escape_single(&path),
-                                            predicate
-                                        );
-                                        let p2 = format!(
-                                            "jsonb_path_exists(doc, '{}[*] ? ({} )')",
-                                            escape_single(&path),
-                                            predicate
-                                        );
+                                        let p1 = jsonpath_exists(&format!(
+                                            "{} ? ({} )",
+                                            path, predicate
+                                        ));
+                                        let p2 = jsonpath_exists(&format!(
+                                            "{}[*] ? ({} )",
+                                            path, predicate
+                                        ));
                                         where_clauses.push(format!("({} OR {})", p1, p2));
                                     }
                                 }
@@ -440,33 +1537,23 @@ impl PgStore {
                                     _ => unreachable!(),
                                 };
                                 if let Some(lit) = json_literal_from_bson(val) {
-                                    let p1 = format!(
-                                        "jsonb_path_exists(doc, '{} ? (@ {} {} )')",
-                                        escape_single(&path),
-                                        op_sql,
-                                        lit
-                                    );
-                                    let p2 = format!(
-                                        "jsonb_path_exists(doc, '{}[*] ? (@ {} {} )')",
-                                        escape_single(&path),
-                                        op_sql,
-                                        lit
-                                    );
+                                    let p1 = jsonpath_exists(&format!(
+                                        "{} ? (@ {} {} )",
+                                        path, op_sql, lit
+                                    ));
+                                    let p2 = jsonpath_exists(&format!(
+                                        "{}[*] ? (@ {} {} )",
+                                        path, op_sql, lit
+                                    ));
                                     where_clauses.push(format!("({} OR {})", p1, p2));
                                 }
                             }
                             "$eq" => {
                                 if let Some(lit) = json_literal_from_bson(val) {
-                                    let p1 = format!(
-                                        "jsonb_path_exists(doc, '{} ? (@ == {} )')",
-                                        escape_single(&path),
-                                        lit
-                                    );
-                                    let p2 = format!(
-                                        "jsonb_path_exists(doc, '{}[*] ? (@ == {} )')",
-                                        escape_single(&path),
-                                        lit
-                                    );
+                                    let p1 =
+                                        jsonpath_exists(&format!("{} ? (@ == {} )", path, lit));
+                                    let p2 =
+                                        jsonpath_exists(&format!("{}[*] ? (@ == {} )", path, lit));
                                     where_clauses.push(format!("({} OR {})", p1, p2));
                                 }
                             }
@@ -476,16 +1563,8 @@ impl PgStore {
                 }
                 _ => {
                     if let Some(lit) = json_literal_from_bson(v) {
-                        let p1 = format!(
-                            "jsonb_path_exists(doc, '{} ? (@ == {} )')",
-                            escape_single(&path),
-                            lit
-                        );
-                        let p2 = format!(
-                            "jsonb_path_exists(doc, '{}[*] ? (@ == {} )')",
-                            escape_single(&path),
-                            lit
-                        );
+                        let p1 = jsonpath_exists(&format!("{} ? (@ == {} )", path, lit));
+                        let p2 = jsonpath_exists(&format!("{}[*] ? (@ == {} )", path, lit));
                         where_clauses.push(format!("({} OR {})", p1, p2));
                     }
                 }
@@ -493,13 +1572,17 @@ impl PgStore {
         }
 
         let t = Instant::now();
-        let client = self.pool.get().await.map_err(err_msg)?;
-        let where_sql = build_where_from_filter(filter);
-        let sql = format!(
-            "SELECT doc_bson, doc FROM {}.{} WHERE {} ORDER BY id ASC LIMIT {}",
-            q_schema, q_table, where_sql, limit
-        );
-        let rows = client.query(&sql, &[]).await.map_err(err_msg)?;
+        let client = self.client().await?;
+        let stmt = bind_sql(0, || {
+            format!(
+                "SELECT doc_bson, doc FROM {}.{} WHERE {} ORDER BY id ASC LIMIT {}",
+                q_schema,
+                q_table,
+                build_where_from_filter(filter),
+                limit
+            )
+        });
+        let rows = query_bound(&**client, &stmt, &[]).await.map_err(err_msg)?;
         let mut out = Vec::with_capacity(rows.len());
         for r in rows {
             let bson_bytes: Option<Vec<u8>> = r.try_get(0).ok();
@@ -526,6 +1609,22 @@ impl PgStore {
         sort: Option<&bson::Document>,
         projection: Option<&bson::Document>,
         limit: i64,
+    ) -> Result<Vec<bson::Document>> {
+        self.find_docs_collated(db, coll, filter, sort, projection, limit, None)
+            .await
+    }
+
+    /// [`PgStore::find_docs`] comparing and ordering strings under `collation`.
+    #[allow(clippy::too_many_arguments)]
+    pub async fn find_docs_collated(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        projection: Option<&bson::Document>,
+        limit: i64,
+        collation: Option<&Collation>,
     ) -> Result<Vec<bson::Document>> {
         // Check for $text operator - should be handled by server layer
         if let Some(f) = filter
@@ -536,31 +1635,13 @@ impl PgStore {
             ));
         }
 
-        let schema = schema_name(db);
-        let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let where_sql = filter.map(build_where_from_filter);
-        let order_sql = build_order_by(sort);
-
-        if let Some(proj_sql) = projection_pushdown_sql(projection) {
+        let stmt = bind_sql(0, || {
+            self.find_sql(db, coll, filter, sort, projection, limit, collation)
+        });
+        if projection_pushdown_sql(projection).is_some() {
             let t = Instant::now();
-            let client = self.pool.get().await.map_err(err_msg)?;
-            let res = match &where_sql {
-                Some(where_clause) => {
-                    let sql = format!(
-                        "SELECT {} AS doc FROM {}.{} WHERE {} {} LIMIT {}",
-                        proj_sql, q_schema, q_table, where_clause, order_sql, limit
-                    );
-                    client.query(&sql, &[]).await
-                }
-                None => {
-                    let sql = format!(
-                        "SELECT {} AS doc FROM {}.{} WHERE TRUE {} LIMIT {}",
-                        proj_sql, q_schema, q_table, order_sql, limit
-                    );
-                    client.query(&sql, &[]).await
-                }
-            };
+            let mut client = self.client().await?;
+            let res = self.query_planned(&mut client, &stmt).await;
             let rows = match res {
                 Ok(r) => r,
                 Err(e) => {
@@ -581,23 +1662,8 @@ impl PgStore {
             Ok(out)
         } else {
             let t = Instant::now();
-            let client = self.pool.get().await.map_err(err_msg)?;
-            let res = match &where_sql {
-                Some(where_clause) => {
-                    let sql = format!(
-                        "SELECT doc_bson, doc FROM {}.{} WHERE {} {} LIMIT {}",
-                        q_schema, q_table, where_clause, order_sql, limit
-                    );
-                    client.query(&sql, &[]).await
-                }
-                None => {
-                    let sql = format!(
-                        "SELECT doc_bson, doc FROM {}.{} WHERE TRUE {} LIMIT {}",
-                        q_schema, q_table, order_sql, limit
-                    );
-                    client.query(&sql, &[]).await
-                }
-            };
+            let mut client = self.client().await?;
+            let res = self.query_planned(&mut client, &stmt).await;
             let rows = match res {
                 Ok(r) => r,
                 Err(e) => {
@@ -634,6 +1700,548 @@ impl PgStore {
         }
     }
 
+    /// The `SELECT` [`PgStore::find_docs_collated`] runs: the whole document, or only the
+    /// projected fields when the projection can be computed in SQL.
+    #[allow(clippy::too_many_arguments)]
+    fn find_sql(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        projection: Option<&bson::Document>,
+        limit: i64,
+        collation: Option<&Collation>,
+    ) -> String {
+        let columns = match projection_pushdown_sql(projection) {
+            Some(proj_sql) => format!("{} AS doc", proj_sql),
+            None => "doc_bson, doc".to_string(),
+        };
+        let where_sql = filter
+            .map(|f| build_where_from_filter_collated(f, collation))
+            .unwrap_or_else(|| "TRUE".to_string());
+        format!(
+            "SELECT {} FROM {}.{} WHERE {} {} LIMIT {}",
+            columns,
+            q_ident(&self.mapping.schema(db)),
+            q_ident(&self.mapping.table(db, coll)),
+            where_sql,
+            build_order_by_collated(sort, collation),
+            limit
+        )
+    }
+
+    /// The `SELECT doc_bson, doc` with this filter, order, `OFFSET` and `LIMIT` that
+    /// [`PgStore::open_doc_cursor`] declares a cursor for and `explain` plans.
+    #[allow(clippy::too_many_arguments)]
+    fn doc_query_sql(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        skip: i64,
+        limit: Option<i64>,
+        collation: Option<&Collation>,
+    ) -> String {
+        let where_sql = filter
+            .map(|f| build_where_from_filter_collated(f, collation))
+            .unwrap_or_else(|| "TRUE".to_string());
+        let mut sql = format!(
+            "SELECT doc_bson, doc FROM {}.{} WHERE {} {}",
+            q_ident(&self.mapping.schema(db)),
+            q_ident(&self.mapping.table(db, coll)),
+            where_sql,
+            build_order_by_collated(sort, collation)
+        );
+        if let Some(n) = limit {
+            sql.push_str(&format!(" LIMIT {}", n));
+        }
+        if skip > 0 {
+            sql.push_str(&format!(" OFFSET {}", skip));
+        }
+        sql
+    }
+
+    /// The statement [`PgStore::find_docs_collated`] sends for this query, with the literal
+    /// values it binds as parameters.
+    #[allow(clippy::too_many_arguments)]
+    pub fn find_statement(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        projection: Option<&bson::Document>,
+        limit: i64,
+        collation: Option<&Collation>,
+    ) -> (String, Vec<String>) {
+        let stmt = bind_sql(0, || {
+            self.find_sql(db, coll, filter, sort, projection, limit, collation)
+        });
+        (stmt.sql, stmt.params)
+    }
+
+    /// The statement [`PgStore::open_doc_cursor`] sends for this query, with the literal
+    /// values it binds as parameters.
+    #[allow(clippy::too_many_arguments)]
+    pub fn doc_cursor_statement(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        skip: i64,
+        limit: Option<i64>,
+        collation: Option<&Collation>,
+    ) -> (String, Vec<String>) {
+        let stmt = self.doc_cursor_sql(db, coll, filter, sort, skip, limit, collation);
+        (stmt.sql, stmt.params)
+    }
+
+    /// The bound `DECLARE` for [`PgStore::open_doc_cursor`].
+    #[allow(clippy::too_many_arguments)]
+    fn doc_cursor_sql(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        skip: i64,
+        limit: Option<i64>,
+        collation: Option<&Collation>,
+    ) -> BoundSql {
+        bind_sql(0, || {
+            format!(
+                "DECLARE {} NO SCROLL CURSOR FOR {}",
+                DOC_CURSOR_NAME,
+                self.doc_query_sql(db, coll, filter, sort, skip, limit, collation)
+            )
+        })
+    }
+
+    /// The statement [`PgStore::find_by_id_docs`] sends; it binds the id's bytes and the
+    /// limit.
+    pub fn find_by_id_statement(&self, db: &str, coll: &str) -> String {
+        format!(
+            "SELECT doc_bson, doc FROM {}.{} WHERE id = $1 LIMIT $2",
+            q_ident(&self.mapping.schema(db)),
+            q_ident(&self.mapping.table(db, coll))
+        )
+    }
+
+    /// Open a [`DocCursor`] over the documents of `db.coll` matching `filter`, ordered by
+    /// `sort`, skipping the first `skip` and stopping after `limit` when given. A missing
+    /// collection yields an already exhausted cursor.
+    #[allow(clippy::too_many_arguments)]
+    pub async fn open_doc_cursor(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        skip: i64,
+        limit: Option<i64>,
+        collation: Option<&Collation>,
+    ) -> Result<DocCursor> {
+        let stmt = self.doc_cursor_sql(db, coll, filter, sort, skip, limit, collation);
+
+        let client = self.pool.get().await.map_err(err_msg)?;
+        client
+            .batch_execute("BEGIN READ ONLY")
+            .await
+            .map_err(err_msg)?;
+        if let Err(e) = execute_bound(&**client, &stmt, &[]).await {
+            client.batch_execute("ROLLBACK").await.map_err(err_msg)?;
+            if e.to_string().contains("does not exist") {
+                return Ok(DocCursor { client: None });
+            }
+            return Err(err_msg(e));
+        }
+        Ok(DocCursor {
+            client: Some(client),
+        })
+    }
+
+    /// Documents of several collections of `db` in one `UNION ALL` query, each branch with
+    /// its own optional filter. Results keep branch order: every document of the first
+    /// collection comes before those of the second, and so on. Missing collections
+    /// contribute nothing.
+    pub async fn union_all_docs(
+        &self,
+        db: &str,
+        branches: &[(&str, Option<&bson::Document>)],
+        limit: i64,
+        collation: Option<&Collation>,
+    ) -> Result<Vec<bson::Document>> {
+        let t = Instant::now();
+        let client = self.client().await?;
+        let mut present = Vec::with_capacity(branches.len());
+        for (i, (coll, filter)) in branches.iter().enumerate() {
+            let table = self.mapping.qualified_table(db, coll);
+            let exists: bool = client
+                .query_one("SELECT to_regclass($1) IS NOT NULL", &[&table])
+                .await
+                .map_err(err_msg)?
+                .get(0);
+            if exists {
+                present.push((i, table, *filter));
+            }
+        }
+        if present.is_empty() {
+            return Ok(Vec::new());
+        }
+        let stmt = bind_sql(0, || {
+            let selects: Vec<String> = present
+                .iter()
+                .map(|(i, table, filter)| {
+                    let where_sql = filter
+                        .map(|f| build_where_from_filter_collated(f, collation))
+                        .unwrap_or_else(|| "TRUE".to_string());
+                    format!(
+                        "SELECT {} AS branch, doc_bson, doc FROM {} WHERE {}",
+                        i, table, where_sql
+                    )
+                })
+                .collect();
+            format!(
+                "SELECT doc_bson, doc FROM ({}) AS u ORDER BY branch LIMIT {}",
+                selects.join(" UNION ALL "),
+                limit
+            )
+        });
+        let rows = self.query_cached(&client, &stmt).await.map_err(err_msg)?;
+        let mut out = Vec::with_capacity(rows.len());
+        for r in rows {
+            let bson_bytes: Option<Vec<u8>> = r.try_get(0).ok();
+            if let Some(bytes) = bson_bytes
+                && let Ok(doc) = bson::Document::from_reader(&mut std::io::Cursor::new(bytes))
+            {
+                out.push(doc);
+                continue;
+            }
+            let json: serde_json::Value = r.get(1);
+            out.push(to_doc_from_json(json));
+        }
+        tracing::debug!(op="union_all_docs", db=%db, branches=branches.len(), elapsed_ms=?t.elapsed().as_millis());
+        Ok(out)
+    }
+
+    /// PostgreSQL's `EXPLAIN (FORMAT JSON)` plan for the query `find_docs_collated` would run,
+    /// in as much detail as `verbosity` asks for.
+    #[allow(clippy::too_many_arguments)]
+    pub async fn explain_find(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        limit: i64,
+        collation: Option<&Collation>,
+        verbosity: ExplainVerbosity,
+    ) -> Result<serde_json::Value> {
+        let limit = (limit > 0).then_some(limit);
+        self.explain_docs(db, coll, filter, sort, 0, limit, collation, verbosity)
+            .await
+    }
+
+    /// `EXPLAIN (FORMAT JSON)` of the document query with this filter, order, `OFFSET` and
+    /// `LIMIT`, as `open_doc_cursor` declares it. Past `queryPlanner` verbosity the statement
+    /// runs, so the plan carries actual row counts and timings.
+    #[allow(clippy::too_many_arguments)]
+    pub async fn explain_docs(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        skip: i64,
+        limit: Option<i64>,
+        collation: Option<&Collation>,
+        verbosity: ExplainVerbosity,
+    ) -> Result<serde_json::Value> {
+        let stmt = self.explain_sql(db, coll, filter, sort, skip, limit, collation, verbosity);
+        let mut client = self.client().await?;
+        let rows = if index_hinted() {
+            query_hinted(&mut client, &stmt).await
+        } else {
+            query_bound(&**client, &stmt, &[]).await
+        }
+        .map_err(err_msg)?;
+        rows.first()
+            .map(|r| r.get(0))
+            .ok_or_else(|| Error::Msg("EXPLAIN returned no plan".into()))
+    }
+
+    /// How many rows PostgreSQL expects the document query with this filter and order to
+    /// read, from its plan: the whole table (as the planner estimates its size) for a
+    /// sequential scan, the rows an index returns otherwise.
+    pub async fn estimate_docs_examined(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        collation: Option<&Collation>,
+    ) -> Result<f64> {
+        fn scanned(node: &serde_json::Value, table_rows: f64) -> f64 {
+            let own = match node.get("Node Type").and_then(|v| v.as_str()) {
+                Some("Seq Scan") => table_rows,
+                Some(_) if node.get("Relation Name").is_some() => node
+                    .get("Plan Rows")
+                    .and_then(|v| v.as_f64())
+                    .unwrap_or(0.0),
+                _ => 0.0,
+            };
+            let children = node
+                .get("Plans")
+                .and_then(|v| v.as_array())
+                .map_or(0.0, |plans| {
+                    plans.iter().map(|p| scanned(p, table_rows)).sum()
+                });
+            own + children
+        }
+        let plan = self
+            .explain_docs(
+                db,
+                coll,
+                filter,
+                sort,
+                0,
+                None,
+                collation,
+                ExplainVerbosity::QueryPlanner,
+            )
+            .await?;
+        let root = plan.get(0).and_then(|t| t.get("Plan"));
+        let seq_scan = plan.to_string().contains("\"Seq Scan\"");
+        let table_rows = if seq_scan {
+            let whole = self
+                .explain_docs(
+                    db,
+                    coll,
+                    None,
+                    None,
+                    0,
+                    None,
+                    None,
+                    ExplainVerbosity::QueryPlanner,
+                )
+                .await?;
+            whole
+                .get(0)
+                .and_then(|t| t.get("Plan"))
+                .and_then(|p| p.get("Plan Rows"))
+                .and_then(|v| v.as_f64())
+                .unwrap_or(0.0)
+        } else {
+            0.0
+        };
+        Ok(root.map_or(0.0, |r| scanned(r, table_rows)))
+    }
+
+    /// [`PgStore::explain_find`] at `allPlansExecution` verbosity with planner strategies
+    /// switched off for the statement (`settings` such as `enable_seqscan = off`), which runs
+    /// the plan PostgreSQL would have picked without them. The transaction setting them is
+    /// rolled back. A dry run's statements share its transaction, so there the plan is
+    /// explained with the strategies left on.
+    #[allow(clippy::too_many_arguments)]
+    pub async fn explain_find_without(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        limit: i64,
+        collation: Option<&Collation>,
+        settings: &[&str],
+    ) -> Result<serde_json::Value> {
+        let limit = (limit > 0).then_some(limit);
+        let stmt = self.explain_sql(
+            db,
+            coll,
+            filter,
+            sort,
+            0,
+            limit,
+            collation,
+            ExplainVerbosity::AllPlansExecution,
+        );
+        let mut client = self.client().await?;
+        let rows = if dry_run_active() {
+            query_bound(&**client, &stmt, &[]).await.map_err(err_msg)?
+        } else {
+            let tx = client.transaction().await.map_err(err_msg)?;
+            for setting in settings {
+                tx.batch_execute(&format!("SET LOCAL {}", setting))
+                    .await
+                    .map_err(err_msg)?;
+            }
+            let rows = query_bound(&*tx, &stmt, &[]).await.map_err(err_msg)?;
+            tx.rollback().await.map_err(err_msg)?;
+            rows
+        };
+        rows.first()
+            .map(|r| r.get(0))
+            .ok_or_else(|| Error::Msg("EXPLAIN returned no plan".into()))
+    }
+
+    #[allow(clippy::too_many_arguments)]
+    fn explain_sql(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        skip: i64,
+        limit: Option<i64>,
+        collation: Option<&Collation>,
+        verbosity: ExplainVerbosity,
+    ) -> BoundSql {
+        bind_sql(0, || {
+            format!(
+                "EXPLAIN ({}) {}",
+                verbosity.explain_options(),
+                self.doc_query_sql(db, coll, filter, sort, skip, limit, collation)
+            )
+        })
+    }
+
+    /// [`PgStore::query_cached`], or [`query_hinted`] for a statement carrying an index hint.
+    async fn query_planned(
+        &self,
+        client: &mut deadpool_postgres::ClientWrapper,
+        stmt: &BoundSql,
+    ) -> std::result::Result<Vec<tokio_postgres::Row>, tokio_postgres::Error> {
+        if index_hinted() {
+            query_hinted(client, stmt).await
+        } else {
+            self.query_cached(client, stmt).await
+        }
+    }
+
+    /// Run a generated query through the statement cache: its shape, the statement text
+    /// with every value bound, is prepared once per pooled connection, without the
+    /// command's `comment`. Runs unprepared, still bound, when caching is disabled or the
+    /// shape cannot be prepared.
+    async fn query_cached(
+        &self,
+        client: &deadpool_postgres::ClientWrapper,
+        stmt: &BoundSql,
+    ) -> std::result::Result<Vec<tokio_postgres::Row>, tokio_postgres::Error> {
+        let shape = &stmt.sql;
+        if self.stmt_cache.lookup(shape).is_some() {
+            // Each connection keeps its own statements; bound them by the shape capacity
+            if client.statement_cache.size() > self.stmt_cache.capacity() {
+                client.statement_cache.clear();
+            }
+            // Prepared without the command's comment: the statement text is the key of each
+            // connection's cache, so a comment per command would prepare every query anew
+            note_sql(shape);
+            match client
+                .prepare_typed_cached(shape, &param_types(&[], stmt))
+                .await
+            {
+                Ok(prepared) => {
+                    match client
+                        .query(&prepared, &bound_args(&[], stmt))
+                        .instrument(sql_span(shape))
+                        .await
+                    {
+                        // Client-side bind failure: a parameter type we can't encode
+                        Err(e) if e.as_db_error().is_none() => {
+                            self.stmt_cache.mark_unpreparable(shape)
+                        }
+                        res => return res,
+                    }
+                }
+                Err(e) => {
+                    // A missing table is the caller's concern, not the shape's
+                    if e.code().is_some_and(|c| {
+                        *c == tokio_postgres::error::SqlState::UNDEFINED_TABLE
+                            || *c == tokio_postgres::error::SqlState::INVALID_SCHEMA_NAME
+                    }) {
+                        return Err(e);
+                    }
+                    tracing::debug!(error = %e, "query shape not preparable; running unprepared");
+                    self.stmt_cache.mark_unpreparable(shape);
+                }
+            }
+        }
+        let pg: &tokio_postgres::Client = client;
+        query_bound(pg, stmt, &[]).await
+    }
+
+    /// Documents matching `filter` whose `id` sorts after `after_id`, in `id` (i.e. ObjectId
+    /// insertion) order. Backs tailable cursors.
+    pub async fn find_docs_after_id(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        after_id: Option<&[u8]>,
+        limit: i64,
+    ) -> Result<Vec<bson::Document>> {
+        let q_schema = q_ident(&self.mapping.schema(db));
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let where_sql = || {
+            filter
+                .map(build_where_from_filter)
+                .unwrap_or_else(|| "TRUE".to_string())
+        };
+        let t = Instant::now();
+        let client = self.client().await?;
+        let res = match after_id {
+            Some(id) => {
+                let stmt = bind_sql(1, || {
+                    format!(
+                        "SELECT doc_bson, doc FROM {}.{} WHERE {} AND id > $1 ORDER BY id LIMIT {}",
+                        q_schema,
+                        q_table,
+                        where_sql(),
+                        limit
+                    )
+                });
+                query_bound(&**client, &stmt, &[(&id, Type::BYTEA)]).await
+            }
+            None => {
+                let stmt = bind_sql(0, || {
+                    format!(
+                        "SELECT doc_bson, doc FROM {}.{} WHERE {} ORDER BY id LIMIT {}",
+                        q_schema,
+                        q_table,
+                        where_sql(),
+                        limit
+                    )
+                });
+                query_bound(&**client, &stmt, &[]).await
+            }
+        };
+        let rows = match res {
+            Ok(r) => r,
+            Err(e) => {
+                if e.to_string().contains("does not exist") {
+                    return Ok(Vec::new());
+                }
+                return Err(err_msg(e));
+            }
+        };
+        let mut out = Vec::with_capacity(rows.len());
+        for r in rows {
+            let bson_bytes: Option<Vec<u8>> = r.try_get(0).ok();
+            if let Some(bytes) = bson_bytes
+                && let Ok(doc) = bson::Document::from_reader(&mut std::io::Cursor::new(bytes))
+            {
+                out.push(doc);
+                continue;
+            }
+            let json: serde_json::Value = r.get(1);
+            out.push(to_doc_from_json(json));
+        }
+        tracing::debug!(op="find_docs_after_id", db=%db, coll=%coll, elapsed_ms=?t.elapsed().as_millis());
+        Ok(out)
+    }
+
     /// Find with a specific client (for transaction support)
     #[allow(clippy::too_many_arguments)]
     pub async fn find_docs_with_client(
@@ -646,30 +2254,30 @@ impl PgStore {
         projection: Option<&bson::Document>,
         limit: i64,
     ) -> Result<Vec<bson::Document>> {
-        let schema = schema_name(db);
-        let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let where_sql = filter.map(build_where_from_filter);
-        let order_sql = build_order_by(sort);
+        self.find_docs_with_client_collated(client, db, coll, filter, sort, projection, limit, None)
+            .await
+    }
 
-        if let Some(proj_sql) = projection_pushdown_sql(projection) {
-            let t = Instant::now();
-            let res = match &where_sql {
-                Some(where_clause) => {
-                    let sql = format!(
-                        "SELECT {} AS doc FROM {}.{} WHERE {} {} LIMIT {}",
-                        proj_sql, q_schema, q_table, where_clause, order_sql, limit
-                    );
-                    client.query(&sql, &[]).await
-                }
-                None => {
-                    let sql = format!(
-                        "SELECT {} AS doc FROM {}.{} WHERE TRUE {} LIMIT {}",
-                        proj_sql, q_schema, q_table, order_sql, limit
-                    );
-                    client.query(&sql, &[]).await
-                }
-            };
+    /// [`PgStore::find_docs_with_client`] comparing and ordering strings under `collation`.
+    #[allow(clippy::too_many_arguments)]
+    pub async fn find_docs_with_client_collated(
+        &self,
+        client: &tokio_postgres::Client,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        sort: Option<&bson::Document>,
+        projection: Option<&bson::Document>,
+        limit: i64,
+        collation: Option<&Collation>,
+    ) -> Result<Vec<bson::Document>> {
+        let stmt = bind_sql(0, || {
+            self.find_sql(db, coll, filter, sort, projection, limit, collation)
+        });
+
+        if projection_pushdown_sql(projection).is_some() {
+            let t = Instant::now();
+            let res = query_bound(client, &stmt, &[]).await;
             let rows = match res {
                 Ok(r) => r,
                 Err(e) => {
@@ -689,22 +2297,7 @@ impl PgStore {
             Ok(out)
         } else {
             let t = Instant::now();
-            let res = match &where_sql {
-                Some(where_clause) => {
-                    let sql = format!(
-                        "SELECT doc_bson, doc FROM {}.{} WHERE {} {} LIMIT {}",
-                        q_schema, q_table, where_clause, order_sql, limit
-                    );
-                    client.query(&sql, &[]).await
-                }
-                None => {
-                    let sql = format!(
-                        "SELECT doc_bson, doc FROM {}.{} WHERE TRUE {} LIMIT {}",
-                        q_schema, q_table, order_sql, limit
-                    );
-                    client.query(&sql, &[]).await
-                }
-            };
+            let res = query_bound(client, &stmt, &[]).await;
             let rows = match res {
                 Ok(r) => r,
                 Err(e) => {
@@ -748,17 +2341,18 @@ impl PgStore {
         subdoc: &serde_json::Value,
         limit: i64,
     ) -> Result<Vec<bson::Document>> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         let sql = format!(
             "SELECT doc_bson, doc FROM {}.{} WHERE doc @> $1::jsonb ORDER BY id ASC LIMIT $2",
             q_schema, q_table
         );
         let t = Instant::now();
-        let client = self.pool.get().await.map_err(err_msg)?;
+        let client = self.client().await?;
         let rows = client
-            .query(&sql, &[&subdoc, &limit])
+            .query(&annotate_sql(&sql), &[&subdoc, &limit])
+            .instrument(sql_span(&sql))
             .await
             .map_err(err_msg)?;
         let mut out = Vec::with_capacity(rows.len());
@@ -783,6 +2377,21 @@ impl PgStore {
     }
 
     pub async fn create_index_single_field(
+        &self,
+        db: &str,
+        coll: &str,
+        name: &str,
+        field: &str,
+        order: i32,
+        spec: &serde_json::Value,
+    ) -> Result<()> {
+        self.create_index_single_field_collated(db, coll, name, field, order, spec, None)
+            .await
+    }
+
+    /// Single-field index whose expression matches the comparisons made under `collation`.
+    #[allow(clippy::too_many_arguments)]
+    pub async fn create_index_single_field_collated(
         &self,
         db: &str,
         coll: &str,
@@ -790,24 +2399,33 @@ impl PgStore {
         field: &str,
         _order: i32,
         spec: &serde_json::Value,
+        collation: Option<&Collation>,
     ) -> Result<()> {
         // Ensure collection (schema/table) exists
         self.ensure_collection(db, coll).await?;
         // Create an expression index on the extracted text value
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let q_idx = q_ident(name);
-        let field_escaped = field.replace('"', "\"\"");
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let q_idx = q_ident(&self.mapping.index(db, coll, name));
         // Expression index requires parentheses around the expression inside the list parentheses
         // e.g., USING btree ((doc->>'field'))
-        let expr = format!("((doc->>'{}'))", field_escaped);
+        let expr = if index_is_unique(spec) {
+            format!("({})", unique_index_elem(field, collation))
+        } else {
+            format!("({})", index_elem(field, collation))
+        };
         let t = Instant::now();
         let ddl = format!(
-            "CREATE INDEX IF NOT EXISTS {} ON {}.{} USING btree {}",
-            q_idx, q_schema, q_table, expr
+            "CREATE {}INDEX IF NOT EXISTS {} ON {}.{} USING btree {}{}",
+            if index_is_unique(spec) { "UNIQUE " } else { "" },
+            q_idx,
+            q_schema,
+            q_table,
+            expr,
+            partial_index_clause(spec, collation)
         );
-        let client = self.pool.get().await.map_err(err_msg)?;
+        let client = self.client().await?;
         client.batch_execute(&ddl).await.map_err(err_msg)?;
         // Persist metadata
         client
@@ -822,12 +2440,37 @@ impl PgStore {
     }
 
     pub async fn drop_index(&self, db: &str, coll: &str, name: &str) -> Result<bool> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_idx = q_ident(name);
+        let q_idx = q_ident(&self.mapping.index(db, coll, name));
         let ddl = format!("DROP INDEX IF EXISTS {}.{}", q_schema, q_idx);
-        let client = self.pool.get().await.map_err(err_msg)?;
+        let client = self.client().await?;
         client.batch_execute(&ddl).await.map_err(err_msg)?;
+        // A 2dsphere index comes with companion indexes of its own
+        let geo = client
+            .query_opt(
+                "SELECT 1 FROM mdb_meta.indexes, jsonb_each_text(spec->'key') AS k \
+                 WHERE db=$1 AND coll=$2 AND name=$3 AND k.value = '2dsphere'",
+                &[&db, &coll, &name],
+            )
+            .await
+            .map_err(err_msg)?;
+        if geo.is_some() {
+            for suffix in ["geo", "gist"] {
+                let q_companion = q_ident(&self.mapping.index(
+                    db,
+                    coll,
+                    &format!("{}_{}", name, suffix),
+                ));
+                client
+                    .batch_execute(&format!(
+                        "DROP INDEX IF EXISTS {}.{}",
+                        q_schema, q_companion
+                    ))
+                    .await
+                    .map_err(err_msg)?;
+            }
+        }
         let n = client
             .execute(
                 "DELETE FROM mdb_meta.indexes WHERE db=$1 AND coll=$2 AND name=$3",
@@ -838,8 +2481,50 @@ impl PgStore {
         Ok(n > 0)
     }
 
+    /// Rebuild every PostgreSQL index on a collection's backing table (primary key, the
+    /// document GIN index and all user-created indexes), returning the rebuilt index names.
+    ///
+    /// On PostgreSQL 12+ each index is rebuilt with `REINDEX INDEX CONCURRENTLY`, which does not
+    /// block reads or writes; older servers fall back to a plain, locking `REINDEX INDEX`.
+    pub async fn reindex_collection(&self, db: &str, coll: &str) -> Result<Vec<String>> {
+        let schema = self.mapping.schema(db);
+        let q_schema = q_ident(&schema);
+        let t = Instant::now();
+        let client = self.client().await?;
+        let version: i32 = client
+            .query_one("SELECT current_setting('server_version_num')::int", &[])
+            .await
+            .map_err(err_msg)?
+            .get(0);
+        let concurrently = if version >= 120000 {
+            " CONCURRENTLY"
+        } else {
+            ""
+        };
+        let rows = client
+            .query(
+                "SELECT indexname FROM pg_indexes WHERE schemaname = $1 AND tablename = $2 ORDER BY indexname",
+                &[&schema, &self.mapping.table(db, coll)],
+            )
+            .await
+            .map_err(err_msg)?;
+        let names: Vec<String> = rows.into_iter().map(|r| r.get::<_, String>(0)).collect();
+        // One statement per index: CONCURRENTLY cannot run inside a multi-statement batch
+        for name in &names {
+            let ddl = format!(
+                "REINDEX INDEX{} {}.{}",
+                concurrently,
+                q_schema,
+                q_ident(name)
+            );
+            client.batch_execute(&ddl).await.map_err(err_msg)?;
+        }
+        tracing::debug!(op="reindex_collection", db=%db, coll=%coll, indexes=%names.len(), concurrent=%!concurrently.is_empty(), elapsed_ms=?t.elapsed().as_millis());
+        Ok(names)
+    }
+
     pub async fn list_index_names(&self, db: &str, coll: &str) -> Result<Vec<String>> {
-        let client = self.pool.get().await.map_err(err_msg)?;
+        let client = self.client().await?;
         let rows = client
             .query(
                 "SELECT name FROM mdb_meta.indexes WHERE db=$1 AND coll=$2",
@@ -850,11 +2535,196 @@ impl PgStore {
         Ok(rows.into_iter().map(|r| r.get::<_, String>(0)).collect())
     }
 
+    /// Name of the index a `hint` selects on `db.coll`: an index name, or a key pattern
+    /// matched against the keys of the created indexes. `_id_` and `{_id: 1}` select the
+    /// primary key. `None` when no index matches.
+    pub async fn resolve_hint(
+        &self,
+        db: &str,
+        coll: &str,
+        hint: &bson::Bson,
+    ) -> Result<Option<String>> {
+        match hint {
+            bson::Bson::String(name) if name == "_id_" => return Ok(Some(name.clone())),
+            bson::Bson::Document(key) if key.len() == 1 && key.contains_key("_id") => {
+                return Ok(Some("_id_".to_string()));
+            }
+            _ => {}
+        }
+        let client = self.client().await?;
+        let rows = client
+            .query(
+                "SELECT name, spec FROM mdb_meta.indexes WHERE db=$1 AND coll=$2",
+                &[&db, &coll],
+            )
+            .await
+            .map_err(err_msg)?;
+        for r in rows {
+            let name: String = r.get(0);
+            let matched = match hint {
+                bson::Bson::String(hinted) => *hinted == name,
+                bson::Bson::Document(pattern) => {
+                    let spec: serde_json::Value = r.get(1);
+                    match json_to_bson(&spec) {
+                        bson::Bson::Document(spec) => spec
+                            .get_document("key")
+                            .is_ok_and(|key| key_patterns_equal(key, pattern)),
+                        _ => false,
+                    }
+                }
+                _ => false,
+            };
+            if matched {
+                return Ok(Some(name));
+            }
+        }
+        Ok(None)
+    }
+
+    /// Specs of the indexes on `db.coll` as `listIndexes` reports them: the primary key as
+    /// `_id_`, then each created index by name with the options it was created with. `None`
+    /// when the collection does not exist.
+    pub async fn list_indexes(&self, db: &str, coll: &str) -> Result<Option<Vec<bson::Document>>> {
+        let client = self.client().await?;
+        let exists = client
+            .query_opt(
+                "SELECT 1 FROM mdb_meta.collections WHERE db = $1 AND coll = $2",
+                &[&db, &coll],
+            )
+            .await
+            .map_err(err_msg)?;
+        if exists.is_none() {
+            return Ok(None);
+        }
+        let rows = client
+            .query(
+                "SELECT name, spec FROM mdb_meta.indexes WHERE db=$1 AND coll=$2 ORDER BY name",
+                &[&db, &coll],
+            )
+            .await
+            .map_err(err_msg)?;
+        let mut out = vec![bson::doc! {"v": 2, "key": {"_id": 1}, "name": "_id_"}];
+        for r in rows {
+            let name: String = r.get(0);
+            let spec_json: serde_json::Value = r.get(1);
+            let mut spec = match json_to_bson(&spec_json) {
+                bson::Bson::Document(d) => d,
+                _ => bson::doc! {"name": &name},
+            };
+            if !spec.contains_key("v") {
+                spec.insert("v", 2);
+            }
+            out.push(spec);
+        }
+        Ok(Some(out))
+    }
+
+    /// Usage counters of the indexes OxideDB manages on `db.coll`, from
+    /// `pg_stat_user_indexes`: the primary key as `_id_`, then each created index by name.
+    pub async fn index_usage(&self, db: &str, coll: &str) -> Result<Vec<IndexUsage>> {
+        let client = self.client().await?;
+        let stats = client
+            .query(
+                "SELECT s.indexrelname::text, i.indisprimary, COALESCE(s.idx_scan, 0)::bigint, \
+                 (EXTRACT(EPOCH FROM COALESCE(d.stats_reset, pg_postmaster_start_time())) * 1000)::bigint, \
+                 pg_relation_size(s.indexrelid) \
+                 FROM pg_stat_user_indexes s \
+                 JOIN pg_index i ON i.indexrelid = s.indexrelid \
+                 LEFT JOIN pg_stat_database d ON d.datname = current_database() \
+                 WHERE s.schemaname = $1 AND s.relname = $2",
+                &[&self.mapping.schema(db), &self.mapping.table(db, coll)],
+            )
+            .await
+            .map_err(err_msg)?;
+        if stats.is_empty() {
+            return Ok(Vec::new());
+        }
+        let since_ms: i64 = stats[0].get(3);
+        let mut scans: HashMap<String, (i64, i64)> = HashMap::new();
+        let mut out = Vec::new();
+        for r in &stats {
+            if r.get::<_, bool>(1) {
+                out.push(IndexUsage {
+                    name: "_id_".to_string(),
+                    spec: bson::doc! {"v": 2, "key": {"_id": 1}, "name": "_id_"},
+                    ops: r.get(2),
+                    since_ms,
+                    size: r.get(4),
+                });
+            } else {
+                scans.insert(r.get(0), (r.get(2), r.get(4)));
+            }
+        }
+
+        let rows = client
+            .query(
+                "SELECT name, spec FROM mdb_meta.indexes WHERE db=$1 AND coll=$2 ORDER BY name",
+                &[&db, &coll],
+            )
+            .await
+            .map_err(err_msg)?;
+        for r in rows {
+            let name: String = r.get(0);
+            let spec_json: serde_json::Value = r.get(1);
+            let spec = match bson::Bson::try_from(spec_json) {
+                Ok(bson::Bson::Document(d)) => d,
+                _ => bson::doc! {"name": &name},
+            };
+            let (ops, size) = scans
+                .get(&self.mapping.index(db, coll, &name))
+                .copied()
+                .unwrap_or((0, 0));
+            out.push(IndexUsage {
+                name,
+                spec,
+                ops,
+                since_ms,
+                size,
+            });
+        }
+        Ok(out)
+    }
+
+    /// Document count and sizes of `db.coll` plus its table activity counters, or `None`
+    /// when the collection does not exist. Counting reads the whole table.
+    pub async fn collection_stats(&self, db: &str, coll: &str) -> Result<Option<CollectionStats>> {
+        let schema = self.mapping.schema(db);
+        let table = self.mapping.table(db, coll);
+        let client = self.client().await?;
+        let sql = format!(
+            "SELECT COUNT(*), COALESCE(SUM(octet_length(doc_bson)), 0)::bigint, \
+             (SELECT pg_table_size(c.oid) FROM pg_class c \
+              JOIN pg_namespace n ON n.oid = c.relnamespace \
+              WHERE n.nspname = $1 AND c.relname = $2), \
+             (SELECT COALESCE(seq_scan, 0) + COALESCE(idx_scan, 0) FROM pg_stat_user_tables \
+              WHERE schemaname = $1 AND relname = $2), \
+             (SELECT n_tup_ins + n_tup_upd + n_tup_del FROM pg_stat_user_tables \
+              WHERE schemaname = $1 AND relname = $2) \
+             FROM {}.{}",
+            q_ident(&schema),
+            q_ident(&table)
+        );
+        let row = match client.query_one(&sql, &[&schema, &table]).await {
+            Ok(r) => r,
+            Err(e) if e.to_string().contains("does not exist") => return Ok(None),
+            Err(e) => return Err(err_msg(e)),
+        };
+        let indexes = self.index_usage(db, coll).await?;
+        Ok(Some(CollectionStats {
+            count: row.get(0),
+            size: row.get(1),
+            storage_size: row.get::<_, Option<i64>>(2).unwrap_or(0),
+            indexes,
+            reads: row.get::<_, Option<i64>>(3).unwrap_or(0),
+            writes: row.get::<_, Option<i64>>(4).unwrap_or(0),
+        }))
+    }
+
     /// Get the fields from the text index for a collection.
     /// Returns empty Vec if no text index exists.
     /// Returns error if multiple text indexes exist (shouldn't happen with uniqueness enforcement).
     pub async fn get_text_index_fields(&self, db: &str, coll: &str) -> Result<Vec<String>> {
-        let client = self.pool.get().await.map_err(err_msg)?;
+        let client = self.client().await?;
         let rows = client
             .query(
                 "SELECT spec FROM mdb_meta.indexes WHERE db=$1 AND coll=$2",
@@ -894,6 +2764,235 @@ impl PgStore {
         Ok(text_fields)
     }
 
+    /// Fields of `db.coll` covered by a 2dsphere index.
+    pub async fn geo_index_fields(&self, db: &str, coll: &str) -> Result<Vec<String>> {
+        let client = self.client().await?;
+        let rows = client
+            .query(
+                "SELECT k.key FROM mdb_meta.indexes, jsonb_each_text(spec->'key') AS k \
+                 WHERE db=$1 AND coll=$2 AND k.value = '2dsphere' ORDER BY name",
+                &[&db, &coll],
+            )
+            .await
+            .map_err(err_msg)?;
+        Ok(rows.into_iter().map(|r| r.get::<_, String>(0)).collect())
+    }
+
+    /// Every single-field index with `expireAfterSeconds`, across all databases.
+    pub async fn ttl_indexes(&self) -> Result<Vec<TtlIndex>> {
+        let client = self.client().await?;
+        let rows = client
+            .query(
+                "SELECT db, coll, name, spec FROM mdb_meta.indexes \
+                 WHERE spec ? 'expireAfterSeconds' ORDER BY db, coll, name",
+                &[],
+            )
+            .await
+            .map_err(err_msg)?;
+        Ok(rows
+            .into_iter()
+            .filter_map(|r| {
+                let spec: serde_json::Value = r.get(3);
+                let expire_after_secs = spec
+                    .get("expireAfterSeconds")
+                    .and_then(serde_json::Value::as_f64)?;
+                let key = spec.get("key")?.as_object()?;
+                if key.len() != 1 {
+                    return None;
+                }
+                let field = key.keys().next()?;
+                Some(TtlIndex {
+                    db: r.get(0),
+                    coll: r.get(1),
+                    name: r.get(2),
+                    field: field.clone(),
+                    expire_after_secs: expire_after_secs as i64,
+                })
+            })
+            .collect())
+    }
+
+    /// Delete the documents `ttl` has expired: those whose field holds a date, or an array
+    /// whose earliest date, is more than `expire_after_secs` old. Documents without a date
+    /// there never expire. Returns how many were deleted.
+    pub async fn delete_expired(&self, ttl: &TtlIndex) -> Result<u64> {
+        let q_schema = q_ident(&self.mapping.schema(&ttl.db));
+        let q_table = q_ident(&self.mapping.table(&ttl.db, &ttl.coll));
+        let path = pg_path_literal(&ttl.field);
+        // Dates are stored as `{"$date": ...}`, holding an RFC 3339 string, milliseconds
+        // or `{"$numberLong": ...}` milliseconds
+        let millis = "CASE jsonb_typeof(e.v->'$date') \
+             WHEN 'string' THEN (EXTRACT(EPOCH FROM (e.v->>'$date')::timestamptz) * 1000)::bigint \
+             WHEN 'number' THEN (e.v->>'$date')::numeric::bigint \
+             WHEN 'object' THEN (e.v->'$date'->>'$numberLong')::bigint END";
+        let sql = format!(
+            "DELETE FROM {}.{} WHERE EXISTS (SELECT 1 FROM jsonb_array_elements(\
+             CASE jsonb_typeof(doc #> {p}) WHEN 'array' THEN doc #> {p} \
+             ELSE jsonb_build_array(doc #> {p}) END) AS e(v) WHERE {} < $1)",
+            q_schema,
+            q_table,
+            millis,
+            p = path
+        );
+        let cutoff =
+            bson::DateTime::now().timestamp_millis() - ttl.expire_after_secs.saturating_mul(1000);
+        let t = Instant::now();
+        let client = self.client().await?;
+        let n = client.execute(&sql, &[&cutoff]).await.map_err(err_msg)?;
+        tracing::debug!(op="delete_expired", db=%ttl.db, coll=%ttl.coll, index=%ttl.name, deleted=%n, elapsed_ms=?t.elapsed().as_millis());
+        Ok(n)
+    }
+
+    /// Set `expireAfterSeconds` of index `name` on `db.coll`, making it a TTL index if it
+    /// was not one. Returns the previous value, if it had one.
+    pub async fn set_index_expiry(
+        &self,
+        db: &str,
+        coll: &str,
+        name: &str,
+        expire_after_secs: i64,
+    ) -> Result<Option<i64>> {
+        let client = self.client().await?;
+        let row = client
+            .query_opt(
+                "UPDATE mdb_meta.indexes i \
+                 SET spec = jsonb_set(i.spec, '{expireAfterSeconds}', to_jsonb($4::bigint)) \
+                 FROM (SELECT spec->'expireAfterSeconds' AS old FROM mdb_meta.indexes \
+                       WHERE db=$1 AND coll=$2 AND name=$3) o \
+                 WHERE i.db=$1 AND i.coll=$2 AND i.name=$3 RETURNING o.old",
+                &[&db, &coll, &name, &expire_after_secs],
+            )
+            .await
+            .map_err(err_msg)?;
+        Ok(row
+            .and_then(|r| r.get::<_, Option<serde_json::Value>>(0))
+            .and_then(|old| old.as_f64())
+            .map(|old| old as i64))
+    }
+
+    /// Whether the PostGIS extension is installed in the database, checked once.
+    pub async fn postgis_available(&self) -> Result<bool> {
+        if let Some(available) = *self.postgis_cache.read().await {
+            return Ok(available);
+        }
+        let client = self.client().await?;
+        let available = client
+            .query_opt("SELECT 1 FROM pg_extension WHERE extname = 'postgis'", &[])
+            .await
+            .map_err(err_msg)?
+            .is_some();
+        *self.postgis_cache.write().await = Some(available);
+        Ok(available)
+    }
+
+    /// Documents of `db.coll` whose `field` holds a point, nearest to (`lon`, `lat`) first,
+    /// each with its distance in meters on the sphere. Only documents matching `filter`
+    /// and within `min_distance`..=`max_distance` are returned, at most `limit` of them.
+    /// With PostGIS the distance is `ST_Distance` over `geography`, ordered with `<->` so a
+    /// 2dsphere index's GiST index can serve it; without, the haversine formula is computed
+    /// in SQL. A missing collection has no documents.
+    #[allow(clippy::too_many_arguments)]
+    pub async fn geo_near_docs(
+        &self,
+        db: &str,
+        coll: &str,
+        field: &str,
+        lon: f64,
+        lat: f64,
+        filter: Option<&bson::Document>,
+        min_distance: Option<f64>,
+        max_distance: Option<f64>,
+        limit: i64,
+    ) -> Result<Vec<(bson::Document, f64)>> {
+        let t = Instant::now();
+        let table = format!(
+            "{}.{}",
+            q_ident(&self.mapping.schema(db)),
+            q_ident(&self.mapping.table(db, coll))
+        );
+        let postgis = self.postgis_available().await?;
+        // The filter's values are bound; the point expression stays inline so it still
+        // matches the GiST index's
+        let stmt = bind_sql(0, || {
+            let where_sql = filter
+                .map(|f| build_where_from_filter_collated(f, None))
+                .unwrap_or_else(|| "TRUE".to_string());
+            if postgis {
+                let point = geography_sql(field);
+                let near = format!(
+                    "geography(ST_SetSRID(ST_MakePoint({}, {}), 4326))",
+                    lon, lat
+                );
+                let distance = format!("ST_Distance({}, {}, false)", point, near);
+                let mut conds = vec![format!("{} IS NOT NULL", point), format!("({})", where_sql)];
+                if let Some(max) = max_distance {
+                    conds.push(format!("ST_DWithin({}, {}, {}, false)", point, near, max));
+                }
+                if let Some(min) = min_distance {
+                    conds.push(format!("{} >= {}", distance, min));
+                }
+                format!(
+                    "SELECT doc_bson, doc, {} FROM {} WHERE {} ORDER BY {} <-> {} LIMIT {}",
+                    distance,
+                    table,
+                    conds.join(" AND "),
+                    point,
+                    near,
+                    limit
+                )
+            } else {
+                let (x, y) = (geo_coordinate_sql(field, 0), geo_coordinate_sql(field, 1));
+                let distance = format!(
+                    "2 * {r} * asin(least(1, sqrt(power(sin(radians({y} - ({lat})) / 2), 2) \
+                     + cos(radians({lat})) * cos(radians({y})) \
+                     * power(sin(radians({x} - ({lon})) / 2), 2))))",
+                    r = EARTH_RADIUS_METERS,
+                    x = x,
+                    y = y,
+                    lon = lon,
+                    lat = lat
+                );
+                let mut conds = vec!["dist IS NOT NULL".to_string()];
+                if let Some(max) = max_distance {
+                    conds.push(format!("dist <= {}", max));
+                }
+                if let Some(min) = min_distance {
+                    conds.push(format!("dist >= {}", min));
+                }
+                format!(
+                    "SELECT doc_bson, doc, dist FROM (SELECT doc_bson, doc, {} AS dist FROM {} \
+                     WHERE {}) AS near WHERE {} ORDER BY dist LIMIT {}",
+                    distance,
+                    table,
+                    where_sql,
+                    conds.join(" AND "),
+                    limit
+                )
+            }
+        });
+        let client = self.client().await?;
+        let rows = match query_bound(&**client, &stmt, &[]).await {
+            Ok(rows) => rows,
+            Err(e) if e.to_string().contains("does not exist") => return Ok(Vec::new()),
+            Err(e) => return Err(err_msg(e)),
+        };
+        let mut out = Vec::with_capacity(rows.len());
+        for r in rows {
+            let distance: f64 = r.get(2);
+            let bson_bytes: Option<Vec<u8>> = r.try_get(0).ok();
+            if let Some(bytes) = bson_bytes
+                && let Ok(doc) = bson::Document::from_reader(&mut std::io::Cursor::new(bytes))
+            {
+                out.push((doc, distance));
+                continue;
+            }
+            let json: serde_json::Value = r.get(1);
+            out.push((to_doc_from_json(json), distance));
+        }
+        tracing::debug!(op="geo_near_docs", db=%db, coll=%coll, n=out.len(), elapsed_ms=?t.elapsed().as_millis());
+        Ok(out)
+    }
+
     pub async fn create_index_compound(
         &self,
         db: &str,
@@ -901,27 +3000,50 @@ impl PgStore {
         name: &str,
         fields: &[(String, i32)],
         spec: &serde_json::Value,
+    ) -> Result<()> {
+        self.create_index_compound_collated(db, coll, name, fields, spec, None)
+            .await
+    }
+
+    /// Compound index whose expressions match the comparisons made under `collation`.
+    pub async fn create_index_compound_collated(
+        &self,
+        db: &str,
+        coll: &str,
+        name: &str,
+        fields: &[(String, i32)],
+        spec: &serde_json::Value,
+        collation: Option<&Collation>,
     ) -> Result<()> {
         // Ensure collection (schema/table) exists
         self.ensure_collection(db, coll).await?;
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let q_idx = q_ident(name);
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let q_idx = q_ident(&self.mapping.index(db, coll, name));
         let mut elems: Vec<String> = Vec::with_capacity(fields.len());
         for (field, order) in fields.iter() {
-            let field_escaped = field.replace('"', "\"\"");
             let ord = if *order < 0 { "DESC" } else { "ASC" };
             // expression index elem
-            elems.push(format!("((doc->>'{}')) {}", field_escaped, ord));
+            let elem = if index_is_unique(spec) {
+                unique_index_elem(field, collation)
+            } else {
+                index_elem(field, collation)
+            };
+            elems.push(format!("{} {}", elem, ord));
         }
         let elems_joined = elems.join(", ");
         let t = Instant::now();
         let ddl = format!(
-            "CREATE INDEX IF NOT EXISTS {} ON {}.{} USING btree ({})",
-            q_idx, q_schema, q_table, elems_joined
+            "CREATE {}INDEX IF NOT EXISTS {} ON {}.{} USING btree ({}){}",
+            if index_is_unique(spec) { "UNIQUE " } else { "" },
+            q_idx,
+            q_schema,
+            q_table,
+            elems_joined,
+            partial_index_clause(spec, collation)
         );
-        let client = self.pool.get().await.map_err(err_msg)?;
+        let client = self.client().await?;
         client.batch_execute(&ddl).await.map_err(err_msg)?;
         client
             .execute(
@@ -945,11 +3067,11 @@ impl PgStore {
     ) -> Result<()> {
         // Ensure collection (schema/table) exists
         self.ensure_collection(db, coll).await?;
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let q_idx = q_ident(name);
-        let field_escaped = field.replace('"', "\"\"");
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let q_idx = q_ident(&self.mapping.index(db, coll, name));
+        let field_escaped = escape_single(field);
 
         let t = Instant::now();
 
@@ -959,11 +3081,11 @@ impl PgStore {
             q_idx, q_schema, q_table, field_escaped
         );
 
-        let client = self.pool.get().await.map_err(err_msg)?;
+        let client = self.client().await?;
         client.batch_execute(&ddl).await.map_err(err_msg)?;
 
         // Also create a functional index for geometry operations
-        let geo_idx_name = format!("{}_geo", name);
+        let geo_idx_name = self.mapping.index(db, coll, &format!("{}_geo", name));
         let q_geo_idx = q_ident(&geo_idx_name);
         let functional_ddl = format!(
             "CREATE INDEX IF NOT EXISTS {} ON {}.{} USING GIN ((doc->'{}'))",
@@ -974,6 +3096,19 @@ impl PgStore {
             .await
             .map_err(err_msg)?;
 
+        // With PostGIS, a GiST index on the points serves $geoNear's distance ordering
+        if self.postgis_available().await? {
+            let q_gist_idx = q_ident(&self.mapping.index(db, coll, &format!("{}_gist", name)));
+            let gist_ddl = format!(
+                "CREATE INDEX IF NOT EXISTS {} ON {}.{} USING GIST (({}))",
+                q_gist_idx,
+                q_schema,
+                q_table,
+                geography_sql(field)
+            );
+            client.batch_execute(&gist_ddl).await.map_err(err_msg)?;
+        }
+
         // Persist metadata
         client
             .execute(
@@ -1007,10 +3142,10 @@ impl PgStore {
             ));
         }
 
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let q_idx = q_ident(name);
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let q_idx = q_ident(&self.mapping.index(db, coll, name));
 
         let t = Instant::now();
 
@@ -1044,7 +3179,7 @@ impl PgStore {
         let tsvector_parts: Vec<String> = fields
             .iter()
             .map(|f| {
-                let escaped = f.replace('"', "\"\"").replace('\'', "''");
+                let escaped = escape_single(f);
                 format!("COALESCE(doc->>'{}', '')", escaped)
             })
             .collect();
@@ -1056,7 +3191,7 @@ impl PgStore {
             q_idx, q_schema, q_table, safe_language, tsvector_expr
         );
 
-        let client = self.pool.get().await.map_err(err_msg)?;
+        let client = self.client().await?;
         client.batch_execute(&ddl).await.map_err(err_msg)?;
 
         // Persist metadata
@@ -1084,16 +3219,13 @@ impl PgStore {
         limit: i64,
         fields: &[String],
     ) -> Result<Vec<bson::Document>> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
 
         let t = Instant::now();
 
         // Build the text search query using plainto_tsquery for safe parsing
-        // Escape single quotes for SQL string literal
-        let escaped_search = search_text.replace("'", "''");
-
         // Validate language against known PostgreSQL text search configurations
         let valid_languages = [
             "danish",
@@ -1128,7 +3260,7 @@ impl PgStore {
             fields
                 .iter()
                 .map(|f| {
-                    let escaped = f.replace('"', "\"\"").replace('\'', "''");
+                    let escaped = escape_single(f);
                     format!("COALESCE(doc->>'{}', '')", escaped)
                 })
                 .collect()
@@ -1136,12 +3268,17 @@ impl PgStore {
         let tsvector_expr = tsvector_parts.join(" || ' ' || ");
 
         let sql = format!(
-            "SELECT id, doc FROM {}.{} WHERE to_tsvector('{}', {}) @@ plainto_tsquery('{}', '{}') LIMIT {}",
-            q_schema, q_table, safe_language, tsvector_expr, safe_language, escaped_search, limit
+            "SELECT id, doc FROM {}.{} WHERE to_tsvector('{}', {}) @@ plainto_tsquery('{}', $1) LIMIT {}",
+            q_schema, q_table, safe_language, tsvector_expr, safe_language, limit
         );
 
-        let client = self.pool.get().await.map_err(err_msg)?;
-        let rows = client.query(&sql, &[]).await.map_err(err_msg)?;
+        // The search text is bound; the rest stays literal so it matches the index expression
+        let client = self.client().await?;
+        let rows = client
+            .query(&annotate_sql(&sql), &[&search_text])
+            .instrument(sql_span(&sql))
+            .await
+            .map_err(err_msg)?;
 
         let mut results = Vec::with_capacity(rows.len());
         for row in rows {
@@ -1180,22 +3317,24 @@ impl PgStore {
             ));
         }
 
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let where_sql = filter
-            .map(build_where_from_filter)
-            .unwrap_or_else(|| "TRUE".to_string());
-        let sql = format!(
-            "SELECT COUNT(*) FROM {}.{} WHERE {}",
-            q_schema, q_table, where_sql
-        );
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let stmt = bind_sql(0, || {
+            let where_sql = filter
+                .map(build_where_from_filter)
+                .unwrap_or_else(|| "TRUE".to_string());
+            format!(
+                "SELECT COUNT(*) FROM {}.{} WHERE {}",
+                q_schema, q_table, where_sql
+            )
+        });
         let t = Instant::now();
-        let client = self.pool.get().await.map_err(err_msg)?;
-        let res = client.query_one(&sql, &[]).await;
+        let client = self.client().await?;
+        let res = query_bound(&**client, &stmt, &[]).await;
         match res {
-            Ok(row) => {
-                let n: i64 = row.get(0);
+            Ok(rows) => {
+                let n: i64 = rows.first().map(|row| row.get(0)).unwrap_or(0);
                 tracing::debug!(op="count_docs", db=%db, coll=%coll, elapsed_ms=?t.elapsed().as_millis());
                 Ok(n)
             }
@@ -1226,17 +3365,21 @@ impl PgStore {
             ));
         }
 
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         // Fast path: _id equality
         if let Some(idb) = filter.get("_id").and_then(id_bytes_from_bson) {
             let sql = format!(
                 "SELECT id, doc_bson, doc FROM {}.{} WHERE id = $1 LIMIT 1",
                 q_schema, q_table
             );
-            let client = self.pool.get().await.map_err(err_msg)?;
-            let rows = client.query(&sql, &[&idb]).await.map_err(err_msg)?;
+            let client = self.client().await?;
+            let rows = client
+                .query(&annotate_sql(&sql), &[&idb])
+                .instrument(sql_span(&sql))
+                .await
+                .map_err(err_msg)?;
             if rows.is_empty() {
                 return Ok(None);
             }
@@ -1255,14 +3398,22 @@ impl PgStore {
             };
             return Ok(Some((id, doc)));
         }
-        let where_sql = build_where_from_filter(filter);
+        let stmt = bind_sql(0, || {
+            format!(
+                "SELECT id, doc_bson, doc FROM {}.{} WHERE {} ORDER BY id ASC LIMIT 1",
+                q_schema,
+                q_table,
+                build_where_from_filter(filter)
+            )
+        });
         let t = Instant::now();
-        let client = self.pool.get().await.map_err(err_msg)?;
-        let sql = format!(
-            "SELECT id, doc_bson, doc FROM {}.{} WHERE {} ORDER BY id ASC LIMIT 1",
-            q_schema, q_table, where_sql
-        );
-        let rows = client.query(&sql, &[]).await.map_err(err_msg)?;
+        let mut client = self.client().await?;
+        let rows = if index_hinted() {
+            query_hinted(&mut client, &stmt).await
+        } else {
+            query_bound(&**client, &stmt, &[]).await
+        }
+        .map_err(err_msg)?;
         if rows.is_empty() {
             return Ok(None);
         }
@@ -1284,6 +3435,96 @@ impl PgStore {
         Ok(Some((id, doc)))
     }
 
+    /// Up to `limit` rows matching `filter` whose ids sort after `after`, in id order, so a
+    /// multi-document update can page through its matches without revisiting rows it has
+    /// already rewritten.
+    pub async fn find_batch_for_update(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: &bson::Document,
+        after: Option<&[u8]>,
+        limit: i64,
+    ) -> Result<Vec<(Vec<u8>, bson::Document)>> {
+        if filter.contains_key("$text") {
+            return Err(Error::Msg(
+                "$text is not supported in update operations".into(),
+            ));
+        }
+        let after_hex: String = after
+            .unwrap_or_default()
+            .iter()
+            .map(|b| format!("{:02x}", b))
+            .collect();
+        let stmt = bind_sql(0, || {
+            format!(
+                "SELECT id, doc_bson, doc FROM {} WHERE ({}) AND id > '\\x{}'::bytea ORDER BY id ASC LIMIT {}",
+                self.mapping.qualified_table(db, coll),
+                build_where_from_filter(filter),
+                after_hex,
+                limit
+            )
+        });
+        let t = Instant::now();
+        let mut client = self.client().await?;
+        let rows = match if index_hinted() {
+            query_hinted(&mut client, &stmt).await
+        } else {
+            query_bound(&**client, &stmt, &[]).await
+        } {
+            Ok(rows) => rows,
+            Err(e) if e.to_string().contains("does not exist") => return Ok(Vec::new()),
+            Err(e) => return Err(err_msg(e)),
+        };
+        let mut out = Vec::with_capacity(rows.len());
+        for r in rows {
+            let id: Vec<u8> = r.get(0);
+            let doc = match r
+                .try_get::<usize, Vec<u8>>(1)
+                .map(|bytes| bson::Document::from_reader(&mut std::io::Cursor::new(bytes)))
+            {
+                Ok(Ok(doc)) => doc,
+                _ => to_doc_from_json(r.get(2)),
+            };
+            out.push((id, doc));
+        }
+        tracing::debug!(op="find_batch_for_update", db=%db, coll=%coll, rows=out.len(), elapsed_ms=?t.elapsed().as_millis());
+        Ok(out)
+    }
+
+    /// Overwrite each of `docs` by id with one `UPDATE`, returning how many rows it wrote.
+    pub async fn update_docs_by_id(
+        &self,
+        db: &str,
+        coll: &str,
+        docs: &[(Vec<u8>, bson::Document)],
+    ) -> Result<u64> {
+        if docs.is_empty() {
+            return Ok(0);
+        }
+        let mut ids = Vec::with_capacity(docs.len());
+        let mut bsons = Vec::with_capacity(docs.len());
+        let mut jsons = Vec::with_capacity(docs.len());
+        for (id, doc) in docs {
+            ids.push(id.clone());
+            bsons.push(bson::to_vec(doc).map_err(err_msg)?);
+            jsons.push(crate::bson_type::to_jsonb(doc).map_err(err_msg)?);
+        }
+        let sql = format!(
+            "UPDATE {} AS t SET doc_bson = v.doc_bson, doc = v.doc FROM unnest($1::bytea[], $2::bytea[], $3::jsonb[]) AS v(id, doc_bson, doc) WHERE t.id = v.id",
+            self.mapping.qualified_table(db, coll)
+        );
+        let t = Instant::now();
+        let client = self.client().await?;
+        let n = client
+            .execute(&annotate_sql(&sql), &[&ids, &bsons, &jsons])
+            .instrument(sql_span(&sql))
+            .await
+            .map_err(err_msg)?;
+        tracing::debug!(op="update_docs_by_id", db=%db, coll=%coll, rows=docs.len(), elapsed_ms=?t.elapsed().as_millis());
+        Ok(n)
+    }
+
     /// Overwrite the full document by id (updates both doc_bson and doc JSON).
     pub async fn update_doc_by_id(
         &self,
@@ -1292,19 +3533,20 @@ impl PgStore {
         id: &[u8],
         new_doc: &bson::Document,
     ) -> Result<u64> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         let sql = format!(
             "UPDATE {}.{} SET doc_bson = $1, doc = $2 WHERE id = $3",
             q_schema, q_table
         );
         let bson_bytes = bson::to_vec(new_doc).map_err(err_msg)?;
-        let json = serde_json::to_value(new_doc).map_err(err_msg)?;
+        let json = crate::bson_type::to_jsonb(new_doc).map_err(err_msg)?;
         let t = Instant::now();
-        let client = self.pool.get().await.map_err(err_msg)?;
+        let client = self.client().await?;
         let n = client
-            .execute(&sql, &[&bson_bytes, &json, &id])
+            .execute(&annotate_sql(&sql), &[&bson_bytes, &json, &id])
+            .instrument(sql_span(&sql))
             .await
             .map_err(err_msg)?;
         tracing::debug!(op="update_doc_by_id", db=%db, coll=%coll, elapsed_ms=?t.elapsed().as_millis());
@@ -1325,30 +3567,41 @@ impl PgStore {
             ));
         }
 
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         // Fast path: _id equality
         if let Some(idb) = filter.get("_id").and_then(id_bytes_from_bson) {
             let del_sql = format!("DELETE FROM {}.{} WHERE id = $1", q_schema, q_table);
-            let client = self.pool.get().await.map_err(err_msg)?;
-            let n = client.execute(&del_sql, &[&idb]).await.map_err(err_msg)?;
+            let client = self.client().await?;
+            let n = client
+                .execute(&annotate_sql(&del_sql), &[&idb])
+                .instrument(sql_span(&del_sql))
+                .await
+                .map_err(err_msg)?;
             return Ok(n);
         }
-        let where_sql = build_where_from_filter(filter);
-        let select_sql = format!(
-            "SELECT id FROM {}.{} WHERE {} ORDER BY id ASC LIMIT 1",
-            q_schema, q_table, where_sql
-        );
+        // One statement picks and deletes the row: the first match in `_id` order, so
+        // repeating a delete with the same filter removes the same document, and never more
+        // than one row however many match or whether an index serves the filter
+        let stmt = bind_sql(0, || {
+            format!(
+                "DELETE FROM {}.{} WHERE ctid IN (SELECT ctid FROM {}.{} WHERE {} ORDER BY id ASC LIMIT 1)",
+                q_schema,
+                q_table,
+                q_schema,
+                q_table,
+                build_where_from_filter(filter)
+            )
+        });
         let t = Instant::now();
-        let client = self.pool.get().await.map_err(err_msg)?;
-        let rows = client.query(&select_sql, &[]).await.map_err(err_msg)?;
-        if rows.is_empty() {
-            return Ok(0);
+        let mut client = self.client().await?;
+        let n = if index_hinted() {
+            execute_hinted(&mut client, &stmt).await
+        } else {
+            execute_bound(&**client, &stmt, &[]).await
         }
-        let id: Vec<u8> = rows[0].get(0);
-        let del_sql = format!("DELETE FROM {}.{} WHERE id = $1", q_schema, q_table);
-        let n = client.execute(&del_sql, &[&id]).await.map_err(err_msg)?;
+        .map_err(err_msg)?;
         tracing::debug!(op="delete_one_by_filter", db=%db, coll=%coll, elapsed_ms=?t.elapsed().as_millis());
         Ok(n)
     }
@@ -1367,24 +3620,330 @@ impl PgStore {
             ));
         }
 
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let where_sql = build_where_from_filter(filter);
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let stmt = bind_sql(0, || {
+            format!(
+                "DELETE FROM {}.{} WHERE {}",
+                q_schema,
+                q_table,
+                build_where_from_filter(filter)
+            )
+        });
         let t = Instant::now();
-        let client = self.pool.get().await.map_err(err_msg)?;
-        let sql = format!("DELETE FROM {}.{} WHERE {}", q_schema, q_table, where_sql);
-        let n = client.execute(&sql, &[]).await.map_err(err_msg)?;
+        let mut client = self.client().await?;
+        let n = if index_hinted() {
+            execute_hinted(&mut client, &stmt).await
+        } else {
+            execute_bound(&**client, &stmt, &[]).await
+        }
+        .map_err(err_msg)?;
         tracing::debug!(op="delete_many_by_filter", db=%db, coll=%coll, elapsed_ms=?t.elapsed().as_millis());
         Ok(n)
     }
-}
 
-fn schema_name(db: &str) -> String {
-    format!("mdb_{}", db)
+    /// Check the integrity of a collection's backing table for the `validate` command.
+    ///
+    /// The basic check runs aggregate queries: row count, rows whose `doc` is not a JSON object
+    /// or lacks `_id`, rows without a stored BSON copy, and duplicate `_id` values. With `full`
+    /// every stored BSON document is additionally decoded and checked for an `_id`.
+    pub async fn validate_collection(
+        &self,
+        db: &str,
+        coll: &str,
+        full: bool,
+    ) -> Result<ValidationReport> {
+        let schema = self.mapping.schema(db);
+        let q_schema = q_ident(&schema);
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let t = Instant::now();
+        let client = self.client().await?;
+        let mut report = ValidationReport::default();
+
+        let stmt = bind_sql(0, || {
+            format!(
+                "SELECT COUNT(*), \
+                 COUNT(*) FILTER (WHERE jsonb_typeof(doc) <> {} OR NOT (doc ? {})), \
+                 COUNT(*) FILTER (WHERE doc_bson IS NULL) \
+                 FROM {}.{}",
+                sql_quote("object"),
+                sql_quote("_id"),
+                q_schema,
+                q_table
+            )
+        });
+        let rows = query_bound(&**client, &stmt, &[]).await.map_err(err_msg)?;
+        let row = rows
+            .first()
+            .ok_or_else(|| Error::Msg("validate returned no counts".into()))?;
+        report.nrecords = row.get(0);
+        let malformed: i64 = row.get(1);
+        let missing_bson: i64 = row.get(2);
+        if malformed > 0 {
+            report.n_invalid_documents += malformed;
+            report.errors.push(format!(
+                "{} document(s) are not objects or have no _id",
+                malformed
+            ));
+        }
+        if missing_bson > 0 {
+            report.warnings.push(format!(
+                "{} document(s) have no stored BSON and are served from JSONB",
+                missing_bson
+            ));
+        }
+
+        let stmt = bind_sql(0, || {
+            format!(
+                "SELECT COUNT(*) FROM (SELECT doc->'_id' FROM {}.{} WHERE doc ? {} \
+                 GROUP BY doc->'_id' HAVING COUNT(*) > 1) d",
+                q_schema,
+                q_table,
+                sql_quote("_id")
+            )
+        });
+        let rows = query_bound(&**client, &stmt, &[]).await.map_err(err_msg)?;
+        let dup_ids: i64 = rows.first().map_or(0, |r| r.get(0));
+        if dup_ids > 0 {
+            report.errors.push(format!(
+                "{} _id value(s) are shared by multiple documents",
+                dup_ids
+            ));
+        }
+
+        if full {
+            let stmt = bind_sql(0, || {
+                format!(
+                    "SELECT doc_bson FROM {}.{} WHERE doc_bson IS NOT NULL",
+                    q_schema, q_table
+                )
+            });
+            let rows = query_bound(&**client, &stmt, &[]).await.map_err(err_msg)?;
+            let mut corrupt = 0i64;
+            for r in rows {
+                let bytes: Vec<u8> = r.get(0);
+                match bson::Document::from_reader(&mut std::io::Cursor::new(bytes)) {
+                    Ok(doc) if doc.contains_key("_id") => {}
+                    _ => corrupt += 1,
+                }
+            }
+            if corrupt > 0 {
+                report.n_invalid_documents += corrupt;
+                report.errors.push(format!(
+                    "{} stored BSON document(s) failed to decode",
+                    corrupt
+                ));
+            }
+        }
+
+        tracing::debug!(op="validate_collection", db=%db, coll=%coll, full=%full, elapsed_ms=?t.elapsed().as_millis());
+        Ok(report)
+    }
+
+    /// Random sample of up to `size` documents without replacement, backing `$sample`.
+    ///
+    /// Two strategies are used:
+    /// - `ORDER BY random() LIMIT n` is exact: every document is equally likely, but the whole
+    ///   (filtered) table is read and sorted. It is used whenever a filter is present, when the
+    ///   collection is small, or when `size` is a large fraction of it.
+    /// - `TABLESAMPLE SYSTEM (p)` reads only a random subset of pages and is used for large,
+    ///   unfiltered collections where `size` is below 5% of the estimated row count. Page-level
+    ///   sampling is approximate (rows sharing a page are picked together); if it returns too
+    ///   few rows the exact strategy is used instead.
+    pub async fn sample_docs(
+        &self,
+        db: &str,
+        coll: &str,
+        filter: Option<&bson::Document>,
+        size: i64,
+    ) -> Result<Vec<bson::Document>> {
+        let schema = self.mapping.schema(db);
+        let q_schema = q_ident(&schema);
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let t = Instant::now();
+        let client = self.client().await?;
+
+        let mut table_sample_pct: Option<f64> = None;
+        if filter.is_none() {
+            let est = client
+                .query_opt(
+                    "SELECT c.reltuples::bigint FROM pg_class c \
+                     JOIN pg_namespace n ON n.oid = c.relnamespace \
+                     WHERE n.nspname = $1 AND c.relname = $2",
+                    &[&schema, &self.mapping.table(db, coll)],
+                )
+                .await
+                .map_err(err_msg)?
+                .map(|r| r.get::<_, i64>(0))
+                .unwrap_or(0);
+            if est >= SAMPLE_TABLESAMPLE_MIN_ROWS
+                && (size as f64) < est as f64 * SAMPLE_TABLESAMPLE_MAX_FRACTION
+            {
+                let pct = (size as f64 / est as f64) * 100.0 * SAMPLE_TABLESAMPLE_OVERSAMPLE;
+                table_sample_pct = Some(pct.min(100.0));
+            }
+        }
+
+        let mut strategies: Vec<BoundSql> = Vec::new();
+        if let Some(pct) = table_sample_pct {
+            strategies.push(bind_sql(0, || {
+                format!(
+                    "SELECT doc_bson, doc FROM {}.{} TABLESAMPLE SYSTEM ({}) ORDER BY random() LIMIT {}",
+                    q_schema, q_table, pct, size
+                )
+            }));
+        }
+        strategies.push(bind_sql(0, || {
+            let where_sql = filter
+                .map(build_where_from_filter)
+                .unwrap_or_else(|| "TRUE".to_string());
+            format!(
+                "SELECT doc_bson, doc FROM {}.{} WHERE {} ORDER BY random() LIMIT {}",
+                q_schema, q_table, where_sql, size
+            )
+        }));
+
+        let mut out = Vec::new();
+        for (i, stmt) in strategies.iter().enumerate() {
+            let rows = match query_bound(&**client, stmt, &[]).await {
+                Ok(r) => r,
+                Err(e) => {
+                    let msg = e.to_string();
+                    if msg.contains("does not exist") {
+                        return Ok(Vec::new());
+                    }
+                    return Err(err_msg(e));
+                }
+            };
+            // Too few rows from page sampling: fall through to the exact strategy
+            if (rows.len() as i64) < size && i + 1 < strategies.len() {
+                continue;
+            }
+            out = Vec::with_capacity(rows.len());
+            for r in rows {
+                let bson_bytes: Option<Vec<u8>> = r.try_get(0).ok();
+                if let Some(bytes) = bson_bytes
+                    && let Ok(doc) = bson::Document::from_reader(&mut std::io::Cursor::new(bytes))
+                {
+                    out.push(doc);
+                    continue;
+                }
+                let json: serde_json::Value = r.get(1);
+                out.push(to_doc_from_json(json));
+            }
+            tracing::debug!(op="sample_docs", db=%db, coll=%coll, table_sample=%(i == 0 && table_sample_pct.is_some()), elapsed_ms=?t.elapsed().as_millis());
+            break;
+        }
+        Ok(out)
+    }
+
+    /// Breadth-first traversal backing `$graphLookup`, for every input at once: `starts`
+    /// holds each input's `startWith` values, and the result each input's reachable
+    /// documents with the smallest depth they were found at.
+    ///
+    /// Documents whose `connect_to` value matches a start value form depth 0; each following
+    /// level matches `connect_to` against the `connect_from` values of documents first reached
+    /// at the previous level. Array values on either side match element-wise. One query runs
+    /// per level for all inputs together, and a document or value already seen by an input is
+    /// not searched again, so the work grows with the edges walked rather than the paths.
+    #[allow(clippy::too_many_arguments)]
+    pub async fn graph_lookup(
+        &self,
+        db: &str,
+        coll: &str,
+        starts: &[Vec<bson::Bson>],
+        connect_from: &str,
+        connect_to: &str,
+        max_depth: Option<i64>,
+        restrict: Option<&bson::Document>,
+    ) -> Result<Vec<Vec<(bson::Document, i64)>>> {
+        let stmt = bind_sql(1, || {
+            format!(
+                r#"
+            SELECT DISTINCT ON (f.i, s.id) f.i, s.id, s.doc_bson, s.doc,
+                jsonb_path_query_array(s.doc, {from}::jsonpath)
+            FROM jsonb_to_recordset($1::jsonb) f(i int, v jsonb)
+            JOIN {schema}.{table} s ON EXISTS (
+                SELECT 1
+                FROM jsonb_array_elements(jsonb_path_query_array(s.doc, {to}::jsonpath)) t(v)
+                WHERE t.v = f.v
+            )
+            WHERE {restrict}
+            ORDER BY f.i, s.id
+            "#,
+                schema = q_ident(&self.mapping.schema(db)),
+                table = q_ident(&self.mapping.table(db, coll)),
+                restrict = restrict
+                    .map(build_where_from_filter)
+                    .unwrap_or_else(|| "TRUE".to_string()),
+                to = sql_quote(&format!("{}[*]", jsonpath_path(connect_to))),
+                from = sql_quote(&format!("{}[*]", jsonpath_path(connect_from))),
+            )
+        });
+
+        let t = Instant::now();
+        let client = self.client().await?;
+        let mut found: Vec<Vec<(bson::Document, i64)>> = vec![Vec::new(); starts.len()];
+        let mut visited: Vec<HashSet<Vec<u8>>> = vec![HashSet::new(); starts.len()];
+        let mut searched: Vec<HashSet<String>> = vec![HashSet::new(); starts.len()];
+        // The values each input searches for next: its `startWith`, then the connectFrom
+        // values of the documents first reached at the previous depth
+        let mut frontier = Vec::new();
+        for (i, values) in starts.iter().enumerate() {
+            for v in values {
+                let v = serde_json::to_value(v).map_err(err_msg)?;
+                if searched[i].insert(v.to_string()) {
+                    frontier.push(serde_json::json!({ "i": i, "v": v }));
+                }
+            }
+        }
+        let mut depth = 0i64;
+        while !frontier.is_empty() && max_depth.is_none_or(|max| depth <= max) {
+            let search = serde_json::Value::Array(std::mem::take(&mut frontier));
+            let rows = match query_bound(&**client, &stmt, &[(&search, Type::JSONB)]).await {
+                Ok(rows) => rows,
+                // Only a missing `from` collection finds nothing
+                Err(e)
+                    if e.code().is_some_and(|c| {
+                        *c == tokio_postgres::error::SqlState::UNDEFINED_TABLE
+                            || *c == tokio_postgres::error::SqlState::INVALID_SCHEMA_NAME
+                    }) =>
+                {
+                    break;
+                }
+                Err(e) => return Err(err_msg(e)),
+            };
+            for r in rows {
+                let i = r.get::<_, i32>(0) as usize;
+                let id: Vec<u8> = r.get(1);
+                // Each document is kept at the first depth it is reached at
+                if !visited[i].insert(id) {
+                    continue;
+                }
+                let bson_bytes: Option<Vec<u8>> = r.try_get(2).ok();
+                let doc = match bson_bytes.and_then(|bytes| {
+                    bson::Document::from_reader(&mut std::io::Cursor::new(bytes)).ok()
+                }) {
+                    Some(doc) => doc,
+                    None => to_doc_from_json(r.get(3)),
+                };
+                found[i].push((doc, depth));
+                let next: serde_json::Value = r.get(4);
+                for v in next.as_array().into_iter().flatten() {
+                    if searched[i].insert(v.to_string()) {
+                        frontier.push(serde_json::json!({ "i": i, "v": v }));
+                    }
+                }
+            }
+            depth += 1;
+        }
+        tracing::debug!(op="graph_lookup", db=%db, coll=%coll, inputs=%starts.len(), depth=%depth, elapsed_ms=?t.elapsed().as_millis());
+        Ok(found)
+    }
 }
 
-fn q_ident(ident: &str) -> String {
+pub(crate) fn q_ident(ident: &str) -> String {
     let escaped = ident.replace('"', "\"\"");
     format!("\"{}\"", escaped)
 }
@@ -1393,17 +3952,25 @@ fn err_msg<E: std::fmt::Display>(e: E) -> Error {
     Error::Msg(e.to_string())
 }
 
-fn escape_single(s: &str) -> String {
-    s.replace('\\', "\\\\").replace('\'', "''")
-}
-
 // removed unused helpers
 
 fn build_where_from_filter(filter: &bson::Document) -> String {
-    build_where_from_filter_internal(filter, false)
+    build_where_from_filter_internal(filter, false, false)
+}
+
+fn build_where_from_filter_collated(
+    filter: &bson::Document,
+    collation: Option<&Collation>,
+) -> String {
+    let case_insensitive = collation.is_some_and(Collation::case_insensitive);
+    build_where_from_filter_internal(filter, false, case_insensitive)
 }
 
-fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool) -> String {
+fn build_where_from_filter_internal(
+    filter: &bson::Document,
+    is_nested: bool,
+    case_insensitive: bool,
+) -> String {
     let mut where_clauses: Vec<String> = Vec::new();
 
     // Handle logical operators at the top level first
@@ -1413,7 +3980,7 @@ fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool) ->
         let mut or_clauses: Vec<String> = Vec::new();
         for item in arr {
             if let bson::Bson::Document(d) = item {
-                let clause = build_where_from_filter_internal(d, true);
+                let clause = build_where_from_filter_internal(d, true, case_insensitive);
                 if clause != "TRUE" {
                     or_clauses.push(clause);
                 }
@@ -1435,7 +4002,7 @@ fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool) ->
         let mut and_clauses: Vec<String> = Vec::new();
         for item in arr {
             if let bson::Bson::Document(d) = item {
-                let clause = build_where_from_filter_internal(d, true);
+                let clause = build_where_from_filter_internal(d, true, case_insensitive);
                 if clause != "TRUE" {
                     and_clauses.push(clause);
                 }
@@ -1454,7 +4021,7 @@ fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool) ->
     if let Some(not_val) = filter.get("$not")
         && let bson::Bson::Document(d) = not_val
     {
-        let clause = build_where_from_filter_internal(d, true);
+        let clause = build_where_from_filter_internal(d, true, case_insensitive);
         if clause != "TRUE" {
             where_clauses.push(format!("NOT ({})", clause));
         }
@@ -1466,7 +4033,7 @@ fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool) ->
         let mut nor_clauses: Vec<String> = Vec::new();
         for item in arr {
             if let bson::Bson::Document(d) = item {
-                let clause = build_where_from_filter_internal(d, true);
+                let clause = build_where_from_filter_internal(d, true, case_insensitive);
                 if clause != "TRUE" {
                     nor_clauses.push(clause);
                 }
@@ -1499,84 +4066,92 @@ fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool) ->
                             if let bson::Bson::Document(em) = val
                                 && let Some(pred) = build_elem_match_pred(&path, em)
                             {
-                                where_clauses.push(format!(
-                                    "jsonb_path_exists(doc, '{}[*] ? ({} )')",
-                                    escape_single(&path),
-                                    pred
-                                ));
+                                where_clauses
+                                    .push(jsonpath_exists(&format!("{}[*] ? ({} )", path, pred)));
                             }
                         }
+                        "$type" => {
+                            // An unknown type name matches nothing
+                            where_clauses.push(
+                                crate::bson_type::sql_predicate(k, val)
+                                    .unwrap_or_else(|| "FALSE".to_string()),
+                            );
+                        }
                         "$exists" => {
                             let clause = if matches!(val, bson::Bson::Boolean(true)) {
-                                format!("jsonb_path_exists(doc, '{}')", escape_single(&path))
+                                jsonpath_exists(&path)
                             } else {
-                                format!("NOT jsonb_path_exists(doc, '{}')", escape_single(&path))
+                                format!("NOT {}", jsonpath_exists(&path))
                             };
                             where_clauses.push(clause);
                         }
                         "$in" => {
                             if let bson::Bson::Array(arr) = val {
                                 let mut preds: Vec<String> = Vec::new();
+                                let mut ci_values: Vec<&str> = Vec::new();
                                 for item in arr {
-                                    if let Some(lit) = json_literal_from_bson(item) {
+                                    if case_insensitive && let bson::Bson::String(s) = item {
+                                        ci_values.push(s.as_str());
+                                    } else if let Some(lit) = json_literal_from_bson(item) {
                                         preds.push(format!("@ == {}", lit));
                                     }
                                 }
-                                if preds.is_empty() {
+                                let mut alternatives: Vec<String> = Vec::new();
+                                if !ci_values.is_empty() {
+                                    alternatives.push(ci_string_in(k, &ci_values));
+                                }
+                                if !preds.is_empty() {
+                                    let predicate = preds.join(" || ");
+                                    let p1 =
+                                        jsonpath_exists(&format!("{} ? ({} )", path, predicate));
+                                    let p2 =
+                                        jsonpath_exists(&format!("{}[*] ? ({} )", path, predicate));
+                                    alternatives.push(format!("{} OR {}", p1, p2));
+                                }
+                                if alternatives.is_empty() {
                                     where_clauses.push("FALSE".to_string());
                                 } else {
-                                    let predicate = preds.join(" || ");
-                                    let p1 = format!(
-                                        "jsonb_path_exists(doc, '{} ? ({} )')",
-                                        escape_single(&path),
-                                        predicate
-                                    );
-                                    let p2 = format!(
-                                        "jsonb_path_exists(doc, '{}[*] ? ({} )')",
-                                        escape_single(&path),
-                                        predicate
-                                    );
-                                    where_clauses.push(format!("({} OR {})", p1, p2));
+                                    where_clauses.push(format!("({})", alternatives.join(" OR ")));
                                 }
                             }
                         }
                         "$ne" => {
-                            if let Some(lit) = json_literal_from_bson(val) {
-                                let p1 = format!(
-                                    "jsonb_path_exists(doc, '{} ? (@ != {} )')",
-                                    escape_single(&path),
-                                    lit
-                                );
-                                let p2 = format!(
-                                    "jsonb_path_exists(doc, '{}[*] ? (@ != {} )')",
-                                    escape_single(&path),
-                                    lit
-                                );
+                            if case_insensitive && let bson::Bson::String(s) = val {
+                                where_clauses
+                                    .push(format!("{} IS NOT TRUE", ci_string_compare(k, "=", s)));
+                            } else if let Some(lit) = json_literal_from_bson(val) {
+                                let p1 = jsonpath_exists(&format!("{} ? (@ != {} )", path, lit));
+                                let p2 = jsonpath_exists(&format!("{}[*] ? (@ != {} )", path, lit));
                                 where_clauses.push(format!("({} OR {})", p1, p2));
                             }
                         }
                         "$nin" => {
                             if let bson::Bson::Array(arr) = val {
                                 let mut preds: Vec<String> = Vec::new();
+                                let mut ci_values: Vec<&str> = Vec::new();
                                 for item in arr {
-                                    if let Some(lit) = json_literal_from_bson(item) {
+                                    if case_insensitive && let bson::Bson::String(s) = item {
+                                        ci_values.push(s.as_str());
+                                    } else if let Some(lit) = json_literal_from_bson(item) {
                                         preds.push(format!("@ != {}", lit));
                                     }
                                 }
+                                if !ci_values.is_empty() {
+                                    where_clauses.push(format!(
+                                        "{} IS NOT TRUE",
+                                        ci_string_in(k, &ci_values)
+                                    ));
+                                }
                                 if preds.is_empty() {
-                                    where_clauses.push("TRUE".to_string());
+                                    if ci_values.is_empty() {
+                                        where_clauses.push("TRUE".to_string());
+                                    }
                                 } else {
                                     let predicate = preds.join(" && ");
-                                    let p1 = format!(
-                                        "jsonb_path_exists(doc, '{} ? ({} )')",
-                                        escape_single(&path),
-                                        predicate
-                                    );
-                                    let p2 = format!(
-                                        "jsonb_path_exists(doc, '{}[*] ? ({} )')",
-                                        escape_single(&path),
-                                        predicate
-                                    );
+                                    let p1 =
+                                        jsonpath_exists(&format!("{} ? ({} )", path, predicate));
+                                    let p2 =
+                                        jsonpath_exists(&format!("{}[*] ? ({} )", path, predicate));
                                     where_clauses.push(format!("({} AND {})", p1, p2));
                                 }
                             }
@@ -1585,7 +4160,7 @@ fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool) ->
                             if let bson::Bson::String(pattern) = val {
                                 let flags =
                                     d.get("$options").and_then(|o| o.as_str()).unwrap_or("");
-                                let regex_clause = build_regex_clause(&path, pattern, flags);
+                                let regex_clause = build_regex_clause(k, pattern, flags);
                                 where_clauses.push(regex_clause);
                             }
                         }
@@ -1594,16 +4169,12 @@ fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool) ->
                                 let mut all_clauses: Vec<String> = Vec::new();
                                 for item in arr {
                                     if let Some(lit) = json_literal_from_bson(item) {
-                                        let p1 = format!(
-                                            "jsonb_path_exists(doc, '{} ? (@ == {} )')",
-                                            escape_single(&path),
-                                            lit
-                                        );
-                                        let p2 = format!(
-                                            "jsonb_path_exists(doc, '{}[*] ? (@ == {} )')",
-                                            escape_single(&path),
-                                            lit
-                                        );
+                                        let p1 =
+                                            jsonpath_exists(&format!("{} ? (@ == {} )", path, lit));
+                                        let p2 = jsonpath_exists(&format!(
+                                            "{}[*] ? (@ == {} )",
+                                            path, lit
+                                        ));
                                         all_clauses.push(format!("({} OR {})", p1, p2));
                                     }
                                 }
@@ -1635,34 +4206,24 @@ fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool) ->
                                 "$lte" => "<=",
                                 _ => unreachable!(),
                             };
-                            if let Some(lit) = json_literal_from_bson(val) {
-                                let p1 = format!(
-                                    "jsonb_path_exists(doc, '{} ? (@ {} {} )')",
-                                    escape_single(&path),
-                                    op_sql,
-                                    lit
-                                );
-                                let p2 = format!(
-                                    "jsonb_path_exists(doc, '{}[*] ? (@ {} {} )')",
-                                    escape_single(&path),
-                                    op_sql,
-                                    lit
-                                );
+                            if case_insensitive && let bson::Bson::String(s) = val {
+                                where_clauses.push(ci_string_compare(k, op_sql, s));
+                            } else if let Some(lit) = json_literal_from_bson(val) {
+                                let p1 =
+                                    jsonpath_exists(&format!("{} ? (@ {} {} )", path, op_sql, lit));
+                                let p2 = jsonpath_exists(&format!(
+                                    "{}[*] ? (@ {} {} )",
+                                    path, op_sql, lit
+                                ));
                                 where_clauses.push(format!("({} OR {})", p1, p2));
                             }
                         }
                         "$eq" => {
-                            if let Some(lit) = json_literal_from_bson(val) {
-                                let p1 = format!(
-                                    "jsonb_path_exists(doc, '{} ? (@ == {} )')",
-                                    escape_single(&path),
-                                    lit
-                                );
-                                let p2 = format!(
-                                    "jsonb_path_exists(doc, '{}[*] ? (@ == {} )')",
-                                    escape_single(&path),
-                                    lit
-                                );
+                            if case_insensitive && let bson::Bson::String(s) = val {
+                                where_clauses.push(ci_string_compare(k, "=", s));
+                            } else if let Some(lit) = json_literal_from_bson(val) {
+                                let p1 = jsonpath_exists(&format!("{} ? (@ == {} )", path, lit));
+                                let p2 = jsonpath_exists(&format!("{}[*] ? (@ == {} )", path, lit));
                                 where_clauses.push(format!("({} OR {})", p1, p2));
                             }
                         }
@@ -1755,24 +4316,27 @@ fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool) ->
                     }
                 }
             }
+            bson::Bson::String(s) if case_insensitive => {
+                where_clauses.push(ci_string_compare(k, "=", s));
+            }
             _ => {
                 if let Some(lit) = json_literal_from_bson(v) {
-                    let p1 = format!(
-                        "jsonb_path_exists(doc, '{} ? (@ == {} )')",
-                        escape_single(&path),
-                        lit
-                    );
-                    let p2 = format!(
-                        "jsonb_path_exists(doc, '{}[*] ? (@ == {} )')",
-                        escape_single(&path),
-                        lit
-                    );
+                    let p1 = jsonpath_exists(&format!("{} ? (@ == {} )", path, lit));
+                    let p2 = jsonpath_exists(&format!("{}[*] ? (@ == {} )", path, lit));
                     where_clauses.push(format!("({} OR {})", p1, p2));
                 }
             }
         }
     }
 
+    // Commands check `expr_filters_translate` before building SQL; anything left
+    // untranslatable here must not widen the match
+    if let Some(expr) = filter.get("$expr") {
+        where_clauses.push(
+            crate::translate::translate_expr_filter(expr).unwrap_or_else(|| "FALSE".to_string()),
+        );
+    }
+
     if where_clauses.is_empty() {
         String::from("TRUE")
     } else if where_clauses.len() == 1 {
@@ -1784,25 +4348,158 @@ fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool) ->
     }
 }
 
-fn build_regex_clause(path: &str, pattern: &str, flags: &str) -> String {
-    // Convert MongoDB regex pattern to PostgreSQL regex
-    // Escape single quotes in pattern
-    let escaped_pattern = pattern.replace("'", "''");
+/// Whether two index key patterns name the same fields, in order, with the same directions
+/// or types; `{a: 1}` and `{a: 1.0}` are the same pattern.
+fn key_patterns_equal(a: &bson::Document, b: &bson::Document) -> bool {
+    let direction = |v: &bson::Bson| match v {
+        bson::Bson::Int32(n) => Some(f64::from(*n)),
+        bson::Bson::Int64(n) => Some(*n as f64),
+        bson::Bson::Double(n) => Some(*n),
+        _ => None,
+    };
+    a.len() == b.len()
+        && a.iter().zip(b.iter()).all(|((ka, va), (kb, vb))| {
+            ka == kb
+                && match (direction(va), direction(vb)) {
+                    (Some(x), Some(y)) => x == y,
+                    _ => va == vb,
+                }
+        })
+}
+
+/// Index element for `field`: the extracted text, lower-cased or with a COLLATE clause
+/// when the index carries a collation.
+fn index_elem(field: &str, collation: Option<&Collation>) -> String {
+    let text = format!("(doc->>'{}')", escape_single(field));
+    match collation {
+        Some(c) if c.case_insensitive() => format!("({})", collated_text_expr(field)),
+        Some(c) if !c.is_simple() => format!("{} {}", text, c.to_collate_clause()),
+        _ => text,
+    }
+}
+
+/// ` WHERE ...` limiting an index to the documents matched by its filter (see
+/// [`index_filter`]), or nothing for a full index. The predicate is translated exactly as a
+/// query filter is, so PostgreSQL sees a query that repeats the expression implies it and
+/// only then uses the index.
+fn partial_index_clause(spec: &serde_json::Value, collation: Option<&Collation>) -> String {
+    match index_filter(spec) {
+        Some(filter) => format!(
+            " WHERE {}",
+            build_where_from_filter_collated(&filter, collation)
+        ),
+        None => String::new(),
+    }
+}
+
+/// The documents an index with `spec` holds: those matching its `partialFilterExpression`,
+/// or for a `sparse` index those having at least one of its key fields. `None` when it
+/// holds them all.
+fn index_filter(spec: &serde_json::Value) -> Option<bson::Document> {
+    if let Some(bson::Bson::Document(filter)) =
+        spec.get("partialFilterExpression").map(json_to_bson)
+        && !filter.is_empty()
+    {
+        return Some(filter);
+    }
+    if !index_is_sparse(spec) {
+        return None;
+    }
+    let mut present: Vec<bson::Document> = spec
+        .get("key")
+        .and_then(|k| k.as_object())?
+        .keys()
+        .map(|field| bson::doc! {field.as_str(): {"$exists": true}})
+        .collect();
+    match present.len() {
+        0 => None,
+        1 => present.pop(),
+        _ => Some(bson::doc! {"$or": present}),
+    }
+}
+
+fn index_is_sparse(spec: &serde_json::Value) -> bool {
+    spec.get("sparse")
+        .and_then(|v| v.as_bool())
+        .unwrap_or(false)
+}
+
+fn index_is_unique(spec: &serde_json::Value) -> bool {
+    spec.get("unique")
+        .and_then(|v| v.as_bool())
+        .unwrap_or(false)
+}
+
+/// Index element for `field` in a unique index. It keeps the JSON value so `1` and `"1"`
+/// stay distinct keys, and keys a missing field as `null` so, like MongoDB, only one
+/// indexed document may lack it; a sparse index leaves such documents out altogether.
+/// Under a case-insensitive collation the key is the JSON type and the lower-cased text,
+/// so strings differing only in case collide.
+fn unique_index_elem(field: &str, collation: Option<&Collation>) -> String {
+    let value = field_expr(field, false);
+    match collation {
+        Some(c) if c.case_insensitive() => format!(
+            "(COALESCE(jsonb_typeof({}), 'null') || ':' || lower(COALESCE({}, '')))",
+            value,
+            field_text_expr(field)
+        ),
+        _ => format!("COALESCE({}, 'null'::jsonb)", value),
+    }
+}
+
+/// Text of `field` as used by case-insensitive comparisons, sorts and collated indexes;
+/// they must all produce the same expression for PostgreSQL to use the index.
+fn collated_text_expr(field: &str) -> String {
+    format!("lower({})", field_text_expr(field))
+}
+
+fn field_text_expr(field: &str) -> String {
+    field_expr(field, true)
+}
+
+fn field_is_string(field: &str) -> String {
+    format!("jsonb_typeof({}) = 'string'", field_expr(field, false))
+}
 
-    // Extract field name from JSONPath format $.”field” or $."field"
-    // Remove leading '$' and extract quoted segments
-    let field_name = if let Some(stripped) = path.strip_prefix("$.") {
-        // Extract content between quotes: $."field" -> field
-        stripped
-            .split(".")
-            .map(|s| s.trim_matches('"'))
-            .collect::<Vec<_>>()
-            .join(".")
+/// `doc->'f'` / `doc #> '{a,b}'` (or the `->>` / `#>>` text forms) for a dotted field path.
+fn field_expr(field: &str, as_text: bool) -> String {
+    let (path_op, key_op) = if as_text {
+        ("#>>", "->>")
     } else {
-        path.trim_start_matches('$').to_string()
+        ("#>", "->")
     };
-    let escaped_path = escape_single(&field_name);
+    if field.contains('.') {
+        format!("(doc {} {})", path_op, pg_path_literal(field))
+    } else {
+        format!("(doc{}'{}')", key_op, escape_single(field))
+    }
+}
+
+/// `field <op> value` ignoring case; only string values of `field` qualify.
+fn ci_string_compare(field: &str, op_sql: &str, value: &str) -> String {
+    format!(
+        "({} AND {} {} {})",
+        field_is_string(field),
+        collated_text_expr(field),
+        op_sql,
+        sql_quote(&value.to_lowercase())
+    )
+}
+
+fn ci_string_in(field: &str, values: &[&str]) -> String {
+    let lits: Vec<String> = values
+        .iter()
+        .map(|v| sql_quote(&v.to_lowercase()))
+        .collect();
+    format!(
+        "({} AND {} IN ({}))",
+        field_is_string(field),
+        collated_text_expr(field),
+        lits.join(", ")
+    )
+}
 
+fn build_regex_clause(field: &str, pattern: &str, flags: &str) -> String {
     // Build PostgreSQL regex flags
     let mut pg_flags = String::new();
     if flags.contains('i') {
@@ -1818,14 +4515,25 @@ fn build_regex_clause(path: &str, pattern: &str, flags: &str) -> String {
         format!("(?{})", pg_flags)
     };
 
-    // Use ~ operator for regex matching
-    format!(
-        "(doc->>'{}') ~ '{}{}'",
-        escaped_path, flag_prefix, escaped_pattern
-    )
+    // Use ~ operator for regex matching; an anchored literal prefix also becomes a range
+    // the B-tree index on the field can serve
+    let text = field_text_expr(field);
+    let regex = format!(
+        "{} ~ {}",
+        text,
+        sql_quote(&format!("{}{}", flag_prefix, pattern))
+    );
+    match crate::translate::regex_prefix_range(&text, pattern, flags) {
+        Some(range) => format!("({} AND {})", range, regex),
+        None => regex,
+    }
 }
 
 fn build_order_by(sort: Option<&bson::Document>) -> String {
+    build_order_by_collated(sort, None)
+}
+
+fn build_order_by_collated(sort: Option<&bson::Document>, collation: Option<&Collation>) -> String {
     let mut parts: Vec<String> = Vec::new();
     let mut has_id = false;
     if let Some(spec) = sort {
@@ -1846,6 +4554,10 @@ fn build_order_by(sort: Option<&bson::Document>) -> String {
             if k == "_id" {
                 has_id = true;
                 parts.push(format!("id {}", ord));
+            } else if k == "$natural" {
+                // Insertion order is total, so no `id` tiebreak is needed
+                has_id = true;
+                parts.push(format!("seq {}", ord));
             } else {
                 let f = escape_single(k);
                 // Heuristic: numbers before strings, then numeric ASC/DESC, then text ASC/DESC
@@ -1855,7 +4567,15 @@ fn build_order_by(sort: Option<&bson::Document>) -> String {
                     "(CASE WHEN {} THEN (doc->>'{}')::double precision END) {}",
                     numeric_re, f, ord
                 );
-                let text_val = format!("(doc->>'{}') {}", f, ord);
+                let text_val = match collation {
+                    Some(c) if c.case_insensitive() => {
+                        format!("{} {}", collated_text_expr(k), ord)
+                    }
+                    Some(c) if !c.is_simple() => {
+                        format!("(doc->>'{}') {} {}", f, c.to_collate_clause(), ord)
+                    }
+                    _ => format!("(doc->>'{}') {}", f, ord),
+                };
                 parts.push(num_first);
                 parts.push(num_val);
                 parts.push(text_val);
@@ -1925,11 +4645,17 @@ fn projection_pushdown_sql(projection: Option<&bson::Document>) -> Option<String
         elems.push("'_id', doc->'_id'".to_string());
     }
     for (field_name, sql_expr) in include_fields {
-        elems.push(format!("'{}', {}", escape_single(&field_name), sql_expr));
+        elems.push(format!("{}, {}", sql_quote(&field_name), sql_expr));
     }
     if elems.is_empty() {
         return None;
     }
+    // Carry the numeric type tags so included fields decode with their original types
+    elems.push(format!(
+        "'{}', doc->'{}'",
+        crate::bson_type::TYPES_KEY,
+        crate::bson_type::TYPES_KEY
+    ));
     Some(format!("jsonb_build_object({})", elems.join(", ")))
 }
 
@@ -1971,38 +4697,21 @@ fn json_to_bson(v: &serde_json::Value) -> bson::Bson {
     }
 }
 
-fn to_doc_from_json(json: serde_json::Value) -> bson::Document {
+fn to_doc_from_json(mut json: serde_json::Value) -> bson::Document {
+    let tags = json
+        .as_object_mut()
+        .and_then(|m| m.remove(crate::bson_type::TYPES_KEY));
     match json_to_bson(&json) {
-        bson::Bson::Document(d) => d,
+        bson::Bson::Document(mut d) => {
+            if let Some(serde_json::Value::Object(tags)) = tags {
+                crate::bson_type::restore_tags(&mut d, &tags);
+            }
+            d
+        }
         _ => bson::Document::new(),
     }
 }
 
-fn jsonpath_path(key: &str) -> String {
-    // Build $."a"."b" style path for dotted keys
-    let mut out = String::from("$");
-    for seg in key.split('.') {
-        let esc = seg.replace('"', "\\\"");
-        out.push_str(".\"");
-        out.push_str(&esc);
-        out.push('"');
-    }
-    out
-}
-
-fn json_literal_from_bson(v: &bson::Bson) -> Option<String> {
-    // Only simple scalar types for now
-    match v {
-        bson::Bson::Null => Some("null".to_string()),
-        bson::Bson::Boolean(b) => Some(if *b { "true".into() } else { "false".into() }),
-        bson::Bson::Int32(n) => Some(n.to_string()),
-        bson::Bson::Int64(n) => Some(n.to_string()),
-        bson::Bson::Double(n) => Some(n.to_string()),
-        bson::Bson::String(s) => Some((serde_json::to_string(s).ok()?).to_string()),
-        _ => None,
-    }
-}
-
 fn id_bytes_from_bson(b: &bson::Bson) -> Option<Vec<u8>> {
     match b {
         bson::Bson::ObjectId(oid) => Some(oid.bytes().to_vec()),
@@ -2218,16 +4927,19 @@ impl PgStore {
             ));
         }
 
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let where_sql = build_where_from_filter(filter);
-        let order_sql = build_order_by(sort);
-        let sql = format!(
-            "SELECT id, doc_bson, doc FROM {}.{} WHERE {} {} LIMIT 1 FOR UPDATE",
-            q_schema, q_table, where_sql, order_sql
-        );
-        match tx.query(&sql, &[]).await {
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let stmt = bind_sql(0, || {
+            format!(
+                "SELECT id, doc_bson, doc FROM {}.{} WHERE {} {} LIMIT 1 FOR UPDATE",
+                q_schema,
+                q_table,
+                build_where_from_filter(filter),
+                build_order_by(sort)
+            )
+        });
+        match query_bound(tx, &stmt, &[]).await {
             Ok(rows) => {
                 if rows.is_empty() {
                     return Ok(None);
@@ -2266,17 +4978,18 @@ impl PgStore {
         id: &[u8],
         new_doc: &bson::Document,
     ) -> Result<u64> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         let sql = format!(
             "UPDATE {}.{} SET doc_bson = $1, doc = $2 WHERE id = $3",
             q_schema, q_table
         );
         let bson_bytes = bson::to_vec(new_doc).map_err(err_msg)?;
-        let json = serde_json::to_value(new_doc).map_err(err_msg)?;
+        let json = crate::bson_type::to_jsonb(new_doc).map_err(err_msg)?;
         let n = tx
-            .execute(&sql, &[&bson_bytes, &json, &id])
+            .execute(&annotate_sql(&sql), &[&bson_bytes, &json, &id])
+            .instrument(sql_span(&sql))
             .await
             .map_err(err_msg)?;
         Ok(n)
@@ -2291,15 +5004,16 @@ impl PgStore {
         bson_bytes: &[u8],
         json: &serde_json::Value,
     ) -> Result<u64> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         let sql = format!(
             "INSERT INTO {}.{} (id, doc_bson, doc) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING",
             q_schema, q_table
         );
         let n = tx
-            .execute(&sql, &[&id, &bson_bytes, &json])
+            .execute(&annotate_sql(&sql), &[&id, &bson_bytes, &json])
+            .instrument(sql_span(&sql))
             .await
             .map_err(err_msg)?;
         Ok(n)
@@ -2312,11 +5026,15 @@ impl PgStore {
         coll: &str,
         id: &[u8],
     ) -> Result<u64> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         let sql = format!("DELETE FROM {}.{} WHERE id = $1", q_schema, q_table);
-        let n = tx.execute(&sql, &[&id]).await.map_err(err_msg)?;
+        let n = tx
+            .execute(&annotate_sql(&sql), &[&id])
+            .instrument(sql_span(&sql))
+            .await
+            .map_err(err_msg)?;
         Ok(n)
     }
 
@@ -2331,9 +5049,9 @@ impl PgStore {
         json: &serde_json::Value,
     ) -> Result<u64> {
         self.ensure_collection(db, coll).await?;
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         let sql = format!(
             "INSERT INTO {}.{} (id, doc_bson, doc) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING",
             q_schema, q_table
@@ -2341,13 +5059,15 @@ impl PgStore {
         let t = Instant::now();
         let n = if let Some(transaction) = tx {
             transaction
-                .execute(&sql, &[&id, &bson_bytes, &json])
+                .execute(&annotate_sql(&sql), &[&id, &bson_bytes, &json])
+                .instrument(sql_span(&sql))
                 .await
                 .map_err(err_msg)?
         } else {
-            let client = self.pool.get().await.map_err(err_msg)?;
+            let client = self.client().await?;
             client
-                .execute(&sql, &[&id, &bson_bytes, &json])
+                .execute(&annotate_sql(&sql), &[&id, &bson_bytes, &json])
+                .instrument(sql_span(&sql))
                 .await
                 .map_err(err_msg)?
         };
@@ -2364,25 +5084,27 @@ impl PgStore {
         id: &[u8],
         new_doc: &bson::Document,
     ) -> Result<u64> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         let sql = format!(
             "UPDATE {}.{} SET doc_bson = $1, doc = $2 WHERE id = $3",
             q_schema, q_table
         );
         let bson_bytes = bson::to_vec(new_doc).map_err(err_msg)?;
-        let json = serde_json::to_value(new_doc).map_err(err_msg)?;
+        let json = crate::bson_type::to_jsonb(new_doc).map_err(err_msg)?;
         let t = Instant::now();
         let n = if let Some(transaction) = tx {
             transaction
-                .execute(&sql, &[&bson_bytes, &json, &id])
+                .execute(&annotate_sql(&sql), &[&bson_bytes, &json, &id])
+                .instrument(sql_span(&sql))
                 .await
                 .map_err(err_msg)?
         } else {
-            let client = self.pool.get().await.map_err(err_msg)?;
+            let client = self.client().await?;
             client
-                .execute(&sql, &[&bson_bytes, &json, &id])
+                .execute(&annotate_sql(&sql), &[&bson_bytes, &json, &id])
+                .instrument(sql_span(&sql))
                 .await
                 .map_err(err_msg)?
         };
@@ -2398,16 +5120,24 @@ impl PgStore {
         coll: &str,
         id: &[u8],
     ) -> Result<u64> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
+        let q_table = q_ident(&self.mapping.table(db, coll));
         let sql = format!("DELETE FROM {}.{} WHERE id = $1", q_schema, q_table);
         let t = Instant::now();
         let n = if let Some(transaction) = tx {
-            transaction.execute(&sql, &[&id]).await.map_err(err_msg)?
+            transaction
+                .execute(&annotate_sql(&sql), &[&id])
+                .instrument(sql_span(&sql))
+                .await
+                .map_err(err_msg)?
         } else {
-            let client = self.pool.get().await.map_err(err_msg)?;
-            client.execute(&sql, &[&id]).await.map_err(err_msg)?
+            let client = self.client().await?;
+            client
+                .execute(&annotate_sql(&sql), &[&id])
+                .instrument(sql_span(&sql))
+                .await
+                .map_err(err_msg)?
         };
         tracing::debug!(op="delete_by_id_tx_opt", db=%db, coll=%coll, elapsed_ms=?t.elapsed().as_millis());
         Ok(n)
@@ -2425,48 +5155,29 @@ impl PgStore {
         projection: Option<&bson::Document>,
         limit: i64,
     ) -> Result<Vec<bson::Document>> {
-        let schema = schema_name(db);
+        let schema = self.mapping.schema(db);
         let q_schema = q_ident(&schema);
-        let q_table = q_ident(coll);
-        let where_sql = filter.map(build_where_from_filter);
-        let order_sql = build_order_by(sort);
+        let q_table = q_ident(&self.mapping.table(db, coll));
+        let stmt = bind_sql(0, || {
+            let where_sql = filter
+                .map(build_where_from_filter)
+                .unwrap_or_else(|| "TRUE".to_string());
+            format!(
+                "SELECT doc_bson, doc FROM {}.{} WHERE {} {} LIMIT {}",
+                q_schema,
+                q_table,
+                where_sql,
+                build_order_by(sort),
+                limit
+            )
+        });
 
         let t = Instant::now();
         let res = if let Some(transaction) = tx {
-            match &where_sql {
-                Some(where_clause) => {
-                    let sql = format!(
-                        "SELECT doc_bson, doc FROM {}.{} WHERE {} {} LIMIT {}",
-                        q_schema, q_table, where_clause, order_sql, limit
-                    );
-                    transaction.query(&sql, &[]).await
-                }
-                None => {
-                    let sql = format!(
-                        "SELECT doc_bson, doc FROM {}.{} WHERE TRUE {} LIMIT {}",
-                        q_schema, q_table, order_sql, limit
-                    );
-                    transaction.query(&sql, &[]).await
-                }
-            }
+            query_bound(transaction, &stmt, &[]).await
         } else {
-            let client = self.pool.get().await.map_err(err_msg)?;
-            match &where_sql {
-                Some(where_clause) => {
-                    let sql = format!(
-                        "SELECT doc_bson, doc FROM {}.{} WHERE {} {} LIMIT {}",
-                        q_schema, q_table, where_clause, order_sql, limit
-                    );
-                    client.query(&sql, &[]).await
-                }
-                None => {
-                    let sql = format!(
-                        "SELECT doc_bson, doc FROM {}.{} WHERE TRUE {} LIMIT {}",
-                        q_schema, q_table, order_sql, limit
-                    );
-                    client.query(&sql, &[]).await
-                }
-            }
+            let client = self.client().await?;
+            query_bound(&**client, &stmt, &[]).await
         };
 
         let rows = match res {
@@ -2513,6 +5224,10 @@ impl PgStore {
         g.contains(db)
     }
     async fn mark_db_known(&self, db: &str) {
+        // What a dry run creates is rolled back
+        if dry_run_active() {
+            return;
+        }
         let mut g = self.databases_cache.write().await;
         g.insert(db.to_string());
     }
@@ -2521,12 +5236,43 @@ impl PgStore {
         g.contains(&(db.to_string(), coll.to_string()))
     }
     async fn mark_collection_known(&self, db: &str, coll: &str) {
+        if dry_run_active() {
+            return;
+        }
         let mut g = self.collections_cache.write().await;
         g.insert((db.to_string(), coll.to_string()));
     }
+    /// Forget a dropped collection (or every collection of a dropped `db`) so the next
+    /// write recreates its table instead of trusting the known-collection cache.
+    async fn forget_collection(&self, db: &str, coll: Option<&str>) {
+        let mut g = self.collections_cache.write().await;
+        g.retain(|(d, c)| d != db || coll.is_some_and(|coll| coll != c));
+        drop(g);
+        self.forget_collation(db, coll).await;
+    }
+    /// Drop cached default collations, view definitions, `autoIncrement` fields and validators
+    /// for one collection, or for all of `db`.
+    async fn forget_collation(&self, db: &str, coll: Option<&str>) {
+        let mut g = self.collation_cache.write().await;
+        g.retain(|(d, c), _| d != db || coll.is_some_and(|coll| coll != c));
+        drop(g);
+        let mut g = self.view_cache.write().await;
+        g.retain(|(d, c), _| d != db || coll.is_some_and(|coll| coll != c));
+        drop(g);
+        let mut g = self.auto_increment_cache.write().await;
+        g.retain(|(d, c), _| d != db || coll.is_some_and(|coll| coll != c));
+        drop(g);
+        let mut g = self.validator_cache.write().await;
+        g.retain(|(d, c), _| d != db || coll.is_some_and(|coll| coll != c));
+    }
 }
 
-/// Collation configuration for sorting
+/// Collation configuration for queries, sorts and indexes.
+///
+/// Only `locale` and `strength` are honoured: strength 2 (case-insensitive) compares
+/// `lower()`-ed text, strength 3 orders with the matching ICU collation and the `simple`
+/// locale keeps binary comparison. Other options are rejected by [`Collation::parse`].
+#[derive(Debug, Clone, PartialEq)]
 pub struct Collation {
     pub locale: String,
     pub strength: Option<i32>,
@@ -2542,15 +5288,106 @@ impl Collation {
         })
     }
 
+    /// Validate a command's `collation` document, erroring on options we cannot honour.
+    pub fn parse(doc: &bson::Document) -> Result<Self> {
+        let locale = doc
+            .get_str("locale")
+            .map_err(|_| Error::Msg("collation must specify a string locale".into()))?;
+        if locale.is_empty()
+            || !locale
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || c == '_' || c == '-')
+        {
+            return Err(Error::Msg(format!(
+                "unsupported collation locale: {}",
+                locale
+            )));
+        }
+        let strength = match doc.get("strength") {
+            None => None,
+            Some(bson::Bson::Int32(n)) => Some(*n),
+            Some(bson::Bson::Int64(n)) => Some(*n as i32),
+            Some(bson::Bson::Double(f)) if f.fract() == 0.0 => Some(*f as i32),
+            Some(_) => return Err(Error::Msg("collation strength must be a number".into())),
+        };
+        if let Some(s) = strength
+            && s != 2
+            && s != 3
+        {
+            return Err(Error::Msg(format!(
+                "unsupported collation strength {}; only 2 and 3 are supported",
+                s
+            )));
+        }
+        for (k, v) in doc.iter() {
+            let supported = match k.as_str() {
+                "locale" | "strength" | "version" => true,
+                "caseLevel" | "numericOrdering" | "backwards" | "normalization" => {
+                    matches!(v, bson::Bson::Boolean(false))
+                }
+                "caseFirst" => v.as_str() == Some("off"),
+                "alternate" => v.as_str() == Some("non-ignorable"),
+                _ => false,
+            };
+            if !supported {
+                return Err(Error::Msg(format!("unsupported collation option: {}", k)));
+            }
+        }
+        Ok(Collation {
+            locale: locale.to_string(),
+            strength,
+        })
+    }
+
+    /// The `simple` locale is plain binary comparison, i.e. no collation at all.
+    pub fn is_simple(&self) -> bool {
+        self.locale == "simple"
+    }
+
+    /// Strength 1/2 collations ignore case; only strength 2 is accepted by `parse`.
+    pub fn case_insensitive(&self) -> bool {
+        !self.is_simple() && matches!(self.strength, Some(s) if s <= 2)
+    }
+
     pub fn to_collate_clause(&self) -> String {
-        format!("COLLATE \"{}\"", self.locale)
+        // PostgreSQL names ICU collations `<bcp47 tag>-x-icu`, e.g. "en-US-x-icu"
+        format!("COLLATE \"{}-x-icu\"", self.locale.replace('_', "-"))
     }
 }
 
 // --- Geospatial query helper functions ---
 
+/// Radius of the sphere distances are measured on, in meters; PostGIS's own when it
+/// computes `geography` distances without the spheroid.
+const EARTH_RADIUS_METERS: f64 = 6_371_008.771_4;
+
+/// Longitude (`axis` 0) or latitude (1) of the point `field` holds, as a GeoJSON `Point`
+/// or a legacy `[lon, lat]` pair; NULL for anything else.
+fn geo_coordinate_sql(field: &str, axis: u8) -> String {
+    let coords = format!(
+        "COALESCE(doc->'{f}'->'coordinates', doc->'{f}')",
+        f = escape_single(field)
+    );
+    format!(
+        "(CASE WHEN jsonb_typeof({c}->{a}) = 'number' THEN ({c}->>{a})::float8 END)",
+        c = coords,
+        a = axis
+    )
+}
+
+/// The point `field` holds as a PostGIS `geography`: the expression a 2dsphere index's
+/// GiST index is built on, so queries must spell it the same way.
+fn geography_sql(field: &str) -> String {
+    format!(
+        "geography(ST_SetSRID(ST_MakePoint({}, {}), 4326))",
+        geo_coordinate_sql(field, 0),
+        geo_coordinate_sql(field, 1)
+    )
+}
+
 /// Build SQL clause for $geoWithin with GeoJSON geometry (using bson::Array)
 fn build_geo_within_clause(field: &str, geom_type: &str, coords: &bson::Array) -> String {
+    let field = escape_single(field);
     match geom_type {
         "Polygon" => {
             // Extract bounding box from polygon coordinates
@@ -2590,6 +5427,7 @@ fn build_geo_within_clause(field: &str, geom_type: &str, coords: &bson::Array) -
 
 /// Build SQL clause for legacy $box operator (using bson::Array)
 fn build_geo_box_clause(field: &str, box_coords: &bson::Array) -> String {
+    let field = escape_single(field);
     if box_coords.len() >= 2 {
         let bottom_left = box_coords[0].as_array();
         let top_right = box_coords[1].as_array();
@@ -2626,6 +5464,7 @@ fn build_geo_box_clause(field: &str, box_coords: &bson::Array) -> String {
 
 /// Build SQL clause for legacy $polygon operator (using bson::Array)
 fn build_geo_polygon_clause(field: &str, poly_coords: &bson::Array) -> String {
+    let field = escape_single(field);
     // Compute bounding box from all polygon vertices
     let (min_lon, max_lon, min_lat, max_lat) = extract_bounding_box_bson(poly_coords);
 
@@ -2647,6 +5486,7 @@ fn build_near_clause(
     max_distance: Option<f64>,
     _spherical: bool,
 ) -> String {
+    let field = escape_single(field);
     // Build the clause using bounding box for efficiency
     if let Some(max_dist) = max_distance {
         // For spherical calculations, convert distance from meters to degrees approximately
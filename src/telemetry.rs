@@ -0,0 +1,135 @@
+//! Optional OpenTelemetry export of the `command` / `pg.query` tracing spans over OTLP.
+//!
+//! The export itself is behind the `otel` cargo feature; trace-context extraction is always
+//! compiled so it can be tested without the exporter stack.
+
+use bson::{Bson, Document};
+use std::collections::HashMap;
+
+/// W3C trace-context headers accepted from a command.
+const TRACE_HEADERS: [&str; 2] = ["traceparent", "tracestate"];
+
+/// Collect W3C trace-context values carried by a command, looking at `comment` first and
+/// then `$clusterTime`. A document `comment` may hold `traceparent`/`tracestate` fields; a
+/// string `comment` may embed them as `traceparent=<value>` tokens.
+pub fn trace_carrier(cmd: &Document) -> HashMap<String, String> {
+    let mut carrier = HashMap::new();
+    match cmd.get("comment") {
+        Some(Bson::Document(d)) => collect_fields(d, &mut carrier),
+        Some(Bson::String(s)) => {
+            for token in s.split(|c: char| c.is_whitespace() || c == ';' || c == ',') {
+                if let Some((k, v)) = token.split_once('=')
+                    && TRACE_HEADERS.contains(&k)
+                    && !v.is_empty()
+                {
+                    carrier.insert(k.to_string(), v.to_string());
+                }
+            }
+        }
+        _ => {}
+    }
+    if carrier.is_empty()
+        && let Ok(cluster_time) = cmd.get_document("$clusterTime")
+    {
+        collect_fields(cluster_time, &mut carrier);
+    }
+    carrier
+}
+
+fn collect_fields(doc: &Document, carrier: &mut HashMap<String, String>) {
+    for key in TRACE_HEADERS {
+        if let Ok(v) = doc.get_str(key) {
+            carrier.insert(key.to_string(), v.to_string());
+        }
+    }
+}
+
+/// Parent `span` on the remote trace context carried by `cmd`, if any.
+#[cfg(feature = "otel")]
+pub fn set_remote_parent(span: &tracing::Span, cmd: &Document) {
+    use opentelemetry::propagation::TextMapPropagator;
+    use tracing_opentelemetry::OpenTelemetrySpanExt;
+
+    let carrier = trace_carrier(cmd);
+    if carrier.is_empty() {
+        return;
+    }
+    let cx = opentelemetry_sdk::propagation::TraceContextPropagator::new().extract(&carrier);
+    span.set_parent(cx);
+}
+
+#[cfg(not(feature = "otel"))]
+pub fn set_remote_parent(_span: &tracing::Span, _cmd: &Document) {}
+
+/// Build a `tracing` layer exporting spans to the OTLP/gRPC collector at `endpoint`.
+#[cfg(feature = "otel")]
+pub fn otlp_layer<S>(endpoint: &str) -> crate::error::Result<impl tracing_subscriber::Layer<S>>
+where
+    S: tracing::Subscriber + for<'span> tracing_subscriber::registry::LookupSpan<'span>,
+{
+    use crate::error::Error;
+    use opentelemetry::KeyValue;
+    use opentelemetry::trace::TracerProvider as _;
+    use opentelemetry_otlp::WithExportConfig;
+    use opentelemetry_sdk::Resource;
+    use opentelemetry_sdk::trace::TracerProvider;
+
+    let exporter = opentelemetry_otlp::SpanExporter::builder()
+        .with_tonic()
+        .with_endpoint(endpoint)
+        .build()
+        .map_err(|e| Error::Msg(format!("failed to build OTLP exporter: {}", e)))?;
+    let provider = TracerProvider::builder()
+        .with_batch_exporter(exporter, opentelemetry_sdk::runtime::Tokio)
+        .with_resource(Resource::new(vec![KeyValue::new(
+            "service.name",
+            "oxidedb",
+        )]))
+        .build();
+    let tracer = provider.tracer("oxidedb");
+    opentelemetry::global::set_tracer_provider(provider);
+    Ok(tracing_opentelemetry::layer().with_tracer(tracer))
+}
+
+/// Flush pending spans; call once before the process exits.
+#[cfg(feature = "otel")]
+pub fn shutdown() {
+    opentelemetry::global::shutdown_tracer_provider();
+}
+
+#[cfg(not(feature = "otel"))]
+pub fn shutdown() {}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bson::doc;
+
+    const TP: &str = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01";
+
+    #[test]
+    fn reads_trace_context_from_document_comment() {
+        let cmd = doc! {"find": "c", "comment": {"traceparent": TP, "tracestate": "k=v"}};
+        let carrier = trace_carrier(&cmd);
+        assert_eq!(carrier.get("traceparent").map(String::as_str), Some(TP));
+        assert_eq!(carrier.get("tracestate").map(String::as_str), Some("k=v"));
+    }
+
+    #[test]
+    fn reads_trace_context_from_string_comment() {
+        let cmd = doc! {"find": "c", "comment": format!("nightly-report traceparent={}", TP)};
+        let carrier = trace_carrier(&cmd);
+        assert_eq!(carrier.get("traceparent").map(String::as_str), Some(TP));
+        assert!(!carrier.contains_key("tracestate"));
+    }
+
+    #[test]
+    fn falls_back_to_cluster_time_and_ignores_plain_comments() {
+        let cmd = doc! {"find": "c", "comment": "just a note", "$clusterTime": {"traceparent": TP}};
+        assert_eq!(
+            trace_carrier(&cmd).get("traceparent").map(String::as_str),
+            Some(TP)
+        );
+        assert!(trace_carrier(&doc! {"find": "c", "comment": "just a note"}).is_empty());
+    }
+}
@@ -1,5 +1,39 @@
 use serde_json::{Map, Value};
 
+tokio::task_local! {
+    /// Values bound by the statement being generated under [`bind_sql`].
+    static BOUND_VALUES: std::cell::RefCell<BoundValues>;
+}
+
+struct BoundValues {
+    /// Number of the first parameter left to the translator
+    first: usize,
+    values: Vec<String>,
+}
+
+/// A generated statement and the values it binds: `sql` refers to `params[i]` as the
+/// `$n::text` parameter numbered `i` past those its caller binds itself.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct BoundSql {
+    pub sql: String,
+    pub params: Vec<String>,
+}
+
+/// Generate a statement with `build`, whose caller binds `$1` to `$caller_params` itself.
+/// Every value [`sql_quote`]d meanwhile becomes the next `$n::text` parameter instead of
+/// part of the SQL text, so the statement's text depends only on the query's shape.
+pub fn bind_sql(caller_params: usize, build: impl FnOnce() -> String) -> BoundSql {
+    let values = BoundValues {
+        first: caller_params + 1,
+        values: Vec::new(),
+    };
+    BOUND_VALUES.sync_scope(std::cell::RefCell::new(values), || {
+        let sql = build();
+        let params = BOUND_VALUES.with(|v| std::mem::take(&mut v.borrow_mut().values));
+        BoundSql { sql, params }
+    })
+}
+
 pub enum WhereSpec {
     Raw(String),
     Containment(serde_json::Value),
@@ -91,6 +125,12 @@ pub fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool
         }
     }
 
+    // Commands that evaluate `$expr` elsewhere check `expr_filters_translate` first; anything
+    // left untranslatable here must not widen the match.
+    if let Some(expr) = filter.get("$expr") {
+        where_clauses.push(translate_expr_filter(expr).unwrap_or_else(|| "FALSE".to_string()));
+    }
+
     // Note: $text operator is handled at the server layer (server.rs) to ensure
     // it uses the correct text index fields. Do not handle $text here.
 
@@ -108,18 +148,15 @@ pub fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool
                             if let bson::Bson::Document(em) = val
                                 && let Some(pred) = build_elem_match_pred(&path, em)
                             {
-                                where_clauses.push(format!(
-                                    "jsonb_path_exists(doc, '{}') ? ({} ))",
-                                    escape_single(&path),
-                                    pred
-                                ));
+                                where_clauses
+                                    .push(jsonpath_exists(&format!("{}[*] ? ({} )", path, pred)));
                             }
                         }
                         "$exists" => {
                             let clause = if matches!(val, bson::Bson::Boolean(true)) {
-                                format!("jsonb_path_exists(doc, '{}')", escape_single(&path))
+                                jsonpath_exists(&path)
                             } else {
-                                format!("NOT jsonb_path_exists(doc, '{}')", escape_single(&path))
+                                format!("NOT {}", jsonpath_exists(&path))
                             };
                             where_clauses.push(clause);
                         }
@@ -135,32 +172,18 @@ pub fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool
                                     where_clauses.push("FALSE".to_string());
                                 } else {
                                     let predicate = preds.join(" || ");
-                                    let p1 = format!(
-                                        "jsonb_path_exists(doc, '{} ? ({} )')",
-                                        escape_single(&path),
-                                        predicate
-                                    );
-                                    let p2 = format!(
-                                        "jsonb_path_exists(doc, '{}[*] ? ({} )')",
-                                        escape_single(&path),
-                                        predicate
-                                    );
+                                    let p1 =
+                                        jsonpath_exists(&format!("{} ? ({} )", path, predicate));
+                                    let p2 =
+                                        jsonpath_exists(&format!("{}[*] ? ({} )", path, predicate));
                                     where_clauses.push(format!("({} OR {})", p1, p2));
                                 }
                             }
                         }
                         "$ne" => {
                             if let Some(lit) = json_literal_from_bson(val) {
-                                let p1 = format!(
-                                    "jsonb_path_exists(doc, '{} ? (@ != {} )')",
-                                    escape_single(&path),
-                                    lit
-                                );
-                                let p2 = format!(
-                                    "jsonb_path_exists(doc, '{}[*] ? (@ != {} )')",
-                                    escape_single(&path),
-                                    lit
-                                );
+                                let p1 = jsonpath_exists(&format!("{} ? (@ != {} )", path, lit));
+                                let p2 = jsonpath_exists(&format!("{}[*] ? (@ != {} )", path, lit));
                                 where_clauses.push(format!("({} OR {})", p1, p2));
                             }
                         }
@@ -176,16 +199,10 @@ pub fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool
                                     where_clauses.push("TRUE".to_string());
                                 } else {
                                     let predicate = preds.join(" && ");
-                                    let p1 = format!(
-                                        "jsonb_path_exists(doc, '{} ? ({} )')",
-                                        escape_single(&path),
-                                        predicate
-                                    );
-                                    let p2 = format!(
-                                        "jsonb_path_exists(doc, '{}[*] ? ({} )')",
-                                        escape_single(&path),
-                                        predicate
-                                    );
+                                    let p1 =
+                                        jsonpath_exists(&format!("{} ? ({} )", path, predicate));
+                                    let p2 =
+                                        jsonpath_exists(&format!("{}[*] ? ({} )", path, predicate));
                                     where_clauses.push(format!("({} AND {})", p1, p2));
                                 }
                             }
@@ -194,7 +211,7 @@ pub fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool
                             if let bson::Bson::String(pattern) = val {
                                 let flags =
                                     d.get("$options").and_then(|o| o.as_str()).unwrap_or("");
-                                let regex_clause = build_regex_clause(&path, pattern, flags);
+                                let regex_clause = build_regex_clause(k, pattern, flags);
                                 where_clauses.push(regex_clause);
                             }
                         }
@@ -203,16 +220,12 @@ pub fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool
                                 let mut all_clauses: Vec<String> = Vec::new();
                                 for item in arr {
                                     if let Some(lit) = json_literal_from_bson(item) {
-                                        let p1 = format!(
-                                            "jsonb_path_exists(doc, '{} ? (@ == {} )')",
-                                            escape_single(&path),
-                                            lit
-                                        );
-                                        let p2 = format!(
-                                            "jsonb_path_exists(doc, '{}[*] ? (@ == {} )')",
-                                            escape_single(&path),
-                                            lit
-                                        );
+                                        let p1 =
+                                            jsonpath_exists(&format!("{} ? (@ == {} )", path, lit));
+                                        let p2 = jsonpath_exists(&format!(
+                                            "{}[*] ? (@ == {} )",
+                                            path, lit
+                                        ));
                                         all_clauses.push(format!("({} OR {})", p1, p2));
                                     }
                                 }
@@ -245,33 +258,19 @@ pub fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool
                                 _ => unreachable!(),
                             };
                             if let Some(lit) = json_literal_from_bson(val) {
-                                let p1 = format!(
-                                    "jsonb_path_exists(doc, '{} ? (@ {} {} )')",
-                                    escape_single(&path),
-                                    op_sql,
-                                    lit
-                                );
-                                let p2 = format!(
-                                    "jsonb_path_exists(doc, '{}[*] ? (@ {} {} )')",
-                                    escape_single(&path),
-                                    op_sql,
-                                    lit
-                                );
+                                let p1 =
+                                    jsonpath_exists(&format!("{} ? (@ {} {} )", path, op_sql, lit));
+                                let p2 = jsonpath_exists(&format!(
+                                    "{}[*] ? (@ {} {} )",
+                                    path, op_sql, lit
+                                ));
                                 where_clauses.push(format!("({} OR {})", p1, p2));
                             }
                         }
                         "$eq" => {
                             if let Some(lit) = json_literal_from_bson(val) {
-                                let p1 = format!(
-                                    "jsonb_path_exists(doc, '{} ? (@ == {} )')",
-                                    escape_single(&path),
-                                    lit
-                                );
-                                let p2 = format!(
-                                    "jsonb_path_exists(doc, '{}[*] ? (@ == {} )')",
-                                    escape_single(&path),
-                                    lit
-                                );
+                                let p1 = jsonpath_exists(&format!("{} ? (@ == {} )", path, lit));
+                                let p2 = jsonpath_exists(&format!("{}[*] ? (@ == {} )", path, lit));
                                 where_clauses.push(format!("({} OR {})", p1, p2));
                             }
                         }
@@ -370,16 +369,8 @@ pub fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool
             }
             _ => {
                 if let Some(lit) = json_literal_from_bson(v) {
-                    let p1 = format!(
-                        "jsonb_path_exists(doc, '{} ? (@ == {} )')",
-                        escape_single(&path),
-                        lit
-                    );
-                    let p2 = format!(
-                        "jsonb_path_exists(doc, '{}[*] ? (@ == {} )')",
-                        escape_single(&path),
-                        lit
-                    );
+                    let p1 = jsonpath_exists(&format!("{} ? (@ == {} )", path, lit));
+                    let p2 = jsonpath_exists(&format!("{}[*] ? (@ == {} )", path, lit));
                     where_clauses.push(format!("({} OR {})", p1, p2));
                 }
             }
@@ -397,11 +388,9 @@ pub fn build_where_from_filter_internal(filter: &bson::Document, is_nested: bool
     }
 }
 
-fn build_regex_clause(path: &str, pattern: &str, flags: &str) -> String {
+fn build_regex_clause(field: &str, pattern: &str, flags: &str) -> String {
     // Convert MongoDB regex pattern to PostgreSQL regex
-    // Escape single quotes in pattern
-    let escaped_pattern = pattern.replace("'", "''");
-    let escaped_path = escape_single(path.trim_start_matches("$"));
+    let escaped_path = escape_single(field);
 
     // Build PostgreSQL regex flags
     let mut pg_flags = String::new();
@@ -419,10 +408,187 @@ fn build_regex_clause(path: &str, pattern: &str, flags: &str) -> String {
     };
 
     // Use ~ operator for regex matching
-    format!(
-        "(doc->>'{}') ~ '{}{}'",
-        escaped_path, flag_prefix, escaped_pattern
-    )
+    let text = format!("(doc->>'{}')", escaped_path);
+    let regex = format!(
+        "{} ~ {}",
+        text,
+        sql_quote(&format!("{}{}", flag_prefix, pattern))
+    );
+    match regex_prefix_range(&text, pattern, flags) {
+        Some(range) => format!("({} AND {})", range, regex),
+        None => regex,
+    }
+}
+
+/// Index-usable range (`text >= 'foo' AND text < 'fop'`) implied by a `^foo...` pattern,
+/// to be ANDed with the regex itself. `None` when the pattern has no anchored literal
+/// prefix or its flags change what `^` or the literal characters match.
+pub fn regex_prefix_range(text: &str, pattern: &str, flags: &str) -> Option<String> {
+    if flags.contains(['i', 'm', 'x']) {
+        return None;
+    }
+    let prefix = regex_literal_prefix(pattern)?;
+    let lower = format!("{} >= {}", text, sql_quote(&prefix));
+    // Only bump an ASCII letter or digit: its successor sorts right after it under any
+    // collation, whereas e.g. 'z' + 1 = '{' is ignorable punctuation in most locales
+    let last = prefix.chars().last()?;
+    if !last.is_ascii_alphanumeric() || matches!(last, 'z' | 'Z' | '9') {
+        return Some(lower);
+    }
+    let mut upper: String = prefix[..prefix.len() - 1].to_string();
+    upper.push((last as u8 + 1) as char);
+    Some(format!("{} AND {} < {}", lower, text, sql_quote(&upper)))
+}
+
+/// Literal text every match of `pattern` must start with, e.g. `foo` for `^foo\d+`.
+fn regex_literal_prefix(pattern: &str) -> Option<String> {
+    let rest = pattern
+        .strip_prefix('^')
+        .or_else(|| pattern.strip_prefix("\\A"))?;
+    // A top-level alternation (`^foo|bar`) is not anchored as a whole
+    if rest.contains('|') {
+        return None;
+    }
+    let mut prefix = String::new();
+    let mut chars = rest.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '\\' => match chars.peek() {
+                Some(&e) if e.is_ascii_punctuation() => {
+                    prefix.push(e);
+                    chars.next();
+                }
+                _ => break,
+            },
+            // The quantifier makes the preceding literal optional
+            '*' | '?' | '{' => {
+                prefix.pop();
+                break;
+            }
+            '.' | '[' | ']' | '(' | ')' | '+' | '^' | '$' | '}' => break,
+            _ => prefix.push(c),
+        }
+    }
+    if prefix.is_empty() {
+        None
+    } else {
+        Some(prefix)
+    }
+}
+
+/// `$expr` as a JSON path filter over the whole document, e.g.
+/// `$ ? (@."spent" > @."budget")`. Comparisons, `$and`/`$or`/`$not` and arithmetic over
+/// field paths and scalar literals translate; anything else is `None`. Like any JSON path
+/// comparison, one involving a missing field or values of different types is false, and
+/// the path runs silently so errors such as a division by zero are false too. Each
+/// `{$rand: {}}` reads a path variable drawn from `random()`, so it varies per row.
+pub fn translate_expr_filter(expr: &bson::Bson) -> Option<String> {
+    let mut rands = 0;
+    let pred = expr_predicate(expr, &mut rands)?;
+    let vars = if rands == 0 {
+        "'{}'::jsonb".to_string()
+    } else {
+        let pairs: Vec<String> = (0..rands)
+            .map(|i| format!("'rand{}', random()", i))
+            .collect();
+        format!("jsonb_build_object({})", pairs.join(", "))
+    };
+    Some(format!(
+        "jsonb_path_exists(doc, {}::jsonpath, {}, true)",
+        sql_quote(&format!("$ ? ({})", pred)),
+        vars
+    ))
+}
+
+/// Whether every `$expr` in `filter`, including those under `$and`, `$or`, `$nor` and
+/// `$not`, translates to SQL.
+pub fn expr_filters_translate(filter: &bson::Document) -> bool {
+    filter.iter().all(|(k, v)| match (k.as_str(), v) {
+        ("$expr", expr) => expr_predicate(expr, &mut 0).is_some(),
+        ("$and" | "$or" | "$nor", bson::Bson::Array(items)) => items
+            .iter()
+            .all(|item| item.as_document().is_none_or(|d| expr_filters_translate(d))),
+        ("$not", bson::Bson::Document(d)) => expr_filters_translate(d),
+        _ => true,
+    })
+}
+
+/// Operands of an `$expr` operator, which may be given bare when there is only one.
+fn expr_args(val: &bson::Bson) -> Vec<&bson::Bson> {
+    match val {
+        bson::Bson::Array(items) => items.iter().collect(),
+        other => vec![other],
+    }
+}
+
+fn expr_predicate(expr: &bson::Bson, rands: &mut usize) -> Option<String> {
+    let doc = expr.as_document()?;
+    if doc.len() != 1 {
+        return None;
+    }
+    let (op, val) = doc.iter().next()?;
+    let args = expr_args(val);
+    match op.as_str() {
+        "$and" | "$or" if !args.is_empty() => {
+            let preds = args
+                .into_iter()
+                .map(|a| expr_predicate(a, rands))
+                .collect::<Option<Vec<_>>>()?;
+            let joiner = if op == "$and" { " && " } else { " || " };
+            Some(format!("({})", preds.join(joiner)))
+        }
+        "$not" if args.len() == 1 => Some(format!("!({})", expr_predicate(args[0], rands)?)),
+        "$eq" | "$ne" | "$gt" | "$gte" | "$lt" | "$lte" if args.len() == 2 => {
+            let cmp = match op.as_str() {
+                "$eq" => "==",
+                "$ne" => "!=",
+                "$gt" => ">",
+                "$gte" => ">=",
+                "$lt" => "<",
+                _ => "<=",
+            };
+            Some(format!(
+                "({} {} {})",
+                expr_operand(args[0], rands)?,
+                cmp,
+                expr_operand(args[1], rands)?
+            ))
+        }
+        _ => None,
+    }
+}
+
+fn expr_operand(val: &bson::Bson, rands: &mut usize) -> Option<String> {
+    match val {
+        bson::Bson::String(s) if s.starts_with("$$") => None,
+        // The `$."a"."b"` path, relative to the document under test
+        bson::Bson::String(s) if s.starts_with('$') => {
+            Some(format!("@{}", &jsonpath_path(&s[1..])[1..]))
+        }
+        bson::Bson::Document(d) if d.len() == 1 => {
+            let (op, arg) = d.iter().next()?;
+            let args = expr_args(arg);
+            let arith = match op.as_str() {
+                "$literal" => return json_literal_from_bson(arg),
+                "$rand" if arg.as_document().is_some_and(|d| d.is_empty()) => {
+                    *rands += 1;
+                    return Some(format!("$rand{}", *rands - 1));
+                }
+                "$add" if !args.is_empty() => " + ",
+                "$multiply" if !args.is_empty() => " * ",
+                "$subtract" if args.len() == 2 => " - ",
+                "$divide" if args.len() == 2 => " / ",
+                _ => return None,
+            };
+            let operands = args
+                .into_iter()
+                .map(|a| expr_operand(a, rands))
+                .collect::<Option<Vec<_>>>()?;
+            Some(format!("({})", operands.join(arith)))
+        }
+        bson::Bson::Document(_) | bson::Bson::Array(_) => None,
+        other => json_literal_from_bson(other),
+    }
 }
 
 pub fn build_where_spec(filter: &bson::Document) -> WhereSpec {
@@ -583,7 +749,7 @@ pub fn projection_pushdown_sql(projection: Option<&bson::Document>) -> Option<St
         elems.push("'_id', doc->'_id'".to_string());
     }
     for (field_name, sql_expr) in include_fields {
-        elems.push(format!("'{}', {}", escape_single(&field_name), sql_expr));
+        elems.push(format!("{}, {}", sql_quote(&field_name), sql_expr));
     }
     if elems.is_empty() {
         return None;
@@ -606,7 +772,7 @@ pub fn json_value_from_bson(v: &bson::Bson) -> Option<serde_json::Value> {
 pub fn jsonpath_path(key: &str) -> String {
     let mut out = String::from("$");
     for seg in key.split('.') {
-        let esc = seg.replace('"', "\\\"");
+        let esc = seg.replace('\\', "\\\\").replace('"', "\\\"");
         out.push_str(".\"");
         out.push_str(&esc);
         out.push('"');
@@ -684,8 +850,42 @@ pub fn build_elem_match_pred(_path: &str, em: &bson::Document) -> Option<String>
     }
 }
 
+/// Escape `s` for use inside a single-quoted SQL literal. Backslashes are not special:
+/// the server runs with `standard_conforming_strings` on (the default since PostgreSQL 9.1).
 pub fn escape_single(s: &str) -> String {
-    s.replace('\\', "\\\\").replace('"', "''")
+    s.replace('\'', "''")
+}
+
+/// `s` as a SQL text value: under [`bind_sql`] the next `$n::text` parameter, bound to `s`;
+/// elsewhere a quoted literal, as in DDL such as a partial index's predicate, which
+/// PostgreSQL does not let take parameters.
+pub fn sql_quote(s: &str) -> String {
+    BOUND_VALUES
+        .try_with(|v| {
+            let mut v = v.borrow_mut();
+            v.values.push(s.to_string());
+            format!("${}::text", v.first + v.values.len() - 1)
+        })
+        .unwrap_or_else(|_| format!("'{}'", escape_single(s)))
+}
+
+/// Quoted `text[]` literal naming a dotted field path for `#>`/`#>>` and `jsonb_set`:
+/// `a.b` becomes `'{"a","b"}'::text[]`. Field paths stay inline, like the keys after
+/// `->`, so statements keep matching expression indexes.
+pub fn pg_path_literal(path: &str) -> String {
+    let elems: Vec<String> = path
+        .split('.')
+        .map(|seg| format!("\"{}\"", seg.replace('\\', "\\\\").replace('"', "\\\"")))
+        .collect();
+    format!(
+        "'{}'::text[]",
+        escape_single(&format!("{{{}}}", elems.join(",")))
+    )
+}
+
+/// `jsonb_path_exists(doc, ...)` for a JSON path expression, bound as a [`sql_quote`]d value.
+pub fn jsonpath_exists(jsonpath: &str) -> String {
+    format!("jsonb_path_exists(doc, {}::jsonpath)", sql_quote(jsonpath))
 }
 
 pub fn translate_expression(expr: &bson::Bson) -> Option<String> {
@@ -704,6 +904,9 @@ pub fn translate_expression(expr: &bson::Bson) -> Option<String> {
                 "$toBool" => translate_type_cast(val, "boolean"),
                 "$concat" => translate_concat(val),
                 "$concatArrays" => translate_concat_arrays(val),
+                "$objectToArray" => translate_object_to_array(val),
+                "$mergeObjects" => translate_merge_objects(val),
+                "$arrayToObject" => translate_array_to_object(val),
                 "$substr" => translate_substr(val),
                 "$substrCP" => translate_substr(val),
                 _ => None,
@@ -711,19 +914,17 @@ pub fn translate_expression(expr: &bson::Bson) -> Option<String> {
         }
         bson::Bson::String(s) if s.starts_with('$') => {
             let path = &s[1..];
-            let segs: Vec<String> = path.split('.').map(escape_single).collect();
-            if segs.len() == 1 {
+            if !path.contains('.') {
                 // Simple field access - use text extraction operator
-                Some(format!("doc->>'{}'", segs[0]))
+                Some(format!("doc->>'{}'", escape_single(path)))
             } else {
                 // Nested field access - use text extraction with path
-                let path_str = segs.join("','");
-                Some(format!("doc #>> '{{\"{}\"}}'", path_str))
+                Some(format!("doc #>> {}", pg_path_literal(path)))
             }
         }
         bson::Bson::String(s) => {
             // String literal - escape and quote for SQL
-            Some(format!("'{}'", escape_single(s)))
+            Some(sql_quote(s))
         }
         bson::Bson::Int32(n) => Some(n.to_string()),
         bson::Bson::Int64(n) => Some(n.to_string()),
@@ -788,6 +989,63 @@ fn translate_concat(val: &bson::Bson) -> Option<String> {
     }
 }
 
+/// JSONB value of a `"$a.b"` field reference (the `->`/`#>` form, where
+/// [`translate_expression`] extracts text). `[ref]` is accepted as the single-argument form.
+fn jsonb_field_ref(val: &bson::Bson) -> Option<String> {
+    match val {
+        bson::Bson::String(s) if s.starts_with('$') && !s.starts_with("$$") => {
+            let path = &s[1..];
+            Some(if !path.contains('.') {
+                format!("doc->'{}'", escape_single(path))
+            } else {
+                format!("doc #> {}", pg_path_literal(path))
+            })
+        }
+        bson::Bson::Array(arr) if arr.len() == 1 => jsonb_field_ref(&arr[0]),
+        _ => None,
+    }
+}
+
+/// `$objectToArray` of a field, one `{k, v}` per key from `jsonb_each`. JSONB keeps keys
+/// ordered by length and then bytes, so the array follows that order, as pushed-down
+/// projections already do. Non-objects yield null.
+fn translate_object_to_array(val: &bson::Bson) -> Option<String> {
+    let src = jsonb_field_ref(val)?;
+    Some(format!(
+        "CASE WHEN jsonb_typeof({src}) = 'object' THEN (SELECT COALESCE(jsonb_agg(jsonb_build_object('k', e.key, 'v', e.value) ORDER BY e.ord), '[]'::jsonb) FROM jsonb_each({src}) WITH ORDINALITY AS e(key, value, ord)) END"
+    ))
+}
+
+/// `$arrayToObject` of a field holding `[{k, v}, ...]` or `[[k, v], ...]`. Elements are
+/// aggregated in array order and JSONB keeps the last value of a repeated key, so later
+/// pairs win as in MongoDB. Non-arrays yield null.
+fn translate_array_to_object(val: &bson::Bson) -> Option<String> {
+    let src = jsonb_field_ref(val)?;
+    Some(format!(
+        "CASE WHEN jsonb_typeof({src}) = 'array' THEN (SELECT COALESCE(jsonb_object_agg(CASE jsonb_typeof(e.value) WHEN 'array' THEN e.value->>0 ELSE e.value->>'k' END, CASE jsonb_typeof(e.value) WHEN 'array' THEN e.value->1 ELSE e.value->'v' END ORDER BY e.ord), '{{}}'::jsonb) FROM jsonb_array_elements({src}) WITH ORDINALITY AS e(value, ord)) END"
+    ))
+}
+
+/// `$mergeObjects` of field references as JSONB `||`, which lets later keys win. Inputs that
+/// are not objects (including null and missing) contribute `{}`.
+fn translate_merge_objects(val: &bson::Bson) -> Option<String> {
+    let args: Vec<&bson::Bson> = match val {
+        bson::Bson::Array(arr) if !arr.is_empty() => arr.iter().collect(),
+        bson::Bson::Array(_) => return None,
+        v => vec![v],
+    };
+    let parts: Vec<String> = args
+        .into_iter()
+        .map(|arg| {
+            let src = jsonb_field_ref(arg)?;
+            Some(format!(
+                "COALESCE(CASE WHEN jsonb_typeof({src}) = 'object' THEN {src} END, '{{}}'::jsonb)"
+            ))
+        })
+        .collect::<Option<_>>()?;
+    Some(format!("({})", parts.join(" || ")))
+}
+
 fn translate_concat_arrays(val: &bson::Bson) -> Option<String> {
     match val {
         bson::Bson::Array(arr) => {
@@ -799,12 +1057,10 @@ fn translate_concat_arrays(val: &bson::Bson) -> Option<String> {
                     // Field reference like "$a" - extract as JSONB array
                     bson::Bson::String(s) if s.starts_with('$') => {
                         let path = &s[1..];
-                        let segs: Vec<String> = path.split('.').map(escape_single).collect();
-                        let jsonb_path = if segs.len() == 1 {
-                            format!("doc->'{}'", segs[0])
+                        let jsonb_path = if !path.contains('.') {
+                            format!("doc->'{}'", escape_single(path))
                         } else {
-                            let path_str = segs.join("','");
-                            format!("doc #> '{{\"{}\"}}'", path_str)
+                            format!("doc #> {}", pg_path_literal(path))
                         };
                         array_sources.push(format!(
                             "SELECT jsonb_array_elements({}) AS elem",
@@ -879,7 +1135,7 @@ fn build_jsonb_field_path(field_key: &str) -> String {
 
     let mut path = String::from("doc");
     for part in parts {
-        let escaped = part.replace('\'', "''");
+        let escaped = escape_single(part);
         path.push_str(&format!("->'{}'", escaped));
     }
     path
@@ -889,17 +1145,7 @@ fn build_jsonb_field_path(field_key: &str) -> String {
 /// Input: "location" or "location.coordinates"
 /// Output: "$.location" or "$.location.coordinates"
 fn build_jsonpath(field_key: &str) -> String {
-    let parts: Vec<&str> = field_key.split('.').collect();
-    if parts.is_empty() {
-        return "$".to_string();
-    }
-
-    let mut path = String::from("$");
-    for part in parts {
-        let escaped = part.replace('"', "\\\"");
-        path.push_str(&format!(".\"{}\"", escaped));
-    }
-    path
+    jsonpath_path(field_key)
 }
 
 /// Build SQL clause for $geoWithin with GeoJSON geometry
@@ -1038,11 +1284,8 @@ fn build_near_clause(
 
     // Build the complete clause
     let mut clauses = vec![
-        format!(
-            "jsonb_path_exists(doc, '{}.type ? (@ == \"Point\")')",
-            jsonpath
-        ),
-        format!("jsonb_path_exists(doc, '{}.coordinates')", jsonpath),
+        jsonpath_exists(&format!("{}.type ? (@ == \"Point\")", jsonpath)),
+        jsonpath_exists(&format!("{}.coordinates", jsonpath)),
     ];
 
     if let Some(max_dist) = max_distance {
@@ -1079,3 +1322,181 @@ fn extract_bounding_box(ring: &bson::Array) -> (f64, f64, f64, f64) {
 
     (min_lon, max_lon, min_lat, max_lat)
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn anchored_literal_prefix_becomes_a_range() {
+        assert_eq!(
+            regex_prefix_range("t", "^foo", "").as_deref(),
+            Some("t >= 'foo' AND t < 'fop'")
+        );
+        assert_eq!(
+            regex_prefix_range("t", "^foo\\.bar\\d+", "s").as_deref(),
+            Some("t >= 'foo.bar' AND t < 'foo.bas'")
+        );
+        // The optional trailing literal is not part of the prefix
+        assert_eq!(
+            regex_prefix_range("t", "^fooa?", "").as_deref(),
+            Some("t >= 'foo' AND t < 'fop'")
+        );
+        // No safe successor for 'z': lower bound only
+        assert_eq!(
+            regex_prefix_range("t", "^abz", "").as_deref(),
+            Some("t >= 'abz'")
+        );
+        assert_eq!(
+            regex_prefix_range("t", "^o'b", "").as_deref(),
+            Some("t >= 'o''b' AND t < 'o''c'")
+        );
+    }
+
+    #[test]
+    fn filter_values_are_bound_not_spliced() {
+        let tricky = [
+            "O'Brien",
+            "x'); DROP TABLE users; --",
+            "back\\slash'",
+            "\"quoted\" ? (@ == 1)",
+            "$1 -- $$",
+        ];
+        let filters: [fn(&str) -> bson::Document; 5] = [
+            |v| bson::doc! { "name": v },
+            |v| bson::doc! { "name": { "$in": [v, "plain"] } },
+            |v| bson::doc! { "name": { "$gte": v } },
+            |v| bson::doc! { "tags": { "$all": [v] } },
+            |v| bson::doc! { "name": { "$regex": v, "$options": "i" } },
+        ];
+        for make in filters {
+            let shape = bind_sql(0, || build_where_from_filter(&make("plain"))).sql;
+            for v in tricky {
+                let bound = bind_sql(0, || build_where_from_filter(&make(v)));
+                assert_eq!(bound.sql, shape, "value {:?} leaked into {}", v, bound.sql);
+                // Raw in a regex, JSON-escaped inside a JSON path
+                let json = serde_json::to_string(v).unwrap();
+                let escaped = &json[1..json.len() - 1];
+                assert!(
+                    bound
+                        .params
+                        .iter()
+                        .any(|p| p.contains(v) || p.contains(escaped)),
+                    "{:?} not bound in {:?}",
+                    v,
+                    bound.params
+                );
+            }
+        }
+    }
+
+    #[test]
+    fn bound_values_follow_the_callers_parameters() {
+        let bound = bind_sql(1, || {
+            format!(
+                "SELECT doc FROM t WHERE {} AND id > $1",
+                build_where_from_filter(&bson::doc! {"a": "x", "b": {"$regex": "^y"}})
+            )
+        });
+        assert_eq!(
+            bound.sql,
+            "SELECT doc FROM t WHERE (jsonb_path_exists(doc, $2::text::jsonpath) OR \
+             jsonb_path_exists(doc, $3::text::jsonpath)) AND ((doc->>'b') >= $5::text AND \
+             (doc->>'b') < $6::text AND (doc->>'b') ~ $4::text) AND id > $1"
+        );
+        assert_eq!(
+            bound.params,
+            [
+                "$.\"a\" ? (@ == \"x\" )",
+                "$.\"a\"[*] ? (@ == \"x\" )",
+                "^y",
+                "y",
+                "z"
+            ]
+        );
+        // Outside `bind_sql`, as for DDL, values are quoted inline
+        assert_eq!(sql_quote("o'b"), "'o''b'");
+    }
+
+    #[test]
+    fn object_array_conversions_read_jsonb_fields() {
+        let sql = translate_expression(&bson::bson!({"$objectToArray": "$attrs.size"})).unwrap();
+        assert!(sql.contains("jsonb_each(doc #> '{\"attrs\",\"size\"}'::text[])"));
+        let sql = translate_expression(&bson::bson!({"$arrayToObject": ["$pairs"]})).unwrap();
+        assert!(sql.contains("jsonb_array_elements(doc->'pairs')"));
+        let sql = translate_expression(&bson::bson!({"$mergeObjects": ["$a", "$b.c"]})).unwrap();
+        assert!(sql.contains(" || "));
+        // Anything but a field reference is left to the aggregation engine
+        assert_eq!(
+            translate_expression(&bson::bson!({"$objectToArray": {"a": 1}})),
+            None
+        );
+        assert_eq!(
+            translate_expression(&bson::bson!({"$arrayToObject": "$$ROOT"})),
+            None
+        );
+    }
+
+    #[test]
+    fn expr_filters_become_json_path_predicates() {
+        let filter = bson::doc! {"$expr": {"$and": [
+            {"$gt": ["$spent", {"$multiply": ["$budget", 1.5]}]},
+            {"$not": [{"$eq": ["$owner.name", {"$literal": "o'neil"}]}]},
+        ]}};
+        let sql = build_where_from_filter(&filter);
+        assert_eq!(
+            sql,
+            "jsonb_path_exists(doc, '$ ? (((@.\"spent\" > (@.\"budget\" * 1.5)) && \
+             !((@.\"owner\".\"name\" == \"o''neil\"))))'::jsonpath, '{}'::jsonb, true)"
+        );
+        assert!(expr_filters_translate(&filter));
+
+        // Unbound variables and operators without a JSON path form are left to the caller
+        for expr in [
+            bson::bson!({"$gt": ["$a", "$$threshold"]}),
+            bson::bson!({"$gt": [{"$size": "$a"}, 1]}),
+            bson::bson!("$flag"),
+        ] {
+            assert_eq!(translate_expr_filter(&expr), None, "{}", expr);
+            let nested = bson::doc! {"$or": [{"a": 1}, {"$expr": expr}]};
+            assert!(!expr_filters_translate(&nested));
+        }
+    }
+
+    #[test]
+    fn rand_reads_a_per_row_variable() {
+        let filter = bson::doc! {"$expr": {"$and": [
+            {"$lt": ["$weight", {"$rand": {}}]},
+            {"$gt": [{"$multiply": [{"$rand": {}}, 10]}, 1]},
+        ]}};
+        let sql = build_where_from_filter(&filter);
+        assert_eq!(
+            sql,
+            "jsonb_path_exists(doc, '$ ? (((@.\"weight\" < $rand0) && (($rand1 * 10) > 1)))'::jsonpath, \
+             jsonb_build_object('rand0', random(), 'rand1', random()), true)"
+        );
+        assert_eq!(
+            translate_expr_filter(&bson::bson!({"$lt": ["$w", {"$rand": {"seed": 1}}]})),
+            None
+        );
+    }
+
+    #[test]
+    fn field_paths_are_quoted() {
+        assert_eq!(pg_path_literal("a.b"), "'{\"a\",\"b\"}'::text[]");
+        assert_eq!(
+            pg_path_literal("a'b.c\"d"),
+            "'{\"a''b\",\"c\\\"d\"}'::text[]"
+        );
+        assert_eq!(jsonpath_path("a'b.c"), "$.\"a'b\".\"c\"");
+    }
+
+    #[test]
+    fn unanchored_or_complex_patterns_have_no_range() {
+        assert_eq!(regex_prefix_range("t", "foo", ""), None);
+        assert_eq!(regex_prefix_range("t", "^foo|bar", ""), None);
+        assert_eq!(regex_prefix_range("t", "^[fg]oo", ""), None);
+        assert_eq!(regex_prefix_range("t", "^foo", "i"), None);
+        assert_eq!(regex_prefix_range("t", "^foo", "m"), None);
+    }
+}
@@ -0,0 +1,466 @@
+//! Users, their built-in roles and what those roles allow, for `authorization`.
+//!
+//! Users live in `admin.system.users` as MongoDB lays them out: `_id` is `<db>.<user>`,
+//! `credentials` holds the SCRAM-SHA-256 keys and `roles` a list of `{role, db}`. A role
+//! grants actions on the database it was granted on, except the `*AnyDatabase`, cluster
+//! and `root` roles, which can only be granted on `admin` and apply to every database.
+//! Each command the dispatcher knows needs one [`Action`]; a connection may run it when
+//! a role of its authenticated user grants that action on the command's database.
+
+use bson::{Binary, Bson, Document, doc, spec::BinarySubtype};
+use uuid::Uuid;
+
+use crate::scram::{SCRAM_MECHANISM, ScramCredentials, ScramServer};
+
+/// The database and collection users are stored in.
+pub const USERS_DB: &str = "admin";
+pub const USERS_COLLECTION: &str = "system.users";
+
+/// What a command needs its caller to be allowed.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Action {
+    /// Handshake and authentication commands any connection may run
+    Open,
+    /// Commands on the connection's own cursors, sessions and transactions
+    Authenticated,
+    /// Reading documents
+    Find,
+    /// Inserting, updating and deleting documents
+    Write,
+    /// Listing collections and indexes
+    List,
+    /// Creating and dropping collections and indexes
+    Schema,
+    /// Database administration: dropping it, `collMod`, `validate`, profiling
+    DbAdmin,
+    /// Managing the database's users
+    UserAdmin,
+    /// `listDatabases`
+    ListDatabases,
+    /// Server-wide status, operations and settings
+    Cluster,
+}
+
+/// A role granted to a user: a built-in role name and the database it applies to.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct RoleRef {
+    pub role: String,
+    pub db: String,
+}
+
+impl RoleRef {
+    pub fn to_document(&self) -> Document {
+        doc! { "role": &self.role, "db": &self.db }
+    }
+}
+
+/// A built-in role: its name, the actions it grants and whether it applies to every
+/// database, in which case it can only be granted on `admin`.
+struct BuiltinRole {
+    name: &'static str,
+    actions: &'static [Action],
+    any_database: bool,
+}
+
+const READ: &[Action] = &[Action::Find, Action::List];
+const READ_WRITE: &[Action] = &[Action::Find, Action::List, Action::Write, Action::Schema];
+const DB_ADMIN: &[Action] = &[Action::List, Action::Schema, Action::DbAdmin];
+const DB_OWNER: &[Action] = &[
+    Action::Find,
+    Action::List,
+    Action::Write,
+    Action::Schema,
+    Action::DbAdmin,
+    Action::UserAdmin,
+];
+
+const BUILTIN_ROLES: &[BuiltinRole] = &[
+    BuiltinRole {
+        name: "read",
+        actions: READ,
+        any_database: false,
+    },
+    BuiltinRole {
+        name: "readWrite",
+        actions: READ_WRITE,
+        any_database: false,
+    },
+    BuiltinRole {
+        name: "dbAdmin",
+        actions: DB_ADMIN,
+        any_database: false,
+    },
+    BuiltinRole {
+        name: "userAdmin",
+        actions: &[Action::UserAdmin],
+        any_database: false,
+    },
+    BuiltinRole {
+        name: "dbOwner",
+        actions: DB_OWNER,
+        any_database: false,
+    },
+    BuiltinRole {
+        name: "readAnyDatabase",
+        actions: &[Action::Find, Action::List, Action::ListDatabases],
+        any_database: true,
+    },
+    BuiltinRole {
+        name: "readWriteAnyDatabase",
+        actions: &[
+            Action::Find,
+            Action::List,
+            Action::Write,
+            Action::Schema,
+            Action::ListDatabases,
+        ],
+        any_database: true,
+    },
+    BuiltinRole {
+        name: "dbAdminAnyDatabase",
+        actions: &[
+            Action::List,
+            Action::Schema,
+            Action::DbAdmin,
+            Action::ListDatabases,
+        ],
+        any_database: true,
+    },
+    BuiltinRole {
+        name: "userAdminAnyDatabase",
+        actions: &[Action::UserAdmin, Action::ListDatabases],
+        any_database: true,
+    },
+    BuiltinRole {
+        name: "clusterAdmin",
+        actions: &[Action::Cluster, Action::ListDatabases],
+        any_database: true,
+    },
+    BuiltinRole {
+        name: "root",
+        actions: &[
+            Action::Find,
+            Action::List,
+            Action::Write,
+            Action::Schema,
+            Action::DbAdmin,
+            Action::UserAdmin,
+            Action::ListDatabases,
+            Action::Cluster,
+        ],
+        any_database: true,
+    },
+];
+
+fn builtin_role(name: &str) -> Option<&'static BuiltinRole> {
+    BUILTIN_ROLES.iter().find(|r| r.name == name)
+}
+
+/// Why a `roles` argument was rejected.
+#[derive(Debug, Clone, PartialEq)]
+pub enum RoleError {
+    /// Not a list of role names and `{role, db}` documents
+    Invalid(String),
+    /// A role that is not built in, or an any-database role granted off `admin`
+    NotFound(String),
+}
+
+/// Parse the `roles` of `createUser` or `updateUser` run on `db`: role names grant the
+/// role on `db`, `{role, db}` documents on the database they name.
+pub fn parse_roles(roles: &Bson, db: &str) -> Result<Vec<RoleRef>, RoleError> {
+    let Bson::Array(items) = roles else {
+        return Err(RoleError::Invalid("roles must be an array".to_string()));
+    };
+    let mut parsed: Vec<RoleRef> = Vec::with_capacity(items.len());
+    for item in items {
+        let role = match item {
+            Bson::String(name) => RoleRef {
+                role: name.clone(),
+                db: db.to_string(),
+            },
+            Bson::Document(d) => {
+                if let Some(key) = d.keys().find(|k| *k != "role" && *k != "db") {
+                    return Err(RoleError::Invalid(format!(
+                        "Unrecognized field '{}' in role document",
+                        key
+                    )));
+                }
+                match (d.get_str("role"), d.get_str("db")) {
+                    (Ok(role), Ok(role_db)) if !role.is_empty() && !role_db.is_empty() => RoleRef {
+                        role: role.to_string(),
+                        db: role_db.to_string(),
+                    },
+                    _ => {
+                        return Err(RoleError::Invalid(
+                            "role documents must have non-empty string fields 'role' and 'db'"
+                                .to_string(),
+                        ));
+                    }
+                }
+            }
+            _ => {
+                return Err(RoleError::Invalid(
+                    "roles must be role names or {role, db} documents".to_string(),
+                ));
+            }
+        };
+        match builtin_role(&role.role) {
+            Some(builtin) if !builtin.any_database || role.db == USERS_DB => {}
+            _ => {
+                return Err(RoleError::NotFound(format!(
+                    "Could not find role: {}@{}",
+                    role.role, role.db
+                )));
+            }
+        }
+        if !parsed.contains(&role) {
+            parsed.push(role);
+        }
+    }
+    Ok(parsed)
+}
+
+/// The databases a user must administer to grant or revoke `role`: the role's own
+/// database, and `admin` too for a role that applies to every database.
+pub fn administering_dbs(role: &RoleRef) -> Vec<&str> {
+    let mut dbs = vec![role.db.as_str()];
+    if builtin_role(&role.role).is_some_and(|builtin| builtin.any_database) && role.db != USERS_DB {
+        dbs.push(USERS_DB);
+    }
+    dbs
+}
+
+/// Whether any of `roles` grants `action` on `db`.
+pub fn allows(roles: &[RoleRef], action: Action, db: &str) -> bool {
+    roles.iter().any(|r| {
+        builtin_role(&r.role).is_some_and(|builtin| {
+            (builtin.any_database || r.db == db) && builtin.actions.contains(&action)
+        })
+    })
+}
+
+/// The `_id` of `user` on `db` in `system.users`.
+pub fn user_id(user: &str, db: &str) -> String {
+    format!("{}.{}", db, user)
+}
+
+/// The `system.users` document for a new user.
+pub fn user_document(
+    user: &str,
+    db: &str,
+    credentials: &ScramCredentials,
+    roles: &[RoleRef],
+) -> Document {
+    doc! {
+        "_id": user_id(user, db),
+        "userId": Binary {
+            subtype: BinarySubtype::Uuid,
+            bytes: Uuid::new_v4().as_bytes().to_vec(),
+        },
+        "user": user,
+        "db": db,
+        "credentials": credentials_document(credentials),
+        "roles": roles.iter().map(RoleRef::to_document).collect::<Vec<_>>(),
+    }
+}
+
+/// The `credentials` of a `system.users` document.
+pub fn credentials_document(credentials: &ScramCredentials) -> Document {
+    doc! { SCRAM_MECHANISM: credentials.to_document() }
+}
+
+/// A `system.users` document as `usersInfo` reports it: the credential mechanisms in
+/// place of the credentials unless `show_credentials`, and `customData` only when
+/// `show_custom_data`.
+pub fn user_info(user: &Document, show_credentials: bool, show_custom_data: bool) -> Document {
+    let mut info = Document::new();
+    for key in ["_id", "userId", "user", "db"] {
+        if let Some(v) = user.get(key) {
+            info.insert(key, v.clone());
+        }
+    }
+    let credentials = user.get_document("credentials").ok();
+    let mechanisms: Vec<String> = credentials
+        .map(|c| c.keys().cloned().collect())
+        .unwrap_or_default();
+    info.insert("mechanisms", mechanisms);
+    if show_credentials && let Some(credentials) = credentials {
+        info.insert("credentials", credentials.clone());
+    }
+    let roles: Vec<Document> = roles_of(user).iter().map(RoleRef::to_document).collect();
+    info.insert("roles", roles);
+    if show_custom_data && let Ok(custom) = user.get_document("customData") {
+        info.insert("customData", custom.clone());
+    }
+    info
+}
+
+/// The roles of a `system.users` document; malformed entries grant nothing.
+pub fn roles_of(user: &Document) -> Vec<RoleRef> {
+    user.get_array("roles")
+        .map(|roles| {
+            roles
+                .iter()
+                .filter_map(|r| {
+                    let r = r.as_document()?;
+                    Some(RoleRef {
+                        role: r.get_str("role").ok()?.to_string(),
+                        db: r.get_str("db").ok()?.to_string(),
+                    })
+                })
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
+/// The SCRAM-SHA-256 credentials of a `system.users` document.
+pub fn credentials_of(user: &Document) -> Option<ScramCredentials> {
+    user.get_document("credentials")
+        .ok()?
+        .get_document(SCRAM_MECHANISM)
+        .ok()
+        .and_then(ScramCredentials::from_document)
+}
+
+/// The user a connection authenticated as.
+#[derive(Debug, Clone, PartialEq)]
+pub struct AuthenticatedUser {
+    pub user: String,
+    pub db: String,
+    pub roles: Vec<RoleRef>,
+    /// The users generation `roles` were read at
+    pub generation: u64,
+}
+
+/// A `saslStart` waiting for its `saslContinue`.
+#[derive(Debug, Clone)]
+pub struct Conversation {
+    pub user: String,
+    pub db: String,
+    pub roles: Vec<RoleRef>,
+    pub generation: u64,
+    pub scram: ScramServer,
+}
+
+/// A connection's authentication state.
+#[derive(Debug, Default)]
+pub struct ConnectionAuth {
+    /// Set once `saslContinue` verifies the client's proof; cleared by `logout`
+    pub user: Option<AuthenticatedUser>,
+    pub conversation: Option<Conversation>,
+    /// A loopback peer, which may create the first user before authenticating (MongoDB's
+    /// localhost exception)
+    pub localhost: bool,
+}
+
+impl ConnectionAuth {
+    pub fn new(localhost: bool) -> Self {
+        Self {
+            localhost,
+            ..Self::default()
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn role(role: &str, db: &str) -> RoleRef {
+        RoleRef {
+            role: role.to_string(),
+            db: db.to_string(),
+        }
+    }
+
+    #[test]
+    fn parses_role_names_and_documents() {
+        let roles = parse_roles(
+            &Bson::Array(vec![
+                Bson::String("read".into()),
+                Bson::Document(doc! {"role": "readWrite", "db": "other"}),
+                Bson::String("read".into()),
+            ]),
+            "app",
+        )
+        .unwrap();
+        assert_eq!(roles, vec![role("read", "app"), role("readWrite", "other")]);
+
+        assert!(matches!(
+            parse_roles(&Bson::Array(vec![Bson::String("owner".into())]), "app"),
+            Err(RoleError::NotFound(_))
+        ));
+        assert!(matches!(
+            parse_roles(&Bson::Array(vec![Bson::String("root".into())]), "app"),
+            Err(RoleError::NotFound(_))
+        ));
+        assert!(parse_roles(&Bson::Array(vec![Bson::String("root".into())]), "admin").is_ok());
+        assert!(matches!(
+            parse_roles(&Bson::String("read".into()), "app"),
+            Err(RoleError::Invalid(_))
+        ));
+        assert!(matches!(
+            parse_roles(
+                &Bson::Array(vec![Bson::Document(
+                    doc! {"role": "read", "db": "app", "extra": 1}
+                )]),
+                "app"
+            ),
+            Err(RoleError::Invalid(_))
+        ));
+        assert!(matches!(
+            parse_roles(
+                &Bson::Array(vec![Bson::Document(doc! {"role": "read", "db": ""})]),
+                "app"
+            ),
+            Err(RoleError::Invalid(_))
+        ));
+    }
+
+    #[test]
+    fn roles_grant_actions_on_their_database() {
+        let reader = [role("read", "app")];
+        assert!(allows(&reader, Action::Find, "app"));
+        assert!(!allows(&reader, Action::Write, "app"));
+        assert!(!allows(&reader, Action::Find, "other"));
+
+        let admin = [role("dbAdmin", "app")];
+        assert!(allows(&admin, Action::DbAdmin, "app"));
+        assert!(!allows(&admin, Action::Find, "app"));
+
+        let root = [role("root", "admin")];
+        assert!(allows(&root, Action::Write, "app"));
+        assert!(allows(&root, Action::Cluster, "admin"));
+        assert!(!allows(
+            &[role("readWriteAnyDatabase", "admin")],
+            Action::Cluster,
+            "admin"
+        ));
+    }
+
+    #[test]
+    fn user_documents_round_trip() {
+        let credentials = ScramCredentials::derive_with("pw", b"salt".to_vec(), 4096);
+        let user = user_document("ann", "app", &credentials, &[role("read", "app")]);
+        assert_eq!(user.get_str("_id").unwrap(), "app.ann");
+        assert_eq!(roles_of(&user), vec![role("read", "app")]);
+        assert_eq!(credentials_of(&user), Some(credentials));
+
+        let info = user_info(&user, false, true);
+        assert_eq!(
+            info.get_array("mechanisms").unwrap(),
+            &vec![Bson::String("SCRAM-SHA-256".into())]
+        );
+        assert!(!info.contains_key("credentials"));
+        assert_eq!(
+            info.get_array("roles").unwrap(),
+            &vec![Bson::Document(doc! {"role": "read", "db": "app"})]
+        );
+        assert!(
+            user_info(&user, true, true)
+                .get_document("credentials")
+                .unwrap()
+                .contains_key("SCRAM-SHA-256")
+        );
+    }
+}
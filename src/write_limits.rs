@@ -0,0 +1,365 @@
+//! Write rate limits per database or collection (`write_limits`).
+//!
+//! Each limited namespace, a database (`app`) or a collection (`app.events`), has a token
+//! bucket refilled at its limit in writes per second and holding at most one second's
+//! worth, so a short burst up to the limit is admitted at once. A write command costs one
+//! token per document it inserts, update it applies or delete it runs, and is admitted
+//! while its namespaces have tokens left; a batch larger than the bucket is admitted when
+//! the bucket is full and leaves it in debt. An aggregation's `$out` or `$merge` is admitted
+//! as one write to its target and charged the rest once it knows how many it made. A write
+//! to a collection must pass both its collection's and its database's limit. Limits can be
+//! replaced while the server runs only through `oxidedbSetWriteLimits`, not by editing the
+//! config file; namespaces kept across a change keep their counters.
+
+use std::collections::BTreeMap;
+use std::fmt::Write as _;
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+use bson::{Bson, Document};
+
+use crate::config::Config;
+use crate::error::{Error, Result};
+use crate::metrics::escape_label;
+
+/// Limits in writes per second, keyed by `db` or `db.collection`.
+pub type WriteLimits = BTreeMap<String, f64>;
+
+/// How long writes are counted for the reported rate
+const RATE_WINDOW: Duration = Duration::from_secs(1);
+
+/// `write_limits` from the config; an invalid entry is an error, so a typo fails startup
+/// instead of leaving writes unthrottled.
+pub fn limits_from_config(cfg: &Config) -> Result<WriteLimits> {
+    let limits: WriteLimits = cfg
+        .write_limits
+        .iter()
+        .flatten()
+        .map(|(ns, limit)| (ns.clone(), *limit))
+        .collect();
+    validate(&limits).map_err(|msg| Error::Msg(format!("write_limits: {}", msg)))?;
+    Ok(limits)
+}
+
+/// The limits of an `oxidedbSetWriteLimits` `limits` document.
+pub fn limits_from_document(doc: &Document) -> std::result::Result<WriteLimits, String> {
+    let mut limits = WriteLimits::new();
+    for (ns, value) in doc {
+        let limit = match value {
+            Bson::Double(v) => *v,
+            Bson::Int32(v) => *v as f64,
+            Bson::Int64(v) => *v as f64,
+            _ => return Err(format!("limit of '{}' must be a number", ns)),
+        };
+        limits.insert(ns.clone(), limit);
+    }
+    validate(&limits)?;
+    Ok(limits)
+}
+
+pub fn limits_to_document(limits: &WriteLimits) -> Document {
+    limits
+        .iter()
+        .map(|(ns, limit)| (ns.clone(), Bson::Double(*limit)))
+        .collect()
+}
+
+fn validate(limits: &WriteLimits) -> std::result::Result<(), String> {
+    for (ns, limit) in limits {
+        if ns.is_empty() || ns.starts_with('.') || ns.ends_with('.') {
+            return Err(format!("invalid namespace '{}'", ns));
+        }
+        if !limit.is_finite() || *limit <= 0.0 {
+            return Err(format!(
+                "limit of '{}' must be a positive number of writes per second",
+                ns
+            ));
+        }
+    }
+    Ok(())
+}
+
+#[derive(Debug)]
+struct Bucket {
+    limit: f64,
+    tokens: f64,
+    refilled: Instant,
+    admitted: u64,
+    throttled: u64,
+    window_start: Instant,
+    window_writes: u64,
+    rate: f64,
+}
+
+impl Bucket {
+    fn new(limit: f64, now: Instant) -> Self {
+        let mut bucket = Self {
+            limit,
+            tokens: 0.0,
+            refilled: now,
+            admitted: 0,
+            throttled: 0,
+            window_start: now,
+            window_writes: 0,
+            rate: 0.0,
+        };
+        bucket.tokens = bucket.capacity();
+        bucket
+    }
+
+    /// One second's worth of writes, and at least one so limits below one per second
+    /// still admit a write now and then.
+    fn capacity(&self) -> f64 {
+        self.limit.max(1.0)
+    }
+
+    fn refill(&mut self, now: Instant) {
+        let elapsed = now.saturating_duration_since(self.refilled).as_secs_f64();
+        self.tokens = (self.tokens + elapsed * self.limit).min(self.capacity());
+        self.refilled = now;
+    }
+
+    /// Close the rate window once it has run its length, so the reported rate covers the
+    /// last full window.
+    fn roll_window(&mut self, now: Instant) {
+        let elapsed = now.saturating_duration_since(self.window_start);
+        if elapsed >= RATE_WINDOW {
+            self.rate = self.window_writes as f64 / elapsed.as_secs_f64();
+            self.window_writes = 0;
+            self.window_start = now;
+        }
+    }
+}
+
+/// The token buckets of the limited namespaces.
+#[derive(Debug, Default)]
+pub struct WriteLimiter {
+    buckets: Mutex<BTreeMap<String, Bucket>>,
+}
+
+impl WriteLimiter {
+    pub fn new(limits: WriteLimits) -> Self {
+        let limiter = Self::default();
+        limiter.set_limits(limits);
+        limiter
+    }
+
+    /// Replace the limits. Namespaces that keep a limit keep their counters and tokens
+    /// (capped to the new limit); the others start with a full bucket.
+    pub fn set_limits(&self, limits: WriteLimits) {
+        let Ok(mut buckets) = self.buckets.lock() else {
+            return;
+        };
+        let now = Instant::now();
+        buckets.retain(|ns, _| limits.contains_key(ns));
+        for (ns, limit) in limits {
+            match buckets.get_mut(&ns) {
+                Some(bucket) => {
+                    bucket.refill(now);
+                    bucket.limit = limit;
+                    bucket.tokens = bucket.tokens.min(bucket.capacity());
+                }
+                None => {
+                    buckets.insert(ns, Bucket::new(limit, now));
+                }
+            }
+        }
+    }
+
+    pub fn limits(&self) -> WriteLimits {
+        match self.buckets.lock() {
+            Ok(buckets) => buckets
+                .iter()
+                .map(|(ns, b)| (ns.clone(), b.limit))
+                .collect(),
+            Err(_) => WriteLimits::new(),
+        }
+    }
+
+    /// Admit `writes` writes to `db`.`coll`, or return the namespace whose limit refuses
+    /// them. Nothing is taken from either bucket unless both admit the writes.
+    pub fn admit(&self, db: &str, coll: &str, writes: u64) -> std::result::Result<(), String> {
+        let Ok(mut buckets) = self.buckets.lock() else {
+            return Ok(());
+        };
+        if buckets.is_empty() {
+            return Ok(());
+        }
+        let now = Instant::now();
+        let namespaces = [format!("{}.{}", db, coll), db.to_string()];
+        for ns in &namespaces {
+            if let Some(bucket) = buckets.get_mut(ns) {
+                bucket.refill(now);
+                if bucket.tokens < (writes as f64).min(bucket.capacity()) {
+                    bucket.throttled += 1;
+                    return Err(ns.clone());
+                }
+            }
+        }
+        charge_buckets(&mut buckets, &namespaces, writes, now);
+        Ok(())
+    }
+
+    /// Charge `writes` writes already made to `db`.`coll` without refusing any, for writes
+    /// whose count is only known once they are done; the buckets may go into debt.
+    pub fn charge(&self, db: &str, coll: &str, writes: u64) {
+        let Ok(mut buckets) = self.buckets.lock() else {
+            return;
+        };
+        let now = Instant::now();
+        let namespaces = [format!("{}.{}", db, coll), db.to_string()];
+        for ns in &namespaces {
+            if let Some(bucket) = buckets.get_mut(ns) {
+                bucket.refill(now);
+            }
+        }
+        charge_buckets(&mut buckets, &namespaces, writes, now);
+    }
+
+    /// Append the limits, current rates and counters in Prometheus text format.
+    pub fn render(&self, out: &mut String) {
+        let Ok(mut buckets) = self.buckets.lock() else {
+            return;
+        };
+        if buckets.is_empty() {
+            return;
+        }
+        let now = Instant::now();
+        for bucket in buckets.values_mut() {
+            bucket.roll_window(now);
+        }
+        let series: [(&str, &str, &str, fn(&Bucket) -> String); 4] = [
+            (
+                "oxidedb_write_limit_ops_per_second",
+                "Configured write limit, by namespace",
+                "gauge",
+                |b| b.limit.to_string(),
+            ),
+            (
+                "oxidedb_write_rate_ops_per_second",
+                "Writes admitted per second over the last second, by namespace",
+                "gauge",
+                |b| b.rate.to_string(),
+            ),
+            (
+                "oxidedb_write_ops_admitted_total",
+                "Writes admitted under a limit, by namespace",
+                "counter",
+                |b| b.admitted.to_string(),
+            ),
+            (
+                "oxidedb_write_commands_throttled_total",
+                "Write commands refused for exceeding a limit, by namespace",
+                "counter",
+                |b| b.throttled.to_string(),
+            ),
+        ];
+        for (name, help, kind, value) in series {
+            let _ = writeln!(out, "# HELP {} {}\n# TYPE {} {}", name, help, name, kind);
+            for (ns, bucket) in buckets.iter() {
+                let _ = writeln!(
+                    out,
+                    "{}{{namespace=\"{}\"}} {}",
+                    name,
+                    escape_label(ns),
+                    value(bucket)
+                );
+            }
+            out.push('\n');
+        }
+    }
+}
+
+/// Take `writes` tokens from each of `namespaces`' buckets and count them as admitted.
+fn charge_buckets(
+    buckets: &mut BTreeMap<String, Bucket>,
+    namespaces: &[String],
+    writes: u64,
+    now: Instant,
+) {
+    for ns in namespaces {
+        if let Some(bucket) = buckets.get_mut(ns) {
+            bucket.tokens -= writes as f64;
+            bucket.admitted += writes;
+            bucket.roll_window(now);
+            bucket.window_writes += writes;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn limits(entries: &[(&str, f64)]) -> WriteLimits {
+        entries.iter().map(|(ns, l)| (ns.to_string(), *l)).collect()
+    }
+
+    #[test]
+    fn admits_a_burst_up_to_the_limit() {
+        let limiter = WriteLimiter::new(limits(&[("app.events", 3.0)]));
+        assert!(limiter.admit("app", "events", 2).is_ok());
+        assert!(limiter.admit("app", "events", 1).is_ok());
+        assert_eq!(
+            limiter.admit("app", "events", 1),
+            Err("app.events".to_string())
+        );
+        assert!(limiter.admit("app", "other", 100).is_ok(), "unlimited");
+        assert!(limiter.admit("reports", "events", 100).is_ok(), "unlimited");
+    }
+
+    #[test]
+    fn database_limit_covers_its_collections() {
+        let limiter = WriteLimiter::new(limits(&[("app", 2.0), ("app.events", 10.0)]));
+        assert!(limiter.admit("app", "events", 1).is_ok());
+        assert!(limiter.admit("app", "users", 1).is_ok());
+        assert_eq!(limiter.admit("app", "events", 1), Err("app".to_string()));
+    }
+
+    #[test]
+    fn oversized_batch_waits_for_a_full_bucket() {
+        let limiter = WriteLimiter::new(limits(&[("app", 5.0)]));
+        assert!(limiter.admit("app", "c", 50).is_ok(), "full bucket");
+        assert!(limiter.admit("app", "c", 1).is_err(), "in debt");
+    }
+
+    #[test]
+    fn charged_writes_put_the_bucket_in_debt() {
+        let limiter = WriteLimiter::new(limits(&[("app.out", 5.0)]));
+        assert!(limiter.admit("app", "out", 1).is_ok());
+        limiter.charge("app", "out", 20);
+        assert!(limiter.admit("app", "out", 1).is_err(), "in debt");
+        limiter.charge("app", "other", 20);
+        assert!(limiter.admit("app", "other", 1).is_ok(), "unlimited");
+    }
+
+    #[test]
+    fn replacing_limits_keeps_counters() {
+        let limiter = WriteLimiter::new(limits(&[("app", 1.0), ("old", 1.0)]));
+        assert!(limiter.admit("app", "c", 1).is_ok());
+        assert!(limiter.admit("app", "c", 1).is_err());
+        limiter.set_limits(limits(&[("app", 2.0), ("new", 4.0)]));
+        assert_eq!(limiter.limits(), limits(&[("app", 2.0), ("new", 4.0)]));
+
+        let mut out = String::new();
+        limiter.render(&mut out);
+        assert!(out.contains("oxidedb_write_limit_ops_per_second{namespace=\"app\"} 2"));
+        assert!(out.contains("oxidedb_write_ops_admitted_total{namespace=\"app\"} 1"));
+        assert!(out.contains("oxidedb_write_commands_throttled_total{namespace=\"app\"} 1"));
+        assert!(out.contains("oxidedb_write_ops_admitted_total{namespace=\"new\"} 0"));
+        assert!(!out.contains("namespace=\"old\""));
+    }
+
+    #[test]
+    fn parses_limit_documents() {
+        let parsed = limits_from_document(&bson::doc! { "app": 10, "app.events": 2.5 }).unwrap();
+        assert_eq!(parsed, limits(&[("app", 10.0), ("app.events", 2.5)]));
+        assert_eq!(
+            limits_to_document(&parsed),
+            bson::doc! { "app": 10.0, "app.events": 2.5 }
+        );
+        assert!(limits_from_document(&bson::doc! { "app": 0 }).is_err());
+        assert!(limits_from_document(&bson::doc! { "app": "fast" }).is_err());
+        assert!(limits_from_document(&bson::doc! { ".events": 1 }).is_err());
+    }
+}
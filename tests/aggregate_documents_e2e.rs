@@ -0,0 +1,155 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, request_id: i32) -> bson::Document {
+    let msg = encode_op_msg(&cmd, 0, request_id);
+    stream.write_all(&msg).await.unwrap();
+    read_one_op_msg(stream).await
+}
+
+#[tokio::test]
+async fn e2e_documents_stage_computes_over_inline_documents() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("documents_{}", rand_suffix(6));
+    let agg = doc! {
+        "aggregate": 1,
+        "pipeline": [
+            {"$documents": [
+                {"sku": "a", "qty": 2, "price": 5.0},
+                {"sku": "b", "qty": 1, "price": 20.0},
+                {"sku": "a", "qty": 3, "price": 5.0},
+            ]},
+            {"$match": {"qty": {"$gte": 2}}},
+            {"$group": {"_id": "$sku", "total": {"$sum": {"$multiply": ["$qty", "$price"]}}}},
+        ],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, agg, 1).await;
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    let cursor = reply.get_document("cursor").unwrap();
+    assert_eq!(
+        cursor.get_str("ns").unwrap(),
+        format!("{}.$cmd.aggregate", dbname)
+    );
+    let batch = cursor.get_array("firstBatch").unwrap();
+    assert_eq!(batch.len(), 1);
+    let group = batch[0].as_document().unwrap();
+    assert_eq!(group.get_str("_id").unwrap(), "a");
+    assert_eq!(group.get_f64("total").unwrap(), 25.0);
+
+    // The documents may come from a `let` variable
+    let agg = doc! {
+        "aggregate": 1,
+        "pipeline": [{"$documents": "$$rows"}, {"$count": "n"}],
+        "cursor": {},
+        "let": {"rows": {"$literal": [{"x": 1}, {"x": 2}]}},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, agg, 2).await;
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch[0].as_document().unwrap().get_i32("n").unwrap(), 2);
+
+    // $documents needs {aggregate: 1}, and {aggregate: 1} needs $documents
+    let on_coll = doc! {
+        "aggregate": "items",
+        "pipeline": [{"$documents": [{"x": 1}]}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    assert_eq!(
+        run(&mut stream, on_coll, 3).await.get_i32("code").unwrap(),
+        73
+    );
+    let no_source = doc! {
+        "aggregate": 1,
+        "pipeline": [{"$match": {}}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    assert_eq!(
+        run(&mut stream, no_source, 4)
+            .await
+            .get_i32("code")
+            .unwrap(),
+        73
+    );
+
+    // $currentOp is another collectionless source, on the admin database
+    let ops = doc! {
+        "aggregate": 1,
+        "pipeline": [{"$currentOp": {}}, {"$match": {"comment": "watching"}}],
+        "cursor": {},
+        "comment": "watching",
+        "$db": "admin",
+    };
+    let reply = run(&mut stream, ops, 5).await;
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 1);
+    let elsewhere = doc! {
+        "aggregate": 1,
+        "pipeline": [{"$currentOp": {}}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    assert_eq!(
+        run(&mut stream, elsewhere, 6)
+            .await
+            .get_i32("code")
+            .unwrap(),
+        73
+    );
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -78,6 +78,15 @@ async fn e2e_geo_near_applies_query_filter() {
     stream.write_all(&msg).await.unwrap();
     let _ = read_one_op_msg(&mut stream).await;
 
+    let ci = doc! {
+        "createIndexes": "places",
+        "indexes": [{"name": "location_2dsphere", "key": {"location": "2dsphere"}}],
+        "$db": &dbname,
+    };
+    let msg = encode_op_msg(&ci, 0, 10);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
     let pipeline = vec![bson::Bson::Document(doc! {
         "$geoNear": {
             "near": {"$geometry": {"type": "Point", "coordinates": [-73.9857, 40.7589]}},
@@ -137,3 +137,67 @@ async fn e2e_aggregate_remove_in_add_fields() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+#[tokio::test]
+async fn e2e_aggregate_now_and_conditional_remove() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("agg_sysvars_{}", rand_suffix(6));
+
+    let create = doc! {"create": "u", "$db": &dbname};
+    let msg = encode_op_msg(&create, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    let docs: Vec<bson::Document> = (0..50)
+        .map(|i| doc! {"_id": i, "email": format!("u{}@example.com", i), "private": i % 2 == 0})
+        .collect();
+    let ins = doc! {"insert": "u", "documents": docs, "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    let pipeline = vec![
+        bson::Bson::Document(doc! {"$project": {
+            "at": "$$NOW",
+            "email": {"$cond": ["$private", "$$REMOVE", "$email"]},
+        }}),
+        bson::Bson::Document(doc! {"$sort": {"_id": 1}}),
+    ];
+    let agg =
+        doc! {"aggregate": "u", "pipeline": pipeline, "cursor": {"batchSize": 100}, "$db": &dbname};
+    let msg = encode_op_msg(&agg, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+    let fb = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(fb.len(), 50);
+    let first_at = *fb[0].as_document().unwrap().get_datetime("at").unwrap();
+    for (i, d) in fb.iter().enumerate() {
+        let d = d.as_document().unwrap();
+        // One $$NOW for the whole command
+        assert_eq!(*d.get_datetime("at").unwrap(), first_at);
+        assert_eq!(d.contains_key("email"), i % 2 == 1, "doc {}", i);
+    }
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
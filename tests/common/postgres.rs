@@ -24,8 +24,11 @@ impl TestDb {
         );
         let url = replace_db_name(&admin_url, &dbname);
 
-        // Create the database
-        let (client, conn) = tokio_postgres::connect(&admin_url, NoTls).await.ok()?;
+        // Create the database. With the URL set, an unreachable server fails the test
+        // rather than skipping it, so CI cannot pass without running against PostgreSQL.
+        let (client, conn) = tokio_postgres::connect(&admin_url, NoTls)
+            .await
+            .expect("connect to OXIDEDB_TEST_POSTGRES_URL");
         tokio::spawn(async move {
             let _ = conn.await;
         });
@@ -33,7 +36,7 @@ impl TestDb {
         client
             .batch_execute(&format!("CREATE DATABASE {} TEMPLATE template0", qname))
             .await
-            .ok()?;
+            .expect("create the test database");
         drop(client);
 
         Some(Self {
@@ -82,6 +82,16 @@ async fn e2e_geo_near_simple() {
     eprintln!("Insert response: {:?}", doc);
     assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
 
+    let ci = doc! {
+        "createIndexes": "places",
+        "indexes": [{"name": "location_2dsphere", "key": {"location": "2dsphere"}}],
+        "$db": &dbname,
+    };
+    let msg = encode_op_msg(&ci, 0, 10);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+
     // Test $geoNear aggregation stage
     let pipeline = vec![bson::Bson::Document(doc! {
         "$geoNear": doc! {
@@ -135,6 +135,16 @@ async fn e2e_geo_near_aggregation() {
     let doc = read_one_op_msg(&mut stream).await;
     assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
 
+    let ci = doc! {
+        "createIndexes": "places",
+        "indexes": [{"name": "location_2dsphere", "key": {"location": "2dsphere"}}],
+        "$db": &dbname,
+    };
+    let msg = encode_op_msg(&ci, 0, 10);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+
     // Test $geoNear aggregation stage
     let pipeline = vec![bson::Bson::Document(doc! {
         "$geoNear": doc! {
@@ -679,6 +689,16 @@ async fn e2e_geo_near_with_query_filter() {
     let doc = read_one_op_msg(&mut stream).await;
     assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
 
+    let ci = doc! {
+        "createIndexes": "filtered",
+        "indexes": [{"name": "location_2dsphere", "key": {"location": "2dsphere"}}],
+        "$db": &dbname,
+    };
+    let msg = encode_op_msg(&ci, 0, 10);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+
     // Test $geoNear with query filter
     let pipeline = vec![bson::Bson::Document(doc! {
         "$geoNear": doc! {
@@ -727,3 +747,117 @@ async fn e2e_geo_near_with_query_filter() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+#[tokio::test]
+async fn e2e_geo_near_requires_index_and_orders_by_distance() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("geo_{}", rand_suffix(6));
+
+    let point = |lon: f64, lat: f64| doc! {"type": "Point", "coordinates": [lon, lat]};
+    let docs = vec![
+        doc! {"_id": "liberty", "kind": "sight", "location": point(-74.0445, 40.6892)},
+        doc! {"_id": "times", "kind": "sight", "location": point(-73.9857, 40.7589)},
+        doc! {"_id": "park", "kind": "park", "location": point(-73.9654, 40.7829)},
+        doc! {"_id": "bridge", "kind": "sight", "location": point(-122.4783, 37.8199)},
+        doc! {"_id": "nowhere", "kind": "sight"},
+    ];
+    let insert = doc! {"insert": "spots", "documents": docs, "$db": &dbname};
+    let msg = encode_op_msg(&insert, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("n").unwrap_or(0), 5);
+
+    let geo_near = |extra: bson::Document| {
+        let mut stage = doc! {
+            "near": {"type": "Point", "coordinates": [-73.9857, 40.7589]},
+            "distanceField": "dist.meters",
+            "spherical": true,
+        };
+        for (k, v) in extra {
+            stage.insert(k, v);
+        }
+        doc! {
+            "aggregate": "spots",
+            "pipeline": [{"$geoNear": stage}],
+            "cursor": {},
+            "$db": &dbname,
+        }
+    };
+
+    // Without a 2dsphere index there is nothing to search
+    let msg = encode_op_msg(&geo_near(doc! {}), 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(1.0), 0.0);
+    assert_eq!(doc.get_i32("code").unwrap(), 27);
+    assert!(doc.get_str("errmsg").unwrap().contains("2dsphere"));
+
+    let ci = doc! {
+        "createIndexes": "spots",
+        "indexes": [{"name": "location_2dsphere", "key": {"location": "2dsphere"}}],
+        "$db": &dbname,
+    };
+    let msg = encode_op_msg(&ci, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+
+    let results = |doc: &bson::Document| -> Vec<(String, f64)> {
+        assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", doc);
+        doc.get_document("cursor")
+            .unwrap()
+            .get_array("firstBatch")
+            .unwrap()
+            .iter()
+            .map(|d| {
+                let d = d.as_document().unwrap();
+                let meters = d.get_document("dist").unwrap().get_f64("meters").unwrap();
+                (d.get_str("_id").unwrap().to_string(), meters)
+            })
+            .collect()
+    };
+
+    // Nearest first, with the distance in meters; documents without a point are skipped
+    let msg = encode_op_msg(&geo_near(doc! {}), 0, 4);
+    stream.write_all(&msg).await.unwrap();
+    let found = results(&read_one_op_msg(&mut stream).await);
+    let ids: Vec<&str> = found.iter().map(|(id, _)| id.as_str()).collect();
+    assert_eq!(ids, vec!["times", "park", "liberty", "bridge"]);
+    assert!(found[0].1 < 1.0);
+    assert!(found[1].1 > 2_000.0 && found[1].1 < 3_500.0, "{:?}", found);
+    assert!(found[3].1 > 4_000_000.0, "{:?}", found);
+
+    // maxDistance and query narrow the results
+    let msg = encode_op_msg(
+        &geo_near(doc! {"maxDistance": 10_000, "query": {"kind": "sight"}}),
+        0,
+        5,
+    );
+    stream.write_all(&msg).await.unwrap();
+    let found = results(&read_one_op_msg(&mut stream).await);
+    let ids: Vec<&str> = found.iter().map(|(id, _)| id.as_str()).collect();
+    assert_eq!(ids, vec!["times", "liberty"]);
+
+    // A key without a 2dsphere index is refused
+    let msg = encode_op_msg(&geo_near(doc! {"key": "elsewhere"}), 0, 6);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("code").unwrap(), 27);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,125 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+#[tokio::test]
+async fn e2e_coll_stats_stage_reports_storage() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("collstats_{}", rand_suffix(6));
+
+    let docs: Vec<bson::Document> = (0..20)
+        .map(|i| doc! {"i": i, "pad": "x".repeat(100)})
+        .collect();
+    let ins = doc! {"insert": "u", "documents": docs, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ins, 0, 1)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("n").unwrap_or(0), 20);
+
+    let ci = doc! {"createIndexes": "u", "indexes": [{"name": "i_1", "key": {"i": 1i32}}], "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ci, 0, 2)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+
+    let agg = doc! {
+        "aggregate": "u",
+        "pipeline": [{"$collStats": {"storageStats": {}, "count": {}}}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    stream.write_all(&encode_op_msg(&agg, 0, 3)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+    let batch = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 1);
+    let stats = batch[0].as_document().unwrap();
+    assert_eq!(stats.get_str("ns").unwrap(), format!("{}.u", dbname));
+    assert_eq!(stats.get_i64("count").unwrap(), 20);
+    let storage = stats.get_document("storageStats").unwrap();
+    assert_eq!(storage.get_i64("count").unwrap(), 20);
+    let size = storage.get_i64("size").unwrap();
+    assert!(size > 20 * 100);
+    assert!(storage.get_i64("storageSize").unwrap() > 0);
+    assert_eq!(storage.get_i32("nindexes").unwrap(), 2);
+    let index_sizes = storage.get_document("indexSizes").unwrap();
+    assert!(index_sizes.contains_key("_id_"));
+    assert!(index_sizes.contains_key("i_1"));
+
+    // scale divides the sizes
+    let agg = doc! {
+        "aggregate": "u",
+        "pipeline": [{"$collStats": {"storageStats": {"scale": 1024}}}, {"$project": {"storageStats.size": 1}}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    stream.write_all(&encode_op_msg(&agg, 0, 4)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let batch = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    let storage = batch[0]
+        .as_document()
+        .unwrap()
+        .get_document("storageStats")
+        .unwrap();
+    assert_eq!(storage.get_i64("size").unwrap(), size / 1024);
+
+    // Only valid as the first stage
+    let agg = doc! {
+        "aggregate": "u",
+        "pipeline": [{"$match": {}}, {"$collStats": {"count": {}}}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    stream.write_all(&encode_op_msg(&agg, 0, 5)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(1.0), 0.0);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
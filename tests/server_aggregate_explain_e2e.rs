@@ -0,0 +1,150 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, request_id: i32) -> bson::Document {
+    let msg = encode_op_msg(&cmd, 0, request_id);
+    stream.write_all(&msg).await.unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn explain_stages(reply: &bson::Document) -> Vec<bson::Document> {
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    reply
+        .get_array("stages")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().clone())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_aggregate_explain_reports_each_stage() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("agg_explain_{}", rand_suffix(6));
+    let docs: Vec<bson::Document> = (0..10)
+        .map(|i| doc! {"kind": if i < 6 { "a" } else { "b" }, "n": i})
+        .collect();
+    let ins = doc! {"insert": "items", "documents": docs, "$db": &dbname};
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 10);
+
+    // The $match runs as the collection query; $group and $sort run in the engine
+    let agg = doc! {
+        "aggregate": "items",
+        "pipeline": [
+            {"$match": {"n": {"$gte": 2}}},
+            {"$group": {"_id": "$kind", "total": {"$sum": "$n"}}},
+            {"$sort": {"_id": 1}},
+        ],
+        "explain": true,
+        "$db": &dbname,
+    };
+    let stages = explain_stages(&run(&mut stream, agg, 2).await);
+    assert_eq!(stages.len(), 3, "{:?}", stages);
+    let cursor = &stages[0];
+    let exec_stats = cursor
+        .get_document("$cursor")
+        .unwrap()
+        .get_document("executionStats")
+        .unwrap();
+    assert_eq!(exec_stats.get_i64("nReturned").unwrap(), 8);
+    assert_eq!(
+        cursor.get_array("fusedStages").unwrap(),
+        &vec![bson::Bson::String("$match".into())]
+    );
+    assert_eq!(cursor.get_i64("nReturned").unwrap(), 8);
+    assert!(stages[1].contains_key("$group"));
+    assert_eq!(stages[1].get_i64("nReturned").unwrap(), 2);
+    assert!(stages[1].get_i64("executionTimeMillisEstimate").unwrap() >= 0);
+    assert!(stages[2].contains_key("$sort"));
+    assert_eq!(stages[2].get_i64("nReturned").unwrap(), 2);
+
+    // A pipeline PostgreSQL answers alone is one $cursor stage fusing all of it
+    let agg = doc! {
+        "aggregate": "items",
+        "pipeline": [
+            {"$match": {"kind": "a"}},
+            {"$sort": {"n": -1}},
+            {"$limit": 4},
+        ],
+        "explain": true,
+        "$db": &dbname,
+    };
+    let stages = explain_stages(&run(&mut stream, agg, 3).await);
+    assert_eq!(stages.len(), 1, "{:?}", stages);
+    let fused: Vec<&str> = stages[0]
+        .get_array("fusedStages")
+        .unwrap()
+        .iter()
+        .map(|b| b.as_str().unwrap())
+        .collect();
+    assert_eq!(fused, vec!["$match", "$sort", "$limit"]);
+    assert_eq!(stages[0].get_i64("nReturned").unwrap(), 4);
+
+    // The explain command takes the same path
+    let explain = doc! {
+        "explain": {"aggregate": "items", "pipeline": [{"$count": "c"}]},
+        "$db": &dbname,
+    };
+    let stages = explain_stages(&run(&mut stream, explain, 4).await);
+    assert_eq!(stages.len(), 2, "{:?}", stages);
+    assert!(!stages[0].contains_key("fusedStages"));
+    assert_eq!(stages[0].get_i64("nReturned").unwrap(), 10);
+    assert_eq!(stages[1].get_str("$count").unwrap(), "c");
+    assert_eq!(stages[1].get_i64("nReturned").unwrap(), 1);
+
+    // Explaining runs the pipeline, so writes are refused
+    let agg = doc! {
+        "aggregate": "items",
+        "pipeline": [{"$out": "copy"}],
+        "explain": true,
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, agg, 5).await;
+    assert_eq!(reply.get_f64("ok").unwrap_or(1.0), 0.0);
+    assert_eq!(reply.get_i32("code").unwrap(), 2);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
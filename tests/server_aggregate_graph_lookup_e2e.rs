@@ -0,0 +1,225 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+#[tokio::test]
+async fn e2e_graph_lookup_depth_and_cycles() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("agg_graph_{}", rand_suffix(6));
+    let create = doc! {"create": "cats", "$db": &dbname};
+    let msg = encode_op_msg(&create, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    // root <- a <- b <- c, plus a cycle x <-> y
+    let ins = doc! {"insert": "cats", "documents": [
+        {"_id": "root"},
+        {"_id": "a", "parent": "root"},
+        {"_id": "b", "parent": "a"},
+        {"_id": "c", "parent": "b"},
+        {"_id": "x", "parent": "y"},
+        {"_id": "y", "parent": "x"},
+    ], "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    let graph = doc! {
+        "from": "cats",
+        "startWith": "$parent",
+        "connectFromField": "parent",
+        "connectToField": "_id",
+        "as": "ancestors",
+        "depthField": "depth",
+    };
+    let pipeline = vec![
+        bson::Bson::Document(doc! {"$match": {"_id": {"$in": ["c", "x"]}}}),
+        bson::Bson::Document(doc! {"$graphLookup": graph}),
+        bson::Bson::Document(doc! {"$sort": {"_id": 1i32}}),
+    ];
+    let agg = doc! {"aggregate": "cats", "pipeline": pipeline, "cursor": {}, "$db": &dbname};
+    let msg = encode_op_msg(&agg, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let fb = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(fb.len(), 2);
+
+    let c = fb[0].as_document().unwrap();
+    assert_eq!(c.get_str("_id").unwrap(), "c");
+    let ancestors = c.get_array("ancestors").unwrap();
+    let ids: Vec<(&str, i64)> = ancestors
+        .iter()
+        .map(|a| {
+            let a = a.as_document().unwrap();
+            (a.get_str("_id").unwrap(), a.get_i64("depth").unwrap())
+        })
+        .collect();
+    assert_eq!(ids, vec![("b", 0), ("a", 1), ("root", 2)]);
+
+    // The cycle terminates and each document is reported once
+    let x = fb[1].as_document().unwrap();
+    assert_eq!(x.get_str("_id").unwrap(), "x");
+    assert_eq!(x.get_array("ancestors").unwrap().len(), 2);
+
+    // maxDepth bounds the traversal
+    let graph = doc! {
+        "from": "cats",
+        "startWith": "$parent",
+        "connectFromField": "parent",
+        "connectToField": "_id",
+        "as": "ancestors",
+        "maxDepth": 0i32,
+    };
+    let pipeline = vec![
+        bson::Bson::Document(doc! {"$match": {"_id": "c"}}),
+        bson::Bson::Document(doc! {"$graphLookup": graph}),
+    ];
+    let agg = doc! {"aggregate": "cats", "pipeline": pipeline, "cursor": {}, "$db": &dbname};
+    let msg = encode_op_msg(&agg, 0, 4);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let fb = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(fb.len(), 1);
+    let c = fb[0].as_document().unwrap();
+    assert_eq!(c.get_array("ancestors").unwrap().len(), 1);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_graph_lookup_dense_graphs_and_missing_collections() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("agg_graph_{}", rand_suffix(6));
+
+    // 40 layers of two nodes, each linked to both nodes of the next layer: 2^40 paths
+    // from the top, but only 80 documents to reach
+    let mut nodes = Vec::new();
+    for layer in 0..40i32 {
+        for side in 0..2i32 {
+            let next = if layer == 39 {
+                vec![]
+            } else {
+                vec![
+                    bson::Bson::Int32((layer + 1) * 2),
+                    bson::Bson::Int32((layer + 1) * 2 + 1),
+                ]
+            };
+            nodes.push(doc! {"_id": layer * 2 + side, "next": next});
+        }
+    }
+    let ins = doc! {"insert": "dag", "documents": nodes, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ins, 0, 1)).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    let graph = |from: &str| {
+        doc! {
+            "from": from,
+            "startWith": "$next",
+            "connectFromField": "next",
+            "connectToField": "_id",
+            "as": "below",
+            "depthField": "depth",
+        }
+    };
+    let pipeline = vec![
+        bson::Bson::Document(doc! {"$match": {"_id": {"$in": [0i32, 1i32, 78i32]}}}),
+        bson::Bson::Document(doc! {"$graphLookup": graph("dag")}),
+        bson::Bson::Document(doc! {"$sort": {"_id": 1i32}}),
+    ];
+    let agg = doc! {"aggregate": "dag", "pipeline": pipeline, "cursor": {}, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&agg, 0, 2)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let fb = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(fb.len(), 3, "{:?}", doc);
+    for (top, reached) in [(0, 78), (1, 78), (2, 0)] {
+        let below = fb[top].as_document().unwrap().get_array("below").unwrap();
+        assert_eq!(below.len(), reached);
+    }
+    let deepest = fb[0].as_document().unwrap().get_array("below").unwrap()[77]
+        .as_document()
+        .unwrap()
+        .get_i64("depth")
+        .unwrap();
+    assert_eq!(deepest, 38);
+
+    // A missing `from` collection finds nothing
+    let pipeline = vec![
+        bson::Bson::Document(doc! {"$match": {"_id": 0i32}}),
+        bson::Bson::Document(doc! {"$graphLookup": graph("nowhere")}),
+    ];
+    let agg = doc! {"aggregate": "dag", "pipeline": pipeline, "cursor": {}, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&agg, 0, 3)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let fb = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    let below = fb[0].as_document().unwrap().get_array("below").unwrap();
+    assert!(below.is_empty());
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -88,3 +88,64 @@ async fn e2e_lookup_basic() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+#[tokio::test]
+async fn e2e_lookup_then_replace_root() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("agg_lookup_root_{}", rand_suffix(6));
+    let ins = doc! {"insert": "orders", "documents": [ {"_id":"o1","sku":"A"}, {"_id":"o2","sku":"B"} ], "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+    let ins = doc! {"insert": "items", "documents": [ {"_id":"A","name":"apple","price":3i32}, {"_id":"B","name":"pear","price":5i32} ], "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    // Promote the joined item to the root, then keep working on it
+    let pipeline = vec![
+        bson::Bson::Document(
+            doc! {"$lookup": {"from": "items", "localField": "sku", "foreignField": "_id", "as": "item"}},
+        ),
+        bson::Bson::Document(doc! {"$unwind": "$item"}),
+        bson::Bson::Document(doc! {"$replaceRoot": {"newRoot": "$item"}}),
+        bson::Bson::Document(doc! {"$match": {"price": {"$gt": 4i32}}}),
+        bson::Bson::Document(doc! {"$replaceWith": {"label": "$name"}}),
+    ];
+    let agg = doc! {"aggregate": "orders", "pipeline": pipeline, "cursor": {}, "$db": &dbname};
+    let msg = encode_op_msg(&agg, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let fb = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(fb.len(), 1);
+    assert_eq!(fb[0].as_document().unwrap(), &doc! {"label": "pear"});
+
+    let pipeline = vec![bson::Bson::Document(
+        doc! {"$replaceRoot": {"newRoot": "$sku"}},
+    )];
+    let agg = doc! {"aggregate": "orders", "pipeline": pipeline, "cursor": {}, "$db": &dbname};
+    let msg = encode_op_msg(&agg, 0, 4);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(1.0), 0.0);
+    assert_eq!(doc.get_i32("code").unwrap_or(0), 40228);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
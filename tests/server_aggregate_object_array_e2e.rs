@@ -0,0 +1,120 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+fn int(v: Option<&bson::Bson>) -> Option<i64> {
+    match v? {
+        bson::Bson::Int32(n) => Some(*n as i64),
+        bson::Bson::Int64(n) => Some(*n),
+        bson::Bson::Double(n) => Some(*n as i64),
+        _ => None,
+    }
+}
+
+fn keys(kv: &bson::Array) -> Vec<String> {
+    let mut keys: Vec<String> = kv
+        .iter()
+        .map(|e| e.as_document().unwrap().get_str("k").unwrap().to_string())
+        .collect();
+    keys.sort();
+    keys
+}
+
+#[tokio::test]
+async fn e2e_object_to_array_round_trips() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("agg_o2a_{}", rand_suffix(6));
+    let ins = doc! {"insert": "u", "documents": [
+        {"_id": 1, "attrs": {"size": "L", "color": "red"}, "pairs": [["a", 1], ["b", 2], ["a", 3]]}
+    ], "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ins, 0, 1)).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    // Aggregation engine
+    let pipeline = vec![doc! {"$project": {
+        "kv": {"$objectToArray": "$attrs"},
+        "back": {"$arrayToObject": {"$objectToArray": "$attrs"}},
+        "obj": {"$arrayToObject": "$pairs"},
+    }}];
+    let agg = doc! {"aggregate": "u", "pipeline": pipeline, "cursor": {}, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&agg, 0, 2)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let fb = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    let d = fb[0].as_document().unwrap();
+    assert_eq!(keys(d.get_array("kv").unwrap()), ["color", "size"]);
+    let back = d.get_document("back").unwrap();
+    assert_eq!(back.get_str("size").unwrap(), "L");
+    assert_eq!(back.get_str("color").unwrap(), "red");
+    let obj = d.get_document("obj").unwrap();
+    assert_eq!(int(obj.get("a")), Some(3));
+    assert_eq!(int(obj.get("b")), Some(2));
+
+    // find projections push the conversions down to jsonb_each / jsonb_object_agg
+    let find = doc! {
+        "find": "u",
+        "filter": {},
+        "projection": {
+            "kv": {"$objectToArray": "$attrs"},
+            "obj": {"$arrayToObject": "$pairs"},
+        },
+        "$db": &dbname
+    };
+    stream.write_all(&encode_op_msg(&find, 0, 3)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", doc);
+    let fb = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    let d = fb[0].as_document().unwrap();
+    assert_eq!(keys(d.get_array("kv").unwrap()), ["color", "size"]);
+    let obj = d.get_document("obj").unwrap();
+    assert_eq!(int(obj.get("a")), Some(3));
+    assert_eq!(int(obj.get("b")), Some(2));
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
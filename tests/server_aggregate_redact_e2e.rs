@@ -0,0 +1,120 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+#[tokio::test]
+async fn e2e_aggregate_redact_prunes_subdocuments_by_level() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("agg_redact_{}", rand_suffix(6));
+
+    let docs = vec![
+        doc! {
+            "_id": "r1",
+            "level": 1i32,
+            "title": "quarterly",
+            "finance": {"level": 3i32, "revenue": 100i32},
+            "sections": [
+                {"level": 1i32, "body": "summary", "notes": [{"level": 2i32, "n": "ok"}, {"level": 4i32, "n": "hidden"}]},
+                {"level": 5i32, "body": "board only"},
+            ],
+        },
+        doc! {"_id": "r2", "level": 5i32, "title": "merger"},
+    ];
+    let ins = doc! {"insert": "reports", "documents": docs, "$db": &dbname};
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 2, "{:?}", reply);
+
+    // A reader cleared up to level 2 sees only the (sub)documents at or below it
+    let pipeline = vec![
+        doc! {"$redact": {"$cond": {
+            "if": {"$lte": ["$level", "$$clearance"]},
+            "then": "$$DESCEND",
+            "else": "$$PRUNE",
+        }}},
+        doc! {"$sort": {"_id": 1i32}},
+    ];
+    let agg = doc! {
+        "aggregate": "reports",
+        "pipeline": pipeline,
+        "let": {"clearance": 2i32},
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, agg, 2).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 1, "{:?}", batch);
+    assert_eq!(
+        batch[0].as_document().unwrap(),
+        &doc! {
+            "_id": "r1",
+            "level": 1i32,
+            "title": "quarterly",
+            "sections": [
+                {"level": 1i32, "body": "summary", "notes": [{"level": 2i32, "n": "ok"}]},
+            ],
+        }
+    );
+
+    // Anything but $$DESCEND, $$PRUNE or $$KEEP is an error
+    let agg = doc! {
+        "aggregate": "reports",
+        "pipeline": [{"$redact": "$title"}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, agg, 3).await;
+    assert_eq!(reply.get_i32("code").unwrap(), 17053, "{:?}", reply);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
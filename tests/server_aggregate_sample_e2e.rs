@@ -279,3 +279,62 @@ async fn e2e_aggregate_sample_with_match() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+#[tokio::test]
+async fn e2e_aggregate_match_then_sample() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("agg_{}", rand_suffix(6));
+
+    // create + insert 1..20, half of them even
+    let create = doc! {"create": "u", "$db": &dbname};
+    let msg = encode_op_msg(&create, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+    let docs: Vec<bson::Document> = (1..=20)
+        .map(|i| doc! {"i": i, "even": i % 2 == 0})
+        .collect();
+    let ins = doc! {"insert": "u", "documents": &docs, "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    // $match directly followed by $sample samples only matching docs, without replacement
+    let pipeline = vec![
+        bson::Bson::Document(doc! {"$match": {"even": true}}),
+        bson::Bson::Document(doc! {"$sample": {"size": 4}}),
+    ];
+    let agg = doc! {"aggregate": "u", "pipeline": pipeline, "cursor": {}, "$db": &dbname};
+    let msg = encode_op_msg(&agg, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+    let fb = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(fb.len(), 4);
+    let mut seen = std::collections::HashSet::new();
+    for d in fb {
+        let d = d.as_document().unwrap();
+        assert!(d.get_bool("even").unwrap());
+        assert!(seen.insert(d.get_i32("i").unwrap()));
+    }
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
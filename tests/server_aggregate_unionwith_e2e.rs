@@ -327,3 +327,81 @@ async fn e2e_unionwith_multiple_stages() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+#[tokio::test]
+async fn e2e_unionwith_between_matches() {
+    // $match on each side of the union pushes down into one UNION ALL query
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("agg_union_{}", rand_suffix(6));
+
+    let ins = doc! {
+        "insert": "sales_2023",
+        "documents": [
+            {"_id": "s23a", "region": "eu", "amount": 10i32},
+            {"_id": "s23b", "region": "us", "amount": 20i32},
+        ],
+        "$db": &dbname
+    };
+    let msg = encode_op_msg(&ins, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    // Different shape: schema differences are fine for JSONB documents
+    let ins = doc! {
+        "insert": "sales_2024",
+        "documents": [
+            {"_id": "s24a", "region": "eu", "amount": 30i32, "channel": "web"},
+            {"_id": "s24b", "region": "us", "amount": 40i32},
+            {"_id": "s24c", "region": "eu", "amount": 5i32},
+        ],
+        "$db": &dbname
+    };
+    let msg = encode_op_msg(&ins, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    let pipeline = vec![
+        bson::Bson::Document(doc! {"$match": {"region": "eu"}}),
+        bson::Bson::Document(doc! {"$unionWith": {
+            "coll": "sales_2024",
+            "pipeline": [ {"$match": {"region": "eu", "amount": {"$gte": 10i32}}} ],
+        }}),
+        bson::Bson::Document(doc! {"$match": {"amount": {"$lt": 100i32}}}),
+        bson::Bson::Document(doc! {"$sort": {"amount": 1i32}}),
+    ];
+    let agg = doc! {"aggregate": "sales_2023", "pipeline": pipeline, "cursor": {}, "$db": &dbname};
+    let msg = encode_op_msg(&agg, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+    let fb = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    let ids: Vec<&str> = fb
+        .iter()
+        .map(|d| d.as_document().unwrap().get_str("_id").unwrap())
+        .collect();
+    assert_eq!(ids, vec!["s23a", "s24a"]);
+    assert_eq!(
+        fb[1].as_document().unwrap().get_str("channel").unwrap(),
+        "web"
+    );
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,229 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, request_id: i32) -> bson::Document {
+    let msg = encode_op_msg(&cmd, 0, request_id);
+    stream.write_all(&msg).await.unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn first_batch(reply: &bson::Document) -> Vec<bson::Document> {
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().clone())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_set_window_fields_moving_average_per_partition() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("window_{}", rand_suffix(6));
+    let hour = 3_600_000i64;
+    let at = |h: i64| bson::DateTime::from_millis(h * hour);
+    let ins = doc! {
+        "insert": "readings",
+        "documents": [
+            {"_id": 1, "sensor": "a", "ts": at(0), "value": 10},
+            {"_id": 2, "sensor": "a", "ts": at(1), "value": 20},
+            {"_id": 3, "sensor": "b", "ts": at(0), "value": 100},
+            {"_id": 4, "sensor": "a", "ts": at(2), "value": 30},
+            {"_id": 5, "sensor": "a", "ts": at(5), "value": 40},
+        ],
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+
+    let agg = doc! {
+        "aggregate": "readings",
+        "pipeline": [
+            {"$setWindowFields": {
+                "partitionBy": "$sensor",
+                "sortBy": {"ts": 1},
+                "output": {
+                    "movingAvg": {"$avg": "$value", "window": {"documents": [-1, "current"]}},
+                    "lastTwoHours": {"$sum": "$value", "window": {"range": [-2, "current"], "unit": "hour"}},
+                    "previous": {"$shift": {"output": "$value", "by": -1}},
+                    "count": {"$count": {}},
+                },
+            }},
+            {"$project": {"_id": 1, "movingAvg": 1, "lastTwoHours": 1, "previous": 1, "count": 1}},
+        ],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let docs = first_batch(&run(&mut stream, agg, 2).await);
+    let ids: Vec<i32> = docs.iter().map(|d| d.get_i32("_id").unwrap()).collect();
+    assert_eq!(ids, vec![1, 2, 4, 5, 3]);
+    let moving: Vec<f64> = docs
+        .iter()
+        .map(|d| d.get_f64("movingAvg").unwrap())
+        .collect();
+    assert_eq!(moving, vec![10.0, 15.0, 25.0, 35.0, 100.0]);
+    let recent: Vec<i32> = docs
+        .iter()
+        .map(|d| d.get_i32("lastTwoHours").unwrap())
+        .collect();
+    assert_eq!(recent, vec![10, 30, 60, 40, 100]);
+    assert!(docs[0].get("previous").unwrap().as_null().is_some());
+    assert_eq!(docs[1].get_i32("previous").unwrap(), 10);
+    assert!(docs[4].get("previous").unwrap().as_null().is_some());
+    assert_eq!(docs[0].get_i32("count").unwrap(), 4);
+    assert_eq!(docs[4].get_i32("count").unwrap(), 1);
+
+    // Invalid specs are rejected when the pipeline is parsed
+    let agg = doc! {
+        "aggregate": "readings",
+        "pipeline": [{"$setWindowFields": {
+            "output": {"s": {"$sum": "$value", "window": {"documents": [-1, 0]}}},
+        }}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, agg, 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap_or(1.0), 0.0, "{:?}", reply);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_set_window_fields_ranks_scores_within_each_group() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("window_rank_{}", rand_suffix(6));
+    let ins = doc! {
+        "insert": "scores",
+        "documents": [
+            {"_id": 1, "team": "red", "score": 50},
+            {"_id": 2, "team": "red", "score": 80},
+            {"_id": 3, "team": "blue", "score": 60},
+            {"_id": 4, "team": "red", "score": 80},
+            {"_id": 5, "team": "red", "score": 70},
+            {"_id": 6, "team": "blue", "score": 90},
+        ],
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+
+    let agg = doc! {
+        "aggregate": "scores",
+        "pipeline": [
+            {"$setWindowFields": {
+                "partitionBy": "$team",
+                "sortBy": {"score": -1},
+                "output": {
+                    "rank": {"$rank": {}},
+                    "denseRank": {"$denseRank": {}},
+                    "position": {"$documentNumber": {}},
+                },
+            }},
+        ],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let docs = first_batch(&run(&mut stream, agg, 2).await);
+    let got: Vec<(String, i32, i32, i32, i32)> = docs
+        .iter()
+        .map(|d| {
+            (
+                d.get_str("team").unwrap().to_string(),
+                d.get_i32("score").unwrap(),
+                d.get_i32("rank").unwrap(),
+                d.get_i32("denseRank").unwrap(),
+                d.get_i32("position").unwrap(),
+            )
+        })
+        .collect();
+    let expected = [
+        ("blue", 90, 1, 1, 1),
+        ("blue", 60, 2, 2, 2),
+        ("red", 80, 1, 1, 1),
+        ("red", 80, 1, 1, 2),
+        ("red", 70, 3, 2, 3),
+        ("red", 50, 4, 3, 4),
+    ];
+    assert_eq!(
+        got,
+        expected
+            .iter()
+            .map(|(t, s, r, d, p)| (t.to_string(), *s, *r, *d, *p))
+            .collect::<Vec<_>>()
+    );
+
+    // Ranking needs exactly one sortBy field
+    let agg = doc! {
+        "aggregate": "scores",
+        "pipeline": [{"$setWindowFields": {
+            "sortBy": {"team": 1, "score": -1},
+            "output": {"rank": {"$rank": {}}},
+        }}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, agg, 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap_or(1.0), 0.0, "{:?}", reply);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
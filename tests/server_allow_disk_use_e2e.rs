@@ -0,0 +1,112 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn first_batch(reply: &bson::Document) -> Vec<bson::Document> {
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .filter_map(|b| b.as_document().cloned())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_blocking_stage_over_limit_requires_allow_disk_use() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.aggregation_memory_limit_bytes = Some(1024);
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("disk_use_{}", rand_suffix(6));
+    let documents: Vec<bson::Document> = (0..50i32)
+        .map(|i| doc! {"n": i, "group": i % 5, "pad": "x".repeat(64)})
+        .collect();
+    let ins = doc! {"insert": "events", "documents": documents, "$db": &dbname};
+    let r = run(&mut stream, ins, 1).await;
+    assert_eq!(r.get_i32("n").unwrap(), 50);
+
+    let group = doc! {"$group": {"_id": "$group", "total": {"$sum": "$n"}}};
+    let agg = doc! {
+        "aggregate": "events",
+        "pipeline": [group.clone()],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, agg, 2).await;
+    assert_eq!(r.get_f64("ok").unwrap(), 0.0);
+    assert_eq!(r.get_i32("code").unwrap(), 292);
+    assert_eq!(
+        r.get_str("codeName").unwrap(),
+        "QueryExceededMemoryLimitNoDiskUseAllowed"
+    );
+
+    let agg = doc! {
+        "aggregate": "events",
+        "pipeline": [group],
+        "cursor": {},
+        "allowDiskUse": true,
+        "$db": &dbname,
+    };
+    assert_eq!(first_batch(&run(&mut stream, agg, 3).await).len(), 5);
+
+    // A leading $sort is delegated to PostgreSQL's ORDER BY
+    let agg = doc! {
+        "aggregate": "events",
+        "pipeline": [{"$sort": {"n": -1i32}}, {"$limit": 3i32}],
+        "cursor": {},
+        "allowDiskUse": true,
+        "$db": &dbname,
+    };
+    let docs = first_batch(&run(&mut stream, agg, 4).await);
+    let ns: Vec<i32> = docs.iter().map(|d| d.get_i32("n").unwrap()).collect();
+    assert_eq!(ns, vec![49, 48, 47]);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,89 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+#[tokio::test]
+async fn e2e_app_name_appears_in_current_op_and_metrics() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+
+    // The driver sends `appName` from the connection string in its handshake
+    let mut app = TcpStream::connect(addr).await.unwrap();
+    let hello = doc! {
+        "hello": 1i32,
+        "client": {
+            "application": {"name": "billing-service"},
+            "driver": {"name": "nodejs", "version": "6.0.0"},
+        },
+        "$db": "admin",
+    };
+    let reply = run(&mut app, hello, 1).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+
+    // currentOp reports its own operation with the connection's appName
+    let ops = doc! {"currentOp": 1i32, "appName": "billing-service", "$db": "admin"};
+    let reply = run(&mut app, ops, 2).await;
+    let inprog = reply.get_array("inprog").unwrap();
+    assert_eq!(inprog.len(), 1, "{:?}", reply);
+    let op = inprog[0].as_document().unwrap();
+    assert_eq!(op.get_str("appName").unwrap(), "billing-service");
+    assert_eq!(
+        op.get_document("command")
+            .unwrap()
+            .get_i32("currentOp")
+            .unwrap(),
+        1
+    );
+
+    // A connection that reported no application name has none
+    let mut other = TcpStream::connect(addr).await.unwrap();
+    let reply = run(&mut other, doc! {"currentOp": 1i32, "$db": "admin"}, 3).await;
+    let inprog = reply.get_array("inprog").unwrap();
+    assert_eq!(inprog.len(), 1, "{:?}", reply);
+    assert!(!inprog[0].as_document().unwrap().contains_key("appName"));
+
+    // Metrics count the application's commands
+    let reply = run(&mut other, doc! {"oxidedbMetrics": 1i32, "$db": "admin"}, 4).await;
+    let metrics = reply.get_str("metrics").unwrap();
+    assert!(
+        metrics.contains("oxidedb_app_requests_total{app_name=\"billing-service\"} 2"),
+        "{}",
+        metrics
+    );
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
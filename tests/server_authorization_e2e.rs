@@ -0,0 +1,188 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::scram::ScramAuth;
+use oxidedb::server::spawn_with_shutdown;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn code(reply: &bson::Document) -> i32 {
+    reply.get_i32("code").unwrap_or(0)
+}
+
+#[tokio::test]
+async fn e2e_roles_limit_what_users_may_run() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.authorization_enabled = Some(true);
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+
+    // Before authenticating only the handshake works, plus the first user over loopback
+    let mut admin = TcpStream::connect(addr).await.unwrap();
+    let reply = run(&mut admin, doc! {"ping": 1i32, "$db": "admin"}, 1).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0);
+    let reply = run(&mut admin, doc! {"find": "c", "$db": "app"}, 2).await;
+    assert_eq!(code(&reply), 13, "{:?}", reply);
+    let create_root = doc! {
+        "createUser": "root",
+        "pwd": "root-pw",
+        "roles": [{"role": "root", "db": "admin"}],
+        "$db": "admin",
+    };
+    let reply = run(&mut admin, create_root.clone(), 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    // The exception closes once a user exists
+    let reply = run(&mut admin, create_root, 4).await;
+    assert_eq!(code(&reply), 13, "{:?}", reply);
+
+    ScramAuth::new("root".into(), "wrong".into(), "admin".into())
+        .authenticate(&mut admin, 5000)
+        .await
+        .unwrap_err();
+    ScramAuth::new("root".into(), "root-pw".into(), "admin".into())
+        .authenticate(&mut admin, 5000)
+        .await
+        .unwrap();
+
+    let reply = run(
+        &mut admin,
+        doc! {"insert": "c", "documents": [{"_id": 1, "x": 1}], "$db": "app"},
+        5,
+    )
+    .await;
+    assert_eq!(reply.get_i32("n").unwrap(), 1, "{:?}", reply);
+    let reply = run(
+        &mut admin,
+        doc! {"createUser": "reader", "pwd": "reader-pw", "roles": ["read"], "$db": "app"},
+        6,
+    )
+    .await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let reply = run(
+        &mut admin,
+        doc! {"createUser": "reader", "pwd": "x", "roles": ["read"], "$db": "app"},
+        7,
+    )
+    .await;
+    assert_eq!(code(&reply), 51003, "{:?}", reply);
+    let reply = run(
+        &mut admin,
+        doc! {"createUser": "bad", "pwd": "x", "roles": ["owner"], "$db": "app"},
+        8,
+    )
+    .await;
+    assert_eq!(code(&reply), 31, "{:?}", reply);
+
+    // hello names the mechanism for an existing user
+    let reply = run(
+        &mut admin,
+        doc! {"hello": 1i32, "saslSupportedMechs": "app.reader", "$db": "admin"},
+        9,
+    )
+    .await;
+    assert_eq!(
+        reply.get_array("saslSupportedMechs").unwrap(),
+        &vec![bson::Bson::String("SCRAM-SHA-256".into())]
+    );
+
+    // A read user finds but may not write, nor read another database
+    let mut reader = TcpStream::connect(addr).await.unwrap();
+    ScramAuth::new("reader".into(), "reader-pw".into(), "app".into())
+        .authenticate(&mut reader, 5000)
+        .await
+        .unwrap();
+    let reply = run(&mut reader, doc! {"find": "c", "$db": "app"}, 10).await;
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 1, "{:?}", reply);
+    let reply = run(
+        &mut reader,
+        doc! {"insert": "c", "documents": [{"_id": 2}], "$db": "app"},
+        11,
+    )
+    .await;
+    assert_eq!(code(&reply), 13, "{:?}", reply);
+    assert_eq!(reply.get_str("codeName").unwrap(), "Unauthorized");
+    let reply = run(&mut reader, doc! {"find": "c", "$db": "other"}, 12).await;
+    assert_eq!(code(&reply), 13, "{:?}", reply);
+    let reply = run(
+        &mut reader,
+        doc! {"find": "system.users", "$db": "admin"},
+        13,
+    )
+    .await;
+    assert_eq!(code(&reply), 13, "{:?}", reply);
+
+    // updateUser grants readWrite from the next authentication on
+    let reply = run(
+        &mut admin,
+        doc! {"updateUser": "reader", "roles": ["readWrite"], "$db": "app"},
+        14,
+    )
+    .await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let mut writer = TcpStream::connect(addr).await.unwrap();
+    ScramAuth::new("reader".into(), "reader-pw".into(), "app".into())
+        .authenticate(&mut writer, 5000)
+        .await
+        .unwrap();
+    let reply = run(
+        &mut writer,
+        doc! {"insert": "c", "documents": [{"_id": 2}], "$db": "app"},
+        15,
+    )
+    .await;
+    assert_eq!(reply.get_i32("n").unwrap(), 1, "{:?}", reply);
+
+    // logout returns the connection to unauthenticated
+    let reply = run(&mut writer, doc! {"logout": 1i32, "$db": "app"}, 16).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0);
+    let reply = run(&mut writer, doc! {"find": "c", "$db": "app"}, 17).await;
+    assert_eq!(code(&reply), 13, "{:?}", reply);
+
+    let reply = run(&mut admin, doc! {"dropUser": "reader", "$db": "app"}, 18).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let reply = run(&mut admin, doc! {"dropUser": "reader", "$db": "app"}, 19).await;
+    assert_eq!(code(&reply), 11, "{:?}", reply);
+    let mut gone = TcpStream::connect(addr).await.unwrap();
+    ScramAuth::new("reader".into(), "reader-pw".into(), "app".into())
+        .authenticate(&mut gone, 5000)
+        .await
+        .unwrap_err();
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
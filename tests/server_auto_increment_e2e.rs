@@ -0,0 +1,208 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, request_id: i32) -> bson::Document {
+    let msg = encode_op_msg(&cmd, 0, request_id);
+    stream.write_all(&msg).await.unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn first_batch(reply: &bson::Document) -> Vec<bson::Document> {
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().clone())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_auto_increment_fills_missing_field() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("autoinc_{}", rand_suffix(6));
+    let create = doc! {
+        "create": "orders",
+        "autoIncrement": {"field": "orderNo", "start": 100},
+        "$db": &dbname,
+    };
+    assert_eq!(
+        run(&mut stream, create, 1).await.get_f64("ok").unwrap(),
+        1.0
+    );
+
+    // A document carrying the field keeps its value and draws nothing
+    let ins = doc! {
+        "insert": "orders",
+        "documents": [{"item": "a"}, {"item": "b", "orderNo": 5}, {"item": "c"}],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, ins, 2).await.get_i32("n").unwrap(), 3);
+    let next = run(
+        &mut stream,
+        doc! {"getNextSequence": "orders", "$db": &dbname},
+        3,
+    )
+    .await;
+    assert_eq!(next.get_i64("value").unwrap(), 102);
+    let ins = doc! {"insert": "orders", "documents": [{"item": "d"}], "$db": &dbname};
+    assert_eq!(run(&mut stream, ins, 4).await.get_i32("n").unwrap(), 1);
+
+    let find = doc! {"find": "orders", "sort": {"$natural": 1}, "$db": &dbname};
+    let docs = first_batch(&run(&mut stream, find, 5).await);
+    let numbers: Vec<i64> = docs
+        .iter()
+        .map(|d| match d.get("orderNo").unwrap() {
+            bson::Bson::Int32(n) => *n as i64,
+            bson::Bson::Int64(n) => *n,
+            other => panic!("unexpected orderNo {:?}", other),
+        })
+        .collect();
+    assert_eq!(numbers, vec![100, 5, 101, 103]);
+    // `_id` is still an ObjectId
+    assert!(docs.iter().all(|d| d.get_object_id("_id").is_ok()));
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_auto_increment_concurrent_inserts_never_collide() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("autoinc_{}", rand_suffix(6));
+    let create = doc! {"create": "tickets", "autoIncrement": {"field": "n"}, "$db": &dbname};
+    assert_eq!(
+        run(&mut stream, create, 1).await.get_f64("ok").unwrap(),
+        1.0
+    );
+
+    let mut tasks = Vec::new();
+    for client in 0..4 {
+        let dbname = dbname.clone();
+        tasks.push(tokio::spawn(async move {
+            let mut stream = TcpStream::connect(addr).await.unwrap();
+            for i in 0..10 {
+                let ins = doc! {
+                    "insert": "tickets",
+                    "documents": [{"client": client}, {"client": client}],
+                    "$db": &dbname,
+                };
+                assert_eq!(run(&mut stream, ins, i + 1).await.get_i32("n").unwrap(), 2);
+            }
+        }));
+    }
+    for t in tasks {
+        t.await.unwrap();
+    }
+
+    let find = doc! {"find": "tickets", "batchSize": 1000, "$db": &dbname};
+    let mut numbers: Vec<i64> = first_batch(&run(&mut stream, find, 2).await)
+        .iter()
+        .map(|d| d.get_i64("n").unwrap())
+        .collect();
+    numbers.sort();
+    assert_eq!(numbers, (1..=80).collect::<Vec<i64>>());
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_auto_increment_rejects_bad_options() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("autoinc_{}", rand_suffix(6));
+    for (i, spec) in [
+        doc! {"field": "_id"},
+        doc! {"field": "a.b"},
+        doc! {"start": 1},
+    ]
+    .into_iter()
+    .enumerate()
+    {
+        let create = doc! {"create": "bad", "autoIncrement": spec, "$db": &dbname};
+        let reply = run(&mut stream, create, i as i32 + 1).await;
+        assert_eq!(reply.get_f64("ok").unwrap(), 0.0, "{:?}", reply);
+        assert_eq!(reply.get_i32("code").unwrap(), 2);
+    }
+
+    let create = doc! {"create": "plain", "$db": &dbname};
+    assert_eq!(
+        run(&mut stream, create, 10).await.get_f64("ok").unwrap(),
+        1.0
+    );
+    let reply = run(
+        &mut stream,
+        doc! {"getNextSequence": "plain", "$db": &dbname},
+        11,
+    )
+    .await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 0.0);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
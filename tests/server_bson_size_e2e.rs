@@ -0,0 +1,165 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+/// Build a document whose BSON encoding is exactly `size` bytes.
+fn doc_of_size(id: i32, size: usize) -> bson::Document {
+    let mut d = doc! {"_id": id, "pad": ""};
+    let base = bson::to_vec(&d).unwrap().len();
+    d.insert("pad", "x".repeat(size - base));
+    assert_eq!(bson::to_vec(&d).unwrap().len(), size);
+    d
+}
+
+#[tokio::test]
+async fn e2e_insert_rejects_document_over_max_bson_size() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let hello = doc! {"hello": 1i32, "$db": "admin"};
+    let msg = encode_op_msg(&hello, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let max = doc.get_i32("maxBsonObjectSize").unwrap() as usize;
+    assert_eq!(max, 16 * 1024 * 1024);
+
+    let dbname = format!("bsonsize_{}", rand_suffix(6));
+    let ins = doc! {"insert": "big", "documents": [doc_of_size(1, max), doc_of_size(2, max + 1)], "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0);
+    assert_eq!(doc.get_i32("n").unwrap(), 1);
+    let errs = doc.get_array("writeErrors").unwrap();
+    assert_eq!(errs.len(), 1);
+    let e0 = errs[0].as_document().unwrap();
+    assert_eq!(e0.get_i32("index").unwrap(), 1);
+    assert_eq!(e0.get_i32("code").unwrap(), 10334);
+    assert_eq!(e0.get_str("codeName").unwrap(), "BSONObjectTooLarge");
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_max_bson_size_is_configurable() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.max_bson_object_size = Some(1024);
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let build_info = doc! {"buildInfo": 1i32, "$db": "admin"};
+    let msg = encode_op_msg(&build_info, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("maxBsonObjectSize").unwrap(), 1024);
+
+    let dbname = format!("bsonsize_{}", rand_suffix(6));
+    let ins = doc! {"insert": "small", "documents": [doc_of_size(1, 1025)], "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("n").unwrap(), 0);
+    let errs = doc.get_array("writeErrors").unwrap();
+    assert_eq!(errs[0].as_document().unwrap().get_i32("code").unwrap(), 10334);
+
+    // Upserted documents are checked too
+    let big = "x".repeat(2048);
+    let upd = doc! {"update": "small", "updates": [{"q": {"_id": 9i32}, "u": {"$set": {"pad": big}}, "upsert": true}], "$db": &dbname};
+    let msg = encode_op_msg(&upd, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0);
+    let errs = doc.get_array("writeErrors").unwrap();
+    assert_eq!(
+        errs[0].as_document().unwrap().get_i32("code").unwrap(),
+        10334
+    );
+
+    // So are existing documents an update grows
+    let ins = doc! {"insert": "small", "documents": [{"_id": 2i32, "items": []}], "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 4);
+    stream.write_all(&msg).await.unwrap();
+    assert_eq!(read_one_op_msg(&mut stream).await.get_i32("n").unwrap(), 1);
+    let items: Vec<String> = (0..20).map(|i| format!("{:060}", i)).collect();
+    let push = doc! {"update": "small", "updates": [{"q": {"_id": 2i32}, "u": {"$push": {"items": items}}}], "$db": &dbname};
+    let msg = encode_op_msg(&push, 0, 5);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0);
+    let errs = doc.get_array("writeErrors").unwrap();
+    assert_eq!(
+        errs[0].as_document().unwrap().get_i32("code").unwrap(),
+        10334
+    );
+    let fam = doc! {"findAndModify": "small", "query": {"_id": 2i32}, "update": {"$push": {"items": "x".repeat(2048)}}, "$db": &dbname};
+    let msg = encode_op_msg(&fam, 0, 6);
+    stream.write_all(&msg).await.unwrap();
+    assert_eq!(
+        read_one_op_msg(&mut stream).await.get_i32("code").unwrap(),
+        10334
+    );
+
+    // The rejected updates left the document as it was
+    let find = doc! {"find": "small", "filter": {"_id": 2i32}, "$db": &dbname};
+    let msg = encode_op_msg(&find, 0, 7);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let found = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()[0]
+        .as_document()
+        .unwrap()
+        .clone();
+    assert!(found.get_array("items").unwrap().is_empty());
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
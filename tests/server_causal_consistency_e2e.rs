@@ -0,0 +1,142 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+use uuid::Uuid;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn create_lsid() -> bson::Document {
+    let uuid = Uuid::new_v4();
+    doc! {
+        "id": bson::Bson::Binary(bson::Binary {
+            subtype: bson::spec::BinarySubtype::Uuid,
+            bytes: uuid.as_bytes().to_vec(),
+        })
+    }
+}
+
+#[tokio::test]
+async fn e2e_after_cluster_time_reads_its_own_writes() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    // A driver may send a session's commands over different pooled connections
+    let mut writer = TcpStream::connect(addr).await.unwrap();
+    let mut reader = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("causal_{}", rand_suffix(6));
+    let lsid = create_lsid();
+
+    let ins = doc! {
+        "insert": "events",
+        "documents": [{"_id": "e1", "kind": "signup"}],
+        "lsid": lsid.clone(),
+        "$db": &dbname,
+    };
+    let reply = run(&mut writer, ins, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 1, "{:?}", reply);
+    let write_time = reply.get_timestamp("operationTime").unwrap();
+    let cluster_time = reply.get_document("$clusterTime").unwrap().clone();
+
+    let find = doc! {
+        "find": "events",
+        "filter": {"_id": "e1"},
+        "readConcern": {"level": "local", "afterClusterTime": write_time},
+        "lsid": lsid.clone(),
+        "$clusterTime": cluster_time,
+        "$db": &dbname,
+    };
+    let reply = run(&mut reader, find, 2).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 1, "{:?}", reply);
+
+    // A time the server has not reached yet is waited for...
+    let soon = bson::Timestamp {
+        time: write_time.time + 1,
+        increment: 1,
+    };
+    let find = doc! {
+        "find": "events",
+        "filter": {},
+        "readConcern": {"afterClusterTime": soon},
+        "maxTimeMS": 10_000i32,
+        "lsid": lsid.clone(),
+        "$db": &dbname,
+    };
+    let reply = run(&mut reader, find, 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let read_time = reply.get_timestamp("operationTime").unwrap();
+    assert!((read_time.time, read_time.increment) > (soon.time, soon.increment));
+
+    // ...for no longer than maxTimeMS
+    let far = bson::Timestamp {
+        time: write_time.time + 3600,
+        increment: 1,
+    };
+    let find = doc! {
+        "find": "events",
+        "filter": {},
+        "readConcern": {"afterClusterTime": far},
+        "maxTimeMS": 50i32,
+        "$db": &dbname,
+    };
+    let reply = run(&mut reader, find, 4).await;
+    assert_eq!(reply.get_i32("code").unwrap(), 50, "{:?}", reply);
+
+    let find = doc! {
+        "find": "events",
+        "filter": {},
+        "readConcern": {"afterClusterTime": 1i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut reader, find, 5).await;
+    assert_eq!(reply.get_i32("code").unwrap(), 14, "{:?}", reply);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
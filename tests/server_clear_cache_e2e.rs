@@ -0,0 +1,108 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn cleared(reply: &bson::Document, key: &str) -> i64 {
+    reply.get_document("cleared").unwrap().get_i64(key).unwrap()
+}
+
+#[tokio::test]
+async fn e2e_clear_cache_reports_and_flushes_entries() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("clear_cache_{}", rand_suffix(6));
+    let ins = doc! {"insert": "items", "documents": [{"a": 1i32}], "$db": &dbname};
+    let r = run(&mut stream, ins, 1).await;
+    assert_eq!(r.get_f64("ok").unwrap(), 1.0);
+
+    let r = run(
+        &mut stream,
+        doc! {"oxidedbClearCache": 1i32, "$db": "admin"},
+        2,
+    )
+    .await;
+    assert_eq!(r.get_f64("ok").unwrap(), 1.0);
+    assert!(cleared(&r, "databases") >= 1);
+    assert!(cleared(&r, "collections") >= 1);
+
+    // Nothing left to clear on a second call
+    let r = run(
+        &mut stream,
+        doc! {"oxidedbClearCache": 1i32, "$db": "admin"},
+        3,
+    )
+    .await;
+    assert_eq!(cleared(&r, "databases"), 0);
+    assert_eq!(cleared(&r, "collections"), 0);
+    assert_eq!(cleared(&r, "collations"), 0);
+
+    // Writes still work once the caches are cold, including after a drop
+    let ins = doc! {"insert": "items", "documents": [{"a": 2i32}], "$db": &dbname};
+    let r = run(&mut stream, ins, 4).await;
+    assert_eq!(r.get_i32("n").unwrap(), 1);
+    let r = run(&mut stream, doc! {"drop": "items", "$db": &dbname}, 5).await;
+    assert_eq!(r.get_f64("ok").unwrap(), 1.0);
+    let ins = doc! {"insert": "items", "documents": [{"a": 3i32}], "$db": &dbname};
+    let r = run(&mut stream, ins, 6).await;
+    assert_eq!(r.get_i32("n").unwrap(), 1);
+    let r = run(
+        &mut stream,
+        doc! {"find": "items", "filter": {}, "$db": &dbname},
+        7,
+    )
+    .await;
+    let batch = r
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 1);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
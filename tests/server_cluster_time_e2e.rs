@@ -0,0 +1,126 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn cluster_time(reply: &bson::Document) -> bson::Timestamp {
+    reply
+        .get_document("$clusterTime")
+        .unwrap()
+        .get_timestamp("clusterTime")
+        .unwrap()
+}
+
+fn later(a: bson::Timestamp, b: bson::Timestamp) -> bool {
+    (a.time, a.increment) > (b.time, b.increment)
+}
+
+#[tokio::test]
+async fn e2e_replies_gossip_a_monotonic_cluster_time() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("clock_{}", rand_suffix(6));
+
+    // Every reply, errors included, carries both fields and each operation is later
+    let ins = doc! {"insert": "c", "documents": [{"_id": "a"}], "$db": &dbname};
+    let write = run(&mut stream, ins, 1).await;
+    assert_eq!(write.get_i32("n").unwrap(), 1, "{:?}", write);
+    let write_time = write.get_timestamp("operationTime").unwrap();
+    assert!(!later(write_time, cluster_time(&write)));
+    let signature = write
+        .get_document("$clusterTime")
+        .unwrap()
+        .get_document("signature")
+        .unwrap();
+    assert_eq!(signature.get_i64("keyId").unwrap(), 0);
+
+    let find = doc! {"find": "c", "filter": {}, "$db": &dbname};
+    let read = run(&mut stream, find, 2).await;
+    let read_time = read.get_timestamp("operationTime").unwrap();
+    assert!(
+        later(read_time, write_time),
+        "{:?} {:?}",
+        read_time,
+        write_time
+    );
+
+    let bad = doc! {"noSuchCommand": 1i32, "$db": &dbname};
+    let err = run(&mut stream, bad, 3).await;
+    assert_eq!(err.get_f64("ok").unwrap(), 0.0);
+    assert!(later(
+        err.get_timestamp("operationTime").unwrap(),
+        read_time
+    ));
+
+    // A later time gossiped by the client moves the clock forward
+    let ahead = bson::Timestamp {
+        time: cluster_time(&err).time + 3600,
+        increment: 5,
+    };
+    let ping = doc! {
+        "ping": 1i32,
+        "$clusterTime": {"clusterTime": ahead, "signature": signature.clone()},
+        "$db": "admin",
+    };
+    let reply = run(&mut stream, ping, 4).await;
+    assert!(later(cluster_time(&reply), ahead), "{:?}", reply);
+
+    // ...and an earlier one never moves it back
+    let behind = bson::Timestamp {
+        time: 1,
+        increment: 1,
+    };
+    let ping = doc! {
+        "ping": 1i32,
+        "$clusterTime": {"clusterTime": behind, "signature": signature.clone()},
+        "$db": "admin",
+    };
+    let again = run(&mut stream, ping, 5).await;
+    assert!(later(cluster_time(&again), cluster_time(&reply)));
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
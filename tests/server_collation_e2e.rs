@@ -0,0 +1,330 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn names(reply: &bson::Document) -> Vec<String> {
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .filter_map(|b| b.as_document())
+        .map(|d| d.get_str("name").unwrap().to_string())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_case_insensitive_collation() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("collation_{}", rand_suffix(6));
+    let ins = doc! {
+        "insert": "products",
+        "documents": [
+            {"name": "banana", "n": 1i32},
+            {"name": "Apple", "n": 2i32},
+            {"name": "cherry", "n": 3i32},
+            {"name": "APPLE", "n": 4i32},
+            {"name": "Banana", "n": 5i32},
+        ],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, ins, 1).await.get_f64("ok").unwrap(), 1.0);
+    let ci = doc! {"locale": "en", "strength": 2i32};
+
+    // Equality ignores case with strength 2, and matches exactly without a collation
+    let find = doc! {"find": "products", "filter": {"name": "apple"}, "collation": ci.clone(), "$db": &dbname};
+    assert_eq!(names(&run(&mut stream, find, 2).await).len(), 2);
+    let find = doc! {"find": "products", "filter": {"name": "apple"}, "$db": &dbname};
+    assert!(names(&run(&mut stream, find, 3).await).is_empty());
+
+    let find = doc! {
+        "find": "products",
+        "filter": {"name": {"$in": ["BANANA", "Cherry"]}},
+        "collation": ci.clone(),
+        "$db": &dbname,
+    };
+    assert_eq!(names(&run(&mut stream, find, 4).await).len(), 3);
+    let find = doc! {
+        "find": "products",
+        "filter": {"name": {"$ne": "BANANA"}},
+        "collation": ci.clone(),
+        "$db": &dbname,
+    };
+    assert_eq!(names(&run(&mut stream, find, 5).await).len(), 3);
+
+    // Sorting interleaves upper and lower case instead of ordering by code point
+    let find = doc! {"find": "products", "sort": {"name": 1i32, "n": 1i32}, "collation": ci.clone(), "$db": &dbname};
+    assert_eq!(
+        names(&run(&mut stream, find, 6).await),
+        vec!["Apple", "APPLE", "banana", "Banana", "cherry"]
+    );
+
+    let agg = doc! {
+        "aggregate": "products",
+        "pipeline": [{"$match": {"name": "BANANA"}}, {"$sort": {"n": -1i32}}],
+        "cursor": {},
+        "collation": ci.clone(),
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, agg, 7).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0);
+    assert_eq!(names(&doc), vec!["Banana", "banana"]);
+
+    // A collated index is built on the same lower() expression the queries use
+    let idx = doc! {
+        "createIndexes": "products",
+        "indexes": [{"name": "name_ci", "key": {"name": 1i32}, "collation": ci.clone()}],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, idx, 8).await.get_f64("ok").unwrap(), 1.0);
+    let client = state.store.as_ref().unwrap().pool().get().await.unwrap();
+    let row = client
+        .query_one(
+            "SELECT indexdef FROM pg_indexes WHERE schemaname = $1 AND indexname = 'name_ci'",
+            &[&format!("mdb_{}", dbname)],
+        )
+        .await
+        .unwrap();
+    let indexdef: String = row.get(0);
+    assert!(indexdef.contains("lower("), "{}", indexdef);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_unsupported_collation_options_are_rejected() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("collation_{}", rand_suffix(6));
+    let bad = [
+        doc! {"locale": "en", "strength": 1i32},
+        doc! {"locale": "en", "numericOrdering": true},
+        doc! {"locale": "en", "caseFirst": "upper"},
+        doc! {"strength": 2i32},
+    ];
+    for (i, collation) in bad.into_iter().enumerate() {
+        let find = doc! {"find": "products", "filter": {}, "collation": collation, "$db": &dbname};
+        let doc = run(&mut stream, find, i as i32 + 1).await;
+        assert_eq!(doc.get_f64("ok").unwrap(), 0.0);
+        assert_eq!(doc.get_i32("code").unwrap(), 2);
+    }
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_collection_default_collation() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("collation_{}", rand_suffix(6));
+    let create = doc! {
+        "create": "names",
+        "collation": {"locale": "en", "strength": 2i32},
+        "$db": &dbname,
+    };
+    assert_eq!(
+        run(&mut stream, create, 1).await.get_f64("ok").unwrap(),
+        1.0
+    );
+    let ins = doc! {
+        "insert": "names",
+        "documents": [{"name": "Zoe"}, {"name": "alice"}, {"name": "ALICE"}],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, ins, 2).await.get_f64("ok").unwrap(), 1.0);
+
+    // listCollections reports the default collation in the collection options
+    let doc = run(
+        &mut stream,
+        doc! {"listCollections": 1i32, "$db": &dbname},
+        3,
+    )
+    .await;
+    let colls = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    let names_coll = colls
+        .iter()
+        .filter_map(|b| b.as_document())
+        .find(|d| d.get_str("name").unwrap() == "names")
+        .unwrap();
+    let collation = names_coll
+        .get_document("options")
+        .unwrap()
+        .get_document("collation")
+        .unwrap();
+    assert_eq!(collation.get_str("locale").unwrap(), "en");
+
+    // Queries and sorts use the default unless the operation overrides it
+    let find = doc! {"find": "names", "filter": {"name": "Alice"}, "$db": &dbname};
+    assert_eq!(names(&run(&mut stream, find, 4).await).len(), 2);
+    let find = doc! {
+        "find": "names",
+        "filter": {"name": "Alice"},
+        "collation": {"locale": "simple"},
+        "$db": &dbname,
+    };
+    assert!(names(&run(&mut stream, find, 5).await).is_empty());
+    let find = doc! {"find": "names", "filter": {}, "sort": {"name": -1i32}, "$db": &dbname};
+    assert_eq!(names(&run(&mut stream, find, 6).await)[0], "Zoe");
+
+    // Indexes created without a collation inherit the default
+    let idx = doc! {
+        "createIndexes": "names",
+        "indexes": [{"name": "name_1", "key": {"name": 1i32}}],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, idx, 7).await.get_f64("ok").unwrap(), 1.0);
+    let client = state.store.as_ref().unwrap().pool().get().await.unwrap();
+    let row = client
+        .query_one(
+            "SELECT indexdef FROM pg_indexes WHERE schemaname = $1 AND indexname = 'name_1'",
+            &[&format!("mdb_{}", dbname)],
+        )
+        .await
+        .unwrap();
+    let indexdef: String = row.get(0);
+    assert!(indexdef.contains("lower("), "{}", indexdef);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_case_insensitive_unique_index() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("collation_{}", rand_suffix(6));
+    let idx = doc! {
+        "createIndexes": "accounts",
+        "indexes": [{
+            "name": "email_1",
+            "key": {"email": 1i32},
+            "unique": true,
+            "collation": {"locale": "en", "strength": 2i32},
+        }],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, idx, 1).await.get_f64("ok").unwrap(), 1.0);
+
+    let ins = doc! {
+        "insert": "accounts",
+        "documents": [{"email": "Foo@x.com"}],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, ins, 2).await.get_i32("n").unwrap(), 1);
+
+    // The same address in another case is a duplicate key
+    let ins = doc! {
+        "insert": "accounts",
+        "documents": [{"email": "foo@x.com"}],
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, ins, 3).await;
+    assert_eq!(doc.get_i32("n").unwrap(), 0);
+    let err = doc.get_array("writeErrors").unwrap()[0]
+        .as_document()
+        .unwrap()
+        .clone();
+    assert_eq!(err.get_i32("code").unwrap(), 11000, "{:?}", err);
+    assert!(
+        err.get_str("errmsg").unwrap().contains("E11000"),
+        "{:?}",
+        err
+    );
+
+    // Values of other types are keyed apart from strings
+    let ins = doc! {
+        "insert": "accounts",
+        "documents": [{"email": "bar@x.com"}, {"email": 1i32}, {"email": "1"}],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, ins, 4).await.get_i32("n").unwrap(), 3);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
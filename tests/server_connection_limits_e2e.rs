@@ -0,0 +1,131 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+#[tokio::test]
+async fn e2e_idle_connection_is_closed_and_its_cursors_released() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.connection_idle_timeout_secs = Some(1);
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("connlim_{}", rand_suffix(6));
+
+    let ins = doc! {"insert": "u", "documents": [{"i": 1}, {"i": 2}, {"i": 3}], "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ins, 0, 1)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("n").unwrap_or(0), 3);
+
+    // Requests inside the idle window keep the connection open
+    tokio::time::sleep(Duration::from_millis(600)).await;
+    let find = doc! {"find": "u", "filter": {}, "batchSize": 1i32, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&find, 0, 2)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor_id = doc.get_document("cursor").unwrap().get_i64("id").unwrap();
+    assert_ne!(cursor_id, 0);
+
+    // Past the idle timeout the server closes the connection
+    tokio::time::sleep(Duration::from_millis(1500)).await;
+    let mut buf = [0u8; 1];
+    let n = tokio::time::timeout(Duration::from_secs(2), stream.read(&mut buf))
+        .await
+        .expect("connection should be closed")
+        .unwrap_or(0);
+    assert_eq!(n, 0);
+
+    // ...and the cursor it opened is gone
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let gm = doc! {"getMore": cursor_id, "collection": "u", "$db": &dbname};
+    stream.write_all(&encode_op_msg(&gm, 0, 3)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert_eq!(cursor.get_i64("id").unwrap(), 0);
+    assert!(cursor.get_array("nextBatch").unwrap().is_empty());
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_client_disconnect_releases_its_cursors() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("connlim_{}", rand_suffix(6));
+
+    let ins = doc! {"insert": "u", "documents": [{"i": 1}, {"i": 2}, {"i": 3}], "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ins, 0, 1)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("n").unwrap_or(0), 3);
+
+    let find = doc! {"find": "u", "filter": {}, "batchSize": 1i32, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&find, 0, 2)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor_id = doc.get_document("cursor").unwrap().get_i64("id").unwrap();
+    assert_ne!(cursor_id, 0);
+
+    // The client hangs up without killing its cursor
+    drop(stream);
+    tokio::time::sleep(Duration::from_millis(300)).await;
+
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let gm = doc! {"getMore": cursor_id, "collection": "u", "$db": &dbname};
+    stream.write_all(&encode_op_msg(&gm, 0, 3)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert_eq!(cursor.get_i64("id").unwrap(), 0);
+    assert!(cursor.get_array("nextBatch").unwrap().is_empty());
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -138,6 +138,147 @@ async fn e2e_cursors_find_getmore_kill() {
     let _ = handle.await.unwrap();
 }
 
+#[tokio::test]
+async fn e2e_find_batch_size_sizes_first_batch() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("batch_size_{}", rand_suffix(6));
+    let docs: Vec<bson::Document> = (0..30i32).map(|i| doc! {"i": i}).collect();
+    let ins = doc! {"insert": "u", "documents": docs, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ins, 0, 1)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("n").unwrap_or(0), 30);
+
+    // batchSize 0 opens a cursor without returning anything
+    let find = doc! {"find": "u", "filter": {}, "batchSize": 0i32, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&find, 0, 2)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert_eq!(cursor.get_array("firstBatch").unwrap().len(), 0);
+    let mut id = cursor.get_i64("id").unwrap();
+    assert_ne!(id, 0);
+
+    // Every document is reachable through getMore, a batch at a time (no truncation)
+    let mut seen = 0;
+    let mut req = 3;
+    while id != 0 {
+        let gm = doc! {"getMore": id, "collection": "u", "batchSize": 4i32, "$db": &dbname};
+        stream.write_all(&encode_op_msg(&gm, 0, req)).await.unwrap();
+        req += 1;
+        let doc = read_one_op_msg(&mut stream).await;
+        let cursor = doc.get_document("cursor").unwrap();
+        let batch = cursor.get_array("nextBatch").unwrap();
+        assert!(batch.len() <= 4);
+        seen += batch.len();
+        id = cursor.get_i64("id").unwrap();
+    }
+    assert_eq!(seen, 30);
+
+    // limit bounds the whole result, batchSize only the first batch
+    let find = doc! {"find": "u", "filter": {}, "batchSize": 5i32, "limit": 7i32, "$db": &dbname};
+    stream
+        .write_all(&encode_op_msg(&find, 0, req))
+        .await
+        .unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert_eq!(cursor.get_array("firstBatch").unwrap().len(), 5);
+    let id = cursor.get_i64("id").unwrap();
+    assert_ne!(id, 0);
+    let gm = doc! {"getMore": id, "collection": "u", "$db": &dbname};
+    stream
+        .write_all(&encode_op_msg(&gm, 0, req + 1))
+        .await
+        .unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert_eq!(cursor.get_array("nextBatch").unwrap().len(), 2);
+    assert_eq!(cursor.get_i64("id").unwrap(), 0);
+
+    let find = doc! {"find": "u", "filter": {}, "batchSize": -1i32, "$db": &dbname};
+    stream
+        .write_all(&encode_op_msg(&find, 0, req + 2))
+        .await
+        .unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(1.0), 0.0);
+    assert_eq!(doc.get_i32("code").unwrap(), 2);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_find_negative_limit_returns_single_batch() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("single_batch_{}", rand_suffix(6));
+    let docs: Vec<bson::Document> = (0..10i32).map(|i| doc! {"i": i}).collect();
+    let ins = doc! {"insert": "u", "documents": docs, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ins, 0, 1)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("n").unwrap_or(0), 10);
+
+    // Negative limit: up to abs(limit) documents, cursor closed even with batchSize smaller
+    let find = doc! {"find": "u", "filter": {}, "limit": -3i32, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&find, 0, 2)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert_eq!(cursor.get_array("firstBatch").unwrap().len(), 3);
+    assert_eq!(cursor.get_i64("id").unwrap(), 0);
+
+    let find = doc! {"find": "u", "filter": {}, "limit": -6i32, "batchSize": 2i32, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&find, 0, 3)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert_eq!(cursor.get_array("firstBatch").unwrap().len(), 2);
+    assert_eq!(cursor.get_i64("id").unwrap(), 0);
+
+    // A positive limit still streams across batches
+    let find = doc! {"find": "u", "filter": {}, "limit": 6i32, "batchSize": 2i32, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&find, 0, 4)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert_eq!(cursor.get_array("firstBatch").unwrap().len(), 2);
+    let id = cursor.get_i64("id").unwrap();
+    assert_ne!(id, 0);
+    let gm = doc! {"getMore": id, "collection": "u", "batchSize": 10i32, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&gm, 0, 5)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert_eq!(cursor.get_array("nextBatch").unwrap().len(), 4);
+    assert_eq!(cursor.get_i64("id").unwrap(), 0);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
 #[tokio::test]
 async fn e2e_cursor_ttl_prune() {
     let testdb = match pg::TestDb::provision_from_env().await {
@@ -195,3 +336,267 @@ async fn e2e_cursor_ttl_prune() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+#[tokio::test]
+async fn e2e_await_data_get_more_waits_for_new_documents() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("cursors_{}", rand_suffix(6));
+
+    let insert = doc! {"insert": "events", "documents": [{"n": 1}], "$db": &dbname};
+    stream
+        .write_all(&encode_op_msg(&insert, 0, 1))
+        .await
+        .unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+
+    let find = doc! {"find": "events", "tailable": true, "awaitData": true, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&find, 0, 2)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert_eq!(cursor.get_array("firstBatch").unwrap().len(), 1);
+    let cursor_id = cursor.get_i64("id").unwrap();
+    assert_ne!(
+        cursor_id, 0,
+        "tailable cursor stays open at the end of the data"
+    );
+
+    // Insert from another connection while the getMore below is waiting
+    let writer_db = dbname.clone();
+    let writer = tokio::spawn(async move {
+        tokio::time::sleep(Duration::from_millis(300)).await;
+        let mut s = TcpStream::connect(addr).await.unwrap();
+        let insert = doc! {"insert": "events", "documents": [{"n": 2}], "$db": &writer_db};
+        s.write_all(&encode_op_msg(&insert, 0, 1)).await.unwrap();
+        read_one_op_msg(&mut s).await
+    });
+
+    let started = std::time::Instant::now();
+    let gm =
+        doc! {"getMore": cursor_id, "collection": "events", "maxTimeMS": 5000i64, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&gm, 0, 3)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    let batch = cursor.get_array("nextBatch").unwrap();
+    assert_eq!(batch.len(), 1);
+    assert_eq!(batch[0].as_document().unwrap().get_i32("n").unwrap(), 2);
+    assert!(started.elapsed() < Duration::from_secs(5));
+    assert_eq!(cursor.get_i64("id").unwrap(), cursor_id);
+    writer.await.unwrap();
+
+    // Nothing new: the getMore blocks for maxTimeMS, then returns an empty batch
+    let started = std::time::Instant::now();
+    let gm =
+        doc! {"getMore": cursor_id, "collection": "events", "maxTimeMS": 200i64, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&gm, 0, 4)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert!(cursor.get_array("nextBatch").unwrap().is_empty());
+    assert_eq!(cursor.get_i64("id").unwrap(), cursor_id);
+    assert!(started.elapsed() >= Duration::from_millis(200));
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_aggregate_streams_batches_through_get_more() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("aggcur_{}", rand_suffix(6));
+
+    let docs: Vec<bson::Document> = (0..250).map(|i| doc! {"i": i}).collect();
+    let ins = doc! {"insert": "u", "documents": docs, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ins, 0, 1)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("n").unwrap_or(0), 250);
+
+    let agg = doc! {
+        "aggregate": "u",
+        "pipeline": [
+            {"$match": {"i": {"$gte": 20}}},
+            {"$sort": {"i": 1}},
+            {"$skip": 5},
+        ],
+        "cursor": {"batchSize": 100i32},
+        "$db": &dbname,
+    };
+    stream.write_all(&encode_op_msg(&agg, 0, 2)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+    let cursor = doc.get_document("cursor").unwrap();
+    let mut id = cursor.get_i64("id").unwrap();
+    assert_ne!(id, 0);
+    let mut seen: Vec<i32> = cursor
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().get_i32("i").unwrap())
+        .collect();
+    assert_eq!(seen.len(), 100);
+
+    let mut req = 3;
+    while id != 0 {
+        let gm = doc! {"getMore": id, "collection": "u", "batchSize": 100i32, "$db": &dbname};
+        stream.write_all(&encode_op_msg(&gm, 0, req)).await.unwrap();
+        req += 1;
+        let doc = read_one_op_msg(&mut stream).await;
+        assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+        let cursor = doc.get_document("cursor").unwrap();
+        id = cursor.get_i64("id").unwrap();
+        let batch = cursor.get_array("nextBatch").unwrap();
+        assert!(batch.len() <= 100);
+        seen.extend(
+            batch
+                .iter()
+                .map(|d| d.as_document().unwrap().get_i32("i").unwrap()),
+        );
+    }
+    assert_eq!(seen, (25..250).collect::<Vec<i32>>());
+
+    // batchSize 0 opens the cursor without returning documents
+    let agg = doc! {
+        "aggregate": "u",
+        "pipeline": [{"$limit": 3}],
+        "cursor": {"batchSize": 0i32},
+        "$db": &dbname,
+    };
+    stream
+        .write_all(&encode_op_msg(&agg, 0, req))
+        .await
+        .unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert!(cursor.get_array("firstBatch").unwrap().is_empty());
+    let id = cursor.get_i64("id").unwrap();
+    assert_ne!(id, 0);
+
+    let kc = doc! {"killCursors": "u", "cursors": [bson::Bson::Int64(id)], "$db": &dbname};
+    stream
+        .write_all(&encode_op_msg(&kc, 0, req + 1))
+        .await
+        .unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_array("cursorsKilled").unwrap().len(), 1);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_aggregate_limit_spans_batches() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("agglim_{}", rand_suffix(6));
+    let docs: Vec<bson::Document> = (0..400).map(|i| doc! {"i": i}).collect();
+    let ins = doc! {"insert": "u", "documents": docs, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ins, 0, 1)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("n").unwrap_or(0), 400);
+
+    // Folded into one LIMIT/OFFSET query, run in the engine, and with the $skip after the
+    // $limit: each returns 250 documents as batches of 100, 100 and 50
+    let pipelines = [
+        (vec![doc! {"$sort": {"i": 1}}, doc! {"$limit": 250}], 0..250),
+        (
+            vec![
+                doc! {"$sort": {"i": 1}},
+                doc! {"$project": {"_id": 0, "i": 1}},
+                doc! {"$limit": 250},
+            ],
+            0..250,
+        ),
+        (
+            vec![
+                doc! {"$sort": {"i": 1}},
+                doc! {"$limit": 300},
+                doc! {"$skip": 50},
+            ],
+            50..300,
+        ),
+    ];
+    let mut req = 2;
+    for (pipeline, expected) in pipelines {
+        let agg = doc! {
+            "aggregate": "u",
+            "pipeline": pipeline.clone(),
+            "cursor": {"batchSize": 100i32},
+            "$db": &dbname,
+        };
+        stream
+            .write_all(&encode_op_msg(&agg, 0, req))
+            .await
+            .unwrap();
+        req += 1;
+        let doc = read_one_op_msg(&mut stream).await;
+        assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", doc);
+        let cursor = doc.get_document("cursor").unwrap();
+        let mut id = cursor.get_i64("id").unwrap();
+        let first = cursor.get_array("firstBatch").unwrap();
+        let mut sizes = vec![first.len()];
+        let mut seen: Vec<i32> = first
+            .iter()
+            .map(|d| d.as_document().unwrap().get_i32("i").unwrap())
+            .collect();
+        while id != 0 {
+            let gm = doc! {"getMore": id, "collection": "u", "batchSize": 100i32, "$db": &dbname};
+            stream.write_all(&encode_op_msg(&gm, 0, req)).await.unwrap();
+            req += 1;
+            let doc = read_one_op_msg(&mut stream).await;
+            let cursor = doc.get_document("cursor").unwrap();
+            id = cursor.get_i64("id").unwrap();
+            let batch = cursor.get_array("nextBatch").unwrap();
+            sizes.push(batch.len());
+            seen.extend(
+                batch
+                    .iter()
+                    .map(|d| d.as_document().unwrap().get_i32("i").unwrap()),
+            );
+        }
+        assert_eq!(sizes, vec![100, 100, 50], "{:?}", pipeline);
+        assert_eq!(seen, expected.collect::<Vec<i32>>(), "{:?}", pipeline);
+    }
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
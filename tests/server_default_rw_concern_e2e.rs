@@ -0,0 +1,133 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+#[tokio::test]
+async fn e2e_get_default_rw_concern_reports_implicit_defaults() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let cmd = doc! {"getDefaultRWConcern": 1i32, "$db": "admin"};
+    let reply = run(&mut stream, cmd, 1).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(
+        reply.get_document("defaultReadConcern").unwrap(),
+        &doc! {"level": "local"}
+    );
+    let wc = reply.get_document("defaultWriteConcern").unwrap();
+    assert_eq!(wc.get_i32("w").unwrap(), 1, "{:?}", wc);
+    assert_eq!(
+        reply.get_str("defaultWriteConcernSource").unwrap(),
+        "implicit"
+    );
+    assert!(reply.get_datetime("localUpdateWallClockTime").is_ok());
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_set_default_rw_concern_validates_and_updates_defaults() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    // Only on admin, and only valid concerns
+    let cmd = doc! {"setDefaultRWConcern": 1i32, "defaultReadConcern": {"level": "majority"}, "$db": "test"};
+    let reply = run(&mut stream, cmd, 1).await;
+    assert_eq!(reply.get_i32("code").unwrap(), 13, "{:?}", reply);
+    for (req, bad) in [
+        doc! {"defaultReadConcern": {"level": "snapshot"}},
+        doc! {"defaultReadConcern": {"level": "sometimes"}},
+        doc! {"defaultWriteConcern": {"w": 0i32}},
+        doc! {"defaultWriteConcern": {"w": 1i32, "wtimeout": "soon"}},
+    ]
+    .into_iter()
+    .enumerate()
+    {
+        let mut cmd = doc! {"setDefaultRWConcern": 1i32};
+        cmd.extend(bad);
+        cmd.insert("$db", "admin");
+        let reply = run(&mut stream, cmd, 2 + req as i32).await;
+        assert_eq!(reply.get_i32("code").unwrap(), 2, "{:?}", reply);
+    }
+
+    let cmd = doc! {
+        "setDefaultRWConcern": 1i32,
+        "defaultReadConcern": {"level": "majority"},
+        "defaultWriteConcern": {"w": "majority", "wtimeout": 1000i32},
+        "$db": "admin",
+    };
+    let reply = run(&mut stream, cmd, 10).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(
+        reply.get_document("defaultReadConcern").unwrap(),
+        &doc! {"level": "majority"}
+    );
+    assert!(reply.get_timestamp("updateOpTime").is_ok());
+
+    let cmd = doc! {"getDefaultRWConcern": 1i32, "$db": "admin"};
+    let reply = run(&mut stream, cmd, 11).await;
+    let wc = reply.get_document("defaultWriteConcern").unwrap();
+    assert_eq!(wc.get_str("w").unwrap(), "majority", "{:?}", reply);
+    assert_eq!(
+        reply.get_str("defaultWriteConcernSource").unwrap(),
+        "global"
+    );
+    assert_eq!(reply.get_str("defaultReadConcernSource").unwrap(), "global");
+
+    // Operations without their own concern still run
+    let cmd = doc! {"insert": "c", "documents": [{"_id": "a"}], "$db": "rwc_defaults"};
+    let reply = run(&mut stream, cmd, 12).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 1, "{:?}", reply);
+    let cmd = doc! {"find": "c", "filter": {}, "$db": "rwc_defaults"};
+    let reply = run(&mut stream, cmd, 13).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
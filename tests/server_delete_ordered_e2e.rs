@@ -0,0 +1,142 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, request_id: i32) -> bson::Document {
+    let msg = encode_op_msg(&cmd, 0, request_id);
+    stream.write_all(&msg).await.unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn first_batch(reply: &bson::Document) -> Vec<bson::Document> {
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().clone())
+        .collect()
+}
+
+fn remaining(reply: &bson::Document) -> Vec<String> {
+    let mut ids: Vec<String> = first_batch(reply)
+        .iter()
+        .map(|d| d.get_str("_id").unwrap().to_string())
+        .collect();
+    ids.sort();
+    ids
+}
+
+#[tokio::test]
+async fn e2e_delete_honours_ordered() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("delord_{}", rand_suffix(6));
+    for (i, coll) in ["ordered", "unordered"].iter().enumerate() {
+        let docs: Vec<bson::Document> = (1..=6)
+            .map(|n| doc! {"_id": format!("d{}", n), "kind": if n <= 3 { "a" } else { "b" }, "name": format!("n{}", n)})
+            .collect();
+        let ins = doc! {"insert": *coll, "documents": docs, "$db": &dbname};
+        assert_eq!(
+            run(&mut stream, ins, i as i32 + 1)
+                .await
+                .get_i32("n")
+                .unwrap(),
+            6
+        );
+    }
+    // The second statement's pattern does not compile, so it fails when it runs
+    let deletes = vec![
+        doc! {"q": {"kind": "a"}, "limit": 1},
+        doc! {"q": {"name": {"$regex": "(unclosed"}}, "limit": 0},
+        doc! {"q": {"kind": "b"}, "limit": 0},
+    ];
+
+    let del = doc! {"delete": "ordered", "deletes": deletes.clone(), "$db": &dbname};
+    let r = run(&mut stream, del, 3).await;
+    assert_eq!(r.get_f64("ok").unwrap(), 1.0, "{:?}", r);
+    assert_eq!(r.get_i32("n").unwrap(), 1);
+    let errs = r.get_array("writeErrors").unwrap();
+    assert_eq!(errs.len(), 1);
+    assert_eq!(errs[0].as_document().unwrap().get_i32("index").unwrap(), 1);
+    let find = doc! {"find": "ordered", "$db": &dbname};
+    assert_eq!(
+        remaining(&run(&mut stream, find, 4).await),
+        vec!["d2", "d3", "d4", "d5", "d6"]
+    );
+
+    let del = doc! {
+        "delete": "unordered",
+        "deletes": deletes,
+        "ordered": false,
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, del, 5).await;
+    assert_eq!(r.get_f64("ok").unwrap(), 1.0, "{:?}", r);
+    assert_eq!(r.get_i32("n").unwrap(), 4);
+    let errs = r.get_array("writeErrors").unwrap();
+    assert_eq!(errs.len(), 1);
+    assert_eq!(errs[0].as_document().unwrap().get_i32("index").unwrap(), 1);
+    let find = doc! {"find": "unordered", "$db": &dbname};
+    assert_eq!(
+        remaining(&run(&mut stream, find, 6).await),
+        vec!["d2", "d3"]
+    );
+
+    // A malformed statement fails the whole command before any statement runs
+    let del = doc! {
+        "delete": "unordered",
+        "deletes": [{"q": {"kind": "a"}, "limit": 0}, {"q": {}, "limit": 5}],
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, del, 7).await;
+    assert_eq!(r.get_f64("ok").unwrap(), 0.0);
+    assert_eq!(r.get_i32("code").unwrap(), 2);
+    let find = doc! {"find": "unordered", "$db": &dbname};
+    assert_eq!(
+        remaining(&run(&mut stream, find, 8).await),
+        vec!["d2", "d3"]
+    );
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,158 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn first_write_error(reply: &bson::Document) -> bson::Document {
+    reply.get_array("writeErrors").unwrap()[0]
+        .as_document()
+        .unwrap()
+        .clone()
+}
+
+#[tokio::test]
+async fn e2e_bypass_document_validation_writes_failing_documents() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("validation_{}", rand_suffix(6));
+
+    let create = doc! {
+        "create": "people",
+        "validator": {"$jsonSchema": {
+            "bsonType": "object",
+            "required": ["name"],
+            "properties": {"age": {"bsonType": "int", "minimum": 0}},
+        }},
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, create, 1).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0, "{:?}", doc);
+
+    // A legacy document without a name fails the schema
+    let ins = doc! {
+        "insert": "people",
+        "documents": [{"_id": "legacy", "age": 40i32}],
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, ins.clone(), 2).await;
+    assert_eq!(doc.get_i32("n").unwrap(), 0, "{:?}", doc);
+    let err = first_write_error(&doc);
+    assert_eq!(err.get_i32("code").unwrap(), 121, "{:?}", err);
+    assert_eq!(
+        err.get_document("errInfo")
+            .unwrap()
+            .get_str("failingDocumentId")
+            .unwrap(),
+        "legacy"
+    );
+
+    // ...and lands when validation is bypassed
+    let mut bypass = ins;
+    bypass.insert("bypassDocumentValidation", true);
+    let doc = run(&mut stream, bypass, 3).await;
+    assert_eq!(doc.get_i32("n").unwrap(), 1, "{:?}", doc);
+    let find = doc! {"find": "people", "filter": {"_id": "legacy"}, "$db": &dbname};
+    let doc = run(&mut stream, find.clone(), 4).await;
+    let batch = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 1, "{:?}", doc);
+
+    // Updates are checked against the document they produce
+    let upd = doc! {
+        "update": "people",
+        "updates": [{"q": {"_id": "legacy"}, "u": {"$set": {"age": -1i32}}}],
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, upd.clone(), 5).await;
+    assert_eq!(doc.get_i32("nModified").unwrap(), 0, "{:?}", doc);
+    assert_eq!(first_write_error(&doc).get_i32("code").unwrap(), 121);
+    let mut bypass = upd;
+    bypass.insert("bypassDocumentValidation", true);
+    let doc = run(&mut stream, bypass, 6).await;
+    assert_eq!(doc.get_i32("nModified").unwrap(), 1, "{:?}", doc);
+
+    let fam = doc! {
+        "findAndModify": "people",
+        "query": {"_id": "legacy"},
+        "update": {"$set": {"age": "unknown"}},
+        "new": true,
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, fam.clone(), 7).await;
+    assert_eq!(doc.get_i32("code").unwrap(), 121, "{:?}", doc);
+    let mut bypass = fam;
+    bypass.insert("bypassDocumentValidation", true);
+    let doc = run(&mut stream, bypass, 8).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0, "{:?}", doc);
+    assert_eq!(
+        doc.get_document("value").unwrap().get_str("age").unwrap(),
+        "unknown"
+    );
+
+    // Conforming documents never needed the flag, and collections without a validator
+    // ignore it
+    let ins = doc! {
+        "insert": "people",
+        "documents": [{"_id": "ann", "name": "Ann", "age": 30i32}],
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, ins, 9).await;
+    assert_eq!(doc.get_i32("n").unwrap(), 1, "{:?}", doc);
+    let ins = doc! {
+        "insert": "notes",
+        "documents": [{"_id": "n1"}],
+        "bypassDocumentValidation": true,
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, ins, 10).await;
+    assert_eq!(doc.get_i32("n").unwrap(), 1, "{:?}", doc);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
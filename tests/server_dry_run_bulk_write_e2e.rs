@@ -0,0 +1,144 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+async fn count(stream: &mut TcpStream, dbname: &str, req: i32) -> usize {
+    let doc = run(
+        stream,
+        doc! {"find": "users", "filter": {}, "$db": dbname},
+        req,
+    )
+    .await;
+    doc.get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .len()
+}
+
+#[tokio::test]
+async fn e2e_dry_run_bulk_write_reports_without_writing() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("dryrun_{}", rand_suffix(6));
+
+    let idx = doc! {
+        "createIndexes": "users",
+        "indexes": [{"name": "email_1", "key": {"email": 1i32}, "unique": true}],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, idx, 1).await.get_f64("ok").unwrap(), 1.0);
+    let ins = doc! {
+        "insert": "users",
+        "documents": [{"_id": "1", "email": "a@x.com", "n": 1i32}, {"_id": "2", "email": "b@x.com", "n": 1i32}],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, ins, 2).await.get_i32("n").unwrap(), 2);
+
+    // Unordered: the duplicate fails on its own and every other operation is evaluated
+    let ops = vec![
+        doc! {"insertOne": {"document": {"_id": "3", "email": "c@x.com"}}},
+        doc! {"insertOne": {"document": {"_id": "4", "email": "a@x.com"}}},
+        doc! {"updateMany": {"filter": {}, "update": {"$inc": {"n": 1i32}}}},
+        doc! {"updateOne": {"filter": {"_id": "9"}, "update": {"$set": {"email": "z@x.com"}}, "upsert": true}},
+        doc! {"deleteOne": {"filter": {"_id": "2"}}},
+    ];
+    let dry = doc! {
+        "oxidedbDryRunBulkWrite": "users",
+        "ops": ops.clone(),
+        "ordered": false,
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, dry, 3).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0, "{:?}", doc);
+    assert!(doc.get_bool("dryRun").unwrap());
+    assert_eq!(doc.get_i64("nInserted").unwrap(), 1, "{:?}", doc);
+    assert_eq!(doc.get_i64("nMatched").unwrap(), 3, "{:?}", doc);
+    assert_eq!(doc.get_i64("nModified").unwrap(), 3, "{:?}", doc);
+    assert_eq!(doc.get_i64("nUpserted").unwrap(), 1, "{:?}", doc);
+    assert_eq!(doc.get_i64("nDeleted").unwrap(), 1, "{:?}", doc);
+    let errors = doc.get_array("writeErrors").unwrap();
+    assert_eq!(errors.len(), 1);
+    let err = errors[0].as_document().unwrap();
+    assert_eq!(err.get_i32("index").unwrap(), 1);
+    assert_eq!(err.get_i32("code").unwrap(), 11000, "{:?}", err);
+
+    // Nothing was kept
+    assert_eq!(count(&mut stream, &dbname, 4).await, 2);
+    let find = doc! {"find": "users", "filter": {"_id": "1"}, "$db": &dbname};
+    let doc = run(&mut stream, find, 5).await;
+    let first = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()[0]
+        .as_document()
+        .unwrap()
+        .clone();
+    assert_eq!(first.get_i32("n").unwrap(), 1);
+
+    // Ordered: evaluation stops at the first failure
+    let dry = doc! {"oxidedbDryRunBulkWrite": "users", "ops": ops, "$db": &dbname};
+    let doc = run(&mut stream, dry, 6).await;
+    assert_eq!(doc.get_i64("nInserted").unwrap(), 1, "{:?}", doc);
+    assert_eq!(doc.get_i64("nMatched").unwrap(), 0, "{:?}", doc);
+    assert_eq!(doc.get_array("writeErrors").unwrap().len(), 1);
+    assert_eq!(count(&mut stream, &dbname, 7).await, 2);
+
+    // An unknown operation fails the command before anything runs
+    let dry = doc! {
+        "oxidedbDryRunBulkWrite": "users",
+        "ops": [{"upsertOne": {"filter": {}}}],
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, dry, 8).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 0.0);
+    assert_eq!(doc.get_i32("code").unwrap(), 2);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -97,3 +97,106 @@ async fn e2e_error_codes() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, request_id: i32) -> bson::Document {
+    let msg = encode_op_msg(&cmd, 0, request_id);
+    stream.write_all(&msg).await.unwrap();
+    read_one_op_msg(stream).await
+}
+
+#[tokio::test]
+async fn e2e_error_code_names_and_write_errors() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("err_{}", rand_suffix(6));
+
+    // Command-level failures carry codeName
+    let r = run(&mut stream, doc! {"frobnicate": 1, "$db": &dbname}, 1).await;
+    assert_eq!(r.get_i32("code").unwrap(), 59);
+    assert_eq!(r.get_str("codeName").unwrap(), "CommandNotFound");
+    let r = run(&mut stream, doc! {"update": "u", "$db": &dbname}, 2).await;
+    assert_eq!(r.get_i32("code").unwrap(), 9);
+    assert_eq!(r.get_str("codeName").unwrap(), "FailedToParse");
+
+    // Duplicate _id: a DuplicateKey write error at the document's index
+    let ins = doc! {"insert": "u", "documents": [{"_id": "a", "n": 1}], "$db": &dbname};
+    assert_eq!(run(&mut stream, ins, 3).await.get_i32("n").unwrap(), 1);
+    let ins = doc! {
+        "insert": "u",
+        "documents": [{"_id": "b"}, {"_id": "a"}, {"_id": "c"}],
+        "ordered": false,
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, ins, 4).await;
+    assert_eq!(r.get_f64("ok").unwrap(), 1.0);
+    assert_eq!(r.get_i32("n").unwrap(), 2);
+    let errs = r.get_array("writeErrors").unwrap();
+    assert_eq!(errs.len(), 1);
+    let we = errs[0].as_document().unwrap();
+    assert_eq!(we.get_i32("index").unwrap(), 1);
+    assert_eq!(we.get_i32("code").unwrap(), 11000);
+    assert_eq!(we.get_document("keyValue").unwrap(), &doc! {"_id": "a"});
+    assert!(
+        we.get_str("errmsg")
+            .unwrap()
+            .starts_with("E11000 duplicate key error")
+    );
+
+    // $inc on a string is a TypeMismatch for that statement; unordered updates go on
+    let upd = doc! {
+        "update": "u",
+        "updates": [
+            {"q": {"_id": "b"}, "u": {"$set": {"n": "text"}}},
+            {"q": {"_id": "b"}, "u": {"$inc": {"n": 1}}},
+            {"q": {"_id": "c"}, "u": {"$inc": {"n": 1}}},
+        ],
+        "ordered": false,
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, upd, 5).await;
+    assert_eq!(r.get_f64("ok").unwrap(), 1.0);
+    assert_eq!(r.get_i32("nModified").unwrap(), 2);
+    let errs = r.get_array("writeErrors").unwrap();
+    assert_eq!(errs.len(), 1);
+    let we = errs[0].as_document().unwrap();
+    assert_eq!(we.get_i32("index").unwrap(), 1);
+    assert_eq!(we.get_i32("code").unwrap(), 14);
+
+    // An ordered update stops at the failing statement
+    let upd = doc! {
+        "update": "u",
+        "updates": [
+            {"q": {"_id": "b"}, "u": {"$inc": {"n": 1}}},
+            {"q": {"_id": "c"}, "u": {"$inc": {"n": 1}}},
+        ],
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, upd, 6).await;
+    assert_eq!(r.get_i32("nModified").unwrap(), 0);
+    assert_eq!(r.get_array("writeErrors").unwrap().len(), 1);
+    let find = doc! {"find": "u", "filter": {"_id": "c"}, "$db": &dbname};
+    let r = run(&mut stream, find, 7).await;
+    let c = r
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()[0]
+        .as_document()
+        .unwrap()
+        .clone();
+    assert_eq!(c.get_i32("n").unwrap(), 1);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
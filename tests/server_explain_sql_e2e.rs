@@ -0,0 +1,155 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+#[tokio::test]
+async fn e2e_explain_sql_shows_statement_and_parameters() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("explain_sql_{}", rand_suffix(6));
+
+    let docs = vec![
+        doc! {"_id": "a", "name": "O'Brien", "qty": 5i32},
+        doc! {"_id": "b", "name": "Lee", "qty": 9i32},
+    ];
+    let ins = doc! {"insert": "items", "documents": docs, "$db": &dbname};
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 2, "{:?}", reply);
+
+    // Filter values are bound as parameters, not spliced into the SQL
+    let cmd = doc! {
+        "oxidedbExplainSQL": {"find": "items", "filter": {"name": "O'Brien"}, "sort": {"qty": 1i32}, "limit": 3i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, cmd, 2).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(
+        reply.get_str("namespace").unwrap(),
+        format!("{}.items", dbname)
+    );
+    let sql = reply.get_str("sql").unwrap();
+    assert!(sql.starts_with("SELECT doc_bson, doc FROM "), "{}", sql);
+    assert!(sql.contains("\"items\""), "{}", sql);
+    assert!(
+        sql.contains("ORDER BY") && sql.ends_with("LIMIT 3"),
+        "{}",
+        sql
+    );
+    assert!(!sql.contains("Brien") && sql.contains("$1"), "{}", sql);
+    let parameters = reply.get_array("parameters").unwrap();
+    assert!(
+        parameters
+            .iter()
+            .any(|p| p.as_str().unwrap().contains("O'Brien")),
+        "{:?}",
+        parameters
+    );
+
+    // A lookup by `_id` uses the primary key
+    let cmd = doc! {
+        "oxidedbExplainSQL": {"find": "items", "filter": {"_id": "a"}, "limit": 1i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, cmd, 3).await;
+    assert!(
+        reply
+            .get_str("sql")
+            .unwrap()
+            .ends_with("WHERE id = $1 LIMIT $2"),
+        "{:?}",
+        reply
+    );
+    let parameters = reply.get_array("parameters").unwrap();
+    assert_eq!(parameters.len(), 2);
+    assert!(parameters[0].as_str().unwrap().starts_with("\\x"));
+    assert_eq!(parameters[1].as_str().unwrap(), "1");
+
+    // A pipeline PostgreSQL answers whole is read through a held cursor
+    let cmd = doc! {
+        "oxidedbExplainSQL": {
+            "aggregate": "items",
+            "pipeline": [{"$match": {"qty": {"$gt": 4i32}}}, {"$skip": 1i32}, {"$limit": 5i32}],
+        },
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, cmd, 4).await;
+    let sql = reply.get_str("sql").unwrap();
+    assert!(sql.starts_with("DECLARE "), "{}", sql);
+    assert!(
+        sql.contains("LIMIT 5") && sql.contains("OFFSET 1"),
+        "{}",
+        sql
+    );
+    assert!(!reply.contains_key("engineStages"));
+
+    // Otherwise the stages after the read are left to the engine
+    let cmd = doc! {
+        "oxidedbExplainSQL": {
+            "aggregate": "items",
+            "pipeline": [
+                {"$match": {"qty": {"$gt": 4i32}}},
+                {"$group": {"_id": null, "total": {"$sum": "$qty"}}},
+            ],
+        },
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, cmd, 5).await;
+    assert!(reply.get_str("sql").unwrap().starts_with("SELECT "));
+    let stages: Vec<&str> = reply
+        .get_array("engineStages")
+        .unwrap()
+        .iter()
+        .map(|s| s.as_str().unwrap())
+        .collect();
+    assert_eq!(stages, vec!["$group"]);
+
+    let cmd = doc! {"oxidedbExplainSQL": {"insert": "items"}, "$db": &dbname};
+    let reply = run(&mut stream, cmd, 6).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 0.0, "{:?}", reply);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,113 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+#[tokio::test]
+async fn e2e_explain_verbosity_levels() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("explain_verbosity_{}", rand_suffix(6));
+
+    let docs: Vec<bson::Document> = (0..200)
+        .map(|i| doc! {"_id": format!("o{}", i), "status": if i % 50 == 0 { "A" } else { "B" }})
+        .collect();
+    let ins = doc! {"insert": "orders", "documents": docs, "$db": &dbname};
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 200, "{:?}", reply);
+    let ci = doc! {
+        "createIndexes": "orders",
+        "indexes": [{"key": {"status": 1i32}, "name": "status_1"}],
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, ci, 2).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+
+    let find = doc! {"find": "orders", "filter": {"status": "A"}};
+
+    // The default only plans the query
+    let explain = doc! {"explain": find.clone(), "$db": &dbname};
+    let reply = run(&mut stream, explain, 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert!(reply.get_document("queryPlanner").is_ok());
+    assert!(reply.get_document("executionStats").is_err(), "{:?}", reply);
+
+    // executionStats runs it
+    let explain = doc! {"explain": find.clone(), "verbosity": "executionStats", "$db": &dbname};
+    let reply = run(&mut stream, explain, 4).await;
+    let stats = reply.get_document("executionStats").unwrap();
+    assert!(stats.get_bool("executionSuccess").unwrap());
+    assert_eq!(stats.get_i64("nReturned").unwrap(), 4, "{:?}", stats);
+    assert!(stats.get_document("executionStages").is_ok());
+    assert!(stats.get_document("postgresBuffers").is_err());
+
+    // allPlansExecution adds buffers and the plan chosen without the winning strategy
+    let explain = doc! {"explain": find.clone(), "verbosity": "allPlansExecution", "$db": &dbname};
+    let reply = run(&mut stream, explain, 5).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let stats = reply.get_document("executionStats").unwrap();
+    assert_eq!(stats.get_i64("nReturned").unwrap(), 4, "{:?}", stats);
+    let buffers = stats.get_document("postgresBuffers").unwrap();
+    assert!(buffers.get_i64("sharedHit").unwrap() + buffers.get_i64("sharedRead").unwrap() > 0);
+    let rejected = reply
+        .get_document("queryPlanner")
+        .unwrap()
+        .get_array("rejectedPlans")
+        .unwrap();
+    let all_plans = stats.get_array("allPlansExecution").unwrap();
+    assert_eq!(all_plans.len(), rejected.len() * 2, "{:?}", reply);
+    for plan in all_plans {
+        let plan = plan.as_document().unwrap();
+        assert_eq!(plan.get_i64("nReturned").unwrap(), 4, "{:?}", plan);
+    }
+
+    let explain = doc! {"explain": find, "verbosity": "everything", "$db": &dbname};
+    let reply = run(&mut stream, explain, 6).await;
+    assert_eq!(reply.get_i32("code").unwrap(), 2, "{:?}", reply);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,114 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+#[tokio::test]
+async fn e2e_export_extended_json_keeps_bson_types() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("export_extjson_{}", rand_suffix(6));
+
+    let docs = vec![
+        doc! {
+            "_id": "a",
+            "small": 5i32,
+            "big": 5i64,
+            "ratio": 5.0f64,
+            "at": bson::DateTime::from_millis(1_709_294_400_000),
+        },
+        doc! {"_id": "b", "small": 6i32},
+        doc! {"_id": "c", "small": 7i32},
+    ];
+    let ins = doc! {"insert": "items", "documents": docs, "$db": &dbname};
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 3, "{:?}", reply);
+
+    let cmd = doc! {
+        "oxidedbExportExtendedJson": "items",
+        "filter": {"_id": "a"},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, cmd, 2).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(reply.get_str("ns").unwrap(), format!("{}.items", dbname));
+    let documents = reply.get_array("documents").unwrap();
+    assert_eq!(documents.len(), 1);
+    let json: serde_json::Value = serde_json::from_str(documents[0].as_str().unwrap()).unwrap();
+    assert_eq!(json["small"], serde_json::json!({"$numberInt": "5"}));
+    assert_eq!(json["big"], serde_json::json!({"$numberLong": "5"}));
+    assert_eq!(json["ratio"], serde_json::json!({"$numberDouble": "5.0"}));
+    assert_eq!(
+        json["at"],
+        serde_json::json!({"$date": {"$numberLong": "1709294400000"}})
+    );
+
+    // Sort, projection and limit apply as in find
+    let cmd = doc! {
+        "oxidedbExportExtendedJson": "items",
+        "sort": {"_id": -1i32},
+        "projection": {"small": 1i32, "_id": 0i32},
+        "limit": 2i32,
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, cmd, 3).await;
+    let documents: Vec<&str> = reply
+        .get_array("documents")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_str().unwrap())
+        .collect();
+    assert_eq!(
+        documents,
+        vec![
+            r#"{"small":{"$numberInt":"7"}}"#,
+            r#"{"small":{"$numberInt":"6"}}"#
+        ]
+    );
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
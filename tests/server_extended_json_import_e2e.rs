@@ -0,0 +1,152 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+async fn find_one(
+    stream: &mut TcpStream,
+    dbname: &str,
+    filter: bson::Document,
+    req: i32,
+) -> bson::Document {
+    let cmd = doc! {"find": "items", "filter": filter, "$db": dbname};
+    let reply = run(stream, cmd, req).await;
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 1, "{:?}", reply);
+    batch[0].as_document().unwrap().clone()
+}
+
+#[tokio::test]
+async fn e2e_extended_json_import_decodes_wrappers() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.extended_json_import = Some(true);
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("extjson_{}", rand_suffix(6));
+
+    let oid = "65a1b2c3d4e5f60718293a4b";
+    let dumped = doc! {
+        "_id": {"$oid": oid},
+        "at": {"$date": "2024-03-01T12:00:00Z"},
+        "legacy_at": {"$date": {"$numberLong": "1700000000000"}},
+        "big": {"$numberLong": "9007199254740993"},
+        "tags": [{"$numberInt": "7"}, {"$numberDecimal": "1.5"}],
+        "op": {"$set": {"a": 1i32}},
+    };
+    let ins = doc! {"insert": "items", "documents": [dumped], "$db": &dbname};
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 1, "{:?}", reply);
+
+    let id = bson::oid::ObjectId::parse_str(oid).unwrap();
+    let stored = find_one(&mut stream, &dbname, doc! {"_id": id}, 2).await;
+    assert_eq!(stored.get_object_id("_id").unwrap(), id);
+    assert_eq!(
+        stored.get_datetime("at").unwrap().timestamp_millis(),
+        1_709_294_400_000
+    );
+    assert_eq!(
+        stored.get_datetime("legacy_at").unwrap().timestamp_millis(),
+        1_700_000_000_000
+    );
+    assert_eq!(stored.get_i64("big").unwrap(), 9_007_199_254_740_993);
+    let tags = stored.get_array("tags").unwrap();
+    assert_eq!(tags[0], bson::Bson::Int32(7));
+    assert!(matches!(tags[1], bson::Bson::Decimal128(_)), "{:?}", tags);
+    // Documents that are not wrappers are kept
+    assert_eq!(
+        stored.get_document("op").unwrap(),
+        &doc! {"$set": {"a": 1i32}}
+    );
+
+    // Typed values can be queried as such
+    let found = find_one(
+        &mut stream,
+        &dbname,
+        doc! {"big": {"$gt": 9_007_199_254_740_992i64}},
+        3,
+    )
+    .await;
+    assert_eq!(found.get_object_id("_id").unwrap(), id);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_extended_json_wrappers_are_literal_by_default() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("extjson_off_{}", rand_suffix(6));
+
+    let ins = doc! {
+        "insert": "items",
+        "documents": [{"_id": "a", "at": {"$date": "2024-03-01T12:00:00Z"}}],
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 1, "{:?}", reply);
+    let stored = find_one(&mut stream, &dbname, doc! {"_id": "a"}, 2).await;
+    assert_eq!(
+        stored.get_document("at").unwrap(),
+        &doc! {"$date": "2024-03-01T12:00:00Z"}
+    );
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
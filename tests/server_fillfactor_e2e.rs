@@ -0,0 +1,214 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+/// The `fillfactor` PostgreSQL holds for the table behind `mdb_<db>.<table>`, if set.
+async fn table_fillfactor(url: &str, db: &str, table: &str) -> Option<String> {
+    let (client, conn) = tokio_postgres::connect(url, tokio_postgres::NoTls)
+        .await
+        .unwrap();
+    tokio::spawn(async move {
+        let _ = conn.await;
+    });
+    let row = client
+        .query_one(
+            "SELECT c.reloptions FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace \
+             WHERE n.nspname = $1 AND c.relname = $2",
+            &[&format!("mdb_{}", db), &table],
+        )
+        .await
+        .unwrap();
+    let options: Option<Vec<String>> = row.get(0);
+    options?
+        .into_iter()
+        .find_map(|o| o.strip_prefix("fillfactor=").map(str::to_string))
+}
+
+/// The `storageEngine.postgresql.fillfactor` `listCollections` reports for `coll`.
+async fn listed_fillfactor(stream: &mut TcpStream, db: &str, coll: &str) -> Option<i64> {
+    let reply = run(
+        stream,
+        doc! {"listCollections": 1i32, "filter": {"name": coll}, "$db": db},
+        100,
+    )
+    .await;
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    let options = batch[0]
+        .as_document()
+        .unwrap()
+        .get_document("options")
+        .unwrap();
+    match options
+        .get_document("storageEngine")
+        .ok()?
+        .get_document("postgresql")
+        .ok()?
+        .get("fillfactor")?
+    {
+        bson::Bson::Int32(n) => Some(*n as i64),
+        bson::Bson::Int64(n) => Some(*n),
+        other => panic!("unexpected fillfactor {:?}", other),
+    }
+}
+
+#[tokio::test]
+async fn e2e_fillfactor_on_create_and_coll_mod() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let create = doc! {
+        "create": "sessions",
+        "storageEngine": {"postgresql": {"fillfactor": 70}, "wiredTiger": {}},
+        "$db": "ff",
+    };
+    let reply = run(&mut stream, create, 1).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(
+        table_fillfactor(&testdb.url, "ff", "sessions").await,
+        Some("70".into())
+    );
+    assert_eq!(
+        listed_fillfactor(&mut stream, "ff", "sessions").await,
+        Some(70)
+    );
+
+    // collMod changes it and keeps the collection's other options
+    let coll_mod = doc! {
+        "collMod": "sessions",
+        "storageEngine": {"postgresql": {"fillfactor": 85}},
+        "$db": "ff",
+    };
+    let reply = run(&mut stream, coll_mod, 2).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(
+        table_fillfactor(&testdb.url, "ff", "sessions").await,
+        Some("85".into())
+    );
+    assert_eq!(
+        listed_fillfactor(&mut stream, "ff", "sessions").await,
+        Some(85)
+    );
+
+    // A plain collection keeps PostgreSQL's default until collMod sets one
+    let reply = run(&mut stream, doc! {"create": "events", "$db": "ff"}, 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(table_fillfactor(&testdb.url, "ff", "events").await, None);
+    let coll_mod = doc! {
+        "collMod": "events",
+        "storageEngine": {"postgresql": {"fillfactor": 90}},
+        "$db": "ff",
+    };
+    let reply = run(&mut stream, coll_mod, 4).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(
+        listed_fillfactor(&mut stream, "ff", "events").await,
+        Some(90)
+    );
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_fillfactor_rejects_bad_options() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    for (i, (engine, code)) in [
+        (doc! {"postgresql": {"fillfactor": 5}}, 2),
+        (doc! {"postgresql": {"fillfactor": "high"}}, 2),
+        (doc! {"postgresql": {"fillfactor": 70.5}}, 2),
+        (doc! {"postgresql": {"autovacuum": true}}, 72),
+        (doc! {"postgresql": 70}, 2),
+    ]
+    .into_iter()
+    .enumerate()
+    {
+        let create = doc! {"create": "bad", "storageEngine": engine, "$db": "ff"};
+        let reply = run(&mut stream, create, i as i32 + 1).await;
+        assert_eq!(reply.get_f64("ok").unwrap(), 0.0, "{:?}", reply);
+        assert_eq!(reply.get_i32("code").unwrap(), code, "{:?}", reply);
+    }
+
+    // collMod on a collection that does not exist
+    let coll_mod = doc! {
+        "collMod": "missing",
+        "storageEngine": {"postgresql": {"fillfactor": 80}},
+        "$db": "ff",
+    };
+    let reply = run(&mut stream, coll_mod, 10).await;
+    assert_eq!(reply.get_i32("code").unwrap(), 26, "{:?}", reply);
+
+    // A bad index option leaves the fillfactor it came with unapplied
+    let create = doc! {
+        "create": "kept",
+        "storageEngine": {"postgresql": {"fillfactor": 70}},
+        "$db": "ff",
+    };
+    let reply = run(&mut stream, create, 11).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let coll_mod = doc! {
+        "collMod": "kept",
+        "storageEngine": {"postgresql": {"fillfactor": 85}},
+        "index": {"name": "nope", "expireAfterSeconds": 60},
+        "$db": "ff",
+    };
+    let reply = run(&mut stream, coll_mod, 12).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 0.0, "{:?}", reply);
+    assert_eq!(
+        table_fillfactor(&testdb.url, "ff", "kept").await,
+        Some("70".into())
+    );
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
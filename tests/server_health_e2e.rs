@@ -0,0 +1,86 @@
+use oxidedb::config::Config;
+use oxidedb::server::spawn_with_shutdown;
+use std::net::SocketAddr;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+async fn http_get(addr: SocketAddr, path: &str) -> String {
+    let mut http = TcpStream::connect(addr).await.unwrap();
+    http.write_all(format!("GET {} HTTP/1.1\r\nHost: localhost\r\n\r\n", path).as_bytes())
+        .await
+        .unwrap();
+    let mut resp = String::new();
+    http.read_to_string(&mut resp).await.unwrap();
+    resp
+}
+
+#[tokio::test]
+async fn e2e_health_and_readiness_with_postgres() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.health_addr = Some("127.0.0.1:0".into());
+
+    let (state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let health_addr = state.health_addr.expect("health endpoint bound");
+    assert_ne!(health_addr, addr);
+
+    let resp = http_get(health_addr, "/healthz").await;
+    assert!(resp.starts_with("HTTP/1.1 200 OK"), "unexpected: {resp}");
+    let resp = http_get(health_addr, "/readyz").await;
+    assert!(resp.starts_with("HTTP/1.1 200 OK"), "unexpected: {resp}");
+    assert!(resp.ends_with("ready\n"));
+    let resp = http_get(health_addr, "/metrics").await;
+    assert!(resp.starts_with("HTTP/1.1 404"));
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_readiness_fails_fast_when_postgres_is_unreachable() {
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    // Nothing listens on port 1, so every connection attempt is refused
+    cfg.postgres_url = Some("postgres://oxidedb@127.0.0.1:1/oxidedb".into());
+    cfg.health_addr = Some("127.0.0.1:0".into());
+
+    let (state, _addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let health_addr = state.health_addr.expect("health endpoint bound");
+
+    // Liveness only reflects the process
+    let resp = http_get(health_addr, "/healthz").await;
+    assert!(resp.starts_with("HTTP/1.1 200 OK"), "unexpected: {resp}");
+
+    let started = std::time::Instant::now();
+    let resp = http_get(health_addr, "/readyz").await;
+    assert!(resp.starts_with("HTTP/1.1 503"), "unexpected: {resp}");
+    assert!(resp.contains("not ready"));
+    assert!(started.elapsed() < std::time::Duration::from_secs(5));
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_health_endpoint_disabled_by_default() {
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+
+    let (state, _addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    assert!(state.health_addr.is_none());
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -91,3 +91,128 @@ async fn e2e_create_and_drop_indexes() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+#[tokio::test]
+async fn e2e_reindex_rebuilds_all_indexes() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("idx_{}", rand_suffix(6));
+
+    let create = doc! {"create": "u", "$db": &dbname};
+    let msg = encode_op_msg(&create, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    let idx_spec = doc! {"name": "a_1", "key": {"a": 1i32}};
+    let ci = doc! {"createIndexes": "u", "indexes": [idx_spec], "$db": &dbname};
+    let msg = encode_op_msg(&ci, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    let ri = doc! {"reIndex": "u", "$db": &dbname};
+    let msg = encode_op_msg(&ri, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+    let names: Vec<&str> = doc
+        .get_array("indexes")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().get_str("name").unwrap())
+        .collect();
+    assert!(names.contains(&"_id_"));
+    assert!(names.contains(&"a_1"));
+    assert_eq!(doc.get_i32("nIndexes").unwrap(), names.len() as i32);
+
+    // reIndex on a missing collection fails with NamespaceNotFound
+    let ri = doc! {"reIndex": "missing", "$db": &dbname};
+    let msg = encode_op_msg(&ri, 0, 4);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(1.0), 0.0);
+    assert_eq!(doc.get_i32("code").unwrap(), 26);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_index_stats_lists_managed_indexes() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("idxstats_{}", rand_suffix(6));
+
+    let ins = doc! {"insert": "u", "documents": [{"a": 1i32}, {"a": 2i32}], "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ins, 0, 1)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+
+    let ci = doc! {"createIndexes": "u", "indexes": [{"name": "a_1", "key": {"a": 1i32}}], "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ci, 0, 2)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+
+    let agg =
+        doc! {"aggregate": "u", "pipeline": [{"$indexStats": {}}], "cursor": {}, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&agg, 0, 3)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+    let batch = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    let names: Vec<&str> = batch
+        .iter()
+        .map(|d| d.as_document().unwrap().get_str("name").unwrap())
+        .collect();
+    assert_eq!(names, vec!["_id_", "a_1"]);
+    for d in batch {
+        let d = d.as_document().unwrap();
+        let accesses = d.get_document("accesses").unwrap();
+        assert!(accesses.get_i64("ops").unwrap() >= 0);
+        assert!(accesses.get_datetime("since").is_ok());
+    }
+    let a_1 = batch[1].as_document().unwrap();
+    assert_eq!(a_1.get_document("key").unwrap(), &doc! {"a": 1i32});
+
+    // Only valid as the first stage
+    let agg = doc! {
+        "aggregate": "u",
+        "pipeline": [{"$match": {}}, {"$indexStats": {}}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    stream.write_all(&encode_op_msg(&agg, 0, 4)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(1.0), 0.0);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
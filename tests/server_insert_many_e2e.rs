@@ -0,0 +1,185 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, request_id: i32) -> bson::Document {
+    let msg = encode_op_msg(&cmd, 0, request_id);
+    stream.write_all(&msg).await.unwrap();
+    read_one_op_msg(stream).await
+}
+
+async fn count(stream: &mut TcpStream, dbname: &str, coll: &str) -> i32 {
+    let agg = doc! {
+        "aggregate": coll,
+        "pipeline": [{"$count": "n"}],
+        "cursor": {},
+        "$db": dbname,
+    };
+    let reply = run(stream, agg, 99).await;
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    batch[0].as_document().unwrap().get_i32("n").unwrap()
+}
+
+fn error_indexes(reply: &bson::Document) -> Vec<(i32, i32)> {
+    reply
+        .get_array("writeErrors")
+        .map(|errs| {
+            errs.iter()
+                .map(|e| {
+                    let e = e.as_document().unwrap();
+                    (e.get_i32("index").unwrap(), e.get_i32("code").unwrap())
+                })
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
+#[tokio::test]
+async fn e2e_insert_many_batches_and_reports_failures_by_index() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("insert_many_{}", rand_suffix(6));
+
+    // Larger than one multi-row INSERT, with a duplicate `_id` in the second chunk
+    let mut docs: Vec<bson::Document> = (0..2500).map(|i| doc! {"_id": i, "v": i}).collect();
+    docs[1500] = doc! {"_id": 10, "v": "dup"};
+
+    let ordered = doc! {"insert": "ordered", "documents": docs.clone(), "$db": &dbname};
+    let reply = run(&mut stream, ordered, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 1500, "{:?}", reply);
+    assert_eq!(error_indexes(&reply), vec![(1500, 11000)]);
+    assert_eq!(count(&mut stream, &dbname, "ordered").await, 1500);
+
+    let unordered = doc! {
+        "insert": "unordered",
+        "documents": docs,
+        "ordered": false,
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, unordered, 2).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 2499, "{:?}", reply);
+    assert_eq!(error_indexes(&reply), vec![(1500, 11000)]);
+    assert_eq!(count(&mut stream, &dbname, "unordered").await, 2499);
+
+    // Documents rejected before reaching PostgreSQL keep their place in the order
+    let mixed = doc! {
+        "insert": "mixed",
+        "documents": [{"_id": 1}, {"_id": 1}, 5, {"_id": 2}],
+        "ordered": false,
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, mixed, 3).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 2, "{:?}", reply);
+    assert_eq!(error_indexes(&reply), vec![(1, 11000), (2, 2)]);
+
+    let mixed = doc! {
+        "insert": "mixed_ordered",
+        "documents": [{"_id": 1}, 5, {"_id": 2}],
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, mixed, 4).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 1, "{:?}", reply);
+    assert_eq!(error_indexes(&reply), vec![(1, 2)]);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_large_unordered_inserts_copy_and_fall_back_on_duplicates() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.copy_insert_threshold = Some(100);
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("insert_copy_{}", rand_suffix(6));
+
+    let docs: Vec<bson::Document> = (0..300)
+        .map(|i| doc! {"_id": i, "at": bson::DateTime::from_millis(i as i64)})
+        .collect();
+    let load = doc! {"insert": "loaded", "documents": docs, "ordered": false, "$db": &dbname};
+    let reply = run(&mut stream, load, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 300, "{:?}", reply);
+    assert!(error_indexes(&reply).is_empty());
+    assert_eq!(count(&mut stream, &dbname, "loaded").await, 300);
+
+    // BSON types survive the binary COPY
+    let find = doc! {"find": "loaded", "filter": {"_id": 7}, "$db": &dbname};
+    let reply = run(&mut stream, find, 2).await;
+    let found = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()[0]
+        .as_document()
+        .unwrap()
+        .clone();
+    assert_eq!(
+        found.get_datetime("at").unwrap(),
+        &bson::DateTime::from_millis(7)
+    );
+
+    // Overlapping `_id`s make COPY fail as a whole; the INSERT path reports each duplicate
+    let docs: Vec<bson::Document> = (250..400).map(|i| doc! {"_id": i}).collect();
+    let reload = doc! {"insert": "loaded", "documents": docs, "ordered": false, "$db": &dbname};
+    let reply = run(&mut stream, reload, 3).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 100, "{:?}", reply);
+    assert_eq!(error_indexes(&reply).len(), 50);
+    assert_eq!(error_indexes(&reply)[0], (0, 11000));
+    assert_eq!(count(&mut stream, &dbname, "loaded").await, 400);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,92 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::{TcpSocket, TcpStream};
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+/// Connect to `addr` from the loopback address `from` (any of 127.0.0.0/8 is local on
+/// Linux).
+async fn connect_from(from: &str, addr: std::net::SocketAddr) -> TcpStream {
+    let socket = TcpSocket::new_v4().unwrap();
+    socket.bind(format!("{}:0", from).parse().unwrap()).unwrap();
+    socket.connect(addr).await.unwrap()
+}
+
+/// Whether the server closes `stream` instead of answering a ping.
+async fn refused(stream: &mut TcpStream) -> bool {
+    let ping = doc! {"ping": 1i32, "$db": "admin"};
+    if stream.write_all(&encode_op_msg(&ping, 0, 1)).await.is_err() {
+        return true;
+    }
+    let mut header = [0u8; 16];
+    tokio::time::timeout(
+        std::time::Duration::from_secs(5),
+        stream.read_exact(&mut header),
+    )
+    .await
+    .expect("the server neither answered nor closed the connection")
+    .is_err()
+}
+
+#[tokio::test]
+async fn e2e_ip_filter_refuses_disallowed_peers() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.ip_allowlist = Some(vec!["127.0.0.1/32".into(), "127.0.1.0/24".into()]);
+    cfg.ip_denylist = Some(vec!["127.0.1.9".into()]);
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+
+    // Allowed peers reach the handshake
+    for from in ["127.0.0.1", "127.0.1.5"] {
+        let mut stream = connect_from(from, addr).await;
+        let reply = run(&mut stream, doc! {"ping": 1i32, "$db": "admin"}, 1).await;
+        assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{}: {:?}", from, reply);
+    }
+
+    // Peers outside the allowlist, or in the denylist, are disconnected unanswered
+    for from in ["127.0.0.2", "127.0.1.9"] {
+        let mut stream = connect_from(from, addr).await;
+        assert!(refused(&mut stream).await, "{} was not refused", from);
+    }
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[test]
+fn invalid_ranges_fail_startup() {
+    let mut cfg = Config::default();
+    cfg.ip_allowlist = Some(vec!["10.0.0.0/40".into()]);
+    assert!(oxidedb::ip_filter::IpFilter::from_config(&cfg).is_err());
+}
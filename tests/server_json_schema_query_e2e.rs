@@ -0,0 +1,145 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn ids(reply: &bson::Document) -> Vec<String> {
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().get_str("_id").unwrap().to_string())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_find_filters_by_json_schema() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("schema_query_{}", rand_suffix(6));
+
+    let docs = vec![
+        doc! {"_id": "a", "name": "ann", "email": "ann@x.io", "team": "red"},
+        doc! {"_id": "b", "name": "bob", "team": "red"},
+        doc! {"_id": "c", "name": "cy", "email": 42i32, "team": "blue"},
+        doc! {"_id": "d", "name": "di", "email": "di@x.io", "team": "blue"},
+    ];
+    let ins = doc! {"insert": "people", "documents": docs, "$db": &dbname};
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 4, "{:?}", reply);
+
+    let schema = doc! {
+        "required": ["name", "email"],
+        "properties": {"email": {"bsonType": "string"}},
+    };
+
+    // Documents conforming to the schema
+    let find = doc! {
+        "find": "people",
+        "filter": {"$jsonSchema": schema.clone()},
+        "sort": {"_id": 1i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, find, 2).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(ids(&reply), vec!["a", "d"]);
+
+    // ...and those that need fixing, narrowed by a condition evaluated in SQL
+    let find = doc! {
+        "find": "people",
+        "filter": {"team": "red", "$nor": [{"$jsonSchema": schema.clone()}]},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, find, 3).await;
+    assert_eq!(ids(&reply), vec!["b"]);
+
+    // Limit and projection apply to the matching documents
+    let find = doc! {
+        "find": "people",
+        "filter": {"$nor": [{"$jsonSchema": schema.clone()}]},
+        "sort": {"_id": -1i32},
+        "limit": 1i32,
+        "projection": {"name": 1i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, find, 4).await;
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(
+        batch,
+        &vec![bson::Bson::Document(doc! {"_id": "c", "name": "cy"})]
+    );
+
+    // A leading $match is evaluated the same way
+    let agg = doc! {
+        "aggregate": "people",
+        "pipeline": [
+            {"$match": {"$jsonSchema": schema.clone()}},
+            {"$sort": {"_id": 1i32}},
+        ],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, agg, 5).await;
+    assert_eq!(ids(&reply), vec!["a", "d"]);
+
+    // Writes would otherwise ignore the schema, so they refuse it
+    let del = doc! {
+        "delete": "people",
+        "deletes": [{"q": {"$jsonSchema": schema}, "limit": 0i32}],
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, del, 6).await;
+    assert_eq!(reply.get_i32("code").unwrap(), 2, "{:?}", reply);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
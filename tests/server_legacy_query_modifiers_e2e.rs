@@ -0,0 +1,98 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+#[tokio::test]
+async fn e2e_legacy_wrapped_query_is_unwrapped() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("legacy_query_{}", rand_suffix(6));
+
+    let docs = vec![
+        doc! {"_id": "a", "status": "open", "n": 1i32},
+        doc! {"_id": "b", "status": "open", "n": 3i32},
+        doc! {"_id": "c", "status": "closed", "n": 2i32},
+        doc! {"_id": "d", "status": "open", "n": 2i32},
+    ];
+    let ins = doc! {"insert": "tickets", "documents": docs, "$db": &dbname};
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 4, "{:?}", reply);
+
+    let find = doc! {
+        "find": "tickets",
+        "filter": {
+            "$query": {"status": "open"},
+            "$orderby": {"n": -1i32},
+            "$comment": "old-tool",
+        },
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, find, 2).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let ids: Vec<&str> = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().get_str("_id").unwrap())
+        .collect();
+    assert_eq!(ids, vec!["b", "d", "a"]);
+
+    // $explain reports the plan instead of the documents
+    let find = doc! {
+        "find": "tickets",
+        "filter": {"$query": {"status": "open"}, "$explain": true},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, find, 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert!(reply.get_document("queryPlanner").is_ok(), "{:?}", reply);
+    assert!(!reply.contains_key("cursor"));
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
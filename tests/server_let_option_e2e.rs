@@ -0,0 +1,146 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, request_id: i32) -> bson::Document {
+    let msg = encode_op_msg(&cmd, 0, request_id);
+    stream.write_all(&msg).await.unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn first_batch_ids(reply: &bson::Document) -> Vec<i32> {
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    let mut ids: Vec<i32> = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().get_i32("_id").unwrap())
+        .collect();
+    ids.sort();
+    ids
+}
+
+#[tokio::test]
+async fn e2e_let_binds_expr_variables() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("let_opt_{}", rand_suffix(6));
+    let _ = run(&mut stream, doc! {"create": "orders", "$db": &dbname}, 1).await;
+    let ins = doc! {"insert": "orders", "documents": [
+        {"_id": 1, "qty": 5, "max": 10, "tags": ["a"]},
+        {"_id": 2, "qty": 20, "max": 10, "tags": ["a", "b"]},
+        {"_id": 3, "qty": 50, "max": 100, "tags": ["a", "b", "c"]},
+    ], "$db": &dbname};
+    let _ = run(&mut stream, ins, 2).await;
+
+    // find: a let-bound threshold, alongside a field-to-field comparison
+    let find = doc! {
+        "find": "orders",
+        "filter": {"$expr": {"$and": [
+            {"$gte": ["$qty", "$$threshold"]},
+            {"$lt": ["$qty", "$max"]},
+        ]}},
+        "let": {"threshold": 10},
+        "$db": &dbname,
+    };
+    assert_eq!(first_batch_ids(&run(&mut stream, find, 3).await), vec![3]);
+
+    // Without the variable the filter cannot be evaluated
+    let unbound = doc! {
+        "find": "orders",
+        "filter": {"$expr": {"$gte": ["$qty", "$$threshold"]}},
+        "$db": &dbname,
+    };
+    assert_eq!(
+        run(&mut stream, unbound, 4).await.get_f64("ok").unwrap(),
+        0.0
+    );
+
+    // aggregate: the variable reaches $match, including one evaluated by the engine
+    let agg = doc! {
+        "aggregate": "orders",
+        "pipeline": [
+            {"$match": {"$expr": {"$gt": ["$qty", "$$threshold"]}}},
+            {"$match": {"$expr": {"$gte": [{"$size": "$tags"}, "$$minTags"]}}},
+        ],
+        "cursor": {},
+        "let": {"threshold": 10, "minTags": 3},
+        "$db": &dbname,
+    };
+    assert_eq!(first_batch_ids(&run(&mut stream, agg, 5).await), vec![3]);
+
+    // update: the filter and the update pipeline both see the variables
+    let upd = doc! {
+        "update": "orders",
+        "updates": [{
+            "q": {"$expr": {"$lt": ["$qty", "$$threshold"]}},
+            "u": [{"$set": {"qty": "$$threshold", "flagged": true}}],
+            "multi": true,
+        }],
+        "let": {"threshold": 10},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, upd, 6).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 1, "{:?}", reply);
+    let flagged = doc! {"find": "orders", "filter": {"flagged": true, "qty": 10}, "$db": &dbname};
+    assert_eq!(
+        first_batch_ids(&run(&mut stream, flagged, 7).await),
+        vec![1]
+    );
+
+    // delete
+    let del = doc! {
+        "delete": "orders",
+        "deletes": [{"q": {"$expr": {"$gt": ["$qty", "$$cutoff"]}}, "limit": 0}],
+        "let": {"cutoff": 15},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, del, 8).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 2, "{:?}", reply);
+    let rest = doc! {"find": "orders", "filter": {}, "$db": &dbname};
+    assert_eq!(first_batch_ids(&run(&mut stream, rest, 9).await), vec![1]);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
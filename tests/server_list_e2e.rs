@@ -94,3 +94,85 @@ async fn e2e_list_databases_and_collections() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+async fn list_collections(
+    stream: &mut TcpStream,
+    cmd: bson::Document,
+    request_id: i32,
+) -> Vec<bson::Document> {
+    let msg = encode_op_msg(&cmd, 0, request_id);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", doc);
+    doc.get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|c| c.as_document().unwrap().clone())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_list_collections_filter_and_name_only() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("list_{}", rand_suffix(6));
+    let creates = [
+        doc! {"create": "orders", "$db": &dbname},
+        doc! {"create": "users", "validator": {"age": {"$gte": 0}}, "validationLevel": "strict", "$db": &dbname},
+        doc! {"create": "user_events", "$db": &dbname},
+    ];
+    for (i, create) in creates.into_iter().enumerate() {
+        let msg = encode_op_msg(&create, 0, i as i32 + 1);
+        stream.write_all(&msg).await.unwrap();
+        assert_eq!(
+            read_one_op_msg(&mut stream).await.get_f64("ok").unwrap(),
+            1.0
+        );
+    }
+
+    // A name filter returns only that collection, with its recorded options
+    let lc = doc! {"listCollections": 1i32, "filter": {"name": "users"}, "$db": &dbname};
+    let colls = list_collections(&mut stream, lc, 10).await;
+    assert_eq!(colls.len(), 1);
+    assert_eq!(colls[0].get_str("type").unwrap(), "collection");
+    let options = colls[0].get_document("options").unwrap();
+    assert_eq!(
+        options.get_document("validator").unwrap(),
+        &doc! {"age": {"$gte": 0}}
+    );
+    assert_eq!(options.get_str("validationLevel").unwrap(), "strict");
+    assert!(colls[0].get_document("info").is_ok());
+
+    // Operators and nameOnly
+    let lc = doc! {
+        "listCollections": 1i32,
+        "filter": {"name": {"$regex": "^user"}, "type": "collection"},
+        "nameOnly": true,
+        "$db": &dbname,
+    };
+    let colls = list_collections(&mut stream, lc, 11).await;
+    let names: Vec<&str> = colls.iter().map(|c| c.get_str("name").unwrap()).collect();
+    assert_eq!(names, vec!["user_events", "users"]);
+    assert_eq!(colls[0].keys().collect::<Vec<_>>(), vec!["name", "type"]);
+
+    let lc = doc! {"listCollections": 1i32, "filter": {"type": "view"}, "$db": &dbname};
+    assert!(list_collections(&mut stream, lc, 12).await.is_empty());
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
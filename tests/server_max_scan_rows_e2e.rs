@@ -0,0 +1,93 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+#[tokio::test]
+async fn e2e_max_scan_rows_refuses_unbounded_scans() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.max_scan_rows = Some(50);
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("max_scan_{}", rand_suffix(6));
+
+    let docs: Vec<bson::Document> = (0..500)
+        .map(|i| doc! {"_id": format!("e{:03}", i), "n": i})
+        .collect();
+    let ins = doc! {"insert": "events", "documents": docs, "$db": &dbname};
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 500, "{:?}", reply);
+
+    // A full scan without a limit is refused
+    let find = doc! {"find": "events", "filter": {"n": {"$gte": 0i32}}, "$db": &dbname};
+    let reply = run(&mut stream, find, 2).await;
+    assert_eq!(reply.get_i32("code").unwrap(), 96, "{:?}", reply);
+    assert_eq!(reply.get_str("codeName").unwrap(), "OperationFailed");
+    assert!(
+        reply.get_str("errmsg").unwrap().contains("max_scan_rows"),
+        "{:?}",
+        reply
+    );
+
+    // An explicit limit overrides the cap
+    let find =
+        doc! {"find": "events", "filter": {"n": {"$gte": 0i32}}, "limit": 10i32, "$db": &dbname};
+    let reply = run(&mut stream, find, 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 10);
+
+    // A lookup through the primary key reads one row
+    let find = doc! {"find": "events", "filter": {"_id": "e007"}, "$db": &dbname};
+    let reply = run(&mut stream, find, 4).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
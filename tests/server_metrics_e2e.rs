@@ -164,3 +164,81 @@ async fn e2e_oxidedb_shadow_metrics_no_shadow() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+#[tokio::test]
+async fn e2e_prometheus_http_endpoint() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.metrics_addr = Some("127.0.0.1:0".into());
+
+    let (state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let metrics_addr = state.metrics_addr.expect("metrics endpoint bound");
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("e2e_prom_{}", rand_suffix(6));
+
+    let ping = doc! {"ping": 1i32, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ping, 0, 1)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+
+    let bogus = doc! {"noSuchCommand": 1i32, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&bogus, 0, 2)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(1.0), 0.0);
+
+    let mut http = TcpStream::connect(metrics_addr).await.unwrap();
+    http.write_all(b"GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+        .await
+        .unwrap();
+    let mut resp = String::new();
+    http.read_to_string(&mut resp).await.unwrap();
+
+    assert!(resp.starts_with("HTTP/1.1 200 OK"), "unexpected response: {resp}");
+    let ping_count = format!(
+        "oxidedb_command_requests_total{{command=\"ping\",db=\"{}\"}} 1",
+        dbname
+    );
+    assert!(resp.contains(&ping_count), "missing {ping_count}");
+    assert!(resp.contains(&format!(
+        "oxidedb_command_duration_seconds_count{{command=\"ping\",db=\"{}\"}} 1",
+        dbname
+    )));
+    assert!(resp.contains(&format!(
+        "oxidedb_command_errors_total{{command=\"noSuchCommand\",db=\"{}\",code=\"59\"}} 1",
+        dbname
+    )));
+    assert!(resp.contains("oxidedb_active_connections"));
+    assert!(resp.contains("oxidedb_pg_pool_max_size"));
+
+    // Anything other than /metrics is a 404
+    let mut http = TcpStream::connect(metrics_addr).await.unwrap();
+    http.write_all(b"GET / HTTP/1.1\r\n\r\n").await.unwrap();
+    let mut resp = String::new();
+    http.read_to_string(&mut resp).await.unwrap();
+    assert!(resp.starts_with("HTTP/1.1 404"));
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_prometheus_http_endpoint_disabled_by_default() {
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+
+    let (state, _addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    assert!(state.metrics_addr.is_none());
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
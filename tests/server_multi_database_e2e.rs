@@ -0,0 +1,125 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn first_batch(reply: &bson::Document) -> Vec<bson::Document> {
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .filter_map(|b| b.as_document().cloned())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_one_connection_interleaves_databases() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let suffix = rand_suffix(6);
+    let db_a = format!("multi_a_{}", suffix);
+    let db_b = format!("multi_b_{}", suffix);
+
+    // Same collection name in both databases, writes alternating on one connection
+    let mut req = 1;
+    for i in 0..3i32 {
+        for (dbname, tag) in [(&db_a, "a"), (&db_b, "b")] {
+            let ins = doc! {
+                "insert": "items",
+                "documents": [{"i": i, "tag": tag}],
+                "$db": dbname,
+            };
+            let r = run(&mut stream, ins, req).await;
+            req += 1;
+            assert_eq!(r.get_i32("n").unwrap(), 1);
+        }
+    }
+    let ins = doc! {"insert": "extra", "documents": [{"only": "b"}], "$db": &db_b};
+    run(&mut stream, ins, req).await;
+    req += 1;
+
+    for (dbname, tag) in [(&db_a, "a"), (&db_b, "b"), (&db_a, "a")] {
+        let find = doc! {"find": "items", "filter": {}, "$db": dbname};
+        let docs = first_batch(&run(&mut stream, find, req).await);
+        req += 1;
+        assert_eq!(docs.len(), 3, "items in {}", dbname);
+        assert!(docs.iter().all(|d| d.get_str("tag").unwrap() == tag));
+    }
+
+    // An update in one database leaves the other untouched
+    let upd = doc! {
+        "update": "items",
+        "updates": [{"q": {}, "u": {"$set": {"touched": true}}, "multi": true}],
+        "$db": &db_a,
+    };
+    let r = run(&mut stream, upd, req).await;
+    req += 1;
+    assert_eq!(r.get_i32("nModified").unwrap(), 3);
+    let find = doc! {"find": "items", "filter": {"touched": true}, "$db": &db_b};
+    assert!(first_batch(&run(&mut stream, find, req).await).is_empty());
+    req += 1;
+
+    let list = doc! {"listCollections": 1i32, "$db": &db_a};
+    let names: Vec<String> = first_batch(&run(&mut stream, list, req).await)
+        .iter()
+        .map(|d| d.get_str("name").unwrap().to_string())
+        .collect();
+    req += 1;
+    assert_eq!(names, vec!["items".to_string()]);
+
+    // Dropping one database keeps the other readable on the same connection
+    let r = run(&mut stream, doc! {"dropDatabase": 1i32, "$db": &db_b}, req).await;
+    req += 1;
+    assert_eq!(r.get_f64("ok").unwrap(), 1.0);
+    let find = doc! {"find": "items", "filter": {}, "$db": &db_a};
+    assert_eq!(first_batch(&run(&mut stream, find, req).await).len(), 3);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,125 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, request_id: i32) -> bson::Document {
+    let msg = encode_op_msg(&cmd, 0, request_id);
+    stream.write_all(&msg).await.unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn first_batch(reply: &bson::Document) -> Vec<bson::Document> {
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().clone())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_natural_sort_and_hint_follow_insertion_order() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("natural_{}", rand_suffix(6));
+    // `_id` order differs from insertion order
+    let inserted = ["m", "c", "x", "a", "q"];
+    for (i, id) in inserted.iter().enumerate() {
+        let ins =
+            doc! {"insert": "log", "documents": [{"_id": *id, "n": i as i32}], "$db": &dbname};
+        assert_eq!(
+            run(&mut stream, ins, i as i32 + 1)
+                .await
+                .get_f64("ok")
+                .unwrap(),
+            1.0
+        );
+    }
+    // Updates keep a document's place
+    let upd = doc! {
+        "update": "log",
+        "updates": [{"q": {"_id": "c"}, "u": {"$set": {"touched": true}}}],
+        "$db": &dbname,
+    };
+    assert_eq!(
+        run(&mut stream, upd, 10)
+            .await
+            .get_i32("nModified")
+            .unwrap(),
+        1
+    );
+
+    let ids = |reply: &bson::Document| -> Vec<String> {
+        first_batch(reply)
+            .iter()
+            .map(|d| d.get_str("_id").unwrap().to_string())
+            .collect()
+    };
+    let forward: Vec<String> = inserted.iter().map(|s| s.to_string()).collect();
+    let mut backward = forward.clone();
+    backward.reverse();
+
+    let find = doc! {"find": "log", "sort": {"$natural": 1}, "$db": &dbname};
+    assert_eq!(ids(&run(&mut stream, find, 11).await), forward);
+    let find = doc! {"find": "log", "sort": {"$natural": -1}, "$db": &dbname};
+    assert_eq!(ids(&run(&mut stream, find, 12).await), backward);
+    let find = doc! {"find": "log", "hint": {"$natural": -1}, "$db": &dbname};
+    assert_eq!(ids(&run(&mut stream, find, 13).await), backward);
+    let find = doc! {
+        "find": "log",
+        "filter": {"n": {"$gte": 2}},
+        "hint": {"$natural": 1},
+        "limit": 2,
+        "$db": &dbname,
+    };
+    assert_eq!(ids(&run(&mut stream, find, 14).await), vec!["x", "a"]);
+    // An explicit sort wins over the hint
+    let find = doc! {"find": "log", "sort": {"_id": 1}, "hint": {"$natural": -1}, "$db": &dbname};
+    assert_eq!(
+        ids(&run(&mut stream, find, 15).await),
+        vec!["a", "c", "m", "q", "x"]
+    );
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,136 @@
+use bson::{Bson, Document, doc};
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn first_batch(stream: &mut TcpStream, cmd: &bson::Document, req: i32) -> Vec<Document> {
+    let msg = encode_op_msg(cmd, 0, req);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(stream).await;
+    doc.get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().clone())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_numeric_types_round_trip() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("num_types_{}", rand_suffix(6));
+    let ins = doc! {"insert": "n", "documents": [
+        {"_id": "i", "v": 7i32, "nested": {"arr": [1i32, 2i64]}},
+        {"_id": "l", "v": 7i64, "nested": {"arr": [3i64]}},
+        {"_id": "d", "v": 7.0f64, "nested": {"arr": [4.5f64]}},
+    ], "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    // Whole documents and projected fields decode with their original types
+    let find = doc! {"find": "n", "filter": {}, "sort": {"_id": 1i32}, "$db": &dbname};
+    let docs = first_batch(&mut stream, &find, 2).await;
+    let find = doc! {"find": "n", "filter": {}, "sort": {"_id": 1i32}, "projection": {"v": 1i32}, "$db": &dbname};
+    let projected = first_batch(&mut stream, &find, 3).await;
+    for batch in [&docs, &projected] {
+        let by_id = |id: &str| {
+            batch
+                .iter()
+                .find(|d| d.get_str("_id").unwrap() == id)
+                .unwrap()
+        };
+        assert_eq!(by_id("i").get("v"), Some(&Bson::Int32(7)));
+        assert_eq!(by_id("l").get("v"), Some(&Bson::Int64(7)));
+        assert_eq!(by_id("d").get("v"), Some(&Bson::Double(7.0)));
+    }
+    let by_id = |id: &str| {
+        docs.iter()
+            .find(|d| d.get_str("_id").unwrap() == id)
+            .unwrap()
+    };
+    assert_eq!(
+        by_id("i")
+            .get_document("nested")
+            .unwrap()
+            .get_array("arr")
+            .unwrap(),
+        &vec![Bson::Int32(1), Bson::Int64(2)]
+    );
+
+    // $type tells int, long and double apart, including inside arrays
+    for (ty, expected) in [
+        (Bson::String("int".into()), vec!["i"]),
+        (Bson::String("long".into()), vec!["l"]),
+        (Bson::Int32(1), vec!["d"]),
+        (Bson::String("number".into()), vec!["d", "i", "l"]),
+    ] {
+        let find = doc! {"find": "n", "filter": {"v": {"$type": (ty.clone())}}, "sort": {"_id": 1i32}, "$db": &dbname};
+        let ids: Vec<String> = first_batch(&mut stream, &find, 4)
+            .await
+            .iter()
+            .map(|d| d.get_str("_id").unwrap().to_string())
+            .collect();
+        assert_eq!(ids, expected, "$type {:?}", ty);
+    }
+    let find = doc! {"find": "n", "filter": {"nested.arr": {"$type": "long"}}, "sort": {"_id": 1i32}, "$db": &dbname};
+    let ids: Vec<String> = first_batch(&mut stream, &find, 5)
+        .await
+        .iter()
+        .map(|d| d.get_str("_id").unwrap().to_string())
+        .collect();
+    assert_eq!(ids, vec!["i", "l"]);
+
+    // Aggregation math widens int + long to long instead of narrowing to int
+    let pipeline = vec![
+        Bson::Document(doc! {"$match": {"v": {"$type": "long"}}}),
+        Bson::Document(
+            doc! {"$project": {"sum": {"$add": ["$v", 1i32]}, "diff": {"$subtract": ["$v", 1i32]}}},
+        ),
+    ];
+    let agg = doc! {"aggregate": "n", "pipeline": pipeline, "cursor": {}, "$db": &dbname};
+    let out = first_batch(&mut stream, &agg, 6).await;
+    assert_eq!(out[0].get("sum"), Some(&Bson::Int64(8)));
+    assert_eq!(out[0].get("diff"), Some(&Bson::Int64(6)));
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
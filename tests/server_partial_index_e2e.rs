@@ -0,0 +1,150 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn winning_plan(reply: &bson::Document) -> bson::Document {
+    reply
+        .get_document("queryPlanner")
+        .unwrap()
+        .get_document("winningPlan")
+        .unwrap()
+        .clone()
+}
+
+#[tokio::test]
+async fn e2e_partial_index_serves_only_queries_within_its_filter() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("partial_{}", rand_suffix(6));
+    let docs: Vec<bson::Document> = (0..5000)
+        .map(|i| {
+            doc! {
+                "name": format!("item-{:05}", i),
+                "status": if i % 10 == 0 { "active" } else { "archived" },
+            }
+        })
+        .collect();
+    let ins = doc! {"insert": "items", "documents": docs, "$db": &dbname};
+    assert_eq!(run(&mut stream, ins, 1).await.get_f64("ok").unwrap(), 1.0);
+    let idx = doc! {
+        "createIndexes": "items",
+        "indexes": [{
+            "name": "name_active",
+            "key": {"name": 1i32},
+            "partialFilterExpression": {"status": "active"},
+        }],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, idx, 2).await.get_f64("ok").unwrap(), 1.0);
+    let client = state.store.as_ref().unwrap().pool().get().await.unwrap();
+    client
+        .batch_execute(&format!("ANALYZE \"mdb_{}\".\"items\"", dbname))
+        .await
+        .unwrap();
+
+    // The filter is kept with the index
+    let list = doc! {"listIndexes": "items", "$db": &dbname};
+    let doc = run(&mut stream, list, 3).await;
+    let specs = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(specs.len(), 2, "{:?}", specs);
+    let spec = specs[1].as_document().unwrap();
+    assert_eq!(spec.get_str("name").unwrap(), "name_active");
+    assert_eq!(
+        spec.get_document("partialFilterExpression").unwrap(),
+        &doc! {"status": "active"}
+    );
+
+    // A query that repeats the filter can use the index
+    let filter = doc! {"status": "active", "name": {"$regex": "^item-001"}};
+    let find = doc! {"find": "items", "filter": filter.clone(), "$db": &dbname};
+    let doc = run(&mut stream, find, 4).await;
+    let batch = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 10);
+    let explain = doc! {"explain": {"find": "items", "filter": filter}, "$db": &dbname};
+    let plan = winning_plan(&run(&mut stream, explain, 5).await);
+    assert_eq!(plan.get_str("stage").unwrap(), "IXSCAN", "{:?}", plan);
+    assert_eq!(plan.get_str("indexName").unwrap(), "name_active");
+
+    // Without it the index would miss archived documents, so it is not used
+    let explain = doc! {
+        "explain": {"find": "items", "filter": {"name": {"$regex": "^item-001"}}},
+        "$db": &dbname,
+    };
+    let plan = winning_plan(&run(&mut stream, explain, 6).await);
+    assert_eq!(plan.get_str("stage").unwrap(), "COLLSCAN", "{:?}", plan);
+
+    // Filters PostgreSQL cannot index are refused
+    let idx = doc! {
+        "createIndexes": "items",
+        "indexes": [{
+            "name": "name_matching",
+            "key": {"name": 1i32},
+            "partialFilterExpression": {"status": {"$regex": "^act"}},
+        }],
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, idx, 7).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 0.0);
+    assert_eq!(doc.get_i32("code").unwrap(), 67);
+
+    // An unknown collection has no indexes to list
+    let list = doc! {"listIndexes": "missing", "$db": &dbname};
+    let doc = run(&mut stream, list, 8).await;
+    assert_eq!(doc.get_i32("code").unwrap(), 26);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
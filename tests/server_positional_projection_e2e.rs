@@ -0,0 +1,171 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+#[tokio::test]
+async fn e2e_positional_projection_in_find_and_aggregate() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("positional_{}", rand_suffix(6));
+
+    let docs = vec![
+        doc! {
+            "_id": "o1",
+            "customer": "ann",
+            "items": [
+                {"sku": "a1", "qty": 1i32},
+                {"sku": "b2", "qty": 4i32},
+                {"sku": "b2", "qty": 9i32},
+            ],
+            "grades": [70i32, 91i32, 95i32],
+        },
+        doc! {
+            "_id": "o2",
+            "customer": "bob",
+            "items": [{"sku": "c3", "qty": 2i32}],
+            "grades": [60i32],
+        },
+    ];
+    let ins = doc! {"insert": "orders", "documents": docs, "$db": &dbname};
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 2, "{:?}", reply);
+
+    let batch = |reply: &bson::Document| -> Vec<bson::Document> {
+        reply
+            .get_document("cursor")
+            .unwrap()
+            .get_array("firstBatch")
+            .unwrap()
+            .iter()
+            .map(|d| d.as_document().unwrap().clone())
+            .collect()
+    };
+
+    // find keeps the first element matching the filter's condition on the array
+    let find = doc! {
+        "find": "orders",
+        "filter": {"items.sku": "b2"},
+        "projection": {"customer": 1i32, "items.$": 1i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, find, 2).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let found = batch(&reply);
+    assert_eq!(found.len(), 1, "{:?}", found);
+    assert_eq!(found[0].get_str("customer").unwrap(), "ann");
+    assert_eq!(
+        found[0].get_array("items").unwrap(),
+        &vec![bson::Bson::Document(doc! {"sku": "b2", "qty": 4i32})]
+    );
+
+    // The same projection after a $match gives the same element
+    let agg = doc! {
+        "aggregate": "orders",
+        "pipeline": [
+            {"$match": {"items.sku": "b2"}},
+            {"$project": {"customer": 1i32, "items.$": 1i32}},
+        ],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, agg, 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let aggregated = batch(&reply);
+    assert_eq!(aggregated.len(), 1, "{:?}", aggregated);
+    assert_eq!(aggregated[0].get_str("customer").unwrap(), "ann");
+    assert_eq!(
+        aggregated[0].get_array("items").unwrap(),
+        found[0].get_array("items").unwrap()
+    );
+
+    // Conditions on the array itself and $elemMatch select the element too
+    let find = doc! {
+        "find": "orders",
+        "filter": {"grades": {"$gte": 90i32}},
+        "projection": {"grades.$": 1i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, find, 4).await;
+    let found = batch(&reply);
+    assert_eq!(found, vec![doc! {"_id": "o1", "grades": [91i32]}]);
+
+    let agg = doc! {
+        "aggregate": "orders",
+        "pipeline": [
+            {"$match": {"items": {"$elemMatch": {"sku": "b2", "qty": {"$gt": 5i32}}}}},
+            {"$project": {"_id": 0i32, "items.$": 1i32}},
+        ],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, agg, 5).await;
+    assert_eq!(
+        batch(&reply),
+        vec![doc! {"items": [{"sku": "b2", "qty": 9i32}]}]
+    );
+
+    // Without a condition on the array there is no element to keep
+    let find = doc! {
+        "find": "orders",
+        "filter": {"customer": "bob"},
+        "projection": {"items.$": 1i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, find, 6).await;
+    assert_eq!(reply.get_i32("code").unwrap(), 51246, "{:?}", reply);
+
+    let find = doc! {
+        "find": "orders",
+        "projection": {"items.$": 1i32, "grades.$": 1i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, find, 7).await;
+    assert_eq!(reply.get_i32("code").unwrap(), 31276, "{:?}", reply);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
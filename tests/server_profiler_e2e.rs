@@ -0,0 +1,128 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+async fn profile_entries(stream: &mut TcpStream, dbname: &str, req: i32) -> Vec<bson::Document> {
+    let find = doc! {"find": "system.profile", "filter": {}, "$db": dbname};
+    let doc = run(stream, find, req).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0);
+    doc.get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .filter_map(|b| b.as_document().cloned())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_profiler_records_operations() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("profiler_{}", rand_suffix(6));
+
+    // Level 2 records everything
+    let doc = run(&mut stream, doc! {"profile": 2i32, "$db": &dbname}, 1).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0);
+    assert_eq!(doc.get_i32("was").unwrap(), 0);
+
+    let ins = doc! {"insert": "items", "documents": [{"_id": 1i32}, {"_id": 2i32}], "$db": &dbname};
+    run(&mut stream, ins, 2).await;
+    let find =
+        doc! {"find": "items", "filter": {"_id": 1i32}, "comment": "prof-test", "$db": &dbname};
+    run(&mut stream, find, 3).await;
+
+    let entries = profile_entries(&mut stream, &dbname, 4).await;
+    let insert = entries
+        .iter()
+        .find(|e| e.get_str("op").ok() == Some("insert"))
+        .expect("insert profiled");
+    assert_eq!(insert.get_str("ns").unwrap(), format!("{}.items", dbname));
+    assert_eq!(insert.get_i64("ninserted").unwrap(), 2);
+    assert!(insert.get_i64("millis").is_ok());
+    assert!(insert.get_datetime("ts").is_ok());
+    let query = entries
+        .iter()
+        .find(|e| e.get_str("op").ok() == Some("query"))
+        .expect("find profiled");
+    assert_eq!(query.get_i64("nreturned").unwrap(), 1);
+    let command = query.get_document("command").unwrap();
+    assert_eq!(command.get_str("find").unwrap(), "items");
+    assert_eq!(command.get_str("comment").unwrap(), "prof-test");
+
+    // Level 1 with a huge slowms records nothing new
+    let doc = run(
+        &mut stream,
+        doc! {"profile": 1i32, "slowms": 1_000_000i32, "$db": &dbname},
+        5,
+    )
+    .await;
+    assert_eq!(doc.get_i32("was").unwrap(), 2);
+    assert_eq!(doc.get_i64("slowms").unwrap(), 1_000_000);
+    let before = profile_entries(&mut stream, &dbname, 6).await.len();
+    run(
+        &mut stream,
+        doc! {"find": "items", "filter": {}, "$db": &dbname},
+        7,
+    )
+    .await;
+    assert_eq!(profile_entries(&mut stream, &dbname, 8).await.len(), before);
+
+    // -1 only reads the level
+    let doc = run(&mut stream, doc! {"profile": -1i32, "$db": &dbname}, 9).await;
+    assert_eq!(doc.get_i32("was").unwrap(), 1);
+    let doc = run(&mut stream, doc! {"profile": 0i32, "$db": &dbname}, 10).await;
+    assert_eq!(doc.get_i32("was").unwrap(), 1);
+
+    let doc = run(&mut stream, doc! {"profile": 5i32, "$db": &dbname}, 11).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 0.0);
+    assert_eq!(doc.get_i32("code").unwrap(), 2);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
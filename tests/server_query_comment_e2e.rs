@@ -0,0 +1,115 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+#[tokio::test]
+async fn e2e_legacy_query_comment_is_not_a_condition() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("query_comment_{}", rand_suffix(6));
+
+    let reply = run(&mut stream, doc! {"profile": 2i32, "$db": &dbname}, 1).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let docs = vec![
+        doc! {"_id": "a", "status": "open"},
+        doc! {"_id": "b", "status": "open"},
+        doc! {"_id": "c", "status": "closed"},
+    ];
+    let ins = doc! {"insert": "tickets", "documents": docs, "$db": &dbname};
+    let reply = run(&mut stream, ins, 2).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 3, "{:?}", reply);
+
+    let find = doc! {
+        "find": "tickets",
+        "filter": {"status": "open", "$comment": "legacy-trace"},
+        "sort": {"_id": 1i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, find, 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 2, "{:?}", batch);
+
+    // A filter holding only a comment matches everything
+    let del = doc! {
+        "delete": "tickets",
+        "deletes": [{"q": {"$comment": "cleanup"}, "limit": 0i32}],
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, del, 4).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 3, "{:?}", reply);
+
+    // The profiler records it as the command's comment
+    let find = doc! {"find": "system.profile", "filter": {}, "$db": &dbname};
+    let reply = run(&mut stream, find, 5).await;
+    let entries = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    let query = entries
+        .iter()
+        .filter_map(|e| e.as_document())
+        .find(|e| e.get_str("op") == Ok("query"))
+        .expect("find profiled");
+    let command = query.get_document("command").unwrap();
+    assert_eq!(command.get_str("comment").unwrap(), "legacy-trace");
+    assert!(
+        !command
+            .get_document("filter")
+            .is_ok_and(|f| f.contains_key("$comment")),
+        "{:?}",
+        command
+    );
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,110 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, request_id: i32) -> bson::Document {
+    let msg = encode_op_msg(&cmd, 0, request_id);
+    stream.write_all(&msg).await.unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn first_batch(reply: &bson::Document) -> Vec<bson::Document> {
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().clone())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_rand_filter_keeps_expected_fraction() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("rand_{}", rand_suffix(6));
+    let docs: Vec<bson::Document> = (0..4000).map(|i| doc! {"i": i, "weight": 0.3}).collect();
+    let ins = doc! {"insert": "items", "documents": docs, "$db": &dbname};
+    assert_eq!(run(&mut stream, ins, 1).await.get_f64("ok").unwrap(), 1.0);
+
+    // Each document draws its own number, so about 70% have weight below it. With 4000
+    // documents the kept count has a standard deviation near 29; the bounds are over 6 of them.
+    let filter = doc! {"$expr": {"$lt": ["$weight", {"$rand": {}}]}};
+    let find = doc! {"find": "items", "filter": filter.clone(), "batchSize": 5000, "$db": &dbname};
+    let kept = first_batch(&run(&mut stream, find, 2).await).len();
+    assert!((2600..=3000).contains(&kept), "find kept {}", kept);
+
+    let agg = doc! {
+        "aggregate": "items",
+        "pipeline": [{"$match": filter}, {"$count": "n"}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let n = first_batch(&run(&mut stream, agg, 3).await)[0]
+        .get_i32("n")
+        .unwrap();
+    assert!((2600..=3000).contains(&n), "aggregate kept {}", n);
+
+    // In a projection every document gets a different value in [0, 1)
+    let agg = doc! {
+        "aggregate": "items",
+        "pipeline": [
+            {"$limit": 100},
+            {"$project": {"_id": 0, "r": {"$rand": {}}}},
+        ],
+        "cursor": {"batchSize": 100},
+        "$db": &dbname,
+    };
+    let draws: Vec<f64> = first_batch(&run(&mut stream, agg, 4).await)
+        .iter()
+        .map(|d| d.get_f64("r").unwrap())
+        .collect();
+    assert_eq!(draws.len(), 100);
+    assert!(draws.iter().all(|r| (0.0..1.0).contains(r)));
+    let mut distinct = draws.clone();
+    distinct.sort_by(|a, b| a.partial_cmp(b).unwrap());
+    distinct.dedup();
+    assert!(distinct.len() > 90, "{:?}", draws);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,114 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+#[tokio::test]
+async fn e2e_anchored_regex_uses_index_range_scan() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("regex_{}", rand_suffix(6));
+    let mut docs: Vec<bson::Document> = (0..5000)
+        .map(|i| doc! {"name": format!("item-{:05}", i)})
+        .collect();
+    docs.extend((0..5).map(|i| doc! {"name": format!("foo{}", i)}));
+    docs.push(doc! {"name": "food"});
+    docs.push(doc! {"name": "xfoo"});
+    let ins = doc! {"insert": "items", "documents": docs, "$db": &dbname};
+    assert_eq!(run(&mut stream, ins, 1).await.get_f64("ok").unwrap(), 1.0);
+    let idx = doc! {
+        "createIndexes": "items",
+        "indexes": [{"name": "name_1", "key": {"name": 1i32}}],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, idx, 2).await.get_f64("ok").unwrap(), 1.0);
+    let client = state.store.as_ref().unwrap().pool().get().await.unwrap();
+    client
+        .batch_execute(&format!("ANALYZE \"mdb_{}\".\"items\"", dbname))
+        .await
+        .unwrap();
+
+    // The range narrows the scan, the residual regex keeps the exact semantics
+    let find = doc! {"find": "items", "filter": {"name": {"$regex": "^foo\\d"}}, "$db": &dbname};
+    let doc = run(&mut stream, find, 3).await;
+    let batch = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 5);
+
+    let explain = doc! {
+        "explain": {"find": "items", "filter": {"name": {"$regex": "^foo"}}},
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, explain, 4).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0);
+    let plan = doc
+        .get_document("queryPlanner")
+        .unwrap()
+        .get_document("winningPlan")
+        .unwrap();
+    assert_eq!(plan.get_str("stage").unwrap(), "IXSCAN", "{:?}", plan);
+    assert_eq!(plan.get_str("indexName").unwrap(), "name_1");
+
+    // An unanchored pattern cannot use the index
+    let explain = doc! {
+        "explain": {"find": "items", "filter": {"name": {"$regex": "foo"}}},
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, explain, 5).await;
+    let plan = doc
+        .get_document("queryPlanner")
+        .unwrap()
+        .get_document("winningPlan")
+        .unwrap();
+    assert_eq!(plan.get_str("stage").unwrap(), "COLLSCAN", "{:?}", plan);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,186 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn index(spec: bson::Document, coll: &str, db: &str) -> bson::Document {
+    doc! {"createIndexes": coll, "indexes": [spec], "$db": db}
+}
+
+#[tokio::test]
+async fn e2e_sparse_unique_index_allows_many_missing_values() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("sparse_{}", rand_suffix(6));
+
+    let spec = doc! {"name": "email_1", "key": {"email": 1i32}, "unique": true, "sparse": true};
+    let doc = run(&mut stream, index(spec, "users", &dbname), 1).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0, "{:?}", doc);
+
+    // Documents without the field are left out of the index, however many there are
+    let ins = doc! {
+        "insert": "users",
+        "documents": [{"name": "a"}, {"name": "b"}, {"name": "c", "email": "c@example.com"}],
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, ins, 2).await;
+    assert_eq!(doc.get_i32("n").unwrap(), 3, "{:?}", doc);
+
+    // Present values are still unique
+    let ins = doc! {
+        "insert": "users",
+        "documents": [{"name": "d", "email": "c@example.com"}],
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, ins, 3).await;
+    assert_eq!(doc.get_i32("n").unwrap(), 0);
+    let err = doc.get_array("writeErrors").unwrap()[0]
+        .as_document()
+        .unwrap()
+        .clone();
+    assert_eq!(err.get_i32("code").unwrap(), 11000, "{:?}", err);
+
+    // Without sparse, a missing field is a null key and only one document may lack it
+    let spec = doc! {"name": "phone_1", "key": {"phone": 1i32}, "unique": true};
+    let doc = run(&mut stream, index(spec, "users", &dbname), 4).await;
+    assert_eq!(doc.get_i32("code").unwrap(), 11000, "{:?}", doc);
+    let spec = doc! {"name": "phone_1", "key": {"phone": 1i32}, "unique": true};
+    let doc = run(&mut stream, index(spec, "contacts", &dbname), 5).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0, "{:?}", doc);
+    let ins = doc! {
+        "insert": "contacts",
+        "documents": [{"name": "a"}, {"name": "b"}],
+        "ordered": false,
+        "$db": &dbname,
+    };
+    let doc = run(&mut stream, ins, 6).await;
+    assert_eq!(doc.get_i32("n").unwrap(), 1, "{:?}", doc);
+
+    // Sparse and a partial filter do not combine
+    let spec = doc! {
+        "name": "nick_1",
+        "key": {"nick": 1i32},
+        "sparse": true,
+        "partialFilterExpression": {"nick": {"$exists": true}},
+    };
+    let doc = run(&mut stream, index(spec, "users", &dbname), 7).await;
+    assert_eq!(doc.get_i32("code").unwrap(), 67);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_sparse_index_serves_only_queries_requiring_the_field() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("sparse_{}", rand_suffix(6));
+
+    let docs: Vec<bson::Document> = (0..5000)
+        .map(|i| {
+            if i % 20 == 0 {
+                doc! {"i": i, "nick": format!("n-{:05}", i)}
+            } else {
+                doc! {"i": i}
+            }
+        })
+        .collect();
+    let ins = doc! {"insert": "people", "documents": docs, "$db": &dbname};
+    assert_eq!(run(&mut stream, ins, 1).await.get_f64("ok").unwrap(), 1.0);
+    let spec = doc! {"name": "nick_1", "key": {"nick": 1i32}, "sparse": true};
+    let doc = run(&mut stream, index(spec, "people", &dbname), 2).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 1.0, "{:?}", doc);
+    let client = state.store.as_ref().unwrap().pool().get().await.unwrap();
+    client
+        .batch_execute(&format!("ANALYZE \"mdb_{}\".\"people\"", dbname))
+        .await
+        .unwrap();
+
+    let plan_of = |reply: bson::Document| {
+        reply
+            .get_document("queryPlanner")
+            .unwrap()
+            .get_document("winningPlan")
+            .unwrap()
+            .clone()
+    };
+
+    // Requiring the field keeps the query within the index
+    let filter = doc! {"nick": {"$exists": true, "$regex": "^n-001"}};
+    let find = doc! {"find": "people", "filter": filter.clone(), "$db": &dbname};
+    let doc = run(&mut stream, find, 3).await;
+    let batch = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 5);
+    let explain = doc! {"explain": {"find": "people", "filter": filter}, "$db": &dbname};
+    let plan = plan_of(run(&mut stream, explain, 4).await);
+    assert_eq!(plan.get_str("stage").unwrap(), "IXSCAN", "{:?}", plan);
+    assert_eq!(plan.get_str("indexName").unwrap(), "nick_1");
+
+    // Documents lacking the field are not in the index, so it cannot answer this
+    let explain = doc! {
+        "explain": {"find": "people", "filter": {"nick": {"$exists": false}}},
+        "$db": &dbname,
+    };
+    let plan = plan_of(run(&mut stream, explain, 5).await);
+    assert_eq!(plan.get_str("stage").unwrap(), "COLLSCAN", "{:?}", plan);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,166 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn first_batch(reply: &bson::Document) -> Vec<bson::Document> {
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .filter_map(|b| b.as_document().cloned())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_values_with_sql_metacharacters_round_trip() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    // No statement cache: literals must be bound on the unprepared path too
+    cfg.statement_cache_size = Some(0);
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("sqli_{}", rand_suffix(6));
+    let tricky = [
+        "O'Brien",
+        "x'); DROP TABLE people; --",
+        "back\\slash'",
+        "\"quoted\" ? (@ == 1)",
+        "$1 -- $$ ;",
+    ];
+    let docs: Vec<bson::Document> = tricky
+        .iter()
+        .enumerate()
+        .map(|(i, name)| doc! {"name": *name, "tags": [*name, "t"], "n": i as i32})
+        .collect();
+    let r = run(
+        &mut stream,
+        doc! {"insert": "people", "documents": docs, "$db": &dbname},
+        1,
+    )
+    .await;
+    assert_eq!(r.get_i32("n").unwrap(), tricky.len() as i32);
+
+    let mut req = 2;
+    for name in tricky {
+        let filters = [
+            doc! {"name": name},
+            doc! {"name": {"$in": [name, "nobody"]}},
+            doc! {"tags": {"$all": [name]}},
+            doc! {"name": {"$gte": name, "$lte": name}},
+            doc! {"name": {"$regex": format!("^{}", regex_escape(name))}},
+        ];
+        for filter in filters {
+            let find = doc! {"find": "people", "filter": filter.clone(), "$db": &dbname};
+            let found = first_batch(&run(&mut stream, find, req).await);
+            req += 1;
+            assert_eq!(found.len(), 1, "filter {:?}", filter);
+            assert_eq!(found[0].get_str("name").unwrap(), name);
+        }
+
+        let agg = doc! {
+            "aggregate": "people",
+            "pipeline": [
+                {"$match": {"name": name}},
+                {"$project": {"_id": 0, "label": {"$concat": ["<", "$name", ">"]}}},
+            ],
+            "cursor": {},
+            "$db": &dbname,
+        };
+        let out = first_batch(&run(&mut stream, agg, req).await);
+        req += 1;
+        assert_eq!(out.len(), 1);
+        assert_eq!(
+            out[0].get_str("label").unwrap(),
+            format!("<{}>", name).as_str()
+        );
+    }
+
+    let upd = doc! {
+        "update": "people",
+        "updates": [{"q": {"name": tricky[1]}, "u": {"$set": {"seen": true}}}],
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, upd, req).await;
+    assert_eq!(r.get_i32("nModified").unwrap(), 1);
+
+    // Explain runs the same bound statement, executing it at executionStats
+    let explain = doc! {
+        "explain": {"find": "people", "filter": {"name": tricky[1]}},
+        "verbosity": "executionStats",
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, explain, req + 10).await;
+    assert_eq!(r.get_f64("ok").unwrap(), 1.0, "explain: {:?}", r);
+
+    let del = doc! {
+        "delete": "people",
+        "deletes": [{"q": {"name": {"$in": [tricky[0], tricky[4]]}}, "limit": 0i32}],
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, del, req + 1).await;
+    assert_eq!(r.get_i32("n").unwrap(), 2);
+
+    // The table is intact and only the deleted rows are gone
+    let find = doc! {"find": "people", "filter": {}, "$db": &dbname};
+    let left = first_batch(&run(&mut stream, find, req + 2).await);
+    assert_eq!(left.len(), tricky.len() - 2);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+fn regex_escape(s: &str) -> String {
+    let mut out = String::new();
+    for c in s.chars() {
+        if "\\^$.|?*+()[]{}".contains(c) {
+            out.push('\\');
+        }
+        out.push(c);
+    }
+    out
+}
@@ -0,0 +1,108 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn first_batch(reply: &bson::Document) -> Vec<bson::Document> {
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .filter_map(|b| b.as_document().cloned())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_repeated_find_shapes_reuse_prepared_statements() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("stmt_cache_{}", rand_suffix(6));
+    let tricky = "O'Brien'); DROP TABLE people; --";
+    let ins = doc! {
+        "insert": "people",
+        "documents": [
+            {"name": "alice", "age": 30i32},
+            {"name": "bob", "age": 40i32},
+            {"name": tricky, "age": 50i32},
+        ],
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, ins, 1).await;
+    assert_eq!(r.get_i32("n").unwrap(), 3);
+
+    let mut req = 2;
+    for name in ["alice", "bob", tricky] {
+        let find = doc! {"find": "people", "filter": {"name": name}, "$db": &dbname};
+        let docs = first_batch(&run(&mut stream, find, req).await);
+        req += 1;
+        assert_eq!(docs.len(), 1, "lookup of {:?}", name);
+        assert_eq!(docs[0].get_str("name").unwrap(), name);
+    }
+
+    // The table survived the quoted value and all three rows are still there
+    let find = doc! {"find": "people", "filter": {"age": {"$gte": 30i32}}, "$db": &dbname};
+    assert_eq!(first_batch(&run(&mut stream, find, req).await).len(), 3);
+
+    let status = run(
+        &mut stream,
+        doc! {"serverStatus": 1i32, "$db": "admin"},
+        req + 1,
+    )
+    .await;
+    let cache = status.get_document("statementCache").unwrap();
+    assert!(
+        cache.get_i64("hits").unwrap() >= 2,
+        "expected the name lookups to share a shape: {:?}",
+        cache
+    );
+    assert!(cache.get_i64("size").unwrap() >= 2);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -607,3 +607,103 @@ async fn e2e_transaction_missing_lsid() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+#[tokio::test]
+async fn e2e_kill_sessions_aborts_transaction_and_closes_cursors() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("txn_kill_{}", rand_suffix(6));
+    let lsid = create_lsid();
+
+    let docs: Vec<bson::Document> = (0..5).map(|i| doc! {"_id": i, "v": i}).collect();
+    let ins = doc! {"insert": "test", "documents": docs, "$db": &dbname};
+    stream.write_all(&encode_op_msg(&ins, 0, 1)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+
+    // open a cursor under the session
+    let find = doc! {"find": "test", "batchSize": 1i32, "lsid": lsid.clone(), "$db": &dbname};
+    stream.write_all(&encode_op_msg(&find, 0, 2)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor_id = doc.get_document("cursor").unwrap().get_i64("id").unwrap();
+    assert_ne!(cursor_id, 0);
+
+    // and an uncommitted write in a transaction
+    let start_txn = doc! {
+        "startTransaction": 1i32,
+        "lsid": lsid.clone(),
+        "txnNumber": 1i64,
+        "autocommit": false,
+        "$db": &dbname
+    };
+    stream
+        .write_all(&encode_op_msg(&start_txn, 0, 3))
+        .await
+        .unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+    let ins = doc! {
+        "insert": "test",
+        "documents": [{"_id": "tx1"}],
+        "lsid": lsid.clone(),
+        "txnNumber": 1i64,
+        "autocommit": false,
+        "$db": &dbname
+    };
+    stream.write_all(&encode_op_msg(&ins, 0, 4)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+
+    let kill = doc! {"killSessions": [lsid.clone()], "$db": "admin"};
+    stream.write_all(&encode_op_msg(&kill, 0, 5)).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", doc);
+
+    let uuid = if let Some(bson::Bson::Binary(binary)) = lsid.get("id") {
+        Uuid::from_slice(&binary.bytes).unwrap()
+    } else {
+        panic!("lsid.id is not a Binary");
+    };
+    assert!(!state.session_manager.has_session(uuid).await);
+
+    // the cursor is gone
+    let get_more = doc! {"getMore": cursor_id, "collection": "test", "$db": &dbname};
+    stream
+        .write_all(&encode_op_msg(&get_more, 0, 6))
+        .await
+        .unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let cursor = doc.get_document("cursor").unwrap();
+    assert_eq!(cursor.get_i64("id").unwrap(), 0);
+    assert!(cursor.get_array("nextBatch").unwrap().is_empty());
+
+    // the transaction's write was rolled back
+    let count = doc! {"find": "test", "filter": {"_id": "tx1"}, "$db": &dbname};
+    stream
+        .write_all(&encode_op_msg(&count, 0, 7))
+        .await
+        .unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let batch = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert!(batch.is_empty());
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,153 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+async fn ids(stream: &mut TcpStream, dbname: &str, req: i32) -> Vec<String> {
+    let find = doc! {"find": "events", "sort": {"_id": 1i32}, "$db": dbname};
+    let reply = run(stream, find, req).await;
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().get_str("_id").unwrap().to_string())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_coll_mod_changes_ttl_expiry() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.ttl_monitor_sleep_secs = Some(1);
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    let dbname = format!("ttl_{}", rand_suffix(6));
+
+    let create = doc! {
+        "createIndexes": "events",
+        "indexes": [
+            {"key": {"createdAt": 1i32}, "name": "createdAt_1", "expireAfterSeconds": 3600i32},
+            {"key": {"seenAt": 1i32}, "name": "seenAt_1"},
+        ],
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, create, 1).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+
+    let now = bson::DateTime::now().timestamp_millis();
+    let minutes_ago = |m: i64| bson::DateTime::from_millis(now - m * 60_000);
+    let docs = vec![
+        doc! {"_id": "old", "createdAt": minutes_ago(120)},
+        doc! {"_id": "recent", "createdAt": minutes_ago(10)},
+        doc! {"_id": "undated", "createdAt": "yesterday"},
+    ];
+    let ins = doc! {"insert": "events", "documents": docs, "$db": &dbname};
+    let reply = run(&mut stream, ins, 2).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 3, "{:?}", reply);
+
+    // An hour's expiry removes only the document from two hours ago
+    tokio::time::sleep(std::time::Duration::from_millis(2500)).await;
+    assert_eq!(
+        ids(&mut stream, &dbname, 11).await,
+        vec!["recent", "undated"]
+    );
+
+    // Down to a minute, the next pass removes the one from ten minutes ago as well
+    let coll_mod = doc! {
+        "collMod": "events",
+        "index": {"name": "createdAt_1", "expireAfterSeconds": 60i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, coll_mod, 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(reply.get_i64("expireAfterSeconds_old").unwrap(), 3600);
+    assert_eq!(reply.get_i64("expireAfterSeconds_new").unwrap(), 60);
+    tokio::time::sleep(std::time::Duration::from_millis(2500)).await;
+    assert_eq!(ids(&mut stream, &dbname, 12).await, vec!["undated"]);
+
+    let list = doc! {"listIndexes": "events", "$db": &dbname};
+    let reply = run(&mut stream, list, 4).await;
+    let specs = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    let created_at = specs
+        .iter()
+        .map(|s| s.as_document().unwrap())
+        .find(|s| s.get_str("name") == Ok("createdAt_1"))
+        .unwrap();
+    assert!(
+        matches!(
+            created_at.get("expireAfterSeconds"),
+            Some(bson::Bson::Int32(60) | bson::Bson::Int64(60))
+        ),
+        "{:?}",
+        created_at
+    );
+
+    // A plain index found by key pattern becomes a TTL index
+    let coll_mod = doc! {
+        "collMod": "events",
+        "index": {"keyPattern": {"seenAt": 1i32}, "expireAfterSeconds": 30i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, coll_mod, 5).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert!(!reply.contains_key("expireAfterSeconds_old"), "{:?}", reply);
+    assert_eq!(reply.get_i64("expireAfterSeconds_new").unwrap(), 30);
+
+    let coll_mod = doc! {
+        "collMod": "events",
+        "index": {"name": "missing_1", "expireAfterSeconds": 30i32},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, coll_mod, 6).await;
+    assert_eq!(reply.get_i32("code").unwrap(), 27, "{:?}", reply);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
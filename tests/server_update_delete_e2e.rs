@@ -209,3 +209,206 @@ async fn e2e_update_nested_and_multi() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+#[tokio::test]
+async fn e2e_delete_limit_one_removes_exactly_one() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("del_one_{}", rand_suffix(6));
+
+    // Three matches and no index on `group`
+    let docs = vec![
+        doc! {"_id": "b", "group": "x"},
+        doc! {"_id": "c", "group": "x"},
+        doc! {"_id": "a", "group": "x"},
+        doc! {"_id": "d", "group": "y"},
+    ];
+    let ins = doc! {"insert": "u", "documents": docs, "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    let d_spec = doc! {"q": {"group": "x"}, "limit": 1i32};
+    let del = doc! {"delete": "u", "deletes": [d_spec], "$db": &dbname};
+    let msg = encode_op_msg(&del, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+    assert_eq!(doc.get_i32("n").unwrap_or(0), 1);
+
+    // The first match in `_id` order is the one removed
+    let find = doc! {"find": "u", "filter": {"group": "x"}, "sort": {"_id": 1}, "$db": &dbname};
+    let msg = encode_op_msg(&find, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let ids: Vec<&str> = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| d.as_document().unwrap().get_str("_id").unwrap())
+        .collect();
+    assert_eq!(ids, vec!["b", "c"]);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_update_many_counts_only_changed_documents() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("upd_many_{}", rand_suffix(6));
+
+    // More matches than one page of a multi-document update; every other one is already
+    // in the target state
+    let docs: Vec<bson::Document> = (0..2500)
+        .map(|i| {
+            doc! {
+                "_id": format!("k{:05}", i),
+                "kind": "job",
+                "status": if i % 2 == 0 { "done" } else { "open" },
+            }
+        })
+        .collect();
+    let ins = doc! {"insert": "jobs", "documents": docs, "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    assert_eq!(
+        read_one_op_msg(&mut stream).await.get_i32("n").unwrap(),
+        2500
+    );
+
+    let u_spec = doc! {"q": {"kind": "job"}, "u": {"$set": {"status": "done"}}, "multi": true};
+    let upd = doc! {"update": "jobs", "updates": [u_spec.clone()], "$db": &dbname};
+    let msg = encode_op_msg(&upd, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+    assert_eq!(doc.get_i32("n").unwrap(), 2500);
+    assert_eq!(doc.get_i32("nModified").unwrap(), 1250);
+
+    // Running it again changes nothing
+    let upd = doc! {"update": "jobs", "updates": [u_spec], "$db": &dbname};
+    let msg = encode_op_msg(&upd, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("n").unwrap(), 2500);
+    assert_eq!(doc.get_i32("nModified").unwrap(), 0);
+
+    // Without multi a single document is updated
+    let u_spec = doc! {"q": {"kind": "job"}, "u": {"$set": {"status": "archived"}}};
+    let upd = doc! {"update": "jobs", "updates": [u_spec], "$db": &dbname};
+    let msg = encode_op_msg(&upd, 0, 4);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("n").unwrap(), 1);
+    assert_eq!(doc.get_i32("nModified").unwrap(), 1);
+    let find = doc! {"find": "jobs", "filter": {"status": "archived"}, "$db": &dbname};
+    let msg = encode_op_msg(&find, 0, 5);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let batch = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 1);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_idempotent_updates_match_without_modifying() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("upd_idem_{}", rand_suffix(6));
+
+    let ins = doc! {
+        "insert": "items",
+        "documents": [{"_id": "a", "name": "widget", "qty": 5, "tags": ["x", "y"]}],
+        "$db": &dbname,
+    };
+    let msg = encode_op_msg(&ins, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    assert_eq!(read_one_op_msg(&mut stream).await.get_i32("n").unwrap(), 1);
+
+    // Each update matches the document; only the last two change what is stored
+    let cases = vec![
+        (doc! {"$set": {"name": "widget"}}, 0),
+        (doc! {"$unset": {"missing": ""}}, 0),
+        (doc! {"$inc": {"qty": 0}}, 0),
+        (doc! {"$pull": {"tags": "z"}}, 0),
+        (doc! {"$set": {"qty": 5_i64}}, 1),
+        (doc! {"$set": {"name": "gadget"}}, 1),
+    ];
+    for (i, (u, modified)) in cases.into_iter().enumerate() {
+        let upd = doc! {
+            "update": "items",
+            "updates": [{"q": {"_id": "a"}, "u": u.clone()}],
+            "$db": &dbname,
+        };
+        let msg = encode_op_msg(&upd, 0, 2 + i as i32);
+        stream.write_all(&msg).await.unwrap();
+        let doc = read_one_op_msg(&mut stream).await;
+        assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", u);
+        assert_eq!(doc.get_i32("n").unwrap(), 1, "{:?}", u);
+        assert_eq!(doc.get_i32("nModified").unwrap(), modified, "{:?}", u);
+    }
+
+    // The same holds across a multi-document update
+    let upd = doc! {
+        "update": "items",
+        "updates": [{"q": {}, "u": {"$set": {"name": "gadget"}}, "multi": true}],
+        "$db": &dbname,
+    };
+    let msg = encode_op_msg(&upd, 0, 20);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_i32("n").unwrap(), 1);
+    assert_eq!(doc.get_i32("nModified").unwrap(), 0);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
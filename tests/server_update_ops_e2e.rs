@@ -100,3 +100,205 @@ async fn e2e_update_inc_rename_push_pull() {
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
+
+#[tokio::test]
+async fn e2e_update_bit_toggles_flags() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("upd_bit_{}", rand_suffix(6));
+    let ins = doc! {"insert": "dev", "documents": [ {"_id": "d1", "flags": 0b0001i32, "mask": 1i64 << 40, "name": "x"} ], "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    // Set bit 2, clear bit 0, flip bit 3; set a high bit on a long
+    let upd = doc! {"update": "dev", "updates": [ {"q": {"_id": "d1"}, "u": {"$bit": {
+        "flags": {"or": 0b0100i32},
+        "mask": {"or": 1i64},
+    }}} ], "$db": &dbname};
+    let msg = encode_op_msg(&upd, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let r = read_one_op_msg(&mut stream).await;
+    assert_eq!(r.get_i32("nModified").unwrap(), 1);
+    let upd = doc! {"update": "dev", "updates": [ {"q": {"_id": "d1"}, "u": {"$bit": {"flags": {"and": !0b0001i32, "xor": 0b1000i32}}}} ], "$db": &dbname};
+    let msg = encode_op_msg(&upd, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    let find = doc! {"find": "dev", "filter": {"_id": "d1"}, "$db": &dbname};
+    let msg = encode_op_msg(&find, 0, 4);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let d = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()[0]
+        .as_document()
+        .unwrap()
+        .clone();
+    assert_eq!(d.get_i32("flags").unwrap(), 0b1100);
+    assert_eq!(d.get_i64("mask").unwrap(), (1i64 << 40) | 1);
+
+    // $bit on a string field is rejected
+    let upd = doc! {"update": "dev", "updates": [ {"q": {"_id": "d1"}, "u": {"$bit": {"name": {"or": 1i32}}}} ], "$db": &dbname};
+    let msg = encode_op_msg(&upd, 0, 5);
+    stream.write_all(&msg).await.unwrap();
+    let r = read_one_op_msg(&mut stream).await;
+    assert_eq!(r.get_f64("ok").unwrap_or(0.0), 1.0);
+    let we = r.get_array("writeErrors").unwrap()[0]
+        .as_document()
+        .unwrap();
+    assert_eq!(we.get_i32("code").unwrap_or(0), 2);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_update_current_date_with_set_and_inc() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("upd_date_{}", rand_suffix(6));
+    let ins = doc! {"insert": "u", "documents": [ {"_id": "x", "n": 1i32} ], "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    let before = bson::DateTime::now();
+    let upd = doc! {"update": "u", "updates": [ {"q": {"_id": "x"}, "u": {
+        "$set": {"status": "seen"},
+        "$inc": {"n": 1i32},
+        "$currentDate": {
+            "updatedAt": true,
+            "audit.at": {"$type": "date"},
+            "audit.ts": {"$type": "timestamp"},
+        },
+    }} ], "$db": &dbname};
+    let msg = encode_op_msg(&upd, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let r = read_one_op_msg(&mut stream).await;
+    assert_eq!(r.get_i32("nModified").unwrap(), 1);
+
+    let find = doc! {"find": "u", "filter": {"_id": "x"}, "$db": &dbname};
+    let msg = encode_op_msg(&find, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let d = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()[0]
+        .as_document()
+        .unwrap()
+        .clone();
+    assert_eq!(d.get_str("status").unwrap(), "seen");
+    assert_eq!(d.get_i32("n").unwrap(), 2);
+    let updated_at = *d.get_datetime("updatedAt").unwrap();
+    assert!(updated_at.timestamp_millis() >= before.timestamp_millis());
+    let audit = d.get_document("audit").unwrap();
+    assert_eq!(*audit.get_datetime("at").unwrap(), updated_at);
+    let ts = audit.get_timestamp("ts").unwrap();
+    assert_eq!(ts.time as i64, updated_at.timestamp_millis() / 1000);
+
+    let upd = doc! {"update": "u", "updates": [ {"q": {"_id": "x"}, "u": {"$currentDate": {"t": {"$type": "clock"}}}} ], "$db": &dbname};
+    let msg = encode_op_msg(&upd, 0, 4);
+    stream.write_all(&msg).await.unwrap();
+    let r = read_one_op_msg(&mut stream).await;
+    assert_eq!(r.get_f64("ok").unwrap_or(0.0), 1.0);
+    let we = r.get_array("writeErrors").unwrap()[0]
+        .as_document()
+        .unwrap();
+    assert_eq!(we.get_i32("code").unwrap_or(0), 2);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_update_with_pipeline() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("upd_pipe_{}", rand_suffix(6));
+    let ins = doc! {"insert": "u", "documents": [
+        {"_id": 1i32, "price": 10i32, "qty": 3i32, "tmp": true},
+        {"_id": 2i32, "profile": {"name": "ada", "lang": "en"}},
+    ], "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    let upd = doc! {"update": "u", "updates": [
+        {"q": {"_id": 1i32}, "u": [
+            {"$set": {"total": {"$multiply": ["$price", "$qty"]}}},
+            {"$unset": "tmp"},
+        ]},
+        {"q": {"_id": 2i32}, "u": [ {"$replaceRoot": {"newRoot": "$profile"}} ]},
+    ], "$db": &dbname};
+    let msg = encode_op_msg(&upd, 0, 2);
+    stream.write_all(&msg).await.unwrap();
+    let r = read_one_op_msg(&mut stream).await;
+    assert_eq!(r.get_i32("nModified").unwrap(), 2);
+
+    let find = doc! {"find": "u", "filter": {}, "sort": {"_id": 1i32}, "$db": &dbname};
+    let msg = encode_op_msg(&find, 0, 3);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    let batch = doc
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .clone();
+    let first = batch[0].as_document().unwrap();
+    assert_eq!(first.get_i32("total").unwrap(), 30);
+    assert!(!first.contains_key("tmp"));
+    let second = batch[1].as_document().unwrap();
+    assert_eq!(second, &doc! {"_id": 2i32, "name": "ada", "lang": "en"});
+
+    let upd = doc! {"update": "u", "updates": [ {"q": {"_id": 1i32}, "u": [ {"$group": {"_id": null}} ]} ], "$db": &dbname};
+    let msg = encode_op_msg(&upd, 0, 4);
+    stream.write_all(&msg).await.unwrap();
+    let r = read_one_op_msg(&mut stream).await;
+    assert_eq!(r.get_f64("ok").unwrap_or(0.0), 1.0);
+    let we = r.get_array("writeErrors").unwrap()[0]
+        .as_document()
+        .unwrap();
+    assert_eq!(we.get_i32("code").unwrap_or(0), 72);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
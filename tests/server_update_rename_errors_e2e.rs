@@ -78,6 +78,31 @@ async fn e2e_rename_collision_errors() {
     assert_eq!(doc.get_f64("ok").unwrap_or(1.0), 0.0);
     assert_eq!(doc.get_i32("code").unwrap_or(0), 2);
 
+    // Path traversing an array
+    let ins =
+        doc! {"insert": "u", "documents": [ {"_id":"arr", "list": [{"v": 1}]} ], "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 6);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+    let upd = doc! {"update": "u", "updates": [ {"q": {"_id":"arr"}, "u": {"$rename": {"list.0.v": "v"}} } ], "$db": &dbname};
+    let msg = encode_op_msg(&upd, 0, 7);
+    stream.write_all(&msg).await.unwrap();
+    // The document itself rejects the rename, so it is a write error
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap_or(0.0), 1.0);
+    assert_eq!(doc.get_i32("nModified").unwrap(), 0);
+    let we = doc.get_array("writeErrors").unwrap()[0]
+        .as_document()
+        .unwrap()
+        .clone();
+    assert_eq!(we.get_i32("index").unwrap(), 0);
+    assert_eq!(we.get_i32("code").unwrap_or(0), 2);
+    assert!(
+        we.get_str("errmsg")
+            .unwrap_or("")
+            .contains("cannot use the part")
+    );
+
     let _ = shutdown.send(true);
     let _ = handle.await.unwrap();
 }
@@ -0,0 +1,182 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::scram::ScramAuth;
+use oxidedb::server::spawn_with_shutdown;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn code(reply: &bson::Document) -> i32 {
+    reply.get_i32("code").unwrap_or(0)
+}
+
+async fn login(addr: std::net::SocketAddr, user: &str, pwd: &str, db: &str) -> TcpStream {
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+    ScramAuth::new(user.into(), pwd.into(), db.into())
+        .authenticate(&mut stream, 5000)
+        .await
+        .unwrap();
+    stream
+}
+
+fn insert(id: i32) -> bson::Document {
+    doc! {"insert": "c", "documents": [{"_id": id}], "$db": "app"}
+}
+
+/// Start a server with authorization and a root user, returning it and the root user's
+/// connection.
+async fn start(
+    testdb: &pg::TestDb,
+    refresh_user_roles: bool,
+) -> (
+    std::net::SocketAddr,
+    tokio::sync::watch::Sender<bool>,
+    tokio::task::JoinHandle<oxidedb::error::Result<()>>,
+    TcpStream,
+) {
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.authorization_enabled = Some(true);
+    cfg.refresh_user_roles = Some(refresh_user_roles);
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut root = TcpStream::connect(addr).await.unwrap();
+    let create = doc! {"createUser": "root", "pwd": "root-pw", "roles": ["root"], "$db": "admin"};
+    let reply = run(&mut root, create, 1).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    ScramAuth::new("root".into(), "root-pw".into(), "admin".into())
+        .authenticate(&mut root, 5000)
+        .await
+        .unwrap();
+    (addr, shutdown, handle, root)
+}
+
+#[tokio::test]
+async fn e2e_granted_and_revoked_roles_apply_to_new_connections() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let (addr, shutdown, handle, mut root) = start(&testdb, false).await;
+    let create = doc! {"createUser": "ann", "pwd": "ann-pw", "roles": ["read"], "$db": "app"};
+    let reply = run(&mut root, create, 2).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+
+    let mut before = login(addr, "ann", "ann-pw", "app").await;
+    assert_eq!(code(&run(&mut before, insert(1), 3).await), 13);
+
+    // Granting reports the new role list; granting a held role changes nothing
+    let grant = doc! {"grantRolesToUser": "ann", "roles": ["readWrite", "read"], "$db": "app"};
+    let reply = run(&mut root, grant, 4).await;
+    assert_eq!(
+        reply.get_array("roles").unwrap(),
+        &vec![
+            bson::Bson::Document(doc! {"role": "read", "db": "app"}),
+            bson::Bson::Document(doc! {"role": "readWrite", "db": "app"}),
+        ],
+        "{:?}",
+        reply
+    );
+    let mut granted = login(addr, "ann", "ann-pw", "app").await;
+    let reply = run(&mut granted, insert(1), 5).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 1, "{:?}", reply);
+    // A connection authenticated earlier keeps the roles it had
+    assert_eq!(code(&run(&mut before, insert(2), 6).await), 13);
+
+    let revoke = doc! {"revokeRolesFromUser": "ann", "roles": ["readWrite"], "$db": "app"};
+    let reply = run(&mut root, revoke, 7).await;
+    assert_eq!(
+        reply.get_array("roles").unwrap(),
+        &vec![bson::Bson::Document(doc! {"role": "read", "db": "app"})]
+    );
+    let mut revoked = login(addr, "ann", "ann-pw", "app").await;
+    assert_eq!(code(&run(&mut revoked, insert(2), 8).await), 13);
+    let reply = run(&mut revoked, doc! {"find": "c", "$db": "app"}, 9).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+
+    // Unknown roles and users are reported
+    let grant = doc! {"grantRolesToUser": "ann", "roles": ["owner"], "$db": "app"};
+    assert_eq!(code(&run(&mut root, grant, 10).await), 31);
+    let grant = doc! {"grantRolesToUser": "nobody", "roles": ["read"], "$db": "app"};
+    assert_eq!(code(&run(&mut root, grant, 11).await), 11);
+
+    // dropAllUsersFromDatabase counts the users it removed, and only those of its database
+    let create = doc! {"createUser": "bob", "pwd": "bob-pw", "roles": [], "$db": "app"};
+    run(&mut root, create, 12).await;
+    let reply = run(
+        &mut root,
+        doc! {"dropAllUsersFromDatabase": 1i32, "$db": "app"},
+        13,
+    )
+    .await;
+    assert_eq!(reply.get_i32("n").unwrap(), 2, "{:?}", reply);
+    let reply = run(&mut root, doc! {"usersInfo": 1i32, "$db": "admin"}, 14).await;
+    assert_eq!(reply.get_array("users").unwrap().len(), 1, "{:?}", reply);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_refresh_user_roles_updates_open_connections() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let (addr, shutdown, handle, mut root) = start(&testdb, true).await;
+    let create = doc! {"createUser": "ann", "pwd": "ann-pw", "roles": ["read"], "$db": "app"};
+    run(&mut root, create, 2).await;
+    let mut ann = login(addr, "ann", "ann-pw", "app").await;
+    assert_eq!(code(&run(&mut ann, insert(1), 3).await), 13);
+
+    let grant = doc! {"grantRolesToUser": "ann", "roles": ["readWrite"], "$db": "app"};
+    run(&mut root, grant, 4).await;
+    let reply = run(&mut ann, insert(1), 5).await;
+    assert_eq!(reply.get_i32("n").unwrap(), 1, "{:?}", reply);
+
+    let revoke = doc! {"revokeRolesFromUser": "ann", "roles": ["readWrite"], "$db": "app"};
+    run(&mut root, revoke, 6).await;
+    assert_eq!(code(&run(&mut ann, insert(2), 7).await), 13);
+
+    // A dropped user's connections are no longer authenticated
+    run(&mut root, doc! {"dropUser": "ann", "$db": "app"}, 8).await;
+    let reply = run(&mut ann, doc! {"find": "c", "$db": "app"}, 9).await;
+    assert_eq!(code(&reply), 13, "{:?}", reply);
+    assert!(
+        reply
+            .get_str("errmsg")
+            .unwrap()
+            .contains("requires authentication")
+    );
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,164 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn user_names(reply: &bson::Document) -> Vec<String> {
+    reply
+        .get_array("users")
+        .unwrap()
+        .iter()
+        .map(|u| u.as_document().unwrap().get_str("_id").unwrap().to_string())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_users_info_reports_users_without_credentials() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    // Users are managed without authorization enabled
+    let create = doc! {
+        "createUser": "ann",
+        "pwd": "ann-pw",
+        "roles": ["readWrite", {"role": "read", "db": "reports"}],
+        "customData": {"team": "billing"},
+        "$db": "app",
+    };
+    let reply = run(&mut stream, create, 1).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let create = doc! {"createUser": "bob", "pwd": "bob-pw", "roles": [], "$db": "app"};
+    let reply = run(&mut stream, create, 2).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let create = doc! {"createUser": "ops", "pwd": "ops-pw", "roles": ["root"], "$db": "admin"};
+    let reply = run(&mut stream, create, 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+
+    // Role documents and mechanisms are validated
+    for (i, (cmd, code)) in [
+        (
+            doc! {"createUser": "x", "pwd": "p", "roles": [{"role": "read"}], "$db": "app"},
+            2,
+        ),
+        (
+            doc! {"createUser": "x", "pwd": "p", "roles": [{"role": "read", "db": "app", "x": 1}], "$db": "app"},
+            2,
+        ),
+        (
+            doc! {"createUser": "x", "pwd": "p", "roles": ["readAnyDatabase"], "$db": "app"},
+            31,
+        ),
+        (
+            doc! {"createUser": "x", "pwd": "p", "roles": [], "mechanisms": ["SCRAM-SHA-1"], "$db": "app"},
+            2,
+        ),
+        (doc! {"createUser": "x", "roles": [], "$db": "app"}, 2),
+    ]
+    .into_iter()
+    .enumerate()
+    {
+        let reply = run(&mut stream, cmd, 10 + i as i32).await;
+        assert_eq!(reply.get_i32("code").unwrap(), code, "{:?}", reply);
+    }
+
+    // One user, by name: roles and mechanisms, no credentials
+    let reply = run(&mut stream, doc! {"usersInfo": "ann", "$db": "app"}, 20).await;
+    let users = reply.get_array("users").unwrap();
+    assert_eq!(users.len(), 1, "{:?}", reply);
+    let ann = users[0].as_document().unwrap();
+    assert_eq!(ann.get_str("user").unwrap(), "ann");
+    assert_eq!(ann.get_str("db").unwrap(), "app");
+    assert_eq!(
+        ann.get_array("roles").unwrap(),
+        &vec![
+            bson::Bson::Document(doc! {"role": "readWrite", "db": "app"}),
+            bson::Bson::Document(doc! {"role": "read", "db": "reports"}),
+        ]
+    );
+    assert_eq!(
+        ann.get_array("mechanisms").unwrap(),
+        &vec![bson::Bson::String("SCRAM-SHA-256".into())]
+    );
+    assert_eq!(
+        ann.get_document("customData").unwrap(),
+        &doc! {"team": "billing"}
+    );
+    assert!(!ann.contains_key("credentials"));
+
+    // showCredentials includes the stored keys, never the password
+    let cmd =
+        doc! {"usersInfo": {"user": "ann", "db": "app"}, "showCredentials": true, "$db": "app"};
+    let reply = run(&mut stream, cmd, 21).await;
+    let ann = reply.get_array("users").unwrap()[0].as_document().unwrap();
+    let scram = ann
+        .get_document("credentials")
+        .unwrap()
+        .get_document("SCRAM-SHA-256")
+        .unwrap();
+    assert_eq!(scram.get_i32("iterationCount").unwrap(), 15000);
+    assert!(scram.contains_key("storedKey") && scram.contains_key("serverKey"));
+    assert!(!format!("{:?}", ann).contains("ann-pw"));
+
+    // Every user of the database, of a list, and of every database
+    let reply = run(&mut stream, doc! {"usersInfo": 1i32, "$db": "app"}, 22).await;
+    assert_eq!(user_names(&reply), vec!["app.ann", "app.bob"]);
+    let cmd = doc! {"usersInfo": ["bob", {"user": "ops", "db": "admin"}, "nobody"], "$db": "app"};
+    let reply = run(&mut stream, cmd, 23).await;
+    assert_eq!(user_names(&reply), vec!["admin.ops", "app.bob"]);
+    let cmd =
+        doc! {"usersInfo": {"forAllDBs": true}, "filter": {"user": {"$ne": "bob"}}, "$db": "admin"};
+    let reply = run(&mut stream, cmd, 24).await;
+    assert_eq!(user_names(&reply), vec!["admin.ops", "app.ann"]);
+
+    // Changes show up in usersInfo
+    let cmd = doc! {"updateUser": "bob", "roles": ["dbAdmin"], "$db": "app"};
+    let reply = run(&mut stream, cmd, 25).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let reply = run(&mut stream, doc! {"usersInfo": "bob", "$db": "app"}, 26).await;
+    let bob = reply.get_array("users").unwrap()[0].as_document().unwrap();
+    assert_eq!(
+        bob.get_array("roles").unwrap(),
+        &vec![bson::Bson::Document(doc! {"role": "dbAdmin", "db": "app"})]
+    );
+    let reply = run(&mut stream, doc! {"dropUser": "bob", "$db": "app"}, 27).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let reply = run(&mut stream, doc! {"usersInfo": "bob", "$db": "app"}, 28).await;
+    assert!(reply.get_array("users").unwrap().is_empty());
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
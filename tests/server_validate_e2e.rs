@@ -0,0 +1,75 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+#[tokio::test]
+async fn e2e_validate_collection() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("validate_{}", rand_suffix(6));
+    let ins = doc! {"insert": "items", "documents": [ {"_id": 1i32, "a": 1i32}, {"_id": 2i32}, {"_id": 3i32} ], "$db": &dbname};
+    let msg = encode_op_msg(&ins, 0, 1);
+    stream.write_all(&msg).await.unwrap();
+    let _ = read_one_op_msg(&mut stream).await;
+
+    for (i, full) in [false, true].into_iter().enumerate() {
+        let validate = doc! {"validate": "items", "full": full, "$db": &dbname};
+        let msg = encode_op_msg(&validate, 0, 2 + i as i32);
+        stream.write_all(&msg).await.unwrap();
+        let doc = read_one_op_msg(&mut stream).await;
+        assert_eq!(doc.get_f64("ok").unwrap(), 1.0);
+        assert!(doc.get_bool("valid").unwrap());
+        assert_eq!(doc.get_i64("nrecords").unwrap(), 3);
+        assert_eq!(doc.get_i64("nInvalidDocuments").unwrap(), 0);
+        assert!(doc.get_array("errors").unwrap().is_empty());
+        assert_eq!(doc.get_str("ns").unwrap(), format!("{}.items", dbname));
+    }
+
+    // Unknown collection
+    let validate = doc! {"validate": "missing", "$db": &dbname};
+    let msg = encode_op_msg(&validate, 0, 10);
+    stream.write_all(&msg).await.unwrap();
+    let doc = read_one_op_msg(&mut stream).await;
+    assert_eq!(doc.get_f64("ok").unwrap(), 0.0);
+    assert_eq!(doc.get_i32("code").unwrap(), 26);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,172 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, request_id: i32) -> bson::Document {
+    let msg = encode_op_msg(&cmd, 0, request_id);
+    stream.write_all(&msg).await.unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn names(reply: &bson::Document) -> Vec<String> {
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .map(|d| {
+            d.as_document()
+                .unwrap()
+                .get_str("name")
+                .unwrap()
+                .to_string()
+        })
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_view_reads_through_pipeline_and_rejects_writes() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("views_{}", rand_suffix(6));
+    let ins = doc! {
+        "insert": "people",
+        "documents": [
+            {"_id": 1, "name": "ann", "age": 17, "city": "Oslo"},
+            {"_id": 2, "name": "bob", "age": 34, "city": "Rome"},
+            {"_id": 3, "name": "cy", "age": 52, "city": "Oslo"},
+            {"_id": 4, "name": "dee", "age": 29, "city": "Oslo"},
+        ],
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, ins, 1).await;
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+
+    let create = doc! {
+        "create": "adults",
+        "viewOn": "people",
+        "pipeline": [
+            {"$match": {"age": {"$gte": 18}}},
+            {"$project": {"name": 1, "age": 1, "city": 1}},
+        ],
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, create.clone(), 2).await;
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    let reply = run(&mut stream, create, 3).await;
+    assert_eq!(reply.get_i32("code").unwrap(), 48, "{:?}", reply);
+
+    // find applies its filter, sort and limit on top of the view's pipeline
+    let find = doc! {
+        "find": "adults",
+        "filter": {"city": "Oslo"},
+        "sort": {"age": 1},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, find, 4).await;
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    assert_eq!(names(&reply), vec!["dee", "cy"]);
+    assert_eq!(
+        reply.get_document("cursor").unwrap().get_str("ns").unwrap(),
+        format!("{}.adults", dbname)
+    );
+
+    // A view over a view stacks both pipelines
+    let create = doc! {
+        "create": "oslo_adults",
+        "viewOn": "adults",
+        "pipeline": [{"$match": {"city": "Oslo"}}],
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, create, 5).await;
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    let agg = doc! {
+        "aggregate": "oslo_adults",
+        "pipeline": [{"$sort": {"age": -1}}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, agg, 6).await;
+    assert_eq!(reply.get_f64("ok").unwrap_or(0.0), 1.0, "{:?}", reply);
+    assert_eq!(names(&reply), vec!["cy", "dee"]);
+
+    // Views are read-only
+    let writes = [
+        doc! {"insert": "adults", "documents": [{"name": "eve", "age": 40}], "$db": &dbname},
+        doc! {"update": "adults", "updates": [{"q": {}, "u": {"$set": {"age": 1}}}], "$db": &dbname},
+        doc! {"delete": "adults", "deletes": [{"q": {}, "limit": 0}], "$db": &dbname},
+        doc! {"createIndexes": "adults", "indexes": [{"key": {"age": 1}, "name": "age_1"}], "$db": &dbname},
+    ];
+    for (i, cmd) in writes.into_iter().enumerate() {
+        let reply = run(&mut stream, cmd, 10 + i as i32).await;
+        assert_eq!(reply.get_f64("ok").unwrap_or(1.0), 0.0, "{:?}", reply);
+        assert_eq!(reply.get_i32("code").unwrap(), 166, "{:?}", reply);
+    }
+
+    let list = doc! {"listCollections": 1, "filter": {"name": "adults"}, "$db": &dbname};
+    let reply = run(&mut stream, list, 20).await;
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert_eq!(batch.len(), 1);
+    let info = batch[0].as_document().unwrap();
+    assert_eq!(info.get_str("type").unwrap(), "view");
+    assert_eq!(
+        info.get_document("options")
+            .unwrap()
+            .get_str("viewOn")
+            .unwrap(),
+        "people"
+    );
+    assert!(
+        info.get_document("info")
+            .unwrap()
+            .get_bool("readOnly")
+            .unwrap()
+    );
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
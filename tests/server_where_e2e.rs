@@ -0,0 +1,174 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn first_batch(reply: &bson::Document) -> Vec<bson::Document> {
+    reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap()
+        .iter()
+        .filter_map(|b| b.as_document().cloned())
+        .collect()
+}
+
+#[tokio::test]
+async fn e2e_where_filters_documents_in_process() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.javascript_enabled = Some(true);
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("where_{}", rand_suffix(6));
+    let ins = doc! {
+        "insert": "accounts",
+        "documents": [
+            {"name": "ada", "credits": 10i32, "debits": 3i32, "status": "active"},
+            {"name": "bob", "credits": 2i32, "debits": 5i32, "status": "active"},
+            {"name": "cyd", "credits": 9i32, "debits": 1i32, "status": "closed"},
+        ],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, ins, 1).await.get_i32("n").unwrap(), 3);
+
+    // Function form, narrowed by a sibling condition, projected afterwards
+    let find = doc! {
+        "find": "accounts",
+        "filter": {
+            "status": "active",
+            "$where": bson::Bson::JavaScriptCode(
+                "function () { return this.credits > obj.debits; }".into(),
+            ),
+        },
+        "projection": {"name": 1i32, "_id": 0i32},
+        "$db": &dbname,
+    };
+    let docs = first_batch(&run(&mut stream, find, 2).await);
+    assert_eq!(docs.len(), 1, "{:?}", docs);
+    assert_eq!(docs[0].get_str("name").unwrap(), "ada");
+    assert!(!docs[0].contains_key("credits"));
+
+    // Bare expression string with sort and limit
+    let find = doc! {
+        "find": "accounts",
+        "filter": {"$where": "this.credits - this.debits > 0"},
+        "sort": {"name": -1i32},
+        "limit": 1i32,
+        "$db": &dbname,
+    };
+    let docs = first_batch(&run(&mut stream, find, 3).await);
+    assert_eq!(docs.len(), 1);
+    assert_eq!(docs[0].get_str("name").unwrap(), "cyd");
+
+    // Compile and runtime errors
+    let find = doc! {"find": "accounts", "filter": {"$where": "while (true) {}"}, "$db": &dbname};
+    let r = run(&mut stream, find, 4).await;
+    assert_eq!(r.get_i32("code").unwrap(), 139, "{:?}", r);
+    let find = doc! {"find": "accounts", "filter": {"$where": "this.nope.x"}, "$db": &dbname};
+    let r = run(&mut stream, find, 5).await;
+    assert_eq!(r.get_i32("code").unwrap(), 139, "{:?}", r);
+
+    // Writes would otherwise ignore the predicate and hit every document
+    let del = doc! {
+        "delete": "accounts",
+        "deletes": [{"q": {"$where": "false"}, "limit": 0i32}],
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, del, 6).await;
+    assert_eq!(r.get_i32("code").unwrap(), 2, "{:?}", r);
+    let find = doc! {"find": "accounts", "filter": {}, "$db": &dbname};
+    assert_eq!(first_batch(&run(&mut stream, find, 7).await).len(), 3);
+
+    // Only a top-level $where is evaluated; nested or in $match it is refused
+    let find = doc! {
+        "find": "accounts",
+        "filter": {"$or": [{"name": "ada"}, {"$where": "true"}]},
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, find, 8).await;
+    assert_eq!(r.get_i32("code").unwrap(), 2, "{:?}", r);
+    let agg = doc! {
+        "aggregate": "accounts",
+        "pipeline": [{"$match": {"$and": [{"$where": "true"}]}}],
+        "cursor": {},
+        "$db": &dbname,
+    };
+    let r = run(&mut stream, agg, 9).await;
+    assert_eq!(r.get_f64("ok").unwrap(), 0.0, "{:?}", r);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[tokio::test]
+async fn e2e_where_can_be_disabled() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.javascript_enabled = Some(false);
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let find = doc! {
+        "find": "accounts",
+        "filter": {"$where": "true"},
+        "$db": format!("where_off_{}", rand_suffix(6)),
+    };
+    let r = run(&mut stream, find, 1).await;
+    assert_eq!(r.get_f64("ok").unwrap(), 0.0);
+    assert_eq!(r.get_i32("code").unwrap(), 2);
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
@@ -0,0 +1,159 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use rand::{Rng, distributions::Alphanumeric};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+fn rand_suffix(n: usize) -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(n)
+        .map(char::from)
+        .collect()
+}
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+fn winning_plan(reply: &bson::Document) -> bson::Document {
+    reply
+        .get_document("queryPlanner")
+        .unwrap()
+        .get_document("winningPlan")
+        .unwrap()
+        .clone()
+}
+
+#[tokio::test]
+async fn e2e_update_and_delete_honour_hint() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    let (state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let dbname = format!("hint_{}", rand_suffix(6));
+    let docs: Vec<bson::Document> = (0..5000)
+        .map(|i| doc! {"name": format!("item-{:05}", i), "qty": i})
+        .collect();
+    let ins = doc! {"insert": "items", "documents": docs, "$db": &dbname};
+    assert_eq!(run(&mut stream, ins, 1).await.get_f64("ok").unwrap(), 1.0);
+    let idx = doc! {
+        "createIndexes": "items",
+        "indexes": [{"name": "name_1", "key": {"name": 1i32}}],
+        "$db": &dbname,
+    };
+    assert_eq!(run(&mut stream, idx, 2).await.get_f64("ok").unwrap(), 1.0);
+    let client = state.store.as_ref().unwrap().pool().get().await.unwrap();
+    client
+        .batch_execute(&format!("ANALYZE \"mdb_{}\".\"items\"", dbname))
+        .await
+        .unwrap();
+
+    // The prefix matches every document, so unhinted the planner scans the table
+    let statement = doc! {
+        "q": {"name": {"$regex": "^item-"}},
+        "u": {"$set": {"seen": true}},
+        "multi": true,
+    };
+    let explain = doc! {
+        "explain": {"update": "items", "updates": [statement.clone()]},
+        "$db": &dbname,
+    };
+    let plan = winning_plan(&run(&mut stream, explain, 3).await);
+    assert_eq!(plan.get_str("stage").unwrap(), "COLLSCAN", "{:?}", plan);
+
+    let mut hinted = statement.clone();
+    hinted.insert("hint", "name_1");
+    let explain = doc! {
+        "explain": {"update": "items", "updates": [hinted.clone()]},
+        "$db": &dbname,
+    };
+    let plan = winning_plan(&run(&mut stream, explain, 4).await);
+    assert_eq!(plan.get_str("stage").unwrap(), "IXSCAN", "{:?}", plan);
+    assert_eq!(plan.get_str("indexName").unwrap(), "name_1");
+
+    // A key pattern selects the same index
+    let mut by_key = statement.clone();
+    by_key.insert("hint", doc! {"name": 1.0});
+    let explain = doc! {
+        "explain": {"update": "items", "updates": [by_key]},
+        "$db": &dbname,
+    };
+    let plan = winning_plan(&run(&mut stream, explain, 5).await);
+    assert_eq!(plan.get_str("indexName").unwrap(), "name_1", "{:?}", plan);
+
+    let upd = doc! {"update": "items", "updates": [hinted], "$db": &dbname};
+    let reply = run(&mut stream, upd, 6).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(reply.get_i32("nModified").unwrap(), 5000);
+
+    let del = doc! {
+        "delete": "items",
+        "deletes": [{"q": {"name": {"$regex": "^item-000"}}, "limit": 0, "hint": {"name": 1}}],
+        "$db": &dbname,
+    };
+    let reply = run(&mut stream, del, 7).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(reply.get_i32("n").unwrap(), 100);
+
+    // Hints naming no index are rejected before anything is written
+    for (req, cmd) in [
+        doc! {
+            "update": "items",
+            "updates": [{"q": {}, "u": {"$set": {"x": 1}}, "multi": true, "hint": "nope_1"}],
+            "$db": &dbname,
+        },
+        doc! {
+            "delete": "items",
+            "deletes": [{"q": {}, "limit": 0, "hint": {"qty": 1}}],
+            "$db": &dbname,
+        },
+    ]
+    .into_iter()
+    .enumerate()
+    {
+        let reply = run(&mut stream, cmd, 8 + req as i32).await;
+        assert_eq!(reply.get_f64("ok").unwrap(), 0.0, "{:?}", reply);
+        assert_eq!(reply.get_i32("code").unwrap(), 2);
+    }
+    let find = doc! {"find": "items", "filter": {"x": 1}, "$db": &dbname};
+    let reply = run(&mut stream, find, 10).await;
+    let batch = reply
+        .get_document("cursor")
+        .unwrap()
+        .get_array("firstBatch")
+        .unwrap();
+    assert!(batch.is_empty());
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
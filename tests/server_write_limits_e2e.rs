@@ -0,0 +1,134 @@
+use bson::doc;
+use oxidedb::config::Config;
+use oxidedb::protocol::{MessageHeader, OP_MSG, decode_op_msg_section0, encode_op_msg};
+use oxidedb::server::spawn_with_shutdown;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+#[path = "common/postgres.rs"]
+mod pg;
+
+async fn read_one_op_msg(stream: &mut TcpStream) -> bson::Document {
+    let mut header = [0u8; 16];
+    stream.read_exact(&mut header).await.unwrap();
+    let (hdr, _) = MessageHeader::parse(&header).unwrap();
+    assert_eq!(hdr.op_code, OP_MSG);
+    let mut body = vec![0u8; (hdr.message_length as usize) - 16];
+    stream.read_exact(&mut body).await.unwrap();
+    let (_flags, doc) = decode_op_msg_section0(&body).unwrap();
+    doc
+}
+
+async fn run(stream: &mut TcpStream, cmd: bson::Document, req: i32) -> bson::Document {
+    stream
+        .write_all(&encode_op_msg(&cmd, 0, req))
+        .await
+        .unwrap();
+    read_one_op_msg(stream).await
+}
+
+#[tokio::test]
+async fn e2e_write_limits_throttle_and_reload() {
+    let testdb = match pg::TestDb::provision_from_env().await {
+        Some(db) => db,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mut cfg = Config::default();
+    cfg.listen_addr = "127.0.0.1:0".into();
+    cfg.postgres_url = Some(testdb.url.clone());
+    cfg.write_limits = Some([("wl.events".to_string(), 2.0)].into_iter().collect());
+    let (_state, addr, shutdown, handle) = spawn_with_shutdown(cfg).await.unwrap();
+    let mut stream = TcpStream::connect(addr).await.unwrap();
+
+    let insert = |n: i32| doc! {"insert": "events", "documents": [{"n": n}], "$db": "wl"};
+
+    // A burst up to the limit is admitted, the next write is refused as retryable
+    for n in 0..2 {
+        let reply = run(&mut stream, insert(n), 1 + n).await;
+        assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    }
+    let reply = run(&mut stream, insert(2), 3).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 0.0, "{:?}", reply);
+    assert_eq!(reply.get_i32("code").unwrap(), 46200);
+    assert_eq!(reply.get_str("codeName").unwrap(), "WriteRateLimitExceeded");
+    let labels = reply.get_array("errorLabels").unwrap();
+    assert_eq!(
+        labels,
+        &vec![bson::Bson::String("RetryableWriteError".into())]
+    );
+
+    // Other collections and reads are not limited
+    let reply = run(
+        &mut stream,
+        doc! {"insert": "other", "documents": [{}, {}, {}], "$db": "wl"},
+        4,
+    )
+    .await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let reply = run(&mut stream, doc! {"find": "events", "$db": "wl"}, 5).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+
+    // The metrics report the limit and the refused command
+    let reply = run(
+        &mut stream,
+        doc! {"oxidedbMetrics": 1i32, "$db": "admin"},
+        6,
+    )
+    .await;
+    let metrics = reply.get_str("metrics").unwrap();
+    assert!(
+        metrics.contains("oxidedb_write_limit_ops_per_second{namespace=\"wl.events\"} 2"),
+        "{}",
+        metrics
+    );
+    assert!(metrics.contains("oxidedb_write_ops_admitted_total{namespace=\"wl.events\"} 2"));
+    assert!(metrics.contains("oxidedb_write_commands_throttled_total{namespace=\"wl.events\"} 1"));
+
+    // Replacing the limits applies at once
+    let reply = run(
+        &mut stream,
+        doc! {"oxidedbSetWriteLimits": 1i32, "limits": {"wl": 1000}, "$db": "admin"},
+        7,
+    )
+    .await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    assert_eq!(reply.get_document("limits").unwrap(), &doc! {"wl": 1000.0});
+    let reply = run(&mut stream, insert(3), 8).await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 1.0, "{:?}", reply);
+    let reply = run(
+        &mut stream,
+        doc! {"oxidedbGetWriteLimits": 1i32, "$db": "admin"},
+        9,
+    )
+    .await;
+    assert_eq!(reply.get_document("limits").unwrap(), &doc! {"wl": 1000.0});
+
+    // Invalid limits are rejected and leave the current ones in place
+    let reply = run(
+        &mut stream,
+        doc! {"oxidedbSetWriteLimits": 1i32, "limits": {"wl": -1}, "$db": "admin"},
+        10,
+    )
+    .await;
+    assert_eq!(reply.get_f64("ok").unwrap(), 0.0, "{:?}", reply);
+    let reply = run(
+        &mut stream,
+        doc! {"oxidedbGetWriteLimits": 1i32, "$db": "admin"},
+        11,
+    )
+    .await;
+    assert_eq!(reply.get_document("limits").unwrap(), &doc! {"wl": 1000.0});
+
+    let _ = shutdown.send(true);
+    let _ = handle.await.unwrap();
+}
+
+#[test]
+fn invalid_limits_fail_startup() {
+    let mut cfg = Config::default();
+    cfg.write_limits = Some([("app".to_string(), 0.0)].into_iter().collect());
+    assert!(oxidedb::write_limits::limits_from_config(&cfg).is_err());
+}
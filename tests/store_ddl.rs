@@ -1,5 +1,6 @@
 mod common;
 use common::postgres::TestDb;
+use oxidedb::schema_map::{SchemaLayout, SchemaMapping};
 use oxidedb::store::PgStore;
 
 #[tokio::test]
@@ -41,3 +42,67 @@ async fn create_drop_collection_and_database_updates_metadata() {
     let dbs = store.list_databases().await.expect("list dbs");
     assert!(!dbs.iter().any(|d| d == "testdb"));
 }
+
+#[tokio::test]
+async fn single_schema_layout_prefixes_tables_in_shared_schema() {
+    let td = match TestDb::provision_from_env().await {
+        Some(v) => v,
+        None => {
+            eprintln!("skipping: set OXIDEDB_TEST_POSTGRES_URL");
+            return;
+        }
+    };
+    let mapping = SchemaMapping::new(SchemaLayout::SingleSchema, "mongo_", "shared_docs");
+    let store = PgStore::connect(&td.url)
+        .await
+        .expect("connect")
+        .with_schema_mapping(mapping);
+    store.bootstrap().await.expect("bootstrap");
+
+    for db in ["a", "b"] {
+        let doc = bson::doc! {"_id": 1i32, "db": db};
+        let id = bson::to_vec(&bson::doc! {"_id": 1i32}).unwrap();
+        let json = serde_json::to_value(&doc).unwrap();
+        store
+            .insert_one(db, "items", &id, &bson::to_vec(&doc).unwrap(), &json)
+            .await
+            .expect("insert");
+    }
+
+    let client = store.pool().get().await.expect("client");
+    let tables: Vec<String> = client
+        .query(
+            "SELECT tablename FROM pg_tables WHERE schemaname = 'shared_docs' ORDER BY tablename",
+            &[],
+        )
+        .await
+        .expect("pg_tables")
+        .iter()
+        .map(|r| r.get(0))
+        .collect();
+    assert_eq!(tables, vec!["mongo_a.items", "mongo_b.items"]);
+
+    // Logical names are unaffected by the layout
+    let dbs = store.list_databases().await.expect("list dbs");
+    assert_eq!(dbs, vec!["a", "b"]);
+    let cols = store.list_collections("a").await.expect("list colls");
+    assert_eq!(cols, vec!["items"]);
+
+    // Dropping one database leaves the shared schema and the other database's table
+    store.drop_database("a").await.expect("drop db");
+    let docs = store
+        .find_docs("b", "items", None, None, None, 10)
+        .await
+        .expect("find");
+    assert_eq!(docs.len(), 1);
+    assert_eq!(docs[0].get_str("db").unwrap(), "b");
+    let remaining: i64 = client
+        .query_one(
+            "SELECT count(*) FROM pg_tables WHERE schemaname = 'shared_docs'",
+            &[],
+        )
+        .await
+        .expect("count")
+        .get(0);
+    assert_eq!(remaining, 1);
+}